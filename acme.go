@@ -0,0 +1,371 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACMEConfig makes the relay serve HTTPS with certificates it obtains and
+// renews itself from Let's Encrypt or another ACME CA.
+type ACMEConfig struct {
+	Domains      []string `json:"domains"`       // host names certificates may be requested for
+	CacheDir     string   `json:"cache_dir"`     // account key and certificates, kept across restarts
+	Email        string   `json:"email"`         // contact the CA sends expiry and policy notices to
+	DirectoryURL string   `json:"directory_url"` // ACME directory; default Let's Encrypt production
+	HTTPListen   string   `json:"http_listen"`   // address answering http-01 challenges, e.g. ":80"; other requests are redirected to https
+}
+
+var acmeErrorsTotal = metrics.newCounterVec("relay_acme_errors_total",
+	"TLS handshakes that got no certificate from the ACME manager, by requested host.", "host")
+
+func validateACME(c *ACMEConfig) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Domains) == 0 {
+		return errors.New("acme.domains is required")
+	}
+	for _, d := range c.Domains {
+		if d == "" || strings.ContainsAny(d, "*/: ") {
+			return fmt.Errorf("acme: invalid domain %q; wildcards, ports and paths are not supported", d)
+		}
+	}
+	if c.CacheDir == "" {
+		return errors.New("acme.cache_dir is required, or every restart requests new certificates and runs into the CA's rate limits")
+	}
+	if c.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPListen); err != nil {
+			return fmt.Errorf("acme: invalid http_listen %q", c.HTTPListen)
+		}
+	}
+	return nil
+}
+
+// acmeRenewBefore is how long before expiry a certificate is renewed; the
+// CA's certificates last 90 days.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeManager obtains, caches and renews the certificates for the listed
+// domains. cache_dir holds the account key in acme_account+key and one file
+// per domain with the certificate key and chain.
+type acmeManager struct {
+	cfg     *ACMEConfig
+	domains map[string]*acmeDomain // only these names get certificates
+
+	mu     sync.Mutex  // serializes orders with the CA
+	client *acmeClient // registered account, set up on first use
+
+	tokens sync.Map // pending http-01 token → key authorization
+	alpn   sync.Map // host → pending tls-alpn-01 certificate
+}
+
+type acmeDomain struct {
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	renewing bool
+	retryAt  time.Time // no renewal attempt before this after a failure
+}
+
+// newACMEManager returns the certificate manager for c. Only the listed
+// domains get certificates, so a client cannot make the relay request one
+// for any name it sends in SNI.
+func newACMEManager(c *ACMEConfig) *acmeManager {
+	m := &acmeManager{cfg: c, domains: map[string]*acmeDomain{}}
+	for _, d := range c.Domains {
+		m.domains[strings.ToLower(d)] = &acmeDomain{}
+	}
+	return m
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		if cert, ok := m.alpn.Load(name); ok {
+			return cert.(*tls.Certificate), nil
+		}
+		return nil, fmt.Errorf("acme: no tls-alpn-01 challenge pending for %q", name)
+	}
+	d := m.domains[name]
+	if d == nil {
+		return nil, fmt.Errorf("acme: host %q is not in acme.domains", name)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cert == nil {
+		cert, err := m.loadCert(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logf(slog.LevelWarn, "ACME: ignoring cached certificate for '%s': %v", name, err)
+		}
+		d.cert = cert
+	}
+	now := time.Now()
+	if d.cert == nil || !now.Before(d.cert.Leaf.NotAfter) {
+		// not tied to the handshake: a client giving up must not abort the
+		// order the next handshake waits for
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		cert, err := m.issue(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		d.cert = cert
+	} else if d.cert.Leaf.NotAfter.Sub(now) < acmeRenewBefore && !d.renewing && now.After(d.retryAt) {
+		d.renewing = true
+		go m.renew(name, d)
+	}
+	return d.cert, nil
+}
+
+// renew replaces the certificate of d in the background; handshakes keep
+// getting the current one until the new one is issued.
+func (m *acmeManager) renew(name string, d *acmeDomain) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cert, err := m.issue(ctx, name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.renewing = false
+	if err != nil {
+		d.retryAt = time.Now().Add(time.Hour)
+		acmeErrorsTotal.Inc(name)
+		logf(slog.LevelWarn, "ACME: renewing certificate for '%s' failed, retrying in an hour: %v", name, err)
+		return
+	}
+	d.cert = cert
+}
+
+// issue orders a new certificate for name and caches it.
+func (m *acmeManager) issue(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return nil, err
+		}
+		c := newACMEClient(cmp.Or(m.cfg.DirectoryURL, letsEncryptURL), key)
+		if err := c.register(ctx, m.cfg.Email); err != nil {
+			return nil, err
+		}
+		m.client = c
+	}
+	// http-01 needs the challenge listener; without it the CA validates
+	// over the TLS port with tls-alpn-01
+	challenge := "tls-alpn-01"
+	if m.cfg.HTTPListen != "" {
+		challenge = "http-01"
+	}
+	chain, key, err := m.client.issue(ctx, name, challenge, func(ch acmeChallenge, keyAuth string) (func(), error) {
+		if ch.Type == "http-01" {
+			m.tokens.Store(ch.Token, keyAuth)
+			return func() { m.tokens.Delete(ch.Token) }, nil
+		}
+		cert, err := acmeALPNCert(name, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+		m.alpn.Store(name, cert)
+		return func() { m.alpn.Delete(name) }, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := acmeCertificate(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.saveCert(name, chain, key); err != nil {
+		logf(slog.LevelWarn, "ACME: caching certificate for '%s': %v", name, err)
+	}
+	logf(slog.LevelInfo, "ACME: obtained certificate for '%s', valid until %s", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+// accountKey loads the account key from the cache, creating it on first use.
+func (m *acmeManager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.cfg.CacheDir, "acme_account+key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: %s: no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.writeCache("acme_account+key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *acmeManager) loadCert(name string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(filepath.Join(m.cfg.CacheDir, name))
+	if err != nil {
+		return nil, err
+	}
+	var key *ecdsa.PrivateKey
+	var chain [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if key == nil || len(chain) == 0 {
+		return nil, errors.New("missing key or certificate")
+	}
+	cert, err := acmeCertificate(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf.VerifyHostname(name) != nil {
+		return nil, fmt.Errorf("certificate is not for %s", name)
+	}
+	return cert, nil
+}
+
+func (m *acmeManager) saveCert(name string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	return m.writeCache(name, data)
+}
+
+// writeCache replaces a cache file atomically; it holds private keys, so
+// only the relay's user may read it.
+func (m *acmeManager) writeCache(file string, data []byte) error {
+	if err := os.MkdirAll(m.cfg.CacheDir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(m.cfg.CacheDir, file+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(m.cfg.CacheDir, file))
+}
+
+func acmeCertificate(chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return nil, errors.New("acme: certificate does not match its key")
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// httpHandler answers http-01 challenges and redirects everything else to
+// https.
+func (m *acmeManager) httpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+			keyAuth, ok := m.tokens.Load(token)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = io.WriteString(w, keyAuth.(string))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+// acmeTLSConfig is the listener's TLS config: certificates come from m, and
+// tls-alpn-01 challenges are answered on the same port.
+func acmeTLSConfig(m *acmeManager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := m.getCertificate(hello)
+			if err != nil {
+				acmeErrorsTotal.Inc(hello.ServerName)
+				logf(slog.LevelWarn, "ACME: no certificate for '%s': %v", hello.ServerName, err)
+			}
+			return cert, err
+		},
+		NextProtos: []string{"h2", "http/1.1", acmeALPNProto},
+	}
+}
+
+// serveACMEChallenges answers http-01 challenges on addr until the returned
+// server is closed. During an upgrade the old process still holds addr
+// until it starts draining, so the address is retried until it is free.
+func serveACMEChallenges(addr string, m *acmeManager) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           m.httpHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		for logged := false; ; logged = true {
+			ln, err := net.Listen("tcp", addr)
+			if err == nil {
+				logf(slog.LevelInfo, "ACME: answering http-01 challenges on %s", ln.Addr())
+				err = srv.Serve(ln)
+				if !errors.Is(err, http.ErrServerClosed) {
+					logf(slog.LevelError, "ACME: challenge server on %s stopped: %v", addr, err)
+				}
+				return
+			}
+			if !logged {
+				logf(slog.LevelWarn, "ACME: cannot listen on %s yet, retrying: %v", addr, err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return srv
+}
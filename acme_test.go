@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCA is just enough of an ACME server to issue a certificate: it checks
+// every request's JWS signature, validates the challenge through the
+// manager under test and signs the CSR with its own root.
+type fakeCA struct {
+	t         *testing.T
+	srv       *httptest.Server
+	m         *acmeManager
+	challenge string
+	lifetime  time.Duration
+
+	mu      sync.Mutex
+	nonce   int
+	account *ecdsa.PublicKey
+	thumb   string
+	orders  int
+	valid   bool
+	cert    []byte
+
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+}
+
+func newFakeCA(t *testing.T, challenge string, lifetime time.Duration) *fakeCA {
+	ca := &fakeCA{t: t, challenge: challenge, lifetime: lifetime}
+	ca.rootKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake root"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.rootKey.PublicKey, ca.rootKey)
+	ca.root, _ = x509.ParseCertificate(der)
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	base := ca.srv.URL
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprint("n", ca.nonce))
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order"})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var msg struct{ Protected, Payload, Signature string }
+	_ = json.NewDecoder(r.Body).Decode(&msg)
+	hdr, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *acmeJWK
+	}
+	_ = json.Unmarshal(hdr, &protected)
+	if protected.URL != base+r.URL.Path || protected.Nonce == "" {
+		ca.t.Errorf("%s: protected header %s", r.URL.Path, hdr)
+	}
+	key := ca.account
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		jwk, _ := json.Marshal(protected.JWK)
+		sum := sha256.Sum256(jwk)
+		ca.account, ca.thumb = key, base64.RawURLEncoding.EncodeToString(sum[:])
+	} else if protected.Kid != base+"/account/1" {
+		ca.t.Errorf("%s: kid %q", r.URL.Path, protected.Kid)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(msg.Signature)
+	sum := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	if key == nil || len(sig) != 64 || !ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		ca.t.Errorf("%s: bad signature", r.URL.Path)
+		writeJSON(w, http.StatusUnauthorized, acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "bad signature"})
+		return
+	}
+
+	token := fmt.Sprint("token-", ca.orders)
+	order := func() map[string]any {
+		o := map[string]any{"status": "pending", "authorizations": []string{base + "/authz/1"}, "finalize": base + "/finalize/1"}
+		if ca.cert != nil {
+			o["status"], o["certificate"] = "valid", base+"/cert/1"
+		}
+		return o
+	}
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", base+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		ca.orders++
+		ca.valid, ca.cert = false, nil
+		w.Header().Set("Location", base+"/order/1")
+		writeJSON(w, http.StatusCreated, order())
+	case "/order/1":
+		writeJSON(w, http.StatusOK, order())
+	case "/authz/1":
+		status := "pending"
+		if ca.valid {
+			status = "valid"
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": status, "challenges": []map[string]string{
+			{"type": "http-01", "url": base + "/challenge/http", "token": token},
+			{"type": "tls-alpn-01", "url": base + "/challenge/alpn", "token": token},
+		}})
+	case "/challenge/http", "/challenge/alpn":
+		keyAuth := token + "." + ca.thumb
+		if ca.challenge == "http-01" {
+			rec := httptest.NewRecorder()
+			ca.m.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/acme-challenge/"+token, nil))
+			ca.valid = r.URL.Path == "/challenge/http" && rec.Body.String() == keyAuth
+		} else {
+			cert, err := ca.m.getCertificate(&tls.ClientHelloInfo{ServerName: "relay.example.com", SupportedProtos: []string{acmeALPNProto}})
+			if err == nil {
+				leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+				sum := sha256.Sum256([]byte(keyAuth))
+				want, _ := asn1.Marshal(sum[:])
+				for _, ext := range leaf.Extensions {
+					ca.valid = ca.valid || ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, want)
+				}
+			}
+			ca.valid = ca.valid && r.URL.Path == "/challenge/alpn"
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "processing"})
+	case "/finalize/1":
+		var req struct{ CSR string }
+		_ = json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if !ca.valid || err != nil || csr.CheckSignature() != nil {
+			writeJSON(w, http.StatusForbidden, acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "not authorized"})
+			return
+		}
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(int64(ca.orders + 1)), Subject: csr.Subject, DNSNames: csr.DNSNames,
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(ca.lifetime)}
+		ca.cert, _ = x509.CreateCertificate(rand.Reader, tmpl, ca.root, csr.PublicKey, ca.rootKey)
+		writeJSON(w, http.StatusOK, order())
+	case "/cert/1":
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeCA) orderCount() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.orders
+}
+
+func TestACMEManager(t *testing.T) {
+	for _, challenge := range []string{"http-01", "tls-alpn-01"} {
+		t.Run(challenge, func(t *testing.T) {
+			ca := newFakeCA(t, challenge, 80*24*time.Hour)
+			c := &ACMEConfig{Domains: []string{"relay.example.com"}, CacheDir: t.TempDir(), DirectoryURL: ca.srv.URL + "/directory"}
+			if challenge == "http-01" {
+				c.HTTPListen = ":80"
+			}
+			ca.m = newACMEManager(c)
+			cfg := acmeTLSConfig(ca.m)
+
+			cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "Relay.Example.com."})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cert.Leaf.DNSNames, []string{"relay.example.com"}) || len(cert.Certificate) != 2 {
+				t.Errorf("certificate for %v with %d certificates in the chain", cert.Leaf.DNSNames, len(cert.Certificate))
+			}
+			if again, _ := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "relay.example.com"}); again != cert {
+				t.Error("certificate not kept in memory")
+			}
+			// a restart reads the certificate back from cache_dir
+			ca.m = newACMEManager(c)
+			cached, err := acmeTLSConfig(ca.m).GetCertificate(&tls.ClientHelloInfo{ServerName: "relay.example.com"})
+			if err != nil || !bytes.Equal(cached.Certificate[0], cert.Certificate[0]) {
+				t.Errorf("cached certificate not used: %v", err)
+			}
+			if n := ca.orderCount(); n != 1 {
+				t.Errorf("%d orders", n)
+			}
+		})
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+	ca := newFakeCA(t, "http-01", 10*24*time.Hour) // inside the renewal window from the start
+	c := &ACMEConfig{Domains: []string{"relay.example.com"}, CacheDir: t.TempDir(), DirectoryURL: ca.srv.URL + "/directory", HTTPListen: ":80"}
+	ca.m = newACMEManager(c)
+	hello := &tls.ClientHelloInfo{ServerName: "relay.example.com"}
+	first, err := ca.m.getCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.mu.Lock()
+	ca.lifetime = 80 * 24 * time.Hour // the renewed one is not renewed again
+	ca.mu.Unlock()
+	// the next handshake still gets the current certificate and starts a renewal
+	if cert, _ := ca.m.getCertificate(hello); cert != first {
+		t.Error("handshake waited for the renewal")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if cert, _ := ca.m.getCertificate(hello); cert != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not renewed")
+		}
+	}
+}
+
+func TestACMEPolicy(t *testing.T) {
+	var contacted atomic.Bool
+	ca := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { contacted.Store(true) }))
+	defer ca.Close()
+	m := newACMEManager(&ACMEConfig{Domains: []string{"relay.example.com"}, CacheDir: t.TempDir(), DirectoryURL: ca.URL})
+	cfg := acmeTLSConfig(m)
+	if !slices.Contains(cfg.NextProtos, acmeALPNProto) {
+		t.Errorf("tls-alpn-01 not offered: %v", cfg.NextProtos)
+	}
+	// a name outside the allowlist fails without contacting the CA
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("certificate for an unlisted domain")
+	}
+	if got := acmeErrorsTotal.Value("other.example.com"); got != 1 {
+		t.Errorf("%v errors counted", got)
+	}
+	// so does a tls-alpn-01 handshake with no challenge pending
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "relay.example.com", SupportedProtos: []string{acmeALPNProto}}); err == nil {
+		t.Error("challenge certificate without a challenge")
+	}
+	if contacted.Load() {
+		t.Error("CA contacted")
+	}
+
+	rec := httptest.NewRecorder()
+	m.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "http://relay.example.com:80/v1/models?x=1", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || loc != "https://relay.example.com/v1/models?x=1" {
+		t.Errorf("redirect: %d %s", rec.Code, loc)
+	}
+	rec = httptest.NewRecorder()
+	m.httpHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/acme-challenge/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown token: %d", rec.Code)
+	}
+}
+
+func TestValidateACME(t *testing.T) {
+	for _, tt := range []struct {
+		c       ACMEConfig
+		wantErr string
+	}{
+		{ACMEConfig{Domains: []string{"relay.example.com"}, CacheDir: "/var/cache/relay", HTTPListen: ":80"}, ""},
+		{ACMEConfig{CacheDir: "/var/cache/relay"}, "domains is required"},
+		{ACMEConfig{Domains: []string{"*.example.com"}, CacheDir: "/var/cache/relay"}, "invalid domain"},
+		{ACMEConfig{Domains: []string{"relay.example.com:443"}, CacheDir: "/var/cache/relay"}, "invalid domain"},
+		{ACMEConfig{Domains: []string{"relay.example.com"}}, "cache_dir is required"},
+		{ACMEConfig{Domains: []string{"relay.example.com"}, CacheDir: "/var/cache/relay", HTTPListen: "80"}, "invalid http_listen"},
+	} {
+		err := validateACME(&tt.c)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: %v, want %q", tt.c, err, tt.wantErr)
+		}
+	}
+}
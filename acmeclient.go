@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A minimal ACME (RFC 8555) client for the relay's own certificates, so the
+// relay needs no ACME library. It registers an ECDSA P-256 account, orders a
+// certificate for one name, proves control of it with an http-01 or
+// tls-alpn-01 challenge and downloads the issued chain.
+
+const (
+	letsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeALPNProto  = "acme-tls/1" // ALPN protocol of tls-alpn-01 validation handshakes
+)
+
+// idPeACMEIdentifier is the certificate extension carrying the tls-alpn-01
+// key authorization digest (RFC 8737).
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey // account key
+	http         *http.Client
+
+	dir   acmeDirectory
+	kid   string // account URL, set by register
+	nonce string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem is an RFC 7807 problem document returned by the CA.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string { return fmt.Sprintf("acme: %s (%s)", p.Detail, p.Type) }
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeJWK is the account public key; the field order is the one RFC 7638
+// requires for the thumbprint.
+type acmeJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{directoryURL: directoryURL, key: key, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *acmeClient) jwk() acmeJWK {
+	pub, _ := c.key.ECDH()
+	p := pub.PublicKey().Bytes() // 0x04 || x || y
+	return acmeJWK{Crv: "P-256", Kty: "EC", X: b64(p[1:33]), Y: b64(p[33:])}
+}
+
+// keyAuthorization is what a challenge response proves the relay holds.
+func (c *acmeClient) keyAuthorization(token string) string {
+	jwk, _ := json.Marshal(c.jwk())
+	sum := sha256.Sum256(jwk)
+	return token + "." + b64(sum[:])
+}
+
+// register creates the account, or looks up the existing one for the key.
+func (c *acmeClient) register(ctx context.Context, email string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory %s: %s", c.directoryURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return fmt.Errorf("acme: directory: %w", err)
+	}
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err = c.post(ctx, c.dir.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return errors.New("acme: account created without a location")
+	}
+	return nil
+}
+
+func (c *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: nonce: %w", err)
+	}
+	resp.Body.Close()
+	if c.nonce = resp.Header.Get("Replay-Nonce"); c.nonce == "" {
+		return fmt.Errorf("acme: nonce: %s sent no Replay-Nonce", c.dir.NewNonce)
+	}
+	return nil
+}
+
+// jws signs payload for url with the account key. Until the account is
+// registered the key itself goes in the header, afterwards its URL.
+func (c *acmeClient) jws(url string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	hdr, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	signed := b64(hdr) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": b64(hdr), "payload": b64(payload), "signature": b64(sig)})
+}
+
+// post sends a signed request; a nil payload makes it a POST-as-GET. A
+// rejected nonce is retried once with the fresh one the CA returned.
+func (c *acmeClient) post(ctx context.Context, url string, payload any) (*http.Response, []byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if c.nonce == "" {
+			if err := c.fetchNonce(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		msg, err := c.jws(url, body)
+		c.nonce = ""
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme: %w", err)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme: %s: %w", url, err)
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			p := &acmeProblem{}
+			if json.Unmarshal(data, p) != nil || p.Type == "" {
+				return nil, nil, fmt.Errorf("acme: %s: %s", url, resp.Status)
+			}
+			if p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, p
+		}
+		return resp, data, nil
+	}
+}
+
+// get fetches the resource at url into v.
+func (c *acmeClient) get(ctx context.Context, url string, v any) (*http.Response, error) {
+	resp, data, err := c.post(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("acme: %s: %w", url, err)
+	}
+	return resp, nil
+}
+
+// poll fetches url into v until status reports it is no longer pending or
+// processing, waiting as long as the CA's Retry-After asks.
+func (c *acmeClient) poll(ctx context.Context, url string, v any, status func() string) error {
+	for {
+		resp, err := c.get(ctx, url, v)
+		if err != nil {
+			return err
+		}
+		if s := status(); s != "pending" && s != "processing" {
+			return nil
+		}
+		wait := time.Second
+		if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && n > 0 {
+			wait = min(time.Duration(n)*time.Second, time.Minute)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// issue orders a certificate for name and returns its DER chain and key.
+// prepare makes the relay answer the challenge and returns its cleanup.
+func (c *acmeClient) issue(ctx context.Context, name, challenge string, prepare func(ch acmeChallenge, keyAuth string) (func(), error)) ([][]byte, *ecdsa.PrivateKey, error) {
+	resp, data, err := c.post(ctx, c.dir.NewOrder, map[string]any{
+		"identifiers": []map[string]string{{"type": "dns", "value": name}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, nil, fmt.Errorf("acme: order: %w", err)
+	}
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(ctx, authzURL, challenge, prepare); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, data, err = c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, nil, fmt.Errorf("acme: order: %w", err)
+	}
+	if order.Status == "processing" {
+		if err := c.poll(ctx, orderURL, &order, func() string { return order.Status }); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order.Status != "valid" {
+		if order.Error != nil {
+			return nil, nil, order.Error
+		}
+		return nil, nil, fmt.Errorf("acme: order for %s is %s", name, order.Status)
+	}
+
+	_, data, err = c.post(ctx, order.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil, fmt.Errorf("acme: no certificate in %s", order.Certificate)
+	}
+	return chain, key, nil
+}
+
+func (c *acmeClient) authorize(ctx context.Context, url, challenge string, prepare func(acmeChallenge, string) (func(), error)) error {
+	var authz acmeAuthorization
+	if _, err := c.get(ctx, url, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil // proven by an earlier order
+	}
+	i := 0
+	for i < len(authz.Challenges) && authz.Challenges[i].Type != challenge {
+		i++
+	}
+	if i == len(authz.Challenges) {
+		return fmt.Errorf("acme: CA offers no %s challenge", challenge)
+	}
+	ch := authz.Challenges[i]
+	cleanup, err := prepare(ch, c.keyAuthorization(ch.Token))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, _, err := c.post(ctx, ch.URL, struct{}{}); err != nil {
+		return err
+	}
+	if err := c.poll(ctx, url, &authz, func() string { return authz.Status }); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		for _, ch := range authz.Challenges {
+			if ch.Error != nil {
+				return ch.Error
+			}
+		}
+		return fmt.Errorf("acme: authorization is %s", authz.Status)
+	}
+	return nil
+}
+
+// acmeALPNCert is the self-signed certificate answering a tls-alpn-01
+// challenge for name.
+func acmeALPNCert(name, keyAuth string) (*tls.Certificate, error) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: name},
+		DNSNames:        []string{name},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
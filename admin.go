@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig enables the /admin/* endpoints.
+type AdminConfig struct {
+	Token      string `json:"token"`       // required bearer token; admin endpoints are disabled when empty
+	CaptureDir string `json:"capture_dir"` // where X-Relay-Capture requests are written; captures are off when empty
+}
+
+// adminEnabled reports whether admin endpoints should be registered.
+func adminEnabled(cfg *Config) bool {
+	return cfg.Admin != nil && cfg.Admin.Token != ""
+}
+
+// adminAuth guards an admin handler with the configured bearer token and,
+// with an audit log, records the requests that may change state.
+func adminAuth(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	return auditAdmin(cfg.audit, func(r *http.Request) string { return adminActor(cfg, r) }, func(w http.ResponseWriter, r *http.Request) {
+		if adminActor(cfg, r) == "" {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token", "authentication_error", "invalid_admin_token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// adminActor names the admin credential r authenticates with, "admin:"
+// followed by the token's fingerprint, or "" when it presents no valid one.
+func adminActor(cfg *Config, r *http.Request) string {
+	if !adminEnabled(cfg) || subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(cfg.Admin.Token)) != 1 {
+		return ""
+	}
+	return "admin:" + keyFingerprint(cfg.Admin.Token)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer xxx" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an OpenAI-style error body.
+func writeJSONError(w http.ResponseWriter, status int, message, typ, code string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    typ,
+			"code":    code,
+		},
+	})
+}
+
+// handleVerbose serves /admin/verbose, switching verbose logging and the log
+// level without a restart:
+//
+//	GET /admin/verbose  {"enabled": true|false, "level": "info", "scopes": [...]}
+//	PUT /admin/verbose  {"enabled": true|false} and/or {"level": "warn"} and/or {"scopes": [...]}
+func handleVerbose(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Enabled *bool     `json:"enabled"`
+			Level   *string   `json:"level"`
+			Scopes  *[]string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Enabled == nil && body.Level == nil && body.Scopes == nil) {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"enabled": true|false}, {"level": "..."} and/or {"scopes": [...]}`, "invalid_request_error", "invalid_parameter")
+			return
+		}
+		var level slog.Level
+		if body.Level != nil {
+			var err error
+			if level, err = parseLogLevel(*body.Level); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_parameter")
+				return
+			}
+		}
+		if body.Scopes != nil {
+			if err := validateVerboseScopes(*body.Scopes); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_parameter")
+				return
+			}
+			setVerboseScopes(*body.Scopes)
+			logf(slog.LevelInfo, "ADMIN: verbose scopes set to [%s]", strings.Join(enabledVerboseScopes(), ", "))
+		}
+		if body.Level != nil {
+			setLogLevel(level)
+			logf(slog.LevelWarn, "ADMIN: log level set to %s", level)
+		}
+		if body.Enabled != nil {
+			setDebugLogging(*body.Enabled)
+			logf(slog.LevelWarn, "ADMIN: verbose mode set to %v", *body.Enabled)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": debugLogging(), "level": strings.ToLower(logLevel.Level().String()), "scopes": enabledVerboseScopes()})
+}
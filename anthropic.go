@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// anthropicMessages serves the Anthropic Messages API (/v1/messages) on top
+// of a chat completions handler: the request is translated to a chat
+// completion, goes through next like any other (rules, toolcallfix, usage,
+// tenants), and the response or stream is translated back.
+func anthropicMessages(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "read body failed")
+			return
+		}
+		var req map[string]any
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "invalid json body")
+			return
+		}
+		chat, err := anthropicToChatRequest(req)
+		if err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		chatBody, _ := json.Marshal(chat)
+
+		inner := r.Clone(r.Context())
+		inner.URL.Path = strings.TrimSuffix(r.URL.Path, "/messages") + "/chat/completions"
+		inner.Body = io.NopCloser(bytes.NewReader(chatBody))
+		inner.ContentLength = int64(len(chatBody))
+		// Anthropic clients send their key in x-api-key; the relay and the
+		// upstream expect a bearer token
+		if key := inner.Header.Get("X-Api-Key"); key != "" && inner.Header.Get("Authorization") == "" {
+			inner.Header.Set("Authorization", "Bearer "+key)
+		}
+		for _, h := range []string{"X-Api-Key", "Anthropic-Version", "Anthropic-Beta", "Accept-Encoding", "Content-Length"} {
+			inner.Header.Del(h)
+		}
+
+		stream, _ := req["stream"].(bool)
+		vlogCtx(r.Context(), "ANTHROPIC: translated /v1/messages request for model '%s' (stream=%v)", getString(req, "model"), stream)
+		aw := &anthropicWriter{w: w, header: http.Header{}, stream: stream, model: getString(req, "model")}
+		next(aw, inner)
+		aw.finish()
+	}
+}
+
+// anthropicToChatRequest translates an Anthropic Messages request into an
+// OpenAI chat completions request.
+func anthropicToChatRequest(req map[string]any) (map[string]any, error) {
+	if getString(req, "model") == "" {
+		return nil, errors.New("model is required")
+	}
+	in, ok := req["messages"].([]any)
+	if !ok {
+		return nil, errors.New("messages must be an array")
+	}
+	chat := map[string]any{"model": req["model"]}
+	for from, to := range map[string]string{
+		"max_tokens":     "max_tokens",
+		"temperature":    "temperature",
+		"top_p":          "top_p",
+		"top_k":          "top_k",
+		"stop_sequences": "stop",
+	} {
+		if v, ok := req[from]; ok {
+			chat[to] = v
+		}
+	}
+	if stream, _ := req["stream"].(bool); stream {
+		chat["stream"] = true
+		// usage arrives in a final chunk, needed for message_delta
+		chat["stream_options"] = map[string]any{"include_usage": true}
+	}
+	if meta, ok := req["metadata"].(map[string]any); ok && getString(meta, "user_id") != "" {
+		chat["user"] = meta["user_id"]
+	}
+
+	var messages []any
+	if system, err := anthropicText(req["system"]); err != nil {
+		return nil, fmt.Errorf("system: %w", err)
+	} else if system != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+	for i, item := range in {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] must be an object", i)
+		}
+		converted, err := anthropicToChatMessages(m)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		messages = append(messages, converted...)
+	}
+	chat["messages"] = messages
+
+	if tools, ok := req["tools"].([]any); ok && len(tools) > 0 {
+		var out []any
+		for _, t := range tools {
+			tool, _ := t.(map[string]any)
+			fn := map[string]any{"name": tool["name"], "parameters": tool["input_schema"]}
+			if d, ok := tool["description"]; ok {
+				fn["description"] = d
+			}
+			out = append(out, map[string]any{"type": "function", "function": fn})
+		}
+		chat["tools"] = out
+	}
+	if choice, ok := req["tool_choice"].(map[string]any); ok {
+		switch getString(choice, "type") {
+		case "auto":
+			chat["tool_choice"] = "auto"
+		case "any":
+			chat["tool_choice"] = "required"
+		case "none":
+			chat["tool_choice"] = "none"
+		case "tool":
+			chat["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": choice["name"]}}
+		}
+		if off, _ := choice["disable_parallel_tool_use"].(bool); off {
+			chat["parallel_tool_calls"] = false
+		}
+	}
+	return chat, nil
+}
+
+// anthropicText joins a string or an array of text blocks.
+func anthropicText(v any) (string, error) {
+	switch c := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return c, nil
+	case []any:
+		var parts []string
+		for _, b := range c {
+			block, _ := b.(map[string]any)
+			if getString(block, "type") != "text" {
+				return "", fmt.Errorf("unsupported block type %q", getString(block, "type"))
+			}
+			parts = append(parts, getString(block, "text"))
+		}
+		return strings.Join(parts, "\n"), nil
+	}
+	return "", fmt.Errorf("unsupported content type %T", v)
+}
+
+// anthropicToChatMessages translates one message. Tool results in a user
+// message become "tool" messages, which come before the user's own content.
+func anthropicToChatMessages(m map[string]any) ([]any, error) {
+	role := getString(m, "role")
+	if role != "user" && role != "assistant" {
+		return nil, fmt.Errorf("unsupported role %q", role)
+	}
+	if s, ok := m["content"].(string); ok {
+		return []any{map[string]any{"role": role, "content": s}}, nil
+	}
+	blocks, ok := m["content"].([]any)
+	if !ok {
+		return nil, errors.New("content must be a string or an array")
+	}
+
+	var out, parts, toolCalls []any
+	var text []string
+	for _, b := range blocks {
+		block, _ := b.(map[string]any)
+		switch typ := getString(block, "type"); typ {
+		case "text":
+			text = append(text, getString(block, "text"))
+			parts = append(parts, map[string]any{"type": "text", "text": block["text"]})
+		case "image":
+			src, _ := block["source"].(map[string]any)
+			url := getString(src, "url")
+			if getString(src, "type") == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", getString(src, "media_type"), getString(src, "data"))
+			}
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+		case "tool_use":
+			args, _ := json.Marshal(block["input"])
+			toolCalls = append(toolCalls, map[string]any{
+				"id":       block["id"],
+				"type":     "function",
+				"function": map[string]any{"name": block["name"], "arguments": string(args)},
+			})
+		case "tool_result":
+			content, err := anthropicText(block["content"])
+			if err != nil {
+				return nil, fmt.Errorf("tool_result: %w", err)
+			}
+			if isErr, _ := block["is_error"].(bool); isErr {
+				content = "Error: " + content
+			}
+			out = append(out, map[string]any{"role": "tool", "tool_call_id": block["tool_use_id"], "content": content})
+		case "thinking", "redacted_thinking":
+			// earlier reasoning is not sent back to chat completions
+		default:
+			return nil, fmt.Errorf("unsupported block type %q", typ)
+		}
+	}
+
+	msg := map[string]any{"role": role}
+	switch {
+	case len(parts) == len(text) && len(text) > 0:
+		msg["content"] = strings.Join(text, "\n")
+	case len(parts) > 0:
+		msg["content"] = parts
+	}
+	if len(toolCalls) > 0 {
+		msg["tool_calls"] = toolCalls
+		if _, ok := msg["content"]; !ok {
+			msg["content"] = nil
+		}
+	}
+	if len(parts) > 0 || len(toolCalls) > 0 {
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// anthropicStopReasons maps chat finish reasons to Anthropic stop reasons.
+var anthropicStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "refusal",
+}
+
+func anthropicStopReason(finish string) string {
+	if r, ok := anthropicStopReasons[finish]; ok {
+		return r
+	}
+	return "end_turn"
+}
+
+func anthropicMessageID(id string) string {
+	return "msg_" + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// chatToAnthropicResponse translates a non-streaming chat completion.
+func chatToAnthropicResponse(resp map[string]any, model string) map[string]any {
+	if m := getString(resp, "model"); m != "" {
+		model = m
+	}
+	content := []any{}
+	finish := ""
+	if choices, _ := resp["choices"].([]any); len(choices) > 0 {
+		choice, _ := choices[0].(map[string]any)
+		finish = getString(choice, "finish_reason")
+		message, _ := choice["message"].(map[string]any)
+		if reasoning := getString(message, "reasoning_content"); reasoning != "" {
+			content = append(content, map[string]any{"type": "thinking", "thinking": reasoning, "signature": ""})
+		}
+		if text := getString(message, "content"); text != "" {
+			content = append(content, map[string]any{"type": "text", "text": text})
+		}
+		calls, _ := message["tool_calls"].([]any)
+		for _, c := range calls {
+			call, _ := c.(map[string]any)
+			fn, _ := call["function"].(map[string]any)
+			content = append(content, map[string]any{
+				"type":  "tool_use",
+				"id":    call["id"],
+				"name":  fn["name"],
+				"input": anthropicToolInput(getString(fn, "arguments")),
+			})
+		}
+	}
+	return map[string]any{
+		"id":            anthropicMessageID(getString(resp, "id")),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   anthropicStopReason(finish),
+		"stop_sequence": nil,
+		"usage":         anthropicUsage(resp["usage"]),
+	}
+}
+
+// anthropicToolInput decodes tool call arguments, which must be an object.
+func anthropicToolInput(args string) any {
+	var input map[string]any
+	if err := json.Unmarshal([]byte(args), &input); err != nil || input == nil {
+		return map[string]any{}
+	}
+	return input
+}
+
+func anthropicUsage(v any) map[string]any {
+	usage, _ := v.(map[string]any)
+	tokens := func(k string) any {
+		if n, ok := usage[k].(float64); ok {
+			return n
+		}
+		return 0
+	}
+	return map[string]any{"input_tokens": tokens("prompt_tokens"), "output_tokens": tokens("completion_tokens")}
+}
+
+// writeAnthropicError writes an Anthropic-style error body.
+func writeAnthropicError(w http.ResponseWriter, status int, typ, message string) {
+	writeJSON(w, status, map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": typ, "message": message},
+	})
+}
+
+// anthropicErrorType maps an HTTP status to an Anthropic error type.
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	}
+	return "api_error"
+}
+
+// anthropicWriter receives the chat completions response and writes its
+// Anthropic translation: errors and complete bodies once the handler is
+// done, streams event by event.
+type anthropicWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	stream bool
+	model  string
+
+	status  int
+	buf     bytes.Buffer // whole body, or the unfinished line of a stream
+	events  *anthropicStream
+	written bool
+}
+
+func (a *anthropicWriter) Header() http.Header { return a.header }
+
+func (a *anthropicWriter) WriteHeader(status int) {
+	if a.status != 0 {
+		return
+	}
+	a.status = status
+	if status != http.StatusOK || !a.stream {
+		return
+	}
+	a.copyHeaders()
+	a.w.Header().Set("Content-Type", "text/event-stream")
+	a.w.WriteHeader(status)
+	a.written = true
+	a.events = &anthropicStream{w: a.w, model: a.model, blockIndex: -1, toolBlocks: map[int]int{}}
+}
+
+func (a *anthropicWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	a.buf.Write(p)
+	if a.events == nil {
+		return len(p), nil
+	}
+	for {
+		line, err := a.buf.ReadString('\n')
+		if err != nil {
+			a.buf.Reset()
+			a.buf.WriteString(line)
+			break
+		}
+		a.events.line(strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+func (a *anthropicWriter) Flush() {
+	if f, ok := a.w.(http.Flusher); ok && a.written {
+		f.Flush()
+	}
+}
+
+// copyHeaders passes on the relay and upstream headers that still apply
+// to the translated body.
+func (a *anthropicWriter) copyHeaders() {
+	for k, vv := range a.header {
+		switch k {
+		case "Content-Type", "Content-Length", "Content-Encoding":
+			continue
+		}
+		a.w.Header()[k] = vv
+	}
+}
+
+// finish writes what was held back once the chat handler returned.
+func (a *anthropicWriter) finish() {
+	if a.events != nil {
+		if a.buf.Len() > 0 {
+			a.events.line(a.buf.String())
+		}
+		a.events.close()
+		a.Flush()
+		return
+	}
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	a.copyHeaders()
+	var resp map[string]any
+	if json.Unmarshal(a.buf.Bytes(), &resp) != nil || a.status != http.StatusOK {
+		message := strings.TrimSpace(a.buf.String())
+		if e, ok := resp["error"].(map[string]any); ok && getString(e, "message") != "" {
+			message = getString(e, "message")
+		}
+		if a.status == http.StatusOK {
+			a.status = http.StatusBadGateway
+		}
+		writeAnthropicError(a.w, a.status, anthropicErrorType(a.status), message)
+		return
+	}
+	writeJSON(a.w, http.StatusOK, chatToAnthropicResponse(resp, a.model))
+}
+
+// anthropicStream turns chat completion chunks into Anthropic stream events.
+type anthropicStream struct {
+	w     io.Writer
+	model string
+
+	started    bool
+	blockIndex int         // index of the open content block, -1 when none
+	blockType  string      // "text", "thinking" or "tool_use"
+	toolBlocks map[int]int // chat tool call index -> content block index
+	finish     string
+	usage      any
+	done       bool
+}
+
+func (s *anthropicStream) event(typ string, data map[string]any) {
+	data["type"] = typ
+	b, _ := json.Marshal(data)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", typ, b)
+}
+
+func (s *anthropicStream) start(id, model string) {
+	if s.started {
+		return
+	}
+	s.started = true
+	if model == "" {
+		model = s.model
+	}
+	s.event("message_start", map[string]any{"message": map[string]any{
+		"id":            anthropicMessageID(id),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       []any{},
+		"stop_reason":   nil,
+		"stop_sequence": nil,
+		"usage":         map[string]any{"input_tokens": 0, "output_tokens": 0},
+	}})
+}
+
+// openBlock starts a content block unless one of the type is already open.
+func (s *anthropicStream) openBlock(typ string, block map[string]any) {
+	if s.blockIndex >= 0 && s.blockType == typ && typ != "tool_use" {
+		return
+	}
+	s.closeBlock()
+	s.blockIndex++
+	s.blockType = typ
+	s.event("content_block_start", map[string]any{"index": s.blockIndex, "content_block": block})
+}
+
+func (s *anthropicStream) closeBlock() {
+	if s.blockType == "" {
+		return
+	}
+	s.event("content_block_stop", map[string]any{"index": s.blockIndex})
+	s.blockType = ""
+}
+
+func (s *anthropicStream) delta(delta map[string]any) {
+	s.event("content_block_delta", map[string]any{"index": s.blockIndex, "delta": delta})
+}
+
+func (s *anthropicStream) line(line string) {
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok || s.done {
+		return
+	}
+	if data == "[DONE]" {
+		s.close()
+		return
+	}
+	var chunk map[string]any
+	if json.Unmarshal([]byte(data), &chunk) != nil {
+		return
+	}
+	if e, ok := chunk["error"].(map[string]any); ok {
+		s.event("error", map[string]any{"error": map[string]any{"type": "api_error", "message": getString(e, "message")}})
+		s.done = true
+		return
+	}
+	s.start(getString(chunk, "id"), getString(chunk, "model"))
+	if u, ok := chunk["usage"].(map[string]any); ok {
+		s.usage = u
+	}
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return
+	}
+	choice, _ := choices[0].(map[string]any)
+	delta, _ := choice["delta"].(map[string]any)
+	if text := getString(delta, "reasoning_content"); text != "" {
+		s.openBlock("thinking", map[string]any{"type": "thinking", "thinking": ""})
+		s.delta(map[string]any{"type": "thinking_delta", "thinking": text})
+	}
+	if text := getString(delta, "content"); text != "" {
+		s.openBlock("text", map[string]any{"type": "text", "text": ""})
+		s.delta(map[string]any{"type": "text_delta", "text": text})
+	}
+	calls, _ := delta["tool_calls"].([]any)
+	for _, c := range calls {
+		call, _ := c.(map[string]any)
+		fn, _ := call["function"].(map[string]any)
+		index := 0
+		if n, ok := call["index"].(float64); ok {
+			index = int(n)
+		}
+		if block, ok := s.toolBlocks[index]; !ok || block != s.blockIndex {
+			s.openBlock("tool_use", map[string]any{"type": "tool_use", "id": call["id"], "name": fn["name"], "input": map[string]any{}})
+			s.toolBlocks[index] = s.blockIndex
+		}
+		if args := getString(fn, "arguments"); args != "" {
+			s.delta(map[string]any{"type": "input_json_delta", "partial_json": args})
+		}
+	}
+	if finish := getString(choice, "finish_reason"); finish != "" {
+		s.finish = finish
+	}
+}
+
+// close ends the message; usage comes after the finish chunk, so the stop
+// reason is sent only now.
+func (s *anthropicStream) close() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.start("", "")
+	s.closeBlock()
+	usage := anthropicUsage(s.usage)
+	s.event("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": anthropicStopReason(s.finish), "stop_sequence": nil},
+		"usage": map[string]any{"output_tokens": usage["output_tokens"]},
+	})
+	s.event("message_stop", map[string]any{})
+}
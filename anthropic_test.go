@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicToChatRequest(t *testing.T) {
+	var req map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"model": "m",
+		"max_tokens": 100,
+		"stop_sequences": ["END"],
+		"system": [{"type": "text", "text": "Be brief."}],
+		"tools": [{"name": "get_weather", "description": "Weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any", "disable_parallel_tool_use": true},
+		"messages": [
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "hmm", "signature": "x"},
+				{"type": "tool_use", "id": "t1", "name": "get_weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "t1", "content": [{"type": "text", "text": "sunny"}]},
+				{"type": "text", "text": "And now?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAA"}}
+			]}
+		]
+	}`), &req)
+	chat, err := anthropicToChatRequest(req)
+	if err != nil {
+		t.Fatalf("anthropicToChatRequest() failed: %v", err)
+	}
+	b, _ := json.Marshal(chat)
+	var got, want map[string]any
+	_ = json.Unmarshal(b, &got)
+	_ = json.Unmarshal([]byte(`{
+		"model": "m",
+		"max_tokens": 100,
+		"stop": ["END"],
+		"tools": [{"type": "function", "function": {"name": "get_weather", "description": "Weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required",
+		"parallel_tool_calls": false,
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "t1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "t1", "content": "sunny"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "And now?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAA"}}
+			]}
+		]
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chat request =\n%s", b)
+	}
+
+	for _, body := range []string{
+		`{"messages": []}`,
+		`{"model": "m", "messages": [{"role": "system", "content": "x"}]}`,
+		`{"model": "m", "messages": [{"role": "user", "content": [{"type": "document"}]}]}`,
+	} {
+		req = map[string]any{}
+		_ = json.Unmarshal([]byte(body), &req)
+		if _, err := anthropicToChatRequest(req); err == nil {
+			t.Errorf("anthropicToChatRequest(%s) succeeded, want error", body)
+		}
+	}
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	var upstreamBody map[string]any
+	var upstreamAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		if upstreamBody["model"] == "broken" {
+			writeJSONError(w, http.StatusTooManyRequests, "slow down", "rate_limit", "")
+			return
+		}
+		if upstreamBody["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			stream := chatStream("Checking.", "<tool_call>get_weather<arg_key>city</arg_key>", "<arg_value>Paris</arg_value></tool_call>")
+			stream = strings.Replace(stream, "data: [DONE]", `data: {"id":"c1","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":5}}`+"\n\ndata: [DONE]", 1)
+			_, _ = io.WriteString(w, stream)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":    "chatcmpl-1",
+			"model": "m",
+			"choices": []any{map[string]any{"index": 0, "finish_reason": "tool_calls", "message": map[string]any{
+				"role":    "assistant",
+				"content": "Checking.",
+				"tool_calls": []any{map[string]any{"id": "call_1", "type": "function", "function": map[string]any{
+					"name": "get_weather", "arguments": `{"city":"Paris"}`,
+				}}},
+			}}},
+			"usage": map[string]any{"prompt_tokens": 7, "completion_tokens": 5},
+		})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream:    upstream.URL,
+		ForwardAuth: true,
+		ModelRules:  []ModelRule{{MatchModel: "m", EnableToolCallFix: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(model string, stream bool) *httptest.ResponseRecorder {
+		body := `{"model":"` + model + `","max_tokens":50,"stream":` + map[bool]string{true: "true", false: "false"}[stream] +
+			`,"tools":[{"name":"get_weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}],"messages":[{"role":"user","content":"Paris?"}]}`
+		r := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+		r.Header.Set("x-api-key", "sk-test")
+		r.Header.Set("anthropic-version", "2023-06-01")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("m", false)
+	var resp struct {
+		ID         string           `json:"id"`
+		Type       string           `json:"type"`
+		Content    []map[string]any `json:"content"`
+		StopReason string           `json:"stop_reason"`
+		Usage      map[string]int   `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("invalid response %d %s: %v", w.Code, w.Body, err)
+	}
+	if upstreamAuth != "Bearer sk-test" {
+		t.Errorf("upstream Authorization = %q, want the x-api-key as bearer token", upstreamAuth)
+	}
+	if resp.ID != "msg_1" || resp.Type != "message" || resp.StopReason != "tool_use" || resp.Usage["output_tokens"] != 5 || len(resp.Content) != 2 ||
+		resp.Content[0]["text"] != "Checking." || resp.Content[1]["type"] != "tool_use" || !reflect.DeepEqual(resp.Content[1]["input"], map[string]any{"city": "Paris"}) {
+		t.Errorf("response = %s", w.Body)
+	}
+
+	w = send("m", true)
+	out := w.Body.String()
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var events []string
+	var args strings.Builder
+	for _, line := range strings.Split(out, "\n") {
+		if e, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, e)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev struct {
+				Delta struct {
+					PartialJSON string `json:"partial_json"`
+				} `json:"delta"`
+			}
+			_ = json.Unmarshal([]byte(data), &ev)
+			args.WriteString(ev.Delta.PartialJSON)
+		}
+	}
+	wantEvents := "message_start content_block_start content_block_delta content_block_stop content_block_start content_block_delta content_block_stop message_delta message_stop"
+	if got := strings.Join(events, " "); got != wantEvents {
+		t.Errorf("events = %s\n%s", got, out)
+	}
+	if args.String() != `{"city":"Paris"}` || !strings.Contains(out, `"stop_reason":"tool_use"`) || !strings.Contains(out, `"usage":{"output_tokens":5}`) {
+		t.Errorf("stream = %s", out)
+	}
+	if upstreamBody["stream_options"] == nil {
+		t.Error("stream_options.include_usage not requested")
+	}
+
+	w = send("broken", false)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `{"message":"slow down","type":"rate_limit_error"}`) {
+		t.Errorf("error = %d %s", w.Code, w.Body)
+	}
+}
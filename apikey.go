@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validateAPIKey checks an api_key / api_key_file pair from upstream_options
+// or a model rule.
+func validateAPIKey(key, file string) error {
+	if key != "" && file != "" {
+		return errors.New("api_key and api_key_file are mutually exclusive")
+	}
+	if file == "" {
+		return nil
+	}
+	k, err := apiKeyFiles.read(file)
+	if err != nil {
+		return fmt.Errorf("api_key_file: %w", err)
+	}
+	if k == "" {
+		return fmt.Errorf("api_key_file %s is empty", file)
+	}
+	return nil
+}
+
+// keyFileCache re-reads key files when they change, so a rotated secret is
+// picked up without a restart.
+type keyFileCache struct {
+	mu    sync.Mutex
+	files map[string]cachedKey
+}
+
+type cachedKey struct {
+	modTime time.Time
+	key     string
+}
+
+var apiKeyFiles = &keyFileCache{files: map[string]cachedKey{}}
+
+func (c *keyFileCache) read(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.files[path]; ok && k.modTime.Equal(fi.ModTime()) {
+		return k.key, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(b))
+	c.files[path] = cachedKey{fi.ModTime(), key}
+	return key, nil
+}
+
+// resolveAPIKey returns the key configured inline or in a file, or "".
+func resolveAPIKey(key, file string) string {
+	if key != "" || file == "" {
+		return key
+	}
+	k, err := apiKeyFiles.read(file)
+	if err != nil {
+		// the file was readable at startup; keep going without a key
+		vlog("UPSTREAM: reading api_key_file failed: %v", err)
+		return ""
+	}
+	return k
+}
+
+// apiKey returns the key configured for the upstream, or "".
+func (c *upstreamClient) apiKey() string {
+	if c.keys != nil {
+		return c.keys.pick(time.Now())
+	}
+	return resolveAPIKey(c.opts.APIKey, c.opts.APIKeyFile)
+}
+
+// authorize sets the Authorization header of an upstream request. The
+// rule's key wins over the upstream's; without either the client's header
+// is kept only when forward_auth is on.
+func (c *upstreamClient) authorize(req *http.Request, rule *ModelRule, forwardAuth bool) {
+	key := ""
+	if rule != nil {
+		key = resolveAPIKey(rule.APIKey, rule.APIKeyFile)
+	}
+	if key == "" {
+		key = c.apiKey()
+	}
+	switch {
+	case key != "":
+		req.Header.Set("Authorization", "Bearer "+key)
+	case !forwardAuth:
+		req.Header.Del("Authorization")
+	}
+}
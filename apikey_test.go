@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamAPIKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"auth": r.Header.Get("Authorization")})
+	}))
+	defer upstream.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("sk-from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Upstream:        upstream.URL,
+		UpstreamOptions: &UpstreamOptions{APIKey: "sk-upstream"},
+		ModelRules: []ModelRule{
+			{MatchModel: "rule-key", APIKey: "sk-rule"},
+			{MatchModel: "file-key", APIKeyFile: keyFile},
+		},
+	}
+	if err := validateModelRules(cfg.ModelRules); err != nil {
+		t.Fatalf("validateModelRules() failed: %v", err)
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	auth := func(path, model string) string {
+		t.Helper()
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{"model":"`+model+`"}`))
+		if path == "/v1/models" {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		r.Header.Set("Authorization", "Bearer sk-dummy")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var body map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return body["auth"]
+	}
+
+	for _, tt := range []struct{ path, model, want string }{
+		{"/v1/chat/completions", "other", "Bearer sk-upstream"},
+		{"/v1/chat/completions", "rule-key", "Bearer sk-rule"},
+		{"/v1/completions", "file-key", "Bearer sk-from-file"},
+		{"/v1/models", "", "Bearer sk-upstream"},
+	} {
+		if got := auth(tt.path, tt.model); got != tt.want {
+			t.Errorf("%s %s: upstream got Authorization %q, want %q", tt.path, tt.model, got, tt.want)
+		}
+	}
+
+	// a rotated key file is picked up on the next request
+	if err := os.WriteFile(keyFile, []byte("sk-rotated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(keyFile, later, later)
+	if got := auth("/v1/chat/completions", "file-key"); got != "Bearer sk-rotated" {
+		t.Errorf("after rotation: Authorization %q, want the new key", got)
+	}
+}
+
+func TestUpstreamAPIKeyForwardAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"auth": r.Header.Get("Authorization")})
+	}))
+	defer upstream.Close()
+
+	for _, forward := range []bool{false, true} {
+		mux, err := newRelayMux(&Config{Upstream: upstream.URL, ForwardAuth: forward})
+		if err != nil {
+			t.Fatalf("newRelayMux() failed: %v", err)
+		}
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		r.Header.Set("Authorization", "Bearer sk-client")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		want := ""
+		if forward {
+			want = "Bearer sk-client"
+		}
+		if !strings.Contains(w.Body.String(), `"auth":"`+want+`"`) {
+			t.Errorf("forward_auth=%v: got %s, want Authorization %q", forward, w.Body.String(), want)
+		}
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty")
+	_ = os.WriteFile(empty, nil, 0o600)
+	for _, tt := range []struct{ key, file string }{
+		{"sk-1", "/some/file"},
+		{"", "/does/not/exist"},
+		{"", empty},
+	} {
+		if err := validateAPIKey(tt.key, tt.file); err == nil {
+			t.Errorf("validateAPIKey(%q, %q) succeeded, want error", tt.key, tt.file)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig appends every admin API mutation and config reload to a
+// tamper-evident log. Each entry carries the hash of the one before it and
+// an HMAC of its own hash, so an edited, dropped or reordered entry breaks
+// the chain, and the chain cannot be rebuilt without the key.
+type AuditConfig struct {
+	Path           string `json:"path"`             // JSONL file entries are appended to
+	SigningKey     string `json:"signing_key"`      // HMAC-SHA256 key signing each entry
+	SigningKeyFile string `json:"signing_key_file"` // file holding the key
+}
+
+// actorHeader optionally names the person or system behind an admin
+// request. Nothing vouches for it, so it is kept apart from the actor as
+// claimed_actor.
+const actorHeader = "X-Relay-Actor"
+
+// maxAuditBodyBytes caps the request body kept in an entry.
+const maxAuditBodyBytes = 64 << 10
+
+func validateAudit(c *AuditConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.Path == "" {
+		return errors.New("audit.path is required")
+	}
+	if (c.SigningKey == "") == (c.SigningKeyFile == "") {
+		return errors.New("audit needs exactly one of signing_key and signing_key_file")
+	}
+	if c.SigningKeyFile != "" {
+		if k, err := apiKeyFiles.read(c.SigningKeyFile); err != nil || k == "" {
+			return fmt.Errorf("audit.signing_key_file %s is unreadable or empty", c.SigningKeyFile)
+		}
+	}
+	return nil
+}
+
+// auditEntry is one line of the log.
+type auditEntry struct {
+	Seq     int64  `json:"seq"`
+	Time    string `json:"time"`
+	Actor   string `json:"actor"`                   // credential that authenticated, "anonymous" if none did, or "system" for reloads
+	Claimed string `json:"claimed_actor,omitempty"` // unverified X-Relay-Actor
+	Token   string `json:"token,omitempty"`         // fingerprint of the admin token presented
+	Remote  string `json:"remote,omitempty"`
+	Action  string `json:"action"` // e.g. "PUT /admin/maintenance" or "config.reload"
+	Status  int    `json:"status,omitempty"`
+	Details any    `json:"details,omitempty"`
+	Prev    string `json:"prev"`           // hash of the previous entry, "" for the first
+	Hash    string `json:"hash,omitempty"` // SHA-256 of the entry without hash and sig
+	Sig     string `json:"sig,omitempty"`  // HMAC-SHA256 of hash
+}
+
+// digest computes the entry's hash over its fields other than hash and sig.
+func (e auditEntry) digest() string {
+	e.Hash, e.Sig = "", ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditSignature(key, hash string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLog appends signed entries to the file.
+type auditLog struct {
+	cfg AuditConfig
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	prev string
+}
+
+// openAuditLog opens the file for appending and continues its chain after
+// the last entry. A file that no longer verifies is reported but not
+// refused: the relay keeps auditing, and the break stays visible to verify.
+func openAuditLog(cfg AuditConfig) (*auditLog, error) {
+	a := &auditLog{cfg: cfg}
+	n, _, err := verifyAuditLog(cfg.Path, a.key())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		logf(slog.LevelError, "AUDIT: %s does not verify: %v", cfg.Path, err)
+		fallthrough
+	default:
+		tail, err := readAuditTail(cfg.Path, 1)
+		if err != nil {
+			return nil, fmt.Errorf("read audit log: %w", err)
+		}
+		if len(tail) > 0 {
+			a.seq, a.prev = tail[0].Seq, tail[0].Hash
+		}
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	a.file = f
+	vlog("AUDIT: %d entries in %s", n, cfg.Path)
+	return a, nil
+}
+
+func (a *auditLog) key() string {
+	return resolveAPIKey(a.cfg.SigningKey, a.cfg.SigningKeyFile)
+}
+
+// record appends an entry, filling in its sequence, time and chain.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq = a.seq + 1
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.Prev = a.prev
+	e.Hash = e.digest()
+	e.Sig = auditSignature(a.key(), e.Hash)
+	b, _ := json.Marshal(e)
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		logf(slog.LevelError, "AUDIT: append failed: %v", err)
+		return
+	}
+	a.seq, a.prev = e.Seq, e.Hash
+}
+
+// verifyAuditLog checks every entry of the file at path against its hash,
+// its signature under key and the entry before it. It returns the number of
+// entries read and the last one that verified.
+func verifyAuditLog(path, key string) (int, *auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	var last *auditEntry
+	n := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 4<<20)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		n++
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return n, last, fmt.Errorf("line %d: %w", n, err)
+		}
+		prev, seq := "", int64(0)
+		if last != nil {
+			prev, seq = last.Hash, last.Seq
+		}
+		switch {
+		case e.Seq != seq+1:
+			return n, last, fmt.Errorf("entry %d: sequence jumps from %d", e.Seq, seq)
+		case e.Prev != prev:
+			return n, last, fmt.Errorf("entry %d: does not follow entry %d", e.Seq, seq)
+		case e.digest() != e.Hash:
+			return n, last, fmt.Errorf("entry %d: hash mismatch, the entry was modified", e.Seq)
+		case !hmac.Equal([]byte(auditSignature(key, e.Hash)), []byte(e.Sig)):
+			return n, last, fmt.Errorf("entry %d: bad signature", e.Seq)
+		}
+		last = &e
+	}
+	return n, last, sc.Err()
+}
+
+// auditAdmin records every admin request that may change state, whether
+// it was allowed or not. Reads are not recorded. actor names the credential
+// that authenticated r, or "" when none did.
+func auditAdmin(a *auditLog, actor func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditBodyBytes))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+
+		e := auditEntry{
+			Actor:   cmp.Or(actor(r), "anonymous"),
+			Claimed: strings.TrimSpace(r.Header.Get(actorHeader)),
+			Token:   keyFingerprint(bearerToken(r)),
+			Remote:  r.RemoteAddr,
+			Action:  r.Method + " " + r.URL.Path,
+			Status:  sw.status,
+		}
+		var details any
+		if json.Unmarshal(body, &details) == nil {
+			e.Details = details
+		} else if len(body) > 0 {
+			e.Details = string(body)
+		}
+		a.record(e)
+	}
+}
+
+// statusWriter remembers the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// handleAudit serves GET /admin/audit: the newest entries (limit, default
+// 50) and whether the whole file verifies.
+func (a *auditLog) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if _, err := fmt.Sscan(s, &limit); err != nil || limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit", "invalid_request_error", "invalid_parameter")
+			return
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, _, verr := verifyAuditLog(a.cfg.Path, a.key())
+	entries, err := readAuditTail(a.cfg.Path, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), "server_error", "audit_read_failed")
+		return
+	}
+	resp := map[string]any{"object": "list", "data": entries, "entries": n, "verified": verr == nil}
+	if verr != nil {
+		resp["error"] = verr.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readAuditTail returns the last limit entries, newest first.
+func readAuditTail(path string, limit int) ([]auditEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	entries := []auditEntry{}
+	for i := len(lines) - 1; i >= 0 && len(entries) < limit; i-- {
+		var e auditEntry
+		if json.Unmarshal([]byte(lines[i]), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// runAuditVerify implements `relay audit-verify --config cfg.jsonc`. It
+// returns the process exit code.
+func runAuditVerify(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	fs.SetOutput(out)
+	var configPath string
+	fs.StringVar(&configPath, "config", "", "path to jsonc config")
+	fs.StringVar(&configPath, "c", "", "path to jsonc config")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if configPath == "" {
+		fmt.Fprintln(out, "Usage: audit-verify --config <config.jsonc>")
+		return 2
+	}
+	cfg, err := loadConfigJSONC(configPath)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  load config: %v\n", err)
+		return 1
+	}
+	if cfg.Audit == nil {
+		fmt.Fprintln(out, "FAIL  the config has no audit section")
+		return 1
+	}
+	key := resolveAPIKey(cfg.Audit.SigningKey, cfg.Audit.SigningKeyFile)
+	n, last, err := verifyAuditLog(cfg.Audit.Path, key)
+	if err != nil {
+		good := int64(0)
+		if last != nil {
+			good = last.Seq
+		}
+		fmt.Fprintf(out, "FAIL  %s: %v (entries 1-%d verify)\n", cfg.Audit.Path, err, good)
+		return 1
+	}
+	fmt.Fprintf(out, "OK    %s: %d entries verify\n", cfg.Audit.Path, n)
+	return 0
+}
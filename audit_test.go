@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditAdminMutations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := &Config{
+		Upstream: "http://127.0.0.1:1",
+		Admin:    &AdminConfig{Token: "admin"},
+		Audit:    &AuditConfig{Path: path, SigningKey: "audit-key"},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set(actorHeader, "alice")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	send("PUT", "/admin/toolcallfix/audit-model", "admin", `{"enabled":true}`)
+	send("GET", "/admin/toolcallfix/audit-model", "admin", "")
+	send("DELETE", "/admin/toolcallfix/audit-model", "admin", "")
+	send("PUT", "/admin/verbose", "guess", `{"enabled":true}`)
+	cfg.audit.record(auditEntry{Actor: "system", Action: "config.reload"})
+
+	n, last, err := verifyAuditLog(path, "audit-key")
+	if err != nil || n != 4 || last.Seq != 4 {
+		t.Fatalf("verifyAuditLog() = %d, %+v, %v; want 4 verified entries", n, last, err)
+	}
+	if _, _, err := verifyAuditLog(path, "other-key"); err == nil {
+		t.Error("log verified under the wrong key")
+	}
+
+	w := send("GET", "/admin/audit", "admin", "")
+	var resp struct {
+		Data     []auditEntry `json:"data"`
+		Verified bool         `json:"verified"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Verified || len(resp.Data) != 4 {
+		t.Fatalf("/admin/audit = %d %s", w.Code, w.Body)
+	}
+	if e := resp.Data[3]; e.Actor != "admin:"+keyFingerprint("admin") || e.Claimed != "alice" || e.Action != "PUT /admin/toolcallfix/audit-model" || e.Status != http.StatusOK ||
+		e.Token != keyFingerprint("admin") || e.Details.(map[string]any)["enabled"] != true {
+		t.Errorf("first entry = %+v", e)
+	}
+	if e := resp.Data[1]; e.Action != "PUT /admin/verbose" || e.Status != http.StatusUnauthorized ||
+		e.Actor != "anonymous" || e.Claimed != "alice" {
+		t.Errorf("rejected attempt = %+v, want it recorded with 401", e)
+	}
+
+	// editing an entry breaks the chain from there on
+	b, _ := os.ReadFile(path)
+	tampered := bytes.Replace(b, []byte(`"status":401`), []byte(`"status":200`), 1)
+	if err := os.WriteFile(path, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, err := verifyAuditLog(path, "audit-key"); err == nil || last.Seq != 2 {
+		t.Errorf("tampered log: last verified %+v, err %v; want a break at entry 3", last, err)
+	}
+
+	// a restarted relay continues after the last entry
+	a, err := openAuditLog(*cfg.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record(auditEntry{Actor: "system", Action: "config.reload"})
+	if tail, _ := readAuditTail(path, 1); len(tail) != 1 || tail[0].Seq != 5 {
+		t.Errorf("entry after reopening = %+v, want seq 5", tail)
+	}
+}
+
+func TestRunAuditVerify(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "audit.jsonl")
+	keyPath := filepath.Join(dir, "key")
+	_ = os.WriteFile(keyPath, []byte("secret\n"), 0o600)
+	cfgPath := filepath.Join(dir, "config.jsonc")
+	_ = os.WriteFile(cfgPath, []byte(`{
+		"upstream": "http://127.0.0.1:1",
+		// verified offline with the same key
+		"audit": {"path": "`+logPath+`", "signing_key_file": "`+keyPath+`"}
+	}`), 0o600)
+	cfg, err := loadConfigJSONC(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := openAuditLog(*cfg.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &configReloader{path: cfgPath, cfg: &Config{audit: a}}
+	r.audit("SIGHUP", nil)
+	r.audit("file change", errors.New("bad rule"))
+
+	var out bytes.Buffer
+	if code := runAuditVerify([]string{"--config", cfgPath}, &out); code != 0 || !strings.Contains(out.String(), "2 entries verify") {
+		t.Errorf("runAuditVerify() = %d: %s", code, out.String())
+	}
+
+	_ = os.WriteFile(keyPath, []byte("rotated"), 0o600)
+	out.Reset()
+	apiKeyFiles.mu.Lock()
+	delete(apiKeyFiles.files, keyPath)
+	apiKeyFiles.mu.Unlock()
+	if code := runAuditVerify([]string{"--config", cfgPath}, &out); code != 1 || !strings.Contains(out.String(), "bad signature") {
+		t.Errorf("runAuditVerify() with another key = %d: %s", code, out.String())
+	}
+}
+
+func TestValidateAudit(t *testing.T) {
+	for _, c := range []AuditConfig{{SigningKey: "k"}, {Path: "audit.jsonl"}, {Path: "a", SigningKey: "k", SigningKeyFile: "f"}, {Path: "a", SigningKeyFile: "/nonexistent"}} {
+		if err := validateAudit(&c); err == nil {
+			t.Errorf("validateAudit(%+v) succeeded, want error", c)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientWriteConfig bounds how long a streaming client may stall before the
+// relay drops it, so a stalled client cannot pin an upstream connection.
+type ClientWriteConfig struct {
+	Timeout     string `json:"timeout"`      // max time one write to the client may block (default "30s")
+	BufferBytes int    `json:"buffer_bytes"` // output queued ahead of a slow client (default 1 MiB)
+}
+
+const (
+	defaultClientWriteTimeout = 30 * time.Second
+	defaultClientBufferBytes  = 1 << 20
+)
+
+var slowClientsTotal = metrics.newCounterVec("relay_slow_clients_dropped_total",
+	"Streaming clients dropped because they stopped reading.", "tenant", "model", "reason")
+
+var errSlowClient = errors.New("client is not reading the stream")
+
+func validateClientWrite(c *ClientWriteConfig) error {
+	if c == nil || c.Timeout == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid client_write.timeout %q", c.Timeout)
+	}
+	return nil
+}
+
+// clientStream queues stream output for the client and writes it from its
+// own goroutine with a deadline per write. The queue is bounded: a producer
+// waits while it is full, and when a write times out or the queue stops
+// draining the client is dropped and abort releases the upstream.
+type clientStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+	limit   int
+	abort   func()
+	tenant  string
+	model   string
+	label   string // model label of the metrics, see metricModel
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	queued int
+	closed bool
+	err    error
+
+	progress chan struct{} // signaled whenever the queue shrinks or the client is dropped
+	done     chan struct{}
+}
+
+func newClientStream(ctx context.Context, w http.ResponseWriter, cfg *ClientWriteConfig, abort func(), tenant string, rule *ModelRule, model string) *clientStream {
+	s := &clientStream{
+		ctx:     ctx,
+		w:       w,
+		rc:      http.NewResponseController(w),
+		timeout: defaultClientWriteTimeout,
+		limit:   defaultClientBufferBytes,
+		abort:   abort,
+		tenant:  tenant,
+		model:   model,
+		label:   metricModel(rule),
+
+		progress: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if cfg != nil {
+		if d, err := time.ParseDuration(cfg.Timeout); err == nil {
+			s.timeout = d
+		}
+		if cfg.BufferBytes > 0 {
+			s.limit = cfg.BufferBytes
+		}
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Write queues p, waiting while the queue is full. The client is dropped when
+// the queue makes no progress for the write timeout, and Write fails from
+// then on.
+func (s *clientStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.err == nil && s.queued > 0 && s.queued+len(p) > s.limit {
+		s.mu.Unlock()
+		var stalled bool
+		select {
+		case <-s.progress:
+		case <-time.After(s.timeout):
+			stalled = true
+		}
+		s.mu.Lock()
+		if stalled {
+			s.drop("buffer", fmt.Errorf("%w: %d bytes queued without progress for %s", errSlowClient, s.queued, s.timeout))
+		}
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.queue = append(s.queue, append([]byte(nil), p...))
+	s.queued += len(p)
+	s.cond.Signal()
+	return len(p), nil
+}
+
+// Flush is a no-op: queued output is flushed as soon as it is written.
+func (s *clientStream) Flush() {}
+
+// dropped reports whether the client was cut off for being too slow.
+func (s *clientStream) dropped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Is(s.err, errSlowClient)
+}
+
+// drop records err and releases the upstream. s.mu must be held.
+func (s *clientStream) drop(reason string, err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	logCtxf(s.ctx, slog.LevelWarn, "STREAM: dropping slow client for model '%s' (tenant %s): %v", s.model, s.tenant, err)
+	slowClientsTotal.Inc(s.tenant, s.label, reason)
+	s.cond.Signal()
+	s.notify()
+	go s.abort()
+}
+
+func (s *clientStream) notify() {
+	select {
+	case s.progress <- struct{}{}:
+	default:
+	}
+}
+
+func (s *clientStream) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil || len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		chunk := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		// not every ResponseWriter supports deadlines; those writes just block
+		_ = s.rc.SetWriteDeadline(time.Now().Add(s.timeout))
+		_, err := s.w.Write(chunk)
+		if err == nil {
+			err = s.rc.Flush()
+		}
+
+		s.mu.Lock()
+		s.queued -= len(chunk)
+		s.notify()
+		switch {
+		case err == nil, errors.Is(err, http.ErrNotSupported):
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			s.drop("timeout", fmt.Errorf("%w: write blocked for %s", errSlowClient, s.timeout))
+		case s.err == nil:
+			// the client went away; nothing to report
+			s.err = err
+			s.notify()
+			go s.abort()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close waits until the queue is written or the client is dropped.
+func (s *clientStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Signal()
+	s.mu.Unlock()
+	<-s.done
+	_ = s.rc.SetWriteDeadline(time.Time{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
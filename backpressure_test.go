@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowClientDropped(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		pad := strings.Repeat("x", 1024)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+			fmt.Fprintln(w, sseChunk("slow", pad, ""))
+			fmt.Fprintln(w)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ClientWrite: &ClientWriteConfig{Timeout: "100ms", BufferBytes: 64 << 10}}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+	}))
+	defer relay.Close()
+
+	resp, err := http.Post(relay.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// read one line, then stall like a backgrounded mobile app
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upstream request was not released for a stalled client")
+	}
+}
+
+func TestClientStreamPassesOutput(t *testing.T) {
+	w := httptest.NewRecorder()
+	out := newClientStream(context.Background(), w, nil, func() {}, "default", nil, "m")
+	for i := range 3 {
+		fmt.Fprintf(out, "data: %d\n\n", i)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "data: 0\n\ndata: 1\n\ndata: 2\n\n" {
+		t.Errorf("unexpected output %q", w.Body.String())
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica is one of several base URLs serving the same models, e.g. vLLM
+// replicas on different hosts.
+type Replica struct {
+	URL    string `json:"url"`    // scheme and host replace the upstream's; the path is taken from the request as usual
+	Weight int    `json:"weight"` // share of requests under "weighted" balancing (default 1)
+}
+
+// defaultReplicaCooldown is how long a replica that could not be reached is
+// left out when replica_cooldown is not set.
+const defaultReplicaCooldown = 30 * time.Second
+
+var (
+	replicaRequestsTotal = metrics.newCounterVec("relay_upstream_replica_requests_total",
+		"Requests sent to each replica of an upstream.", "upstream", "replica")
+	replicaFailuresTotal = metrics.newCounterVec("relay_upstream_replica_failures_total",
+		"Requests to a replica that failed without a response, marking it down.", "upstream", "replica")
+)
+
+func validateReplicas(o *UpstreamOptions) error {
+	for i, r := range o.Replicas {
+		if u, err := url.Parse(r.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("upstream_options.replicas[%d]: invalid url %q", i, r.URL)
+		}
+		if r.Weight < 0 {
+			return fmt.Errorf("upstream_options.replicas[%d]: weight must not be negative", i)
+		}
+	}
+	switch o.Balance {
+	case "", "round_robin", "weighted", "least_outstanding":
+	default:
+		return fmt.Errorf("unknown upstream_options.balance %q", o.Balance)
+	}
+	if o.ReplicaCooldown != "" {
+		if d, err := time.ParseDuration(o.ReplicaCooldown); err != nil || d <= 0 {
+			return fmt.Errorf("invalid upstream_options.replica_cooldown %q", o.ReplicaCooldown)
+		}
+	}
+	return nil
+}
+
+// replica is the balancer's state for one Replica.
+type replica struct {
+	url      *url.URL
+	weight   int
+	inFlight atomic.Int64 // requests whose response body is still open
+
+	// guarded by balancer.mu
+	current int       // smooth weighted round-robin credit
+	downAt  time.Time // when it last failed; zero while healthy
+}
+
+// balancer spreads an upstream's requests over its replicas. Replicas that
+// fail at the connection level are marked down passively and skipped for
+// the cooldown; when all of them are down, all are tried again rather than
+// failing every request.
+type balancer struct {
+	upstream string
+	policy   string
+	cooldown time.Duration
+	replicas []*replica
+
+	mu   sync.Mutex
+	next int // round-robin position
+}
+
+// newBalancer returns nil when the options list no replicas.
+func newBalancer(up *url.URL, o UpstreamOptions) *balancer {
+	if len(o.Replicas) == 0 {
+		return nil
+	}
+	b := &balancer{upstream: up.Host, policy: o.Balance, cooldown: defaultReplicaCooldown}
+	if b.policy == "" {
+		b.policy = "round_robin"
+	}
+	if o.ReplicaCooldown != "" {
+		// validated at startup
+		b.cooldown, _ = time.ParseDuration(o.ReplicaCooldown)
+	}
+	for _, r := range o.Replicas {
+		u, _ := url.Parse(r.URL)
+		b.replicas = append(b.replicas, &replica{url: u, weight: max(r.Weight, 1)})
+	}
+	return b
+}
+
+// healthy returns the replicas not marked down. Callers hold mu.
+func (b *balancer) healthy(now time.Time) []*replica {
+	var up []*replica
+	for _, r := range b.replicas {
+		if r.downAt.IsZero() || now.Sub(r.downAt) >= b.cooldown {
+			up = append(up, r)
+		}
+	}
+	if len(up) == 0 {
+		return b.replicas
+	}
+	return up
+}
+
+// pick chooses the replica for the next request. A conversation id pins the
+// request to one replica, as long as that replica is up.
+func (b *balancer) pick(conversation string, now time.Time) *replica {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	up := b.healthy(now)
+	if conversation != "" {
+		addrs := make([]string, len(up))
+		for i, r := range up {
+			addrs[i] = r.url.Host
+		}
+		owner := replicaFor(conversation, addrs)
+		for _, r := range up {
+			if r.url.Host == owner {
+				return r
+			}
+		}
+	}
+	switch b.policy {
+	case "weighted":
+		// smooth weighted round-robin: picks are interleaved rather than
+		// sent to one replica in bursts
+		total := 0
+		var best *replica
+		for _, r := range up {
+			r.current += r.weight
+			total += r.weight
+			if best == nil || r.current > best.current {
+				best = r
+			}
+		}
+		best.current -= total
+		return best
+	case "least_outstanding":
+		// ties go round-robin so an idle pool is not served by one replica
+		var best *replica
+		for i := range up {
+			r := up[(b.next+i)%len(up)]
+			if best == nil || r.inFlight.Load()*int64(best.weight) < best.inFlight.Load()*int64(r.weight) {
+				best = r
+			}
+		}
+		b.next++
+		return best
+	}
+	r := up[b.next%len(up)]
+	b.next++
+	return r
+}
+
+// markDown takes r out of rotation for the cooldown.
+func (b *balancer) markDown(r *replica, err error, now time.Time) {
+	b.mu.Lock()
+	wasUp := r.downAt.IsZero() || now.Sub(r.downAt) >= b.cooldown
+	r.downAt = now
+	b.mu.Unlock()
+	if wasUp {
+		logf(slog.LevelWarn, "UPSTREAM: replica %s of %s marked down for %s: %v", r.url.Host, b.upstream, b.cooldown, err)
+	}
+}
+
+// markUp puts r back into rotation before its cooldown has passed.
+func (b *balancer) markUp(r *replica) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.downAt = time.Time{}
+}
+
+// route points req at r.
+func (b *balancer) route(req *http.Request, r *replica) {
+	req.URL.Scheme, req.URL.Host = r.url.Scheme, r.url.Host
+	replicaRequestsTotal.Inc(b.upstream, r.url.Host)
+}
+
+// replicaFailed reports whether a request error means the replica itself is
+// unusable rather than the client having gone away.
+func replicaFailed(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, context.Canceled)
+}
+
+type replicaReport struct {
+	URL            string `json:"url"`
+	Weight         int    `json:"weight"`
+	ActiveRequests int64  `json:"active_requests"`
+	Healthy        bool   `json:"healthy"`
+}
+
+func (b *balancer) report() []replicaReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var rep []replicaReport
+	for _, r := range b.replicas {
+		rep = append(rep, replicaReport{
+			URL:            r.url.String(),
+			Weight:         r.weight,
+			ActiveRequests: r.inFlight.Load(),
+			Healthy:        r.downAt.IsZero() || now.Sub(r.downAt) >= b.cooldown,
+		})
+	}
+	return rep
+}
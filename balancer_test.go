@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBalancerPolicies(t *testing.T) {
+	replicas := []Replica{{URL: "http://a:8000", Weight: 3}, {URL: "http://b:8000"}}
+	count := func(b *balancer, n int) map[string]int {
+		got := map[string]int{}
+		for i := 0; i < n; i++ {
+			got[b.pick("", time.Now()).url.Host]++
+		}
+		return got
+	}
+
+	rr := newBalancer(parseURL("http://llm"), UpstreamOptions{Replicas: replicas})
+	if got := count(rr, 4); got["a:8000"] != 2 || got["b:8000"] != 2 {
+		t.Errorf("round_robin: %v", got)
+	}
+	weighted := newBalancer(parseURL("http://llm"), UpstreamOptions{Replicas: replicas, Balance: "weighted"})
+	if got := count(weighted, 8); got["a:8000"] != 6 || got["b:8000"] != 2 {
+		t.Errorf("weighted: %v", got)
+	}
+
+	lo := newBalancer(parseURL("http://llm"), UpstreamOptions{Replicas: []Replica{{URL: "http://a:8000"}, {URL: "http://b:8000"}}, Balance: "least_outstanding"})
+	lo.replicas[0].inFlight.Add(2)
+	if got := count(lo, 3); got["b:8000"] != 3 {
+		t.Errorf("least_outstanding with a busy: %v", got)
+	}
+
+	// a replica marked down is skipped until the cooldown has passed
+	now := time.Now()
+	rr.markDown(rr.replicas[0], fmt.Errorf("connection refused"), now)
+	for i := 0; i < 3; i++ {
+		if r := rr.pick("", now.Add(time.Second)); r.url.Host != "b:8000" {
+			t.Fatalf("picked %s while it is down", r.url.Host)
+		}
+	}
+	if got := rr.pick("", now.Add(defaultReplicaCooldown)); got == nil {
+		t.Fatal("no replica after the cooldown")
+	}
+	// with every replica down all are used again
+	rr.markDown(rr.replicas[1], fmt.Errorf("connection refused"), now)
+	if r := rr.pick("", now.Add(time.Second)); r == nil {
+		t.Error("no replica when all are down")
+	}
+
+	// conversations stay on one replica
+	first := rr.pick("conv-a", now.Add(time.Hour)).url.Host
+	for i := 0; i < 3; i++ {
+		if got := rr.pick("conv-a", now.Add(time.Hour)).url.Host; got != first {
+			t.Fatalf("conversation moved from %s to %s", first, got)
+		}
+	}
+}
+
+func TestReplicaFailover(t *testing.T) {
+	var served int
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{Replicas: []Replica{{URL: dead.URL}, {URL: live.URL}}}}
+	send := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		proxyWithJSONPatch(w, r, parseURL("http://llm.invalid"), false, cfg, nil)
+		return w.Code
+	}
+	if code := send(); code != http.StatusBadGateway {
+		t.Fatalf("first request to the dead replica: status %d", code)
+	}
+	for i := 0; i < 4; i++ {
+		if code := send(); code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want the dead replica skipped", i, code)
+		}
+	}
+	if served != 4 {
+		t.Errorf("live replica served %d requests, want 4", served)
+	}
+	rep := upstreamFor(cfg, parseURL("http://llm.invalid")).transportReport()
+	if len(rep.Replicas) != 2 || rep.Replicas[0].Healthy || !rep.Replicas[1].Healthy {
+		t.Errorf("transport report replicas: %+v", rep.Replicas)
+	}
+}
+
+func TestValidateReplicas(t *testing.T) {
+	for _, o := range []UpstreamOptions{
+		{Replicas: []Replica{{URL: "a:8000"}}},
+		{Replicas: []Replica{{URL: "http://a:8000", Weight: -1}}},
+		{Replicas: []Replica{{URL: "http://a:8000"}}, Balance: "random"},
+		{Replicas: []Replica{{URL: "http://a:8000"}}, ReplicaCooldown: "soon"},
+	} {
+		if err := validateUpstreamOptions(&o); err == nil {
+			t.Errorf("%+v: no error", o)
+		}
+	}
+}
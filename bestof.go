@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// BestOfConfig generates several candidates for a chat completion and returns
+// only the best one.
+type BestOfConfig struct {
+	N            int       `json:"n"`            // candidates per request (2..16)
+	Temperatures []float64 `json:"temperatures"` // per-candidate temperature, cycled; empty keeps the request's
+	Scorer       string    `json:"scorer"`       // "heuristic" (default) or "judge"
+	JudgeModel   string    `json:"judge_model"`  // model asked to pick the best; defaults to the request's
+	JudgePrompt  string    `json:"judge_prompt"` // system prompt for the judge; a generic one is used when empty
+}
+
+const defaultJudgePrompt = "You are given a conversation and several candidate replies to it. " +
+	"Pick the candidate that answers the last message best: correct, complete and to the point. " +
+	"Reply with the candidate number only."
+
+var bestOfTotal = metrics.newCounterVec("relay_best_of_requests_total",
+	"Requests answered with the best of several generated candidates.", "tenant", "model", "scorer")
+
+func validateBestOf(b *BestOfConfig) error {
+	if b.N < 2 || b.N > maxEmulatedN {
+		return fmt.Errorf("best_of.n must be between 2 and %d", maxEmulatedN)
+	}
+	switch b.Scorer {
+	case "", "heuristic", "judge":
+	default:
+		return fmt.Errorf("unknown best_of.scorer %q", b.Scorer)
+	}
+	return nil
+}
+
+// bestOfFor returns the rule's best-of settings when they apply to the
+// request: a chat completion that asks for a single choice.
+func bestOfFor(rule *ModelRule, path string, payload map[string]any) *BestOfConfig {
+	if rule == nil || rule.BestOf == nil || !strings.HasSuffix(path, "/chat/completions") {
+		return nil
+	}
+	if n, _ := payload["n"].(float64); n > 1 {
+		return nil
+	}
+	return rule.BestOf
+}
+
+type bestOfCandidate struct {
+	resp    map[string]any
+	content string
+	finish  string
+}
+
+// bestOf generates the candidates for body, picks one and returns it as an
+// upstream response would look, streamed when the client asked for a stream.
+// When every candidate fails the last failure is returned.
+func bestOf(ctx context.Context, cfg *BestOfConfig, body []byte, stream bool, send func([]byte) (*http.Response, error), tenant, label string) (*http.Response, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	model := getString(payload, "model")
+
+	candidates := make([]*bestOfCandidate, cfg.N)
+	failures := make([]*http.Response, cfg.N)
+	errs := make([]error, cfg.N)
+	var wg sync.WaitGroup
+	for i := range cfg.N {
+		req := make(map[string]any, len(payload))
+		for k, v := range payload {
+			req[k] = v
+		}
+		req["stream"] = false
+		delete(req, "stream_options")
+		delete(req, "n")
+		if len(cfg.Temperatures) > 0 {
+			req["temperature"] = cfg.Temperatures[i%len(cfg.Temperatures)]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candidates[i], failures[i], errs[i] = generateCandidate(req, send)
+		}()
+	}
+	wg.Wait()
+
+	var ok []*bestOfCandidate
+	for _, c := range candidates {
+		if c != nil {
+			ok = append(ok, c)
+		}
+	}
+	var failure *http.Response
+	for _, f := range failures {
+		if f == nil {
+			continue
+		}
+		if failure != nil {
+			failure.Body.Close()
+		}
+		failure = f
+	}
+	if len(ok) == 0 {
+		if failure != nil {
+			return failure, nil
+		}
+		return nil, errors.Join(errs...)
+	}
+	if failure != nil {
+		failure.Body.Close()
+	}
+
+	best, scorer := 0, "heuristic"
+	if cfg.Scorer == "judge" && len(ok) > 1 {
+		if i, err := judgeCandidates(cfg, payload, ok, send); err != nil {
+			vlogCtx(ctx, "BESTOF: judge failed, falling back to heuristic: %v", err)
+			best = pickHeuristic(ok)
+		} else {
+			best, scorer = i, "judge"
+		}
+	} else {
+		best = pickHeuristic(ok)
+	}
+	vlogCtx(ctx, "BESTOF: picked candidate %d of %d for model '%s' (%s)", best+1, len(ok), model, scorer)
+	bestOfTotal.Inc(tenant, label, scorer)
+
+	// usage covers every candidate, since each of them was paid for
+	winner := ok[best].resp
+	var prompt, completion float64
+	for _, c := range ok {
+		u, _ := c.resp["usage"].(map[string]any)
+		p, _ := u["prompt_tokens"].(float64)
+		n, _ := u["completion_tokens"].(float64)
+		prompt += p
+		completion += n
+	}
+	if prompt+completion > 0 {
+		winner["usage"] = map[string]any{
+			"prompt_tokens":     prompt,
+			"completion_tokens": completion,
+			"total_tokens":      prompt + completion,
+		}
+	}
+
+	var out []byte
+	var err error
+	header := http.Header{}
+	if stream {
+		out, err = completionToSSE(winner, payload)
+		header.Set("Content-Type", "text/event-stream")
+	} else {
+		out, err = json.Marshal(winner)
+		header.Set("Content-Type", "application/json")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(out)),
+	}, nil
+}
+
+// generateCandidate sends one non-streaming request. A non-200 response is
+// returned unread so it can be relayed if no candidate succeeds.
+func generateCandidate(req map[string]any, send func([]byte) (*http.Response, error)) (*bestOfCandidate, *http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := send(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, nil, err
+	}
+	choices, _ := out["choices"].([]any)
+	if len(choices) == 0 {
+		return nil, nil, errors.New("candidate has no choices")
+	}
+	choice, _ := choices[0].(map[string]any)
+	msg, _ := choice["message"].(map[string]any)
+	out["choices"] = choices[:1]
+	return &bestOfCandidate{resp: out, content: getString(msg, "content"), finish: getString(choice, "finish_reason")}, nil, nil
+}
+
+// pickHeuristic prefers candidates that finished on their own, then the
+// longest answer.
+func pickHeuristic(cs []*bestOfCandidate) int {
+	best := 0
+	score := func(c *bestOfCandidate) (bool, int) {
+		return c.finish == "stop" || c.finish == "tool_calls", utf8.RuneCountInString(c.content)
+	}
+	for i := 1; i < len(cs); i++ {
+		done, n := score(cs[i])
+		bestDone, bestN := score(cs[best])
+		if (done && !bestDone) || (done == bestDone && n > bestN) {
+			best = i
+		}
+	}
+	return best
+}
+
+var judgeNumber = regexp.MustCompile(`\d+`)
+
+// judgeCandidates asks a model to pick the best candidate and returns its
+// position in cs.
+func judgeCandidates(cfg *BestOfConfig, payload map[string]any, cs []*bestOfCandidate, send func([]byte) (*http.Response, error)) (int, error) {
+	var b strings.Builder
+	b.WriteString("Conversation:\n")
+	messages, _ := payload["messages"].([]any)
+	for _, m := range messages {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		if text := messageText(msg); text != "" {
+			fmt.Fprintf(&b, "%s: %s\n", getString(msg, "role"), text)
+		}
+	}
+	for i, c := range cs {
+		fmt.Fprintf(&b, "\nCandidate %d:\n%s\n", i+1, c.content)
+	}
+
+	prompt := cfg.JudgePrompt
+	if prompt == "" {
+		prompt = defaultJudgePrompt
+	}
+	model := cfg.JudgeModel
+	if model == "" {
+		model = getString(payload, "model")
+	}
+	req := map[string]any{
+		"model":       model,
+		"temperature": 0,
+		"stream":      false,
+		"messages": []any{
+			map[string]any{"role": "system", "content": prompt},
+			map[string]any{"role": "user", "content": b.String()},
+		},
+	}
+	verdict, failure, err := generateCandidate(req, send)
+	if failure != nil {
+		failure.Body.Close()
+		return 0, fmt.Errorf("judge returned %s", failure.Status)
+	}
+	if err != nil {
+		return 0, err
+	}
+	m := judgeNumber.FindString(verdict.content)
+	n, err := strconv.Atoi(m)
+	if err != nil || n < 1 || n > len(cs) {
+		return 0, fmt.Errorf("judge gave no candidate number: %q", verdict.content)
+	}
+	return n - 1, nil
+}
+
+// messageText returns the text of a chat message, joining text parts.
+func messageText(msg map[string]any) string {
+	switch c := msg["content"].(type) {
+	case string:
+		return c
+	case []any:
+		var parts []string
+		for _, p := range c {
+			if part, ok := p.(map[string]any); ok && getString(part, "type") == "text" {
+				parts = append(parts, getString(part, "text"))
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// completionToSSE replays a chat completion as a stream: one delta with the
+// whole message, a finish chunk, usage when the client asked for it, and
+// [DONE].
+func completionToSSE(resp map[string]any, payload map[string]any) ([]byte, error) {
+	envelope := func(choices []any) map[string]any {
+		chunk := map[string]any{"object": "chat.completion.chunk", "choices": choices}
+		for _, k := range []string{"id", "created", "model", "system_fingerprint"} {
+			if v, ok := resp[k]; ok {
+				chunk[k] = v
+			}
+		}
+		return chunk
+	}
+	choices, _ := resp["choices"].([]any)
+	var chunks []map[string]any
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		delta := map[string]any{}
+		if msg, ok := choice["message"].(map[string]any); ok {
+			for k, v := range msg {
+				delta[k] = v
+			}
+			if calls, ok := delta["tool_calls"].([]any); ok {
+				for i, tc := range calls {
+					if call, ok := tc.(map[string]any); ok {
+						call["index"] = i
+					}
+				}
+			}
+		}
+		idx := choice["index"]
+		chunks = append(chunks,
+			envelope([]any{map[string]any{"index": idx, "delta": delta, "finish_reason": nil}}),
+			envelope([]any{map[string]any{"index": idx, "delta": map[string]any{}, "finish_reason": choice["finish_reason"]}}))
+	}
+	opts, _ := payload["stream_options"].(map[string]any)
+	if include, _ := opts["include_usage"].(bool); include && resp["usage"] != nil {
+		chunk := envelope([]any{})
+		chunk["usage"] = resp["usage"]
+		chunks = append(chunks, chunk)
+	}
+
+	var out bytes.Buffer
+	for _, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&out, "data: %s\n\n", data)
+	}
+	out.WriteString("data: [DONE]\n\n")
+	return out.Bytes(), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bestOfUpstream answers candidates by temperature and the judge with verdict.
+func bestOfUpstream(t *testing.T, verdict string, requests *[]map[string]any) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		*requests = append(*requests, body)
+		mu.Unlock()
+		if body["stream"] != false {
+			t.Errorf("upstream got stream = %v, want false", body["stream"])
+		}
+		content := verdict
+		if getString(body, "model") != "judge" {
+			content = map[float64]string{0.2: "short", 0.8: "a much longer answer", 1.4: "mid answer"}[body["temperature"].(float64)]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"c","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`, content)
+	}))
+}
+
+func TestBestOfHeuristic(t *testing.T) {
+	var requests []map[string]any
+	upstream := bestOfUpstream(t, "", &requests)
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", BestOf: &BestOfConfig{N: 3, Temperatures: []float64{0.2, 0.8, 1.4}}}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	if len(requests) != 3 {
+		t.Fatalf("upstream requests = %d, want 3", len(requests))
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage map[string]float64 `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "a much longer answer" {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if resp.Usage["total_tokens"] != 15 {
+		t.Errorf("usage = %v, want the sum over candidates", resp.Usage)
+	}
+}
+
+func TestBestOfJudgeStream(t *testing.T) {
+	var requests []map[string]any
+	upstream := bestOfUpstream(t, "Candidate 3 is best.", &requests)
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", BestOf: &BestOfConfig{
+		N: 3, Temperatures: []float64{0.2, 0.8, 1.4}, Scorer: "judge", JudgeModel: "judge",
+	}}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	if len(requests) != 4 {
+		t.Fatalf("upstream requests = %d, want 3 candidates and a judge", len(requests))
+	}
+	// candidates finish in any order, so the judge's third may be any of them
+	judge := requests[3]
+	prompt := judge["messages"].([]any)[1].(map[string]any)["content"].(string)
+	var third string
+	for _, c := range []string{"short", "a much longer answer", "mid answer"} {
+		if strings.Contains(prompt, "Candidate 3:\n"+c+"\n") {
+			third = c
+		}
+	}
+	content, finishes, _ := streamedContent(t, w.Body.String())
+	if content != third {
+		t.Errorf("content = %q, want the judge's pick %q", content, third)
+	}
+	if len(finishes) != 1 || finishes[0] != "stop" {
+		t.Errorf("finishes = %v, want [stop]", finishes)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]") {
+		t.Errorf("stream does not end with [DONE]:\n%s", w.Body.String())
+	}
+}
+
+func TestValidateBestOf(t *testing.T) {
+	for _, b := range []BestOfConfig{{N: 1}, {N: 3, Scorer: "vote"}} {
+		if err := validateModelRules([]ModelRule{{MatchModel: "m", BestOf: &b}}); err == nil {
+			t.Errorf("expected an error for %+v", b)
+		}
+	}
+}
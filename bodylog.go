@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BodyLogConfig persists the full request and response of every completion
+// to debug model behavior after the fact. Unlike transcripts nothing is kept
+// in memory or served back; entries only go to disk.
+type BodyLogConfig struct {
+	Path           string   `json:"path"`            // JSONL file every exchange is appended to
+	Dir            string   `json:"dir"`             // or a directory with one JSON file per exchange
+	MaxBodyBytes   int      `json:"max_body_bytes"`  // per body; default 1 MiB
+	RedactHeaders  []string `json:"redact_headers"`  // headers masked besides the credential headers
+	RedactFields   []string `json:"redact_fields"`   // JSON field names masked anywhere in bodies
+	RedactPatterns []string `json:"redact_patterns"` // regexes masked in bodies
+}
+
+// credentialHeaders are always masked in the body log.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Api-Key", "Cookie", "Set-Cookie", adminTokenHeader}
+
+// bodyLogEntry is one exchange. Bodies are embedded as JSON when they are
+// JSON and as strings otherwise (SSE streams, truncated or plain bodies).
+type bodyLogEntry struct {
+	ID              string      `json:"id"`
+	Time            time.Time   `json:"time"`
+	DurationMs      int64       `json:"duration_ms"`
+	Method          string      `json:"method"`
+	Path            string      `json:"path"`
+	Model           string      `json:"model"`
+	Tenant          string      `json:"tenant"`
+	Key             string      `json:"key,omitempty"` // client key fingerprint, never the key itself
+	Rule            string      `json:"rule,omitempty"`
+	Upstream        string      `json:"upstream,omitempty"`
+	Status          int         `json:"status"`
+	Stream          bool        `json:"stream"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	Request         any         `json:"request"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	Response        any         `json:"response"`
+	Reconstructed   any         `json:"reconstructed,omitempty"` // a stream put back together as one completion
+	Truncated       bool        `json:"truncated,omitempty"`
+}
+
+type bodyLog struct {
+	bodyRedactor
+	cfg     BodyLogConfig
+	headers []string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func validateBodyLog(c *BodyLogConfig) error {
+	if c == nil {
+		return nil
+	}
+	if (c.Path == "") == (c.Dir == "") {
+		return errors.New("body_log needs exactly one of path and dir")
+	}
+	if c.MaxBodyBytes < 0 {
+		return errors.New("body_log.max_body_bytes must not be negative")
+	}
+	_, err := newBodyRedactor("body_log", c.RedactFields, c.RedactPatterns)
+	return err
+}
+
+func newBodyLog(cfg BodyLogConfig) (*bodyLog, error) {
+	redactor, err := newBodyRedactor("body_log", cfg.RedactFields, cfg.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+	l := &bodyLog{bodyRedactor: redactor, cfg: cfg, headers: slices.Concat(credentialHeaders, cfg.RedactHeaders)}
+	if l.cfg.MaxBodyBytes == 0 {
+		l.cfg.MaxBodyBytes = 1 << 20
+	}
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	if l.file, err = os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *bodyLog) write(e *bodyLogEntry) {
+	if l.cfg.Dir != "" {
+		b, err := json.MarshalIndent(e, "", "  ")
+		if err == nil {
+			name := e.Time.UTC().Format("20060102T150405.000") + "-" + e.ID + ".json"
+			err = os.WriteFile(filepath.Join(l.cfg.Dir, name), b, 0o600)
+		}
+		if err != nil {
+			logf(slog.LevelError, "BODYLOG: write failed: %v", err)
+		}
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := json.NewEncoder(l.file).Encode(e); err != nil {
+		logf(slog.LevelError, "BODYLOG: append to %s failed: %v", l.cfg.Path, err)
+	}
+}
+
+// redactHeaders copies h with the credential and configured headers masked.
+func (l *bodyLog) redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range l.headers {
+		if vs := out.Values(name); len(vs) > 0 {
+			masked := make([]string, len(vs))
+			for i := range masked {
+				masked[i] = redactedValue
+			}
+			out[http.CanonicalHeaderKey(name)] = masked
+		}
+	}
+	return out
+}
+
+// bodyValue embeds a JSON body as JSON and anything else as a string.
+func bodyValue(body string) any {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	return body
+}
+
+// recordBodies wraps a completion handler so every exchange goes to the body
+// log, streams as sent to the client and put back together.
+func recordBodies(l *bodyLog, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqBody, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		reqHeaders := l.redactHeaders(r.Header)
+
+		cw := &captureWriter{ResponseWriter: w, limit: l.cfg.MaxBodyBytes}
+		next(cw, r)
+
+		var meta struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		_ = json.Unmarshal(reqBody, &meta)
+		truncated := cw.truncated
+		if len(reqBody) > l.cfg.MaxBodyBytes {
+			reqBody = reqBody[:l.cfg.MaxBodyBytes]
+			truncated = true
+		}
+		response := cw.buf.String()
+		e := &bodyLogEntry{
+			ID:              uuid.NewString(),
+			Time:            start,
+			DurationMs:      time.Since(start).Milliseconds(),
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			Model:           meta.Model,
+			Tenant:          tenantName(r.Context()),
+			Key:             keyFingerprint(bearerToken(r)),
+			Status:          cw.status,
+			Stream:          meta.Stream,
+			RequestHeaders:  reqHeaders,
+			Request:         bodyValue(l.redactBody(string(reqBody))),
+			ResponseHeaders: l.redactHeaders(w.Header()),
+			Response:        bodyValue(l.redactBody(response)),
+			Truncated:       truncated,
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			e.Rule, e.Upstream = info.rule, info.upstream
+		}
+		if meta.Stream && strings.Contains(response, "data: ") {
+			if c := reconstructStream(response); c != nil {
+				if b, err := json.Marshal(c); err == nil {
+					e.Reconstructed = bodyValue(l.redactBody(string(b)))
+				}
+			}
+		}
+		l.write(e)
+	}
+}
+
+// reconstructStream puts the chunks of a chat or text completion stream
+// back together as the single response the request would have received
+// without stream: the deltas of each choice concatenated, tool call
+// arguments joined per call, the last finish_reason and the usage.
+func reconstructStream(sse string) map[string]any {
+	type toolCall struct {
+		id, typ, name string
+		args          strings.Builder
+	}
+	type choice struct {
+		content, reasoning, text strings.Builder
+		role, finish             string
+		calls                    map[int]*toolCall
+		hasReasoning             bool
+	}
+	var out map[string]any
+	choices := map[int]*choice{}
+	chat := false
+	for _, line := range strings.Split(sse, "\n") {
+		data, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			ID      string `json:"id"`
+			Object  string `json:"object"`
+			Created int64  `json:"created"`
+			Model   string `json:"model"`
+			Usage   any    `json:"usage"`
+			Choices []struct {
+				Index        int     `json:"index"`
+				Text         *string `json:"text"`
+				FinishReason *string `json:"finish_reason"`
+				Delta        struct {
+					Role             string  `json:"role"`
+					Content          *string `json:"content"`
+					ReasoningContent *string `json:"reasoning_content"`
+					ToolCalls        []struct {
+						Index    int    `json:"index"`
+						ID       string `json:"id"`
+						Type     string `json:"type"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(data), &chunk) != nil {
+			continue
+		}
+		if out == nil {
+			out = map[string]any{"id": chunk.ID, "created": chunk.Created, "model": chunk.Model}
+		}
+		if chunk.Object == "chat.completion.chunk" {
+			chat = true
+		}
+		if chunk.Usage != nil {
+			out["usage"] = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			ch := choices[c.Index]
+			if ch == nil {
+				ch = &choice{calls: map[int]*toolCall{}}
+				choices[c.Index] = ch
+			}
+			if c.FinishReason != nil {
+				ch.finish = *c.FinishReason
+			}
+			if c.Text != nil {
+				ch.text.WriteString(*c.Text)
+				continue
+			}
+			chat = true
+			if c.Delta.Role != "" {
+				ch.role = c.Delta.Role
+			}
+			if c.Delta.Content != nil {
+				ch.content.WriteString(*c.Delta.Content)
+			}
+			if c.Delta.ReasoningContent != nil {
+				ch.reasoning.WriteString(*c.Delta.ReasoningContent)
+				ch.hasReasoning = true
+			}
+			for _, tc := range c.Delta.ToolCalls {
+				call := ch.calls[tc.Index]
+				if call == nil {
+					call = &toolCall{}
+					ch.calls[tc.Index] = call
+				}
+				if tc.ID != "" {
+					call.id = tc.ID
+				}
+				if tc.Type != "" {
+					call.typ = tc.Type
+				}
+				call.name += tc.Function.Name
+				call.args.WriteString(tc.Function.Arguments)
+			}
+		}
+	}
+	if out == nil {
+		return nil
+	}
+
+	indexes := make([]int, 0, len(choices))
+	for i := range choices {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	list := make([]any, 0, len(indexes))
+	for _, i := range indexes {
+		ch := choices[i]
+		var finish any
+		if ch.finish != "" {
+			finish = ch.finish
+		}
+		if !chat {
+			list = append(list, map[string]any{"index": i, "text": ch.text.String(), "finish_reason": finish})
+			continue
+		}
+		role := ch.role
+		if role == "" {
+			role = "assistant"
+		}
+		msg := map[string]any{"role": role, "content": ch.content.String()}
+		if ch.hasReasoning {
+			msg["reasoning_content"] = ch.reasoning.String()
+		}
+		if len(ch.calls) > 0 {
+			callIdx := make([]int, 0, len(ch.calls))
+			for j := range ch.calls {
+				callIdx = append(callIdx, j)
+			}
+			sort.Ints(callIdx)
+			calls := make([]any, 0, len(callIdx))
+			for _, j := range callIdx {
+				call := ch.calls[j]
+				typ := call.typ
+				if typ == "" {
+					typ = "function"
+				}
+				calls = append(calls, map[string]any{
+					"id": call.id, "type": typ,
+					"function": map[string]any{"name": call.name, "arguments": call.args.String()},
+				})
+			}
+			msg["tool_calls"] = calls
+		}
+		list = append(list, map[string]any{"index": i, "message": msg, "finish_reason": finish})
+	}
+	out["choices"] = list
+	if chat {
+		out["object"] = "chat.completion"
+	} else {
+		out["object"] = "text_completion"
+	}
+	return out
+}
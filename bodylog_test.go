@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBodyLogJSONL(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=s3cret")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"call 555-1234"}}]}`)
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "bodies.jsonl")
+	cfg := &Config{Upstream: upstream.URL, BodyLog: &BodyLogConfig{
+		Path:           path,
+		RedactHeaders:  []string{"X-Customer"},
+		RedactFields:   []string{"user"},
+		RedactPatterns: []string{`\d{3}-\d{4}`},
+	}}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","user":"alice","messages":[{"role":"user","content":"hi"}]}`))
+	r.Header.Set("Authorization", "Bearer sk-secret")
+	r.Header.Set("X-Customer", "acme")
+	r.Header.Set("X-Trace", "t1")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "555-1234") {
+		t.Fatalf("client got %d %s; the log must not alter responses", w.Code, w.Body)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"sk-secret", "acme", "alice", "555-1234", "s3cret"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("%q not redacted: %s", secret, raw)
+		}
+	}
+	var e struct {
+		Model          string
+		Status         int
+		Key            string
+		RequestHeaders http.Header `json:"request_headers"`
+		Request        map[string]any
+		Response       map[string]any
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		t.Fatalf("%v: %s", err, raw)
+	}
+	if e.Model != "m" || e.Status != 200 || !strings.HasPrefix(e.Key, "sha256:") {
+		t.Errorf("entry = %+v", e)
+	}
+	if e.RequestHeaders.Get("Authorization") != redactedValue || e.RequestHeaders.Get("X-Trace") != "t1" {
+		t.Errorf("request headers = %v", e.RequestHeaders)
+	}
+	if e.Request["user"] != redactedValue || e.Response["choices"] == nil {
+		t.Errorf("bodies not embedded as JSON: %v %v", e.Request, e.Response)
+	}
+}
+
+func TestBodyLogDirReconstructsStreams(t *testing.T) {
+	stream := `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"think"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hel"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"lo","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"ls","arguments":"{\"dir\":"}}]},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"/tmp\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"total_tokens":9}}
+
+data: [DONE]
+
+`
+	dir := t.TempDir()
+	l, err := newBodyLog(BodyLogConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := recordBodies(l, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, stream)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`)))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("files = %v", files)
+	}
+	raw, _ := os.ReadFile(files[0])
+	var e struct {
+		Stream        bool
+		Response      string
+		Reconstructed map[string]any
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Stream || e.Response != stream {
+		t.Errorf("stream not logged as sent: %q", e.Response)
+	}
+	got, _ := json.Marshal(e.Reconstructed)
+	want := `{"choices":[{"finish_reason":"tool_calls","index":0,"message":{"content":"Hello","reasoning_content":"think","role":"assistant","tool_calls":[{"function":{"arguments":"{\"dir\":\"/tmp\"}","name":"ls"},"id":"call_1","type":"function"}]}}],"created":1,"id":"c1","model":"m","object":"chat.completion","usage":{"total_tokens":9}}`
+	if string(got) != want {
+		t.Errorf("reconstructed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidateBodyLog(t *testing.T) {
+	for _, c := range []BodyLogConfig{{}, {Path: "a", Dir: "b"}, {Path: "a", MaxBodyBytes: -1}, {Dir: "b", RedactPatterns: []string{"("}}} {
+		if validateBodyLog(&c) == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
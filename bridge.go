@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// apiBridge translates between the API the client called and the API the
+// upstream actually exposes (see ModelRule.UpstreamAPI).
+type apiBridge struct {
+	name            string
+	fromSuffix      string // client path suffix, e.g. "/chat/completions"
+	toSuffix        string // upstream path suffix, e.g. "/completions"
+	convertRequest  func(rule *ModelRule, req map[string]any) error
+	convertResponse func(resp map[string]any)
+	// newChunkConverter returns a per-stream converter, since chunk
+	// translation may need to remember what was already emitted.
+	newChunkConverter func() func(chunk map[string]any)
+}
+
+var chatToCompletionsBridge = &apiBridge{
+	name:              "chat->completions",
+	fromSuffix:        "/chat/completions",
+	toSuffix:          "/completions",
+	convertRequest:    chatToCompletionsRequest,
+	convertResponse:   completionToChatResponse,
+	newChunkConverter: newCompletionToChatChunkConverter,
+}
+
+var completionsToChatBridge = &apiBridge{
+	name:              "completions->chat",
+	fromSuffix:        "/completions",
+	toSuffix:          "/chat/completions",
+	convertRequest:    completionsToChatRequest,
+	convertResponse:   chatToCompletionResponse,
+	newChunkConverter: newChatToCompletionChunkConverter,
+}
+
+// newAPIBridge returns the bridge needed to serve path with the rule's
+// upstream API, or nil when the request can be forwarded as-is.
+func newAPIBridge(rule *ModelRule, path string) *apiBridge {
+	if rule == nil {
+		return nil
+	}
+	switch rule.UpstreamAPI {
+	case "completions":
+		if strings.HasSuffix(path, chatToCompletionsBridge.fromSuffix) {
+			return chatToCompletionsBridge
+		}
+	case "chat":
+		if strings.HasSuffix(path, completionsToChatBridge.fromSuffix) &&
+			!strings.HasSuffix(path, completionsToChatBridge.toSuffix) {
+			return completionsToChatBridge
+		}
+	}
+	return nil
+}
+
+// upstreamPath rewrites the client path to the upstream endpoint.
+func (b *apiBridge) upstreamPath(path string) string {
+	return strings.TrimSuffix(path, b.fromSuffix) + b.toSuffix
+}
+
+// convertBody translates a complete non-streaming upstream response.
+func (b *apiBridge) convertBody(body []byte) ([]byte, error) {
+	var resp map[string]any
+	if err := decodeResponse(body, &resp); err != nil {
+		return nil, fmt.Errorf("decode upstream response: %w", err)
+	}
+	b.convertResponse(resp)
+	return json.Marshal(resp)
+}
+
+// convertStream translates an upstream SSE stream line by line. The returned
+// reader must be closed so the converting goroutine can exit.
+func (b *apiBridge) convertStream(src io.Reader) io.ReadCloser {
+	convert := b.newChunkConverter()
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(src)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				out := convertSSELine(strings.TrimRight(line, "\r\n"), convert)
+				if _, werr := io.WriteString(pw, out+"\n"); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					pw.Close()
+				} else {
+					pw.CloseWithError(err)
+				}
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// convertSSELine applies convert to a "data: {json}" line; anything else
+// ([DONE], comments, blank separators) passes through unchanged.
+func convertSSELine(line string, convert func(map[string]any)) string {
+	if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+		return line
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return line
+	}
+	convert(chunk)
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return "data: " + string(out)
+}
+
+// chatToCompletionsRequest renders the chat messages with the rule's prompt
+// template and drops fields the completions API does not understand.
+func chatToCompletionsRequest(rule *ModelRule, req map[string]any) error {
+	if _, ok := req["messages"]; !ok {
+		return errors.New("messages is required")
+	}
+	if err := applyPromptTemplate(rule, req); err != nil {
+		return err
+	}
+	if v, ok := req["max_completion_tokens"]; ok {
+		if _, exists := req["max_tokens"]; !exists {
+			req["max_tokens"] = v
+		}
+		delete(req, "max_completion_tokens")
+	}
+	for _, k := range []string{"tools", "tool_choice", "parallel_tool_calls", "functions", "function_call"} {
+		delete(req, k)
+	}
+	return nil
+}
+
+// completionToChatResponse turns a text_completion object into chat.completion.
+func completionToChatResponse(resp map[string]any) {
+	resp["object"] = "chat.completion"
+	choices, _ := resp["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		choice["message"] = map[string]any{
+			"role":    "assistant",
+			"content": getString(choice, "text"),
+		}
+		delete(choice, "text")
+	}
+}
+
+// newCompletionToChatChunkConverter turns text_completion stream chunks into
+// chat.completion.chunk, adding the assistant role to each choice's first delta.
+func newCompletionToChatChunkConverter() func(map[string]any) {
+	started := map[float64]bool{}
+	return func(chunk map[string]any) {
+		chunk["object"] = "chat.completion.chunk"
+		choices, _ := chunk["choices"].([]any)
+		for _, c := range choices {
+			choice, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			delta := map[string]any{"content": getString(choice, "text")}
+			idx, _ := choice["index"].(float64)
+			if !started[idx] {
+				delta["role"] = "assistant"
+				started[idx] = true
+			}
+			choice["delta"] = delta
+			delete(choice, "text")
+		}
+	}
+}
+
+// completionsToChatRequest maps a legacy prompt onto a single user message and
+// translates the completions-only sampling fields.
+func completionsToChatRequest(_ *ModelRule, req map[string]any) error {
+	prompt, ok := req["prompt"]
+	if !ok {
+		if _, hasMessages := req["messages"]; hasMessages {
+			return nil
+		}
+		return errors.New("prompt is required")
+	}
+	if arr, isArr := prompt.([]any); isArr {
+		if len(arr) != 1 {
+			return errors.New("batched prompts are not supported by the chat upstream")
+		}
+		prompt = arr[0]
+	}
+	text, ok := prompt.(string)
+	if !ok {
+		return errors.New("prompt must be a string")
+	}
+	if echo, _ := req["echo"].(bool); echo {
+		return errors.New("echo is not supported by the chat upstream")
+	}
+
+	delete(req, "prompt")
+	req["messages"] = []any{map[string]any{"role": "user", "content": text}}
+
+	// completions uses an integer logprobs; chat uses a bool plus top_logprobs
+	if n, ok := req["logprobs"].(float64); ok {
+		req["logprobs"] = true
+		if n > 0 {
+			req["top_logprobs"] = n
+		}
+	}
+	for _, k := range []string{"suffix", "echo", "best_of"} {
+		delete(req, k)
+	}
+	return nil
+}
+
+// chatToCompletionResponse turns a chat.completion object into text_completion.
+func chatToCompletionResponse(resp map[string]any) {
+	resp["object"] = "text_completion"
+	choices, _ := resp["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		msg, _ := choice["message"].(map[string]any)
+		choice["text"] = getString(msg, "content")
+		delete(choice, "message")
+	}
+}
+
+// newChatToCompletionChunkConverter turns chat.completion.chunk deltas back
+// into text_completion chunks.
+func newChatToCompletionChunkConverter() func(map[string]any) {
+	return func(chunk map[string]any) {
+		chunk["object"] = "text_completion"
+		choices, _ := chunk["choices"].([]any)
+		for _, c := range choices {
+			choice, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			delta, _ := choice["delta"].(map[string]any)
+			choice["text"] = getString(delta, "content")
+			delete(choice, "delta")
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatToCompletionsBridge(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+
+		if stream, _ := gotBody["stream"].(bool); stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(w, `data: {"id":"cmpl-1","object":"text_completion","created":1,"model":"raw","choices":[{"index":0,"text":"Hel","logprobs":null,"finish_reason":null}]}`)
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, `data: {"id":"cmpl-1","object":"text_completion","created":1,"model":"raw","choices":[{"index":0,"text":"lo","logprobs":null,"finish_reason":"stop"}]}`)
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, `data: [DONE]`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"cmpl-1","object":"text_completion","created":1,"model":"raw","choices":[{"index":0,"text":"Hello","logprobs":null,"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		ModelRules: []ModelRule{
+			{MatchModel: "raw", PromptTemplate: "chatml", UpstreamAPI: "completions"},
+		},
+	}
+	patcher := func(req map[string]any) error {
+		applyRules(cfg, req)
+		return nil
+	}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		body := `{"model":"raw","messages":[{"role":"user","content":"Hi"}],"tools":[{"type":"function"}],"max_completion_tokens":16}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, patcher)
+
+		if gotPath != "/v1/completions" {
+			t.Errorf("expected upstream path /v1/completions, got %s", gotPath)
+		}
+		if gotBody["prompt"] != "<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n" {
+			t.Errorf("unexpected rendered prompt: %v", gotBody["prompt"])
+		}
+		if _, exists := gotBody["messages"]; exists {
+			t.Errorf("messages should not be forwarded")
+		}
+		if _, exists := gotBody["tools"]; exists {
+			t.Errorf("tools should not be forwarded")
+		}
+		if gotBody["max_tokens"] != float64(16) {
+			t.Errorf("max_completion_tokens should map to max_tokens, got %v", gotBody["max_tokens"])
+		}
+
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response json: %v (%s)", err, w.Body.String())
+		}
+		if resp["object"] != "chat.completion" {
+			t.Errorf("expected object chat.completion, got %v", resp["object"])
+		}
+		choice := resp["choices"].([]any)[0].(map[string]any)
+		msg := choice["message"].(map[string]any)
+		if msg["role"] != "assistant" || msg["content"] != "Hello" {
+			t.Errorf("unexpected message: %v", msg)
+		}
+		if _, exists := choice["text"]; exists {
+			t.Errorf("text should be removed from choice")
+		}
+		if resp["usage"] == nil {
+			t.Errorf("usage should be preserved")
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		body := `{"model":"raw","messages":[{"role":"user","content":"Hi"}],"stream":true}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, patcher)
+
+		out, _ := io.ReadAll(w.Result().Body)
+		var content strings.Builder
+		roles := 0
+		for _, line := range strings.Split(string(out), "\n") {
+			if !strings.HasPrefix(line, "data: {") {
+				continue
+			}
+			var chunk map[string]any
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+				t.Fatalf("invalid chunk: %v", err)
+			}
+			if chunk["object"] != "chat.completion.chunk" {
+				t.Errorf("expected chat.completion.chunk, got %v", chunk["object"])
+			}
+			delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+			if delta["role"] == "assistant" {
+				roles++
+			}
+			content.WriteString(delta["content"].(string))
+		}
+		if content.String() != "Hello" {
+			t.Errorf("expected streamed content Hello, got %q", content.String())
+		}
+		if roles != 1 {
+			t.Errorf("expected role on first delta only, got %d", roles)
+		}
+		if !bytes.Contains(out, []byte("data: [DONE]")) {
+			t.Errorf("expected [DONE] to pass through")
+		}
+	})
+}
+
+func TestNewAPIBridge(t *testing.T) {
+	rule := &ModelRule{UpstreamAPI: "completions"}
+	if b := newAPIBridge(rule, "/v1/chat/completions"); b != chatToCompletionsBridge {
+		t.Errorf("expected chat->completions bridge")
+	}
+	if b := newAPIBridge(rule, "/v1/completions"); b != nil {
+		t.Errorf("completions requests need no bridge, got %s", b.name)
+	}
+	if b := newAPIBridge(&ModelRule{}, "/v1/chat/completions"); b != nil {
+		t.Errorf("rules without upstream_api need no bridge")
+	}
+	if b := newAPIBridge(nil, "/v1/chat/completions"); b != nil {
+		t.Errorf("nil rule needs no bridge")
+	}
+}
+
+func TestCompletionsToChatBridge(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+
+		if stream, _ := gotBody["stream"].(bool); stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(w, `data: {"id":"c-1","object":"chat.completion.chunk","created":1,"model":"chat","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`)
+			fmt.Fprintln(w, `data: {"id":"c-1","object":"chat.completion.chunk","created":1,"model":"chat","choices":[{"index":0,"delta":{"content":"42"},"finish_reason":"stop"}]}`)
+			fmt.Fprintln(w, `data: [DONE]`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"c-1","object":"chat.completion","created":1,"model":"chat","choices":[{"index":0,"message":{"role":"assistant","content":"42"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "chat", UpstreamAPI: "chat"}}}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		body := `{"model":"chat","prompt":"What is 6*7?","logprobs":2,"echo":false,"best_of":1}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		if gotPath != "/v1/chat/completions" {
+			t.Errorf("expected upstream path /v1/chat/completions, got %s", gotPath)
+		}
+		msgs, _ := gotBody["messages"].([]any)
+		if len(msgs) != 1 || msgs[0].(map[string]any)["content"] != "What is 6*7?" {
+			t.Errorf("prompt should map to a single user message, got %v", gotBody["messages"])
+		}
+		if gotBody["logprobs"] != true || gotBody["top_logprobs"] != float64(2) {
+			t.Errorf("logprobs should map to chat form, got %v / %v", gotBody["logprobs"], gotBody["top_logprobs"])
+		}
+		for _, k := range []string{"prompt", "echo", "best_of"} {
+			if _, exists := gotBody[k]; exists {
+				t.Errorf("%s should not be forwarded", k)
+			}
+		}
+
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response json: %v", err)
+		}
+		choice := resp["choices"].([]any)[0].(map[string]any)
+		if resp["object"] != "text_completion" || choice["text"] != "42" {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		body := `{"model":"chat","prompt":["What is 6*7?"],"stream":true}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		out := w.Body.String()
+		if strings.Contains(out, `"delta"`) {
+			t.Errorf("deltas should be converted to text: %s", out)
+		}
+		if !strings.Contains(out, `"text":"42"`) || !strings.Contains(out, `"object":"text_completion"`) {
+			t.Errorf("expected text_completion chunks, got %s", out)
+		}
+	})
+
+	t.Run("batched prompts rejected", func(t *testing.T) {
+		body := `{"model":"chat","prompt":["a","b"]}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
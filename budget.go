@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientBudget caps what a client key may spend per UTC day and calendar
+// month. Once a cap is reached, requests are refused until it resets.
+type ClientBudget struct {
+	DailyTokens   int64   `json:"daily_tokens"`   // total tokens per day (0 = unlimited)
+	MonthlyTokens int64   `json:"monthly_tokens"` // total tokens per month (0 = unlimited)
+	DailyCost     float64 `json:"daily_cost"`     // cost per day from the prices table (0 = unlimited)
+	MonthlyCost   float64 `json:"monthly_cost"`   // cost per month from the prices table (0 = unlimited)
+}
+
+var budgetRejectionsTotal = metrics.newCounterVec("relay_budget_rejections_total",
+	"Requests refused because the client key's budget was spent.", "client", "budget")
+
+func validateBudgets(cfg *Config) error {
+	for i, k := range cfg.ClientKeys {
+		b := k.Budget
+		if b == nil {
+			continue
+		}
+		if b.DailyTokens < 0 || b.MonthlyTokens < 0 || b.DailyCost < 0 || b.MonthlyCost < 0 {
+			return fmt.Errorf("client_keys[%d].budget: limits must not be negative", i)
+		}
+		if (b.DailyCost > 0 || b.MonthlyCost > 0) && len(cfg.Prices) == 0 {
+			return fmt.Errorf("client_keys[%d].budget: cost limits need a prices table", i)
+		}
+	}
+	return nil
+}
+
+// budgetSpend is what a key spent in the current day and month.
+type budgetSpend struct {
+	DayTokens   int64   `json:"day_tokens"`
+	MonthTokens int64   `json:"month_tokens"`
+	DayCost     float64 `json:"day_cost"`
+	MonthCost   float64 `json:"month_cost"`
+}
+
+// budgetState tracks one key's spending. Requests are admitted while every
+// limit still has room, so the request that crosses a limit completes and
+// the key is refused from the next one on.
+type budgetState struct {
+	client string
+	limits ClientBudget
+
+	mu         sync.Mutex
+	day, month time.Time // start of the current windows, UTC
+	spent      budgetSpend
+}
+
+// budgetError tells the client which budget is spent and when it resets.
+type budgetError struct {
+	budget      string // "daily_tokens", "monthly_cost", ...
+	used, limit string
+	resets      time.Time
+	retryAfter  time.Duration
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("You exceeded the %s budget of this API key: used %s of %s. The budget resets at %s.",
+		e.budget, e.used, e.limit, e.resets.Format(time.RFC3339))
+}
+
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *budgetState) roll(now time.Time) {
+	if d := dayStart(now); !d.Equal(s.day) {
+		s.day, s.spent.DayTokens, s.spent.DayCost = d, 0, 0
+	}
+	if m := monthStart(now); !m.Equal(s.month) {
+		s.month, s.spent.MonthTokens, s.spent.MonthCost = m, 0, 0
+	}
+}
+
+// check returns the first spent budget, or nil.
+func (s *budgetState) check(now time.Time) *budgetError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(now)
+	nextDay, nextMonth := s.day.AddDate(0, 0, 1), s.month.AddDate(0, 1, 0)
+	tokens := func(used, limit int64) (string, string) {
+		return strconv.FormatInt(used, 10) + " tokens", strconv.FormatInt(limit, 10) + " tokens"
+	}
+	cost := func(used, limit float64) (string, string) {
+		return strconv.FormatFloat(used, 'f', -1, 64), strconv.FormatFloat(limit, 'f', -1, 64)
+	}
+	var e *budgetError
+	switch l := s.limits; {
+	case l.DailyTokens > 0 && s.spent.DayTokens >= l.DailyTokens:
+		e = &budgetError{budget: "daily_tokens", resets: nextDay}
+		e.used, e.limit = tokens(s.spent.DayTokens, l.DailyTokens)
+	case l.DailyCost > 0 && s.spent.DayCost >= l.DailyCost:
+		e = &budgetError{budget: "daily_cost", resets: nextDay}
+		e.used, e.limit = cost(s.spent.DayCost, l.DailyCost)
+	case l.MonthlyTokens > 0 && s.spent.MonthTokens >= l.MonthlyTokens:
+		e = &budgetError{budget: "monthly_tokens", resets: nextMonth}
+		e.used, e.limit = tokens(s.spent.MonthTokens, l.MonthlyTokens)
+	case l.MonthlyCost > 0 && s.spent.MonthCost >= l.MonthlyCost:
+		e = &budgetError{budget: "monthly_cost", resets: nextMonth}
+		e.used, e.limit = cost(s.spent.MonthCost, l.MonthlyCost)
+	default:
+		return nil
+	}
+	e.retryAfter = e.resets.Sub(now)
+	return e
+}
+
+// charge adds a finished request to the windows it started in, unless
+// they have been rolled over since.
+func (s *budgetState) charge(start time.Time, tokens int64, cost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dayStart(start).Equal(s.day) {
+		s.spent.DayTokens += tokens
+		s.spent.DayCost += cost
+	}
+	if monthStart(start).Equal(s.month) {
+		s.spent.MonthTokens += tokens
+		s.spent.MonthCost += cost
+	}
+}
+
+func (s *budgetState) snapshot(now time.Time) budgetSpend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(now)
+	return s.spent
+}
+
+// newBudgets returns the state of every key with a budget, by key. With a
+// usage ledger the current day and month are read back from it, so a
+// restart does not hand out a fresh budget.
+func newBudgets(cfg *Config) map[string]*budgetState {
+	budgets := map[string]*budgetState{}
+	now := time.Now()
+	for _, k := range cfg.ClientKeys {
+		if k.Budget == nil || *k.Budget == (ClientBudget{}) {
+			continue
+		}
+		s := &budgetState{client: k.label(), limits: *k.Budget}
+		s.roll(now)
+		if cfg.usage != nil {
+			if err := s.restore(cfg.usage); err != nil {
+				logf(slog.LevelWarn, "BUDGET: could not read the spending of client '%s' from the usage ledger: %v", s.client, err)
+			}
+		}
+		budgets[k.Key] = s
+	}
+	return budgets
+}
+
+func (s *budgetState) restore(l *usageLedger) error {
+	ctx := context.Background()
+	month, err := l.query(ctx, usageQuery{From: s.month, Client: s.client})
+	if err != nil {
+		return err
+	}
+	day, err := l.query(ctx, usageQuery{From: s.day, Client: s.client})
+	if err != nil {
+		return err
+	}
+	for _, row := range month {
+		s.spent.MonthTokens += row.TotalTokens
+		s.spent.MonthCost += row.Cost
+	}
+	for _, row := range day {
+		s.spent.DayTokens += row.TotalTokens
+		s.spent.DayCost += row.Cost
+	}
+	return nil
+}
+
+// enforceBudgets refuses requests from keys whose budget is spent and
+// charges each finished request to its key. It runs inside clientAuth.
+func enforceBudgets(idx clientKeyIndex, budgets map[string]*budgetState, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, _ := idx.authenticate(r)
+		s := budgets[bearerToken(r)]
+		if k == nil || s == nil {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		if err := s.check(start); err != nil {
+			vlogCtx(r.Context(), "BUDGET: client '%s' has spent its %s budget (%s of %s)", s.client, err.budget, err.used, err.limit)
+			budgetRejectionsTotal.Inc(s.client, err.budget)
+			w.Header().Set("Retry-After", strconv.Itoa(int((err.retryAfter+time.Second-1)/time.Second)))
+			writeJSONError(w, http.StatusTooManyRequests, err.Error(), "insufficient_quota", "insufficient_quota")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		info := requestInfoFrom(r.Context())
+		if info == nil {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		}
+		next(w, r)
+
+		tokens := int64(info.usage.TotalTokens)
+		if tokens == 0 && info.upstream != "" {
+			// sent upstream without usage reported; the prompt was certainly spent
+			var payload map[string]any
+			_ = json.Unmarshal(body, &payload)
+			prompt, _ := estimateRequestTokens(payload)
+			tokens = int64(prompt)
+		}
+		s.charge(start, tokens, info.cost)
+	}
+}
+
+type budgetStatus struct {
+	Client string       `json:"client"`
+	Limits ClientBudget `json:"limits"`
+	Spent  budgetSpend  `json:"spent"`
+}
+
+// handleBudgets serves GET /admin/budgets: each key's limits and what it
+// spent this day and month.
+func handleBudgets(budgets map[string]*budgetState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		now := time.Now()
+		data := make([]budgetStatus, 0, len(budgets))
+		for _, s := range budgets {
+			data = append(data, budgetStatus{Client: s.client, Limits: s.limits, Spent: s.snapshot(now)})
+		}
+		sort.Slice(data, func(i, j int) bool { return data[i].Client < data[j].Client })
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBudgetState(t *testing.T) {
+	s := &budgetState{client: "c", limits: ClientBudget{DailyTokens: 100, MonthlyCost: 1}}
+	now := time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC)
+	if e := s.check(now); e != nil {
+		t.Fatal(e)
+	}
+	s.charge(now, 100, 0.5)
+	e := s.check(now)
+	if e == nil || e.budget != "daily_tokens" || e.retryAfter != time.Hour || !strings.Contains(e.Error(), "used 100 tokens of 100 tokens") {
+		t.Fatalf("after the daily limit: %v", e)
+	}
+
+	// the day resets at midnight UTC, the month on the first
+	feb := now.Add(2 * time.Hour)
+	if e := s.check(feb); e != nil {
+		t.Errorf("next day: %v", e)
+	}
+	s.charge(feb, 1, 1)
+	if e := s.check(feb); e == nil || e.budget != "monthly_cost" || !e.resets.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("after the monthly cost: %v", e)
+	}
+
+	// a request that started in an old window is not charged to the new one
+	s.charge(now, 1000, 0)
+	if got := s.snapshot(feb); got.DayTokens != 1 || got.MonthCost != 1 {
+		t.Errorf("spent %+v", got)
+	}
+}
+
+func TestEnforceBudgets(t *testing.T) {
+	var calls int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+
+	ledger := filepath.Join(t.TempDir(), "usage.jsonl")
+	newRelay := func() (http.Handler, *Config) {
+		cfg := &Config{
+			Upstream: upstream.URL,
+			Admin:    &AdminConfig{Token: "admin"},
+			ClientKeys: []ClientKey{
+				{Key: "sk-capped", Name: "capped", Budget: &ClientBudget{DailyTokens: 20}},
+				{Key: "sk-free", Name: "free"},
+			},
+			UsageLedger: &UsageLedgerConfig{Path: ledger},
+		}
+		mux, err := newRelayMux(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loggingMiddleware(mux), cfg
+	}
+	send := func(h http.Handler, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`))
+		r.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	relay, cfg := newRelay()
+	// the request crossing the limit still runs
+	for i := range 2 {
+		if w := send(relay, "sk-capped"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	w := send(relay, "sk-capped")
+	var body struct {
+		Error struct{ Message, Type, Code string }
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusTooManyRequests || body.Error.Code != "insufficient_quota" ||
+		!strings.Contains(body.Error.Message, "daily_tokens budget") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over budget: %d %s %v", w.Code, w.Body, w.Header())
+	}
+	if calls != 2 || budgetRejectionsTotal.Value("capped", "daily_tokens") == 0 {
+		t.Errorf("%d upstream calls", calls)
+	}
+	if w := send(relay, "sk-free"); w.Code != http.StatusOK {
+		t.Errorf("key without a budget: %d", w.Code)
+	}
+
+	aw := httptest.NewRecorder()
+	ar := httptest.NewRequest("GET", "/admin/budgets", nil)
+	ar.Header.Set("Authorization", "Bearer admin")
+	relay.ServeHTTP(aw, ar)
+	if !strings.Contains(aw.Body.String(), `"client":"capped","limits":{"daily_tokens":20,`) || !strings.Contains(aw.Body.String(), `"day_tokens":30`) {
+		t.Errorf("/admin/budgets: %s", aw.Body)
+	}
+
+	// what was spent today survives a restart through the usage ledger
+	if err := cfg.usage.flush(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	restarted, _ := newRelay()
+	if w := send(restarted, "sk-capped"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("after a restart: %d", w.Code)
+	}
+
+	if err := validateBudgets(&Config{ClientKeys: []ClientKey{{Key: "k", Budget: &ClientBudget{DailyCost: 1}}}}); err == nil {
+		t.Error("accepted a cost budget without prices")
+	}
+}
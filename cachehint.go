@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// CacheHintConfig attaches a stable hint to upstream requests so that a
+// backend with prefix caching (e.g. vLLM) keeps requests that share a
+// prefix together: in the same cache namespace via cache_salt, or on the
+// same replica via a routing header.
+type CacheHintConfig struct {
+	Source string `json:"source"` // "client" (the client's API key) or "conversation" (the opening messages)
+	Field  string `json:"field"`  // top-level body field to set, e.g. "cache_salt"
+	Header string `json:"header"` // request header to set, e.g. "X-Session-Affinity"
+}
+
+func validateCacheHint(c *CacheHintConfig) error {
+	switch c.Source {
+	case "client", "conversation":
+	default:
+		return fmt.Errorf("unknown cache_hint.source %q", c.Source)
+	}
+	if c.Field == "" && c.Header == "" {
+		return fmt.Errorf("cache_hint needs field or header")
+	}
+	return nil
+}
+
+// applyCacheHint sets the rule's cache hint on the request body and
+// headers. A field the client set itself is kept.
+func applyCacheHint(c *CacheHintConfig, r *http.Request, payload map[string]any) {
+	hint := cacheHint(c.Source, r, payload)
+	if hint == "" {
+		return
+	}
+	if c.Field != "" {
+		if _, ok := payload[c.Field]; !ok {
+			payload[c.Field] = hint
+		}
+	}
+	if c.Header != "" {
+		r.Header = r.Header.Clone()
+		r.Header.Set(c.Header, hint)
+	}
+	vlogCtx(r.Context(), "RULE: cache hint %s from %s", hint, c.Source)
+}
+
+// cacheHint derives the hint, or returns "" when the request has nothing to
+// derive it from. Hints are hashes, so keys and prompts are not exposed.
+func cacheHint(source string, r *http.Request, payload map[string]any) string {
+	h := sha256.New()
+	switch source {
+	case "client":
+		key := bearerToken(r)
+		if key == "" {
+			return ""
+		}
+		h.Write([]byte(key))
+	case "conversation":
+		// a conversation is known by its model and the messages up to the
+		// first user turn, which every later turn repeats
+		messages, _ := payload["messages"].([]any)
+		var prefix []any
+		for _, m := range messages {
+			prefix = append(prefix, m)
+			if msg, _ := m.(map[string]any); getString(msg, "role") == "user" {
+				break
+			}
+		}
+		if len(prefix) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(prefix)
+		h.Write([]byte(getString(payload, "model")))
+		h.Write([]byte{0})
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheHint(t *testing.T) {
+	conversation := func(body string) string {
+		var payload map[string]any
+		_ = json.Unmarshal([]byte(body), &payload)
+		return cacheHint("conversation", httptest.NewRequest("POST", "/", nil), payload)
+	}
+	turn1 := conversation(`{"model":"m","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+	turn2 := conversation(`{"model":"m","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"more"}]}`)
+	other := conversation(`{"model":"m","messages":[{"role":"system","content":"be verbose"},{"role":"user","content":"hi"}]}`)
+	otherModel := conversation(`{"model":"n","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+	if turn1 == "" || turn1 != turn2 {
+		t.Errorf("turns of one conversation got hints %q and %q, want the same", turn1, turn2)
+	}
+	if other == turn1 || otherModel == turn1 {
+		t.Error("different conversations got the same hint")
+	}
+	if h := conversation(`{"model":"m","prompt":"hi"}`); h != "" {
+		t.Errorf("request without messages got hint %q", h)
+	}
+
+	client := func(key string) string {
+		r := httptest.NewRequest("POST", "/", nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return cacheHint("client", r, nil)
+	}
+	if a := client("sk-a"); a == "" || a != client("sk-a") || a == client("sk-b") || strings.Contains(a, "sk-a") {
+		t.Errorf("client hint %q is not a stable hash of the key", a)
+	}
+	if h := client(""); h != "" {
+		t.Errorf("request without a key got hint %q", h)
+	}
+
+	for _, c := range []CacheHintConfig{{Source: "session", Field: "cache_salt"}, {Source: "client"}} {
+		if err := validateCacheHint(&c); err == nil {
+			t.Errorf("validateCacheHint(%+v) succeeded, want error", c)
+		}
+	}
+}
+
+func TestCacheHintForwarded(t *testing.T) {
+	var gotSalt, gotHeader string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		gotSalt = getString(req, "cache_salt")
+		gotHeader = r.Header.Get("X-Session-Affinity")
+		writeJSON(w, http.StatusOK, map[string]any{})
+	}))
+	defer upstream.Close()
+
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{{
+			MatchModel: "qwen",
+			CacheHint:  &CacheHintConfig{Source: "client", Field: "cache_salt", Header: "X-Session-Affinity"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	send := func(body string) {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sk-test")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	send(`{"model":"qwen","messages":[{"role":"user","content":"hi"}]}`)
+	if gotSalt == "" || gotHeader != gotSalt {
+		t.Errorf("upstream got cache_salt %q and header %q, want the same hint", gotSalt, gotHeader)
+	}
+	send(`{"model":"qwen","cache_salt":"mine","messages":[{"role":"user","content":"hi"}]}`)
+	if gotSalt != "mine" {
+		t.Errorf("client's cache_salt replaced with %q", gotSalt)
+	}
+	send(`{"model":"other","messages":[{"role":"user","content":"hi"}]}`)
+	if gotSalt != "" || gotHeader != "" {
+		t.Errorf("model without the rule got cache_salt %q and header %q", gotSalt, gotHeader)
+	}
+}
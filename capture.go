@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Capture headers. A client asks for a capture with X-Relay-Capture: 1 and
+// proves it may do so with the admin token; neither header is forwarded.
+const (
+	captureHeader    = "X-Relay-Capture"
+	captureIDHeader  = "X-Relay-Capture-Id"
+	adminTokenHeader = "X-Relay-Admin-Token"
+)
+
+// streamCapture tees one streaming request's upstream SSE and the output sent
+// to the client into files under admin.capture_dir, so a mangled stream can
+// be compared with what the upstream actually sent.
+type streamCapture struct {
+	id       string
+	upstream *os.File
+	client   *os.File
+}
+
+// startCapture returns nil unless the request asks for a capture, carries the
+// admin token and captures are enabled.
+func startCapture(cfg *Config, r *http.Request, body []byte) *streamCapture {
+	if r.Header.Get(captureHeader) != "1" || !adminEnabled(cfg) || cfg.Admin.CaptureDir == "" {
+		return nil
+	}
+	token := r.Header.Get(adminTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Admin.Token)) != 1 {
+		vlogCtx(r.Context(), "CAPTURE: ignoring capture request without a valid admin token")
+		return nil
+	}
+
+	id := time.Now().UTC().Format("20060102T150405") + "-" + uuid.NewString()[:8]
+	base := filepath.Join(cfg.Admin.CaptureDir, id)
+	if err := os.MkdirAll(cfg.Admin.CaptureDir, 0o700); err != nil {
+		vlogCtx(r.Context(), "CAPTURE: %v", err)
+		return nil
+	}
+	if err := os.WriteFile(base+".request.json", body, 0o600); err != nil {
+		vlogCtx(r.Context(), "CAPTURE: %v", err)
+		return nil
+	}
+	c := &streamCapture{id: id}
+	var err error
+	if c.upstream, err = os.OpenFile(base+".upstream.sse", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600); err != nil {
+		vlogCtx(r.Context(), "CAPTURE: %v", err)
+		return nil
+	}
+	if c.client, err = os.OpenFile(base+".client.sse", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600); err != nil {
+		c.upstream.Close()
+		vlogCtx(r.Context(), "CAPTURE: %v", err)
+		return nil
+	}
+	logCtxf(r.Context(), slog.LevelInfo, "CAPTURE: capturing stream %s to %s.*", id, base)
+	return c
+}
+
+// teeUpstream copies everything read from body into the upstream file.
+func (c *streamCapture) teeUpstream(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, c.upstream), body}
+}
+
+// teeClient copies everything written to w into the client file.
+func (c *streamCapture) teeClient(w io.Writer) io.Writer {
+	return io.MultiWriter(w, c.client)
+}
+
+func (c *streamCapture) Close() {
+	c.upstream.Close()
+	c.client.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamCapture(t *testing.T) {
+	var forwarded http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk("c", "hi", "stop"))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	cfg := &Config{
+		Admin:      &AdminConfig{Token: "admin-secret", CaptureDir: dir},
+		ModelRules: []ModelRule{{MatchModel: "m", Trailer: " [bot]"}},
+	}
+	send := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+		r.Header.Set(captureHeader, "1")
+		r.Header.Set(adminTokenHeader, token)
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		return w
+	}
+
+	if w := send("wrong"); w.Header().Get(captureIDHeader) != "" {
+		t.Fatal("captured without a valid admin token")
+	}
+	w := send("admin-secret")
+	id := w.Header().Get(captureIDHeader)
+	if id == "" {
+		t.Fatal("missing capture id header")
+	}
+	if forwarded.Get(captureHeader) != "" || forwarded.Get(adminTokenHeader) != "" {
+		t.Errorf("capture headers were forwarded upstream: %v", forwarded)
+	}
+
+	read := func(suffix string) string {
+		b, err := os.ReadFile(filepath.Join(dir, id+suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if !strings.Contains(read(".request.json"), `"stream":true`) {
+		t.Errorf("request not captured")
+	}
+	if up := read(".upstream.sse"); !strings.Contains(up, `"content":"hi"`) || strings.Contains(up, "[bot]") {
+		t.Errorf("unexpected upstream capture:\n%s", up)
+	}
+	if client := read(".client.sse"); client != w.Body.String() || !strings.Contains(client, "[bot]") {
+		t.Errorf("client capture does not match the response:\n%s", client)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("expected 3 capture files, got %d", len(entries))
+	}
+}
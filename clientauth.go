@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// ClientKey is a virtual API key the relay accepts from clients. When any
+// client_keys are configured, requests without one of them are rejected.
+type ClientKey struct {
+	Key    string   `json:"key"`
+	Name   string   `json:"name"`   // shown in logs instead of the key
+	Models []string `json:"models"` // allowed model names or globs; empty allows all
+
+	TokensPerMinute int           `json:"tokens_per_minute"` // prompt plus max_tokens allowed per minute (0 = unlimited)
+	Budget          *ClientBudget `json:"budget"`            // daily and monthly token or cost caps
+}
+
+func validateClientKeys(keys []ClientKey) error {
+	seen := map[string]bool{}
+	for i, k := range keys {
+		if k.Key == "" {
+			return fmt.Errorf("client_keys[%d]: key is required", i)
+		}
+		if seen[k.Key] {
+			return fmt.Errorf("client_keys[%d]: duplicate key %q", i, maskKey(k.Key))
+		}
+		seen[k.Key] = true
+		if k.TokensPerMinute < 0 {
+			return fmt.Errorf("client_keys[%d]: tokens_per_minute must not be negative", i)
+		}
+		for _, m := range k.Models {
+			if _, err := path.Match(m, ""); err != nil {
+				return fmt.Errorf("client_keys[%d]: invalid model pattern %q: %w", i, m, err)
+			}
+		}
+	}
+	return nil
+}
+
+// label names the key in logs.
+func (k *ClientKey) label() string {
+	if k.Name != "" {
+		return k.Name
+	}
+	return maskKey(k.Key)
+}
+
+// allows reports whether the key may use model.
+func (k *ClientKey) allows(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, m := range k.Models {
+		if ok, _ := path.Match(m, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKeyIndex looks up client keys by their value.
+type clientKeyIndex map[string]*ClientKey
+
+func newClientKeyIndex(keys []ClientKey) clientKeyIndex {
+	idx := clientKeyIndex{}
+	for i := range keys {
+		idx[keys[i].Key] = &keys[i]
+	}
+	return idx
+}
+
+// authenticate returns the client key the request carries, or the message
+// OpenAI sends when there is none.
+func (idx clientKeyIndex) authenticate(r *http.Request) (*ClientKey, string) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, "You didn't provide an API key. You need to provide your API key in an Authorization header using Bearer auth (i.e. Authorization: Bearer YOUR_KEY)."
+	}
+	k, ok := idx[token]
+	if !ok {
+		return nil, fmt.Sprintf("Incorrect API key provided: %s.", maskKey(token))
+	}
+	return k, ""
+}
+
+// clientAuth rejects requests without a configured client key. With
+// checkModel set it also reads the request body and rejects models the key
+// may not use, as OpenAI does for models a key has no access to.
+func clientAuth(idx clientKeyIndex, next http.HandlerFunc, checkModel bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, msg := idx.authenticate(r)
+		if k == nil {
+			vlogCtx(r.Context(), "AUTH: rejected %s %s: %s", r.Method, r.URL.Path, msg)
+			writeJSONError(w, http.StatusUnauthorized, msg, "invalid_request_error", "invalid_api_key")
+			return
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.client = k.label()
+		}
+		if checkModel && len(k.Models) > 0 {
+			meta, _, err := readRequestMeta(r)
+			if err != nil {
+				http.Error(w, "read body failed", http.StatusBadRequest)
+				return
+			}
+			if !k.allows(meta.Model) {
+				vlogCtx(r.Context(), "AUTH: client '%s' may not use model '%s'", k.label(), meta.Model)
+				writeModelNotFound(w, meta.Model)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientAuth(t *testing.T) {
+	upstream := echoUpstream("global")
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream: upstream.URL,
+		ClientKeys: []ClientKey{
+			{Key: "sk-relay-alice", Name: "alice"},
+			{Key: "sk-relay-bob", Name: "bob", Models: []string{"qwen-*"}},
+		},
+	}
+	if err := validateClientKeys(cfg.ClientKeys); err != nil {
+		t.Fatalf("validateClientKeys() failed: %v", err)
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+
+	tests := []struct {
+		key, model string
+		wantStatus int
+		wantCode   string
+	}{
+		{"sk-relay-alice", "gpt-4o", 200, ""},
+		{"sk-relay-bob", "qwen-72b", 200, ""},
+		{"sk-relay-bob", "gpt-4o", 404, "model_not_found"},
+		{"sk-unknown-key", "gpt-4o", 401, "invalid_api_key"},
+		{"", "gpt-4o", 401, "invalid_api_key"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+tt.model+`"}`))
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("key %q model %q: status %d, want %d", tt.key, tt.model, w.Code, tt.wantStatus)
+			continue
+		}
+		var body struct {
+			Model string `json:"model"`
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Code    string `json:"code"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		if tt.wantCode == "" {
+			if body.Model != tt.model {
+				t.Errorf("key %q: upstream got model %q, want %q", tt.key, body.Model, tt.model)
+			}
+			continue
+		}
+		if body.Error.Code != tt.wantCode || body.Error.Type != "invalid_request_error" {
+			t.Errorf("key %q: error %+v, want code %s", tt.key, body.Error, tt.wantCode)
+		}
+		if strings.Contains(body.Error.Message, "sk-unknown-key") {
+			t.Errorf("error message reveals the key: %q", body.Error.Message)
+		}
+	}
+
+	// the models list needs a key but is not filtered by model
+	r := httptest.NewRequest("GET", "/v1/models", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Errorf("/v1/models without key: status %d, want 401", w.Code)
+	}
+}
+
+func TestValidateClientKeys(t *testing.T) {
+	for _, keys := range [][]ClientKey{
+		{{Name: "no key"}},
+		{{Key: "sk-1"}, {Key: "sk-1"}},
+		{{Key: "sk-1", Models: []string{"qwen-["}}},
+	} {
+		if err := validateClientKeys(keys); err == nil {
+			t.Errorf("validateClientKeys(%+v) succeeded, want error", keys)
+		}
+	}
+}
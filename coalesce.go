@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var coalescedRequestsTotal = metrics.newCounterVec("relay_coalesced_requests_total",
+	"Non-streaming requests answered with the response of an identical request already in flight.", "tenant", "model")
+
+// coalescedCall is one upstream request shared by identical requests.
+type coalescedCall struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// coalesceGroup tracks the in-flight requests of rules with coalesce set.
+type coalesceGroup struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+var coalescer = &coalesceGroup{calls: map[string]*coalescedCall{}}
+
+// coalesceKey identifies requests whose responses are interchangeable: the
+// same body for the same endpoint and upstream, sent with the same
+// credentials, so clients never receive an answer made with another's key.
+func coalesceKey(r *http.Request, upstream *url.URL, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{r.URL.Path, upstream.String(), tenantName(r.Context()), r.Header.Get("Authorization")} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// do sends the request for key unless an identical one is in flight, in
+// which case it waits for that response. Every caller gets its own copy of
+// the response. A caller whose leader was canceled by its client sends the
+// request itself rather than failing with it.
+func (g *coalesceGroup) do(ctx context.Context, key string, send func() (*http.Response, error)) (*http.Response, bool, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if c.err != nil && errors.Is(c.err, context.Canceled) && ctx.Err() == nil {
+			resp, err := send()
+			return resp, false, err
+		}
+		resp, err := c.response()
+		return resp, true, err
+	}
+	c := &coalescedCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	resp, err := send()
+	if err == nil {
+		c.status, c.header = resp.StatusCode, resp.Header
+		c.body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	c.err = err
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	resp, err = c.response()
+	return resp, false, err
+}
+
+func (c *coalescedCall) response() (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		StatusCode:    c.status,
+		Header:        c.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+	}, nil
+}
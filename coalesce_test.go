@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceIdenticalRequests(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if r.Header.Get("Authorization") == "Bearer sk-a" {
+			<-release
+		}
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":"answer %d"}}]}`, n)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "default", Coalesce: true}}}
+	send := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), true, cfg, nil)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := send("sk-a", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+			bodies[i] = fmt.Sprintf("%d %s", w.Code, w.Body)
+		}()
+	}
+	// every copy joins the first request before it is answered
+	for hits.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// other credentials, bodies or streams are not shared
+	if w := send("sk-b", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); !strings.Contains(w.Body.String(), "answer 2") {
+		t.Errorf("another key shared the response: %s", w.Body)
+	}
+	close(release)
+	wg.Wait()
+	for _, b := range bodies {
+		if b != bodies[0] || !strings.HasPrefix(b, "200 ") {
+			t.Errorf("responses differ: %q vs %q", b, bodies[0])
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+	if w := send("sk-c", `{"model":"m","stream":true}`); w.Code != http.StatusOK || hits.Load() != 3 {
+		t.Errorf("stream: %d, hits %d", w.Code, hits.Load())
+	}
+}
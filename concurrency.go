@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultQueueTimeout bounds how long a queued request waits for a slot.
+const defaultQueueTimeout = 30 * time.Second
+
+var (
+	upstreamQueuedTotal = metrics.newCounterVec("relay_upstream_queued_total",
+		"Requests that waited for a free slot under upstream_options.max_concurrent.", "upstream")
+	upstreamQueueRejectionsTotal = metrics.newCounterVec("relay_upstream_queue_rejections_total",
+		"Requests answered 503 because the upstream queue was full or the wait timed out.", "upstream", "reason")
+)
+
+var (
+	errQueueFull    = errors.New("upstream queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the upstream queue")
+)
+
+func validateConcurrency(o *UpstreamOptions) error {
+	if o.MaxConcurrent < 0 || o.MaxQueue < 0 {
+		return errors.New("upstream_options.max_concurrent and max_queue must not be negative")
+	}
+	if o.MaxQueue > 0 && o.MaxConcurrent == 0 {
+		return errors.New("upstream_options.max_queue requires max_concurrent")
+	}
+	if o.QueueTimeout != "" {
+		if d, err := time.ParseDuration(o.QueueTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid upstream_options.queue_timeout %q", o.QueueTimeout)
+		}
+	}
+	return nil
+}
+
+// concurrencyLimiter caps the requests open against one upstream. A request
+// holds its slot until its response body is closed, so a stream counts for
+// as long as it runs. Requests over the cap wait in FIFO order; a freed slot
+// is handed straight to the oldest waiter, so a newcomer cannot overtake it.
+type concurrencyLimiter struct {
+	upstream string
+	max      int
+	maxQueue int
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+// newConcurrencyLimiter returns nil when max_concurrent is not set.
+func newConcurrencyLimiter(upstream string, o UpstreamOptions) *concurrencyLimiter {
+	if o.MaxConcurrent <= 0 {
+		return nil
+	}
+	l := &concurrencyLimiter{upstream: upstream, max: o.MaxConcurrent, maxQueue: o.MaxQueue, timeout: defaultQueueTimeout}
+	if d, err := time.ParseDuration(o.QueueTimeout); err == nil {
+		l.timeout = d // validated at startup
+	}
+	return l
+}
+
+// acquire takes a slot, waiting in the queue when none is free.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.active < l.max && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.waiters) >= l.maxQueue {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+	upstreamQueuedTotal.Inc(l.upstream)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return err
+		}
+	}
+	// the slot was handed over while giving up; pass it on
+	l.releaseLocked()
+	return err
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *concurrencyLimiter) releaseLocked() {
+	if len(l.waiters) > 0 {
+		next := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		close(next)
+		return
+	}
+	l.active--
+}
+
+// queued returns the number of waiting requests.
+func (l *concurrencyLimiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters)
+}
+
+// limitedBody releases the request's slot when the response is closed.
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// doLimited sends req once a slot is free. A full queue or a wait that
+// times out is answered with 503 and Retry-After, which retry and fallback
+// rules treat like an overloaded upstream.
+func (c *upstreamClient) doLimited(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if c.limit == nil {
+		return send(req)
+	}
+	if err := c.limit.acquire(req.Context()); err != nil {
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		reason := "full"
+		if errors.Is(err, errQueueTimeout) {
+			reason = "timeout"
+		}
+		vlogCtx(req.Context(), "UPSTREAM: %s for %s (%d slots)", err, c.url.Host, c.limit.max)
+		upstreamQueueRejectionsTotal.Inc(c.url.Host, reason)
+		return queueRejection(err), nil
+	}
+	resp, err := send(req)
+	if err != nil {
+		c.limit.release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: c.limit.release}
+	return resp, nil
+}
+
+func queueRejection(err error) *http.Response {
+	body, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"message": err.Error() + ", please retry later",
+		"type":    "server_error",
+		"code":    "upstream_overloaded",
+	}})
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Retry-After": {"1"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+}
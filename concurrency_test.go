@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	l := newConcurrencyLimiter("llm", UpstreamOptions{MaxConcurrent: 1, MaxQueue: 2, QueueTimeout: "5s"})
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			l.release()
+		}()
+		// queue the waiters in a known order
+		for l.queued() < i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := l.acquire(context.Background()); err != errQueueFull {
+		t.Errorf("third waiter: %v, want a full queue", err)
+	}
+	l.release()
+	wg.Wait()
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("served in order %v", order)
+	}
+	if l.active != 0 {
+		t.Errorf("%d slots still taken", l.active)
+	}
+
+	short := newConcurrencyLimiter("llm", UpstreamOptions{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: "10ms"})
+	_ = short.acquire(context.Background())
+	if err := short.acquire(context.Background()); err != errQueueTimeout {
+		t.Errorf("wait past queue_timeout: %v", err)
+	}
+	if short.queued() != 0 {
+		t.Error("timed out waiter left in the queue")
+	}
+}
+
+func TestUpstreamMaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	active, peak := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{MaxConcurrent: 2, MaxQueue: 1}}
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		return w
+	}
+	client := upstreamFor(cfg, parseURL(upstream.URL))
+	results := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() { results <- send().Code }()
+	}
+	for {
+		mu.Lock()
+		open := active
+		mu.Unlock()
+		if open == 2 && client.limit.queued() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// two requests are open and one waits, so a fourth finds the queue full
+	w := send()
+	var body struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || body.Error.Code != "upstream_overloaded" {
+		t.Errorf("over the queue: %d %s", w.Code, w.Body)
+	}
+	if rep := client.transportReport(); rep.MaxConcurrent != 2 || rep.Queued != 1 {
+		t.Errorf("transport report: %+v", rep)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if code := <-results; code != http.StatusOK {
+			t.Errorf("queued request: status %d", code)
+		}
+	}
+	if peak != 2 {
+		t.Errorf("upstream saw %d requests at once, want 2", peak)
+	}
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	for _, o := range []UpstreamOptions{
+		{MaxConcurrent: -1},
+		{MaxQueue: 5},
+		{MaxConcurrent: 2, QueueTimeout: "later"},
+	} {
+		if err := validateUpstreamOptions(&o); err == nil {
+			t.Errorf("%+v: no error", o)
+		}
+	}
+}
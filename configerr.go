@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// locateConfigError turns a json.Unmarshal error on the comment-stripped
+// config into one naming the line and column of the original file, followed
+// by that line and a caret under the column.
+func locateConfigError(path, src string, offsets []int, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	// the offset counts the bytes read, so the culprit is the one before it
+	pos := len(src)
+	if i := int(offset) - 1; i >= 0 && i < len(offsets) {
+		pos = offsets[i]
+	}
+	line := strings.Count(src[:pos], "\n") + 1
+	lineStart := strings.LastIndexByte(src[:pos], '\n') + 1
+	lineEnd := strings.IndexByte(src[pos:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += pos
+	}
+	text := strings.TrimRight(src[lineStart:lineEnd], "\r")
+	col := utf8.RuneCountInString(src[lineStart:pos]) + 1
+
+	// keep tabs so the caret lines up with the text above it
+	var pad strings.Builder
+	for _, r := range src[lineStart:min(pos, lineStart+len(text))] {
+		if r == '\t' {
+			pad.WriteByte('\t')
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+	gutter := fmt.Sprintf("%5d | ", line)
+	return fmt.Errorf("%s:%d:%d: %w\n%s%s\n%s%s^", path, line, col, err,
+		gutter, text, strings.Repeat(" ", len(gutter)-2)+"| ", pad.String())
+}
+
+// warnDuplicateRules logs model rules that can never match because an
+// earlier rule has the same match_model or match_model_regex.
+func warnDuplicateRules(cfg *Config) {
+	check := func(where string, rules []ModelRule) {
+		first := map[string]int{}
+		for i, rule := range rules {
+			key := "match_model " + rule.MatchModel
+			if rule.MatchModel == "" {
+				if rule.MatchModelRegex == "" {
+					continue
+				}
+				key = "match_model_regex " + rule.MatchModelRegex
+			}
+			if j, ok := first[key]; ok {
+				logf(slog.LevelWarn, "CONFIG: %s[%d] repeats %q of %s[%d] and is never used", where, i, ruleName(&rule), where, j)
+				continue
+			}
+			first[key] = i
+		}
+	}
+	check("model_rules", cfg.ModelRules)
+	for _, t := range cfg.Tenants {
+		check(fmt.Sprintf("tenant %q model_rules", t.Name), t.ModelRules)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigErrorLocation(t *testing.T) {
+	tests := []struct {
+		name, config string
+		wantPos      string
+		wantLine     string
+	}{
+		{
+			name: "syntax error after comments",
+			config: `{
+  // upstream server
+  "upstream": "http://127.0.0.1:8000", /* a block
+  comment spanning lines */
+  "model_rules": [
+    { "match_model": "a" "set": {} }
+  ]
+}`,
+			wantPos:  ":6:26: invalid character '\"' after object key:value pair",
+			wantLine: `    6 |     { "match_model": "a" "set": {} }` + "\n      |                          ^",
+		},
+		{
+			name:     "wrong type",
+			config:   "{\n  \"upstream\": \"http://127.0.0.1:8000\",\n  \"forward_auth\": \"yes\"\n}",
+			wantPos:  ":3:23: json: cannot unmarshal string",
+			wantLine: `    3 |   "forward_auth": "yes"`,
+		},
+		{
+			name:    "unexpected end",
+			config:  "{\n  \"upstream\": \"http://127.0.0.1:8000\",\n",
+			wantPos: ":2:39: unexpected end of JSON input",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.jsonc")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfigJSONC(path)
+			if err == nil {
+				t.Fatal("loadConfigJSONC() succeeded, want error")
+			}
+			msg := err.Error()
+			if !strings.HasPrefix(msg, path+tt.wantPos) {
+				t.Errorf("error = %q, want prefix %q", msg, path+tt.wantPos)
+			}
+			if !strings.Contains(msg, tt.wantLine) {
+				t.Errorf("error = %q, want snippet %q", msg, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestWarnDuplicateRules(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	warnDuplicateRules(&Config{
+		ModelRules: []ModelRule{
+			{MatchModel: "qwen-*"},
+			{MatchModelRegex: "llama.*"},
+			{MatchModel: "qwen-*"},
+			{MatchModelRegex: "llama.*"},
+			{MatchModel: "default"},
+		},
+		Tenants: []TenantConfig{{Name: "a", ModelRules: []ModelRule{{MatchModel: "m"}, {MatchModel: "m"}}}},
+	})
+	out := buf.String()
+	for _, want := range []string{
+		`model_rules[2] repeats "qwen-*" of model_rules[0]`,
+		`model_rules[3] repeats "/llama.*/" of model_rules[1]`,
+		`tenant "a" model_rules[1] repeats "m" of tenant "a" model_rules[0]`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "repeats") != 3 {
+		t.Errorf("unexpected warnings:\n%s", out)
+	}
+}
+
+func TestRelaxJSON(t *testing.T) {
+	tests := []struct{ input, want string }{
+		{`{"a": 1, "b": [1, 2,],}`, `{"a": 1, "b": [1, 2]}`},
+		{"{\n  \"a\": [\n    1,\n  ],\n}", "{\n  \"a\": [\n    1\n  ]\n}"},
+		{`{listen: ":8080", model_rules: [{match_model: "a", "set": {temperature_0: 1}}]}`,
+			`{"listen": ":8080", "model_rules": [{"match_model": "a", "set": {"temperature_0": 1}}]}`},
+		{`{"s": "a, ]", "t": "{x: 1,}"}`, `{"s": "a, ]", "t": "{x: 1,}"}`}, // strings are left alone
+		{`[a, b]`, `[a, b]`}, // bare words outside key position stay invalid
+	}
+	for _, tt := range tests {
+		offsets := make([]int, len(tt.input))
+		for i := range offsets {
+			offsets[i] = i
+		}
+		got, gotOffsets := relaxJSON(tt.input, offsets)
+		if got != tt.want {
+			t.Errorf("relaxJSON(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+		if len(gotOffsets) != len(got) {
+			t.Errorf("relaxJSON(%q): %d offsets for %d bytes", tt.input, len(gotOffsets), len(got))
+		}
+	}
+
+	// errors after relaxed syntax still point at the original text
+	path := filepath.Join(t.TempDir(), "config.jsonc")
+	_ = os.WriteFile(path, []byte("{\n  upstream: \"http://x\", // c\n  listen: 8080,\n}"), 0o600)
+	_, err := loadConfigJSONC(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":3:14: json: cannot unmarshal number") {
+		t.Errorf("error = %v, want it at 3:14", err)
+	}
+}
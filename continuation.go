@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var streamContinuationsTotal = metrics.newCounterVec("relay_stream_continuations_total",
+	"Truncated streams that were re-issued to continue generation.", "tenant", "model", "reason")
+
+// continuation relays an upstream SSE stream and, when it is cut off by a
+// transport error or finish_reason "length", re-issues the request with the
+// partial output appended as assistant context, splicing the new stream in so
+// the client sees one uninterrupted response.
+type continuation struct {
+	ctx         context.Context
+	payload     map[string]any
+	maxAttempts int
+	send        func(body []byte) (*http.Response, error)
+
+	tenant  string
+	model   string
+	label   string // model label of the metrics, see metricModel
+	id      any    // id/created of the first stream, reused for continued chunks
+	created any
+	partial strings.Builder
+}
+
+var errClientGone = errors.New("stream consumer closed")
+
+// newContinuationStream wraps first, or returns nil when the request shape
+// cannot be continued (multiple choices, or neither messages nor a prompt).
+func newContinuationStream(ctx context.Context, first io.Reader, payload map[string]any, rule *ModelRule, tenant string, send func([]byte) (*http.Response, error)) io.ReadCloser {
+	if n, ok := payload["n"].(float64); ok && n > 1 {
+		return nil
+	}
+	_, isChat := payload["messages"].([]any)
+	_, isPrompt := payload["prompt"].(string)
+	if !isChat && !isPrompt {
+		return nil
+	}
+
+	c := &continuation{
+		ctx:         ctx,
+		payload:     payload,
+		maxAttempts: rule.ContinueOnTruncation,
+		send:        send,
+		tenant:      tenant,
+		model:       getString(payload, "model"),
+		label:       metricModel(rule),
+	}
+	pr, pw := io.Pipe()
+	go c.run(first, pw)
+	return pr
+}
+
+func (c *continuation) run(first io.Reader, pw *io.PipeWriter) {
+	current := first
+	for attempt := 0; ; attempt++ {
+		heldFinish, readErr, writeErr := c.relay(current, pw, attempt > 0)
+		if current != first {
+			current.(io.Closer).Close()
+		}
+		if writeErr != nil {
+			return
+		}
+		if heldFinish == "" && readErr == nil {
+			pw.Close()
+			return
+		}
+
+		reason := "length"
+		if readErr != nil {
+			reason = "error"
+		}
+		var next io.ReadCloser
+		var err error
+		if attempt < c.maxAttempts {
+			vlogCtx(c.ctx, "CONTINUE: stream for model '%s' truncated (%s), re-issuing with %d bytes of partial output",
+				c.model, reason, c.partial.Len())
+			streamContinuationsTotal.Inc(c.tenant, c.label, reason)
+			next, err = c.reissue()
+			if err != nil {
+				logCtxf(c.ctx, slog.LevelWarn, "CONTINUE: re-issue failed for model '%s': %v", c.model, err)
+			}
+		}
+		if next == nil {
+			// out of attempts: surface the truncation the way upstream reported it
+			if heldFinish != "" {
+				fmt.Fprintf(pw, "%s\n\ndata: [DONE]\n\n", heldFinish)
+				pw.Close()
+			} else {
+				pw.CloseWithError(readErr)
+			}
+			return
+		}
+		current = next
+	}
+}
+
+// relay copies one upstream stream to pw. When the stream ends with
+// finish_reason "length", that chunk is withheld (returned as heldFinish) along
+// with everything after it, so a continuation can take over.
+func (c *continuation) relay(body io.Reader, pw *io.PipeWriter, continued bool) (heldFinish string, readErr, writeErr error) {
+	reader := bufio.NewReader(body)
+	for {
+		raw, err := reader.ReadString('\n')
+		if len(raw) > 0 {
+			line := strings.TrimRight(raw, "\r\n")
+			out, held, forward := c.processLine(line, continued, heldFinish != "")
+			if held != "" {
+				heldFinish = held
+			}
+			if forward {
+				if _, werr := io.WriteString(pw, out+"\n"); werr != nil {
+					return "", nil, errClientGone
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return heldFinish, nil, nil
+			}
+			return "", err, nil
+		}
+	}
+}
+
+// processLine returns the line to forward (if any) and, for a length-truncated
+// chunk, the withheld finish line.
+func (c *continuation) processLine(line string, continued, truncated bool) (out, held string, forward bool) {
+	if !strings.HasPrefix(line, "data: ") {
+		return line, "", true
+	}
+	if line == "data: [DONE]" {
+		return line, "", !truncated
+	}
+	if truncated {
+		return "", "", false
+	}
+
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return line, "", true
+	}
+	changed := false
+	if c.id == nil {
+		c.id, c.created = chunk["id"], chunk["created"]
+	} else if continued {
+		chunk["id"], chunk["created"] = c.id, c.created
+		changed = true
+	}
+
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return line, "", true
+	}
+	choice, _ := choices[0].(map[string]any)
+	delta, _ := choice["delta"].(map[string]any)
+	if continued && delta != nil {
+		delete(delta, "role")
+	}
+	if s, ok := delta["content"].(string); ok {
+		c.partial.WriteString(s)
+	} else if s, ok := choice["text"].(string); ok {
+		c.partial.WriteString(s)
+	}
+
+	if getString(choice, "finish_reason") == "length" {
+		held = withheldFinishLine(chunk, choice, delta)
+		choice["finish_reason"] = nil
+		changed = true
+	}
+
+	if !changed {
+		return line, held, true
+	}
+	b, err := json.Marshal(chunk)
+	if err != nil {
+		return line, held, true
+	}
+	return "data: " + string(b), held, true
+}
+
+// withheldFinishLine renders the withheld finish chunk without its content, which is
+// forwarded separately.
+func withheldFinishLine(chunk, choice, delta map[string]any) string {
+	content, hasContent := delta["content"]
+	text, hasText := choice["text"]
+	if hasContent {
+		delta["content"] = ""
+	}
+	if hasText {
+		choice["text"] = ""
+	}
+	b, _ := json.Marshal(chunk)
+	if hasContent {
+		delta["content"] = content
+	}
+	if hasText {
+		choice["text"] = text
+	}
+	return "data: " + string(b)
+}
+
+// reissue sends the original request again with the partial output so far
+// appended as assistant context (chat) or to the prompt (completions).
+func (c *continuation) reissue() (io.ReadCloser, error) {
+	next := make(map[string]any, len(c.payload))
+	for k, v := range c.payload {
+		next[k] = v
+	}
+	if messages, ok := c.payload["messages"].([]any); ok {
+		extended := append(append([]any(nil), messages...),
+			map[string]any{"role": "assistant", "content": c.partial.String()})
+		next["messages"] = extended
+	} else {
+		next["prompt"] = getString(c.payload, "prompt") + c.partial.String()
+	}
+
+	body, err := json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return resp.Body, nil
+}
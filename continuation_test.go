@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func sseChunk(id, content, finish string) string {
+	fr := "null"
+	if finish != "" {
+		fr = fmt.Sprintf("%q", finish)
+	}
+	return fmt.Sprintf(`data: {"id":%q,"object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":%q},"finish_reason":%s}]}`, id, content, fr)
+}
+
+// streamedContent concatenates delta contents and collects finish reasons.
+func streamedContent(t *testing.T, out string) (string, []string, []string) {
+	var content strings.Builder
+	var finishes, ids []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var chunk map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", line, err)
+		}
+		ids = append(ids, chunk["id"].(string))
+		choice := chunk["choices"].([]any)[0].(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		content.WriteString(getString(delta, "content"))
+		if fr, ok := choice["finish_reason"].(string); ok {
+			finishes = append(finishes, fr)
+		}
+	}
+	return content.String(), finishes, ids
+}
+
+func TestContinuationOnLength(t *testing.T) {
+	var mu sync.Mutex
+	var requests []map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requests = append(requests, body)
+		n := len(requests)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if n == 1 {
+			fmt.Fprintln(w, sseChunk("first", "Once upon", ""))
+			fmt.Fprintln(w, sseChunk("first", " a", "length"))
+			fmt.Fprintln(w, `data: {"id":"first","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"completion_tokens":3}}`)
+			fmt.Fprintln(w, "data: [DONE]")
+			return
+		}
+		fmt.Fprintln(w, sseChunk("second", " time.", "stop"))
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", ContinueOnTruncation: 2}}}
+	body := `{"model":"m","messages":[{"role":"user","content":"tell a story"}],"stream":true}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	out := w.Body.String()
+	content, finishes, ids := streamedContent(t, out)
+	if content != "Once upon a time." {
+		t.Errorf("expected spliced content, got %q", content)
+	}
+	if len(finishes) != 1 || finishes[0] != "stop" {
+		t.Errorf("expected only the final stop finish_reason, got %v", finishes)
+	}
+	for _, id := range ids {
+		if id != "first" {
+			t.Errorf("continued chunks should keep the first stream id, got %q", id)
+		}
+	}
+	if strings.Count(out, "[DONE]") != 1 || strings.Contains(out, `"usage"`) {
+		t.Errorf("truncated stream tail should be withheld:\n%s", out)
+	}
+	if strings.Count(out, `"role"`) != 2 {
+		t.Errorf("continued chunks should not repeat the role delta:\n%s", out)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", len(requests))
+	}
+	msgs := requests[1]["messages"].([]any)
+	last := msgs[len(msgs)-1].(map[string]any)
+	if last["role"] != "assistant" || last["content"] != "Once upon a" {
+		t.Errorf("expected partial output as assistant context, got %v", last)
+	}
+}
+
+func TestContinuationOnUpstreamError(t *testing.T) {
+	truncate := truncatedStreamHandler(t)
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			truncate(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk("y", " rest", "stop"))
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", ContinueOnTruncation: 1}}}
+	body := `{"model":"m","prompt":"p","stream":true}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	out := w.Body.String()
+	if strings.Contains(out, "stream_interrupted") {
+		t.Errorf("continued stream should not report an error:\n%s", out)
+	}
+	if !strings.Contains(out, "partial") || !strings.Contains(out, " rest") || !strings.HasSuffix(strings.TrimSpace(out), "[DONE]") {
+		t.Errorf("expected partial then continued content:\n%s", out)
+	}
+}
+
+func TestContinuationAttemptsExhausted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk("z", "more", "length"))
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", ContinueOnTruncation: 2}}}
+	body := `{"model":"m","messages":[],"stream":true}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	content, finishes, _ := streamedContent(t, w.Body.String())
+	if content != "moremoremore" {
+		t.Errorf("expected 1 + 2 attempts of content, got %q", content)
+	}
+	if len(finishes) != 1 || finishes[0] != "length" {
+		t.Errorf("expected the final length finish to be surfaced, got %v", finishes)
+	}
+	if strings.Count(w.Body.String(), "[DONE]") != 1 {
+		t.Errorf("expected a single [DONE]:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+)
+
+// conversationHeader optionally names the conversation a request belongs to.
+// Every turn of a conversation goes to the same upstream replica, which
+// keeps the backend's prefix cache warm, and transcripts can be searched by
+// it. The header is forwarded, so a load balancer in front of the upstream
+// can pin on it as well.
+const conversationHeader = "X-Conversation-Id"
+
+// pinnedClient returns the client for the replica that owns the
+// conversation id. Replicas are the addresses the upstream host resolves to
+// through upstream_options; with the system resolver, or a single address,
+// there is nothing to choose and the shared client is used.
+func (c *upstreamClient) pinnedClient(ctx context.Context, id string) *http.Client {
+	if c.res == nil {
+		return c.client
+	}
+	addrs, err := c.res.addresses(ctx)
+	if err != nil || len(addrs) < 2 {
+		return c.client
+	}
+	addr := replicaFor(id, addrs)
+	vlogCtx(ctx, "UPSTREAM: conversation '%s' pinned to %s", id, addr)
+	// connections are pooled per replica; a shared pool would hand the
+	// request whichever replica's connection is idle
+	if client, ok := c.replicas.Load(addr); ok {
+		return client.(*http.Client)
+	}
+	client, _ := c.replicas.LoadOrStore(addr, c.newClient(c.res.dialPreferring(addr)))
+	return client.(*http.Client)
+}
+
+// replicaFor picks the address with the highest hash of id and address
+// (rendezvous hashing): when a replica comes or goes, only the
+// conversations it owned move.
+func replicaFor(id string, addrs []string) string {
+	var best string
+	var bestScore uint64
+	for _, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+		h.Write([]byte(addr))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = addr, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConversationPinning(t *testing.T) {
+	var mu sync.Mutex
+	served := map[string]map[string]int{} // conversation -> replica -> requests
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replica, _, _ := net.SplitHostPort(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+		id := r.Header.Get(conversationHeader)
+		mu.Lock()
+		if served[id] == nil {
+			served[id] = map[string]int{}
+		}
+		served[id][replica]++
+		mu.Unlock()
+		fmt.Fprint(w, `{"choices":[]}`)
+	})}
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(first.Addr().String())
+	second, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		first.Close()
+		t.Skipf("no second loopback address: %v", err)
+	}
+	go srv.Serve(first)
+	go srv.Serve(second)
+	defer srv.Close()
+
+	replicas := []string{"127.0.0.1", "127.0.0.2"}
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{Resolve: replicas}}
+	up := parseURL("http://llm.invalid:" + port)
+	ids := []string{"conv-a", "conv-b", "conv-c", "conv-d", "conv-e", "conv-f"}
+	for turn := 0; turn < 3; turn++ {
+		for _, id := range ids {
+			r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+			r.Header.Set(conversationHeader, id)
+			w := httptest.NewRecorder()
+			proxyWithJSONPatch(w, r, up, false, cfg, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+		}
+	}
+
+	used := map[string]bool{}
+	for _, id := range ids {
+		want := replicaFor(id, replicas)
+		if got := served[id]; len(got) != 1 || got[want] != 3 {
+			t.Errorf("conversation %s served by %v, want all 3 turns on %s", id, got, want)
+		}
+		used[want] = true
+	}
+	if len(used) != 2 {
+		t.Errorf("all conversations pinned to %v, want both replicas used", used)
+	}
+}
+
+func TestReplicaForStable(t *testing.T) {
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("conv-%d", i)
+		before := replicaFor(id, addrs)
+		after := replicaFor(id, addrs[:2])
+		if before != "10.0.0.3" && after != before {
+			t.Errorf("conversation %s moved from %s to %s when another replica left", id, before, after)
+		}
+		if before != after {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no conversation was owned by the removed replica")
+	}
+}
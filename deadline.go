@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeadlineConfig lets clients send X-Deadline-Ms, the time they will wait
+// for a complete answer. The relay caps max_tokens at what the model can
+// generate in that time and gives up on the upstream when it passes.
+type DeadlineConfig struct {
+	DefaultTTFT            string  `json:"default_ttft"`              // time to first token assumed before a model has streamed (default "1s")
+	DefaultTokensPerSecond float64 `json:"default_tokens_per_second"` // generation speed assumed before a model has streamed (default 20)
+	MinTokens              int     `json:"min_tokens"`                // never cap max_tokens below this (default 16)
+}
+
+const (
+	deadlineHeader          = "X-Deadline-Ms"
+	deadlineMaxTokensHeader = "X-Relay-Deadline-Max-Tokens"
+
+	defaultDeadlineTTFT = time.Second
+	defaultDeadlineTPS  = 20
+	defaultDeadlineMin  = 16
+
+	// deadlineHeadroom is the share of the estimated time actually planned
+	// for, since generation speed varies between requests.
+	deadlineHeadroom = 0.9
+)
+
+var (
+	deadlineCappedTotal = metrics.newCounterVec("relay_deadline_capped_total",
+		"Requests whose max_tokens was lowered to fit their X-Deadline-Ms.", "tenant", "model")
+	deadlineExpiredTotal = metrics.newCounterVec("relay_deadline_expired_total",
+		"Streams ended with finish_reason length because their X-Deadline-Ms passed.", "tenant", "model")
+)
+
+// errDeadlineExpired is the cancel cause of a request whose X-Deadline-Ms
+// passed, telling it apart from a client that went away.
+var errDeadlineExpired = errors.New("X-Deadline-Ms passed")
+
+func deadlineExpired(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errDeadlineExpired)
+}
+
+func validateDeadline(c *DeadlineConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.DefaultTTFT != "" {
+		if d, err := time.ParseDuration(c.DefaultTTFT); err != nil || d < 0 {
+			return fmt.Errorf("deadline.default_ttft: invalid duration %q", c.DefaultTTFT)
+		}
+	}
+	if c.DefaultTokensPerSecond < 0 {
+		return errors.New("deadline.default_tokens_per_second must not be negative")
+	}
+	if c.MinTokens < 0 {
+		return errors.New("deadline.min_tokens must not be negative")
+	}
+	return nil
+}
+
+// generationSpeed is a model's smoothed time to first token and streaming
+// speed.
+type generationSpeed struct {
+	ttft            time.Duration
+	tokensPerSecond float64
+}
+
+// speedEstimator learns each model's speed from the streams it relays,
+// keyed by the metrics model label so clients cannot grow it without bound.
+// Non-streaming responses arrive in one piece and cannot tell the first
+// token apart from the rest, so they are not used.
+type speedEstimator struct {
+	mu     sync.Mutex
+	models map[string]*generationSpeed
+}
+
+// speedAlpha weighs the latest stream in the moving averages.
+const speedAlpha = 0.2
+
+var generationSpeeds = &speedEstimator{models: map[string]*generationSpeed{}}
+
+// observe records a successful stream of completionTokens that took total,
+// ttft of it before the first byte.
+func (e *speedEstimator) observe(model string, ttft, total time.Duration, completionTokens int) {
+	decode := total - ttft
+	if completionTokens <= 1 || decode <= 0 {
+		return
+	}
+	tps := float64(completionTokens) / decode.Seconds()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := e.models[model]
+	if s == nil {
+		e.models[model] = &generationSpeed{ttft: ttft, tokensPerSecond: tps}
+		return
+	}
+	s.ttft = time.Duration(speedAlpha*float64(ttft) + (1-speedAlpha)*float64(s.ttft))
+	s.tokensPerSecond = speedAlpha*tps + (1-speedAlpha)*s.tokensPerSecond
+}
+
+func (e *speedEstimator) get(model string) (generationSpeed, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s := e.models[model]; s != nil {
+		return *s, true
+	}
+	return generationSpeed{}, false
+}
+
+// deadlineTokens is how many tokens fit in deadline at speed, never fewer
+// than minTokens.
+func deadlineTokens(deadline time.Duration, speed generationSpeed, minTokens int) int {
+	left := float64(deadline-speed.ttft) * deadlineHeadroom
+	n := int(left / float64(time.Second) * speed.tokensPerSecond)
+	return max(n, minTokens)
+}
+
+// parseDeadline reads X-Deadline-Ms; ok is false without the header.
+func parseDeadline(r *http.Request) (d time.Duration, ok bool, err error) {
+	v := r.Header.Get(deadlineHeader)
+	if v == "" {
+		return 0, false, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false, fmt.Errorf("invalid %s header %q: want a positive number of milliseconds", deadlineHeader, v)
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// applyDeadline honors X-Deadline-Ms on completion requests: max_tokens is
+// lowered to what the model should manage in time, and the upstream is
+// abandoned once the deadline passes; a stream then ends as if it ran out
+// of tokens (see endStreamAtDeadline). The cap is returned in
+// X-Relay-Deadline-Max-Tokens.
+func applyDeadline(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	c := cfg.Deadline
+	defaults := generationSpeed{ttft: defaultDeadlineTTFT, tokensPerSecond: defaultDeadlineTPS}
+	if c.DefaultTTFT != "" {
+		defaults.ttft, _ = time.ParseDuration(c.DefaultTTFT) // validated at load
+	}
+	if c.DefaultTokensPerSecond > 0 {
+		defaults.tokensPerSecond = c.DefaultTokensPerSecond
+	}
+	minTokens := c.MinTokens
+	if minTokens == 0 {
+		minTokens = defaultDeadlineMin
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok, err := parseDeadline(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_deadline")
+			return
+		}
+		if !ok {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		var payload map[string]any
+		if json.Unmarshal(body, &payload) == nil && payload != nil {
+			ruleCfg := cfg
+			if t := tenantFromContext(r.Context()); t != nil {
+				ruleCfg = t.cfg
+			}
+			model := getString(payload, "model")
+			label := metricModel(resolveRule(ruleCfg, model))
+			speed, known := generationSpeeds.get(label)
+			if !known {
+				speed = defaults
+			}
+			limit := deadlineTokens(deadline, speed, minTokens)
+			field := "max_tokens"
+			if _, ok := payload["max_completion_tokens"]; ok {
+				field = "max_completion_tokens"
+			}
+			if n, ok := payload[field].(float64); !ok || int(n) > limit {
+				payload[field] = limit
+				body, _ = json.Marshal(payload)
+				deadlineCappedTotal.Inc(tenantName(r.Context()), label)
+				vlogCtx(r.Context(), "DEADLINE: capped %s of model '%s' at %d to finish within %s (ttft %s, %.1f tokens/s, learned=%v)",
+					field, model, limit, deadline, speed.ttft, speed.tokensPerSecond, known)
+			}
+			w.Header().Set(deadlineMaxTokensHeader, strconv.Itoa(limit))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx, cancel := context.WithTimeoutCause(r.Context(), deadline, errDeadlineExpired)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// endStreamAtDeadline ends a stream whose deadline passed the way a
+// max_tokens cut would: a finish_reason "length" chunk for every choice,
+// then [DONE], so the client keeps the partial answer.
+func endStreamAtDeadline(ctx context.Context, w io.Writer, envelope *streamEnvelope, tenant string, rule *ModelRule, model string) {
+	vlogCtx(ctx, "DEADLINE: %s passed mid-stream for model '%s', ending with finish_reason length", deadlineHeader, model)
+	deadlineExpiredTotal.Inc(tenant, metricModel(rule))
+	chunk, _ := json.Marshal(finishChunk(envelope.last, envelope.indexes, "length"))
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", chunk)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
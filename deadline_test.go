@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineTokens(t *testing.T) {
+	speed := generationSpeed{ttft: time.Second, tokensPerSecond: 20}
+	if got := deadlineTokens(3*time.Second, speed, 16); got != 36 {
+		t.Errorf("3s: %d tokens, want 36", got)
+	}
+	if got := deadlineTokens(500*time.Millisecond, speed, 16); got != 16 {
+		t.Errorf("deadline before the first token: %d tokens, want the minimum", got)
+	}
+
+	e := &speedEstimator{models: map[string]*generationSpeed{}}
+	e.observe("m", time.Second, 3*time.Second, 100) // 50 tokens/s
+	e.observe("m", 2*time.Second, 4*time.Second, 50)
+	e.observe("m", time.Second, time.Second, 10) // no time to decode: ignored
+	s, ok := e.get("m")
+	if !ok || s.ttft != 1200*time.Millisecond || fmt.Sprintf("%.1f", s.tokensPerSecond) != "45.0" {
+		t.Errorf("learned %+v", s)
+	}
+}
+
+func TestApplyDeadline(t *testing.T) {
+	var seen map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = nil
+		_ = json.NewDecoder(r.Body).Decode(&seen)
+		if seen["model"] == "slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream:   upstream.URL,
+		Deadline:   &DeadlineConfig{DefaultTTFT: "500ms", DefaultTokensPerSecond: 10},
+		ModelRules: []ModelRule{{MatchModel: "deadline-fast-*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(deadline, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		if deadline != "" {
+			r.Header.Set(deadlineHeader, deadline)
+		}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// (2.5s - 0.5s) * 0.9 * 10 tokens/s
+	w := send("2500", `{"model":"deadline-m","messages":[]}`)
+	if seen["max_tokens"] != float64(18) || w.Header().Get(deadlineMaxTokensHeader) != "18" {
+		t.Errorf("sent max_tokens %v, header %q", seen["max_tokens"], w.Header().Get(deadlineMaxTokensHeader))
+	}
+	send("2500", `{"model":"deadline-m","messages":[],"max_completion_tokens":1000}`)
+	if seen["max_completion_tokens"] != float64(18) || seen["max_tokens"] != nil {
+		t.Errorf("sent %v", seen)
+	}
+	send("2500", `{"model":"deadline-m","messages":[],"max_tokens":5}`)
+	if seen["max_tokens"] != float64(5) {
+		t.Errorf("a lower max_tokens was raised to %v", seen["max_tokens"])
+	}
+	send("", `{"model":"deadline-m","messages":[]}`)
+	if _, ok := seen["max_tokens"]; ok {
+		t.Errorf("capped without a deadline: %v", seen)
+	}
+
+	// learned speeds replace the defaults; they are kept per rule, not per
+	// model name a client sends
+	generationSpeeds.observe("deadline-fast-*", 100*time.Millisecond, 1100*time.Millisecond, 100)
+	send("1100", `{"model":"deadline-fast-1","messages":[]}`)
+	if seen["max_tokens"] != float64(90) {
+		t.Errorf("fast model: max_tokens %v", seen["max_tokens"])
+	}
+	if _, ok := generationSpeeds.get("deadline-fast-1"); ok {
+		t.Error("speed keyed by the client's model name")
+	}
+	if got := deadlineCappedTotal.Value("default", "deadline-fast-*"); got != 1 {
+		t.Errorf("capped counted %v times under the rule", got)
+	}
+
+	// the upstream is abandoned when the deadline passes
+	start := time.Now()
+	if w := send("100", `{"model":"slow","messages":[]}`); w.Code == http.StatusOK || time.Since(start) > time.Second {
+		t.Errorf("slow upstream: %d after %s", w.Code, time.Since(start))
+	}
+
+	if w := send("soon", `{"model":"deadline-m","messages":[]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid header: %d", w.Code)
+	}
+}
+
+func TestDeadlineEndsStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL, Deadline: &DeadlineConfig{}, ModelRules: []ModelRule{{MatchModel: "deadline-stream"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"deadline-stream","stream":true,"messages":[]}`))
+	r.Header.Set(deadlineHeader, "200")
+	mux.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	want := `data: {"choices":[{"delta":{},"finish_reason":"length","index":0}],"id":"c1","model":"m","object":"chat.completion.chunk"}` + "\n\ndata: [DONE]\n\n"
+	if !strings.Contains(body, `"content":"Hel"`) || !strings.HasSuffix(body, want) || strings.Contains(body, "stream_interrupted") {
+		t.Errorf("stream:\n%s", body)
+	}
+	if got := deadlineExpiredTotal.Value("default", "deadline-stream"); got != 1 {
+		t.Errorf("%v expired streams counted", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDebugBytes caps each side of a /admin/debug/chat record.
+const maxDebugBytes = 4 << 20
+
+type debugTraceKey struct{}
+
+// debugTrace collects what a /admin/debug/chat request sent to the upstream
+// and what came back, before the relay transformed it.
+type debugTrace struct {
+	request   []byte
+	upstream  bytes.Buffer
+	truncated bool
+}
+
+// debugTraceFrom returns the trace of a debug request, or nil.
+func debugTraceFrom(ctx context.Context) *debugTrace {
+	d, _ := ctx.Value(debugTraceKey{}).(*debugTrace)
+	return d
+}
+
+func (d *debugTrace) Write(p []byte) (int, error) {
+	room := maxDebugBytes - d.upstream.Len()
+	if len(p) > room {
+		d.truncated = true
+		d.upstream.Write(p[:max(room, 0)])
+	} else {
+		d.upstream.Write(p)
+	}
+	return len(p), nil
+}
+
+// teeUpstream copies everything read from body into the trace.
+func (d *debugTrace) teeUpstream(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, d), body}
+}
+
+// debugSink is the client side of a debug request; captureWriter keeps
+// what the relay writes to it.
+type debugSink struct{ header http.Header }
+
+func (s debugSink) Header() http.Header         { return s.header }
+func (s debugSink) Write(p []byte) (int, error) { return len(p), nil }
+func (s debugSink) WriteHeader(int)             {}
+
+// handleDebugChat serves /admin/debug/chat. The body is a chat completions
+// request; it runs like a client's request, for the tenant named by
+// ?tenant= if any, and the answer lays the upstream's events next to the
+// ones the relay emitted:
+//
+//	{"status": 200, "request": {...}, "upstream": [...], "relay": [...]}
+//
+// request is the body as sent upstream, after model rules. Events are the
+// SSE data payloads, or the whole body of a non-stream response.
+func handleDebugChat(chat http.HandlerFunc, tenants *tenantRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		if name := r.URL.Query().Get("tenant"); name != "" {
+			t := tenants.byName(name)
+			if t == nil {
+				writeJSONError(w, http.StatusNotFound, "unknown tenant "+name, "invalid_request_error", "unknown_tenant")
+				return
+			}
+			ctx = context.WithValue(ctx, tenantContextKey{}, t)
+		}
+		trace := &debugTrace{}
+		req := r.Clone(context.WithValue(ctx, debugTraceKey{}, trace))
+		req.URL.Path = "/v1/chat/completions"
+		req.Header.Del("Authorization") // the admin token is not for the upstream
+
+		rec := &captureWriter{ResponseWriter: debugSink{header: http.Header{}}, limit: maxDebugBytes}
+		chat(rec, req)
+
+		out := map[string]any{
+			"status":   rec.status,
+			"upstream": debugEvents(trace.upstream.Bytes()),
+			"relay":    debugEvents(rec.buf.Bytes()),
+		}
+		if json.Valid(trace.request) {
+			out["request"] = json.RawMessage(trace.request)
+		}
+		if trace.truncated || rec.truncated {
+			out["truncated"] = true
+		}
+		// the events are easier to read without "<" escaped
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(out)
+	}
+}
+
+// debugEvents splits an SSE stream into its data payloads, as JSON where
+// they are JSON. A body that is not SSE is one event.
+func debugEvents(b []byte) []any {
+	events := []any{}
+	event := func(s string) any {
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+		return s
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("data:")) {
+		if len(bytes.TrimSpace(b)) > 0 {
+			events = append(events, event(string(b)))
+		}
+		return events
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64<<10), maxDebugBytes)
+	for sc.Scan() {
+		if data, ok := strings.CutPrefix(sc.Text(), "data:"); ok {
+			events = append(events, event(strings.TrimSpace(data)))
+		}
+	}
+	return events
+}
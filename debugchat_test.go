@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugChat(t *testing.T) {
+	var gotAuth, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk("c", "<tool_call>ls<arg_key>dir</arg_key><arg_value>/tmp</arg_value></tool_call>", ""))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, sseChunk("c", "", "stop"))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream:    upstream.URL,
+		ForwardAuth: true,
+		Admin:       &AdminConfig{Token: "admin-secret"},
+		ModelRules:  []ModelRule{{MatchModel: "glm", EnableToolCallFix: true, Set: map[string]any{"temperature": 0.2}}},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/debug/chat"+query, strings.NewReader(`{"model":"glm","stream":true,"messages":[]}`))
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("")
+	var got struct {
+		Status   int               `json:"status"`
+		Request  map[string]any    `json:"request"`
+		Upstream []json.RawMessage `json:"upstream"`
+		Relay    []json.RawMessage `json:"relay"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if gotAuth != "" || !strings.Contains(gotBody, `"temperature":0.2`) {
+		t.Errorf("upstream got auth %q body %s", gotAuth, gotBody)
+	}
+	if got.Status != http.StatusOK || got.Request["temperature"] != 0.2 {
+		t.Errorf("status %d, request %v", got.Status, got.Request)
+	}
+	if len(got.Upstream) != 3 || !strings.Contains(string(got.Upstream[0]), "<tool_call>") || string(got.Upstream[2]) != `"[DONE]"` {
+		t.Errorf("upstream events %s", got.Upstream)
+	}
+	relay := fmt.Sprintf("%s", got.Relay)
+	if strings.Contains(relay, "<tool_call>") || !strings.Contains(relay, `"name":"ls"`) || !strings.Contains(relay, `"finish_reason":"tool_calls"`) {
+		t.Errorf("relay events %s", relay)
+	}
+
+	if w := send("?tenant=nope"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown tenant: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeprecationConfig marks the models a rule matches as deprecated. Clients
+// are told in response headers, and what happens after the sunset date is
+// up to AfterSunset.
+type DeprecationConfig struct {
+	Since       string `json:"since"`        // when the model was deprecated, "2026-01-15" or RFC 3339
+	Sunset      string `json:"sunset"`       // when it is retired, "2026-03-31" (midnight UTC) or RFC 3339
+	Replacement string `json:"replacement"`  // the model clients should move to
+	AfterSunset string `json:"after_sunset"` // "rewrite" to the replacement, "reject", or "" to keep forwarding
+}
+
+const (
+	deprecatedModelHeader = "X-Relay-Deprecated-Model"
+
+	afterSunsetRewrite = "rewrite"
+	afterSunsetReject  = "reject"
+)
+
+var deprecatedRequestsTotal = metrics.newCounterVec("relay_deprecated_model_requests_total",
+	"Requests for deprecated models, by client and requested model; action is warn, rewrite or reject.", "client", "model", "action")
+
+func validateDeprecation(c *DeprecationConfig) error {
+	for name, v := range map[string]string{"since": c.Since, "sunset": c.Sunset} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseUsageTime(v); err != nil {
+			return fmt.Errorf("deprecation.%s: invalid date %q", name, v)
+		}
+	}
+	switch c.AfterSunset {
+	case "", afterSunsetReject:
+	case afterSunsetRewrite:
+		if c.Replacement == "" {
+			return errors.New("deprecation.after_sunset \"rewrite\" needs a replacement")
+		}
+	default:
+		return fmt.Errorf("deprecation: unknown after_sunset %q", c.AfterSunset)
+	}
+	if c.AfterSunset != "" && c.Sunset == "" {
+		return errors.New("deprecation.after_sunset needs a sunset date")
+	}
+	return nil
+}
+
+// deprecationLogs remembers the day each client was last logged using each
+// deprecated model, so the log gets one line per client, model and day.
+var deprecationLogs sync.Map // client, model -> day
+
+// warning is the text of the Warning header and of the log line.
+func (c *DeprecationConfig) warning(model string, sunset time.Time, retired bool) string {
+	msg := fmt.Sprintf("The model '%s' is deprecated", model)
+	switch {
+	case retired:
+		msg = fmt.Sprintf("The model '%s' was retired on %s", model, sunset.Format(time.DateOnly))
+	case !sunset.IsZero():
+		msg += fmt.Sprintf(" and will be retired on %s", sunset.Format(time.DateOnly))
+	}
+	if c.Replacement != "" {
+		msg += fmt.Sprintf("; use '%s' instead", c.Replacement)
+	}
+	return msg + "."
+}
+
+// applyDeprecations handles requests for models whose rule has a
+// deprecation: the response carries Deprecation, Sunset and Warning
+// headers, each client's use is logged, and after the sunset the request
+// is rewritten to the replacement or rejected. Rules are looked up per
+// request, in the tenant's own rules when it has them, so deprecations
+// added by a reload take effect at once.
+func applyDeprecations(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfg
+		if t := tenantFromContext(r.Context()); t != nil {
+			cfg = t.cfg
+		}
+		if !hasDeprecations(cfg.rules()) {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var payload map[string]any
+		_ = json.Unmarshal(body, &payload)
+		model := getString(payload, "model")
+		rule := resolveRule(cfg, model)
+		if rule == nil || rule.Deprecation == nil {
+			next(w, r)
+			return
+		}
+		d := rule.Deprecation
+
+		now := time.Now()
+		var sunset time.Time
+		if d.Sunset != "" {
+			sunset, _ = parseUsageTime(d.Sunset) // validated at load
+		}
+		retired := !sunset.IsZero() && !now.Before(sunset)
+		warning := d.warning(model, sunset, retired)
+
+		h := w.Header()
+		if d.Since != "" {
+			since, _ := parseUsageTime(d.Since)
+			h.Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+		} else {
+			h.Set("Deprecation", "true")
+		}
+		if !sunset.IsZero() {
+			h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		h.Set("Warning", fmt.Sprintf("299 llm-api-relay %q", warning))
+
+		action := "warn"
+		if retired {
+			switch d.AfterSunset {
+			case afterSunsetRewrite:
+				action = afterSunsetRewrite
+			case afterSunsetReject:
+				action = afterSunsetReject
+			}
+		}
+		client := ""
+		if info := requestInfoFrom(r.Context()); info != nil {
+			client = info.client
+		}
+		if client == "" {
+			client = keyFingerprint(bearerToken(r))
+		}
+		deprecatedRequestsTotal.Inc(client, metricModel(rule), action)
+		day := now.UTC().Format(time.DateOnly)
+		if last, _ := deprecationLogs.Swap(client+"\x00"+model, day); last != day {
+			logCtxf(r.Context(), slog.LevelWarn, "DEPRECATION: client '%s' requested the deprecated model '%s' (%s): %s", client, model, action, warning)
+		}
+
+		switch action {
+		case afterSunsetReject:
+			writeJSONError(w, http.StatusGone, warning, "invalid_request_error", "model_retired")
+			return
+		case afterSunsetRewrite:
+			payload["model"] = d.Replacement
+			body, _ = json.Marshal(payload)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			h.Set(deprecatedModelHeader, model)
+			vlogCtx(r.Context(), "DEPRECATION: rewriting retired model '%s' to '%s'", model, d.Replacement)
+		}
+		next(w, r)
+	}
+}
+
+func hasDeprecations(rules []ModelRule) bool {
+	for i := range rules {
+		if rules[i].Deprecation != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeprecations(t *testing.T) {
+	var upstreamModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		upstreamModel, _ = body["model"].(string)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer upstream.Close()
+	future := time.Now().AddDate(0, 1, 0).UTC().Format(time.DateOnly)
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{
+			{MatchModel: "old-soon", Deprecation: &DeprecationConfig{Since: "2026-01-15", Sunset: future, Replacement: "new", AfterSunset: afterSunsetRewrite}},
+			{MatchModel: "old-gone", Deprecation: &DeprecationConfig{Sunset: "2026-01-01", Replacement: "new", AfterSunset: afterSunsetRewrite}},
+			{MatchModel: "old-dead", Deprecation: &DeprecationConfig{Sunset: "2026-01-01", AfterSunset: afterSunsetReject}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(model string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		r.Header.Set("Authorization", "Bearer sk-deprecation")
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	client := keyFingerprint("sk-deprecation")
+
+	// before the sunset the request goes through with warnings
+	w := send("old-soon")
+	if w.Code != http.StatusOK || upstreamModel != "old-soon" {
+		t.Fatalf("before the sunset: %d, upstream got %q", w.Code, upstreamModel)
+	}
+	if got := w.Header().Get("Deprecation"); got != "@1768435200" {
+		t.Errorf("Deprecation: %q", got)
+	}
+	if got := w.Header().Get("Sunset"); !strings.HasSuffix(got, "00:00:00 GMT") {
+		t.Errorf("Sunset: %q", got)
+	}
+	if got := w.Header().Get("Warning"); !strings.HasPrefix(got, `299 llm-api-relay "The model 'old-soon' is deprecated and will be retired on `+future+`; use 'new' instead."`) {
+		t.Errorf("Warning: %q", got)
+	}
+	if w.Header().Get(deprecatedModelHeader) != "" {
+		t.Error("rewritten before the sunset")
+	}
+
+	// after it, rewritten to the replacement
+	w = send("old-gone")
+	if w.Code != http.StatusOK || upstreamModel != "new" {
+		t.Fatalf("after the sunset: %d, upstream got %q", w.Code, upstreamModel)
+	}
+	if got := w.Header().Get(deprecatedModelHeader); got != "old-gone" {
+		t.Errorf("%s: %q", deprecatedModelHeader, got)
+	}
+	if got := w.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("Deprecation without since: %q", got)
+	}
+
+	// or rejected
+	upstreamModel = ""
+	w = send("old-dead")
+	if w.Code != http.StatusGone || upstreamModel != "" || !strings.Contains(w.Body.String(), `"model_retired"`) {
+		t.Errorf("retired model: %d %s", w.Code, w.Body.String())
+	}
+
+	// other models are left alone
+	w = send("current")
+	if w.Code != http.StatusOK || upstreamModel != "current" || w.Header().Get("Deprecation") != "" {
+		t.Errorf("current model: %d, %v", w.Code, w.Header())
+	}
+
+	send("old-soon")
+	for _, tt := range []struct {
+		model, action string
+		want          float64
+	}{
+		{"old-soon", "warn", 2},
+		{"old-gone", afterSunsetRewrite, 1},
+		{"old-dead", afterSunsetReject, 1},
+		{"current", "warn", 0},
+	} {
+		if got := deprecatedRequestsTotal.Value(client, tt.model, tt.action); got != tt.want {
+			t.Errorf("%s %s: %v requests, want %v", tt.model, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDeprecation(t *testing.T) {
+	for _, tt := range []struct {
+		c       DeprecationConfig
+		wantErr string
+	}{
+		{DeprecationConfig{Since: "2026-01-15", Sunset: "2026-03-31T12:00:00Z", Replacement: "new"}, ""},
+		{DeprecationConfig{Sunset: "2026-03-31", AfterSunset: afterSunsetReject}, ""},
+		{DeprecationConfig{Sunset: "31/03/2026"}, "invalid date"},
+		{DeprecationConfig{Sunset: "2026-03-31", AfterSunset: afterSunsetRewrite}, "needs a replacement"},
+		{DeprecationConfig{Replacement: "new", AfterSunset: afterSunsetRewrite}, "needs a sunset"},
+		{DeprecationConfig{Sunset: "2026-03-31", AfterSunset: "block"}, "unknown after_sunset"},
+	} {
+		err := validateDeprecation(&tt.c)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: %v, want %q", tt.c, err, tt.wantErr)
+		}
+	}
+}
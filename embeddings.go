@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxEmbeddingBatchesInFlight bounds how many batches of one request are
+// sent to the upstream at a time.
+const maxEmbeddingBatchesInFlight = 4
+
+var embeddingBatchesTotal = metrics.newCounterVec("relay_embedding_batches_total",
+	"Upstream requests made for embeddings requests split into batches.", "tenant", "model")
+
+// proxyEmbeddings serves /v1/embeddings: the request gets the model rules
+// and, when the rule sets embedding_batch_size, an input array larger than
+// that is sent in batches whose results are merged into one response.
+func proxyEmbeddings(w http.ResponseWriter, r *http.Request, upstream *url.URL, cfg *Config) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "read body failed", http.StatusBadRequest)
+		return
+	}
+	_ = r.Body.Close()
+	var payload map[string]any
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		http.Error(w, "invalid json body", http.StatusBadRequest)
+		return
+	}
+	if !routeUnmatched(cfg, payload) {
+		writeModelNotFound(w, getString(payload, "model"))
+		return
+	}
+	rule := resolveRule(cfg, getString(payload, "model"))
+	cfg.warm.touch(rule, time.Now())
+	applyRules(cfg, payload)
+
+	batches := embeddingBatches(payload, rule)
+	if len(batches) > 1 {
+		// the batches are decoded to merge them
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+	}
+	target := *r.URL
+	client := upstreamFor(cfg, upstream)
+	ollama := cfg.UpstreamType == upstreamOllama
+	if ollama {
+		target.Path = ollamaPath(target.Path, "/embeddings", "/api/embed")
+	}
+	send := newRetrier(rule, tenantName(r.Context()), getString(payload, "model")).wrap(r.Context(), func(body []byte) (*http.Response, error) {
+		if ollama {
+			return sendOllamaEmbed(r, client, &target, rule, cfg.ForwardAuth, body)
+		}
+		return sendJSONUpstream(r, client, &target, rule, cfg.ForwardAuth, body)
+	})
+	send = withFallbacks(r, r.URL, rule, getString(payload, "model"), send)
+
+	var resp *http.Response
+	if len(batches) <= 1 {
+		body, _ := json.Marshal(payload)
+		resp, err = send(body)
+	} else {
+		vlogCtx(r.Context(), "EMBEDDINGS: splitting %d inputs for model '%s' into %d requests", len(payload["input"].([]any)), getString(payload, "model"), len(batches))
+		embeddingBatchesTotal.Add(float64(len(batches)), tenantName(r.Context()), metricModel(rule))
+		resp, err = sendEmbeddingBatches(payload, batches, send)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// embeddingBatches splits the input array into slices of at most the rule's
+// embedding_batch_size, or returns nil when it need not be split. A single
+// string or token array is one input.
+func embeddingBatches(payload map[string]any, rule *ModelRule) [][]any {
+	if rule == nil || rule.EmbeddingBatchSize <= 0 {
+		return nil
+	}
+	input, ok := payload["input"].([]any)
+	if !ok || len(input) <= rule.EmbeddingBatchSize {
+		return nil
+	}
+	if _, tokens := input[0].(float64); tokens {
+		return nil
+	}
+	var batches [][]any
+	for i := 0; i < len(input); i += rule.EmbeddingBatchSize {
+		batches = append(batches, input[i:min(i+rule.EmbeddingBatchSize, len(input))])
+	}
+	return batches
+}
+
+// sendEmbeddingBatches sends each batch as its own request and merges the
+// results, renumbering their indexes and adding up usage. A failed or
+// non-200 batch is returned as is and the others are dropped.
+func sendEmbeddingBatches(payload map[string]any, batches [][]any, send func([]byte) (*http.Response, error)) (*http.Response, error) {
+	resps := make([]*http.Response, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, maxEmbeddingBatchesInFlight)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		req := make(map[string]any, len(payload))
+		for k, v := range payload {
+			req[k] = v
+		}
+		req["input"] = batch
+		body, _ := json.Marshal(req)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			resps[i], errs[i] = send(body)
+		}()
+	}
+	wg.Wait()
+
+	closeAll := func(except *http.Response) {
+		for _, resp := range resps {
+			if resp != nil && resp != except {
+				resp.Body.Close()
+			}
+		}
+	}
+	for i, resp := range resps {
+		if errs[i] != nil {
+			closeAll(nil)
+			return nil, errs[i]
+		}
+		if resp.StatusCode != http.StatusOK {
+			closeAll(resp)
+			return resp, nil
+		}
+	}
+	defer closeAll(nil)
+
+	var merged map[string]any
+	var data []any
+	var usage tokenUsage
+	offset := 0
+	for i, resp := range resps {
+		var part struct {
+			Data  []map[string]any `json:"data"`
+			Usage tokenUsage       `json:"usage"`
+		}
+		raw, err := io.ReadAll(resp.Body)
+		if err == nil {
+			err = json.Unmarshal(raw, &part)
+		}
+		if err == nil && i == 0 {
+			err = json.Unmarshal(raw, &merged)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode embeddings batch %d: %w", i, err)
+		}
+		for _, d := range part.Data {
+			idx, _ := d["index"].(float64)
+			d["index"] = offset + int(idx)
+			data = append(data, d)
+		}
+		offset += len(batches[i])
+		usage.PromptTokens += part.Usage.PromptTokens
+		usage.TotalTokens += part.Usage.TotalTokens
+	}
+	merged["data"] = data
+	merged["usage"] = map[string]any{"prompt_tokens": usage.PromptTokens, "total_tokens": usage.TotalTokens}
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	header := resps[0].Header.Clone()
+	header.Del("Content-Length")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(out)),
+	}, nil
+}
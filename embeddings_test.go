@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEmbeddings(t *testing.T) {
+	var mu sync.Mutex
+	var got []map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+		if getString(req, "model") == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"no such model","code":"model_not_found"}}`)
+			return
+		}
+		inputs, ok := req["input"].([]any)
+		if !ok {
+			inputs = []any{req["input"]}
+		}
+		var data []string
+		for i, in := range inputs {
+			data = append(data, fmt.Sprintf(`{"object":"embedding","index":%d,"embedding":[%d]}`, i, len(in.(string))))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"object":"list","data":[%s],"model":%q,"usage":{"prompt_tokens":%d,"total_tokens":%d}}`,
+			strings.Join(data, ","), getString(req, "model"), len(inputs), len(inputs))
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{
+			{MatchModel: "small", Set: map[string]any{"model": "text-embedding-3-small", "dimensions": 256}, EmbeddingBatchSize: 2},
+		},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body string) *httptest.ResponseRecorder {
+		got = nil
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body)))
+		return w
+	}
+
+	w := send(`{"model":"small","input":"hello"}`)
+	if w.Code != http.StatusOK || len(got) != 1 || got[0]["model"] != "text-embedding-3-small" || got[0]["dimensions"] != float64(256) {
+		t.Fatalf("single input: %d %s; upstream got %v", w.Code, w.Body, got)
+	}
+
+	w = send(`{"model":"small","input":["a","bb","ccc","dddd","eeeee"]}`)
+	if w.Code != http.StatusOK || len(got) != 3 {
+		t.Fatalf("batched: %d %s; %d upstream requests", w.Code, w.Body, len(got))
+	}
+	var resp struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage tokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 5 || resp.Usage.PromptTokens != 5 || resp.Usage.TotalTokens != 5 || resp.Model != "text-embedding-3-small" {
+		t.Fatalf("batched response %s", w.Body)
+	}
+	for i, d := range resp.Data {
+		if d.Index != i || d.Embedding[0] != float64(i+1) {
+			t.Errorf("data[%d] = %+v, want index %d for an input of %d bytes", i, d, i, i+1)
+		}
+	}
+
+	// an upstream error is passed on unchanged
+	cfg.ModelRules[0].Set = map[string]any{"model": "missing"}
+	w = send(`{"model":"small","input":["a","b","c"]}`)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "model_not_found") {
+		t.Errorf("failed batch: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOllamaEmbeddings(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(b, &gotBody)
+		fmt.Fprint(w, `{"model":"bge-m3","embeddings":[[0.5,-1],[2,0.25]],"prompt_eval_count":7}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Upstream: upstream.URL, UpstreamType: upstreamOllama}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model":"bge-m3","input":["a","b"],"encoding_format":"base64"}`)))
+	if w.Code != http.StatusOK || gotPath != "/api/embed" || gotBody["encoding_format"] != nil {
+		t.Fatalf("%d %s; upstream got %s %v", w.Code, w.Body, gotPath, gotBody)
+	}
+	want := `{"data":[{"embedding":"AAAAPwAAgL8=","index":0,"object":"embedding"},{"embedding":"AAAAQAAAgD4=","index":1,"object":"embedding"}],"model":"bge-m3","object":"list","usage":{"prompt_tokens":7,"total_tokens":7}}`
+	if w.Body.String() != want {
+		t.Errorf("response %s\nwant %s", w.Body, want)
+	}
+}
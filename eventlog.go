@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventLogConfig appends one JSON line per completed request. Unlike the
+// access log it is a contract for machines: every line carries a schema
+// version, and within a version fields are only ever added.
+type EventLogConfig struct {
+	Path     string `json:"path"`      // JSONL file appended to; "-" writes to stdout
+	MaxBytes int64  `json:"max_bytes"` // rename the file to <path>.1 once it reaches this size (0 = never)
+}
+
+// eventSchemaVersion is bumped when a field of requestEvent is renamed,
+// removed or changes meaning.
+const eventSchemaVersion = 1
+
+// Error classes of requestEvent, stable across releases.
+const (
+	errorClassCanceled          = "client_canceled"
+	errorClassStreamInterrupted = "stream_interrupted"
+	errorClassRateLimited       = "rate_limited"
+	errorClassAuth              = "auth"
+	errorClassInvalidRequest    = "invalid_request"
+	errorClassTimeout           = "timeout"
+	errorClassUpstream          = "upstream"
+)
+
+var eventLogErrorsTotal = metrics.newCounterVec("relay_event_log_errors_total",
+	"Event log lines that could not be written.", "path")
+
+func validateEventLog(c *EventLogConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.Path == "" {
+		return errors.New("event_log.path is required")
+	}
+	if c.MaxBytes < 0 {
+		return errors.New("event_log.max_bytes must not be negative")
+	}
+	if c.Path == "-" && c.MaxBytes > 0 {
+		return errors.New("event_log.max_bytes cannot be used with stdout")
+	}
+	return nil
+}
+
+// requestEvent is one line of the event log.
+type requestEvent struct {
+	Schema     int    `json:"schema"`
+	Event      string `json:"event"` // "request.completed"
+	Time       string `json:"time"`  // when the response ended, RFC 3339 with nanoseconds
+	StartedAt  string `json:"started_at"`
+	DurationMs int64  `json:"duration_ms"`
+	TTFTMs     *int64 `json:"ttft_ms"` // until the first response byte; null when nothing was sent
+
+	Path          string `json:"path"`
+	Model         string `json:"model"`          // as the client asked for it
+	UpstreamModel string `json:"upstream_model"` // after the model rules
+	Rule          string `json:"rule"`           // match_model of the rule applied, "" for none
+	Upstream      string `json:"upstream"`       // host the request was sent to
+	Tenant        string `json:"tenant"`
+	Client        string `json:"client"` // client key name, "" without client_keys
+	Key           string `json:"key"`    // fingerprint of the client's bearer token
+	Stream        bool   `json:"stream"`
+
+	Status           int     `json:"status"`
+	FinishReason     string  `json:"finish_reason"`
+	ErrorClass       string  `json:"error_class"` // "" on success
+	RequestBytes     int     `json:"request_bytes"`
+	ResponseBytes    int     `json:"response_bytes"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"` // from the prices table; 0 for unpriced models
+}
+
+// errorClass buckets how a request failed, or returns "" when it did not.
+func errorClass(r *http.Request, status int, streamError bool) string {
+	switch {
+	case r.Context().Err() != nil:
+		return errorClassCanceled
+	case streamError:
+		return errorClassStreamInterrupted
+	case status == http.StatusTooManyRequests:
+		return errorClassRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errorClassAuth
+	case status == http.StatusGatewayTimeout || status == http.StatusRequestTimeout:
+		return errorClassTimeout
+	case status >= 500:
+		return errorClassUpstream
+	case status >= 400:
+		return errorClassInvalidRequest
+	}
+	return ""
+}
+
+// eventLog appends events to a file or stdout.
+type eventLog struct {
+	cfg EventLogConfig
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File // nil for stdout
+	size int64
+}
+
+func openEventLog(cfg EventLogConfig) (*eventLog, error) {
+	l := &eventLog{cfg: cfg, out: os.Stdout}
+	if cfg.Path == "-" {
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLog) open() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open event log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open event log: %w", err)
+	}
+	l.file, l.out, l.size = f, f, fi.Size()
+	return nil
+}
+
+// record writes the event for a finished request.
+func (l *eventLog) record(r *http.Request, info *requestInfo, meta requestMeta, start time.Time, requestBytes int, uw *usageWriter) {
+	if l == nil {
+		return
+	}
+	end := time.Now()
+	e := requestEvent{
+		Schema:           eventSchemaVersion,
+		Event:            "request.completed",
+		Time:             end.UTC().Format(time.RFC3339Nano),
+		StartedAt:        start.UTC().Format(time.RFC3339Nano),
+		DurationMs:       end.Sub(start).Milliseconds(),
+		Path:             r.URL.Path,
+		Model:            meta.Model,
+		UpstreamModel:    info.upstreamModel,
+		Rule:             info.rule,
+		Upstream:         info.upstream,
+		Tenant:           tenantName(r.Context()),
+		Client:           info.client,
+		Key:              keyFingerprint(bearerToken(r)),
+		Stream:           meta.Stream,
+		Status:           uw.status,
+		FinishReason:     uw.finishReason,
+		ErrorClass:       errorClass(r, uw.status, uw.streamError),
+		RequestBytes:     requestBytes,
+		ResponseBytes:    uw.bytes,
+		PromptTokens:     uw.usage.PromptTokens,
+		CompletionTokens: uw.usage.CompletionTokens,
+		TotalTokens:      uw.usage.TotalTokens,
+		Cost:             info.cost,
+	}
+	if uw.bytes > 0 {
+		ttft := uw.firstByte.Milliseconds()
+		e.TTFTMs = &ttft
+	}
+	line, _ := json.Marshal(e)
+	l.write(append(line, '\n'))
+}
+
+// write appends one line, rotating the file first when it is full. Each line
+// goes out in a single write, so readers tailing the file never see half of
+// one.
+func (l *eventLog) write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.cfg.MaxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxBytes {
+		l.rotate()
+	}
+	var err error
+	if l.out == nil {
+		// the file could not be reopened after rotating; try again
+		err = l.open()
+	}
+	if err == nil {
+		var n int
+		n, err = l.out.Write(line)
+		l.size += int64(n)
+	}
+	if err != nil {
+		eventLogErrorsTotal.Inc(l.cfg.Path)
+		logf(slog.LevelError, "EVENTS: write to %s failed: %v", l.cfg.Path, err)
+	}
+}
+
+// rotate moves the full file to <path>.1, replacing an older one, and
+// starts a new file. Callers hold mu.
+func (l *eventLog) rotate() {
+	l.file.Close()
+	if err := os.Rename(l.cfg.Path, l.cfg.Path+".1"); err != nil {
+		logf(slog.LevelError, "EVENTS: rotating %s failed: %v", l.cfg.Path, err)
+	}
+	l.out, l.file = nil, nil
+	if err := l.open(); err != nil {
+		logf(slog.LevelError, "EVENTS: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req["model"] == "limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"slow down"}}`)
+		case req["stream"] == true:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(w, `data: {"choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":null}]}`)
+			fmt.Fprintln(w, `data: {"choices":[{"index":0,"delta":{},"finish_reason":"length"}],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}`)
+			fmt.Fprintln(w, `data: [DONE]`)
+		default:
+			fmt.Fprint(w, `{"choices":[{"index":0,"message":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+		}
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	cfg := &Config{
+		Upstream:   upstream.URL,
+		ModelRules: []ModelRule{{MatchModel: "gpt-*", Set: map[string]any{"model": "qwen3"}}},
+		EventLog:   &EventLogConfig{Path: path},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"model":"gpt-4o"}`,
+		`{"model":"gpt-4o","stream":true}`,
+		`{"model":"limited"}`,
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []requestEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e requestEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	e := events[0]
+	if e.Schema != eventSchemaVersion || e.Event != "request.completed" || e.Model != "gpt-4o" || e.UpstreamModel != "qwen3" ||
+		e.Rule != "gpt-*" || e.Upstream != parseURL(upstream.URL).Host || e.Status != 200 || e.FinishReason != "stop" ||
+		e.ErrorClass != "" || e.TotalTokens != 8 || e.TTFTMs == nil || e.RequestBytes == 0 {
+		t.Errorf("non-stream event: %+v", e)
+	}
+	if e := events[1]; !e.Stream || e.FinishReason != "length" || e.PromptTokens != 7 {
+		t.Errorf("stream event: %+v", e)
+	}
+	if e := events[2]; e.Status != 429 || e.ErrorClass != errorClassRateLimited || e.Rule != "" {
+		t.Errorf("rate limited event: %+v", e)
+	}
+}
+
+func TestEventLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := openEventLog(EventLogConfig{Path: path, MaxBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.write([]byte("first-line\n"))
+	l.write([]byte("second\n"))
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "first-line\n" {
+		t.Errorf("rotated file: %q", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "second\n" {
+		t.Errorf("current file: %q", b)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExperimentConfig splits the traffic of a rule between variants of the
+// request. Each end user lands in the same variant on every request, and
+// the per-variant metrics show how the variants compare.
+type ExperimentConfig struct {
+	Name     string              `json:"name"`      // shown in the response header and the metrics
+	BucketBy string              `json:"bucket_by"` // request field hashed to pick the variant, e.g. "metadata.user_id" (default "user")
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+// ExperimentVariant is one arm of an experiment.
+type ExperimentVariant struct {
+	Name         string         `json:"name"`
+	Weight       int            `json:"weight"`        // share of the traffic relative to the other variants; all 0 splits evenly
+	Set          map[string]any `json:"set"`           // request fields overwritten, e.g. {"temperature": 0.3}
+	SystemPrompt string         `json:"system_prompt"` // replaces the system message of chat requests
+}
+
+// experimentHeader tags responses with the variant of each experiment the
+// request took part in, as "name=variant, ...".
+const experimentHeader = "X-Relay-Experiment"
+
+const defaultBucketBy = "user"
+
+var experimentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var (
+	experimentRequestsTotal = metrics.newCounterVec("relay_experiment_requests_total",
+		"Requests in each experiment variant, by response status.", "experiment", "variant", "status")
+	experimentTokensTotal = metrics.newCounterVec("relay_experiment_tokens_total",
+		"Tokens used by each experiment variant, by type (prompt/completion).", "experiment", "variant", "type")
+	experimentCostTotal = metrics.newCounterVec("relay_experiment_cost_total",
+		"Cost of the requests in each experiment variant, for models with prices.", "experiment", "variant")
+	experimentDuration = metrics.newHistogramVec("relay_experiment_duration_seconds",
+		"Time to complete the requests in each experiment variant.", durationBuckets, "experiment", "variant")
+)
+
+var durationBuckets = []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64, 128}
+
+func validateExperiments(exps []ExperimentConfig) error {
+	names := map[string]bool{}
+	for _, e := range exps {
+		if !experimentNamePattern.MatchString(e.Name) {
+			return fmt.Errorf("experiment name %q must be letters, digits, '_', '.' or '-'", e.Name)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate experiment %q", e.Name)
+		}
+		names[e.Name] = true
+		if e.BucketBy != "" && strings.Contains("."+e.BucketBy+".", "..") {
+			return fmt.Errorf("experiment %q: invalid bucket_by %q", e.Name, e.BucketBy)
+		}
+		if len(e.Variants) < 2 {
+			return fmt.Errorf("experiment %q needs at least two variants", e.Name)
+		}
+		variants := map[string]bool{}
+		for _, v := range e.Variants {
+			if !experimentNamePattern.MatchString(v.Name) {
+				return fmt.Errorf("experiment %q: variant name %q must be letters, digits, '_', '.' or '-'", e.Name, v.Name)
+			}
+			if variants[v.Name] {
+				return fmt.Errorf("experiment %q: duplicate variant %q", e.Name, v.Name)
+			}
+			variants[v.Name] = true
+			if v.Weight < 0 {
+				return fmt.Errorf("experiment %q: variant %q has a negative weight", e.Name, v.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// experimentAssignment is the variant a request got in one experiment.
+type experimentAssignment struct {
+	experiment string
+	variant    *ExperimentVariant
+}
+
+// pick returns the variant for key. The experiment name is hashed in, so
+// a user's variants in different experiments are independent.
+func (e *ExperimentConfig) pick(key string) *ExperimentVariant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	if total == 0 {
+		return &e.Variants[sum%uint64(len(e.Variants))]
+	}
+	n := int(sum % uint64(total))
+	for i := range e.Variants {
+		if n < e.Variants[i].Weight {
+			return &e.Variants[i]
+		}
+		n -= e.Variants[i].Weight
+	}
+	return &e.Variants[len(e.Variants)-1]
+}
+
+// bucketKey is what a request is assigned a variant by: the bucket_by
+// field, or without it the client key, so one client's requests still go
+// to one variant. Requests with neither take part in no experiment.
+func bucketKey(e *ExperimentConfig, r *http.Request, payload map[string]any) string {
+	path := e.BucketBy
+	if path == "" {
+		path = defaultBucketBy
+	}
+	var v any = payload
+	for _, name := range strings.Split(path, ".") {
+		obj, _ := v.(map[string]any)
+		v = obj[name]
+	}
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if info := requestInfoFrom(r.Context()); info != nil && info.client != "" {
+		return "client:" + info.client
+	}
+	if token := bearerToken(r); token != "" {
+		return "client:" + keyFingerprint(token)
+	}
+	return ""
+}
+
+// assignExperiments picks the request's variant in each experiment of the
+// rule. It runs before the rule is applied, since the rule may unset the
+// field the requests are bucketed by.
+func assignExperiments(r *http.Request, rule *ModelRule, payload map[string]any) []experimentAssignment {
+	if rule == nil {
+		return nil
+	}
+	var out []experimentAssignment
+	for i := range rule.Experiments {
+		e := &rule.Experiments[i]
+		key := bucketKey(e, r, payload)
+		if key == "" {
+			vlogCtx(r.Context(), "EXPERIMENT: '%s' skipped, the request has no %s and no client key", e.Name, cmp.Or(e.BucketBy, defaultBucketBy))
+			continue
+		}
+		out = append(out, experimentAssignment{e.Name, e.pick(key)})
+	}
+	return out
+}
+
+// applyExperiments changes the request as its variants say, after the rule
+// so a variant can override what the rule sets, tags the response and
+// records the variants for the metrics.
+func applyExperiments(w http.ResponseWriter, r *http.Request, assigned []experimentAssignment, payload map[string]any) {
+	if len(assigned) == 0 {
+		return
+	}
+	tags := make([]string, 0, len(assigned))
+	for _, a := range assigned {
+		for k, v := range a.variant.Set {
+			payload[k] = cloneValue(v)
+		}
+		if a.variant.SystemPrompt != "" {
+			if messages, ok := payload["messages"].([]any); ok {
+				payload["messages"] = replaceSystemPrompt(messages, a.variant.SystemPrompt)
+			}
+		}
+		tags = append(tags, a.experiment+"="+a.variant.Name)
+		vlogCtx(r.Context(), "EXPERIMENT: '%s' variant '%s'", a.experiment, a.variant.Name)
+	}
+	w.Header().Set(experimentHeader, strings.Join(tags, ", "))
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.experiments = assigned
+	}
+}
+
+// replaceSystemPrompt swaps the content of the leading system message for
+// prompt, or adds a system message.
+func replaceSystemPrompt(messages []any, prompt string) []any {
+	if len(messages) > 0 {
+		if m, ok := messages[0].(map[string]any); ok && getString(m, "role") == "system" {
+			out := append([]any(nil), messages...)
+			system := make(map[string]any, len(m))
+			for k, v := range m {
+				system[k] = v
+			}
+			system["content"] = prompt
+			out[0] = system
+			return out
+		}
+	}
+	return append([]any{map[string]any{"role": "system", "content": prompt}}, messages...)
+}
+
+// observeExperiments counts a finished request in the metrics of its
+// variants.
+func observeExperiments(info *requestInfo, status int, usage tokenUsage, cost float64, priced bool, elapsed time.Duration) {
+	for _, a := range info.experiments {
+		experimentRequestsTotal.Inc(a.experiment, a.variant.Name, strconv.Itoa(status))
+		experimentTokensTotal.Add(float64(usage.PromptTokens), a.experiment, a.variant.Name, "prompt")
+		experimentTokensTotal.Add(float64(usage.CompletionTokens), a.experiment, a.variant.Name, "completion")
+		if priced {
+			experimentCostTotal.Add(cost, a.experiment, a.variant.Name)
+		}
+		experimentDuration.Observe(elapsed.Seconds(), a.experiment, a.variant.Name)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExperiments(t *testing.T) {
+	var upstreamBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"ok"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{{
+			MatchModel: "default",
+			Set:        map[string]any{"temperature": 1.0},
+			Unset:      []string{"user"},
+			Experiments: []ExperimentConfig{
+				{Name: "temp", Variants: []ExperimentVariant{
+					{Name: "low", Weight: 50, Set: map[string]any{"temperature": 0.3}},
+					{Name: "high", Weight: 50, Set: map[string]any{"temperature": 0.7}},
+				}},
+				{Name: "prompt", BucketBy: "metadata.user_id", Variants: []ExperimentVariant{
+					{Name: "A"},
+					{Name: "B", SystemPrompt: "Be brief."},
+				}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// users are split about evenly, and each stays in its variant
+	variants := map[string]int{}
+	for i := range 400 {
+		body := fmt.Sprintf(`{"model":"m","user":"user-%d","messages":[{"role":"user","content":"hi"}]}`, i)
+		w := send(body, "")
+		tag := w.Header().Get(experimentHeader)
+		low := strings.Contains(tag, "temp=low")
+		if !low && !strings.Contains(tag, "temp=high") {
+			t.Fatalf("%s: %q", experimentHeader, tag)
+		}
+		want := 0.7
+		if low {
+			variants["low"]++
+			want = 0.3
+		}
+		if upstreamBody["temperature"] != want {
+			t.Fatalf("variant %q sent temperature %v", tag, upstreamBody["temperature"])
+		}
+		if _, ok := upstreamBody["user"]; ok {
+			t.Fatal("the rule's unset was not applied")
+		}
+		if i%50 == 0 && send(body, "").Header().Get(experimentHeader) != tag {
+			t.Errorf("user-%d changed variant", i)
+		}
+	}
+	if variants["low"] < 160 || variants["low"] > 240 {
+		t.Errorf("%d of 400 users in the low variant", variants["low"])
+	}
+
+	// the second experiment buckets by metadata.user_id and swaps the
+	// system prompt
+	prompts := map[string]bool{}
+	for i := range 20 {
+		w := send(fmt.Sprintf(`{"model":"m","metadata":{"user_id":"u%d"},"messages":[{"role":"system","content":"Be thorough."},{"role":"user","content":"hi"}]}`, i), "")
+		messages := upstreamBody["messages"].([]any)
+		system := messages[0].(map[string]any)["content"].(string)
+		b := strings.Contains(w.Header().Get(experimentHeader), "prompt=B")
+		if b != (system == "Be brief.") || len(messages) != 2 {
+			t.Fatalf("%q got %v", w.Header().Get(experimentHeader), messages)
+		}
+		prompts[system] = true
+	}
+	if len(prompts) != 2 {
+		t.Errorf("only %v seen", prompts)
+	}
+
+	// without the field the client key decides; with neither no experiment
+	// applies and the rule's own value is sent
+	w := send(`{"model":"m","messages":[]}`, "sk-team")
+	if tag := w.Header().Get(experimentHeader); !strings.Contains(tag, "temp=") || !strings.Contains(tag, "prompt=") {
+		t.Errorf("request with a client key: %q", tag)
+	}
+	w = send(`{"model":"m","messages":[]}`, "")
+	if tag := w.Header().Get(experimentHeader); tag != "" || upstreamBody["temperature"] != 1.0 {
+		t.Errorf("anonymous request: %q, temperature %v", tag, upstreamBody["temperature"])
+	}
+
+	if got := experimentRequestsTotal.Value("temp", "low", "200") + experimentRequestsTotal.Value("temp", "high", "200"); got != 400+8+1 {
+		t.Errorf("%v requests counted in the temp experiment", got)
+	}
+	if got := experimentTokensTotal.Value("temp", "low", "completion"); got != 5*experimentRequestsTotal.Value("temp", "low", "200") {
+		t.Errorf("%v completion tokens in the low variant", got)
+	}
+}
+
+func TestValidateExperiments(t *testing.T) {
+	two := []ExperimentVariant{{Name: "a"}, {Name: "b"}}
+	for _, tt := range []struct {
+		exps    []ExperimentConfig
+		wantErr string
+	}{
+		{[]ExperimentConfig{{Name: "temp", Variants: two}}, ""},
+		{[]ExperimentConfig{{Name: "temp test", Variants: two}}, "experiment name"},
+		{[]ExperimentConfig{{Name: "x", Variants: two}, {Name: "x", Variants: two}}, "duplicate experiment"},
+		{[]ExperimentConfig{{Name: "x", Variants: two[:1]}}, "at least two variants"},
+		{[]ExperimentConfig{{Name: "x", Variants: []ExperimentVariant{{Name: "a"}, {Name: "a"}}}}, "duplicate variant"},
+		{[]ExperimentConfig{{Name: "x", Variants: []ExperimentVariant{{Name: "a", Weight: -1}, {Name: "b"}}}}, "negative weight"},
+		{[]ExperimentConfig{{Name: "x", BucketBy: "metadata..id", Variants: two}}, "invalid bucket_by"},
+	} {
+		err := validateExperiments(tt.exps)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: %v, want %q", tt.exps, err, tt.wantErr)
+		}
+	}
+}
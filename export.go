@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportConfig configures a batch exporter of per-request usage records.
+type ExportConfig struct {
+	Type      string `json:"type"`       // "clickhouse" or "postgres"
+	DSN       string `json:"dsn"`        // clickhouse: HTTP interface URL; postgres: connection string
+	Table     string `json:"table"`      // default "llm_requests"
+	Interval  string `json:"interval"`   // flush interval, default "10s"
+	BatchSize int    `json:"batch_size"` // flush early once this many records are queued; default 500
+}
+
+// requestRecord is one exported row.
+type requestRecord struct {
+	Time             time.Time `json:"time"`
+	Path             string    `json:"path"`
+	Model            string    `json:"model"`
+	Tenant           string    `json:"tenant"`
+	Key              string    `json:"key"`
+	Status           int       `json:"status"`
+	Stream           bool      `json:"stream"`
+	LatencyMs        int64     `json:"latency_ms"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+}
+
+// recordSink writes a batch of records to an external store.
+type recordSink interface {
+	write(ctx context.Context, records []requestRecord) error
+}
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// maxQueuedBatches bounds how much is retained while a sink is failing.
+const maxQueuedBatches = 10
+
+// exporter buffers records and flushes them to its sink on an interval.
+type exporter struct {
+	name      string
+	sink      recordSink
+	interval  time.Duration
+	batchSize int
+
+	mu      sync.Mutex
+	pending []requestRecord
+	kick    chan struct{}
+}
+
+func newExporter(cfg ExportConfig) (*exporter, error) {
+	if cfg.Table == "" {
+		cfg.Table = "llm_requests"
+	}
+	if !tableNamePattern.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("invalid table name %q", cfg.Table)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	interval := 10 * time.Second
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", cfg.Interval)
+		}
+		interval = d
+	}
+
+	var sink recordSink
+	switch cfg.Type {
+	case "clickhouse":
+		u, err := url.Parse(cfg.DSN)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid clickhouse dsn %q", cfg.DSN)
+		}
+		sink = &clickhouseSink{endpoint: u, table: cfg.Table, client: &http.Client{Timeout: 30 * time.Second}}
+	case "postgres":
+		pg, err := parsePostgresDSN(cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		sink = &postgresSink{cfg: pg, table: cfg.Table}
+	default:
+		return nil, fmt.Errorf("unknown exporter type %q", cfg.Type)
+	}
+
+	return &exporter{
+		name:      cfg.Type,
+		sink:      sink,
+		interval:  interval,
+		batchSize: cfg.BatchSize,
+		kick:      make(chan struct{}, 1),
+	}, nil
+}
+
+// add queues a record, dropping the oldest ones when the sink has fallen far behind.
+func (e *exporter) add(rec requestRecord) {
+	e.mu.Lock()
+	e.pending = append(e.pending, rec)
+	if limit := e.batchSize * maxQueuedBatches; len(e.pending) > limit {
+		dropped := len(e.pending) - limit
+		e.pending = append(e.pending[:0:0], e.pending[dropped:]...)
+		logf(slog.LevelWarn, "EXPORT: %s backlog full, dropped %d records", e.name, dropped)
+	}
+	full := len(e.pending) >= e.batchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) queueDepth() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.pending)
+}
+
+// flush writes everything queued; records stay queued if the sink fails.
+func (e *exporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	for start := 0; start < len(batch); start += e.batchSize {
+		end := min(start+e.batchSize, len(batch))
+		if err := e.sink.write(ctx, batch[start:end]); err != nil {
+			e.mu.Lock()
+			e.pending = append(batch[start:], e.pending...)
+			e.mu.Unlock()
+			return err
+		}
+		vlog("EXPORT: wrote %d records to %s", end-start, e.name)
+	}
+	return nil
+}
+
+// run flushes until ctx is done, with a final flush on the way out.
+func (e *exporter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := e.flush(final); err != nil {
+				logf(slog.LevelWarn, "EXPORT: final %s flush failed, %d records lost: %v", e.name, e.queueDepth(), err)
+			}
+			return
+		case <-ticker.C:
+		case <-e.kick:
+		}
+		if err := e.flush(ctx); err != nil {
+			logf(slog.LevelWarn, "EXPORT: %s flush failed: %v", e.name, err)
+		}
+	}
+}
+
+// clickhouseSink inserts rows through the ClickHouse HTTP interface.
+type clickhouseSink struct {
+	endpoint *url.URL
+	table    string
+	client   *http.Client
+}
+
+func (s *clickhouseSink) write(ctx context.Context, records []requestRecord) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	u := *s.endpoint
+	u.User = nil
+	q := u.Query()
+	q.Set("query", "INSERT INTO "+s.table+" FORMAT JSONEachRow")
+	q.Set("date_time_input_format", "best_effort")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &body)
+	if err != nil {
+		return err
+	}
+	if user := s.endpoint.User; user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// postgresSink inserts each batch as multi-row INSERTs that commit
+// together, over a connection kept between batches.
+type postgresSink struct {
+	cfg   *pgConfig
+	table string
+
+	mu   sync.Mutex
+	conn *pgConn // nil until the first write and after a failed one
+}
+
+const postgresColumns = 11
+
+// postgresMaxRows keeps a statement under the protocol's 65535 parameters.
+const postgresMaxRows = 65535 / postgresColumns
+
+func (s *postgresSink) write(ctx context.Context, records []requestRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := dialPostgres(ctx, s.cfg)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var statements []pgStatement
+	for start := 0; start < len(records); start += postgresMaxRows {
+		rows := records[start:min(start+postgresMaxRows, len(records))]
+		var query strings.Builder
+		query.WriteString("INSERT INTO " + s.table +
+			" (time, path, model, tenant, key, status, stream, latency_ms, prompt_tokens, completion_tokens, total_tokens) VALUES ")
+		args := make([]string, 0, len(rows)*postgresColumns)
+		for i, rec := range rows {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for j := range postgresColumns {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				fmt.Fprintf(&query, "$%d", i*postgresColumns+j+1)
+			}
+			query.WriteString(")")
+			args = append(args, rec.Time.UTC().Format(time.RFC3339Nano), rec.Path, rec.Model, rec.Tenant, rec.Key,
+				strconv.Itoa(rec.Status), strconv.FormatBool(rec.Stream), strconv.FormatInt(rec.LatencyMs, 10),
+				strconv.Itoa(rec.PromptTokens), strconv.Itoa(rec.CompletionTokens), strconv.Itoa(rec.TotalTokens))
+		}
+		statements = append(statements, pgStatement{query.String(), args})
+	}
+	if err := s.conn.execBatch(ctx, statements); err != nil {
+		// the connection may be in any state; start over on the next batch
+		s.conn.close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSink struct {
+	mu      sync.Mutex
+	fail    bool
+	batches [][]requestRecord
+}
+
+func (s *fakeSink) write(ctx context.Context, records []requestRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("sink down")
+	}
+	s.batches = append(s.batches, append([]requestRecord(nil), records...))
+	return nil
+}
+
+func TestRecordUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"hi"}}]}`)
+			fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}`)
+			fmt.Fprintln(w, `data: [DONE]`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"x","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		stream bool
+		want   tokenUsage
+	}{
+		{"non-stream", false, tokenUsage{5, 3, 8}},
+		{"stream", true, tokenUsage{7, 2, 9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{}
+			e := &exporter{name: "fake", sink: sink, batchSize: 10, kick: make(chan struct{}, 1)}
+			handler := recordUsage(&Config{}, []*exporter{e}, func(w http.ResponseWriter, r *http.Request) {
+				proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+			})
+
+			body := fmt.Sprintf(`{"model":"glm","stream":%v,"messages":[]}`, tt.stream)
+			r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer client-key")
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if err := e.flush(context.Background()); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+			if len(sink.batches) != 1 || len(sink.batches[0]) != 1 {
+				t.Fatalf("expected one record, got %v", sink.batches)
+			}
+			rec := sink.batches[0][0]
+			if rec.Model != "glm" || rec.Status != http.StatusOK || rec.Stream != tt.stream || rec.Path != "/v1/chat/completions" {
+				t.Errorf("unexpected record: %+v", rec)
+			}
+			if rec.Key != keyFingerprint("client-key") {
+				t.Errorf("expected key fingerprint, got %q", rec.Key)
+			}
+			got := tokenUsage{rec.PromptTokens, rec.CompletionTokens, rec.TotalTokens}
+			if got != tt.want {
+				t.Errorf("usage = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExporterRetainsRecordsOnFailure(t *testing.T) {
+	sink := &fakeSink{fail: true}
+	e := &exporter{name: "fake", sink: sink, batchSize: 2, kick: make(chan struct{}, 1)}
+	for i := 0; i < 3; i++ {
+		e.add(requestRecord{Status: 200 + i})
+	}
+	if len(e.kick) != 1 {
+		t.Errorf("reaching batch_size should trigger an early flush")
+	}
+
+	if err := e.flush(context.Background()); err == nil {
+		t.Fatal("expected flush error")
+	}
+	if len(e.pending) != 3 {
+		t.Fatalf("failed records should stay queued, got %d", len(e.pending))
+	}
+
+	sink.fail = false
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 2 || len(sink.batches[1]) != 1 {
+		t.Errorf("expected batches of 2 and 1, got %v", sink.batches)
+	}
+	if sink.batches[0][0].Status != 200 || sink.batches[1][0].Status != 202 {
+		t.Errorf("records should keep their order: %v", sink.batches)
+	}
+
+	for i := 0; i < 2*maxQueuedBatches+5; i++ {
+		e.add(requestRecord{Status: i})
+	}
+	if len(e.pending) != 2*maxQueuedBatches || e.pending[0].Status != 5 {
+		t.Errorf("backlog should drop the oldest records, got %d starting at %d", len(e.pending), e.pending[0].Status)
+	}
+}
+
+func TestExporterFlushesOnStop(t *testing.T) {
+	sink := &fakeSink{}
+	e := &exporter{name: "fake", sink: sink, interval: time.Hour, batchSize: 10, kick: make(chan struct{}, 1)}
+	e.add(requestRecord{Status: 200})
+	b := newBackground()
+	b.run(e.run)
+	b.stop()
+	if len(sink.batches) != 1 || len(e.pending) != 0 {
+		t.Errorf("queued record not written on stop: %v", sink.batches)
+	}
+}
+
+func TestClickHouseSink(t *testing.T) {
+	var query, user, pass string
+	var rows []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		user, pass, _ = r.BasicAuth()
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var row map[string]any
+			if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+				t.Errorf("invalid row %q: %v", sc.Text(), err)
+			}
+			rows = append(rows, row)
+		}
+		if r.URL.Query().Get("database") != "analytics" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Code: 81. DB::Exception: Database does not exist")
+		}
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://relay:secret@", 1) + "/?database=analytics"
+	e, err := newExporter(ExportConfig{Type: "clickhouse", DSN: dsn})
+	if err != nil {
+		t.Fatalf("newExporter() failed: %v", err)
+	}
+	e.add(requestRecord{Model: "a", TotalTokens: 3})
+	e.add(requestRecord{Model: "b", TotalTokens: 4})
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if query != "INSERT INTO llm_requests FORMAT JSONEachRow" {
+		t.Errorf("unexpected query %q", query)
+	}
+	if user != "relay" || pass != "secret" {
+		t.Errorf("expected basic auth from dsn, got %q/%q", user, pass)
+	}
+	if len(rows) != 2 || rows[1]["model"] != "b" || rows[1]["total_tokens"] != float64(4) {
+		t.Errorf("unexpected rows: %v", rows)
+	}
+
+	bad, _ := newExporter(ExportConfig{Type: "clickhouse", DSN: server.URL})
+	bad.add(requestRecord{})
+	if err := bad.flush(context.Background()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected clickhouse error to be surfaced, got %v", err)
+	}
+}
+
+func TestNewExporterValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ExportConfig
+	}{
+		{"unknown type", ExportConfig{Type: "mysql", DSN: "x"}},
+		{"bad table", ExportConfig{Type: "postgres", DSN: "postgres://localhost/db", Table: "t; DROP TABLE x"}},
+		{"bad interval", ExportConfig{Type: "postgres", DSN: "postgres://localhost/db", Interval: "soon"}},
+		{"bad clickhouse dsn", ExportConfig{Type: "clickhouse", DSN: "localhost:8123"}},
+	}
+	for _, tt := range tests {
+		if _, err := newExporter(tt.cfg); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+
+	if _, err := newExporter(ExportConfig{Type: "postgres", DSN: "postgres://localhost/db", Table: "metrics.llm_requests"}); err != nil {
+		t.Errorf("schema-qualified table should be accepted: %v", err)
+	}
+}
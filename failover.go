@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// FallbackTarget is where a request goes when the rule's upstream fails
+// with a 5xx, a 429 or a connection error.
+type FallbackTarget struct {
+	Upstream   string `json:"upstream"`     // base URL of an OpenAI compatible upstream; empty keeps the rule's upstream
+	Model      string `json:"model"`        // model to ask for instead; empty keeps the request's
+	APIKey     string `json:"api_key"`      // key for a different upstream
+	APIKeyFile string `json:"api_key_file"` // file holding that key
+}
+
+// defaultFallbackBudget is the share of a rule's requests per minute that
+// may fail over when fallback_budget is not set. At least
+// minFallbacksPerMinute are always allowed, so quiet rules still fail over.
+const (
+	defaultFallbackBudget = 0.2
+	minFallbacksPerMinute = 10
+)
+
+var (
+	upstreamFallbacksTotal = metrics.newCounterVec("relay_upstream_fallbacks_total",
+		"Requests sent to a fallback after the upstream failed.", "tenant", "model", "reason")
+	fallbackBudgetExhaustedTotal = metrics.newCounterVec("relay_fallback_budget_exhausted_total",
+		"Failed requests not sent to a fallback because the budget was spent.", "tenant", "model")
+)
+
+func validateFallbacks(rule *ModelRule) error {
+	for i, fb := range rule.Fallbacks {
+		if fb.Upstream == "" && fb.Model == "" {
+			return fmt.Errorf("fallbacks[%d]: upstream or model is required", i)
+		}
+		if fb.Upstream != "" {
+			if u, err := url.Parse(fb.Upstream); err != nil || u.Host == "" {
+				return fmt.Errorf("fallbacks[%d]: invalid upstream %q", i, fb.Upstream)
+			}
+		}
+	}
+	if rule.FallbackBudget < 0 || rule.FallbackBudget > 1 {
+		return fmt.Errorf("fallback_budget must be between 0 and 1")
+	}
+	return nil
+}
+
+// fallbackBudget counts a rule's requests and failovers in a fixed
+// one-minute window, so a failing upstream cannot turn every request into
+// several and swamp the fallbacks.
+type fallbackBudget struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	spent       int
+}
+
+// fallbackBudgets holds a budget per tenant and rule.
+var fallbackBudgets sync.Map
+
+func budgetFor(tenant string, rule *ModelRule) *fallbackBudget {
+	b, _ := fallbackBudgets.LoadOrStore(tenant+"\x00"+ruleName(rule), &fallbackBudget{})
+	return b.(*fallbackBudget)
+}
+
+func (b *fallbackBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) >= time.Minute {
+		b.windowStart, b.requests, b.spent = now, 0, 0
+	}
+}
+
+func (b *fallbackBudget) request(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	b.requests++
+}
+
+// spend takes one failover from the budget, reporting false when none is left.
+func (b *fallbackBudget) spend(ratio float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	if b.spent >= max(minFallbacksPerMinute, int(ratio*float64(b.requests))) {
+		return false
+	}
+	b.spent++
+	return true
+}
+
+// failoverReason reports why a response should go to a fallback, or "".
+func failoverReason(resp *http.Response, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return "status"
+	}
+	return ""
+}
+
+// withFallbacks wraps send, which sends to the rule's upstream, so that a
+// failed request is sent to the rule's fallbacks in turn. Fallbacks on the
+// same upstream go through send with the model replaced; others get the
+// body at path, without the client's Authorization. The last answer is
+// returned when every target fails.
+func withFallbacks(r *http.Request, path *url.URL, rule *ModelRule, model string, send func([]byte) (*http.Response, error)) func([]byte) (*http.Response, error) {
+	if rule == nil || len(rule.Fallbacks) == 0 {
+		return send
+	}
+	ctx := r.Context()
+	tenant, label := tenantName(ctx), metricModel(rule)
+	budget := budgetFor(tenant, rule)
+	ratio := rule.FallbackBudget
+	if ratio == 0 {
+		ratio = defaultFallbackBudget
+	}
+	return func(body []byte) (*http.Response, error) {
+		budget.request(time.Now())
+		resp, err := send(body)
+		for i, fb := range rule.Fallbacks {
+			reason := failoverReason(resp, err)
+			if reason == "" || ctx.Err() != nil {
+				break
+			}
+			if !budget.spend(ratio, time.Now()) {
+				vlogCtx(r.Context(), "FALLBACK: budget spent for rule '%s', not failing over", ruleName(rule))
+				fallbackBudgetExhaustedTotal.Inc(tenant, label)
+				break
+			}
+			if err != nil {
+				vlogCtx(r.Context(), "FALLBACK: upstream error for model '%s': %v, trying fallback %d", model, err, i+1)
+			} else {
+				vlogCtx(r.Context(), "FALLBACK: upstream status %d for model '%s', trying fallback %d", resp.StatusCode, model, i+1)
+				resp.Body.Close()
+			}
+			upstreamFallbacksTotal.Inc(tenant, label, reason)
+
+			fbBody := body
+			if fb.Model != "" {
+				if fbBody, err = replaceModel(body, fb.Model); err != nil {
+					return nil, err
+				}
+			}
+			if fb.Upstream == "" {
+				resp, err = send(fbBody)
+				continue
+			}
+			up, _ := url.Parse(fb.Upstream) // validated at startup
+			fbRule := &ModelRule{MatchModel: rule.MatchModel, APIKey: fb.APIKey, APIKeyFile: fb.APIKeyFile}
+			resp, err = sendJSONUpstream(r, upstreamFor(&Config{}, up), path, fbRule, false, fbBody)
+		}
+		return resp, err
+	}
+}
+
+// replaceModel returns body with its model field set to model.
+func replaceModel(body []byte, model string) ([]byte, error) {
+	var obj map[string]any
+	if err := json.Unmarshal(body, &obj); err != nil || obj == nil {
+		return nil, fmt.Errorf("fallback: request body is not a JSON object")
+	}
+	obj["model"] = model
+	return json.Marshal(obj)
+}
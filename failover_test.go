@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFallbacks(t *testing.T) {
+	var models []string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		models = append(models, getString(req, "model"))
+		if getString(req, "model") != "small" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":{"message":"model is loading"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"from small"}}]}`)
+	}))
+	defer primary.Close()
+
+	var backupAuth, backupModel string
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupAuth = r.Header.Get("Authorization")
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		backupModel = getString(req, "model")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"from backup"}}]}`)
+	}))
+	defer backup.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := &Config{
+		ForwardAuth: true,
+		ModelRules: []ModelRule{
+			{MatchModel: "big", Fallbacks: []FallbackTarget{{Model: "small"}}},
+			{MatchModel: "remote", Fallbacks: []FallbackTarget{{Upstream: down.URL}, {Upstream: backup.URL, Model: "gpt-4o-mini", APIKey: "sk-backup"}}},
+			{MatchModel: "none"},
+		},
+	}
+	send := func(model string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`"}`))
+		r.Header.Set("Authorization", "Bearer sk-client")
+		proxyWithJSONPatch(w, r, parseURL(primary.URL), true, cfg, func(req map[string]any) error {
+			applyRules(cfg, req)
+			return nil
+		})
+		return w
+	}
+
+	models = nil
+	if w := send("big"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "from small") || fmt.Sprint(models) != "[big small]" {
+		t.Errorf("same upstream: %d %s, upstream saw %v", w.Code, w.Body, models)
+	}
+	if w := send("remote"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "from backup") {
+		t.Errorf("other upstream: %d %s", w.Code, w.Body)
+	}
+	if backupAuth != "Bearer sk-backup" || backupModel != "gpt-4o-mini" {
+		t.Errorf("backup got auth %q model %q", backupAuth, backupModel)
+	}
+	if w := send("none"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without fallbacks: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestFallbackBudget(t *testing.T) {
+	var b fallbackBudget
+	now := time.Now()
+	for range 100 {
+		b.request(now)
+	}
+	spent := 0
+	for b.spend(0.2, now) {
+		spent++
+	}
+	if spent != 20 {
+		t.Errorf("spent %d failovers for 100 requests, want 20", spent)
+	}
+	if !b.spend(0.2, now.Add(time.Minute)) {
+		t.Error("budget not renewed in the next window")
+	}
+
+	var quiet fallbackBudget
+	quiet.request(now)
+	for i := range minFallbacksPerMinute {
+		if !quiet.spend(0.2, now) {
+			t.Fatalf("failover %d refused, want at least %d per minute", i+1, minFallbacksPerMinute)
+		}
+	}
+}
+
+func TestValidateFallbacks(t *testing.T) {
+	for _, rule := range []ModelRule{
+		{Fallbacks: []FallbackTarget{{}}},
+		{Fallbacks: []FallbackTarget{{Upstream: "not a url"}}},
+		{Fallbacks: []FallbackTarget{{Model: "m"}}, FallbackBudget: 1.5},
+	} {
+		if err := validateFallbacks(&rule); err == nil {
+			t.Errorf("validateFallbacks(%+v) succeeded, want error", rule)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxEmulatedN bounds how many upstream requests one client request may fan
+// out to.
+const maxEmulatedN = 16
+
+var fanOutTotal = metrics.newCounterVec("relay_fanout_requests_total",
+	"Requests with n > 1 emulated by parallel upstream requests.", "tenant", "model")
+
+// emulatedN returns the n to fan out to, or 0 when the request is served by a
+// single upstream request.
+func emulatedN(rule *ModelRule, payload map[string]any) int {
+	if rule == nil || !rule.EmulateN {
+		return 0
+	}
+	n, _ := payload["n"].(float64)
+	if n <= 1 {
+		return 0
+	}
+	return int(n)
+}
+
+// fanOut sends body n times with n set to 1 and merges the responses into one
+// that looks like the upstream generated n choices itself. A failed or non-200
+// upstream response is returned as is and the others are dropped.
+func fanOut(body []byte, n int, stream bool, send func([]byte) (*http.Response, error)) (*http.Response, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	payload["n"] = 1
+	single, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	resps := make([]*http.Response, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = send(single)
+		}()
+	}
+	wg.Wait()
+
+	closeAll := func(except *http.Response) {
+		for _, resp := range resps {
+			if resp != nil && resp != except {
+				resp.Body.Close()
+			}
+		}
+	}
+	for i, resp := range resps {
+		if errs[i] != nil {
+			closeAll(nil)
+			return nil, errs[i]
+		}
+		if resp.StatusCode != http.StatusOK {
+			closeAll(resp)
+			return resp, nil
+		}
+	}
+
+	merged := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     resps[0].Status,
+		Header:     resps[0].Header.Clone(),
+	}
+	merged.Header.Del("Content-Length")
+	if stream {
+		merged.Body = mergeStreams(resps)
+		return merged, nil
+	}
+	defer closeAll(nil)
+	out, err := mergeBodies(resps)
+	if err != nil {
+		return nil, err
+	}
+	merged.Body = io.NopCloser(bytes.NewReader(out))
+	return merged, nil
+}
+
+// mergeBodies joins non-streaming responses, giving the choices of the i-th
+// response index i. Prompt tokens are counted once, as n > 1 upstreams do.
+func mergeBodies(resps []*http.Response) ([]byte, error) {
+	var merged map[string]any
+	var choices []any
+	var usage fanOutUsage
+	for i, resp := range resps {
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var r map[string]any
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("fan-out response %d: %w", i, err)
+		}
+		if merged == nil {
+			merged = r
+		}
+		cs, _ := r["choices"].([]any)
+		for _, c := range cs {
+			if choice, ok := c.(map[string]any); ok {
+				choice["index"] = i
+			}
+			choices = append(choices, c)
+		}
+		usage.add(r["usage"])
+	}
+	merged["choices"] = choices
+	if usage.seen {
+		merged["usage"] = usage.value()
+	}
+	return json.Marshal(merged)
+}
+
+// fanOutUsage sums the usage objects of fanned-out responses.
+type fanOutUsage struct {
+	seen       bool
+	prompt     float64
+	completion float64
+}
+
+func (u *fanOutUsage) add(v any) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	if !u.seen {
+		u.prompt, _ = m["prompt_tokens"].(float64)
+	}
+	c, _ := m["completion_tokens"].(float64)
+	u.completion += c
+	u.seen = true
+}
+
+func (u *fanOutUsage) value() map[string]any {
+	return map[string]any{
+		"prompt_tokens":     u.prompt,
+		"completion_tokens": u.completion,
+		"total_tokens":      u.prompt + u.completion,
+	}
+}
+
+// fanOutStream interleaves the chunks of several SSE streams as they arrive.
+// Choices are re-indexed by stream, every chunk takes the id of the first
+// chunk seen, and usage is held back and sent summed before a single [DONE].
+type fanOutStream struct {
+	resps []*http.Response
+	pw    *io.PipeWriter
+
+	mu    sync.Mutex
+	id    any
+	usage fanOutUsage
+	last  map[string]any
+}
+
+func mergeStreams(resps []*http.Response) io.ReadCloser {
+	pr, pw := io.Pipe()
+	s := &fanOutStream{resps: resps, pw: pw}
+	go s.run()
+	return &fanOutBody{PipeReader: pr, resps: resps}
+}
+
+func (s *fanOutStream) run() {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.resps))
+	for i, resp := range s.resps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.relay(i, resp.Body)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		s.pw.CloseWithError(err)
+		return
+	}
+	var tail []string
+	if s.usage.seen && s.last != nil {
+		chunk := map[string]any{"choices": []any{}, "usage": s.usage.value()}
+		for _, k := range []string{"object", "created", "model"} {
+			if v, ok := s.last[k]; ok {
+				chunk[k] = v
+			}
+		}
+		chunk["id"] = s.id
+		if data, err := json.Marshal(chunk); err == nil {
+			tail = append(tail, "data: "+string(data), "")
+		}
+	}
+	tail = append(tail, "data: [DONE]", "")
+	if s.write(tail) == nil {
+		s.pw.Close()
+	}
+}
+
+// relay copies the data lines of one stream, dropping its [DONE].
+func (s *fanOutStream) relay(index int, body io.Reader) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "data: ") && line != "data: [DONE]" {
+			if out, ok := s.rewrite(index, strings.TrimPrefix(line, "data: ")); ok {
+				if werr := s.write([]string{"data: " + out, ""}); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// rewrite re-indexes a chunk and strips its usage. ok is false when nothing
+// is left to send.
+func (s *fanOutStream) rewrite(index int, data string) (string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return data, true
+	}
+	s.mu.Lock()
+	if s.id == nil {
+		s.id = chunk["id"]
+	}
+	chunk["id"] = s.id
+	s.usage.add(chunk["usage"])
+	s.last = chunk
+	s.mu.Unlock()
+	delete(chunk, "usage")
+
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return "", false
+	}
+	for _, c := range choices {
+		if choice, ok := c.(map[string]any); ok {
+			choice["index"] = index
+		}
+	}
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return data, true
+	}
+	return string(out), true
+}
+
+// write sends lines as one unit so chunks of different streams do not mix.
+func (s *fanOutStream) write(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.pw, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// fanOutBody closes the upstream bodies along with the merged stream.
+type fanOutBody struct {
+	*io.PipeReader
+	resps []*http.Response
+}
+
+func (b *fanOutBody) Close() error {
+	for _, resp := range b.resps {
+		resp.Body.Close()
+	}
+	return b.PipeReader.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFanOutNonStream(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["n"] != float64(1) {
+			t.Errorf("upstream got n = %v, want 1", body["n"])
+		}
+		i := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"c%d","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"answer %d"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`, i, i)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", EmulateN: true}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","n":3}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	if calls.Load() != 3 {
+		t.Fatalf("upstream calls = %d, want 3", calls.Load())
+	}
+	var resp struct {
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage map[string]float64 `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(resp.Choices) != 3 {
+		t.Fatalf("got %d choices, want 3: %s", len(resp.Choices), w.Body.String())
+	}
+	contents := map[string]bool{}
+	for i, c := range resp.Choices {
+		if c.Index != i {
+			t.Errorf("choice %d has index %d", i, c.Index)
+		}
+		contents[c.Message.Content] = true
+	}
+	if len(contents) != 3 {
+		t.Errorf("expected distinct contents, got %v", contents)
+	}
+	if resp.Usage["prompt_tokens"] != 5 || resp.Usage["completion_tokens"] != 6 || resp.Usage["total_tokens"] != 11 {
+		t.Errorf("unexpected usage: %v", resp.Usage)
+	}
+}
+
+func TestFanOutStream(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := calls.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk(fmt.Sprintf("s%d", i), fmt.Sprintf("part %d", i), ""))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, sseChunk(fmt.Sprintf("s%d", i), "", "stop"))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":4,"completion_tokens":3,"total_tokens":7}}`)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", EmulateN: true}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","n":2,"stream":true}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	out := w.Body.String()
+	if strings.Count(out, "data: [DONE]") != 1 || !strings.HasSuffix(strings.TrimSpace(out), "data: [DONE]") {
+		t.Fatalf("expected a single trailing [DONE]:\n%s", out)
+	}
+	ids := map[any]bool{}
+	finished := map[float64]bool{}
+	var usage map[string]any
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var chunk map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", line, err)
+		}
+		ids[chunk["id"]] = true
+		if u, ok := chunk["usage"].(map[string]any); ok {
+			usage = u
+		}
+		for _, c := range chunk["choices"].([]any) {
+			choice := c.(map[string]any)
+			if choice["finish_reason"] != nil {
+				finished[choice["index"].(float64)] = true
+			}
+		}
+	}
+	var indexes []float64
+	for idx := range finished {
+		indexes = append(indexes, idx)
+	}
+	sort.Float64s(indexes)
+	if fmt.Sprint(indexes) != "[0 1]" {
+		t.Errorf("finished choice indexes = %v, want [0 1]", indexes)
+	}
+	if len(ids) != 1 {
+		t.Errorf("chunks carry %d ids, want 1", len(ids))
+	}
+	if usage == nil || usage["completion_tokens"] != float64(6) || usage["prompt_tokens"] != float64(4) {
+		t.Errorf("unexpected usage: %v", usage)
+	}
+}
+
+func TestFanOutLimit(t *testing.T) {
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", EmulateN: true}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(fmt.Sprintf(`{"model":"m","n":%d}`, maxEmulatedN+1)))
+	proxyWithJSONPatch(w, r, parseURL("http://127.0.0.1:1"), false, cfg, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = ""
+
+// buildVersion falls back to the VCS revision embedded by the Go toolchain.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				return s.Value[:12]
+			}
+		}
+	}
+	return "dev"
+}
+
+type upstreamHealth struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Reachable  bool   `json:"reachable"`
+	Healthy    bool   `json:"healthy"` // reachable, or with health_check, up by its thresholds
+	StatusCode int    `json:"status_code,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+	CheckedAt  string `json:"checked_at"`
+}
+
+type healthReport struct {
+	Status        string           `json:"status"` // "ok", "degraded", "down" (health_check only), "starting" or "maintenance"
+	Version       string           `json:"version"`
+	StartedAt     string           `json:"started_at"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	InFlight      int64            `json:"in_flight_requests"`
+	Upstreams     []upstreamHealth `json:"upstreams"`
+	Routes        []routeHealth    `json:"routes"`
+	Queues        map[string]int   `json:"queues"`
+
+	Preflight []preflightResult `json:"preflight,omitempty"`
+}
+
+// routeHealth summarizes the upstreams one route can send to; the route is
+// down when none of them is healthy.
+type routeHealth struct {
+	Name             string `json:"name"`
+	Healthy          bool   `json:"healthy"`
+	HealthyUpstreams int    `json:"healthy_upstreams"`
+	Upstreams        int    `json:"upstreams"`
+}
+
+// healthzReport is the /healthz body, which leaves out upstream URLs.
+type healthzReport struct {
+	Status string        `json:"status"`
+	Routes []routeHealth `json:"routes"`
+}
+
+type healthUpstream struct {
+	name string
+	url  *url.URL
+}
+
+// healthChecker probes upstreams and reports internal queue depths.
+type healthChecker struct {
+	started  time.Time
+	client   *http.Client
+	ttl      time.Duration // probe results are reused for this long
+	maxStale time.Duration // and served while re-probing in the background until this old
+	inFlight atomic.Int64
+
+	upstreams []healthUpstream
+	queues    map[string]func() int
+	preflight *preflight    // nil without a preflight config
+	active    *activeHealth // nil without a health_check config; probes run on demand then
+
+	mu         sync.Mutex
+	cached     []upstreamHealth
+	checkedAt  time.Time
+	refreshing bool
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		started: time.Now(),
+		client:  &http.Client{Timeout: 3 * time.Second},
+		ttl:     defaultHealthFreshFor,
+		queues:  map[string]func() int{},
+	}
+}
+
+func (h *healthChecker) addUpstream(name string, u *url.URL) {
+	h.upstreams = append(h.upstreams, healthUpstream{name, u})
+}
+
+func (h *healthChecker) addQueue(name string, depth func() int) {
+	h.queues[name] = depth
+}
+
+// ready reports whether the startup preflight, if any, has passed.
+func (h *healthChecker) ready() bool {
+	return h.preflight == nil || h.preflight.ready.Load()
+}
+
+// track counts requests currently being proxied.
+func (h *healthChecker) track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.inFlight.Add(1)
+		defer h.inFlight.Add(-1)
+		next(w, r)
+	}
+}
+
+// probe issues GET /v1/models against an upstream. Any HTTP response, even
+// 401, counts as reachable; only transport failures do not.
+func (h *healthChecker) probe(u healthUpstream) upstreamHealth {
+	res := upstreamHealth{Name: u.name, URL: u.url.Redacted()}
+	target := u.url.ResolveReference(&url.URL{Path: "/v1/models"})
+	start := time.Now()
+	resp, err := h.client.Get(target.String())
+	res.LatencyMs = time.Since(start).Milliseconds()
+	res.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp.Body.Close()
+	res.Reachable = true
+	res.Healthy = true
+	res.StatusCode = resp.StatusCode
+	return res
+}
+
+func (h *healthChecker) upstreamStatus() []upstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	age := time.Since(h.checkedAt)
+	if h.cached != nil && age < h.ttl {
+		return h.cached
+	}
+	if h.cached != nil && age < h.maxStale {
+		if !h.refreshing {
+			h.refreshing = true
+			go h.refresh()
+		}
+		return h.cached
+	}
+	h.cached, h.checkedAt = h.probeAll(), time.Now()
+	return h.cached
+}
+
+// refresh re-probes in the background while stale results are served.
+func (h *healthChecker) refresh() {
+	results := h.probeAll()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cached, h.checkedAt, h.refreshing = results, time.Now(), false
+}
+
+func (h *healthChecker) probeAll() []upstreamHealth {
+	results := make([]upstreamHealth, len(h.upstreams))
+	var wg sync.WaitGroup
+	for i, u := range h.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.probe(u)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// status returns the upstreams and routes from the background checks, or
+// from on-demand probes where every upstream is a route of its own.
+func (h *healthChecker) status() ([]upstreamHealth, []routeHealth) {
+	if h.active != nil {
+		return h.active.status()
+	}
+	ups := h.upstreamStatus()
+	routes := make([]routeHealth, len(ups))
+	for i, u := range ups {
+		routes[i] = routeHealth{Name: u.Name, Healthy: u.Healthy, Upstreams: 1}
+		if u.Healthy {
+			routes[i].HealthyUpstreams = 1
+		}
+	}
+	return ups, routes
+}
+
+// routeDown reports the first route the background checks found without a
+// healthy upstream, or "". Without health_check it never probes.
+func (h *healthChecker) routeDown() string {
+	if h.active == nil {
+		return ""
+	}
+	_, routes := h.active.status()
+	for _, r := range routes {
+		if !r.Healthy {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+func (h *healthChecker) report() healthReport {
+	rep := healthReport{
+		Status:        "ok",
+		Version:       buildVersion(),
+		StartedAt:     h.started.UTC().Format(time.RFC3339),
+		UptimeSeconds: int64(time.Since(h.started).Seconds()),
+		InFlight:      h.inFlight.Load(),
+		Queues:        map[string]int{},
+	}
+	rep.Upstreams, rep.Routes = h.status()
+	for _, u := range rep.Upstreams {
+		if !u.Healthy {
+			rep.Status = "degraded"
+		}
+	}
+	for _, r := range rep.Routes {
+		if !r.Healthy && h.active != nil {
+			rep.Status = "down"
+		}
+	}
+	for name, depth := range h.queues {
+		rep.Queues[name] = depth()
+	}
+	if h.preflight != nil {
+		results, ok := h.preflight.status()
+		rep.Preflight = results
+		if !ok {
+			rep.Status = "starting"
+		}
+	}
+	if maintenance.state().Enabled {
+		rep.Status = "maintenance"
+	}
+	return rep
+}
+
+// serveHealthz serves /healthz: the overall status and per-route health.
+// Unlike the detailed report, a degraded relay answers 200, since every
+// route still has an upstream to send to.
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	rep := h.report()
+	status := http.StatusOK
+	if rep.Status != "ok" && rep.Status != "degraded" {
+		status = http.StatusServiceUnavailable
+	}
+	for _, r := range rep.Routes {
+		if !r.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, healthzReport{Status: rep.Status, Routes: rep.Routes})
+}
+
+// ServeHTTP serves the detailed report; degraded status returns 503.
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rep := h.report()
+	status := http.StatusOK
+	if rep.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthDetails(t *testing.T) {
+	var probes atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if r.URL.Path != "/v1/models" {
+			t.Errorf("unexpected probe path %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	h := newHealthChecker()
+	h.addUpstream("default", parseURL(upstream.URL))
+	h.addQueue("tracing", func() int { return 7 })
+
+	block := make(chan struct{})
+	entered := make(chan struct{})
+	handler := h.track(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-block
+	})
+	go handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	<-entered
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/details", nil))
+	close(block)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var rep healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if rep.Status != "ok" || rep.Version == "" || rep.InFlight != 1 || rep.Queues["tracing"] != 7 {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+	if len(rep.Upstreams) != 1 || !rep.Upstreams[0].Reachable || rep.Upstreams[0].StatusCode != http.StatusUnauthorized {
+		t.Errorf("401 should still count as reachable: %+v", rep.Upstreams)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz/details", nil))
+	if probes.Load() != 1 {
+		t.Errorf("probe results should be cached, got %d probes", probes.Load())
+	}
+}
+
+func TestHealthDetailsDegraded(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := parseURL(down.URL)
+	down.Close()
+
+	h := newHealthChecker()
+	h.addUpstream("default", downURL)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/details", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	var rep healthReport
+	_ = json.Unmarshal(w.Body.Bytes(), &rep)
+	if rep.Status != "degraded" || rep.Upstreams[0].Reachable || rep.Upstreams[0].Error == "" {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+}
+
+func TestHealthDetailsNeedsAdmin(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	for _, tt := range []struct {
+		admin *AdminConfig
+		token string
+		want  int
+	}{
+		{nil, "", http.StatusNotFound},
+		{&AdminConfig{Token: "admin"}, "", http.StatusUnauthorized},
+		{&AdminConfig{Token: "admin"}, "admin", http.StatusOK},
+	} {
+		mux, err := newRelayMux(&Config{Upstream: upstream.URL, Admin: tt.admin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/healthz/details", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("admin %+v, token %q: %d, want %d", tt.admin, tt.token, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig probes every upstream in the background. A route (the
+// top-level upstream, or a tenant's) whose upstreams are all down turns
+// /health and /healthz into 503, so a load balancer in front of several
+// relays can route around it.
+type HealthCheckConfig struct {
+	Interval           string `json:"interval"`            // time between probes (default "10s")
+	Timeout            string `json:"timeout"`             // per probe (default "3s")
+	Path               string `json:"path"`                // probed path (default "/v1/models")
+	UnhealthyThreshold int    `json:"unhealthy_threshold"` // consecutive failures before an upstream is down (default 2)
+	HealthyThreshold   int    `json:"healthy_threshold"`   // consecutive successes before it is up again (default 1)
+}
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 3 * time.Second
+)
+
+var upstreamHealthTransitionsTotal = metrics.newCounterVec("relay_upstream_health_transitions_total",
+	"Upstreams the active health check marked up or down.", "route", "upstream", "state")
+
+func validateHealthCheck(hc *HealthCheckConfig) error {
+	if hc == nil {
+		return nil
+	}
+	for name, v := range map[string]string{"interval": hc.Interval, "timeout": hc.Timeout} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("invalid health_check.%s %q", name, v)
+		}
+	}
+	if hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+		return fmt.Errorf("health_check thresholds must not be negative")
+	}
+	return nil
+}
+
+// healthTarget is one probed base URL: an upstream, or one of its replicas.
+type healthTarget struct {
+	url     *url.URL
+	replica *replica // nil unless the upstream balances over replicas
+
+	// guarded by activeHealth.mu
+	healthy   bool
+	fails     int // consecutive
+	successes int // consecutive
+	last      upstreamHealth
+}
+
+// healthRoute is the set of upstreams one route's requests can go to.
+type healthRoute struct {
+	name    string
+	client  *upstreamClient
+	targets []*healthTarget
+}
+
+// activeHealth probes every route's upstreams on an interval.
+type activeHealth struct {
+	interval  time.Duration
+	timeout   time.Duration
+	path      string
+	unhealthy int
+	healthy   int
+	routes    []*healthRoute
+
+	mu sync.Mutex
+}
+
+func newActiveHealth(hc HealthCheckConfig) *activeHealth {
+	a := &activeHealth{
+		interval:  defaultHealthCheckInterval,
+		timeout:   defaultHealthCheckTimeout,
+		path:      hc.Path,
+		unhealthy: max(hc.UnhealthyThreshold, 1),
+		healthy:   max(hc.HealthyThreshold, 1),
+	}
+	if hc.UnhealthyThreshold == 0 {
+		a.unhealthy = 2
+	}
+	// validated at startup
+	if d, err := time.ParseDuration(hc.Interval); err == nil {
+		a.interval = d
+	}
+	if d, err := time.ParseDuration(hc.Timeout); err == nil {
+		a.timeout = d
+	}
+	if a.path == "" {
+		a.path = "/v1/models"
+	}
+	return a
+}
+
+// addRoute registers the upstream a route sends to. Upstreams with replicas
+// are probed per replica, and the result also takes replicas in and out of
+// the balancer's rotation. Targets start healthy, so a relay does not
+// report itself down before the first round.
+func (a *activeHealth) addRoute(name string, c *upstreamClient) {
+	route := &healthRoute{name: name, client: c}
+	if c.lb != nil {
+		for _, r := range c.lb.replicas {
+			route.targets = append(route.targets, &healthTarget{url: r.url, replica: r, healthy: true})
+		}
+	} else {
+		route.targets = append(route.targets, &healthTarget{url: c.url, healthy: true})
+	}
+	a.routes = append(a.routes, route)
+}
+
+func (a *activeHealth) run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		a.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes every target once, in parallel.
+func (a *activeHealth) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, route := range a.routes {
+		for _, t := range route.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.record(route, t, a.probe(ctx, route.client, t))
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// probe requests the health path from one target with the upstream's key
+// and Host. Transport errors and 5xx fail; any other status, even 401,
+// means the upstream is serving.
+func (a *activeHealth) probe(ctx context.Context, c *upstreamClient, t *healthTarget) upstreamHealth {
+	res := upstreamHealth{URL: t.url.Redacted()}
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	target := c.target(&url.URL{Path: a.path})
+	target.Scheme, target.Host = t.url.Scheme, t.url.Host
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Host = c.opts.Host
+	if key := c.apiKey(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	res.LatencyMs = time.Since(start).Milliseconds()
+	res.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	res.Reachable = true
+	res.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 500 {
+		res.Error = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return res
+}
+
+// record applies a probe result to the target's thresholds.
+func (a *activeHealth) record(route *healthRoute, t *healthTarget, res upstreamHealth) {
+	ok := res.Error == ""
+	a.mu.Lock()
+	res.Name = route.name
+	t.last = res
+	wasHealthy := t.healthy
+	if ok {
+		t.fails, t.successes = 0, t.successes+1
+		if !t.healthy && t.successes >= a.healthy {
+			t.healthy = true
+		}
+	} else {
+		t.fails, t.successes = t.fails+1, 0
+		if t.healthy && t.fails >= a.unhealthy {
+			t.healthy = false
+		}
+	}
+	healthy := t.healthy
+	a.mu.Unlock()
+
+	if t.replica != nil {
+		if healthy {
+			route.client.lb.markUp(t.replica)
+		} else {
+			route.client.lb.markDown(t.replica, fmt.Errorf("health check: %s", res.Error), time.Now())
+		}
+	}
+	if healthy != wasHealthy {
+		state, level := "up", slog.LevelInfo
+		if !healthy {
+			state, level = "down", slog.LevelWarn
+		}
+		logf(level, "HEALTH: %s upstream %s is %s: %s", route.name, t.url.Redacted(), state, res.Error)
+		upstreamHealthTransitionsTotal.Inc(route.name, t.url.Host, state)
+	}
+}
+
+// status returns the latest probe of every target and the health of each
+// route.
+func (a *activeHealth) status() ([]upstreamHealth, []routeHealth) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ups []upstreamHealth
+	var routes []routeHealth
+	for _, route := range a.routes {
+		rh := routeHealth{Name: route.name, Upstreams: len(route.targets)}
+		for _, t := range route.targets {
+			last := t.last
+			if last.URL == "" {
+				// not probed yet
+				last = upstreamHealth{Name: route.name, URL: t.url.Redacted()}
+			}
+			last.Healthy = t.healthy
+			ups = append(ups, last)
+			if t.healthy {
+				rh.HealthyUpstreams++
+			}
+		}
+		rh.Healthy = rh.HealthyUpstreams > 0
+		routes = append(routes, rh)
+	}
+	return ups, routes
+}
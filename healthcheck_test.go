@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActiveHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer sk-up" {
+			t.Errorf("probe %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream:        upstream.URL,
+		UpstreamOptions: &UpstreamOptions{APIKey: "sk-up"},
+		// probes are driven by the test
+		HealthCheck: &HealthCheckConfig{Interval: "1h", UnhealthyThreshold: 2},
+	}
+	h := newHealthChecker()
+	h.active = newActiveHealth(*cfg.HealthCheck)
+	h.active.addRoute("default", upstreamFor(cfg, parseURL(upstream.URL)))
+
+	healthz := func() (int, healthzReport) {
+		w := httptest.NewRecorder()
+		h.serveHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		var rep healthzReport
+		_ = json.Unmarshal(w.Body.Bytes(), &rep)
+		return w.Code, rep
+	}
+
+	h.active.checkAll(context.Background())
+	if code, rep := healthz(); code != http.StatusOK || rep.Status != "ok" || len(rep.Routes) != 1 || !rep.Routes[0].Healthy {
+		t.Fatalf("healthy upstream: %d %+v", code, rep)
+	}
+
+	failing.Store(true)
+	h.active.checkAll(context.Background())
+	if h.routeDown() != "" {
+		t.Fatal("one failed probe marked the upstream down before the threshold")
+	}
+	h.active.checkAll(context.Background())
+	if h.routeDown() != "default" {
+		t.Fatal("upstream not down after two failed probes")
+	}
+	if code, rep := healthz(); code != http.StatusServiceUnavailable || rep.Status != "down" || rep.Routes[0].HealthyUpstreams != 0 {
+		t.Errorf("down upstream: %d %+v", code, rep)
+	}
+	if ups, _ := h.active.status(); ups[0].StatusCode != http.StatusInternalServerError || ups[0].Healthy {
+		t.Errorf("details: %+v", ups)
+	}
+
+	failing.Store(false)
+	h.active.checkAll(context.Background())
+	if h.routeDown() != "" {
+		t.Error("upstream still down after a successful probe")
+	}
+}
+
+func TestActiveHealthCheckReplicas(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	cfg := &Config{
+		Upstream:        "http://vllm.invalid",
+		UpstreamOptions: &UpstreamOptions{Replicas: []Replica{{URL: dead.URL}, {URL: live.URL}}},
+		HealthCheck:     &HealthCheckConfig{Interval: "50ms", UnhealthyThreshold: 1},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the dead replica leaves rotation before any request reaches it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if strings.Contains(w.Body.String(), `"healthy_upstreams":1`) {
+			if w.Code != http.StatusOK {
+				t.Errorf("a route with one live replica: %d", w.Code)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dead replica never marked down: %s", w.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/health with one live replica: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "strings"
+
+// relaxJSON turns comment-free JSONC into strict JSON for encoding/json: it
+// drops trailing commas before } and ] and quotes bare object keys such as
+// {listen: ":8080"}. offsets maps each byte of s to the original file, as
+// returned by stripJSONCOffsets, and is carried over to the result.
+func relaxJSON(s string, offsets []int) (string, []int) {
+	var out strings.Builder
+	out.Grow(len(s))
+	outOffsets := make([]int, 0, len(offsets))
+	write := func(b byte, i int) {
+		out.WriteByte(b)
+		outOffsets = append(outOffsets, offsets[i])
+	}
+
+	var stack []byte // open '{' and '['
+	inString, escape := false, false
+	expectKey := false // after '{' or ',' inside an object
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			write(c, i)
+			switch {
+			case escape:
+				escape = false
+			case c == '\\':
+				escape = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			write(c, i)
+			continue
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			stack = append(stack, c)
+		case c == '}' || c == ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case c == ',':
+			j := i + 1
+			for j < len(s) && strings.IndexByte(" \t\n\r", s[j]) >= 0 {
+				j++
+			}
+			if j < len(s) && (s[j] == '}' || s[j] == ']') {
+				// trailing comma
+				continue
+			}
+		case expectKey && isKeyStart(c):
+			j := i
+			for j < len(s) && isKeyPart(s[j]) {
+				j++
+			}
+			k := j
+			for k < len(s) && strings.IndexByte(" \t\n\r", s[k]) >= 0 {
+				k++
+			}
+			if k < len(s) && s[k] == ':' {
+				write('"', i)
+				for ; i < j; i++ {
+					write(s[i], i)
+				}
+				write('"', j-1)
+				i--
+				expectKey = false
+				continue
+			}
+		}
+		write(c, i)
+		expectKey = (c == '{' || c == ',') && len(stack) > 0 && stack[len(stack)-1] == '{'
+	}
+	return out.String(), outOffsets
+}
+
+func isKeyStart(c byte) bool {
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isKeyPart(c byte) bool {
+	return isKeyStart(c) || c == '-' || '0' <= c && c <= '9'
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var jsonRepairsTotal = metrics.newCounterVec("relay_json_repairs_total",
+	"JSON-mode responses by outcome (valid, repaired, retried, failed).", "tenant", "model", "result")
+
+// wantsJSONOutput reports whether the client asked for JSON through
+// response_format and the rule opts in to repairing it.
+func wantsJSONOutput(rule *ModelRule, payload map[string]any) bool {
+	return rule != nil && rule.RepairJSON && requestsJSON(payload)
+}
+
+// requestsJSON reports whether response_format asks for JSON output.
+func requestsJSON(payload map[string]any) bool {
+	format, _ := payload["response_format"].(map[string]any)
+	switch getString(format, "type") {
+	case "json_object", "json_schema":
+		return true
+	}
+	return false
+}
+
+// readJSONOutput reads a non-stream completion and makes the content of every
+// choice parseable JSON. decode, when set, converts the upstream body to the
+// client's format first. If repair is not enough the request is re-issued up
+// to the rule's json_retries times; when all attempts fail the last body is
+// returned as is.
+func readJSONOutput(ctx context.Context, resp *http.Response, decode func([]byte) ([]byte, error), resend func() (*http.Response, error), rule *ModelRule, tenant, model string) ([]byte, error) {
+	retries, label := rule.JSONRetries, metricModel(rule)
+	for attempt := 0; ; attempt++ {
+		raw, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if decode != nil {
+			if raw, err = decode(raw); err != nil {
+				return nil, err
+			}
+		}
+
+		fixed, result := repairJSONChoices(raw)
+		if result != "failed" {
+			if attempt > 0 {
+				result = "retried"
+			}
+			vlogCtx(ctx, "JSONMODE: %s output for model '%s'", result, model)
+			jsonRepairsTotal.Inc(tenant, label, result)
+			return fixed, nil
+		}
+		if attempt >= retries {
+			logCtxf(ctx, slog.LevelWarn, "JSONMODE: model '%s' returned invalid JSON after %d attempt(s), passing it through", model, attempt+1)
+			jsonRepairsTotal.Inc(tenant, label, "failed")
+			return raw, nil
+		}
+
+		vlogCtx(ctx, "JSONMODE: invalid JSON from model '%s', retrying (%d/%d)", model, attempt+1, retries)
+		next, err := resend()
+		if err != nil || next.StatusCode != http.StatusOK {
+			if err == nil {
+				_ = next.Body.Close()
+			}
+			jsonRepairsTotal.Inc(tenant, label, "failed")
+			return raw, nil
+		}
+		resp = next
+	}
+}
+
+// repairJSONChoices repairs message.content (chat) or text (completions) of
+// each choice. result is "valid" when nothing had to change, "repaired" when
+// some content was fixed, and "failed" when some content could not be fixed.
+func repairJSONChoices(body []byte) (out []byte, result string) {
+	var resp map[string]any
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return body, "failed"
+	}
+	choices, _ := resp["choices"].([]any)
+	result = "valid"
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		holder, field := choice, "text"
+		if msg, ok := choice["message"].(map[string]any); ok {
+			holder, field = msg, "content"
+		}
+		content, ok := holder[field].(string)
+		if !ok || isJSONDocument(content) {
+			// tool calls and refusals carry no content to repair
+			continue
+		}
+		fixed, ok := repairJSON(content)
+		if !ok {
+			return body, "failed"
+		}
+		holder[field] = fixed
+		result = "repaired"
+	}
+	if result == "valid" {
+		return body, result
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return body, "failed"
+	}
+	return out, result
+}
+
+// isJSONDocument reports whether s is a JSON object or array.
+func isJSONDocument(s string) bool {
+	s = strings.TrimSpace(s)
+	return (strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")) && json.Valid([]byte(s))
+}
+
+// repairJSON pulls a JSON object or array out of model output: it drops
+// markdown code fences and surrounding prose, removes trailing commas and
+// closes strings and brackets left open by a truncated reply.
+func repairJSON(s string) (string, bool) {
+	s = stripCodeFence(s)
+	if isJSONDocument(s) {
+		return strings.TrimSpace(s), true
+	}
+	start := strings.IndexAny(s, "{[")
+	if start < 0 {
+		return "", false
+	}
+	candidate := extractJSON(s[start:])
+	if !isJSONDocument(candidate) {
+		return "", false
+	}
+	return candidate, true
+}
+
+// stripCodeFence returns the body of the first ``` fence in s, or s itself.
+func stripCodeFence(s string) string {
+	start := strings.Index(s, "```")
+	if start < 0 {
+		return s
+	}
+	body := s[start+3:]
+	// skip the language tag, e.g. ```json
+	if nl := strings.IndexByte(body, '\n'); nl >= 0 {
+		body = body[nl+1:]
+	} else {
+		return s
+	}
+	if end := strings.Index(body, "```"); end >= 0 {
+		body = body[:end]
+	}
+	return body
+}
+
+// extractJSON scans s, which starts with '{' or '[', up to the end of the
+// first complete value, dropping trailing commas on the way. If s ends before
+// the value is closed the missing quote and brackets are appended.
+func extractJSON(s string) string {
+	var out []byte
+	var closers []byte
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			out = append(out, c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			closers = append(closers, '}')
+		case '[':
+			closers = append(closers, ']')
+		case '}', ']':
+			if len(closers) == 0 || closers[len(closers)-1] != c {
+				// mismatched bracket; let validation reject it
+				return string(append(out, c))
+			}
+			closers = closers[:len(closers)-1]
+			out = append(trimTrailingComma(out), c)
+			if len(closers) == 0 {
+				return string(out)
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+
+	if inString {
+		if escaped {
+			out = out[:len(out)-1]
+		}
+		out = append(out, '"')
+	}
+	out = trimTrailingComma(out)
+	for i := len(closers) - 1; i >= 0; i-- {
+		out = append(out, closers[i])
+	}
+	return string(out)
+}
+
+func trimTrailingComma(b []byte) []byte {
+	trimmed := bytes.TrimRight(b, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[len(trimmed)-1] == ',' {
+		return trimmed[:len(trimmed)-1]
+	}
+	return b
+}
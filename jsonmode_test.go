@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"already valid", ` {"a":1} `, `{"a":1}`, true},
+		{"json fence", "```json\n{\"a\": 1}\n```", `{"a": 1}`, true},
+		{"fence with prose", "Here you go:\n```\n[1, 2]\n```\nLet me know!", `[1, 2]`, true},
+		{"trailing prose", `{"a": "b"} I hope this helps.`, `{"a": "b"}`, true},
+		{"leading prose", `Sure! {"a": {"b": [1]}}`, `{"a": {"b": [1]}}`, true},
+		{"braces in strings", `{"a": "}{"} done`, `{"a": "}{"}`, true},
+		{"trailing commas", `{"a": [1, 2,], "b": 3,}`, `{"a": [1, 2], "b": 3}`, true},
+		{"truncated", `{"a": [1, 2], "b": "unfinish`, `{"a": [1, 2], "b": "unfinish"}`, true},
+		{"no json", "I cannot help with that.", "", false},
+		{"broken", `{"a": }`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := repairJSON(tt.input)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("%s: repairJSON(%q) = %q, %v; want %q, %v", tt.name, tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestJSONModeProxy(t *testing.T) {
+	replies := []string{"Sure, here it is: no json yet", "```json\n{\"answer\": 42,}\n```"}
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		content := replies[min(n, len(replies)-1)]
+		writeJSON(w, http.StatusOK, map[string]any{
+			"object":  "chat.completion",
+			"choices": []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": content}}},
+		})
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		rule        ModelRule
+		body        string
+		wantContent string
+		wantCalls   int32
+	}{
+		{"repair after retry", ModelRule{MatchModel: "m", RepairJSON: true, JSONRetries: 1}, `{"model":"m","response_format":{"type":"json_object"}}`, `{"answer": 42}`, 2},
+		{"retries exhausted", ModelRule{MatchModel: "m", RepairJSON: true}, `{"model":"m","response_format":{"type":"json_object"}}`, "Sure, here it is: no json yet", 1},
+		{"not json mode", ModelRule{MatchModel: "m", RepairJSON: true, JSONRetries: 1}, `{"model":"m"}`, "Sure, here it is: no json yet", 1},
+		{"rule disabled", ModelRule{MatchModel: "m"}, `{"model":"m","response_format":{"type":"json_object"}}`, "Sure, here it is: no json yet", 1},
+	}
+	for _, tt := range tests {
+		calls.Store(0)
+		cfg := &Config{ModelRules: []ModelRule{tt.rule}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		var resp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+			t.Fatalf("%s: bad response %q: %v", tt.name, w.Body.String(), err)
+		}
+		if got := resp.Choices[0].Message.Content; got != tt.wantContent {
+			t.Errorf("%s: content = %q, want %q", tt.name, got, tt.wantContent)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("%s: upstream calls = %d, want %d", tt.name, got, tt.wantCalls)
+		}
+	}
+}
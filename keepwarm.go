@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// keepWarmTick is how often the keeper looks for models that are due a ping.
+const keepWarmTick = 5 * time.Second
+
+var keepWarmPingsTotal = metrics.newCounterVec("relay_keep_warm_pings_total",
+	"Pings sent to keep idle models loaded, by result.", "tenant", "model", "result")
+
+func validateKeepWarm(rule *ModelRule) error {
+	if rule.KeepWarm == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(rule.KeepWarm); err != nil || d <= 0 {
+		return fmt.Errorf("invalid keep_warm %q", rule.KeepWarm)
+	}
+	if rule.MatchModel == "" || rule.MatchModel == "default" || isGlob(rule.MatchModel) {
+		return fmt.Errorf("keep_warm needs a match_model naming one model")
+	}
+	return nil
+}
+
+// keepWarm pings the models of rules with keep_warm that have been idle for
+// their interval, so backends that unload idle models (Ollama, llama.cpp
+// router) keep them in memory. Client requests count as activity.
+type keepWarm struct {
+	cfg    *Config
+	up     *url.URL
+	tenant string
+
+	mu   sync.Mutex
+	last map[string]time.Time // model -> last request or ping
+}
+
+func newKeepWarm(cfg *Config, up *url.URL, tenant string) *keepWarm {
+	return &keepWarm{cfg: cfg, up: up, tenant: tenant, last: map[string]time.Time{}}
+}
+
+// touch records client traffic for the rule's model.
+func (k *keepWarm) touch(rule *ModelRule, now time.Time) {
+	if k == nil || rule == nil || rule.KeepWarm == "" {
+		return
+	}
+	k.mu.Lock()
+	k.last[rule.MatchModel] = now
+	k.mu.Unlock()
+}
+
+func (k *keepWarm) run(ctx context.Context) {
+	t := time.NewTicker(keepWarmTick)
+	defer t.Stop()
+	for {
+		k.pingDue(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// pingDue pings, one after another, every model idle for its interval.
+// Rules are read on each round, so reloads take effect.
+func (k *keepWarm) pingDue(ctx context.Context, now time.Time) {
+	rules := k.cfg.rules()
+	for i := range rules {
+		rule := &rules[i]
+		if rule.KeepWarm == "" {
+			continue
+		}
+		interval, _ := time.ParseDuration(rule.KeepWarm) // validated at load
+		k.mu.Lock()
+		due := now.Sub(k.last[rule.MatchModel]) >= interval
+		if due {
+			k.last[rule.MatchModel] = now
+		}
+		k.mu.Unlock()
+		if !due {
+			continue
+		}
+		if err := k.ping(ctx, rule, interval); err != nil {
+			logf(slog.LevelWarn, "KEEPWARM: ping for model '%s' (tenant %s) failed: %v", rule.MatchModel, k.tenant, err)
+			keepWarmPingsTotal.Inc(k.tenant, metricModel(rule), "error")
+			continue
+		}
+		vlog("KEEPWARM: pinged model '%s' (tenant %s)", rule.MatchModel, k.tenant)
+		keepWarmPingsTotal.Inc(k.tenant, metricModel(rule), "ok")
+	}
+}
+
+// ping sends the smallest request that keeps the model loaded: a one-token
+// completion, or for Ollama a load request without messages that also
+// extends keep_alive. Rule options such as num_ctx are kept, since Ollama
+// reloads a model asked for with different ones.
+func (k *keepWarm) ping(ctx context.Context, rule *ModelRule, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, max(interval, time.Minute))
+	defer cancel()
+
+	payload := map[string]any{
+		"model":      rule.MatchModel,
+		"messages":   []any{map[string]any{"role": "user", "content": "ping"}},
+		"max_tokens": 1,
+	}
+	applyRules(k.cfg, payload)
+	payload["max_tokens"], payload["stream"] = 1, false
+	path := "/v1/chat/completions"
+	if k.cfg.UpstreamType == upstreamOllama {
+		req, err := chatToOllamaRequest(payload)
+		if err != nil {
+			return err
+		}
+		req["messages"] = []any{}
+		req["keep_alive"] = ollamaKeepAlive(rule)
+		payload = req
+		path = ollamaPath(path, "/chat/completions", "/api/chat")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := upstreamFor(k.cfg, k.up)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.target(&url.URL{Path: path}).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = client.host()
+	req.Header.Set("Content-Type", "application/json")
+	client.normalizeClientHeaders(req)
+	client.authorize(req, rule, false)
+	resp, err := client.doJSON(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ollamaKeepAlive is the keep_alive asked of Ollama for a keep_warm rule:
+// long enough that the model outlives the gap to the next ping.
+func ollamaKeepAlive(rule *ModelRule) string {
+	interval, _ := time.ParseDuration(rule.KeepWarm)
+	return (2*interval + keepWarmTick).String()
+}
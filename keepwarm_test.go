@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeepWarm(t *testing.T) {
+	var paths []string
+	var last map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		last = nil
+		_ = json.NewDecoder(r.Body).Decode(&last)
+		writeJSON(w, http.StatusOK, map[string]any{})
+	}))
+	defer upstream.Close()
+
+	rule := ModelRule{MatchModel: "llama", KeepWarm: "1m", Set: map[string]any{"options": map[string]any{"num_ctx": 8192}}}
+	cfg := &Config{ModelRules: []ModelRule{rule, {MatchModel: "other"}}}
+	k := newKeepWarm(cfg, parseURL(upstream.URL), defaultTenant)
+	ctx := context.Background()
+	start := time.Now()
+
+	k.pingDue(ctx, start)
+	if len(paths) != 1 || paths[0] != "/v1/chat/completions" || last["model"] != "llama" || last["max_tokens"] != float64(1) {
+		t.Fatalf("startup ping: %v %v", paths, last)
+	}
+	k.pingDue(ctx, start.Add(30*time.Second))
+	k.touch(&rule, start.Add(50*time.Second))
+	k.pingDue(ctx, start.Add(70*time.Second))
+	if len(paths) != 1 {
+		t.Errorf("pinged %d times, want no pings while the model is in use", len(paths))
+	}
+	k.pingDue(ctx, start.Add(110*time.Second))
+	if len(paths) != 2 {
+		t.Errorf("pinged %d times, want a ping after a minute idle", len(paths))
+	}
+
+	// Ollama is asked to load the model without generating anything
+	cfg.UpstreamType = upstreamOllama
+	k.pingDue(ctx, start.Add(170*time.Second))
+	if len(paths) != 3 || paths[2] != "/api/chat" {
+		t.Fatalf("ollama ping: %v", paths)
+	}
+	msgs, _ := last["messages"].([]any)
+	opts, _ := last["options"].(map[string]any)
+	if msgs == nil || len(msgs) != 0 || last["keep_alive"] != "2m5s" || opts["num_ctx"] != float64(8192) {
+		t.Errorf("ollama ping body: %v", last)
+	}
+}
+
+func TestValidateKeepWarm(t *testing.T) {
+	for _, r := range []ModelRule{
+		{MatchModel: "llama", KeepWarm: "soon"},
+		{MatchModel: "llama", KeepWarm: "-1m"},
+		{MatchModel: "llama-*", KeepWarm: "1m"},
+		{MatchModel: "default", KeepWarm: "1m"},
+	} {
+		if err := validateKeepWarm(&r); err == nil {
+			t.Errorf("validateKeepWarm(%+v) succeeded, want error", r)
+		}
+	}
+}
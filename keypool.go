@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// badKeyCooldown is how long a key the upstream rejected is skipped before
+// it is tried again, e.g. after the provider account was topped up.
+const badKeyCooldown = 10 * time.Minute
+
+var upstreamKeyRejectionsTotal = metrics.newCounterVec("relay_upstream_key_rejections_total",
+	"Keys from upstream_options.api_keys the upstream rejected with 401 or 403.", "upstream", "key")
+
+func validateKeyPool(o *UpstreamOptions) error {
+	if len(o.APIKeys) > 0 && (o.APIKey != "" || o.APIKeyFile != "") {
+		return errors.New("upstream_options: api_keys and api_key/api_key_file are mutually exclusive")
+	}
+	for i, k := range o.APIKeys {
+		if k == "" {
+			return fmt.Errorf("upstream_options: api_keys[%d] is empty", i)
+		}
+	}
+	if o.KeyAlertWebhook != "" {
+		if u, err := url.Parse(o.KeyAlertWebhook); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid upstream_options.key_alert_webhook %q", o.KeyAlertWebhook)
+		}
+	}
+	return nil
+}
+
+// keyPool hands out an upstream's api_keys in order, skipping keys the
+// upstream has rejected.
+type keyPool struct {
+	keys    []string
+	webhook string
+
+	mu  sync.Mutex
+	bad map[string]time.Time // key -> when it was rejected
+}
+
+func newKeyPool(o UpstreamOptions) *keyPool {
+	if len(o.APIKeys) == 0 {
+		return nil
+	}
+	return &keyPool{keys: o.APIKeys, webhook: o.KeyAlertWebhook, bad: map[string]time.Time{}}
+}
+
+// pick returns the first key that is not marked bad. When every key is,
+// the one rejected longest ago is tried.
+func (p *keyPool) pick(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	oldest := ""
+	for _, k := range p.keys {
+		at, bad := p.bad[k]
+		if !bad || now.Sub(at) >= badKeyCooldown {
+			return k
+		}
+		if oldest == "" || at.Before(p.bad[oldest]) {
+			oldest = k
+		}
+	}
+	return oldest
+}
+
+// reject marks key bad, reporting whether it is a pool key that was not
+// already marked, along with how many keys are still usable.
+func (p *keyPool) reject(key string, now time.Time) (marked bool, usable int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k == key {
+			at, bad := p.bad[k]
+			marked = !bad || now.Sub(at) >= badKeyCooldown
+			p.bad[k] = now
+		}
+	}
+	for _, k := range p.keys {
+		if at, bad := p.bad[k]; !bad || now.Sub(at) >= badKeyCooldown {
+			usable++
+		}
+	}
+	return marked, usable
+}
+
+func (p *keyPool) contains(key string) bool {
+	for _, k := range p.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAlert is the key_alert_webhook body.
+type keyAlert struct {
+	Upstream string `json:"upstream"`
+	Key      string `json:"key"` // fingerprint of the rejected key
+	Status   int    `json:"status"`
+	Usable   int    `json:"usable_keys"`
+	Time     string `json:"time"`
+}
+
+// observeAuth marks the pool key a request was sent with bad when the
+// upstream answers 401 or 403, and alerts the operator.
+func (c *upstreamClient) observeAuth(req *http.Request, status int) {
+	if c.keys == nil || (status != http.StatusUnauthorized && status != http.StatusForbidden) {
+		return
+	}
+	key := bearerToken(req)
+	now := time.Now()
+	marked, usable := c.keys.reject(key, now)
+	if !marked {
+		return
+	}
+	a := keyAlert{Upstream: c.url.Host, Key: keyFingerprint(key), Status: status, Usable: usable, Time: now.UTC().Format(time.RFC3339)}
+	upstreamKeyRejectionsTotal.Inc(a.Upstream, a.Key)
+	logCtxf(req.Context(), slog.LevelWarn, "UPSTREAM: %s rejected api key %s with status %d, %d of %d keys left", a.Upstream, a.Key, status, usable, len(c.keys.keys))
+	if c.keys.webhook != "" {
+		go notifyKeyAlert(c.keys.webhook, a)
+	}
+}
+
+// retryWithNextKey re-sends a request whose pool key was just rejected
+// with the next key, once. When the pool has no other key the client gets a
+// 502 rather than the provider's auth error, which is not about its own key.
+func (c *upstreamClient) retryWithNextKey(req *http.Request, resp *http.Response, send func() (*http.Response, error)) (*http.Response, error) {
+	if c.keys == nil || !rejectedAuth(resp) || !c.keys.contains(bearerToken(req)) {
+		return resp, nil
+	}
+	if next := c.keys.pick(time.Now()); next != bearerToken(req) {
+		resp.Body.Close()
+		vlogCtx(req.Context(), "UPSTREAM: retrying %s with the next api key", req.URL.Path)
+		req.Header.Set("Authorization", "Bearer "+next)
+		var err error
+		if resp, err = send(); err != nil || !rejectedAuth(resp) {
+			return resp, err
+		}
+	}
+	resp.Body.Close()
+	body, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"message": "the upstream rejected the relay's api keys",
+		"type":    "api_error",
+		"code":    "upstream_auth_failed",
+	}})
+	return &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func rejectedAuth(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+func notifyKeyAlert(webhook string, a keyAlert) {
+	body, _ := json.Marshal(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		logf(slog.LevelError, "UPSTREAM: key alert webhook failed: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logf(slog.LevelError, "UPSTREAM: key alert webhook failed: %v", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logf(slog.LevelError, "UPSTREAM: key alert webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolFailover(t *testing.T) {
+	var keys []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerToken(r)
+		keys = append(keys, key)
+		if key != "sk-good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"message":"Incorrect API key provided","code":"invalid_api_key"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"ok"}}]}`)
+	}))
+	defer upstream.Close()
+	alerts := make(chan keyAlert, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a keyAlert
+		_ = json.NewDecoder(r.Body).Decode(&a)
+		alerts <- a
+	}))
+	defer webhook.Close()
+
+	send := func(cfg *Config) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		return w
+	}
+
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{APIKeys: []string{"sk-revoked", "sk-good"}, KeyAlertWebhook: webhook.URL}}
+	if w := send(cfg); w.Code != http.StatusOK || fmt.Sprint(keys) != "[sk-revoked sk-good]" {
+		t.Fatalf("first request: %d %s, keys tried %v", w.Code, w.Body, keys)
+	}
+	select {
+	case a := <-alerts:
+		if a.Key != keyFingerprint("sk-revoked") || a.Status != http.StatusUnauthorized || a.Usable != 1 {
+			t.Errorf("alert %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert for the rejected key")
+	}
+	keys = nil
+	if w := send(cfg); w.Code != http.StatusOK || fmt.Sprint(keys) != "[sk-good]" {
+		t.Errorf("second request: %d, keys tried %v; want the rejected key skipped", w.Code, keys)
+	}
+
+	// without a usable key the client does not see the provider's 401
+	cfg = &Config{UpstreamOptions: &UpstreamOptions{APIKeys: []string{"sk-a", "sk-b"}}}
+	w := send(cfg)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "upstream_auth_failed") {
+		t.Errorf("all keys rejected: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestKeyPoolPick(t *testing.T) {
+	p := newKeyPool(UpstreamOptions{APIKeys: []string{"a", "b"}})
+	now := time.Now()
+	if marked, usable := p.reject("a", now); !marked || usable != 1 || p.pick(now) != "b" {
+		t.Fatalf("after rejecting a: marked %v usable %d pick %q", marked, usable, p.pick(now))
+	}
+	if marked, _ := p.reject("a", now); marked {
+		t.Error("a key already marked bad was reported again")
+	}
+	p.reject("b", now.Add(time.Second))
+	if k := p.pick(now.Add(2 * time.Second)); k != "a" {
+		t.Errorf("all keys bad: pick %q, want the one rejected longest ago", k)
+	}
+	if k := p.pick(now.Add(badKeyCooldown)); k != "a" {
+		t.Errorf("after the cooldown: pick %q, want a again", k)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadShedConfig rejects low-priority completion traffic first when the
+// relay is under pressure, instead of slowing every client down equally.
+// Pressure is the larger of in-flight requests over max_in_flight and the
+// moving average time to first byte over max_latency; 1 means saturated.
+type LoadShedConfig struct {
+	MaxInFlight  int     `json:"max_in_flight"`  // completion requests in flight at full pressure
+	MaxLatency   string  `json:"max_latency"`    // average time to first byte at full pressure, e.g. "5s"
+	ShedLowAt    float64 `json:"shed_low_at"`    // pressure from which low priority is rejected, default 0.8
+	ShedNormalAt float64 `json:"shed_normal_at"` // pressure from which normal priority is rejected, default 1
+	RetryAfter   int     `json:"retry_after"`    // seconds, default 5
+}
+
+const (
+	defaultShedLowAt      = 0.8
+	defaultShedNormalAt   = 1.0
+	defaultShedRetryAfter = 5
+
+	// pressureHeader tells clients how loaded the relay is, 0 to 1 and above.
+	pressureHeader = "X-Relay-Pressure"
+	// priorityHeader lets a client mark its own request as less important;
+	// it cannot raise the priority its tenant has.
+	priorityHeader = "X-Relay-Priority"
+
+	// latencyStale drops a latency average no request has updated lately,
+	// so an idle relay does not keep shedding on old samples.
+	latencyStale = 30 * time.Second
+)
+
+// Request priorities; high is never shed.
+var priorities = map[string]int{"low": 0, "normal": 1, "high": 2}
+
+func validateLoadShed(c *LoadShedConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxInFlight <= 0 && c.MaxLatency == "" {
+		return fmt.Errorf("load_shedding needs max_in_flight or max_latency")
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("invalid load_shedding.max_in_flight %d", c.MaxInFlight)
+	}
+	if c.MaxLatency != "" {
+		if d, err := time.ParseDuration(c.MaxLatency); err != nil || d <= 0 {
+			return fmt.Errorf("invalid load_shedding.max_latency %q", c.MaxLatency)
+		}
+	}
+	if c.ShedLowAt < 0 || c.ShedNormalAt < 0 || c.RetryAfter < 0 {
+		return fmt.Errorf("load_shedding thresholds and retry_after must not be negative")
+	}
+	low, normal := c.ShedLowAt, c.ShedNormalAt
+	if low == 0 {
+		low = defaultShedLowAt
+	}
+	if normal == 0 {
+		normal = defaultShedNormalAt
+	}
+	if low > normal {
+		return fmt.Errorf("load_shedding.shed_low_at %g is above shed_normal_at %g", low, normal)
+	}
+	return nil
+}
+
+func validatePriority(p string) error {
+	if _, ok := priorities[p]; p != "" && !ok {
+		return fmt.Errorf("invalid priority %q, want low, normal or high", p)
+	}
+	return nil
+}
+
+var loadShedTotal = metrics.newCounterVec("relay_load_shed_total",
+	"Completion requests rejected by load shedding, by priority.", "priority")
+
+// loadShedder measures pressure and turns requests away by priority.
+type loadShedder struct {
+	maxInFlight int64
+	maxLatency  time.Duration
+	thresholds  [2]float64 // by priority: low, normal
+	retryAfter  int
+
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	latency   float64 // moving average time to first byte, in seconds
+	sampledAt time.Time
+	now       func() time.Time
+}
+
+func newLoadShedder(c LoadShedConfig) *loadShedder {
+	s := &loadShedder{
+		maxInFlight: int64(c.MaxInFlight),
+		thresholds:  [2]float64{c.ShedLowAt, c.ShedNormalAt},
+		retryAfter:  c.RetryAfter,
+		now:         time.Now,
+	}
+	s.maxLatency, _ = time.ParseDuration(c.MaxLatency) // validated at load
+	if s.thresholds[0] == 0 {
+		s.thresholds[0] = defaultShedLowAt
+	}
+	if s.thresholds[1] == 0 {
+		s.thresholds[1] = defaultShedNormalAt
+	}
+	if s.retryAfter == 0 {
+		s.retryAfter = defaultShedRetryAfter
+	}
+	return s
+}
+
+// pressure is the load relative to the configured limits.
+func (s *loadShedder) pressure() float64 {
+	var p float64
+	if s.maxInFlight > 0 {
+		p = float64(s.inFlight.Load()) / float64(s.maxInFlight)
+	}
+	if s.maxLatency > 0 {
+		s.mu.Lock()
+		if s.now().Sub(s.sampledAt) < latencyStale {
+			p = max(p, s.latency/s.maxLatency.Seconds())
+		}
+		s.mu.Unlock()
+	}
+	return p
+}
+
+// observe feeds one time to first byte into the moving average.
+func (s *loadShedder) observe(d time.Duration) {
+	const weight = 0.2
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.sampledAt) >= latencyStale {
+		s.latency = d.Seconds()
+	} else {
+		s.latency += weight * (d.Seconds() - s.latency)
+	}
+	s.sampledAt = now
+}
+
+// requestPriority is the tenant's priority, lowered by the client's
+// X-Relay-Priority header if that asks for less.
+func requestPriority(r *http.Request) string {
+	p := "normal"
+	if t := tenantFromContext(r.Context()); t != nil && t.priority != "" {
+		p = t.priority
+	}
+	if h := strings.ToLower(r.Header.Get(priorityHeader)); h != "" {
+		if level, ok := priorities[h]; ok && level < priorities[p] {
+			p = h
+		}
+	}
+	return p
+}
+
+// guard rejects the request with 429 when pressure is at or above the
+// threshold of its priority, and reports the pressure on every response.
+// It runs inside tenant identification, which decides the priority.
+func (s *loadShedder) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pressure := s.pressure()
+		w.Header().Set(pressureHeader, strconv.FormatFloat(pressure, 'f', 2, 64))
+		priority := requestPriority(r)
+		if level := priorities[priority]; level < len(s.thresholds) && pressure >= s.thresholds[level] {
+			loadShedTotal.Inc(priority)
+			vlogCtx(r.Context(), "LOADSHED: rejected %s priority request at pressure %.2f", priority, pressure)
+			w.Header().Set("Retry-After", strconv.Itoa(s.retryAfter))
+			writeJSONError(w, http.StatusTooManyRequests, "the relay is overloaded, please retry later", "rate_limit_error", "load_shed")
+			return
+		}
+
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		sw := &shedWriter{ResponseWriter: w, start: time.Now()}
+		next(sw, r)
+		if sw.status > 0 && sw.status < 500 {
+			s.observe(sw.firstByte)
+		}
+	}
+}
+
+// shedWriter records when the first byte of the response was written.
+type shedWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	firstByte time.Duration
+}
+
+func (s *shedWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+		s.firstByte = time.Since(s.start)
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *shedWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+		s.firstByte = time.Since(s.start)
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *shedWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
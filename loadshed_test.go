@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadShedderPriorities(t *testing.T) {
+	s := newLoadShedder(LoadShedConfig{MaxInFlight: 10, MaxLatency: "2s"})
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	h := s.guard(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	send := func(tenantPriority, header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if tenantPriority != "" {
+			r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, &tenant{name: "t", priority: tenantPriority}))
+		}
+		if header != "" {
+			r.Header.Set(priorityHeader, header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := send("", ""); w.Code != http.StatusOK || w.Header().Get(pressureHeader) != "0.00" {
+		t.Errorf("idle: %d, pressure %q", w.Code, w.Header().Get(pressureHeader))
+	}
+
+	// 8 of 10 in flight sheds low priority only
+	s.inFlight.Add(8)
+	if w := send("", "low"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "5" || !strings.Contains(w.Body.String(), "load_shed") {
+		t.Errorf("low priority at 0.8: %d %s", w.Code, w.Body)
+	}
+	if w := send("", ""); w.Code != http.StatusOK || w.Header().Get(pressureHeader) != "0.80" {
+		t.Errorf("normal priority at 0.8: %d, pressure %q", w.Code, w.Header().Get(pressureHeader))
+	}
+	// the header cannot raise a normal request to high
+	s.inFlight.Add(2)
+	if w := send("", "high"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("normal priority at 1.0: %d", w.Code)
+	}
+	if w := send("high", ""); w.Code != http.StatusOK {
+		t.Errorf("high priority at 1.0: %d", w.Code)
+	}
+	s.inFlight.Add(-10)
+
+	// slow first bytes raise pressure until the samples go stale; the
+	// fast requests above have gone stale first
+	now = now.Add(latencyStale)
+	s.observe(3 * time.Second)
+	if p := s.pressure(); !near(p, 1.5) {
+		t.Errorf("pressure after a 3s first byte = %v, want 1.5", p)
+	}
+	s.observe(time.Second)
+	if p := s.pressure(); !near(p, 1.3) {
+		t.Errorf("pressure after a 1s first byte = %v, want the moving average 1.3", p)
+	}
+	now = now.Add(latencyStale)
+	if p := s.pressure(); p != 0 {
+		t.Errorf("pressure with stale samples = %v, want 0", p)
+	}
+}
+
+func TestLoadShedTenantPriority(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		writeJSON(w, http.StatusOK, map[string]any{"choices": []any{}})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		LoadShed: &LoadShedConfig{MaxInFlight: 1},
+		Tenants: []TenantConfig{
+			{Name: "batch", Keys: []string{"sk-batch"}, Priority: "low"},
+			{Name: "prod", Keys: []string{"sk-prod"}, Priority: "high"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`))
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send("sk-other") }()
+	<-started
+	if w := send("sk-batch"); w.Code != http.StatusTooManyRequests || w.Header().Get(pressureHeader) != "1.00" {
+		t.Errorf("low priority tenant under full pressure: %d, pressure %q", w.Code, w.Header().Get(pressureHeader))
+	}
+	go func() { done <- send("sk-prod") }()
+	<-started
+	close(release)
+	for i := 0; i < 2; i++ {
+		if w := <-done; w.Code != http.StatusOK {
+			t.Errorf("admitted request: %d %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestValidateLoadShed(t *testing.T) {
+	for _, c := range []LoadShedConfig{{}, {MaxInFlight: -1, MaxLatency: "1s"}, {MaxLatency: "soon"}, {MaxInFlight: 5, ShedLowAt: 1.2}} {
+		if err := validateLoadShed(&c); err == nil {
+			t.Errorf("validateLoadShed(%+v) succeeded, want error", c)
+		}
+	}
+	if err := validateTenants(&Config{Tenants: []TenantConfig{{Name: "t", Keys: []string{"k"}, Priority: "urgent"}}}); err == nil {
+		t.Error("validateTenants accepted an unknown priority")
+	}
+}
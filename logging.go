@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogConfig sets up the relay's log. Messages keep their "PREFIX: " so they
+// read the same in both formats; verbose (-v) output is the debug level.
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info (default), warn or error
+	Format string `json:"format"` // text (default) or json
+	Output string `json:"output"` // stderr (default), stdout or a file path, appended to
+}
+
+// logLevel is the minimum level logged; -v and /admin/verbose lower it to
+// debug at runtime.
+var logLevel = new(slog.LevelVar)
+
+// baseLogLevel is the configured level, restored when verbose logging is
+// switched off again.
+var baseLogLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log.level %q (want debug, info, warn or error)", s)
+}
+
+func validateLogConfig(c *LogConfig) error {
+	if c == nil {
+		return nil
+	}
+	if _, err := parseLogLevel(c.Level); err != nil {
+		return err
+	}
+	if c.Format != "" && c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("invalid log.format %q (want text or json)", c.Format)
+	}
+	return nil
+}
+
+// setupLogging installs the slog handler c describes as the default logger,
+// which the standard log package then writes through as well. verbose (-v)
+// overrides the configured level with debug.
+func setupLogging(c *LogConfig, verbose bool) error {
+	if c == nil {
+		c = &LogConfig{}
+	}
+	level, err := parseLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stderr
+	switch c.Output {
+	case "", "stderr":
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("open log.output: %w", err)
+		}
+		out = f
+	}
+	setLogLevel(level)
+	if verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if c.Format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(out, opts)))
+	}
+	return nil
+}
+
+// debugLogging reports whether the debug level is logged, i.e. whether the
+// relay runs verbose.
+func debugLogging() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+// setLogLevel replaces the configured level.
+func setLogLevel(level slog.Level) {
+	baseLogLevel.Set(level)
+	logLevel.Set(level)
+}
+
+// setDebugLogging switches verbose logging on or off at runtime. Off returns
+// to the configured level, or info when that is debug.
+func setDebugLogging(on bool) {
+	switch base := baseLogLevel.Level(); {
+	case on:
+		logLevel.Set(slog.LevelDebug)
+	case base > slog.LevelDebug:
+		logLevel.Set(base)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+// logf logs a "PREFIX: message" at level.
+func logf(level slog.Level, format string, args ...any) {
+	logCtxf(context.Background(), level, format, args...)
+}
+
+// logCtxf is logf for a line about the request ctx belongs to; the line
+// carries the request's ID.
+func logCtxf(ctx context.Context, level slog.Level, format string, args ...any) {
+	if level < logLevel.Level() {
+		return
+	}
+	writeLog(ctx, slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0))
+}
+
+func writeLog(ctx context.Context, r slog.Record) {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	_ = slog.Default().Handler().Handle(ctx, r)
+}
+
+// fatalf logs at the error level and exits.
+func fatalf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// debugf logs a verbose message of scope at the debug level. An enabled
+// verbose scope gets its messages logged below the configured level too.
+func debugf(ctx context.Context, scope, format string, args ...any) {
+	if !verboseEnabled(scope) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelDebug, fmt.Sprintf(format, args...), 0)
+	r.AddAttrs(slog.String("scope", scope))
+	writeLog(ctx, r)
+}
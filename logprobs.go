@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// applyLogprobs carries out a rule's logprobs option. "request" asks the
+// upstream for the logprob of every generated token, "strip" removes the
+// client's logprobs fields for backends that reject or slow down on them.
+// The completions API takes the number of alternatives in logprobs; chat
+// takes a flag and top_logprobs.
+func applyLogprobs(mode string, req map[string]any) {
+	switch mode {
+	case "request":
+		if _, chat := req["messages"]; chat {
+			req["logprobs"] = true
+		} else if _, ok := req["logprobs"].(float64); !ok {
+			req["logprobs"] = 0
+		}
+	case "strip":
+		delete(req, "logprobs")
+		delete(req, "top_logprobs")
+	}
+}
+
+// decodeResponse decodes an upstream response that is rewritten and sent
+// on. Each choice's logprobs stay raw JSON and other numbers stay as
+// written, so token logprobs reach the client exactly as the upstream sent
+// them.
+func decodeResponse(raw []byte, resp *map[string]any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(resp); err != nil {
+		return err
+	}
+	var lp struct {
+		Choices []struct {
+			Logprobs json.RawMessage `json:"logprobs"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(raw, &lp) != nil {
+		return nil
+	}
+	choices, _ := (*resp)["choices"].([]any)
+	for i, c := range choices {
+		if choice, ok := c.(map[string]any); ok && i < len(lp.Choices) && lp.Choices[i].Logprobs != nil {
+			choice["logprobs"] = lp.Choices[i].Logprobs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyLogprobs(t *testing.T) {
+	for _, tt := range []struct {
+		mode, req, want string
+	}{
+		{"request", `{"messages":[]}`, `{"logprobs":true,"messages":[]}`},
+		{"request", `{"messages":[],"logprobs":false,"top_logprobs":3}`, `{"logprobs":true,"messages":[],"top_logprobs":3}`},
+		{"request", `{"prompt":"hi"}`, `{"logprobs":0,"prompt":"hi"}`},
+		{"request", `{"prompt":"hi","logprobs":5}`, `{"logprobs":5,"prompt":"hi"}`},
+		{"strip", `{"messages":[],"logprobs":true,"top_logprobs":3}`, `{"messages":[]}`},
+		{"", `{"messages":[],"logprobs":true}`, `{"logprobs":true,"messages":[]}`},
+	} {
+		var req map[string]any
+		_ = json.Unmarshal([]byte(tt.req), &req)
+		applyLogprobs(tt.mode, req)
+		if got, _ := json.Marshal(req); string(got) != tt.want {
+			t.Errorf("%q %s: got %s, want %s", tt.mode, tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestLogprobsPassthrough(t *testing.T) {
+	call := "<tool_call>get_weather<arg_key>city</arg_key><arg_value>Paris</arg_value></tool_call>"
+	logprobs := `{"content":[{"token":"<tool_call>","logprob":-1.1920929e-07,"bytes":[60],"top_logprobs":[{"token":"<tool_call>","logprob":-1.1920929e-07,"bytes":[60]}]}]}`
+	var upstreamBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		content, _ := json.Marshal(call)
+		if upstreamBody["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%s},\"logprobs\":%s,\"finish_reason\":null}]}\n\n", content, logprobs)
+			fmt.Fprint(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"\"},\"logprobs\":null,\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+			return
+		}
+		fmt.Fprintf(w, `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":%s},"logprobs":%s,"finish_reason":"stop"}]}`, content, logprobs)
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{
+			{MatchModel: "m", EnableToolCallFix: true, ToolsViaPrompt: true, Trailer: " (generated)", Logprobs: "request"},
+			{MatchModel: "plain", Logprobs: "strip"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body string) string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		return w.Body.String()
+	}
+
+	// non-streaming: the tool call and trailer rewrite keeps the logprobs
+	// as the upstream wrote them
+	out := send(`{"model":"m","tools":` + weatherTools + `,"messages":[{"role":"user","content":"Paris?"}]}`)
+	if upstreamBody["logprobs"] != true {
+		t.Errorf("logprobs not requested: %v", upstreamBody)
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				ToolCalls []any `json:"tool_calls"`
+			}
+			Logprobs json.RawMessage
+		}
+	}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || len(resp.Choices) != 1 || len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Fatalf("non-streaming response: %s", out)
+	}
+	if !strings.Contains(string(resp.Choices[0].Logprobs), `"logprob":-1.1920929e-07,"bytes":[60]`) {
+		t.Errorf("logprobs changed: %s", resp.Choices[0].Logprobs)
+	}
+
+	// streaming: the chunk turned into tool_calls still carries them
+	out = send(`{"model":"m","stream":true,"tools":` + weatherTools + `,"messages":[{"role":"user","content":"Paris?"}]}`)
+	if strings.Count(out, `"logprob":-1.1920929e-07`) != 2 || !strings.Contains(out, `"tool_calls"`) {
+		t.Errorf("stream lost the logprobs:\n%s", out)
+	}
+
+	send(`{"model":"plain","logprobs":true,"top_logprobs":5,"messages":[]}`)
+	if _, ok := upstreamBody["logprobs"]; ok || upstreamBody["top_logprobs"] != nil {
+		t.Errorf("logprobs not stripped: %v", upstreamBody)
+	}
+}
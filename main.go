@@ -3,114 +3,650 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"llm-api-relay/toolcallfix"
 )
 
 type Config struct {
-	Listen      string      `json:"listen"`
-	Upstream    string      `json:"upstream"`
-	ForwardAuth bool        `json:"forward_auth"`
-	ModelRules  []ModelRule `json:"model_rules"`
+	Listen       string       `json:"listen"`
+	DrainTimeout string       `json:"drain_timeout"` // how long in-flight requests may finish after SIGTERM or an upgrade (default "10m")
+	PIDFile      string       `json:"pid_file"`      // written with the pid of the serving process, updated by upgrades
+	Upstream     string       `json:"upstream"`
+	UpstreamType string       `json:"upstream_type"` // "openai" (default) or "ollama" for the native Ollama API
+	ForwardAuth  bool         `json:"forward_auth"`
+	ModelRules   []ModelRule  `json:"model_rules"`
+	Prices       []ModelPrice `json:"prices"` // token prices per model, for cost accounting
+
+	Admin       *AdminConfig        `json:"admin"`
+	Transcripts *TranscriptConfig   `json:"transcripts"`
+	BodyLog     *BodyLogConfig      `json:"body_log"`
+	Exporters   []ExportConfig      `json:"exporters"`
+	MetricsPush []MetricsPushConfig `json:"metrics_push"`
+	Tracing     *TracingConfig      `json:"tracing"`
+	Tenants     []TenantConfig      `json:"tenants"`
+	ClientKeys  []ClientKey         `json:"client_keys"`
+
+	UnmatchedModels string `json:"unmatched_models"` // "pass" (default), "reject" or "route" when no rule matches
+	CatchAllModel   string `json:"catch_all_model"`  // model that "route" sends unmatched requests to
+
+	ValidateRequests bool `json:"validate_requests"` // reject malformed chat completion bodies with 400 before forwarding
+	MaxRelayHops     int  `json:"max_relay_hops"`    // refuse requests that already passed this many relays (default 8)
+
+	Log           *LogConfig `json:"log"`            // log level, format (text or json) and output
+	VerboseScopes []string   `json:"verbose_scopes"` // subsystems logged in detail without -v: rules, proxy, toolcallfix, auth, stream
+
+	UpstreamOptions      *UpstreamOptions            `json:"upstream_options"`
+	ClientWrite          *ClientWriteConfig          `json:"client_write"`
+	Preflight            *PreflightConfig            `json:"preflight"`
+	HealthCheck          *HealthCheckConfig          `json:"health_check"`
+	StaleWhileRevalidate *StaleWhileRevalidateConfig `json:"stale_while_revalidate"`
+	Reload               *ReloadConfig               `json:"reload"`
+	SLOAlert             *SLOAlertConfig             `json:"slo_alert"`
+	LoadShed             *LoadShedConfig             `json:"load_shedding"`
+	Audit                *AuditConfig                `json:"audit"`
+	Passthrough          *PassthroughConfig          `json:"passthrough"`
+	EventLog             *EventLogConfig             `json:"event_log"`
+	UsageLedger          *UsageLedgerConfig          `json:"usage_ledger"`
+	Deadline             *DeadlineConfig             `json:"deadline"`
+	RequestSigning       *RequestSigningConfig       `json:"request_signing"`
+	ACME                 *ACMEConfig                 `json:"acme"`
+
+	live        *liveRules            // rules in effect, swapped on reload
+	tenantRules map[string]*liveRules // per-tenant rules in effect, by tenant name
+	audit       *auditLog             // nil without an audit section
+	events      *eventLog             // nil without an event_log section
+	usage       *usageLedger          // nil without a usage_ledger section
+	warm        *keepWarm             // pings keep_warm models; nil when another config owns them
+	workers     *background           // loops started by newRelayMux that flush on shutdown
 }
 
 type ModelRule struct {
-	MatchModel        string         `json:"match_model"`        // exact match; use "default" as fallback
-	Set               map[string]any `json:"set"`                // overwrite/add fields at top-level
-	Extra             map[string]any `json:"extra"`              // merge into request["extra"] (object)
-	Unset             []string       `json:"unset"`              // remove fields at top-level
-	EnableToolCallFix bool           `json:"enable_toolcallfix"` // enable/disable toolcallfix per model
-}
+	MatchModel            string            `json:"match_model"`             // exact name or glob such as "qwen2.5-*"; use "default" as fallback
+	Set                   map[string]any    `json:"set"`                     // overwrite/add fields at top-level
+	Extra                 map[string]any    `json:"extra"`                   // merge into request["extra"] (object)
+	Unset                 []string          `json:"unset"`                   // remove fields at top-level
+	EnableToolCallFix     bool              `json:"enable_toolcallfix"`      // enable/disable toolcallfix per model
+	ToolCallFixFormat     string            `json:"toolcallfix_format"`      // "glm" (default), "hermes" or "deepseek"
+	ToolCallFixTags       *toolcallfix.Tags `json:"toolcallfix_tags"`        // custom tool call tags for glm/hermes style output
+	ToolCallFixSchema     string            `json:"toolcallfix_schema"`      // "coerce" (default) or "strict": calls that do not fit the request tools become content
+	ToolCallFixStreamArgs bool              `json:"toolcallfix_stream_args"` // emit the name first, then arguments deltas as values arrive
+	ToolsViaPrompt        bool              `json:"tools_via_prompt"`        // describe tools in the system prompt for models without tool support
+	ToolsPrompt           string            `json:"tools_prompt"`            // Go text/template replacing the default tools prompt
+	PromptTemplate        string            `json:"prompt_template"`         // chatml/llama2/llama3/mistral/alpaca or a Go text/template
+	UpstreamAPI           string            `json:"upstream_api"`            // "completions" or "chat": the only API the upstream serves
+
+	APIKey     string `json:"api_key"`      // upstream key for this model, overrides upstream_options.api_key
+	APIKeyFile string `json:"api_key_file"` // file holding the upstream key for this model
+
+	MatchModelRegex string `json:"match_model_regex"` // regex matched against the whole model name
+
+	// Merge merges objects into named fields, e.g. "chat_template_kwargs" or
+	// the nested "extra_body.chat_template_kwargs".
+	Merge map[string]map[string]any `json:"merge"`
+
+	Reasoning *ReasoningConfig `json:"reasoning"` // map reasoning_effort onto the provider's thinking parameters
+
+	Deprecation *DeprecationConfig `json:"deprecation"` // warn clients of the models this rule matches and retire them after a sunset date
+
+	Experiments []ExperimentConfig `json:"experiments"` // split the rule's traffic between request variants
+
+	StreamPipeline   []string `json:"stream_pipeline"`   // order of streaming stages; default defaultStreamPipeline
+	ThinkRouting     string   `json:"think_routing"`     // "reasoning" moves <think> content to reasoning_content, "drop" removes it
+	Logprobs         string   `json:"logprobs"`          // "request" asks the upstream for token logprobs, "strip" removes them from requests
+	SynthesizeUsage  bool     `json:"synthesize_usage"`  // add an estimated usage chunk when the upstream streams none
+	Tokenizer        string   `json:"tokenizer"`         // "chars" (default), "cjk" or a tokenizer.json/vocab.json/tiktoken file for token estimates
+	SynthesizeRole   bool     `json:"synthesize_role"`   // open each choice with delta.role and end with [DONE] when the upstream omits them
+	ValidateResponse string   `json:"validate_response"` // "log" or "flag" upstream output that deviates from the OpenAI schema
+	StreamPace       string   `json:"stream_pace"`       // minimum gap between streamed chunks, e.g. "20ms"
+
+	ContinueOnTruncation int `json:"continue_on_truncation"` // max re-issues when a stream is cut off (0 = disabled)
+
+	EnforceStop     bool `json:"enforce_stop"`      // end streams at the client's stop sequences in the relay
+	MaxOutputTokens int  `json:"max_output_tokens"` // end streams after this many content chunks (0 = no cap)
+	MaxOutputBytes  int  `json:"max_output_bytes"`  // end streams after this many bytes of content (0 = no cap)
+
+	RedactPatterns []string `json:"redact_patterns"` // regexes masked in streamed output
+	RedactWindow   int      `json:"redact_window"`   // bytes held back for matches split across chunks (default 64)
+	Trailer        string   `json:"trailer"`         // text appended to every completion, e.g. an AI-generated notice
+
+	EmulateN bool          `json:"emulate_n"` // serve n > 1 with n parallel n=1 upstream requests
+	Coalesce bool          `json:"coalesce"`  // identical concurrent non-streaming requests share one upstream request
+	BestOf   *BestOfConfig `json:"best_of"`   // answer with the best of several generated candidates
+
+	Retry *RetryConfig `json:"retry"` // re-issue requests that fail with retryable statuses or error bodies
 
-var verboseMode bool
+	CacheHint *CacheHintConfig     `json:"cache_hint"` // prefix-cache hint (cache_salt or routing header) per client or conversation
+	Cache     *ResponseCacheConfig `json:"cache"`      // serve repeated non-streaming requests from a response cache
 
-// verbose mode helper function
+	SLO *SLOConfig `json:"slo"` // availability and TTFT objectives, tracked as error budget burn rates
+
+	RepairJSON  bool `json:"repair_json"`  // fix invalid output when response_format asks for JSON (non-stream only)
+	JSONRetries int  `json:"json_retries"` // max re-issues when the output cannot be repaired
+
+	KeepWarm string `json:"keep_warm"` // ping the model after this much idle time, e.g. "4m", so the backend keeps it loaded
+
+	EmbeddingBatchSize int `json:"embedding_batch_size"` // max inputs per upstream /v1/embeddings request (0 = no split)
+
+	Fallbacks      []FallbackTarget `json:"fallbacks"`       // tried in order when the upstream answers 5xx or 429 or cannot be reached
+	FallbackBudget float64          `json:"fallback_budget"` // share of requests per minute that may fail over (default 0.2, at least 10)
+}
+
+// verbose mode helper function, logging at the debug level; below it only
+// messages of the enabled verbose_scopes are logged
 func vlog(format string, args ...any) {
-	if verboseMode {
-		log.Printf(format, args...)
+	vlogCtx(context.Background(), format, args...)
+}
+
+// vlogCtx is vlog for a line about the request ctx belongs to.
+func vlogCtx(ctx context.Context, format string, args ...any) {
+	if debugLogging() || verboseScopes.Load() != 0 {
+		debugf(ctx, logScope(format), format, args...)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelftest(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit-verify" {
+		os.Exit(runAuditVerify(os.Args[2:], os.Stdout))
+	}
+
 	var configPath string
 	var verbose bool
 	flag.StringVar(&configPath, "config", "", "path to jsonc config")
 	flag.StringVar(&configPath, "c", "", "path to jsonc config")
 	flag.BoolVar(&verbose, "v", false, "verbose mode - print operation details")
 	flag.BoolVar(&verbose, "verbose", false, "verbose mode - print operation details")
+	var scopes string
+	flag.StringVar(&scopes, "verbose-scopes", "", "comma-separated verbose scopes ("+strings.Join(verboseScopeNames, ", ")+"); overrides verbose_scopes in the config")
 	flag.Parse()
 
 	// Require config parameter
 	if configPath == "" {
 		fmt.Printf("Usage: %s --config <config.jsonc>\n", os.Args[0])
+		fmt.Printf("       %s selftest --config <config.jsonc>\n", os.Args[0])
+		fmt.Printf("       %s audit-verify --config <config.jsonc>\n", os.Args[0])
 		return
 	}
 
-	verboseMode = verbose
-	if verboseMode {
-		log.Printf("verbose mode enabled")
+	cfg, err := loadConfigJSONC(configPath)
+	if err != nil {
+		fatalf("load config failed: %v", err)
+	}
+	if err := setupLogging(cfg.Log, verbose); err != nil {
+		fatalf("%v", err)
+	}
+	if verbose {
+		logf(slog.LevelInfo, "verbose mode enabled")
+	}
+	if scopes != "" {
+		cfg.VerboseScopes = strings.Split(scopes, ",")
+		if err := validateVerboseScopes(cfg.VerboseScopes); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	setVerboseScopes(cfg.VerboseScopes)
+	if len(cfg.VerboseScopes) > 0 && !verbose {
+		logf(slog.LevelInfo, "verbose scopes enabled: %s", strings.Join(enabledVerboseScopes(), ", "))
+	}
+	toolcallfix.Logf = scopedLogf("toolcallfix")
+
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		fatalf("%v", err)
 	}
+	go newConfigReloader(configPath, cfg).run(context.Background())
 
-	cfg, err := loadConfigJSONC(configPath)
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           loggingMiddleware(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if cfg.ACME != nil {
+		m := newACMEManager(cfg.ACME)
+		srv.TLSConfig = acmeTLSConfig(m)
+		if cfg.ACME.HTTPListen != "" {
+			challenges := serveACMEChallenges(cfg.ACME.HTTPListen, m)
+			// frees the address for the process taking over in an upgrade
+			srv.RegisterOnShutdown(func() { _ = challenges.Close() })
+		}
+		logf(slog.LevelInfo, "ACME: serving HTTPS for %s, certificates cached in %s", strings.Join(cfg.ACME.Domains, ", "), cfg.ACME.CacheDir)
+	}
+	ln, err := listen(cfg.Listen)
 	if err != nil {
-		log.Fatalf("load config failed: %v", err)
+		fatalf("%v", err)
+	}
+	if cfg.PIDFile != "" {
+		if err := os.WriteFile(cfg.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			fatalf("write pid_file: %v", err)
+		}
 	}
+	drain := defaultDrainTimeout
+	if d, err := time.ParseDuration(cfg.DrainTimeout); err == nil {
+		drain = d
+	}
+	logf(slog.LevelInfo, "llm-api-relay %s listening on %s, upstream=%s", buildVersion(), ln.Addr(), cfg.Upstream)
+	serveUntilStopped(srv, ln, drain)
+	cfg.workers.stop()
+	closeUpstreams()
+	if err := cfg.usage.flush(context.Background()); err != nil {
+		logf(slog.LevelError, "USAGE: final flush failed, the last totals are lost: %v", err)
+	}
+}
 
+// background runs worker loops until stop, so the last batch they hold is
+// sent before the process exits.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// run starts loop with a context that is canceled by stop.
+func (b *background) run(loop func(context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		loop(b.ctx)
+	}()
+}
+
+// stop cancels the loops and waits for them to return.
+func (b *background) stop() {
+	if b == nil {
+		return
+	}
+	b.cancel()
+	b.wg.Wait()
+}
+
+// newRelayMux builds every endpoint of the relay for cfg and starts the
+// background workers its optional features need. cfg.workers.stop ends the
+// workers that flush on the way out.
+func newRelayMux(cfg *Config) (*http.ServeMux, error) {
 	up, err := url.Parse(cfg.Upstream)
 	if err != nil {
-		log.Fatalf("invalid upstream: %v", err)
+		return nil, fmt.Errorf("invalid upstream: %w", err)
 	}
+	cfg.workers = newBackground()
 
 	mux := http.NewServeMux()
+	if cfg.live == nil {
+		cfg.live = newLiveRules(cfg.ModelRules)
+	}
+	// admin handlers pick up the audit log when they are wrapped
+	if cfg.Audit != nil {
+		if cfg.audit, err = openAuditLog(*cfg.Audit); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.EventLog != nil {
+		if cfg.events, err = openEventLog(*cfg.EventLog); err != nil {
+			return nil, err
+		}
+	}
+
+	health := newHealthChecker()
+	health.addUpstream("default", up)
 
 	// OpenAI compatible endpoints
-	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
-		proxyPassthrough(w, r, up, cfg.ForwardAuth, nil)
-	})
+	proxy := newProxyHandlers(cfg, up)
+	modelsHandler, chatHandler, completionsHandler := proxy.models, proxy.chat, proxy.completions
+	embeddingsHandler, passthroughHandler := proxy.embeddings, proxy.passthrough
+	var tenants *tenantRouter
+	if len(cfg.Tenants) > 0 {
+		tenants, err = newTenantRouter(cfg, proxy)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tenants.all {
+			if t.upstream != nil {
+				health.addUpstream("tenant:"+t.name, t.upstream)
+			}
+		}
+		modelsHandler = tenants.dispatch(func(h proxyHandlers) http.HandlerFunc { return h.models })
+		chatHandler = tenants.dispatch(func(h proxyHandlers) http.HandlerFunc { return h.chat })
+		completionsHandler = tenants.dispatch(func(h proxyHandlers) http.HandlerFunc { return h.completions })
+		embeddingsHandler = tenants.dispatch(func(h proxyHandlers) http.HandlerFunc { return h.embeddings })
+		passthroughHandler = tenants.dispatch(func(h proxyHandlers) http.HandlerFunc { return h.passthrough })
+	}
+	if swr := cfg.StaleWhileRevalidate; swr != nil {
+		if swr.Models != nil {
+			modelsHandler = newModelsCache(swr.Models).serve(modelsHandler)
+		}
+		if swr.Health != nil {
+			health.ttl, health.maxStale, _ = swr.Health.durations(defaultHealthFreshFor, defaultHealthMaxStale) // validated at load
+		}
+	}
+	// debug requests skip the accounting and limits added below
+	debugChatHandler, debugCompletionsHandler := chatHandler, completionsHandler
+
+	// tenants sharing the top-level upstream and rules share its keeper
+	cfg.warm = newKeepWarm(cfg, up, defaultTenant)
+	go cfg.warm.run(context.Background())
+	if tenants != nil {
+		for i, t := range tenants.all {
+			tc := cfg.Tenants[i]
+			if tc.Upstream == "" && tc.ModelRules == nil && tc.UpstreamType == "" {
+				t.cfg.warm = cfg.warm
+				continue
+			}
+			tup := up
+			if t.upstream != nil {
+				tup = t.upstream
+			}
+			t.cfg.warm = newKeepWarm(t.cfg, tup, t.name)
+			go t.cfg.warm.run(context.Background())
+		}
+	}
 
-	patcher := func(req map[string]any) {
-		applyRules(cfg, req)
+	if cfg.Preflight != nil {
+		targets := []preflightTarget{{"default", upstreamFor(cfg, up)}}
+		if tenants != nil {
+			for _, t := range tenants.all {
+				if t.upstream != nil {
+					targets = append(targets, preflightTarget{"tenant:" + t.name, upstreamFor(t.cfg, t.upstream)})
+				}
+			}
+		}
+		health.preflight = newPreflight(*cfg.Preflight, targets)
+		go health.preflight.run(context.Background())
 	}
 
-	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		proxyWithJSONPatch(w, r, up, cfg.ForwardAuth, cfg, patcher)
-	})
+	if cfg.HealthCheck != nil {
+		health.active = newActiveHealth(*cfg.HealthCheck)
+		health.active.addRoute("default", upstreamFor(cfg, up))
+		if tenants != nil {
+			for _, t := range tenants.all {
+				if t.upstream != nil {
+					health.active.addRoute("tenant:"+t.name, upstreamFor(t.cfg, t.upstream))
+				}
+			}
+		}
+		go health.active.run(context.Background())
+	}
 
-	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
-		proxyWithJSONPatch(w, r, up, cfg.ForwardAuth, cfg, patcher)
-	})
+	if cfg.Transcripts != nil {
+		store, err := newTranscriptStore(*cfg.Transcripts)
+		if err != nil {
+			return nil, fmt.Errorf("open transcript store failed: %w", err)
+		}
+		go store.compactLoop(time.Hour)
+		chatHandler = recordTranscript(store, chatHandler)
+		completionsHandler = recordTranscript(store, completionsHandler)
+		if adminEnabled(cfg) {
+			mux.HandleFunc("/admin/transcripts", adminAuth(cfg, handleTranscripts(store)))
+			mux.HandleFunc("/admin/transcripts/", adminAuth(cfg, handleTranscripts(store)))
+			replayable := map[string]http.HandlerFunc{
+				"/v1/chat/completions": debugChatHandler,
+				"/v1/completions":      debugCompletionsHandler,
+			}
+			mux.HandleFunc("/admin/transcripts/{id}/replay", adminAuth(cfg, handleReplay(store, replayable, tenants)))
+		}
+	}
+	if cfg.BodyLog != nil {
+		bl, err := newBodyLog(*cfg.BodyLog)
+		if err != nil {
+			return nil, fmt.Errorf("open body_log failed: %w", err)
+		}
+		chatHandler = recordBodies(bl, chatHandler)
+		completionsHandler = recordBodies(bl, completionsHandler)
+	}
+
+	// usage accounting feeds the per-tenant metrics, so it runs even
+	// without exporters
+	var exporters []*exporter
+	for i, ec := range cfg.Exporters {
+		e, err := newExporter(ec)
+		if err != nil {
+			return nil, fmt.Errorf("create %s exporter failed: %w", ec.Type, err)
+		}
+		cfg.workers.run(e.run)
+		health.addQueue(fmt.Sprintf("exporter[%d]:%s", i, ec.Type), e.queueDepth)
+		exporters = append(exporters, e)
+	}
+	if cfg.UsageLedger != nil {
+		if cfg.usage, err = openUsageLedger(*cfg.UsageLedger); err != nil {
+			return nil, err
+		}
+		go cfg.usage.run(context.Background())
+		if adminEnabled(cfg) {
+			mux.HandleFunc("/admin/usage", adminAuth(cfg, handleUsage(cfg.usage)))
+		}
+	}
+	if len(cfg.Prices) > 0 && adminEnabled(cfg) {
+		mux.HandleFunc("/admin/costs", adminAuth(cfg, handleCosts()))
+	}
+	if cfg.Deadline != nil {
+		chatHandler = applyDeadline(cfg, chatHandler)
+		completionsHandler = applyDeadline(cfg, completionsHandler)
+	}
+	chatHandler = recordUsage(cfg, exporters, chatHandler)
+	completionsHandler = recordUsage(cfg, exporters, completionsHandler)
+	embeddingsHandler = recordUsage(cfg, exporters, embeddingsHandler)
+	// usage is accounted to the model actually served
+	chatHandler = applyDeprecations(cfg, chatHandler)
+	completionsHandler = applyDeprecations(cfg, completionsHandler)
+	embeddingsHandler = applyDeprecations(cfg, embeddingsHandler)
+
+	for _, mc := range cfg.MetricsPush {
+		p, err := newMetricsPusher(mc, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("create %s metrics pusher failed: %w", mc.Type, err)
+		}
+		cfg.workers.run(p.run)
+	}
+
+	if cfg.Tracing != nil {
+		t, err := newTracer(*cfg.Tracing, up)
+		if err != nil {
+			return nil, fmt.Errorf("create tracer failed: %w", err)
+		}
+		go t.run(context.Background())
+		health.addQueue("tracing", t.queueDepth)
+		chatHandler = recordTrace(t, chatHandler)
+		completionsHandler = recordTrace(t, completionsHandler)
+	}
+
+	// shedding runs inside tenant identification, which sets the priority
+	if cfg.LoadShed != nil {
+		shedder := newLoadShedder(*cfg.LoadShed)
+		chatHandler = shedder.guard(chatHandler)
+		completionsHandler = shedder.guard(completionsHandler)
+	}
+
+	if tenants != nil {
+		modelsHandler = tenants.identify(modelsHandler, false)
+		chatHandler = tenants.identify(chatHandler, true)
+		completionsHandler = tenants.identify(completionsHandler, true)
+		embeddingsHandler = tenants.identify(embeddingsHandler, false)
+		passthroughHandler = tenants.identify(passthroughHandler, false)
+	}
+	if len(cfg.ClientKeys) > 0 {
+		keys := newClientKeyIndex(cfg.ClientKeys)
+		if windows := newTokenWindows(cfg.ClientKeys); len(windows) > 0 {
+			chatHandler = limitClientTokens(keys, windows, chatHandler)
+			completionsHandler = limitClientTokens(keys, windows, completionsHandler)
+		}
+		if budgets := newBudgets(cfg); len(budgets) > 0 {
+			chatHandler = enforceBudgets(keys, budgets, chatHandler)
+			completionsHandler = enforceBudgets(keys, budgets, completionsHandler)
+			if adminEnabled(cfg) {
+				mux.HandleFunc("/admin/budgets", adminAuth(cfg, handleBudgets(budgets)))
+			}
+		}
+		modelsHandler = clientAuth(keys, modelsHandler, false)
+		chatHandler = clientAuth(keys, chatHandler, true)
+		completionsHandler = clientAuth(keys, completionsHandler, true)
+		embeddingsHandler = clientAuth(keys, embeddingsHandler, true)
+		passthroughHandler = clientAuth(keys, passthroughHandler, false)
+	}
+	// signatures are checked on the body as sent, before any conversion
+	signatures := newSignatureVerifier(cfg.RequestSigning)
+	mux.HandleFunc("/v1/models", relayChain(cfg, signatures.guard(maintenance.guard(modelsHandler))))
+	mux.HandleFunc("/v1/chat/completions", relayChain(cfg, signatures.guard(maintenance.guard(health.track(chatHandler)))))
+	mux.HandleFunc("/v1/messages", relayChain(cfg, signatures.guard(maintenance.guard(health.track(anthropicMessages(chatHandler))))))
+	mux.HandleFunc("/v1/completions", relayChain(cfg, signatures.guard(maintenance.guard(health.track(completionsHandler)))))
+	mux.HandleFunc("/v1/embeddings", relayChain(cfg, signatures.guard(maintenance.guard(health.track(embeddingsHandler)))))
+	if cfg.Passthrough != nil {
+		mux.HandleFunc("/v1/", relayChain(cfg, signatures.guard(cfg.Passthrough.guard(maintenance.guard(passthroughHandler)))))
+	}
+
+	mux.Handle("/metrics", metrics)
 
 	// health
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		// load balancers stop sending traffic while the relay drains
+		if maintenance.state().Enabled {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("maintenance"))
+			return
+		}
+		if !health.ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("starting"))
+			return
+		}
+		if route := health.routeDown(); route != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("upstream down: " + route))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/healthz", health.serveHealthz)
+	if adminEnabled(cfg) {
+		mux.HandleFunc("/admin/toolcallfix", adminAuth(cfg, handleToolCallFix(cfg)))
+		mux.HandleFunc("/admin/toolcallfix/", adminAuth(cfg, handleToolCallFix(cfg)))
+		mux.HandleFunc("/admin/tenants", adminAuth(cfg, handleTenants(cfg)))
+		mux.HandleFunc("/admin/tenants/", adminAuth(cfg, handleTenants(cfg)))
+		mux.HandleFunc("/admin/transport", adminAuth(cfg, handleTransport))
+		mux.HandleFunc("/admin/maintenance", adminAuth(cfg, handleMaintenance(health)))
+		mux.HandleFunc("/admin/verbose", adminAuth(cfg, handleVerbose))
+		mux.HandleFunc("/admin/slo", adminAuth(cfg, slos.handleSLO))
+		mux.HandleFunc("/admin/debug/chat", adminAuth(cfg, handleDebugChat(debugChatHandler, tenants)))
+		if cfg.audit != nil {
+			mux.HandleFunc("/admin/audit", adminAuth(cfg, cfg.audit.handleAudit))
+		}
+		mux.HandleFunc("/healthz/details", adminAuth(cfg, health.ServeHTTP))
+	}
 
-	srv := &http.Server{
-		Addr:              cfg.Listen,
-		Handler:           loggingMiddleware(mux),
-		ReadHeaderTimeout: 10 * time.Second,
+	return mux, nil
+}
+
+// proxyHandlers are the upstream-facing endpoints for one configuration.
+type proxyHandlers struct {
+	models, chat, completions http.HandlerFunc
+	embeddings                http.HandlerFunc
+	passthrough               http.HandlerFunc // other /v1/* endpoints, forwarded unchanged
+}
+
+func newProxyHandlers(cfg *Config, up *url.URL) proxyHandlers {
+	patcher := func(req map[string]any) error {
+		applyRules(cfg, req)
+		return nil
 	}
-	log.Printf("listening on %s, upstream=%s", cfg.Listen, cfg.Upstream)
-	log.Fatal(srv.ListenAndServe())
+
+	// completions requests may carry chat-style messages that need rendering
+	completionsPatcher := func(req map[string]any) error {
+		rule := resolveRule(cfg, getString(req, "model"))
+		applyRules(cfg, req)
+		return applyPromptTemplate(rule, req)
+	}
+
+	return proxyHandlers{
+		models: func(w http.ResponseWriter, r *http.Request) {
+			if cfg.UpstreamType == upstreamOllama {
+				ollamaModels(w, r, upstreamFor(cfg, up), cfg.ForwardAuth)
+				return
+			}
+			proxyPassthrough(w, r, upstreamFor(cfg, up), cfg.ForwardAuth, nil)
+		},
+		chat: func(w http.ResponseWriter, r *http.Request) {
+			proxyWithJSONPatch(w, r, up, cfg.ForwardAuth, cfg, patcher)
+		},
+		completions: func(w http.ResponseWriter, r *http.Request) {
+			proxyWithJSONPatch(w, r, up, cfg.ForwardAuth, cfg, completionsPatcher)
+		},
+		embeddings: func(w http.ResponseWriter, r *http.Request) {
+			proxyEmbeddings(w, r, up, cfg)
+		},
+		passthrough: func(w http.ResponseWriter, r *http.Request) {
+			proxyPassthrough(w, r, upstreamFor(cfg, up), cfg.ForwardAuth, passthroughBody(r))
+		},
+	}
+}
+
+// requestInfo carries facts that inner handlers learn about a request, such
+// as its tenant, back out to the access log.
+type requestInfo struct {
+	id     string // X-Request-Id, the client's or one the relay assigned
+	tenant string
+	client string     // client key name when client_keys are configured
+	usage  tokenUsage // set by recordUsage once the response is done
+	cost   float64    // price of usage; 0 when the model has no price
+
+	// outputTokens, when set, is told the output tokens estimated so far
+	// while a stream runs
+	outputTokens func(n int)
+
+	// set by the proxy once the model rules are applied
+	rule          string
+	upstream      string
+	upstreamModel string
+	experiments   []experimentAssignment
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s (%s)", r.Method, r.URL.Path, time.Since(start))
+		info := &requestInfo{id: assignRequestID(w, r)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "duration", time.Since(start), "request_id", info.id}
+		if info.client != "" {
+			attrs = append(attrs, "client", info.client)
+		}
+		if info.tenant != "" {
+			attrs = append(attrs, "tenant", info.tenant)
+		}
+		if info.cost > 0 {
+			attrs = append(attrs, "cost", info.cost)
+		}
+		for _, a := range info.experiments {
+			attrs = append(attrs, "experiment."+a.experiment, a.variant.Name)
+		}
+		slog.Info("request", attrs...)
 	})
 }
 
@@ -119,25 +655,232 @@ func loadConfigJSONC(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	clean := stripJSONC(string(b))
+	clean, offsets := relaxJSON(stripJSONCOffsets(string(b)))
 	var cfg Config
 	if err := json.Unmarshal([]byte(clean), &cfg); err != nil {
-		return nil, err
+		return nil, locateConfigError(path, string(b), offsets, err)
 	}
+	warnDuplicateRules(&cfg)
 	if cfg.Listen == "" {
 		cfg.Listen = ":8080"
 	}
 	if cfg.Upstream == "" {
 		return nil, errors.New("upstream is required")
 	}
+	if err := validateUpstreamType(cfg.UpstreamType); err != nil {
+		return nil, err
+	}
+	if err := validateModelRules(cfg.ModelRules); err != nil {
+		return nil, err
+	}
+	if err := validateUpstreamOptions(cfg.UpstreamOptions); err != nil {
+		return nil, err
+	}
+	if err := validateClientWrite(cfg.ClientWrite); err != nil {
+		return nil, err
+	}
+	if err := validatePreflight(cfg.Preflight); err != nil {
+		return nil, err
+	}
+	if err := validateHealthCheck(cfg.HealthCheck); err != nil {
+		return nil, err
+	}
+	if err := validateStaleWhileRevalidate(cfg.StaleWhileRevalidate); err != nil {
+		return nil, err
+	}
+	if err := validateSLOAlert(cfg.SLOAlert); err != nil {
+		return nil, err
+	}
+	if err := validateReload(cfg.Reload); err != nil {
+		return nil, err
+	}
+	if err := validateLoadShed(cfg.LoadShed); err != nil {
+		return nil, err
+	}
+	if err := validateAudit(cfg.Audit); err != nil {
+		return nil, err
+	}
+	if err := validatePassthrough(cfg.Passthrough); err != nil {
+		return nil, err
+	}
+	if err := validateEventLog(cfg.EventLog); err != nil {
+		return nil, err
+	}
+	if err := validateUsageLedger(cfg.UsageLedger); err != nil {
+		return nil, err
+	}
+	if err := validatePrices(cfg.Prices); err != nil {
+		return nil, err
+	}
+	if err := validateDeadline(cfg.Deadline); err != nil {
+		return nil, err
+	}
+	if err := validateRelayHops(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRequestSigning(cfg.RequestSigning); err != nil {
+		return nil, err
+	}
+	if err := validateACME(cfg.ACME); err != nil {
+		return nil, err
+	}
+	if err := validateLogConfig(cfg.Log); err != nil {
+		return nil, err
+	}
+	if err := validateBodyLog(cfg.BodyLog); err != nil {
+		return nil, err
+	}
+	if err := validateVerboseScopes(cfg.VerboseScopes); err != nil {
+		return nil, err
+	}
+	if err := validateDrainTimeout(cfg.DrainTimeout); err != nil {
+		return nil, err
+	}
+	if err := validateTenants(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateClientKeys(cfg.ClientKeys); err != nil {
+		return nil, err
+	}
+	if err := validateBudgets(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateUnmatched(&cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
+// validateModelRules rejects rules whose options cannot work together.
+func validateModelRules(rules []ModelRule) error {
+	for _, rule := range rules {
+		if err := validateRuleMatch(rule); err != nil {
+			return err
+		}
+		if rule.PromptTemplate != "" {
+			if _, err := lookupPromptTemplate(rule.PromptTemplate); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if err := validateAPIKey(rule.APIKey, rule.APIKeyFile); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		switch rule.UpstreamAPI {
+		case "", "chat":
+		case "completions":
+			if rule.PromptTemplate == "" {
+				return fmt.Errorf("model rule %q: upstream_api \"completions\" requires prompt_template", ruleName(&rule))
+			}
+		default:
+			return fmt.Errorf("model rule %q: unknown upstream_api %q", ruleName(&rule), rule.UpstreamAPI)
+		}
+		if _, err := compileRedactPatterns(rule.RedactPatterns); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		for target := range rule.Merge {
+			if slices.Contains(strings.Split(target, "."), "") {
+				return fmt.Errorf("model rule %q: invalid merge target %q", ruleName(&rule), target)
+			}
+		}
+		if _, err := toolcallfix.NewTransformerWithTags(rule.ToolCallFixFormat, rule.ToolCallFixTags); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		switch rule.ToolCallFixSchema {
+		case "", toolcallfix.SchemaCoerce, toolcallfix.SchemaStrict:
+		default:
+			return fmt.Errorf("model rule %q: unknown toolcallfix_schema %q", ruleName(&rule), rule.ToolCallFixSchema)
+		}
+		if err := validateStreamPipeline(rule.StreamPipeline); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		if err := validateResponseMode(rule.ValidateResponse); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		switch rule.ThinkRouting {
+		case "", "reasoning", "drop":
+		default:
+			return fmt.Errorf("model rule %q: unknown think_routing %q", ruleName(&rule), rule.ThinkRouting)
+		}
+		if _, err := loadTokenizer(rule.Tokenizer); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		switch rule.Logprobs {
+		case "", "request", "strip":
+		default:
+			return fmt.Errorf("model rule %q: unknown logprobs %q", ruleName(&rule), rule.Logprobs)
+		}
+		if err := validateKeepWarm(&rule); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		if rule.EmbeddingBatchSize < 0 {
+			return fmt.Errorf("model rule %q: embedding_batch_size must not be negative", ruleName(&rule))
+		}
+		if rule.StreamPace != "" {
+			if d, err := time.ParseDuration(rule.StreamPace); err != nil || d <= 0 {
+				return fmt.Errorf("model rule %q: invalid stream_pace %q", ruleName(&rule), rule.StreamPace)
+			}
+		}
+		if err := validateExperiments(rule.Experiments); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		if rule.Deprecation != nil {
+			if err := validateDeprecation(rule.Deprecation); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if rule.Reasoning != nil {
+			if err := validateReasoning(rule.Reasoning); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if err := validateToolsViaPrompt(&rule); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		if rule.SLO != nil {
+			if err := validateSLO(rule.SLO); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if rule.Retry != nil {
+			if err := validateRetry(rule.Retry); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if err := validateFallbacks(&rule); err != nil {
+			return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+		}
+		if rule.BestOf != nil {
+			if err := validateBestOf(rule.BestOf); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if rule.CacheHint != nil {
+			if err := validateCacheHint(rule.CacheHint); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+		if rule.Cache != nil {
+			if err := validateResponseCache(rule.Cache); err != nil {
+				return fmt.Errorf("model rule %q: %w", ruleName(&rule), err)
+			}
+		}
+	}
+	return nil
+}
+
 // stripJSONC removes // line comments and /* block comments */.
 // It’s simple and pragmatic for config use.
 func stripJSONC(s string) string {
+	out, _ := stripJSONCOffsets(s)
+	return out
+}
+
+// stripJSONCOffsets is stripJSONC that also returns, for every byte of the
+// output, its offset in s, so parse errors can point into the original file.
+func stripJSONCOffsets(s string) (string, []int) {
 	var out strings.Builder
 	out.Grow(len(s))
+	offsets := make([]int, 0, len(s))
 
 	inString := false
 	escape := false
@@ -152,6 +895,7 @@ func stripJSONC(s string) string {
 			if c == '\n' {
 				inLineComment = false
 				out.WriteByte(c)
+				offsets = append(offsets, i)
 			}
 			continue
 		}
@@ -168,6 +912,7 @@ func stripJSONC(s string) string {
 		// handle string state
 		if inString {
 			out.WriteByte(c)
+			offsets = append(offsets, i)
 			if escape {
 				escape = false
 				continue
@@ -186,6 +931,7 @@ func stripJSONC(s string) string {
 		if c == '"' {
 			inString = true
 			out.WriteByte(c)
+			offsets = append(offsets, i)
 			continue
 		}
 
@@ -205,8 +951,9 @@ func stripJSONC(s string) string {
 		}
 
 		out.WriteByte(c)
+		offsets = append(offsets, i)
 	}
-	return out.String()
+	return out.String(), offsets
 }
 
 func applyRules(cfg *Config, req map[string]any) {
@@ -214,20 +961,15 @@ func applyRules(cfg *Config, req map[string]any) {
 
 	vlog("RULE: processing model '%s'", model)
 
-	rule := findRule(cfg.ModelRules, model)
-	if rule == nil {
-		vlog("RULE: no exact match for '%s', trying 'default'", model)
-		rule = findRule(cfg.ModelRules, "default")
-	}
-
+	rule := resolveRule(cfg, model)
 	if rule == nil {
 		vlog("RULE: no rule found for model '%s', applying no changes", model)
 		return
 	}
 
-	vlog("RULE: matched rule '%s', applying transformations", rule.MatchModel)
-	vlog("RULE: rule operations - unset: %d fields, set: %d fields, extra: %d fields",
-		len(rule.Unset), len(rule.Set), len(rule.Extra))
+	vlog("RULE: matched rule '%s', applying transformations", ruleName(rule))
+	vlog("RULE: rule operations - unset: %d fields, set: %d fields, extra: %d fields, merge: %d targets",
+		len(rule.Unset), len(rule.Set), len(rule.Extra), len(rule.Merge))
 
 	// unset first
 	for _, k := range rule.Unset {
@@ -238,32 +980,86 @@ func applyRules(cfg *Config, req map[string]any) {
 	// set top-level
 	for k, v := range rule.Set {
 		vlog("RULE: setting '%s' = %v", k, v)
-		req[k] = v
+		req[k] = cloneValue(v)
 	}
 
 	// merge extra
 	if len(rule.Extra) > 0 {
-		extra, _ := req["extra"].(map[string]any)
-		if extra == nil {
-			extra = map[string]any{}
-			req["extra"] = extra
-		}
-		for k, v := range rule.Extra {
-			vlog("RULE: adding to extra '%s' = %v", k, v)
-			extra[k] = v
-		}
+		mergeInto(req, "extra", rule.Extra)
+	}
+
+	// merge named targets, in a stable order
+	targets := make([]string, 0, len(rule.Merge))
+	for target := range rule.Merge {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		mergeInto(req, target, rule.Merge[target])
+	}
+
+	if rule.Logprobs != "" {
+		vlog("RULE: logprobs '%s'", rule.Logprobs)
+		applyLogprobs(rule.Logprobs, req)
+	}
+
+	// map reasoning_effort last so a set value is mapped as well
+	if rule.Reasoning != nil {
+		applyReasoning(rule.Reasoning, req)
 	}
 
 	vlog("RULE: transformation complete for model '%s'", model)
 }
 
-func findRule(rules []ModelRule, model string) *ModelRule {
-	for i := range rules {
-		if rules[i].MatchModel == model {
-			return &rules[i]
+// mergeInto merges fields into the object at target, a dot-separated path
+// of top-level and nested field names. Missing or non-object fields along
+// the path are replaced with objects.
+func mergeInto(req map[string]any, target string, fields map[string]any) {
+	obj := req
+	for _, name := range strings.Split(target, ".") {
+		next, _ := obj[name].(map[string]any)
+		if next == nil {
+			next = map[string]any{}
+			obj[name] = next
 		}
+		obj = next
 	}
-	return nil
+	for k, v := range fields {
+		vlog("RULE: adding to %s '%s' = %v", target, k, v)
+		obj[k] = cloneValue(v)
+	}
+}
+
+// cloneValue deep-copies a JSON value taken from a rule. Rules are shared by
+// all requests, so a request must never hold (and later modify) their maps
+// and slices, e.g. when a merge target is an object the rule also sets.
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = cloneValue(e)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, e := range v {
+			s[i] = cloneValue(e)
+		}
+		return s
+	}
+	return v
+}
+
+// resolveRule returns the rule for model, falling back to the "default" rule.
+func resolveRule(cfg *Config, model string) *ModelRule {
+	rules := cfg.rules()
+	rule := findRule(rules, model)
+	if rule == nil {
+		vlog("RULE: no match for '%s', trying 'default'", model)
+		rule = findExactRule(rules, "default")
+	}
+	return rule
 }
 
 func getString(m map[string]any, key string) string {
@@ -277,18 +1073,18 @@ func getString(m map[string]any, key string) string {
 	return ""
 }
 
-// shouldEnableToolCallFix determines whether to enable toolcallfix for a given model
-func shouldEnableToolCallFix(cfg *Config, model string) bool {
-	// Find exact match rule
-	rule := findRule(cfg.ModelRules, model)
-	if rule == nil {
-		// Try default rule as fallback
-		vlog("TOOLCALLFIX: no exact match for '%s', trying 'default'", model)
-		rule = findRule(cfg.ModelRules, "default")
+// shouldEnableToolCallFix determines whether to enable toolcallfix for a
+// request from tenant matched to rule (nil when no rule matched) and asking
+// for model. The rule is the one matched before its "set" was applied, so a
+// rule that renames the model still decides.
+func shouldEnableToolCallFix(tenant string, rule *ModelRule, model string) bool {
+	if ov, ok := toolCallFixToggles.get(toolCallFixKeyFor(tenant, rule, model)); ok && ov.Enabled != nil {
+		vlog("TOOLCALLFIX: using runtime override for '%s': enable=%v", model, *ov.Enabled)
+		return *ov.Enabled
 	}
 
 	if rule != nil {
-		vlog("TOOLCALLFIX: using rule '%s': enable=%v", rule.MatchModel, rule.EnableToolCallFix)
+		vlog("TOOLCALLFIX: using rule '%s': enable=%v", ruleName(rule), rule.EnableToolCallFix)
 		return rule.EnableToolCallFix
 	}
 
@@ -297,34 +1093,56 @@ func shouldEnableToolCallFix(cfg *Config, model string) bool {
 	return false
 }
 
+// toolCallFixFormat returns the tool call format for a request matched to
+// rule: a runtime override from /admin/toolcallfix, else the rule's.
+func toolCallFixFormat(tenant string, rule *ModelRule, model string) string {
+	if ov, ok := toolCallFixToggles.get(toolCallFixKeyFor(tenant, rule, model)); ok && ov.Format != nil {
+		return cmp.Or(*ov.Format, toolcallfix.FormatGLM)
+	}
+	if rule != nil && rule.ToolCallFixFormat != "" {
+		return rule.ToolCallFixFormat
+	}
+	return toolcallfix.FormatGLM
+}
+
+// toolCallFixTags returns the custom tool call tags, from the same place as
+// toolCallFixFormat, or nil when the format's own tags apply.
+func toolCallFixTags(tenant string, rule *ModelRule, model string) *toolcallfix.Tags {
+	if ov, ok := toolCallFixToggles.get(toolCallFixKeyFor(tenant, rule, model)); ok && ov.Format != nil {
+		return ov.Tags
+	}
+	if rule != nil {
+		return rule.ToolCallFixTags
+	}
+	return nil
+}
+
 // proxyPassthrough forwards request to upstream (no body patch).
-func proxyPassthrough(w http.ResponseWriter, r *http.Request, upstream *url.URL, forwardAuth bool, newBody io.Reader) {
-	target := upstream.ResolveReference(r.URL)
+func proxyPassthrough(w http.ResponseWriter, r *http.Request, upstream *upstreamClient, forwardAuth bool, newBody io.Reader) {
+	target := upstream.target(r.URL)
 	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), newBody)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	if newBody == r.Body {
+		// streamed as is, e.g. an audio upload
+		req.ContentLength = r.ContentLength
+	}
 
 	copyHeaders(req.Header, r.Header)
+	upstream.normalizeClientHeaders(req)
 	// Host should be upstream host
-	req.Host = upstream.Host
+	req.Host = upstream.host()
 
-	if !forwardAuth {
-		req.Header.Del("Authorization")
-	}
+	upstream.authorize(req, nil, forwardAuth)
 
 	// If we provided a new body, set content-type if missing
 	if newBody != nil && req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	// Use a transport that supports streaming well
-	client := &http.Client{
-		Timeout: 0, // streaming: no timeout
-	}
-
-	resp, err := client.Do(req)
+	resp, err := upstream.do(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -340,15 +1158,22 @@ func proxyPassthrough(w http.ResponseWriter, r *http.Request, upstream *url.URL,
 	w.WriteHeader(resp.StatusCode)
 
 	// stream copy
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		copyFlushing(w, resp.Body)
+		return
+	}
 	_, _ = io.Copy(w, resp.Body)
 }
 
-func proxyWithJSONPatch(w http.ResponseWriter, r *http.Request, upstream *url.URL, forwardAuth bool, cfg *Config, patch func(map[string]any)) {
+func proxyWithJSONPatch(w http.ResponseWriter, r *http.Request, upstream *url.URL, forwardAuth bool, cfg *Config, patch func(map[string]any) error) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	rt := requestTraceFrom(r.Context())
+	parseSpan := rt.start("parse request", spanKindInternal)
+	defer parseSpan.end(nil)
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "read body failed", http.StatusBadRequest)
@@ -356,15 +1181,91 @@ func proxyWithJSONPatch(w http.ResponseWriter, r *http.Request, upstream *url.UR
 	}
 	_ = r.Body.Close()
 
+	// canceled when a streaming client is dropped, ending every upstream
+	// request made for it
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	var payload map[string]any
 	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
 		http.Error(w, "invalid json body", http.StatusBadRequest)
 		return
 	}
 
+	if cfg.ValidateRequests && strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		if err := validateChatRequest(payload); err != nil {
+			vlogCtx(r.Context(), "VALIDATE: rejecting request: %s", err.message)
+			writeRequestError(w, err)
+			return
+		}
+	}
+
+	if !routeUnmatched(cfg, payload) {
+		writeModelNotFound(w, getString(payload, "model"))
+		return
+	}
+	parseSpan.end(nil)
+
+	rulesSpan := rt.start("apply rules", spanKindInternal)
+	defer rulesSpan.end(nil)
+	// resolve the rule before patching, since "set" may rename the model
+	rule := resolveRule(cfg, getString(payload, "model"))
+	if rule != nil {
+		rulesSpan.str("relay.rule", ruleName(rule))
+	}
+	cfg.warm.touch(rule, time.Now())
+	bridge := newAPIBridge(rule, r.URL.Path)
+	jsonMode := wantsJSONOutput(rule, payload)
+	experiments := assignExperiments(r, rule, payload)
+
 	// patch request json
 	if patch != nil {
-		patch(payload)
+		if err := patch(payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	applyExperiments(w, r, experiments, payload)
+
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.upstream, info.upstreamModel = upstream.Host, getString(payload, "model")
+		if rule != nil {
+			info.rule = ruleName(rule)
+		}
+	}
+
+	// the tools stay with the relay to check the calls in the response
+	tools := payload["tools"]
+	promptTools := rule != nil && rule.ToolsViaPrompt && strings.HasSuffix(r.URL.Path, "/chat/completions")
+	if promptTools {
+		if tools, err = applyToolsViaPrompt(rule, payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if rule != nil && rule.CacheHint != nil {
+		applyCacheHint(rule.CacheHint, r, payload)
+	}
+
+	targetURL := *r.URL
+	if bridge != nil {
+		if err := bridge.convertRequest(rule, payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targetURL.Path = bridge.upstreamPath(targetURL.Path)
+		vlogCtx(r.Context(), "BRIDGE: %s, forwarding to %s", bridge.name, targetURL.Path)
+	}
+	fallbackURL := targetURL // fallbacks speak the OpenAI API
+	ollama := cfg.UpstreamType == upstreamOllama
+	if ollama {
+		if !strings.HasSuffix(targetURL.Path, "/chat/completions") {
+			writeJSONError(w, http.StatusNotFound, "the ollama upstream serves chat completions only", "invalid_request_error", "unsupported_endpoint")
+			return
+		}
+		targetURL.Path = ollamaPath(targetURL.Path, "/chat/completions", "/api/chat")
 	}
 
 	patched, err := json.Marshal(payload)
@@ -372,6 +1273,7 @@ func proxyWithJSONPatch(w http.ResponseWriter, r *http.Request, upstream *url.UR
 		http.Error(w, "marshal patched body failed", http.StatusBadGateway)
 		return
 	}
+	rulesSpan.end(nil)
 
 	// Determine whether client expects streaming (OpenAI style stream=true)
 	stream := false
@@ -379,88 +1281,260 @@ func proxyWithJSONPatch(w http.ResponseWriter, r *http.Request, upstream *url.UR
 		stream = true
 	}
 
-	target := upstream.ResolveReference(r.URL)
-	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), bytes.NewReader(patched))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	fanN := emulatedN(rule, payload)
+	if fanN > maxEmulatedN {
+		http.Error(w, fmt.Sprintf("n must not exceed %d", maxEmulatedN), http.StatusBadRequest)
 		return
 	}
-
-	copyHeaders(req.Header, r.Header)
-	req.Host = upstream.Host
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(patched)))
-
-	if !forwardAuth {
-		req.Header.Del("Authorization")
+	var bestOfCfg *BestOfConfig
+	if bridge == nil {
+		bestOfCfg = bestOfFor(rule, r.URL.Path, payload)
 	}
-
-	client := &http.Client{Timeout: 0}
-	resp, err := client.Do(req)
+	client := upstreamFor(cfg, upstream)
+	sendOne := newRetrier(rule, tenantName(r.Context()), getString(payload, "model")).wrap(r.Context(), func(body []byte) (*http.Response, error) {
+		if ollama {
+			return sendOllamaChat(r, client, &targetURL, rule, forwardAuth, body)
+		}
+		return sendJSONUpstream(r, client, &targetURL, rule, forwardAuth, body)
+	})
+	sendOne = withFallbacks(r, &fallbackURL, rule, getString(payload, "model"), sendOne)
+	send := func(body []byte) (*http.Response, error) {
+		if fanN > 0 {
+			return fanOut(body, fanN, stream, sendOne)
+		}
+		if bestOfCfg != nil {
+			return bestOf(r.Context(), bestOfCfg, body, stream, sendOne, tenantName(r.Context()), metricModel(rule))
+		}
+		return sendOne(body)
+	}
+	if fanN > 0 {
+		vlogCtx(r.Context(), "FANOUT: emulating n=%d with parallel requests for model '%s'", fanN, getString(payload, "model"))
+		fanOutTotal.Inc(tenantName(r.Context()), metricModel(rule))
+	}
+	first := send
+	if rule != nil && rule.Coalesce && !stream {
+		key := coalesceKey(r, upstream, patched)
+		first = func(body []byte) (*http.Response, error) {
+			resp, shared, err := coalescer.do(r.Context(), key, func() (*http.Response, error) { return send(body) })
+			if shared {
+				vlogCtx(r.Context(), "COALESCE: answered '%s' with the response of an identical request", getString(payload, "model"))
+				coalescedRequestsTotal.Inc(tenantName(r.Context()), metricModel(rule))
+			}
+			return resp, err
+		}
+	}
+	first = withResponseCache(w, r, rule, upstream, payload, stream, first)
+	resp, err := first(patched)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	if trace := debugTraceFrom(r.Context()); trace != nil {
+		trace.request = patched
+		resp.Body = trace.teeUpstream(resp.Body)
+	}
+	var capture *streamCapture
+	if stream {
+		if capture = startCapture(cfg, r, bodyBytes); capture != nil {
+			defer capture.Close()
+			w.Header().Set(captureIDHeader, capture.id)
+			resp.Body = capture.teeUpstream(resp.Body)
+		}
+	}
+
 	// copy response headers
 	for k, vv := range resp.Header {
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
+	if rt != nil {
+		// the client joins the relay's span, not the upstream's
+		w.Header().Set(traceparentHeader, rt.traceparent())
+	}
+
+	if rule != nil && rule.ValidateResponse != "" && !stream && bridge == nil && resp.StatusCode == http.StatusOK {
+		if err := validateResponseBody(w, r, rule, payload, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	var body io.Reader = resp.Body
+	if stream && rule != nil && rule.ContinueOnTruncation > 0 && resp.StatusCode == http.StatusOK {
+		if cont := newContinuationStream(r.Context(), resp.Body, payload, rule, tenantName(r.Context()), send); cont != nil {
+			defer cont.Close()
+			body = cont
+		}
+	}
+	if jsonMode && !stream && resp.StatusCode == http.StatusOK {
+		var decode func([]byte) ([]byte, error)
+		if bridge != nil {
+			decode = bridge.convertBody
+		}
+		resend := func() (*http.Response, error) { return send(patched) }
+		out, err := readJSONOutput(r.Context(), resp, decode, resend, rule, tenantName(r.Context()), getString(payload, "model"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write(out)
+		return
+	}
+	trailer := ""
+	if rule != nil && !requestsJSON(payload) {
+		// appended text would break the JSON the client asked for
+		trailer = rule.Trailer
+	}
+	// non-streaming responses get the conversion the stream pipeline does,
+	// unless a relay behind this one already did it
+	upstreamFixed := toolCallsFixedUpstream(resp)
+	fixCalls := promptTools && !stream && !upstreamFixed && shouldEnableToolCallFix(tenantName(r.Context()), rule, getString(payload, "model"))
+	if !stream && resp.StatusCode == http.StatusOK && (bridge != nil || trailer != "" || fixCalls) {
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if bridge != nil {
+			if raw, err = bridge.convertBody(raw); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+		if fixCalls {
+			raw = toolCallsFromContent(tenantName(r.Context()), rule, getString(payload, "model"), tools, raw)
+			w.Header().Set(toolCallFixMarkerHeader, "applied")
+		}
+		if trailer != "" {
+			raw = appendTrailer(raw, trailer)
+		}
+		// the rewritten body has a different length
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write(raw)
+		return
+	}
+	if bridge != nil && resp.StatusCode == http.StatusOK {
+		// the translated body has a different length
+		w.Header().Del("Content-Length")
+		converted := bridge.convertStream(body)
+		defer converted.Close()
+		body = converted
+	}
+	model := getString(payload, "model")
+	if stream && resp.StatusCode == http.StatusOK {
+		sr := &streamRequest{
+			ctx:           r.Context(),
+			cfg:           cfg,
+			rule:          rule,
+			payload:       payload,
+			tools:         tools,
+			tenant:        tenantName(r.Context()),
+			model:         model,
+			trailer:       trailer,
+			upstreamFixed: upstreamFixed,
+		}
+		piped, closePipeline := buildStreamPipeline(body, sr)
+		defer closePipeline()
+		body = piped
+		if sr.toolCallsFixed {
+			w.Header().Set(toolCallFixMarkerHeader, "applied")
+		}
+	}
 
 	// If streaming, ensure flush
 	w.WriteHeader(resp.StatusCode)
 	if !stream {
-		_, _ = io.Copy(w, resp.Body)
+		_, _ = io.Copy(w, body)
 		return
 	}
 
-	// Extract model name for toolcallfix decision
-	model := getString(payload, "model")
-
-	// Check if toolcallfix should be enabled for this model
-	enableToolCallFix := shouldEnableToolCallFix(cfg, model)
-
 	// streaming: copy line by line (works for SSE) but still safe for chunked bytes
-	flusher, ok := w.(http.Flusher)
-	if !ok {
+	if _, ok := w.(http.Flusher); !ok {
 		// fallback
-		_, _ = io.Copy(w, resp.Body)
+		_, _ = io.Copy(w, body)
 		return
 	}
 
-	if enableToolCallFix {
-		vlog("TOOLCALLFIX: transforming stream for model '%s'", model)
-		if err := toolcallfix.TransformStream(resp.Body, w); err != nil {
-			vlog("TOOLCALLFIX: transformation failed: %v", err)
-			// Fallback to direct stream copy
-			_, _ = io.Copy(w, resp.Body)
-			flusher.Flush()
-			return
-		}
-		vlog("TOOLCALLFIX: transformation completed successfully for model '%s'", model)
-		return
+	// a stalled client is dropped instead of holding the upstream open
+	cs := newClientStream(r.Context(), w, cfg.ClientWrite, cancel, tenantName(r.Context()), rule, model)
+	defer cs.Close()
+	var out io.Writer = cs
+	if capture != nil {
+		out = capture.teeClient(cs)
 	}
 
-	// Original streaming logic without toolcallfix
-	reader := bufio.NewReader(resp.Body)
+	// first token spans the wait for the first data event, stream complete
+	// the rest of the stream
+	streamSpan := rt.start("first token", spanKindInternal)
+	defer func() { streamSpan.end(r.Context().Err()) }()
+	// under X-Deadline-Ms the stream may have to be ended by the relay
+	var envelope *streamEnvelope
+	if _, ok := r.Context().Deadline(); ok {
+		envelope = &streamEnvelope{}
+	}
+	firstToken := true
+	reader := bufio.NewReader(body)
 	for {
 		chunk, err := reader.ReadBytes('\n')
 		if len(chunk) > 0 {
-			_, _ = w.Write(chunk)
-			flusher.Flush()
+			if firstToken && bytes.HasPrefix(chunk, []byte("data: ")) {
+				firstToken = false
+				streamSpan.end(nil)
+				streamSpan = rt.start("stream complete", spanKindInternal)
+			}
+			if data, ok := bytes.CutPrefix(chunk, []byte("data: {")); ok && envelope != nil {
+				var c map[string]any
+				if json.Unmarshal(append([]byte("{"), data...), &c) == nil {
+					envelope.remember(c)
+				}
+			}
+			if _, werr := out.Write(chunk); werr != nil {
+				return
+			}
 		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return
+			switch {
+			case errors.Is(err, io.EOF):
+			case deadlineExpired(r.Context()):
+				endStreamAtDeadline(r.Context(), out, envelope, tenantName(r.Context()), rule, model)
+			case r.Context().Err() == nil:
+				// a canceled context means the client left or was
+				// dropped, not that the upstream failed
+				writeStreamError(r.Context(), out, tenantName(r.Context()), rule, model, err)
+				streamSpan.end(err)
 			}
 			return
 		}
 	}
 }
 
+// sendJSONUpstream posts a JSON body to the upstream endpoint for path,
+// carrying over the client's headers.
+func sendJSONUpstream(r *http.Request, upstream *upstreamClient, path *url.URL, rule *ModelRule, forwardAuth bool, body []byte) (*http.Response, error) {
+	target := upstream.target(path)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	copyHeaders(req.Header, r.Header)
+	upstream.normalizeClientHeaders(req)
+	req.Host = upstream.host()
+	req.Header.Set("Content-Type", "application/json")
+	upstream.authorize(req, rule, forwardAuth)
+
+	span := startUpstreamSpan(r, req)
+	resp, err := upstream.doJSON(req, body)
+	span.endStatus(resp, err)
+	return resp, err
+}
+
 func copyHeaders(dst, src http.Header) {
 	// copy all headers, but avoid hop-by-hop headers
 	hop := map[string]struct{}{
@@ -478,6 +1552,10 @@ func copyHeaders(dst, src http.Header) {
 		if _, ok := hop[k]; ok {
 			continue
 		}
+		// relay controls are for the relay only
+		if k == captureHeader || k == adminTokenHeader {
+			continue
+		}
 		// Let Go set these properly
 		if strings.EqualFold(k, "Host") {
 			continue
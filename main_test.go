@@ -166,7 +166,7 @@ func TestLoadConfigJSONC(t *testing.T) {
 			"listen": ":8080",
 			"upstream": "http://example.com",
 			// missing closing brace
-		}`
+		`
 
 		tmpFile, err := createTempFile(configJSON)
 		if err != nil {
@@ -285,6 +285,40 @@ func TestApplyRules(t *testing.T) {
 		}
 	})
 
+	t.Run("merge targets", func(t *testing.T) {
+		cfg := &Config{ModelRules: []ModelRule{{
+			MatchModel: "qwen3",
+			Extra:      map[string]any{"a": 1},
+			Merge: map[string]map[string]any{
+				"chat_template_kwargs":            {"enable_thinking": false},
+				"metadata":                        {"team": "search"},
+				"extra_body.chat_template_kwargs": {"thinking": true},
+			},
+		}}}
+		req := map[string]any{
+			"model":                "qwen3",
+			"chat_template_kwargs": map[string]any{"keep": "me"},
+			"metadata":             "not an object",
+		}
+
+		applyRules(cfg, req)
+
+		kwargs, _ := req["chat_template_kwargs"].(map[string]any)
+		if kwargs["enable_thinking"] != false || kwargs["keep"] != "me" {
+			t.Errorf("chat_template_kwargs = %v", req["chat_template_kwargs"])
+		}
+		if meta, _ := req["metadata"].(map[string]any); meta["team"] != "search" {
+			t.Errorf("metadata = %v", req["metadata"])
+		}
+		body, _ := req["extra_body"].(map[string]any)
+		if nested, _ := body["chat_template_kwargs"].(map[string]any); nested["thinking"] != true {
+			t.Errorf("extra_body = %v", req["extra_body"])
+		}
+		if extra, _ := req["extra"].(map[string]any); extra["a"] != 1 {
+			t.Errorf("extra = %v", req["extra"])
+		}
+	})
+
 	t.Run("fallback to default rule", func(t *testing.T) {
 		req := map[string]any{
 			"model":       "unknown-model",
@@ -428,7 +462,7 @@ func TestProxyPassthrough(t *testing.T) {
 
 		w := httptest.NewRecorder()
 
-		proxyPassthrough(w, req, upstreamURL, false, nil)
+		proxyPassthrough(w, req, upstreamFor(&Config{}, upstreamURL), false, nil)
 
 		resp := w.Result()
 		if resp.StatusCode != http.StatusOK {
@@ -453,7 +487,7 @@ func TestProxyPassthrough(t *testing.T) {
 
 		w := httptest.NewRecorder()
 
-		proxyPassthrough(w, req, upstreamURL, true, nil)
+		proxyPassthrough(w, req, upstreamFor(&Config{}, upstreamURL), true, nil)
 
 		resp := w.Result()
 		if resp.StatusCode != http.StatusOK {
@@ -489,3 +523,12 @@ func parseURLTest(s string) *url.URL {
 	}
 	return u
 }
+
+func TestValidateMergeTargets(t *testing.T) {
+	for target, ok := range map[string]bool{"metadata": true, "extra_body.chat_template_kwargs": true, "": false, "a..b": false, ".a": false} {
+		err := validateModelRules([]ModelRule{{MatchModel: "m", Merge: map[string]map[string]any{target: {"k": 1}}}})
+		if (err == nil) != ok {
+			t.Errorf("merge target %q: err = %v", target, err)
+		}
+	}
+}
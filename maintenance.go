@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultMaintenanceRetryAfter = 60 // seconds
+
+// maintenanceMode turns new API requests away with 503 while requests already
+// in flight, including long streams, run to completion. It is switched
+// through the admin API and not persisted across restarts.
+type maintenanceMode struct {
+	mu         sync.RWMutex
+	enabled    bool
+	since      time.Time
+	retryAfter int
+	message    string
+}
+
+var maintenance = &maintenanceMode{}
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Since      string `json:"since,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Message    string `json:"message,omitempty"`
+	InFlight   int64  `json:"in_flight_requests"`
+}
+
+func (m *maintenanceMode) set(enabled bool, retryAfter int, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enabled && !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled = enabled
+	m.retryAfter = retryAfter
+	m.message = message
+}
+
+func (m *maintenanceMode) state() maintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.enabled {
+		return maintenanceState{}
+	}
+	return maintenanceState{
+		Enabled:    true,
+		Since:      m.since.UTC().Format(time.RFC3339),
+		RetryAfter: m.retryAfter,
+		Message:    m.message,
+	}
+}
+
+// guard rejects requests with 503 and Retry-After while maintenance is on.
+func (m *maintenanceMode) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := m.state()
+		if !st.Enabled {
+			next(w, r)
+			return
+		}
+		msg := st.Message
+		if msg == "" {
+			msg = "the relay is under maintenance, please retry later"
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(st.RetryAfter))
+		writeJSONError(w, http.StatusServiceUnavailable, msg, "service_unavailable", "maintenance")
+	}
+}
+
+// handleMaintenance serves /admin/maintenance:
+//
+//	GET    /admin/maintenance  current state and requests still in flight
+//	PUT    /admin/maintenance  {"enabled": true, "retry_after": 120, "message": "..."}
+//	DELETE /admin/maintenance  leave maintenance mode
+func handleMaintenance(health *healthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Enabled    *bool  `json:"enabled"`
+				RetryAfter int    `json:"retry_after"`
+				Message    string `json:"message"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil || body.RetryAfter < 0 {
+				writeJSONError(w, http.StatusBadRequest, `body must be {"enabled": true|false, "retry_after": seconds, "message": "..."}`, "invalid_request_error", "invalid_parameter")
+				return
+			}
+			if body.RetryAfter == 0 {
+				body.RetryAfter = defaultMaintenanceRetryAfter
+			}
+			maintenance.set(*body.Enabled, body.RetryAfter, body.Message)
+			vlog("MAINTENANCE: enabled=%v retry_after=%d", *body.Enabled, body.RetryAfter)
+		case http.MethodDelete:
+			maintenance.set(false, 0, "")
+			vlog("MAINTENANCE: disabled")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st := maintenance.state()
+		st.InFlight = health.inFlight.Load()
+		writeJSON(w, http.StatusOK, st)
+	}
+}
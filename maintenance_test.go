@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+	defer maintenance.set(false, 0, "")
+
+	cfg := &Config{Upstream: upstream.URL, Admin: &AdminConfig{Token: "admin-secret"}}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if strings.HasPrefix(path, "/admin/") {
+			r.Header.Set("Authorization", "Bearer admin-secret")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "/v1/chat/completions", `{"model":"m"}`); w.Code != http.StatusOK {
+		t.Fatalf("status before maintenance = %d", w.Code)
+	}
+	if w := do("PUT", "/admin/maintenance", `{"enabled":true,"retry_after":120,"message":"upgrading"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Fatalf("enable maintenance: %d %s", w.Code, w.Body.String())
+	}
+
+	w := do("POST", "/v1/chat/completions", `{"model":"m"}`)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "120" || !strings.Contains(w.Body.String(), "upgrading") {
+		t.Errorf("during maintenance: %d Retry-After=%q %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	if w := do("GET", "/health", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/health during maintenance = %d, want 503", w.Code)
+	}
+	if w := do("PUT", "/admin/maintenance", `{"retry_after":5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("missing enabled: status = %d, want 400", w.Code)
+	}
+
+	if w := do("DELETE", "/admin/maintenance", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":false`) {
+		t.Fatalf("disable maintenance: %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/chat/completions", `{"model":"m"}`); w.Code != http.StatusOK {
+		t.Errorf("status after maintenance = %d", w.Code)
+	}
+}
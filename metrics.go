@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a minimal Prometheus text-format registry, kept in-house
+// so the relay stays free of external dependencies.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []metricCollector
+}
+
+type metricCollector interface {
+	writeTo(w io.Writer, prefix string)
+	series(fn func(name string, labels, values []string, v float64))
+}
+
+var metrics = &metricsRegistry{}
+
+var (
+	requestsTotal = metrics.newCounterVec("relay_requests_total",
+		"Completion requests by tenant, model and response status.", "tenant", "model", "status")
+	tokensTotal = metrics.newCounterVec("relay_tokens_total",
+		"Tokens reported by upstream usage, by tenant, model and type (prompt/completion).", "tenant", "model", "type")
+	estimatedUsageTotal = metrics.newCounterVec("relay_estimated_usage_total",
+		"Streams whose usage the upstream did not report and the relay estimated with the model's tokenizer.", "tenant", "model")
+	streamErrorsTotal = metrics.newCounterVec("relay_stream_errors_total",
+		"Streams that ended with an upstream error after the response had started.", "tenant", "model")
+
+	requestBytes = metrics.newHistogramVec("relay_request_bytes",
+		"Size of completion request bodies, by tenant and model.", sizeBuckets, "tenant", "model")
+	responseBytes = metrics.newHistogramVec("relay_response_bytes",
+		"Size of completion response bodies sent to clients, by tenant and model.", sizeBuckets, "tenant", "model")
+	requestMessages = metrics.newHistogramVec("relay_request_messages",
+		"Messages per chat completion request, by tenant and model.", messageBuckets, "tenant", "model")
+	promptTokens = metrics.newHistogramVec("relay_prompt_tokens",
+		"Prompt tokens per request as reported by upstream usage, by tenant and model.", tokenBuckets, "tenant", "model")
+	completionTokens = metrics.newHistogramVec("relay_completion_tokens",
+		"Completion tokens per request as reported by upstream usage, by tenant and model.", tokenBuckets, "tenant", "model")
+)
+
+// Histogram buckets for the workload shape metrics.
+var (
+	sizeBuckets    = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+	tokenBuckets   = []float64{16, 64, 256, 1024, 4096, 16384, 65536, 262144}
+	messageBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128}
+)
+
+func (m *metricsRegistry) register(c metricCollector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// ServeHTTP writes all registered metrics in Prometheus text format.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+func (m *metricsRegistry) writeTo(w io.Writer) {
+	m.writePrefixed(w, "")
+}
+
+// writePrefixed writes the exposition with prefix prepended to every name.
+func (m *metricsRegistry) writePrefixed(w io.Writer, prefix string) {
+	for _, c := range m.snapshot() {
+		c.writeTo(w, prefix)
+	}
+}
+
+// series calls fn for every series of every registered metric.
+func (m *metricsRegistry) series(fn func(name string, labels, values []string, v float64)) {
+	for _, c := range m.snapshot() {
+		c.series(fn)
+	}
+}
+
+func (m *metricsRegistry) snapshot() []metricCollector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]metricCollector(nil), m.collectors...)
+}
+
+// counterVec is a monotonically increasing counter partitioned by labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by joined label values
+}
+
+func (m *metricsRegistry) newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	m.register(c)
+	return c
+}
+
+// Inc adds one to the series identified by labelValues.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series identified by labelValues.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value of a series, mainly for tests.
+func (c *counterVec) Value(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// each calls fn for every series with its label values.
+func (c *counterVec) each(fn func(labelValues []string, v float64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.values {
+		fn(strings.Split(k, "\xff"), v)
+	}
+}
+
+func (c *counterVec) series(fn func(name string, labels, values []string, v float64)) {
+	c.each(func(values []string, v float64) {
+		fn(c.name, c.labels, values, v)
+	})
+}
+
+func (c *counterVec) writeTo(w io.Writer, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := prefix + c.name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(c.labels, k), c.values[k])
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	parts := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%q", name, v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// histogramVec is a Prometheus histogram partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, ascending; +Inf is implied
+
+	mu     sync.Mutex
+	values map[string]*histogram // keyed by joined label values
+}
+
+type histogram struct {
+	counts []float64 // observations per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  float64
+}
+
+func (m *metricsRegistry) newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	m.register(h)
+	return h
+}
+
+// Observe records v in the series identified by labelValues.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v) // first bound >= v
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.values[key]
+	if s == nil {
+		s = &histogram{counts: make([]float64, len(h.buckets)+1)}
+		h.values[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// Count returns the number of observations of a series, mainly for tests.
+func (h *histogramVec) Count(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.values[key]; s != nil {
+		return s.count
+	}
+	return 0
+}
+
+// each calls fn for every series as its _bucket, _sum and _count samples.
+// Caller must hold h.mu.
+func (h *histogramVec) each(keys []string, fn func(name string, labels, values []string, v float64)) {
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		s := h.values[k]
+		values := strings.Split(k, "\xff")
+		if len(h.labels) == 0 {
+			values = nil
+		}
+		cumulative := 0.0
+		for i, n := range s.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			fn(h.name+"_bucket", bucketLabels, append(append([]string(nil), values...), le), cumulative)
+		}
+		fn(h.name+"_sum", h.labels, values, s.sum)
+		fn(h.name+"_count", h.labels, values, s.count)
+	}
+}
+
+func (h *histogramVec) series(fn func(name string, labels, values []string, v float64)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	h.each(keys, fn)
+}
+
+func (h *histogramVec) writeTo(w io.Writer, prefix string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name := prefix + h.name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.each(keys, func(sample string, labels, values []string, v float64) {
+		fmt.Fprintf(w, "%s%s %g\n", prefix+sample, formatLabels(labels, strings.Join(values, "\xff")), v)
+	})
+}
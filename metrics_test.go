@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVecExposition(t *testing.T) {
+	reg := &metricsRegistry{}
+	c := reg.newCounterVec("test_requests_total", "Test requests.", "model", "status")
+	c.Inc("b", "200")
+	c.Inc("a", "500")
+	c.Add(2, "a", "500")
+
+	if got := c.Value("a", "500"); got != 3 {
+		t.Errorf("Value() = %v, want 3", got)
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_requests_total Test requests.
+# TYPE test_requests_total counter
+test_requests_total{model="a",status="500"} 3
+test_requests_total{model="b",status="200"} 1
+`
+	if w.Body.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", w.Body.String(), want)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestCounterVecWithoutLabels(t *testing.T) {
+	reg := &metricsRegistry{}
+	c := reg.newCounterVec("test_total", "Test.")
+	c.Inc()
+
+	var b strings.Builder
+	reg.writeTo(&b)
+	if !strings.Contains(b.String(), "test_total 1\n") {
+		t.Errorf("unexpected exposition: %s", b.String())
+	}
+}
+
+func TestHistogramVecExposition(t *testing.T) {
+	reg := &metricsRegistry{}
+	h := reg.newHistogramVec("test_size", "Test sizes.", []float64{10, 100}, "model")
+	h.Observe(5, "a")
+	h.Observe(10, "a")
+	h.Observe(50, "a")
+	h.Observe(500, "a")
+	h.Observe(1, "b")
+
+	if got := h.Count("a"); got != 4 {
+		t.Errorf("Count() = %v, want 4", got)
+	}
+
+	var b strings.Builder
+	reg.writeTo(&b)
+	want := `# HELP test_size Test sizes.
+# TYPE test_size histogram
+test_size_bucket{model="a",le="10"} 2
+test_size_bucket{model="a",le="100"} 3
+test_size_bucket{model="a",le="+Inf"} 4
+test_size_sum{model="a"} 565
+test_size_count{model="a"} 4
+test_size_bucket{model="b",le="10"} 1
+test_size_bucket{model="b",le="100"} 1
+test_size_bucket{model="b",le="+Inf"} 1
+test_size_sum{model="b"} 1
+test_size_count{model="b"} 1
+`
+	if b.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	// pushers see the same samples
+	var samples int
+	reg.series(func(name string, labels, values []string, v float64) {
+		samples++
+		if len(labels) != len(values) {
+			t.Errorf("%s: labels %v do not match values %v", name, labels, values)
+		}
+	})
+	if samples != 10 {
+		t.Errorf("series() gave %d samples, want 10", samples)
+	}
+}
+
+func TestWorkloadHistograms(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"usage": map[string]any{"prompt_tokens": 300, "completion_tokens": 20}})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL, ModelRules: []ModelRule{{MatchModel: "shape-*"}}})
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	body := `{"model":"shape-m","messages":[{"role":"system","content":"s"},{"role":"user","content":"u"},{"role":"user","content":"v"}]}`
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+	for _, h := range []*histogramVec{requestBytes, responseBytes, requestMessages, promptTokens, completionTokens} {
+		if got := h.Count("default", "shape-*"); got != 1 {
+			t.Errorf("%s count = %v, want 1", h.name, got)
+		}
+	}
+	var b strings.Builder
+	metrics.writeTo(&b)
+	for _, want := range []string{
+		`relay_request_messages_bucket{tenant="default",model="shape-*",le="2"} 0`,
+		`relay_request_messages_bucket{tenant="default",model="shape-*",le="4"} 1`,
+		`relay_prompt_tokens_sum{tenant="default",model="shape-*"} 300`,
+		fmt.Sprintf(`relay_request_bytes_sum{tenant="default",model="shape-*"} %d`, len(body)),
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	// models no rule matches share one series
+	before := requestsTotal.Value("default", unmatchedModel, "200")
+	for _, model := range []string{"typo-1", "typo-2"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`"}`)))
+	}
+	if got := requestsTotal.Value("default", unmatchedModel, "200") - before; got != 2 {
+		t.Errorf("%v requests counted as %s, want 2", got, unmatchedModel)
+	}
+}
+
+func TestFeatureMetricsUseRuleLabel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"choices": []any{}})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL, ModelRules: []ModelRule{
+		{MatchModel: "label-*", Cache: &ResponseCacheConfig{TTL: "1h"}, SLO: &SLOConfig{Availability: 0.99}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client-chosen names matched by one rule share its series
+	for _, model := range []string{"label-a", "label-b"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`)))
+	}
+	if got := responseCacheTotal.Value("default", "label-*", "miss"); got != 2 {
+		t.Errorf("%v cache misses under the rule", got)
+	}
+	if got := sloEventsTotal.Value("label-*", "availability", "good"); got != 2 {
+		t.Errorf("%v SLO events under the rule", got)
+	}
+	if responseCacheTotal.Value("default", "label-a", "miss") != 0 || sloEventsTotal.Value("label-a", "availability", "good") != 0 {
+		t.Error("series labelled with the client's model name")
+	}
+}
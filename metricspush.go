@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsPushConfig sends the /metrics series to a StatsD daemon or a
+// Prometheus Pushgateway for deployments that cannot be scraped.
+type MetricsPushConfig struct {
+	Type     string `json:"type"`     // "statsd" or "pushgateway"
+	Address  string `json:"address"`  // statsd: host:port (UDP); pushgateway: base URL
+	Interval string `json:"interval"` // push interval, default "10s"
+	Prefix   string `json:"prefix"`   // prepended to every metric name
+	Job      string `json:"job"`      // pushgateway job label, default "llm-api-relay"
+	Instance string `json:"instance"` // pushgateway instance label, default the hostname
+}
+
+// metricSink delivers one snapshot of the registry.
+type metricSink interface {
+	push(ctx context.Context, reg *metricsRegistry) error
+}
+
+// metricsPusher pushes the registry to its sink on an interval.
+type metricsPusher struct {
+	name     string
+	sink     metricSink
+	reg      *metricsRegistry
+	interval time.Duration
+}
+
+func newMetricsPusher(cfg MetricsPushConfig, reg *metricsRegistry) (*metricsPusher, error) {
+	interval := 10 * time.Second
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", cfg.Interval)
+		}
+		interval = d
+	}
+
+	var sink metricSink
+	switch cfg.Type {
+	case "statsd":
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, fmt.Errorf("invalid statsd address %q", cfg.Address)
+		}
+		sink = &statsdSink{addr: cfg.Address, prefix: cfg.Prefix, last: map[string]float64{}}
+	case "pushgateway":
+		u, err := url.Parse(cfg.Address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid pushgateway address %q", cfg.Address)
+		}
+		if cfg.Job == "" {
+			cfg.Job = "llm-api-relay"
+		}
+		if cfg.Instance == "" {
+			cfg.Instance, _ = os.Hostname()
+		}
+		u = u.JoinPath("metrics", "job", cfg.Job)
+		if cfg.Instance != "" {
+			u = u.JoinPath("instance", cfg.Instance)
+		}
+		sink = &pushgatewaySink{endpoint: u, prefix: cfg.Prefix, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return nil, fmt.Errorf("unknown metrics_push type %q", cfg.Type)
+	}
+	return &metricsPusher{name: cfg.Type, sink: sink, reg: reg, interval: interval}, nil
+}
+
+// run pushes until ctx is done, with a final push on the way out.
+func (p *metricsPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := p.sink.push(final, p.reg); err != nil {
+				logf(slog.LevelWarn, "METRICS: final %s push failed: %v", p.name, err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if err := p.sink.push(ctx, p.reg); err != nil {
+			logf(slog.LevelWarn, "METRICS: %s push failed: %v", p.name, err)
+		}
+	}
+}
+
+// statsdMaxPacket keeps datagrams under a typical network MTU.
+const statsdMaxPacket = 1432
+
+// statsdSink sends counter increments since the previous push. Label values
+// become dot-separated name segments since plain StatsD has no tags.
+type statsdSink struct {
+	addr   string
+	prefix string
+	last   map[string]float64 // value at the previous successful push
+}
+
+func (s *statsdSink) push(ctx context.Context, reg *metricsRegistry) error {
+	current := map[string]float64{}
+	var lines []string
+	reg.series(func(name string, _, values []string, v float64) {
+		parts := []string{s.prefix + name}
+		for _, lv := range values {
+			parts = append(parts, statsdSegment(lv))
+		}
+		key := strings.Join(parts, ".")
+		current[key] = v
+		if delta := v - s.last[key]; delta > 0 {
+			lines = append(lines, key+":"+strconv.FormatFloat(delta, 'f', -1, 64)+"|c")
+		}
+	})
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	s.last = current
+	return nil
+}
+
+// statsdSegment replaces the characters StatsD treats as separators.
+func statsdSegment(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', '\n', ' ', '/':
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// pushgatewaySink replaces the relay's metric group with the current
+// exposition on every push.
+type pushgatewaySink struct {
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+}
+
+func (s *pushgatewaySink) push(ctx context.Context, reg *metricsRegistry) error {
+	var body bytes.Buffer
+	reg.writePrefixed(&body, s.prefix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
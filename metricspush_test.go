@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatsdPushSendsDeltas(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() []string {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read statsd packet: %v", err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+
+	reg := &metricsRegistry{}
+	c := reg.newCounterVec("relay_requests_total", "Requests.", "tenant", "model", "status")
+	c.Add(3, "", "qwen2.5.7b", "200")
+	c.Inc("team-a", "gpt", "500")
+
+	p, err := newMetricsPusher(MetricsPushConfig{Type: "statsd", Address: conn.LocalAddr().String(), Prefix: "llm."}, reg)
+	if err != nil {
+		t.Fatalf("newMetricsPusher() failed: %v", err)
+	}
+	ctx := context.Background()
+	if err := p.sink.push(ctx, reg); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	want := []string{
+		"llm.relay_requests_total.none.qwen2_5_7b.200:3|c",
+		"llm.relay_requests_total.team-a.gpt.500:1|c",
+	}
+	if got := read(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("first push = %q, want %q", got, want)
+	}
+
+	// only the increment since the last push is sent
+	c.Add(2, "", "qwen2.5.7b", "200")
+	if err := p.sink.push(ctx, reg); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if got := read(); len(got) != 1 || got[0] != "llm.relay_requests_total.none.qwen2_5_7b.200:2|c" {
+		t.Errorf("second push = %q", got)
+	}
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+	}))
+	defer gateway.Close()
+
+	reg := &metricsRegistry{}
+	reg.newCounterVec("relay_requests_total", "Requests.", "model").Inc("m")
+
+	p, err := newMetricsPusher(MetricsPushConfig{Type: "pushgateway", Address: gateway.URL, Prefix: "edge_", Instance: "relay-1"}, reg)
+	if err != nil {
+		t.Fatalf("newMetricsPusher() failed: %v", err)
+	}
+	if err := p.sink.push(context.Background(), reg); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/llm-api-relay/instance/relay-1" {
+		t.Errorf("pushed with %s %s", method, path)
+	}
+	if !strings.Contains(body, "# TYPE edge_relay_requests_total counter\n") || !strings.Contains(body, `edge_relay_requests_total{model="m"} 1`) {
+		t.Errorf("unexpected body:\n%s", body)
+	}
+}
+
+func TestMetricsPushFinalPushOnStop(t *testing.T) {
+	var pushes atomic.Int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes.Add(1)
+	}))
+	defer gateway.Close()
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	cfg := &Config{Upstream: upstream.URL, MetricsPush: []MetricsPushConfig{{Type: "pushgateway", Address: gateway.URL, Interval: "1h"}}}
+	if _, err := newRelayMux(cfg); err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	cfg.workers.stop()
+	if got := pushes.Load(); got != 1 {
+		t.Errorf("%d pushes after stop, want the final one", got)
+	}
+}
+
+func TestMetricsPushConfigErrors(t *testing.T) {
+	for _, cfg := range []MetricsPushConfig{
+		{Type: "graphite", Address: "127.0.0.1:2003"},
+		{Type: "statsd", Address: "localhost"},
+		{Type: "pushgateway", Address: "not a url"},
+		{Type: "statsd", Address: "127.0.0.1:8125", Interval: "soon"},
+	} {
+		if _, err := newMetricsPusher(cfg, &metricsRegistry{}); err == nil {
+			t.Errorf("newMetricsPusher(%+v) succeeded, want error", cfg)
+		}
+	}
+}
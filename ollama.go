@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upstreamOllama is the upstream_type of a bare Ollama server, which is
+// spoken to through its native /api/chat and /api/tags endpoints.
+const upstreamOllama = "ollama"
+
+func validateUpstreamType(t string) error {
+	switch t {
+	case "", "openai", upstreamOllama:
+		return nil
+	}
+	return fmt.Errorf("unknown upstream_type %q", t)
+}
+
+// ollamaPath maps an OpenAI endpoint path onto the Ollama one, keeping any
+// prefix in front of /v1.
+func ollamaPath(path, suffix, endpoint string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, suffix), "/v1")
+	return base + endpoint
+}
+
+// ollamaOptions are the sampling fields that move into the request options
+// under another or the same name.
+var ollamaOptions = map[string]string{
+	"temperature":           "temperature",
+	"top_p":                 "top_p",
+	"seed":                  "seed",
+	"frequency_penalty":     "frequency_penalty",
+	"presence_penalty":      "presence_penalty",
+	"max_tokens":            "num_predict",
+	"max_completion_tokens": "num_predict",
+}
+
+// chatToOllamaRequest translates a chat completions request into an Ollama
+// /api/chat request. Ollama fields set by model rules (options, keep_alive,
+// think) are carried over.
+func chatToOllamaRequest(req map[string]any) (map[string]any, error) {
+	messages, err := chatToOllamaMessages(req["messages"])
+	if err != nil {
+		return nil, err
+	}
+	stream, _ := req["stream"].(bool)
+	out := map[string]any{
+		"model":    req["model"],
+		"messages": messages,
+		"stream":   stream, // Ollama streams unless told otherwise
+	}
+	for _, k := range []string{"tools", "keep_alive", "think"} {
+		if v, ok := req[k]; ok {
+			out[k] = v
+		}
+	}
+
+	options := map[string]any{}
+	if o, ok := req["options"].(map[string]any); ok {
+		for k, v := range o {
+			options[k] = v
+		}
+	}
+	for from, to := range ollamaOptions {
+		if v, ok := req[from]; ok && v != nil {
+			options[to] = v
+		}
+	}
+	switch stop := req["stop"].(type) {
+	case string:
+		options["stop"] = []any{stop}
+	case []any:
+		options["stop"] = stop
+	}
+	if len(options) > 0 {
+		out["options"] = options
+	}
+
+	if rf, ok := req["response_format"].(map[string]any); ok {
+		switch getString(rf, "type") {
+		case "json_object":
+			out["format"] = "json"
+		case "json_schema":
+			js, _ := rf["json_schema"].(map[string]any)
+			if schema, ok := js["schema"]; ok {
+				out["format"] = schema
+			} else {
+				out["format"] = "json"
+			}
+		}
+	}
+	return out, nil
+}
+
+// chatToOllamaMessages flattens content parts into text plus base64 images,
+// and turns tool call arguments back into objects.
+func chatToOllamaMessages(v any) ([]any, error) {
+	in, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("messages is required")
+	}
+	toolNames := map[string]string{} // tool_call_id -> function name
+	out := make([]any, 0, len(in))
+	for _, m := range in {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			return nil, errors.New("messages must be objects")
+		}
+		role := getString(msg, "role")
+		if role == "developer" {
+			role = "system"
+		}
+		om := map[string]any{"role": role}
+
+		switch content := msg["content"].(type) {
+		case string:
+			om["content"] = content
+		case []any:
+			var text []string
+			var images []any
+			for _, p := range content {
+				part, _ := p.(map[string]any)
+				switch getString(part, "type") {
+				case "text":
+					text = append(text, getString(part, "text"))
+				case "image_url":
+					img, _ := part["image_url"].(map[string]any)
+					data, ok := ollamaImage(getString(img, "url"))
+					if !ok {
+						return nil, errors.New("the ollama upstream takes images only as base64 data URLs")
+					}
+					images = append(images, data)
+				}
+			}
+			om["content"] = strings.Join(text, "\n")
+			if len(images) > 0 {
+				om["images"] = images
+			}
+		default:
+			om["content"] = ""
+		}
+
+		if thinking := getString(msg, "reasoning_content"); thinking != "" {
+			om["thinking"] = thinking
+		}
+		if calls, ok := msg["tool_calls"].([]any); ok {
+			var ocalls []any
+			for _, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				name := getString(fn, "name")
+				toolNames[getString(call, "id")] = name
+				args := map[string]any{}
+				if s := getString(fn, "arguments"); s != "" {
+					if err := json.Unmarshal([]byte(s), &args); err != nil {
+						return nil, fmt.Errorf("tool call %q: arguments are not a JSON object", name)
+					}
+				}
+				ocalls = append(ocalls, map[string]any{"function": map[string]any{"name": name, "arguments": args}})
+			}
+			om["tool_calls"] = ocalls
+		}
+		if role == "tool" {
+			if name, ok := toolNames[getString(msg, "tool_call_id")]; ok {
+				om["tool_name"] = name
+			}
+		}
+		out = append(out, om)
+	}
+	return out, nil
+}
+
+// ollamaImage extracts the base64 payload of a data URL.
+func ollamaImage(u string) (string, bool) {
+	rest, ok := strings.CutPrefix(u, "data:")
+	if !ok {
+		return "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return "", false
+	}
+	return data, true
+}
+
+// ollamaChatResponse is a non-streaming /api/chat response or one line of a
+// streaming one.
+type ollamaChatResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Message   struct {
+		Content   string `json:"content"`
+		Thinking  string `json:"thinking"`
+		ToolCalls []struct {
+			Function struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+func (o *ollamaChatResponse) created() int64 {
+	t, err := time.Parse(time.RFC3339Nano, o.CreatedAt)
+	if err != nil {
+		return time.Now().Unix()
+	}
+	return t.Unix()
+}
+
+func (o *ollamaChatResponse) usage() map[string]any {
+	return map[string]any{
+		"prompt_tokens":     o.PromptEvalCount,
+		"completion_tokens": o.EvalCount,
+		"total_tokens":      o.PromptEvalCount + o.EvalCount,
+	}
+}
+
+// toolCalls converts the message's tool calls, numbering them from first.
+func (o *ollamaChatResponse) toolCalls(first int, withIndex bool) []any {
+	var calls []any
+	for i, tc := range o.Message.ToolCalls {
+		args := string(tc.Function.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		call := map[string]any{
+			"id":       fmt.Sprintf("call_%d", first+i),
+			"type":     "function",
+			"function": map[string]any{"name": tc.Function.Name, "arguments": args},
+		}
+		if withIndex {
+			call["index"] = first + i
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// finishReason maps done_reason, reporting tool_calls when any were made.
+func (o *ollamaChatResponse) finishReason(madeCalls bool) string {
+	switch {
+	case madeCalls:
+		return "tool_calls"
+	case o.DoneReason == "length":
+		return "length"
+	}
+	return "stop"
+}
+
+// sendOllamaChat sends a chat completions body to the Ollama /api/chat
+// endpoint at path and returns the answer as the chat completions API would
+// give it, so retries, fan-out and the stream pipeline work unchanged.
+func sendOllamaChat(r *http.Request, upstream *upstreamClient, path *url.URL, rule *ModelRule, forwardAuth bool, body []byte) (*http.Response, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	req, err := chatToOllamaRequest(payload)
+	if err != nil {
+		return ollamaRequestError(err), nil
+	}
+	if _, ok := req["keep_alive"]; !ok && rule != nil && rule.KeepWarm != "" {
+		req["keep_alive"] = ollamaKeepAlive(rule)
+	}
+	converted, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the relay reads the answer, so it must not come back compressed
+	or := r.Clone(r.Context())
+	or.Header.Del("Accept-Encoding")
+	resp, err := sendJSONUpstream(or, upstream, path, rule, forwardAuth, converted)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Header.Del("Content-Length")
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Body = io.NopCloser(bytes.NewReader(ollamaErrorBody(resp.StatusCode, raw)))
+		return resp, nil
+	}
+
+	id := "chatcmpl-" + randomHex(12)
+	if stream, _ := req["stream"].(bool); stream {
+		opts, _ := payload["stream_options"].(map[string]any)
+		includeUsage, _ := opts["include_usage"].(bool)
+		resp.Header.Set("Content-Type", "text/event-stream")
+		resp.Body = newOllamaStream(resp.Body, id, includeUsage)
+		return resp, nil
+	}
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var o ollamaChatResponse
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return nil, fmt.Errorf("decode ollama response: %w", err)
+	}
+	calls := o.toolCalls(0, false)
+	msg := map[string]any{"role": "assistant", "content": o.Message.Content}
+	if o.Message.Thinking != "" {
+		msg["reasoning_content"] = o.Message.Thinking
+	}
+	if len(calls) > 0 {
+		msg["tool_calls"] = calls
+	}
+	out, _ := json.Marshal(map[string]any{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": o.created(),
+		"model":   o.Model,
+		"choices": []any{map[string]any{"index": 0, "message": msg, "finish_reason": o.finishReason(len(calls) > 0)}},
+		"usage":   o.usage(),
+	})
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	return resp, nil
+}
+
+// ollamaErrorBody rewrites Ollama's {"error": "..."} into the OpenAI error
+// shape.
+func ollamaErrorBody(status int, raw []byte) []byte {
+	var e struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &e) == nil && e.Error != "" {
+		msg = e.Error
+	}
+	typ, code := "upstream_error", "ollama_error"
+	switch {
+	case status == http.StatusNotFound:
+		typ, code = "invalid_request_error", "model_not_found"
+	case status < 500:
+		typ, code = "invalid_request_error", "invalid_request"
+	}
+	b, _ := json.Marshal(map[string]any{"error": map[string]any{"message": msg, "type": typ, "code": code}})
+	return b
+}
+
+// ollamaRequestError answers a request that cannot be translated with 400.
+func ollamaRequestError(err error) *http.Response {
+	b, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"message": err.Error(), "type": "invalid_request_error", "code": "invalid_request",
+	}})
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(b)),
+	}
+}
+
+// ollamaStream turns Ollama's NDJSON stream into chat.completion.chunk
+// events.
+type ollamaStream struct {
+	id           string
+	includeUsage bool
+	started      bool
+	calls        int // tool calls emitted so far
+}
+
+// newOllamaStream converts src as it is read. The returned reader must be
+// closed so the converting goroutine can exit.
+func newOllamaStream(src io.ReadCloser, id string, includeUsage bool) io.ReadCloser {
+	s := &ollamaStream{id: id, includeUsage: includeUsage}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		reader := bufio.NewReader(src)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				events, done := s.convert(line)
+				for _, ev := range events {
+					if _, werr := io.WriteString(pw, ev+"\n\n"); werr != nil {
+						return
+					}
+				}
+				if done {
+					pw.Close()
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF // no done line
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// convert translates one NDJSON line into SSE events and reports whether
+// the stream is over.
+func (s *ollamaStream) convert(line []byte) ([]string, bool) {
+	var o ollamaChatResponse
+	if err := json.Unmarshal(line, &o); err != nil {
+		return nil, false
+	}
+	if o.Error != "" {
+		b, _ := json.Marshal(map[string]any{"error": map[string]any{
+			"message": o.Error, "type": "upstream_error", "code": "ollama_error",
+		}})
+		return []string{"data: " + string(b)}, true
+	}
+
+	chunk := func(choices []any) string {
+		b, _ := json.Marshal(map[string]any{
+			"id": s.id, "object": "chat.completion.chunk", "created": o.created(), "model": o.Model,
+			"choices": choices,
+		})
+		return "data: " + string(b)
+	}
+	delta := map[string]any{}
+	if !s.started {
+		delta["role"] = "assistant"
+		s.started = true
+	}
+	if o.Message.Content != "" {
+		delta["content"] = o.Message.Content
+	}
+	if o.Message.Thinking != "" {
+		delta["reasoning_content"] = o.Message.Thinking
+	}
+	if calls := o.toolCalls(s.calls, true); len(calls) > 0 {
+		delta["tool_calls"] = calls
+		s.calls += len(calls)
+	}
+
+	var events []string
+	choice := map[string]any{"index": 0, "delta": delta, "finish_reason": nil}
+	if !o.Done {
+		if len(delta) > 0 {
+			events = append(events, chunk([]any{choice}))
+		}
+		return events, false
+	}
+	choice["finish_reason"] = o.finishReason(s.calls > 0)
+	events = append(events, chunk([]any{choice}))
+	if s.includeUsage {
+		b, _ := json.Marshal(map[string]any{
+			"id": s.id, "object": "chat.completion.chunk", "created": o.created(), "model": o.Model,
+			"choices": []any{}, "usage": o.usage(),
+		})
+		events = append(events, "data: "+string(b))
+	}
+	return append(events, "data: [DONE]"), true
+}
+
+// sendOllamaEmbed sends an embeddings body to the Ollama /api/embed
+// endpoint at path and returns the answer in the OpenAI shape.
+func sendOllamaEmbed(r *http.Request, upstream *upstreamClient, path *url.URL, rule *ModelRule, forwardAuth bool, body []byte) (*http.Response, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	req := map[string]any{"model": payload["model"], "input": payload["input"]}
+	switch input := payload["input"].(type) {
+	case string:
+	case []any:
+		for _, in := range input {
+			if _, ok := in.(string); !ok {
+				return ollamaRequestError(errors.New("the ollama upstream takes embeddings input as text only")), nil
+			}
+		}
+	default:
+		return ollamaRequestError(errors.New("input is required")), nil
+	}
+	for _, k := range []string{"dimensions", "truncate", "options", "keep_alive"} {
+		if v, ok := payload[k]; ok {
+			req[k] = v
+		}
+	}
+	if _, ok := req["keep_alive"]; !ok && rule != nil && rule.KeepWarm != "" {
+		req["keep_alive"] = ollamaKeepAlive(rule)
+	}
+	converted, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	or := r.Clone(r.Context())
+	or.Header.Del("Accept-Encoding")
+	resp, err := sendJSONUpstream(or, upstream, path, rule, forwardAuth, converted)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "application/json")
+	if resp.StatusCode != http.StatusOK {
+		resp.Body = io.NopCloser(bytes.NewReader(ollamaErrorBody(resp.StatusCode, raw)))
+		return resp, nil
+	}
+	var o struct {
+		Model           string      `json:"model"`
+		Embeddings      [][]float64 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return nil, fmt.Errorf("decode ollama response: %w", err)
+	}
+	base64 := getString(payload, "encoding_format") == "base64"
+	data := make([]any, len(o.Embeddings))
+	for i, e := range o.Embeddings {
+		var embedding any = e
+		if base64 {
+			embedding = embeddingBase64(e)
+		}
+		data[i] = map[string]any{"object": "embedding", "index": i, "embedding": embedding}
+	}
+	out, _ := json.Marshal(map[string]any{
+		"object": "list",
+		"data":   data,
+		"model":  o.Model,
+		"usage":  map[string]any{"prompt_tokens": o.PromptEvalCount, "total_tokens": o.PromptEvalCount},
+	})
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	return resp, nil
+}
+
+// embeddingBase64 encodes an embedding the way encoding_format "base64"
+// asks for: little-endian float32s.
+func embeddingBase64(e []float64) string {
+	b := make([]byte, 4*len(e))
+	for i, v := range e {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// ollamaModels serves /v1/models from the Ollama /api/tags list.
+func ollamaModels(w http.ResponseWriter, r *http.Request, upstream *upstreamClient, forwardAuth bool) {
+	path := *r.URL
+	path.Path = ollamaPath(r.URL.Path, "/models", "/api/tags")
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.target(&path).String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	copyHeaders(req.Header, r.Header)
+	upstream.normalizeClientHeaders(req)
+	req.Header.Del("Accept-Encoding")
+	req.Host = upstream.host()
+	upstream.authorize(req, nil, forwardAuth)
+
+	resp, err := upstream.do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write(ollamaErrorBody(resp.StatusCode, raw))
+		return
+	}
+	var tags struct {
+		Models []struct {
+			Name       string `json:"name"`
+			ModifiedAt string `json:"modified_at"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(raw, &tags); err != nil {
+		http.Error(w, fmt.Sprintf("decode ollama model list: %v", err), http.StatusBadGateway)
+		return
+	}
+	data := []any{}
+	for _, m := range tags.Models {
+		o := ollamaChatResponse{CreatedAt: m.ModifiedAt}
+		data = append(data, map[string]any{"id": m.Name, "object": "model", "created": o.created(), "owned_by": "ollama"})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+}
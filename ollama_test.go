@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOllamaUpstream(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		switch r.URL.Path {
+		case "/api/tags":
+			fmt.Fprint(w, `{"models":[{"name":"qwen3:8b","modified_at":"2025-05-01T10:00:00Z"}]}`)
+			return
+		case "/api/chat":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		gotBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		switch model := getString(gotBody, "model"); {
+		case model == "missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"model \"missing\" not found, try pulling it first"}`)
+		case gotBody["stream"] == true:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			for _, line := range []string{
+				`{"model":"` + model + `","created_at":"2025-05-01T10:00:00Z","message":{"role":"assistant","content":"","thinking":"Hmm."},"done":false}`,
+				`{"model":"` + model + `","created_at":"2025-05-01T10:00:00Z","message":{"role":"assistant","content":"Let me check.<tool_call>get_weather<arg_key>city</arg_key>"},"done":false}`,
+				`{"model":"` + model + `","created_at":"2025-05-01T10:00:00Z","message":{"role":"assistant","content":"<arg_value>Paris</arg_value></tool_call>"},"done":false}`,
+				`{"model":"` + model + `","created_at":"2025-05-01T10:00:01Z","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":12,"eval_count":9}`,
+			} {
+				fmt.Fprintln(w, line)
+			}
+		default:
+			fmt.Fprint(w, `{"model":"qwen3:8b","created_at":"2025-05-01T10:00:00Z","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}}]},"done":true,"done_reason":"stop","prompt_eval_count":12,"eval_count":5}`)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		UpstreamType: upstreamOllama,
+		ModelRules: []ModelRule{
+			{MatchModel: "qwen3:8b", Set: map[string]any{"options": map[string]any{"num_ctx": 8192}}},
+			{MatchModel: "glm4", EnableToolCallFix: true},
+		},
+	}
+	patcher := func(req map[string]any) error {
+		applyRules(cfg, req)
+		return nil
+	}
+	send := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, patcher)
+		return w
+	}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		w := send("/v1/chat/completions", `{"model":"qwen3:8b","max_tokens":64,"stop":"END","response_format":{"type":"json_object"},
+			"messages":[
+				{"role":"developer","content":"Be brief."},
+				{"role":"user","content":[{"type":"text","text":"Weather here?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBOR"}}]},
+				{"role":"assistant","content":null,"tool_calls":[{"id":"call_7","type":"function","function":{"name":"locate","arguments":"{\"precise\":true}"}}]},
+				{"role":"tool","tool_call_id":"call_7","content":"Paris"}
+			],
+			"tools":[{"type":"function","function":{"name":"get_weather"}}]}`)
+		if gotPath != "/api/chat" || w.Code != http.StatusOK {
+			t.Fatalf("path %s, status %d: %s", gotPath, w.Code, w.Body)
+		}
+		want := `{"format":"json","messages":[{"content":"Be brief.","role":"system"},{"content":"Weather here?","images":["iVBOR"],"role":"user"},{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":{"precise":true},"name":"locate"}}]},{"content":"Paris","role":"tool","tool_name":"locate"}],"model":"qwen3:8b","options":{"num_ctx":8192,"num_predict":64,"stop":["END"]},"stream":false,"tools":[{"function":{"name":"get_weather"},"type":"function"}]}`
+		if b, _ := json.Marshal(gotBody); string(b) != want {
+			t.Errorf("ollama request:\n got %s\nwant %s", b, want)
+		}
+
+		var resp struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Message struct {
+					ToolCalls []struct {
+						ID       string `json:"id"`
+						Function struct{ Name, Arguments string }
+					} `json:"tool_calls"`
+				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage map[string]int `json:"usage"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+			t.Fatalf("response %s: %v", w.Body, err)
+		}
+		c := resp.Choices[0]
+		if resp.Object != "chat.completion" || c.FinishReason != "tool_calls" || len(c.Message.ToolCalls) != 1 ||
+			c.Message.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` || resp.Usage["total_tokens"] != 17 {
+			t.Errorf("response = %s", w.Body)
+		}
+	})
+
+	t.Run("streaming through toolcallfix", func(t *testing.T) {
+		w := send("/v1/chat/completions", `{"model":"glm4","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Weather?"}]}`)
+		out := w.Body.String()
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		for _, s := range []string{`"reasoning_content":"Hmm."`, `"content":"Let me check."`, `"name":"get_weather"`, `"finish_reason":"tool_calls"`, `"total_tokens":21`, "data: [DONE]"} {
+			if !strings.Contains(out, s) {
+				t.Errorf("stream lacks %s:\n%s", s, out)
+			}
+		}
+		if strings.Contains(out, "<tool_call>") {
+			t.Errorf("tool call markup leaked:\n%s", out)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		w := send("/v1/chat/completions", `{"model":"missing","messages":[{"role":"user","content":"Hi"}]}`)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"model_not_found"`) {
+			t.Errorf("missing model: %d %s", w.Code, w.Body)
+		}
+		w = send("/v1/chat/completions", `{"model":"qwen3:8b","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("remote image: %d %s", w.Code, w.Body)
+		}
+		w = send("/v1/completions", `{"model":"qwen3:8b","prompt":"Hi"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("completions: %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("models", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newProxyHandlers(cfg, parseURL(upstream.URL)).models(w, httptest.NewRequest("GET", "/v1/models", nil))
+		if !strings.Contains(w.Body.String(), `"id":"qwen3:8b"`) || !strings.Contains(w.Body.String(), `"owned_by":"ollama"`) {
+			t.Errorf("/v1/models = %d %s", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig exports one OTLP span per completion request following the
+// OpenTelemetry GenAI semantic conventions. Langfuse accepts the same payload
+// on its /api/public/otel/v1/traces endpoint.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`     // OTLP/HTTP traces URL, e.g. http://collector:4318/v1/traces
+	Headers     map[string]string `json:"headers"`      // extra headers, e.g. Authorization for Langfuse
+	ServiceName string            `json:"service_name"` // default "llm-api-relay"
+	Provider    string            `json:"provider"`     // gen_ai.provider.name, default "openai"
+	OmitContent bool              `json:"omit_content"` // drop prompts and completions from spans
+	Interval    string            `json:"interval"`     // flush interval, default "5s"
+}
+
+// maxTraceBodyBytes caps how much of a response is kept to build span content.
+const maxTraceBodyBytes = 4 << 20
+
+// maxQueuedSpans bounds memory while the collector is unreachable.
+const maxQueuedSpans = 10000
+
+// maxToolCallIndex bounds the tool calls kept per choice, so a bogus index
+// in a streamed delta cannot allocate an arbitrarily long slice.
+const maxToolCallIndex = 128
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"` // int64 is a string in OTLP JSON
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpValues `json:"arrayValue,omitempty"`
+}
+
+type otlpValues struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+const spanKindClient = 3
+
+// spanAttrs collects span attributes in insertion order.
+type spanAttrs []otlpAttribute
+
+func (a *spanAttrs) str(key, v string) {
+	if v != "" {
+		*a = append(*a, otlpAttribute{key, otlpValue{StringValue: &v}})
+	}
+}
+
+func (a *spanAttrs) i64(key string, v int64) {
+	s := strconv.FormatInt(v, 10)
+	*a = append(*a, otlpAttribute{key, otlpValue{IntValue: &s}})
+}
+
+// num adds a numeric request parameter; integer keys are emitted as intValue.
+func (a *spanAttrs) num(key string, v any, integer bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return
+	}
+	if integer {
+		if i, err := n.Int64(); err == nil {
+			a.i64(key, i)
+		}
+		return
+	}
+	if f, err := n.Float64(); err == nil {
+		*a = append(*a, otlpAttribute{key, otlpValue{DoubleValue: &f}})
+	}
+}
+
+func (a *spanAttrs) strs(key string, vs []string) {
+	if len(vs) == 0 {
+		return
+	}
+	arr := &otlpValues{}
+	for _, v := range vs {
+		arr.Values = append(arr.Values, otlpValue{StringValue: &v})
+	}
+	*a = append(*a, otlpAttribute{key, otlpValue{ArrayValue: arr}})
+}
+
+func (a *spanAttrs) encoded(key string, v any) {
+	if b, err := json.Marshal(v); err == nil {
+		a.str(key, string(b))
+	}
+}
+
+// tracer buffers finished spans and posts them to an OTLP/HTTP endpoint.
+type tracer struct {
+	cfg           TracingConfig
+	serverAddress string
+	client        *http.Client
+	interval      time.Duration
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newTracer(cfg TracingConfig, upstream *url.URL) (*tracer, error) {
+	if u, err := url.Parse(cfg.Endpoint); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q", cfg.Endpoint)
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "llm-api-relay"
+	}
+	if cfg.Provider == "" {
+		cfg.Provider = "openai"
+	}
+	interval := 5 * time.Second
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid tracing interval %q", cfg.Interval)
+		}
+		interval = d
+	}
+	t := &tracer{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}, interval: interval}
+	if upstream != nil {
+		t.serverAddress = upstream.Hostname()
+	}
+	return t, nil
+}
+
+func (t *tracer) add(span otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, span)
+	if len(t.spans) > maxQueuedSpans {
+		t.spans = append(t.spans[:0:0], t.spans[len(t.spans)-maxQueuedSpans:]...)
+	}
+}
+
+func (t *tracer) queueDepth() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.spans)
+}
+
+// flush posts all queued spans; they are requeued if the collector fails.
+func (t *tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	var resource spanAttrs
+	resource.str("service.name", t.cfg.ServiceName)
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "llm-api-relay"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = t.post(ctx, body)
+	if err != nil {
+		t.mu.Lock()
+		t.spans = append(spans, t.spans...)
+		t.mu.Unlock()
+		return err
+	}
+	vlog("OTEL: exported %d spans", len(spans))
+	return nil
+}
+
+func (t *tracer) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.flush(ctx); err != nil {
+			logf(slog.LevelWarn, "OTEL: export failed: %v", err)
+		}
+	}
+}
+
+// traceParent parses a W3C traceparent header into trace and parent span ids.
+func traceParent(h string) (traceID, spanID string) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// recordTrace wraps a completion handler and emits a GenAI client span per
+// request, followed by the spans of its stages. The client gets the span's
+// traceparent back.
+func recordTrace(t *tracer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqBody, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+		traceID, parentID := traceParent(r.Header.Get(traceparentHeader))
+		if traceID == "" {
+			traceID = randomHex(16)
+		}
+		rt := &requestTrace{traceID: traceID, spanID: randomHex(8)}
+		w.Header().Set(traceparentHeader, rt.traceparent())
+		cw := &captureWriter{ResponseWriter: w, limit: maxTraceBodyBytes}
+		next(cw, r.WithContext(context.WithValue(r.Context(), requestTraceKey{}, rt)))
+		end := time.Now()
+
+		span := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            rt.spanID,
+			ParentSpanID:      parentID,
+			Kind:              spanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		}
+		name, attrs := t.genAIAttributes(r.URL.Path, reqBody, cw.buf.String(), cw.status)
+		attrs.str("relay.tenant", tenantName(r.Context()))
+		span.Name, span.Attributes = name, attrs
+		if cw.status >= 400 {
+			span.Status = otlpStatus{Code: 2, Message: http.StatusText(cw.status)}
+		}
+		t.add(span)
+		rt.mu.Lock()
+		for _, child := range rt.spans {
+			t.add(child)
+		}
+		rt.mu.Unlock()
+	}
+}
+
+// genAIAttributes maps a request/response pair onto gen_ai.* span attributes.
+func (t *tracer) genAIAttributes(path string, reqBody []byte, response string, status int) (string, spanAttrs) {
+	var req map[string]any
+	dec := json.NewDecoder(bytes.NewReader(reqBody))
+	dec.UseNumber()
+	_ = dec.Decode(&req)
+
+	operation := "chat"
+	if strings.HasSuffix(path, "/completions") && !strings.HasSuffix(path, "/chat/completions") {
+		operation = "text_completion"
+	}
+	model, _ := req["model"].(string)
+	stream, _ := req["stream"].(bool)
+
+	var attrs spanAttrs
+	attrs.str("gen_ai.operation.name", operation)
+	attrs.str("gen_ai.provider.name", t.cfg.Provider)
+	attrs.str("gen_ai.request.model", model)
+	attrs.str("server.address", t.serverAddress)
+	for _, p := range []struct {
+		field, key string
+		integer    bool
+	}{
+		{"temperature", "gen_ai.request.temperature", false},
+		{"top_p", "gen_ai.request.top_p", false},
+		{"max_tokens", "gen_ai.request.max_tokens", true},
+		{"max_completion_tokens", "gen_ai.request.max_tokens", true},
+		{"frequency_penalty", "gen_ai.request.frequency_penalty", false},
+		{"presence_penalty", "gen_ai.request.presence_penalty", false},
+		{"seed", "gen_ai.request.seed", true},
+	} {
+		attrs.num(p.key, req[p.field], p.integer)
+	}
+	attrs.i64("http.response.status_code", int64(status))
+	if status >= 400 {
+		attrs.str("error.type", strconv.Itoa(status))
+	}
+
+	out := collectCompletion(response, stream)
+	attrs.str("gen_ai.response.id", out.id)
+	attrs.str("gen_ai.response.model", out.model)
+	attrs.strs("gen_ai.response.finish_reasons", out.finishReasons())
+	if out.usage != nil {
+		attrs.i64("gen_ai.usage.input_tokens", int64(out.usage.PromptTokens))
+		attrs.i64("gen_ai.usage.output_tokens", int64(out.usage.CompletionTokens))
+	}
+	if !t.cfg.OmitContent {
+		attrs.encoded("gen_ai.input.messages", inputMessages(req))
+		attrs.encoded("gen_ai.output.messages", out.outputMessages())
+	}
+
+	name := operation
+	if model != "" {
+		name += " " + model
+	}
+	return name, attrs
+}
+
+// inputMessages converts request messages (or a prompt) to GenAI message parts.
+func inputMessages(req map[string]any) []map[string]any {
+	if prompt, ok := req["prompt"].(string); ok {
+		return []map[string]any{{"role": "user", "parts": []any{textPart(prompt)}}}
+	}
+	msgs, _ := req["messages"].([]any)
+	var out []map[string]any
+	for _, m := range msgs {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		role, _ := msg["role"].(string)
+		var parts []any
+		if role == "tool" {
+			id, _ := msg["tool_call_id"].(string)
+			parts = append(parts, map[string]any{"type": "tool_call_response", "id": id, "response": msg["content"]})
+		} else if text, err := flattenContent(msg["content"]); err == nil && text != "" {
+			parts = append(parts, textPart(text))
+		}
+		calls, _ := msg["tool_calls"].([]any)
+		for _, c := range calls {
+			call, _ := c.(map[string]any)
+			fn, _ := call["function"].(map[string]any)
+			parts = append(parts, map[string]any{"type": "tool_call", "id": call["id"], "name": fn["name"], "arguments": fn["arguments"]})
+		}
+		out = append(out, map[string]any{"role": role, "parts": parts})
+	}
+	return out
+}
+
+func textPart(s string) map[string]any {
+	return map[string]any{"type": "text", "content": s}
+}
+
+// completionOutput accumulates choices from a JSON or SSE completion response.
+type completionOutput struct {
+	id, model string
+	usage     *tokenUsage
+	choices   map[int]*choiceOutput
+}
+
+type choiceOutput struct {
+	text      strings.Builder
+	finish    string
+	toolCalls []*toolCallOutput
+}
+
+type toolCallOutput struct {
+	id, name  string
+	arguments strings.Builder
+}
+
+type completionChoice struct {
+	Index        int     `json:"index"`
+	Text         string  `json:"text"`
+	FinishReason *string `json:"finish_reason"`
+	Message      *struct {
+		Content   any            `json:"content"`
+		ToolCalls []toolCallJSON `json:"tool_calls"`
+	} `json:"message"`
+	Delta *struct {
+		Content   string         `json:"content"`
+		ToolCalls []toolCallJSON `json:"tool_calls"`
+	} `json:"delta"`
+}
+
+type toolCallJSON struct {
+	Index    *int   `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+func collectCompletion(body string, stream bool) *completionOutput {
+	out := &completionOutput{choices: map[int]*choiceOutput{}}
+	if !stream {
+		out.add(body)
+		return out
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: {") {
+			out.add(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return out
+}
+
+func (o *completionOutput) add(raw string) {
+	var resp struct {
+		ID      string             `json:"id"`
+		Model   string             `json:"model"`
+		Usage   *tokenUsage        `json:"usage"`
+		Choices []completionChoice `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+		return
+	}
+	if o.id == "" {
+		o.id = resp.ID
+	}
+	if o.model == "" {
+		o.model = resp.Model
+	}
+	if resp.Usage != nil {
+		o.usage = resp.Usage
+	}
+	for _, c := range resp.Choices {
+		ch := o.choices[c.Index]
+		if ch == nil {
+			ch = &choiceOutput{}
+			o.choices[c.Index] = ch
+		}
+		ch.text.WriteString(c.Text)
+		if c.FinishReason != nil && *c.FinishReason != "" {
+			ch.finish = *c.FinishReason
+		}
+		if c.Message != nil {
+			if s, ok := c.Message.Content.(string); ok {
+				ch.text.WriteString(s)
+			}
+			for _, tc := range c.Message.ToolCalls {
+				call := &toolCallOutput{id: tc.ID, name: tc.Function.Name}
+				call.arguments.WriteString(tc.Function.Arguments)
+				ch.toolCalls = append(ch.toolCalls, call)
+			}
+		}
+		if c.Delta != nil {
+			ch.text.WriteString(c.Delta.Content)
+			for _, tc := range c.Delta.ToolCalls {
+				ch.addToolCallDelta(tc)
+			}
+		}
+	}
+}
+
+// addToolCallDelta merges a streamed tool call fragment by its index.
+// Fragments with an index out of range are dropped.
+func (ch *choiceOutput) addToolCallDelta(tc toolCallJSON) {
+	idx := len(ch.toolCalls)
+	if tc.Index != nil {
+		idx = *tc.Index
+	}
+	if idx < 0 || idx > maxToolCallIndex {
+		return
+	}
+	for len(ch.toolCalls) <= idx {
+		ch.toolCalls = append(ch.toolCalls, &toolCallOutput{})
+	}
+	call := ch.toolCalls[idx]
+	if tc.ID != "" {
+		call.id = tc.ID
+	}
+	if tc.Function.Name != "" {
+		call.name = tc.Function.Name
+	}
+	call.arguments.WriteString(tc.Function.Arguments)
+}
+
+func (o *completionOutput) sortedIndexes() []int {
+	idx := make([]int, 0, len(o.choices))
+	for i := range o.choices {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	return idx
+}
+
+func (o *completionOutput) finishReasons() []string {
+	var reasons []string
+	for _, i := range o.sortedIndexes() {
+		if f := o.choices[i].finish; f != "" {
+			reasons = append(reasons, f)
+		}
+	}
+	return reasons
+}
+
+func (o *completionOutput) outputMessages() []map[string]any {
+	var out []map[string]any
+	for _, i := range o.sortedIndexes() {
+		ch := o.choices[i]
+		parts := []any{}
+		if ch.text.Len() > 0 {
+			parts = append(parts, textPart(ch.text.String()))
+		}
+		for _, call := range ch.toolCalls {
+			parts = append(parts, map[string]any{"type": "tool_call", "id": call.id, "name": call.name, "arguments": call.arguments.String()})
+		}
+		out = append(out, map[string]any{"role": "assistant", "parts": parts, "finish_reason": ch.finish})
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// spanAttr returns the attribute value as a plain Go value for assertions.
+func spanAttr(attrs []otlpAttribute, key string) any {
+	for _, a := range attrs {
+		if a.Key != key {
+			continue
+		}
+		switch v := a.Value; {
+		case v.StringValue != nil:
+			return *v.StringValue
+		case v.IntValue != nil:
+			return *v.IntValue
+		case v.DoubleValue != nil:
+			return *v.DoubleValue
+		case v.ArrayValue != nil:
+			var out []string
+			for _, e := range v.ArrayValue.Values {
+				out = append(out, *e.StringValue)
+			}
+			return out
+		}
+	}
+	return nil
+}
+
+func TestRecordTraceStreamingToolCall(t *testing.T) {
+	var upstreamParent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("traceparent", "00-ffffffffffffffffffffffffffffffff-ffffffffffffffff-01")
+		fmt.Fprintln(w, `data: {"id":"chatcmpl-1","model":"glm-4.6","choices":[{"index":0,"delta":{"role":"assistant","content":"Checking."}}]}`)
+		fmt.Fprintln(w, `data: {"id":"chatcmpl-1","model":"glm-4.6","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`)
+		fmt.Fprintln(w, `data: {"id":"chatcmpl-1","model":"glm-4.6","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`)
+		fmt.Fprintln(w, `data: {"id":"chatcmpl-1","model":"glm-4.6","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":8,"total_tokens":20}}`)
+		fmt.Fprintln(w, `data: [DONE]`)
+	}))
+	defer upstream.Close()
+
+	tr, err := newTracer(TracingConfig{Endpoint: "http://collector:4318/v1/traces"}, parseURL(upstream.URL))
+	if err != nil {
+		t.Fatalf("newTracer() failed: %v", err)
+	}
+	handler := recordTrace(tr, func(w http.ResponseWriter, r *http.Request) {
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+	})
+
+	body := `{"model":"glm","stream":true,"temperature":0.2,"max_tokens":100,"messages":[{"role":"user","content":"weather in Paris?"}]}`
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+
+	// the request span comes first, then its stages in the order they end
+	var names []string
+	for _, s := range tr.spans[1:] {
+		names = append(names, s.Name)
+		if s.TraceID != tr.spans[0].TraceID || s.ParentSpanID != tr.spans[0].SpanID || s.EndTimeUnixNano == "" {
+			t.Errorf("stage %q is not a finished child of the request span: %+v", s.Name, s)
+		}
+	}
+	if got := strings.Join(names, ","); got != "parse request,apply rules,upstream call,first token,stream complete" {
+		t.Fatalf("stages = %s", got)
+	}
+	span := tr.spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span should join the incoming trace, got %s/%s", span.TraceID, span.ParentSpanID)
+	}
+	if call := tr.spans[3]; upstreamParent != "00-"+span.TraceID+"-"+call.SpanID+"-01" {
+		t.Errorf("upstream got traceparent %q, want the upstream call span %s", upstreamParent, call.SpanID)
+	}
+	if got := rec.Header().Get("traceparent"); got != "00-"+span.TraceID+"-"+span.SpanID+"-01" {
+		t.Errorf("client got traceparent %q, want the request span", got)
+	}
+	if span.Name != "chat glm" || span.Kind != spanKindClient {
+		t.Errorf("unexpected span name/kind: %q %d", span.Name, span.Kind)
+	}
+
+	want := map[string]any{
+		"gen_ai.operation.name":          "chat",
+		"gen_ai.provider.name":           "openai",
+		"gen_ai.request.model":           "glm",
+		"gen_ai.response.model":          "glm-4.6",
+		"gen_ai.response.id":             "chatcmpl-1",
+		"gen_ai.request.temperature":     0.2,
+		"gen_ai.request.max_tokens":      "100",
+		"gen_ai.usage.input_tokens":      "12",
+		"gen_ai.usage.output_tokens":     "8",
+		"server.address":                 "127.0.0.1",
+		"gen_ai.response.finish_reasons": []string{"tool_calls"},
+	}
+	for key, v := range want {
+		if got := spanAttr(span.Attributes, key); fmt.Sprint(got) != fmt.Sprint(v) {
+			t.Errorf("%s = %v, want %v", key, got, v)
+		}
+	}
+
+	var output []map[string]any
+	if err := json.Unmarshal([]byte(spanAttr(span.Attributes, "gen_ai.output.messages").(string)), &output); err != nil {
+		t.Fatalf("invalid output messages: %v", err)
+	}
+	parts := output[0]["parts"].([]any)
+	if len(parts) != 2 || parts[0].(map[string]any)["content"] != "Checking." {
+		t.Fatalf("unexpected output parts: %v", parts)
+	}
+	call := parts[1].(map[string]any)
+	if call["type"] != "tool_call" || call["name"] != "get_weather" || call["arguments"] != `{"city":"Paris"}` {
+		t.Errorf("tool call deltas should be merged, got %v", call)
+	}
+	if !strings.Contains(spanAttr(span.Attributes, "gen_ai.input.messages").(string), "weather in Paris?") {
+		t.Errorf("input messages should include the prompt")
+	}
+}
+
+func TestAddToolCallDeltaIndexBounds(t *testing.T) {
+	var ch choiceOutput
+	for _, idx := range []int{-1, maxToolCallIndex + 1, 1 << 40} {
+		ch.addToolCallDelta(toolCallJSON{Index: &idx})
+	}
+	if len(ch.toolCalls) != 0 {
+		t.Fatalf("out of range deltas kept %d tool calls", len(ch.toolCalls))
+	}
+	idx := 1
+	ch.addToolCallDelta(toolCallJSON{Index: &idx, ID: "call_2"})
+	if len(ch.toolCalls) != 2 || ch.toolCalls[1].id != "call_2" {
+		t.Errorf("in range delta not merged: %d tool calls", len(ch.toolCalls))
+	}
+}
+
+func TestRecordTraceOmitContentAndErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	tr, _ := newTracer(TracingConfig{Endpoint: "http://collector:4318/v1/traces", OmitContent: true}, nil)
+	handler := recordTrace(tr, func(w http.ResponseWriter, r *http.Request) {
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+	})
+	r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model":"m","prompt":"secret"}`))
+	handler(httptest.NewRecorder(), r)
+
+	span := tr.spans[0]
+	if span.Status.Code != 2 || spanAttr(span.Attributes, "error.type") != "503" {
+		t.Errorf("expected error status, got %+v", span.Status)
+	}
+	if spanAttr(span.Attributes, "gen_ai.operation.name") != "text_completion" {
+		t.Errorf("expected text_completion operation")
+	}
+	if spanAttr(span.Attributes, "gen_ai.input.messages") != nil || spanAttr(span.Attributes, "gen_ai.output.messages") != nil {
+		t.Errorf("content should be omitted")
+	}
+	if len(span.TraceID) != 32 || span.ParentSpanID != "" {
+		t.Errorf("expected a fresh root trace, got %q parent %q", span.TraceID, span.ParentSpanID)
+	}
+}
+
+func TestTracerFlush(t *testing.T) {
+	var payload map[string]any
+	var auth string
+	fail := true
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer collector.Close()
+
+	tr, _ := newTracer(TracingConfig{
+		Endpoint: collector.URL + "/api/public/otel/v1/traces",
+		Headers:  map[string]string{"Authorization": "Basic cGs6c2s="},
+	}, nil)
+	tr.add(otlpSpan{TraceID: "t", SpanID: "s", Name: "chat m"})
+
+	if err := tr.flush(context.Background()); err == nil {
+		t.Fatal("expected collector error")
+	}
+	if len(tr.spans) != 1 {
+		t.Fatalf("spans should be requeued on failure")
+	}
+
+	fail = false
+	if err := tr.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if auth != "Basic cGs6c2s=" {
+		t.Errorf("configured headers should be sent, got %q", auth)
+	}
+	rs := payload["resourceSpans"].([]any)[0].(map[string]any)
+	if !strings.Contains(fmt.Sprint(rs["resource"]), "llm-api-relay") {
+		t.Errorf("expected service.name resource attribute, got %v", rs["resource"])
+	}
+	spans := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	if len(spans) != 1 || spans[0].(map[string]any)["name"] != "chat m" {
+		t.Errorf("unexpected spans: %v", spans)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+var outputLimitedTotal = metrics.newCounterVec("relay_output_limited_total",
+	"Streams cut off by the relay because they exceeded a rule's output cap.", "tenant", "model", "limit")
+
+// pipeSSE feeds src to handle line by line (without the line ending) in a
+// goroutine and streams the lines handle returns. handle returns more=false
+// to end the stream early. The returned reader must be closed so the
+// goroutine can exit.
+func pipeSSE(src io.Reader, handle func(line string) (out []string, more bool)) io.ReadCloser {
+	return pipeSSEWithEnd(src, handle, nil)
+}
+
+// pipeSSEWithEnd is pipeSSE with end called once src ends cleanly, to
+// append lines to the stream.
+func pipeSSEWithEnd(src io.Reader, handle func(line string) (out []string, more bool), end func() []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(src)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				out, more := handle(strings.TrimRight(line, "\r\n"))
+				for _, l := range out {
+					if _, werr := io.WriteString(pw, l+"\n"); werr != nil {
+						return
+					}
+				}
+				if !more {
+					pw.Close()
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					if end != nil {
+						for _, l := range end() {
+							if _, werr := io.WriteString(pw, l+"\n"); werr != nil {
+								return
+							}
+						}
+					}
+					pw.Close()
+				} else {
+					pw.CloseWithError(err)
+				}
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// outputGuard caps the text a stream may carry, for backends that ignore
+// max_tokens. Tokens are counted as content-bearing chunks, which is one
+// token per chunk for most backends; bytes are counted over content,
+// reasoning_content and (completions) text.
+type outputGuard struct {
+	ctx       context.Context
+	maxTokens int
+	maxBytes  int
+	tenant    string
+	model     string
+	label     string // model label of the metrics, see metricModel
+
+	tokens int
+	bytes  int
+	streamEnvelope
+}
+
+// newOutputGuard wraps src, or returns nil when the rule sets no cap.
+func newOutputGuard(ctx context.Context, src io.Reader, rule *ModelRule, tenant, model string) io.ReadCloser {
+	if rule == nil || (rule.MaxOutputTokens <= 0 && rule.MaxOutputBytes <= 0) {
+		return nil
+	}
+	g := &outputGuard{
+		ctx:       ctx,
+		maxTokens: rule.MaxOutputTokens,
+		maxBytes:  rule.MaxOutputBytes,
+		tenant:    tenant,
+		model:     model,
+		label:     metricModel(rule),
+	}
+	return pipeSSE(src, g.handle)
+}
+
+func (g *outputGuard) handle(line string) ([]string, bool) {
+	if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	g.remember(chunk)
+
+	texts := chunkTexts(chunk)
+	if len(texts) == 0 {
+		return []string{line}, true
+	}
+	if g.maxTokens > 0 && g.tokens >= g.maxTokens {
+		return g.stop(nil, "tokens"), false
+	}
+	g.tokens++
+
+	limit := ""
+	for _, t := range texts {
+		s := t.get()
+		if g.maxBytes > 0 && g.bytes+len(s) > g.maxBytes {
+			s = truncateUTF8(s, g.maxBytes-g.bytes)
+			t.set(s)
+			limit = "bytes"
+		}
+		g.bytes += len(s)
+	}
+	if limit == "" {
+		return []string{line}, true
+	}
+	return g.stop(chunk, limit), false
+}
+
+// streamEnvelope follows a stream for a final chunk the relay adds to end
+// it early.
+type streamEnvelope struct {
+	last    map[string]any // envelope of the latest chunk, reused for the final one
+	indexes []any          // choice indexes seen so far
+}
+
+func (e *streamEnvelope) remember(chunk map[string]any) {
+	e.last = chunk
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		idx, ok := choice["index"]
+		if !ok {
+			continue
+		}
+		seen := false
+		for _, i := range e.indexes {
+			seen = seen || i == idx
+		}
+		if !seen {
+			e.indexes = append(e.indexes, idx)
+		}
+	}
+}
+
+// stop emits the truncated chunk, if any, then a finish_reason "length"
+// chunk per choice and [DONE].
+func (g *outputGuard) stop(truncated map[string]any, limit string) []string {
+	vlogCtx(g.ctx, "GUARD: output cap (%s) reached for model '%s', ending stream", limit, g.model)
+	outputLimitedTotal.Inc(g.tenant, g.label, limit)
+
+	var out []string
+	if truncated != nil {
+		choices, _ := truncated["choices"].([]any)
+		for _, c := range choices {
+			if choice, ok := c.(map[string]any); ok {
+				choice["finish_reason"] = nil
+			}
+		}
+		if data, err := json.Marshal(truncated); err == nil {
+			out = append(out, "data: "+string(data), "")
+		}
+	}
+	if data, err := json.Marshal(finishChunk(g.last, g.indexes, "length")); err == nil {
+		out = append(out, "data: "+string(data), "")
+	}
+	return append(out, "data: [DONE]", "")
+}
+
+// finishChunk builds a chunk that ends every choice in indexes with reason,
+// copying id, object, created and model from last.
+func finishChunk(last map[string]any, indexes []any, reason string) map[string]any {
+	chunk := map[string]any{}
+	for _, k := range []string{"id", "object", "created", "model"} {
+		if v, ok := last[k]; ok {
+			chunk[k] = v
+		}
+	}
+	if len(indexes) == 0 {
+		indexes = []any{0}
+	}
+	choices := make([]any, 0, len(indexes))
+	for _, idx := range indexes {
+		choice := map[string]any{"index": idx, "finish_reason": reason}
+		if getString(last, "object") == "text_completion" {
+			choice["text"] = ""
+		} else {
+			choice["delta"] = map[string]any{}
+		}
+		choices = append(choices, choice)
+	}
+	chunk["choices"] = choices
+	return chunk
+}
+
+// chunkText is one non-empty text field of a stream chunk.
+type chunkText struct {
+	holder map[string]any
+	field  string
+}
+
+func (t chunkText) get() string  { return getString(t.holder, t.field) }
+func (t chunkText) set(s string) { t.holder[t.field] = s }
+
+// chunkTexts returns the non-empty text fields of every choice in chunk:
+// delta.content and delta.reasoning_content for chat, text for completions.
+func chunkTexts(chunk map[string]any) []chunkText {
+	var texts []chunkText
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			for _, f := range []string{"content", "reasoning_content"} {
+				if getString(delta, f) != "" {
+					texts = append(texts, chunkText{delta, f})
+				}
+			}
+		} else if getString(choice, "text") != "" {
+			texts = append(texts, chunkText{choice, "text"})
+		}
+	}
+	return texts
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOutputGuard(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 10; i++ {
+			fmt.Fprintln(w, sseChunk("runaway", "héllo ", ""))
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, sseChunk("runaway", "", "stop"))
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		rule        ModelRule
+		wantContent string
+		wantFinish  string
+	}{
+		{"no cap", ModelRule{MatchModel: "m"}, strings.Repeat("héllo ", 10), "stop"},
+		{"token cap", ModelRule{MatchModel: "m", MaxOutputTokens: 3}, strings.Repeat("héllo ", 3), "length"},
+		{"byte cap splits chunk", ModelRule{MatchModel: "m", MaxOutputBytes: 11}, "héllo hél", "length"},
+		{"byte cap keeps runes whole", ModelRule{MatchModel: "m", MaxOutputBytes: 9}, "héllo h", "length"},
+		{"cap not reached", ModelRule{MatchModel: "m", MaxOutputTokens: 10}, strings.Repeat("héllo ", 10), "stop"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{ModelRules: []ModelRule{tt.rule}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		out := w.Body.String()
+		content, finishes, ids := streamedContent(t, out)
+		if content != tt.wantContent {
+			t.Errorf("%s: content = %q, want %q", tt.name, content, tt.wantContent)
+		}
+		if len(finishes) != 1 || finishes[0] != tt.wantFinish {
+			t.Errorf("%s: finish reasons = %v, want [%s]", tt.name, finishes, tt.wantFinish)
+		}
+		if ids[len(ids)-1] != "runaway" {
+			t.Errorf("%s: final chunk should reuse the stream id, got %v", tt.name, ids)
+		}
+		if !strings.HasSuffix(out, "data: [DONE]\n") && !strings.HasSuffix(out, "data: [DONE]\n\n") {
+			t.Errorf("%s: stream should end with [DONE]:\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestOutputGuardCompletions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: {\"id\":\"c\",\"object\":\"text_completion\",\"choices\":[{\"index\":0,\"text\":\"abc\",\"finish_reason\":null}]}\n\n")
+		}
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", MaxOutputBytes: 4}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model":"m","prompt":"x","stream":true}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	out := w.Body.String()
+	if strings.Count(out, `"text":"abc"`) != 1 || !strings.Contains(out, `"text":"a"`) {
+		t.Errorf("expected 4 bytes of text in total:\n%s", out)
+	}
+	if !strings.Contains(out, `"finish_reason":"length","index":0,"text":""`) {
+		t.Errorf("expected a text_completion length chunk:\n%s", out)
+	}
+}
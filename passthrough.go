@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// PassthroughConfig forwards /v1/* endpoints the relay has no handler for
+// (audio, images, files, ...) to the upstream unchanged. Model
+// rules, toolcallfix and usage accounting do not apply to them.
+type PassthroughConfig struct {
+	Allow []string `json:"allow"` // exact paths or "/v1/audio/*" prefixes; empty allows every /v1/* path
+}
+
+func validatePassthrough(p *PassthroughConfig) error {
+	if p == nil {
+		return nil
+	}
+	for _, a := range p.Allow {
+		if !strings.HasPrefix(a, "/v1/") {
+			return fmt.Errorf("passthrough.allow: %q must start with /v1/", a)
+		}
+		if strings.Contains(strings.TrimSuffix(a, "/*"), "*") {
+			return fmt.Errorf("passthrough.allow: %q: \"*\" is only allowed as a trailing \"/*\"", a)
+		}
+	}
+	return nil
+}
+
+// allows reports whether path may be passed through.
+func (p *PassthroughConfig) allows(path string) bool {
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, a := range p.Allow {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == a {
+			return true
+		}
+	}
+	return false
+}
+
+// guard answers paths outside the allowlist the way an unregistered route
+// would, in the OpenAI error shape.
+func (p *PassthroughConfig) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.allows(r.URL.Path) {
+			vlogCtx(r.Context(), "PASSTHROUGH: %s %s is not allowed", r.Method, r.URL.Path)
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path), "invalid_request_error", "unknown_url")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// passthroughBody is the client's body to stream upstream, or nil when the
+// request has none.
+func passthroughBody(r *http.Request) io.Reader {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	return r.Body
+}
+
+// copyFlushing copies an upstream response to the client, flushing after
+// every read so event streams (e.g. /v1/responses) are not held back.
+func copyFlushing(w http.ResponseWriter, body io.Reader) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		_, _ = io.Copy(w, body)
+		return
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			f.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPassthrough(t *testing.T) {
+	var gotPath, gotBody, gotType, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotType, gotAuth = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"object":"list","data":[]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream:        upstream.URL,
+		UpstreamOptions: &UpstreamOptions{APIKey: "sk-upstream"},
+		Passthrough:     &PassthroughConfig{Allow: []string{"/v1/moderations", "/v1/audio/*"}},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("POST", "/v1/moderations", "application/json", `{"model":"omni-moderation-latest","input":"hi"}`)
+	if w.Code != http.StatusOK || gotPath != "/v1/moderations" || gotBody != `{"model":"omni-moderation-latest","input":"hi"}` || gotAuth != "Bearer sk-upstream" {
+		t.Errorf("moderations: %d %s; upstream got %s %q auth %q", w.Code, w.Body, gotPath, gotBody, gotAuth)
+	}
+
+	form := "--b\r\nContent-Disposition: form-data; name=\"model\"\r\n\r\nwhisper-1\r\n--b--\r\n"
+	w = send("POST", "/v1/audio/transcriptions", "multipart/form-data; boundary=b", form)
+	if w.Code != http.StatusOK || gotPath != "/v1/audio/transcriptions" || gotBody != form || gotType != "multipart/form-data; boundary=b" {
+		t.Errorf("audio: %d; upstream got %s %q (%s)", w.Code, gotPath, gotBody, gotType)
+	}
+
+	gotPath = ""
+	w = send("GET", "/v1/files", "", "")
+	if w.Code != http.StatusNotFound || gotPath != "" || !strings.Contains(w.Body.String(), `"code":"unknown_url"`) {
+		t.Errorf("path outside the allowlist: %d %s, upstream got %q", w.Code, w.Body, gotPath)
+	}
+
+	// the relay's own endpoints still take precedence
+	cfg.Passthrough.Allow = nil
+	w = send("GET", "/v1/models", "", "")
+	if w.Code != http.StatusOK || gotPath != "/v1/models" {
+		t.Errorf("/v1/models: %d, upstream got %q", w.Code, gotPath)
+	}
+}
+
+func TestValidatePassthrough(t *testing.T) {
+	for _, allow := range []string{"/v2/embeddings", "embeddings", "/v1/*/speech"} {
+		if err := validatePassthrough(&PassthroughConfig{Allow: []string{allow}}); err == nil {
+			t.Errorf("validatePassthrough(%q) succeeded, want error", allow)
+		}
+	}
+}
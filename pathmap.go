@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// pathMapping rewrites client paths for upstreams that do not serve the
+// OpenAI layout. Patterns are exact paths or prefixes ending in "/*"; the
+// part matched by "*" replaces the "*" of the target.
+type pathMapping struct {
+	exact    map[string]string
+	prefixes []pathPrefix // longest first
+}
+
+type pathPrefix struct {
+	prefix string // pattern without the trailing "*"
+	target string
+}
+
+func validatePaths(paths map[string]string) error {
+	for from, to := range paths {
+		if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return fmt.Errorf("upstream_options.paths: %q -> %q: paths must start with /", from, to)
+		}
+		wild := strings.HasSuffix(from, "/*")
+		if strings.Count(from, "*") > 1 || (!wild && strings.Contains(from, "*")) {
+			return fmt.Errorf("upstream_options.paths: %q: \"*\" is only allowed as a trailing \"/*\"", from)
+		}
+		if strings.Count(to, "*") > 1 || (!wild && strings.Contains(to, "*")) {
+			return fmt.Errorf("upstream_options.paths: %q: target %q may use \"*\" once, and only for a /* pattern", from, to)
+		}
+	}
+	return nil
+}
+
+func newPathMapping(paths map[string]string) *pathMapping {
+	if len(paths) == 0 {
+		return nil
+	}
+	m := &pathMapping{exact: map[string]string{}}
+	for from, to := range paths {
+		if strings.HasSuffix(from, "/*") {
+			m.prefixes = append(m.prefixes, pathPrefix{strings.TrimSuffix(from, "*"), to})
+		} else {
+			m.exact[from] = to
+		}
+	}
+	sort.Slice(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].prefix) > len(m.prefixes[j].prefix)
+	})
+	return m
+}
+
+// rewrite maps path, preferring an exact pattern over the longest prefix.
+// Unmatched paths are returned as is.
+func (m *pathMapping) rewrite(path string) string {
+	if m == nil {
+		return path
+	}
+	if to, ok := m.exact[path]; ok {
+		return to
+	}
+	for _, p := range m.prefixes {
+		if rest, ok := strings.CutPrefix(path, p.prefix); ok {
+			return strings.Replace(p.target, "*", rest, 1)
+		}
+	}
+	return path
+}
+
+// target resolves the client's path against the upstream after mapping it.
+func (c *upstreamClient) target(path *url.URL) *url.URL {
+	mapped := *path
+	if p := c.paths.rewrite(path.Path); p != path.Path {
+		vlog("UPSTREAM: path %s mapped to %s", path.Path, p)
+		mapped.Path, mapped.RawPath = p, ""
+	}
+	return c.url.ResolveReference(&mapped)
+}
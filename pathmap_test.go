@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPathMappingRewrite(t *testing.T) {
+	m := newPathMapping(map[string]string{
+		"/v1/chat/completions": "/api/v3/chat/completions",
+		"/v1/*":                "/accounts/acme/v1/*",
+		"/v1/models/*":         "/catalog/*",
+	})
+	tests := []struct{ in, want string }{
+		{"/v1/chat/completions", "/api/v3/chat/completions"},
+		{"/v1/completions", "/accounts/acme/v1/completions"},
+		{"/v1/models/llama", "/catalog/llama"},
+		{"/v1/models", "/accounts/acme/v1/models"},
+		{"/health", "/health"},
+	}
+	for _, tt := range tests {
+		if got := m.rewrite(tt.in); got != tt.want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, paths := range []map[string]string{
+		{"v1/chat": "/x"},
+		{"/v1/*/chat": "/x"},
+		{"/v1/chat": "/x/*"},
+	} {
+		if err := validatePaths(paths); err == nil {
+			t.Errorf("expected an error for %v", paths)
+		}
+	}
+}
+
+func TestPathMappingProxy(t *testing.T) {
+	var path string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{Paths: map[string]string{"/v1/*": "/openai/deployments/acme/*"}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions?api-version=2024-10-21", strings.NewReader(`{"model":"m"}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+	if path != "/openai/deployments/acme/chat/completions?api-version=2024-10-21" {
+		t.Errorf("upstream got %q", path)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePostgres is just enough of a Postgres server to accept the exporter:
+// it declines TLS, authenticates with SCRAM-SHA-256 and records the
+// statements it is sent.
+type fakePostgres struct {
+	ln       net.Listener
+	password string
+
+	mu         sync.Mutex
+	startup    map[string]string
+	statements []pgStatement
+}
+
+func newFakePostgres(t *testing.T, password string) *fakePostgres {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePostgres{ln: ln, password: password}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readUntyped := func() []byte {
+		var n [4]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(n[:])-4)
+		_, _ = io.ReadFull(r, body)
+		return body
+	}
+	read := func() (byte, []byte) {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return 0, nil
+		}
+		return typ, readUntyped()
+	}
+	send := func(typ byte, body []byte) {
+		msg := append([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+		_, _ = conn.Write(append(msg, body...))
+	}
+	auth := func(code uint32, data string) {
+		send('R', append(binary.BigEndian.AppendUint32(nil, code), data...))
+	}
+
+	body := readUntyped()
+	if binary.BigEndian.Uint32(body) == pgSSLRequestCode {
+		_, _ = conn.Write([]byte("N"))
+		body = readUntyped()
+	}
+	params := map[string]string{}
+	fields := strings.Split(string(body[4:]), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[fields[i]] = fields[i+1]
+	}
+	f.mu.Lock()
+	f.startup = params
+	f.mu.Unlock()
+
+	// SCRAM-SHA-256, server side
+	auth(10, "SCRAM-SHA-256\x00\x00")
+	_, first := read()
+	mech, rest, _ := strings.Cut(string(first), "\x00")
+	clientFirst := strings.TrimPrefix(rest[4:], "n,,")
+	if mech != "SCRAM-SHA-256" {
+		return
+	}
+	salt := []byte("pepper")
+	serverFirst := "r=" + scramAttrs(clientFirst)["r"] + "srv,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	auth(11, serverFirst)
+	_, final := read()
+	withoutProof, proof64, _ := strings.Cut(string(final), ",p=")
+	salted, _ := pbkdf2.Key(sha256.New, f.password, salt, 4096, sha256.Size)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+	proof, _ := base64.StdEncoding.DecodeString(proof64)
+	sig := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		if i < len(sig) {
+			proof[i] ^= sig[i]
+		}
+	}
+	if recovered := sha256.Sum256(proof); !hmac.Equal(recovered[:], storedKey[:]) {
+		send('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+		return
+	}
+	auth(12, "v="+base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)))
+	auth(0, "")
+	send('Z', []byte("I"))
+
+	var pending []pgStatement
+	var query string
+	for {
+		typ, body := read()
+		switch typ {
+		case 'P':
+			query, _, _ = strings.Cut(string(body[1:]), "\x00")
+			send('1', nil)
+		case 'B':
+			b := body[2:] // unnamed portal and statement
+			n := int(binary.BigEndian.Uint16(b[2:]))
+			b = b[4:]
+			args := make([]string, n)
+			for i := range args {
+				size := int(binary.BigEndian.Uint32(b))
+				args[i], b = string(b[4:4+size]), b[4+size:]
+			}
+			pending = append(pending, pgStatement{query, args})
+			send('2', nil)
+		case 'E':
+			send('C', []byte("INSERT 0 1\x00"))
+		case 'S':
+			f.mu.Lock()
+			f.statements = append(f.statements, pending...)
+			f.mu.Unlock()
+			pending = nil
+			send('Z', []byte("I"))
+		default:
+			return
+		}
+	}
+}
+
+func TestPostgresSink(t *testing.T) {
+	pg := newFakePostgres(t, "secret")
+	e, err := newExporter(ExportConfig{Type: "postgres", DSN: "postgres://relay:secret@" + pg.ln.Addr().String() + "/analytics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)
+	e.add(requestRecord{Time: at, Path: "/v1/chat/completions", Model: "glm", Tenant: "default", Key: "abc", Status: 200, Stream: true, LatencyMs: 1200, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15})
+	e.add(requestRecord{Time: at, Path: "/v1/completions", Model: "qwen", Tenant: "team-a", Status: 502})
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the connection is reused for the next batch
+	e.add(requestRecord{Time: at, Model: "glm"})
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	pg.mu.Lock()
+	startup, statements := pg.startup, pg.statements
+	pg.mu.Unlock()
+	if startup["user"] != "relay" || startup["database"] != "analytics" {
+		t.Errorf("startup parameters = %v", startup)
+	}
+	if len(statements) != 2 {
+		t.Fatalf("%d statements, want one per batch", len(statements))
+	}
+	st := statements[0]
+	if !strings.HasPrefix(st.query, "INSERT INTO llm_requests (time, path, model, tenant, key,") || !strings.HasSuffix(st.query, "($12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)") {
+		t.Errorf("query = %s", st.query)
+	}
+	want := "2026-10-17T08:30:00Z|/v1/chat/completions|glm|default|abc|200|true|1200|10|5|15|2026-10-17T08:30:00Z|/v1/completions|qwen|team-a||502|false|0|0|0|0"
+	if got := strings.Join(st.args, "|"); got != want {
+		t.Errorf("args = %s", got)
+	}
+
+	bad, _ := newExporter(ExportConfig{Type: "postgres", DSN: "postgres://relay:wrong@" + pg.ln.Addr().String() + "/analytics"})
+	bad.add(requestRecord{})
+	if err := bad.flush(context.Background()); err == nil || !strings.Contains(err.Error(), "28P01") {
+		t.Errorf("wrong password: %v", err)
+	}
+	if bad.queueDepth() != 1 {
+		t.Errorf("record not kept for a retry")
+	}
+}
+
+func TestParsePostgresDSN(t *testing.T) {
+	for _, tt := range []struct {
+		dsn     string
+		want    pgConfig
+		wantErr string
+	}{
+		{dsn: "postgres://relay:se%20cret@db:6432/analytics?sslmode=disable",
+			want: pgConfig{host: "db", port: "6432", user: "relay", password: "se cret", database: "analytics", sslmode: "disable"}},
+		{dsn: "postgresql://db", want: pgConfig{host: "db", port: "5432", user: "postgres", database: "postgres", sslmode: "prefer"}},
+		{dsn: `host=db user=relay password='it\'s secret' dbname=analytics sslmode=verify-full`,
+			want: pgConfig{host: "db", port: "5432", user: "relay", password: "it's secret", database: "analytics", sslmode: "verify-full"}},
+		{dsn: "postgres://db/x?sslmode=allow", wantErr: "unsupported sslmode"},
+		{dsn: "postgres://db/x?connect_timeout=5", wantErr: "unsupported parameter"},
+		{dsn: "host=db password='open", wantErr: "unterminated quote"},
+	} {
+		got, err := parsePostgresDSN(tt.dsn)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: %v, want %q", tt.dsn, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("%s: %+v, %v", tt.dsn, got, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"llm-api-relay/toolcallfix"
+)
+
+// streamRequest is what a stream stage may need to know about the request.
+type streamRequest struct {
+	ctx     context.Context // the client request's, for log lines
+	cfg     *Config
+	rule    *ModelRule
+	payload map[string]any
+	tools   any // the request's tools, kept when tools_via_prompt removed them from payload
+	tenant  string
+	model   string
+	trailer string // empty when the client asked for JSON output
+
+	upstreamFixed  bool // a relay behind this one already converted the tool calls
+	toolCallsFixed bool // set by the toolcallfix stage when it runs
+}
+
+// streamStage wraps a streaming response body with one chunk processor, or
+// returns nil when the request does not use it.
+type streamStage func(src io.Reader, sr *streamRequest) io.ReadCloser
+
+// streamStages are the chunk processors a rule's stream_pipeline can name.
+var streamStages = map[string]streamStage{
+	"validate": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newResponseValidator(sr.ctx, src, sr.rule, sr.payload, sr.tenant, sr.model)
+	},
+	"role": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newRoleSynthesizer(sr.ctx, src, sr.rule, sr.tenant, sr.model)
+	},
+	"think": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newThinkRouter(src, sr.rule)
+	},
+	"stop": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newStopScanner(sr.ctx, src, sr.rule, sr.payload, sr.tenant)
+	},
+	"redact": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newStreamRedactor(sr.ctx, src, sr.rule, sr.tenant, sr.model)
+	},
+	"output_guard": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newOutputGuard(sr.ctx, src, sr.rule, sr.tenant, sr.model)
+	},
+	"trailer": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newTrailerInjector(src, sr.trailer)
+	},
+	"toolcallfix": newToolCallFixStage,
+	"usage": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newUsageSynthesizer(src, sr.rule, sr.payload)
+	},
+	"pace": func(src io.Reader, sr *streamRequest) io.ReadCloser {
+		return newStreamPacer(src, sr.rule)
+	},
+}
+
+// defaultStreamPipeline is the order used when a rule sets no
+// stream_pipeline. Stages whose options are not set pass the stream through.
+var defaultStreamPipeline = []string{"validate", "role", "think", "stop", "redact", "output_guard", "trailer", "toolcallfix", "usage", "pace"}
+
+func validateStreamPipeline(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := streamStages[name]; !ok {
+			return fmt.Errorf("unknown stream_pipeline stage %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate stream_pipeline stage %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// buildStreamPipeline chains the rule's stages over body. The returned
+// close function releases every stage.
+func buildStreamPipeline(body io.Reader, sr *streamRequest) (io.Reader, func()) {
+	names := defaultStreamPipeline
+	if sr.rule != nil && sr.rule.StreamPipeline != nil {
+		names = sr.rule.StreamPipeline
+	}
+	// characters split by the upstream are joined before any stage decodes them
+	joiner := newRuneJoiner(body, sr.tenant, metricModel(sr.rule))
+	stages := []io.Closer{joiner}
+	body = joiner
+	for _, name := range names {
+		if stage := streamStages[name](body, sr); stage != nil {
+			stages = append(stages, stage)
+			body = stage
+		}
+	}
+	return body, func() {
+		for i := len(stages) - 1; i >= 0; i-- {
+			stages[i].Close()
+		}
+	}
+}
+
+// newToolCallFixStage rewrites tool call markup in content into tool_calls
+// when toolcallfix is enabled for the model.
+func newToolCallFixStage(src io.Reader, sr *streamRequest) io.ReadCloser {
+	if sr.upstreamFixed {
+		vlogCtx(sr.ctx, "TOOLCALLFIX: upstream relay already converted the stream for model '%s'", sr.model)
+		return nil
+	}
+	if !shouldEnableToolCallFix(sr.tenant, sr.rule, sr.model) {
+		return nil
+	}
+	sr.toolCallsFixed = true
+	format := toolCallFixFormat(sr.tenant, sr.rule, sr.model)
+	vlogCtx(sr.ctx, "TOOLCALLFIX: transforming %s stream for model '%s'", format, sr.model)
+	transformer, _ := toolcallfix.NewTransformerWithTags(format, toolCallFixTags(sr.tenant, sr.rule, sr.model)) // validated at load
+	tools := sr.tools
+	if tools == nil {
+		tools = sr.payload["tools"]
+	}
+	if setter, ok := transformer.(toolcallfix.ToolsSetter); ok && tools != nil {
+		// calls are checked against the request's tools and argument values
+		// take the types their schemas declare
+		tools, _ := json.Marshal(tools)
+		if err := setter.SetTools(tools); err != nil {
+			vlogCtx(sr.ctx, "TOOLCALLFIX: ignoring request tools: %v", err)
+		} else if sr.rule != nil {
+			_ = setter.SetSchemaMode(sr.rule.ToolCallFixSchema) // validated at load
+		}
+	}
+	if streamer, ok := transformer.(toolcallfix.ArgsStreamer); ok && sr.rule != nil && sr.rule.ToolCallFixStreamArgs {
+		streamer.SetStreamArgs(true)
+	}
+	return pipeSSE(src, func(line string) ([]string, bool) {
+		out, err := transformer.TransformLine(line)
+		if err != nil {
+			vlogCtx(sr.ctx, "TOOLCALLFIX: transformation failed: %v", err)
+			return []string{line}, true
+		}
+		return out, true
+	})
+}
+
+// streamPacer spaces out data events for clients that render bursts badly.
+type streamPacer struct {
+	interval time.Duration
+	last     time.Time
+}
+
+// newStreamPacer wraps src, or returns nil when the rule sets no stream_pace.
+func newStreamPacer(src io.Reader, rule *ModelRule) io.ReadCloser {
+	if rule == nil || rule.StreamPace == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(rule.StreamPace)
+	if err != nil || d <= 0 {
+		// validated at startup
+		return nil
+	}
+	p := &streamPacer{interval: d}
+	return pipeSSE(src, p.handle)
+}
+
+func (p *streamPacer) handle(line string) ([]string, bool) {
+	if strings.HasPrefix(line, "data: ") {
+		if wait := p.interval - time.Since(p.last); !p.last.IsZero() && wait > 0 {
+			time.Sleep(wait)
+		}
+		p.last = time.Now()
+	}
+	return []string{line}, true
+}
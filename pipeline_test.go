@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chatStream(pieces ...string) string {
+	var b strings.Builder
+	for _, p := range pieces {
+		content, _ := json.Marshal(p)
+		fmt.Fprintf(&b, `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":%s},"finish_reason":null}]}`+"\n\n", content)
+	}
+	b.WriteString(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n\ndata: [DONE]\n\n")
+	return b.String()
+}
+
+func runPipeline(t *testing.T, rule *ModelRule, payload map[string]any, input string) string {
+	t.Helper()
+	body, closePipeline := buildStreamPipeline(strings.NewReader(input), &streamRequest{
+		ctx: context.Background(), cfg: &Config{}, rule: rule, payload: payload, tenant: "default", model: "m", trailer: rule.Trailer,
+	})
+	defer closePipeline()
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read pipeline: %v", err)
+	}
+	return string(out)
+}
+
+// streamFields concatenates a delta field over every chunk of a stream.
+func streamFields(t *testing.T, stream, field string) string {
+	t.Helper()
+	var b strings.Builder
+	for _, line := range strings.Split(stream, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]any
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, c := range chunk["choices"].([]any) {
+			delta, _ := c.(map[string]any)["delta"].(map[string]any)
+			b.WriteString(getString(delta, field))
+		}
+	}
+	return b.String()
+}
+
+func TestThinkRouting(t *testing.T) {
+	input := chatStream("<th", "ink>step one", ", step two</thi", "nk>", "The answer", " is <b>4</b>.")
+
+	out := runPipeline(t, &ModelRule{ThinkRouting: "reasoning"}, nil, input)
+	if got := streamFields(t, out, "reasoning_content"); got != "step one, step two" {
+		t.Errorf("reasoning_content = %q", got)
+	}
+	if got := streamFields(t, out, "content"); got != "The answer is <b>4</b>." {
+		t.Errorf("content = %q", got)
+	}
+
+	out = runPipeline(t, &ModelRule{ThinkRouting: "drop"}, nil, input)
+	if got := streamFields(t, out, "reasoning_content"); got != "" {
+		t.Errorf("dropped reasoning still streamed: %q", got)
+	}
+	if got := streamFields(t, out, "content"); got != "The answer is <b>4</b>." {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestUsageSynthesis(t *testing.T) {
+	payload := map[string]any{"messages": []any{map[string]any{"role": "user", "content": "12345678"}}}
+	out := runPipeline(t, &ModelRule{SynthesizeUsage: true}, payload, chatStream("abcd", "efgh"))
+	if !strings.Contains(out, `"usage":{"completion_tokens":2,"prompt_tokens":2,"total_tokens":4}`) {
+		t.Errorf("no synthesized usage:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "data: [DONE]\n\n") {
+		t.Errorf("stream does not end with [DONE]:\n%s", out)
+	}
+
+	// usage from the upstream is left alone
+	withUsage := strings.Replace(chatStream("abcd"), "data: [DONE]", `data: {"id":"c1","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":9,"total_tokens":18}}`+"\n\ndata: [DONE]", 1)
+	out = runPipeline(t, &ModelRule{SynthesizeUsage: true}, payload, withUsage)
+	if strings.Count(out, `"usage"`) != 1 {
+		t.Errorf("usage duplicated:\n%s", out)
+	}
+}
+
+func TestStreamPace(t *testing.T) {
+	start := time.Now()
+	runPipeline(t, &ModelRule{StreamPace: "20ms"}, nil, chatStream("a", "b", "c"))
+	// four data events (three pieces and the finish chunk) plus [DONE]
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("paced stream took %v, want at least 80ms", elapsed)
+	}
+}
+
+func TestStreamPipelineOrder(t *testing.T) {
+	rule := &ModelRule{Trailer: "[AI]", RedactPatterns: []string{`\[AI\]`}}
+	input := chatStream("hello")
+
+	// by default the trailer is added after redaction
+	if got := streamFields(t, runPipeline(t, rule, nil, input), "content"); got != "hello[AI]" {
+		t.Errorf("default order content = %q", got)
+	}
+	rule.StreamPipeline = []string{"trailer", "redact"}
+	if got := streamFields(t, runPipeline(t, rule, nil, input), "content"); got != "hello[REDACTED]" {
+		t.Errorf("trailer-first content = %q", got)
+	}
+	rule.StreamPipeline = []string{}
+	if got := streamFields(t, runPipeline(t, rule, nil, input), "content"); got != "hello" {
+		t.Errorf("empty pipeline content = %q", got)
+	}
+}
+
+func TestValidateStreamPipeline(t *testing.T) {
+	for _, rule := range []ModelRule{
+		{StreamPipeline: []string{"stop", "nope"}},
+		{StreamPipeline: []string{"stop", "stop"}},
+		{ThinkRouting: "hide"},
+		{StreamPace: "fast"},
+	} {
+		rule.MatchModel = "m"
+		if err := validateModelRules([]ModelRule{rule}); err == nil {
+			t.Errorf("validateModelRules(%+v) succeeded, want error", rule)
+		}
+	}
+}
+
+func TestToolCallFixStageUsesRequestTools(t *testing.T) {
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", EnableToolCallFix: true}}}
+	input := chatStream("<tool_call>view<arg_key>path</arg_key><arg_value>42</arg_value><arg_key>limit</arg_key><arg_value>10</arg_value></tool_call>")
+	var tools any
+	_ = json.Unmarshal([]byte(`[{"type":"function","function":{"name":"view","parameters":{"type":"object","properties":{"path":{"type":"string"},"limit":{"type":"integer"}}}}}]`), &tools)
+
+	for _, tt := range []struct {
+		payload map[string]any
+		want    string
+	}{
+		{nil, `{"limit":10,"path":42}`},
+		{map[string]any{"tools": tools}, `{"limit":10,"path":"42"}`},
+	} {
+		stage := newToolCallFixStage(strings.NewReader(input), &streamRequest{ctx: context.Background(), cfg: cfg, rule: &cfg.ModelRules[0], payload: tt.payload, model: "m"})
+		out, _ := io.ReadAll(stage)
+		stage.Close()
+		if !strings.Contains(string(out), fmt.Sprintf("%q", tt.want)) {
+			t.Errorf("with payload %v: arguments are not %s:\n%s", tt.payload, tt.want, out)
+		}
+	}
+
+	// in strict mode a call the tools do not declare stays content
+	rule := &ModelRule{MatchModel: "m", EnableToolCallFix: true, ToolCallFixSchema: "strict"}
+	cfg.ModelRules = []ModelRule{*rule}
+	input = chatStream("<tool_call>rm<arg_key>path</arg_key><arg_value>/</arg_value></tool_call>")
+	stage := newToolCallFixStage(strings.NewReader(input), &streamRequest{ctx: context.Background(), cfg: cfg, rule: rule, payload: map[string]any{"tools": tools}, model: "m"})
+	out, _ := io.ReadAll(stage)
+	stage.Close()
+	if got := streamFields(t, string(out), "content"); !strings.HasPrefix(got, "<tool_call>rm") {
+		t.Errorf("strict mode content = %q, want the undeclared call as text", got)
+	}
+
+	// with toolcallfix_stream_args the arguments arrive in pieces
+	rule = &ModelRule{MatchModel: "m", EnableToolCallFix: true, ToolCallFixStreamArgs: true}
+	cfg.ModelRules = []ModelRule{*rule}
+	input = chatStream("<tool_call>view<arg_key>path</arg_key><arg_value>a", ".go</arg_value></tool_call>")
+	stage = newToolCallFixStage(strings.NewReader(input), &streamRequest{ctx: context.Background(), cfg: cfg, rule: rule, payload: map[string]any{"tools": tools}, model: "m"})
+	out, _ = io.ReadAll(stage)
+	stage.Close()
+	if n := strings.Count(string(out), `"tool_calls":[`); n != 3 {
+		t.Errorf("got %d tool call chunks, want the name and two argument deltas:\n%s", n, out)
+	}
+	if !strings.Contains(string(out), `"arguments":".go\"}"`) {
+		t.Errorf("last argument delta missing:\n%s", out)
+	}
+}
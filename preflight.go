@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PreflightConfig checks every upstream at startup. Until all checks pass
+// /health answers 503, so traffic is not routed to a relay with a bad config.
+type PreflightConfig struct {
+	WarmConnections int    `json:"warm_connections"` // connections (and TLS sessions) opened per upstream up front
+	APIKey          string `json:"api_key"`          // bearer key sent with the checks; defaults to upstream_options.api_key
+	RetryInterval   string `json:"retry_interval"`   // wait between rounds while a check fails (default "10s")
+}
+
+const defaultPreflightRetry = 10 * time.Second
+
+func validatePreflight(p *PreflightConfig) error {
+	if p == nil || p.RetryInterval == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(p.RetryInterval); err != nil || d <= 0 {
+		return fmt.Errorf("invalid preflight.retry_interval %q", p.RetryInterval)
+	}
+	return nil
+}
+
+type preflightTarget struct {
+	name   string
+	client *upstreamClient
+}
+
+type preflightResult struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// preflight runs the startup checks until they all pass.
+type preflight struct {
+	cfg     PreflightConfig
+	targets []preflightTarget
+	retry   time.Duration
+	ready   atomic.Bool
+
+	mu      sync.Mutex
+	results []preflightResult
+}
+
+func newPreflight(cfg PreflightConfig, targets []preflightTarget) *preflight {
+	p := &preflight{cfg: cfg, targets: targets, retry: defaultPreflightRetry}
+	if d, err := time.ParseDuration(cfg.RetryInterval); err == nil {
+		p.retry = d
+	}
+	for _, t := range targets {
+		if tr, ok := t.client.client.Transport.(*http.Transport); ok && cfg.WarmConnections > 0 {
+			// keep the warmed connections instead of closing all but two
+			tr.MaxIdleConnsPerHost = max(tr.MaxIdleConnsPerHost, cfg.WarmConnections)
+		}
+	}
+	return p
+}
+
+func (p *preflight) run(ctx context.Context) {
+	for round := 1; ; round++ {
+		results := make([]preflightResult, len(p.targets))
+		var wg sync.WaitGroup
+		for i, t := range p.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = p.check(ctx, t)
+			}()
+		}
+		wg.Wait()
+
+		p.mu.Lock()
+		p.results = results
+		p.mu.Unlock()
+		failed := 0
+		for _, res := range results {
+			if !res.OK {
+				failed++
+				logf(slog.LevelWarn, "PREFLIGHT: %s failed: %s", res.Name, res.Error)
+			}
+		}
+		if failed == 0 {
+			p.ready.Store(true)
+			logf(slog.LevelInfo, "PREFLIGHT: %d upstream(s) passed, ready", len(results))
+			return
+		}
+		logf(slog.LevelWarn, "PREFLIGHT: round %d: %d of %d upstream(s) failed, retrying in %s", round, failed, len(results), p.retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.retry):
+		}
+	}
+}
+
+// check sends GET /v1/models over warm_connections parallel requests, which
+// leaves that many established connections in the pool. Transport errors
+// and rejected credentials fail the check; other statuses only prove the
+// upstream answers.
+func (p *preflight) check(ctx context.Context, t preflightTarget) preflightResult {
+	res := preflightResult{Name: t.name}
+	n := max(p.cfg.WarmConnections, 1)
+	statuses := make([]int, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], errs[i] = p.probe(ctx, t.client)
+		}()
+	}
+	wg.Wait()
+	for i := range n {
+		if errs[i] != nil {
+			res.Error = errs[i].Error()
+			return res
+		}
+		res.StatusCode = statuses[i]
+		if statuses[i] == http.StatusUnauthorized || statuses[i] == http.StatusForbidden {
+			res.Error = fmt.Sprintf("credentials rejected with status %d", statuses[i])
+			return res
+		}
+	}
+	res.OK = true
+	return res
+}
+
+func (p *preflight) probe(ctx context.Context, c *upstreamClient) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.target(&url.URL{Path: "/v1/models"}).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = c.host()
+	key := p.cfg.APIKey
+	if key == "" {
+		key = c.apiKey()
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain so the connection goes back to the pool
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// status returns the latest results and whether every check has passed.
+func (p *preflight) status() ([]preflightResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.results, p.ready.Load()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreflightGatesHealth(t *testing.T) {
+	var accept atomic.Bool
+	var probes atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer sk-check" || !accept.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		time.Sleep(20 * time.Millisecond) // overlap the probes so each needs a connection
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Upstream: upstream.URL, Admin: &AdminConfig{Token: "admin"}, Preflight: &PreflightConfig{
+		WarmConnections: 3,
+		APIKey:          "sk-check",
+		RetryInterval:   "20ms",
+	}}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	health := func() (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		return w.Code, w.Body.String()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for probes.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code, body := health(); code != http.StatusServiceUnavailable || body != "starting" {
+		t.Fatalf("/health with rejected credentials = %d %q", code, body)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/healthz/details", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	mux.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"status":"starting"`) || !strings.Contains(w.Body.String(), "credentials rejected") {
+		t.Errorf("details = %s", w.Body.String())
+	}
+
+	accept.Store(true)
+	for time.Now().Before(deadline) {
+		if code, _ := health(); code == http.StatusOK {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code, body := health(); code != http.StatusOK {
+		t.Fatalf("/health after preflight passed = %d %q", code, body)
+	}
+	if n := upstreamFor(cfg, parseURLTest(upstream.URL)).transportReport().IdleConns; n < 3 {
+		t.Errorf("idle connections = %d, want at least 3 warmed", n)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ModelPrice is what a model's tokens cost, per million. The currency is
+// whatever the table is written in; the relay only multiplies.
+type ModelPrice struct {
+	Model  string  `json:"model"`  // exact name or glob such as "gpt-4o*"
+	Input  float64 `json:"input"`  // per million prompt tokens
+	Output float64 `json:"output"` // per million completion tokens
+}
+
+var costTotal = metrics.newCounterVec("relay_cost_total",
+	"Cost of the tokens used, from the prices table.", "tenant", "client", "model")
+
+func validatePrices(prices []ModelPrice) error {
+	seen := map[string]bool{}
+	for i, p := range prices {
+		if p.Model == "" {
+			return fmt.Errorf("prices[%d]: model is required", i)
+		}
+		if isGlob(p.Model) {
+			if _, err := path.Match(p.Model, ""); err != nil {
+				return fmt.Errorf("prices[%d]: invalid model pattern %q: %w", i, p.Model, err)
+			}
+		}
+		if seen[p.Model] {
+			return fmt.Errorf("prices[%d]: duplicate model %q", i, p.Model)
+		}
+		seen[p.Model] = true
+		if p.Input < 0 || p.Output < 0 {
+			return fmt.Errorf("prices[%d]: prices must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// findPrice returns the price of model. As with model rules, an exact name
+// wins over globs, and among globs the first one listed.
+func findPrice(prices []ModelPrice, model string) *ModelPrice {
+	for i := range prices {
+		if prices[i].Model == model {
+			return &prices[i]
+		}
+	}
+	for i := range prices {
+		if isGlob(prices[i].Model) {
+			if ok, _ := path.Match(prices[i].Model, model); ok {
+				return &prices[i]
+			}
+		}
+	}
+	return nil
+}
+
+// requestCost prices usage by the model the client asked for, or else by
+// the model the rules sent upstream. ok is false when neither is priced.
+func requestCost(prices []ModelPrice, model, upstreamModel string, usage tokenUsage) (cost float64, ok bool) {
+	p := findPrice(prices, model)
+	if p == nil && upstreamModel != "" {
+		p = findPrice(prices, upstreamModel)
+	}
+	if p == nil {
+		return 0, false
+	}
+	return (float64(usage.PromptTokens)*p.Input + float64(usage.CompletionTokens)*p.Output) / 1e6, true
+}
+
+type costRow struct {
+	Tenant string  `json:"tenant"`
+	Client string  `json:"client"`
+	Model  string  `json:"model"`
+	Cost   float64 `json:"cost"`
+}
+
+// handleCosts serves GET /admin/costs: the cost accrued since the relay
+// started, per tenant, client and model. It reads relay_cost_total, so it
+// always agrees with /metrics.
+func handleCosts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		client, model := r.URL.Query().Get("client"), r.URL.Query().Get("model")
+		data := []costRow{}
+		var total float64
+		costTotal.each(func(lv []string, v float64) {
+			if (client != "" && lv[1] != client) || (model != "" && lv[2] != model) {
+				return
+			}
+			data = append(data, costRow{Tenant: lv[0], Client: lv[1], Model: lv[2], Cost: v})
+			total += v
+		})
+		slices.SortFunc(data, func(a, b costRow) int {
+			return strings.Compare(a.Tenant+"\x00"+a.Client+"\x00"+a.Model, b.Tenant+"\x00"+b.Client+"\x00"+b.Model)
+		})
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data, "total": total})
+	}
+}
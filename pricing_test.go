@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestCost(t *testing.T) {
+	prices := []ModelPrice{
+		{Model: "gpt-4o*", Input: 5, Output: 15},
+		{Model: "gpt-*", Input: 1, Output: 1},
+		{Model: "gpt-4o-mini", Input: 0.15, Output: 0.6},
+		{Model: "qwen3", Input: 0.5, Output: 1},
+	}
+	usage := tokenUsage{PromptTokens: 2000, CompletionTokens: 1000}
+	tests := []struct {
+		model, upstream string
+		want            float64
+		priced          bool
+	}{
+		{"gpt-4o-mini", "", 0.0009, true},  // exact beats globs
+		{"gpt-4o-2024", "", 0.025, true},   // first glob listed
+		{"gpt-3.5", "", 0.003, true},       // second glob
+		{"my-alias", "qwen3", 0.002, true}, // priced by the upstream model
+		{"my-alias", "llama", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := requestCost(prices, tt.model, tt.upstream, usage)
+		if ok != tt.priced || fmt.Sprintf("%.6f", got) != fmt.Sprintf("%.6f", tt.want) {
+			t.Errorf("%s/%s: %v %v, want %v %v", tt.model, tt.upstream, got, ok, tt.want, tt.priced)
+		}
+	}
+
+	for _, bad := range [][]ModelPrice{
+		{{Input: 1}},
+		{{Model: "gpt-[", Input: 1}},
+		{{Model: "a", Input: -1}},
+		{{Model: "a"}, {Model: "a"}},
+	} {
+		if validatePrices(bad) == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+}
+
+func TestCostAccounting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`)
+	}))
+	defer upstream.Close()
+	cfg := &Config{
+		Upstream:    upstream.URL,
+		Admin:       &AdminConfig{Token: "admin"},
+		ClientKeys:  []ClientKey{{Key: "sk-costly", Name: "costly"}},
+		ModelRules:  []ModelRule{{MatchModel: "priced-*"}, {MatchModel: "free"}},
+		Prices:      []ModelPrice{{Model: "priced-*", Input: 2, Output: 10}},
+		UsageLedger: &UsageLedgerConfig{},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := loggingMiddleware(mux)
+	for _, model := range []string{"priced-a", "priced-a", "free"} {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		r.Header.Set("Authorization", "Bearer sk-costly")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// 2 * (1000*2 + 500*10) / 1e6
+	if got := costTotal.Value(defaultTenant, "costly", "priced-*"); fmt.Sprintf("%.4f", got) != "0.0140" {
+		t.Errorf("relay_cost_total = %v", got)
+	}
+	if got := costTotal.Value(defaultTenant, "costly", "free"); got != 0 {
+		t.Errorf("unpriced model cost %v", got)
+	}
+
+	admin := func(path string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+	var costs struct {
+		Data  []costRow `json:"data"`
+		Total float64   `json:"total"`
+	}
+	if err := json.Unmarshal([]byte(admin("/admin/costs?client=costly")), &costs); err != nil {
+		t.Fatal(err)
+	}
+	if len(costs.Data) != 1 || costs.Data[0].Model != "priced-*" || fmt.Sprintf("%.4f", costs.Total) != "0.0140" {
+		t.Errorf("/admin/costs: %+v", costs)
+	}
+	if body := admin("/admin/usage?model=priced-a&group_by=client"); !strings.Contains(body, `"cost":0.014`) {
+		t.Errorf("/admin/usage: %s", body)
+	}
+}
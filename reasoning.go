@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// ReasoningConfig maps the client's generic reasoning_effort onto the knob
+// the upstream provider understands.
+type ReasoningConfig struct {
+	Provider string         `json:"provider"` // "openai", "anthropic" or "qwen"
+	Budgets  map[string]int `json:"budgets"`  // thinking tokens per effort, overrides defaultReasoningBudgets
+}
+
+// defaultReasoningBudgets are the thinking budgets for providers that take
+// a token count instead of an effort level.
+var defaultReasoningBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     2048,
+	"medium":  8192,
+	"high":    24576,
+}
+
+func validateReasoning(c *ReasoningConfig) error {
+	switch c.Provider {
+	case "openai", "anthropic", "qwen":
+	default:
+		return fmt.Errorf("unknown reasoning.provider %q", c.Provider)
+	}
+	for effort, budget := range c.Budgets {
+		if _, ok := defaultReasoningBudgets[effort]; !ok {
+			return fmt.Errorf("unknown reasoning effort %q in reasoning.budgets", effort)
+		}
+		if budget <= 0 {
+			return fmt.Errorf("reasoning.budgets.%s must be positive", effort)
+		}
+	}
+	return nil
+}
+
+// budget returns the thinking tokens for effort.
+func (c *ReasoningConfig) budget(effort string) int {
+	if b, ok := c.Budgets[effort]; ok {
+		return b
+	}
+	return defaultReasoningBudgets[effort]
+}
+
+// applyReasoning rewrites reasoning_effort ("none", "minimal", "low",
+// "medium" or "high") for the rule's provider. Unknown efforts are left
+// for the upstream to reject.
+func applyReasoning(c *ReasoningConfig, req map[string]any) {
+	effort := getString(req, "reasoning_effort")
+	if effort == "" {
+		return
+	}
+	if _, ok := defaultReasoningBudgets[effort]; !ok && effort != "none" {
+		vlog("RULE: unknown reasoning_effort %q, passing it through", effort)
+		return
+	}
+
+	switch c.Provider {
+	case "openai":
+		// o-series models reason unless told otherwise and know no "none"
+		if effort == "none" {
+			delete(req, "reasoning_effort")
+		}
+		return
+	case "anthropic":
+		if effort == "none" {
+			req["thinking"] = map[string]any{"type": "disabled"}
+		} else {
+			budget := c.budget(effort)
+			req["thinking"] = map[string]any{"type": "enabled", "budget_tokens": budget}
+			// max_tokens includes thinking and must exceed the budget, so
+			// keep the client's allowance for the answer on top of it
+			if maxTokens, ok := req["max_tokens"].(float64); ok && int(maxTokens) <= budget {
+				req["max_tokens"] = budget + int(maxTokens)
+			}
+		}
+	case "qwen":
+		fields := map[string]any{"enable_thinking": effort != "none"}
+		if effort != "none" {
+			fields["thinking_budget"] = c.budget(effort)
+		}
+		mergeInto(req, "extra", fields)
+	}
+	vlog("RULE: mapped reasoning_effort %q for %s", effort, c.Provider)
+	delete(req, "reasoning_effort")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyReasoning(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ReasoningConfig
+		req  string
+		want string
+	}{
+		{"openai passes effort", ReasoningConfig{Provider: "openai"},
+			`{"reasoning_effort":"high"}`, `{"reasoning_effort":"high"}`},
+		{"openai drops none", ReasoningConfig{Provider: "openai"},
+			`{"reasoning_effort":"none"}`, `{}`},
+		{"anthropic budget", ReasoningConfig{Provider: "anthropic"},
+			`{"reasoning_effort":"medium","max_tokens":20000}`,
+			`{"max_tokens":20000,"thinking":{"budget_tokens":8192,"type":"enabled"}}`},
+		{"anthropic keeps answer allowance", ReasoningConfig{Provider: "anthropic", Budgets: map[string]int{"low": 4000}},
+			`{"reasoning_effort":"low","max_tokens":1000}`,
+			`{"max_tokens":5000,"thinking":{"budget_tokens":4000,"type":"enabled"}}`},
+		{"anthropic none", ReasoningConfig{Provider: "anthropic"},
+			`{"reasoning_effort":"none"}`, `{"thinking":{"type":"disabled"}}`},
+		{"qwen into extra", ReasoningConfig{Provider: "qwen"},
+			`{"reasoning_effort":"high","extra":{"keep":1}}`,
+			`{"extra":{"enable_thinking":true,"keep":1,"thinking_budget":24576}}`},
+		{"qwen none", ReasoningConfig{Provider: "qwen"},
+			`{"reasoning_effort":"none"}`, `{"extra":{"enable_thinking":false}}`},
+		{"unknown effort untouched", ReasoningConfig{Provider: "qwen"},
+			`{"reasoning_effort":"extreme"}`, `{"reasoning_effort":"extreme"}`},
+		{"no effort", ReasoningConfig{Provider: "anthropic"}, `{"model":"m"}`, `{"model":"m"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req map[string]any
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			applyReasoning(&tt.cfg, req)
+			got, _ := json.Marshal(req)
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReasoningAppliedAfterSet(t *testing.T) {
+	cfg := &Config{ModelRules: []ModelRule{{
+		MatchModel: "claude",
+		Set:        map[string]any{"reasoning_effort": "low"},
+		Reasoning:  &ReasoningConfig{Provider: "anthropic"},
+	}}}
+	req := map[string]any{"model": "claude"}
+	applyRules(cfg, req)
+	thinking, _ := req["thinking"].(map[string]any)
+	if thinking["budget_tokens"] != 2048 || req["reasoning_effort"] != nil {
+		t.Errorf("request = %v", req)
+	}
+}
+
+func TestValidateReasoning(t *testing.T) {
+	for _, c := range []ReasoningConfig{
+		{Provider: "gemini"},
+		{Provider: "qwen", Budgets: map[string]int{"extreme": 100}},
+		{Provider: "anthropic", Budgets: map[string]int{"low": 0}},
+	} {
+		if err := validateModelRules([]ModelRule{{MatchModel: "m", Reasoning: &c}}); err == nil {
+			t.Errorf("validateModelRules(%+v) succeeded, want error", c)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers shared by relays deployed in front of one another (an edge relay
+// forwarding to a central one).
+const (
+	// relayHopsHeader counts the relays a request has passed. Each relay
+	// forwards one more than it received and refuses requests that went
+	// around too often, so a misconfigured pair cannot loop forever.
+	relayHopsHeader = "X-Relay-Hops"
+	// toolCallFixMarkerHeader is set on responses whose tool calls a relay
+	// already converted. A relay further out sees it on its upstream's
+	// response and leaves the calls alone.
+	toolCallFixMarkerHeader = "X-Relay-Toolcallfix"
+	// upstreamRequestIDHeader keeps the upstream's own request ID when it
+	// differs from the one the client sent.
+	upstreamRequestIDHeader = "X-Upstream-Request-Id"
+	requestIDHeader         = "X-Request-Id"
+)
+
+// defaultMaxRelayHops is generous for edge → central → provider layouts
+// while still catching a relay that points at itself.
+const defaultMaxRelayHops = 8
+
+var relayHopLimitRejectionsTotal = metrics.newCounterVec("relay_hop_limit_rejections_total",
+	"Requests refused because they already passed max_relay_hops relays.", "path")
+
+func validateRelayHops(cfg *Config) error {
+	if cfg.MaxRelayHops < 0 {
+		return errors.New("max_relay_hops must not be negative")
+	}
+	return nil
+}
+
+// relayHops parses the hop count a request arrived with; a missing or
+// malformed header counts as a request straight from a client.
+func relayHops(r *http.Request) int {
+	n, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(relayHopsHeader)))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// relayChain counts the request as one more hop, which every upstream
+// request copying the client's headers carries on, and merges the request
+// IDs of the relays behind it into the one the client sent.
+func relayChain(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	limit := cfg.MaxRelayHops
+	if limit == 0 {
+		limit = defaultMaxRelayHops
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		hops := relayHops(r)
+		if hops >= limit {
+			vlogCtx(r.Context(), "RELAY: refusing request after %d relay hops", hops)
+			relayHopLimitRejectionsTotal.Inc(r.URL.Path)
+			writeJSONError(w, http.StatusLoopDetected,
+				"request passed "+strconv.Itoa(hops)+" relays; check that no relay forwards to itself",
+				"invalid_request_error", "relay_loop_detected")
+			return
+		}
+		r.Header.Set(relayHopsHeader, strconv.Itoa(hops+1))
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			w = &requestIDWriter{ResponseWriter: w, id: id}
+		}
+		next(w, r)
+	}
+}
+
+// requestIDWriter makes the response carry the client's request ID exactly
+// once. Relays behind this one echo the ID they were forwarded; an upstream
+// that assigns its own is kept in X-Upstream-Request-Id rather than being
+// added as a second X-Request-Id.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id          string
+	wroteHeader bool
+}
+
+func (rw *requestIDWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		h := rw.Header()
+		var others []string
+		for _, v := range h.Values(requestIDHeader) {
+			if v != rw.id {
+				others = append(others, v)
+			}
+		}
+		if len(others) > 0 && h.Get(upstreamRequestIDHeader) == "" {
+			h.Set(upstreamRequestIDHeader, strings.Join(others, ", "))
+		}
+		h.Set(requestIDHeader, rw.id)
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *requestIDWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *requestIDWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. for the
+// write deadlines of slow client handling.
+func (rw *requestIDWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// toolCallsFixedUpstream reports whether a relay behind this one already
+// converted the response's tool calls.
+func toolCallsFixedUpstream(resp *http.Response) bool {
+	return resp.Header.Get(toolCallFixMarkerHeader) != ""
+}
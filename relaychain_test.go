@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRelayChain(t *testing.T) {
+	var modelHops []string
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modelHops = append(modelHops, r.Header.Get(relayHopsHeader))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set(requestIDHeader, "provider-1")
+		fmt.Fprint(w, chatStream("Checking.", "<tool_call>get_weather<arg_key>city</arg_key>", "<arg_value>Paris</arg_value></tool_call>"))
+		w.(http.Flusher).Flush()
+	}))
+	defer model.Close()
+
+	rules := []ModelRule{{MatchModel: "glm", EnableToolCallFix: true}}
+	central, err := newRelayMux(&Config{Upstream: model.URL, ModelRules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	centralServer := httptest.NewServer(central)
+	defer centralServer.Close()
+	edge, err := newRelayMux(&Config{Upstream: centralServer.URL, ModelRules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"glm","stream":true}`))
+	r.Header.Set(requestIDHeader, "client-1")
+	edge.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if len(modelHops) != 1 || modelHops[0] != "2" {
+		t.Errorf("hops seen by the model: %v", modelHops)
+	}
+	out := w.Body.String()
+	if strings.Contains(out, "<tool_call>") || strings.Count(out, `"name":"get_weather"`) != 1 {
+		t.Errorf("tool call not converted exactly once:\n%s", out)
+	}
+	if got := w.Header().Get(toolCallFixMarkerHeader); got == "" {
+		t.Error("response lacks the toolcallfix marker")
+	}
+	if got := w.Header().Values(requestIDHeader); len(got) != 1 || got[0] != "client-1" {
+		t.Errorf("X-Request-Id: %v", got)
+	}
+	if got := w.Header().Get(upstreamRequestIDHeader); got != "provider-1" {
+		t.Errorf("X-Upstream-Request-Id: %q", got)
+	}
+}
+
+func TestRelayChainHonorsUpstreamMarker(t *testing.T) {
+	// the upstream claims it already converted the calls, so the markup it
+	// sends is left as it is
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(toolCallFixMarkerHeader, "applied")
+		fmt.Fprint(w, chatStream("<tool_call>get_weather<arg_key>city</arg_key><arg_value>Paris</arg_value></tool_call>"))
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL, ModelRules: []ModelRule{{MatchModel: "glm", EnableToolCallFix: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"glm","stream":true}`)))
+	if strings.Contains(w.Body.String(), `"tool_calls"`) || !strings.Contains(w.Body.String(), `tool_call\u003eget_weather`) {
+		t.Errorf("stream converted again:\n%s", w.Body)
+	}
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	var called bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL, MaxRelayHops: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	r.Header.Set(relayHopsHeader, "3")
+	mux.ServeHTTP(w, r)
+	body, _ := io.ReadAll(w.Body)
+	if w.Code != http.StatusLoopDetected || !strings.Contains(string(body), "relay_loop_detected") || called {
+		t.Errorf("status %d, upstream called %v: %s", w.Code, called, body)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReloadConfig enables watching the config file in addition to SIGHUP.
+type ReloadConfig struct {
+	Watch    bool   `json:"watch"`    // reload when the file changes
+	Interval string `json:"interval"` // how often to check the file, default "2s"
+}
+
+const defaultReloadInterval = 2 * time.Second
+
+func validateReload(c *ReloadConfig) error {
+	if c == nil || c.Interval == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+		return fmt.Errorf("invalid reload.interval %q", c.Interval)
+	}
+	return nil
+}
+
+// liveRules holds the model rules in effect. Handlers look rules up on
+// every request, so a reload takes effect for new requests while streams
+// in flight keep the rule they started with.
+type liveRules struct {
+	rules atomic.Pointer[[]ModelRule]
+}
+
+func newLiveRules(rules []ModelRule) *liveRules {
+	l := &liveRules{}
+	l.rules.Store(&rules)
+	return l
+}
+
+// rules returns the model rules currently in effect for c.
+func (c *Config) rules() []ModelRule {
+	if c.live != nil {
+		return *c.live.rules.Load()
+	}
+	return c.ModelRules
+}
+
+// configReloader re-reads the config file and swaps in its model rules.
+// Other settings are fixed at startup; changes to them are only logged.
+type configReloader struct {
+	path string
+	cfg  *Config
+
+	mu      sync.Mutex
+	current *Config // last config loaded from path
+	modTime time.Time
+}
+
+func newConfigReloader(path string, cfg *Config) *configReloader {
+	r := &configReloader{path: path, cfg: cfg, current: cfg}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	return r
+}
+
+// reload loads the file and, when it is valid, swaps in its rules.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fi, err := os.Stat(r.path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	next, err := loadConfigJSONC(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.cfg.live.rules.Store(&next.ModelRules)
+	tenants := map[string]TenantConfig{}
+	for _, tc := range next.Tenants {
+		tenants[tc.Name] = tc
+	}
+	for name, live := range r.cfg.tenantRules {
+		tc, ok := tenants[name]
+		if !ok {
+			logf(slog.LevelWarn, "RELOAD: tenant %q was removed; restart to drop it, keeping its rules", name)
+			continue
+		}
+		rules := next.ModelRules
+		if tc.ModelRules != nil {
+			rules = tc.ModelRules
+		}
+		live.rules.Store(&rules)
+	}
+	if !sameStartupSettings(r.current, next) {
+		logf(slog.LevelWarn, "RELOAD: settings other than model_rules changed; restart to apply them")
+	}
+	r.current = next
+	logf(slog.LevelInfo, "RELOAD: loaded %d model rule(s) from %s", len(next.ModelRules), r.path)
+	return nil
+}
+
+// sameStartupSettings reports whether a and b differ only in model rules.
+func sameStartupSettings(a, b *Config) bool {
+	strip := func(c *Config) string {
+		cp := *c
+		cp.ModelRules, cp.live, cp.tenantRules = nil, nil, nil
+		cp.Tenants = append([]TenantConfig(nil), c.Tenants...)
+		for i := range cp.Tenants {
+			cp.Tenants[i].ModelRules = nil
+		}
+		b, _ := json.Marshal(cp)
+		return string(b)
+	}
+	return strip(a) == strip(b)
+}
+
+// changed reports whether the file was modified since the last load.
+func (r *configReloader) changed() bool {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !fi.ModTime().Equal(r.modTime)
+}
+
+// run reloads on SIGHUP and, with reload.watch, when the file changes.
+func (r *configReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if rc := r.cfg.Reload; rc != nil && rc.Watch {
+		interval := defaultReloadInterval
+		if d, err := time.ParseDuration(rc.Interval); err == nil {
+			interval = d
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		trigger := "SIGHUP"
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+			trigger = "file change"
+		}
+		err := r.reload()
+		if err != nil {
+			logf(slog.LevelError, "RELOAD: keeping the current config: %v", err)
+		}
+		r.audit(trigger, err)
+	}
+}
+
+// audit records a reload attempt in the audit log, if there is one.
+func (r *configReloader) audit(trigger string, err error) {
+	details := map[string]any{"trigger": trigger, "path": r.path, "ok": err == nil}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	r.cfg.audit.record(auditEntry{Actor: "system", Action: "config.reload", Details: details})
+}
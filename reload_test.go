@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigReloadSwapsRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.jsonc")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{
+		"upstream": "http://127.0.0.1:1",
+		"model_rules": [{"match_model": "m", "set": {"temperature": 0.1}}],
+		"tenants": [
+			{"name": "a", "keys": ["sk-a"], "model_rules": [{"match_model": "m", "set": {"temperature": 0.2}}]},
+			{"name": "b", "keys": ["sk-b"]}
+		]
+	}`)
+	cfg, err := loadConfigJSONC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRelayMux(cfg); err != nil {
+		t.Fatal(err)
+	}
+	temperature := func(c *Config) any {
+		rule := resolveRule(c, "m")
+		if rule == nil {
+			return nil
+		}
+		return rule.Set["temperature"]
+	}
+	tenant := func(name string) *Config { return &Config{live: cfg.tenantRules[name]} }
+
+	inFlight := resolveRule(cfg, "m")
+	write(`{
+		"upstream": "http://127.0.0.1:1",
+		"model_rules": [{"match_model": "m", "set": {"temperature": 0.5}}],
+		"tenants": [
+			{"name": "a", "keys": ["sk-a"], "model_rules": [{"match_model": "m", "set": {"temperature": 0.6}}]},
+			{"name": "b", "keys": ["sk-b"]}
+		]
+	}`)
+	r := newConfigReloader(path, cfg)
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload() failed: %v", err)
+	}
+	if got := temperature(cfg); got != 0.5 {
+		t.Errorf("top-level temperature = %v, want 0.5", got)
+	}
+	if got := temperature(tenant("a")); got != 0.6 {
+		t.Errorf("tenant a temperature = %v, want 0.6", got)
+	}
+	if got := temperature(tenant("b")); got != 0.5 {
+		t.Errorf("tenant b (inherits) temperature = %v, want 0.5", got)
+	}
+	if inFlight.Set["temperature"] != 0.1 {
+		t.Errorf("rule held by an in-flight request changed to %v", inFlight.Set["temperature"])
+	}
+
+	write(`{"upstream": "http://127.0.0.1:1", "model_rules": [{"match_model": "m", "prompt_template": "nope"}]}`)
+	if err := r.reload(); err == nil {
+		t.Error("reload() of an invalid config succeeded")
+	}
+	if got := temperature(cfg); got != 0.5 {
+		t.Errorf("temperature after failed reload = %v, want 0.5", got)
+	}
+}
+
+func TestConfigReloadWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.jsonc")
+	if err := os.WriteFile(path, []byte(`{"upstream":"http://127.0.0.1:1","reload":{"watch":true,"interval":"10ms"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigJSONC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRelayMux(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newConfigReloader(path, cfg).run(ctx)
+
+	if err := os.WriteFile(path, []byte(`{"upstream":"http://127.0.0.1:1","reload":{"watch":true,"interval":"10ms"},"model_rules":[{"match_model":"new"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// make the change visible even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for resolveRule(cfg, "new") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("watched config change was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestConcurrentReloadAndToggles runs requests while rules are reloaded and
+// runtime toggles flip; run it with -race.
+func TestConcurrentReloadAndToggles(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer setDebugLogging(false)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"choices": []any{}})
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.jsonc")
+	config := func(temperature float64) string {
+		return fmt.Sprintf(`{
+			"upstream": %q,
+			"admin": {"token": "admin"},
+			"model_rules": [{
+				"match_model": "m",
+				"set": {"temperature": %v, "chat_template_kwargs": {"thinking": true}},
+				"merge": {"chat_template_kwargs": {"effort": "low"}}
+			}]
+		}`, upstream.URL, temperature)
+	}
+	if err := os.WriteFile(path, []byte(config(0.1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigJSONC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(path, cfg)
+	admin := func(method, path, body string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Errorf("request got status %d", w.Code)
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			_ = os.WriteFile(path, []byte(config(float64(j)/10)), 0o644)
+			if err := reloader.reload(); err != nil {
+				t.Errorf("reload() failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			admin("PUT", "/admin/verbose", fmt.Sprintf(`{"enabled":%v}`, j%2 == 0))
+			admin("PUT", "/admin/toolcallfix/m", fmt.Sprintf(`{"enabled":%v}`, j%2 == 1))
+		}
+		admin("DELETE", "/admin/toolcallfix/m", "")
+	}()
+	wg.Wait()
+
+	// requests got copies of the rule's objects, never the rule's own maps
+	rule := resolveRule(cfg, "m")
+	if kwargs := rule.Set["chat_template_kwargs"].(map[string]any); len(kwargs) != 1 {
+		t.Errorf("rule's chat_template_kwargs modified by requests: %v", kwargs)
+	}
+}
+
+func TestAdminVerbose(t *testing.T) {
+	defer setDebugLogging(false)
+	mux, err := newRelayMux(&Config{Upstream: "http://127.0.0.1:1", Admin: &AdminConfig{Token: "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, body string) (int, bool) {
+		r := httptest.NewRequest(method, "/admin/verbose", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var got struct {
+			Enabled bool `json:"enabled"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &got)
+		return w.Code, got.Enabled
+	}
+	if code, enabled := send("PUT", `{"enabled":true}`); code != http.StatusOK || !enabled || !debugLogging() {
+		t.Errorf("PUT enabled=true: status %d, enabled %v", code, enabled)
+	}
+	if code, _ := send("PUT", `{}`); code != http.StatusBadRequest {
+		t.Errorf("PUT without enabled: status %d, want 400", code)
+	}
+	if code, enabled := send("GET", ""); code != http.StatusOK || !enabled {
+		t.Errorf("GET: status %d, enabled %v", code, enabled)
+	}
+	if code, _ := send("DELETE", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d, want 405", code)
+	}
+}
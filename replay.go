@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxReplayDiffCells caps the line diff of a replay; longer outputs are only
+// compared for equality.
+const maxReplayDiffCells = 4 << 20
+
+// replayRequest is the optional body of POST /admin/transcripts/{id}/replay.
+type replayRequest struct {
+	Model    string `json:"model"`    // replaces the model of the stored request
+	Tenant   string `json:"tenant"`   // run as this tenant instead of the original one
+	Upstream string `json:"upstream"` // send straight to this base URL, skipping model rules
+	APIKey   string `json:"api_key"`  // bearer token for upstream
+}
+
+// replaySide is one run of a request as the replay answer shows it.
+type replaySide struct {
+	Model      string `json:"model"`
+	Tenant     string `json:"tenant"`
+	Upstream   string `json:"upstream,omitempty"`
+	Status     int    `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Text       string `json:"text"`
+	Response   string `json:"response,omitempty"`
+}
+
+// handleReplay serves POST /admin/transcripts/{id}/replay. The stored request
+// runs again, through the relay as its tenant or straight against another
+// upstream, and the answer compares the assistant text of both runs:
+//
+//	{"id": "...", "original": {...}, "replay": {...}, "identical": false, "diff": ["  a", "- b", "+ c"]}
+//
+// Replays skip the transcript store and usage accounting, so they do not
+// show up as client traffic.
+func handleReplay(store *transcriptStore, handlers map[string]http.HandlerFunc, tenants *tenantRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t := store.get(r.PathValue("id"))
+		if t == nil {
+			writeJSONError(w, http.StatusNotFound, "transcript not found", "invalid_request_error", "not_found")
+			return
+		}
+		var opts replayRequest
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "invalid replay options: "+err.Error(), "invalid_request_error", "invalid_body")
+			return
+		}
+		handler := handlers[t.Path]
+		if handler == nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "cannot replay requests to "+t.Path, "invalid_request_error", "not_replayable")
+			return
+		}
+		var body map[string]any
+		if err := json.Unmarshal([]byte(t.Request), &body); err != nil || body == nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "the stored request is not a complete JSON object (truncated?)", "invalid_request_error", "not_replayable")
+			return
+		}
+		if opts.Model != "" {
+			body["model"] = opts.Model
+		}
+		payload, _ := json.Marshal(body)
+
+		side := replaySide{Model: getString(body, "model"), Tenant: t.Tenant}
+		if opts.Tenant != "" {
+			side.Tenant = opts.Tenant
+		}
+		ctx := r.Context()
+		if side.Tenant != defaultTenant {
+			tn := tenants.byName(side.Tenant)
+			if tn == nil {
+				writeJSONError(w, http.StatusNotFound, "unknown tenant "+side.Tenant, "invalid_request_error", "unknown_tenant")
+				return
+			}
+			ctx = context.WithValue(ctx, tenantContextKey{}, tn)
+		}
+
+		req := r.Clone(ctx)
+		req.URL.Path = t.Path
+		req.Header = http.Header{"Content-Type": {"application/json"}} // the admin token is not for the upstream
+		if t.Conversation != "" {
+			req.Header.Set(conversationHeader, t.Conversation)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(payload))
+		req.ContentLength = int64(len(payload))
+
+		start := time.Now()
+		var status int
+		var response []byte
+		if opts.Upstream != "" {
+			up, err := url.Parse(opts.Upstream)
+			if err != nil || up.Host == "" {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid upstream %q", opts.Upstream), "invalid_request_error", "invalid_parameter")
+				return
+			}
+			side.Upstream = up.Redacted()
+			resp, err := sendJSONUpstream(req, upstreamFor(&Config{}, up), &url.URL{Path: t.Path}, &ModelRule{APIKey: opts.APIKey}, false, payload)
+			if err != nil {
+				writeJSONError(w, http.StatusBadGateway, "replay failed: "+err.Error(), "api_error", "upstream_error")
+				return
+			}
+			response, _ = io.ReadAll(io.LimitReader(resp.Body, maxDebugBytes))
+			_ = resp.Body.Close()
+			status = resp.StatusCode
+		} else {
+			rec := &captureWriter{ResponseWriter: debugSink{header: http.Header{}}, limit: maxDebugBytes}
+			handler(rec, req)
+			status, response = rec.status, rec.buf.Bytes()
+		}
+		side.Status = status
+		side.DurationMs = time.Since(start).Milliseconds()
+		stream, _ := body["stream"].(bool)
+		side.Text = store.redactText(extractResponseText(string(response), stream))
+		side.Response = store.redactBody(string(response))
+
+		out := map[string]any{
+			"id": t.ID,
+			"original": replaySide{
+				Model:      t.Model,
+				Tenant:     t.Tenant,
+				Status:     t.Status,
+				DurationMs: t.DurationMs,
+				Text:       t.ResponseText,
+			},
+			"replay":    side,
+			"identical": side.Text == t.ResponseText,
+		}
+		if side.Text != t.ResponseText {
+			if diff := diffLines(t.ResponseText, side.Text); diff != nil {
+				out["diff"] = diff
+			}
+		}
+		// replaying a redacted request sends the placeholders upstream
+		if strings.Contains(t.Request, redactedValue) {
+			out["redacted"] = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(out)
+	}
+}
+
+// diffLines is a line diff of a and b: common lines start with two spaces,
+// removed ones with "- " and added ones with "+ ". It returns nil when the
+// texts are too long to diff.
+func diffLines(a, b string) []string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(x)*len(y) > maxReplayDiffCells {
+		return nil
+	}
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			diff = append(diff, "  "+x[i])
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+x[i])
+			i++
+		default:
+			diff = append(diff, "+ "+y[j])
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("a\nb\nc\nd", "a\nc\nx\nd")
+	want := []string{"  a", "- b", "  c", "+ x", "  d"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := diffLines("old", "new"); !slices.Equal(got, []string{"- old", "+ new"}) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var backendAuth string
+	answer := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			backendAuth = r.Header.Get("Authorization")
+			var req map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"content":"Hello\nfrom %s via %s"},"finish_reason":"stop"}]}`, req["model"], name)
+		}
+	}
+	upstream := httptest.NewServer(answer("upstream"))
+	defer upstream.Close()
+	other := httptest.NewServer(answer("other"))
+	defer other.Close()
+
+	mux, err := newRelayMux(&Config{
+		Upstream:    upstream.URL,
+		Admin:       &AdminConfig{Token: "admin"},
+		Transcripts: &TranscriptConfig{MaxBodyBytes: 256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"a","messages":[]}`)))
+	long := `{"model":"a","messages":[{"role":"user","content":"` + strings.Repeat("x", 300) + `"}]}`
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(long)))
+
+	admin := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, r)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	_, list := admin("GET", "/admin/transcripts", "")
+	data := list["data"].([]any)
+	if len(data) != 2 {
+		t.Fatalf("%d transcripts", len(data))
+	}
+	truncatedID := data[0].(map[string]any)["id"].(string) // newest first
+	id := data[1].(map[string]any)["id"].(string)
+
+	// the same request gives the same answer
+	code, out := admin("POST", "/admin/transcripts/"+id+"/replay", "")
+	if code != http.StatusOK || out["identical"] != true || out["diff"] != nil {
+		t.Errorf("plain replay: %d %v", code, out)
+	}
+
+	// another model, through the relay
+	_, out = admin("POST", "/admin/transcripts/"+id+"/replay", `{"model":"b"}`)
+	diff, _ := out["diff"].([]any)
+	if out["identical"] != false || len(diff) != 3 || diff[0] != "  Hello" || diff[1] != "- from a via upstream" || diff[2] != "+ from b via upstream" {
+		t.Errorf("model replay: %v", out)
+	}
+	if replay := out["replay"].(map[string]any); replay["model"] != "b" || replay["status"] != float64(200) {
+		t.Errorf("replay side: %v", replay)
+	}
+
+	// another upstream, with its own key and without the admin token
+	_, out = admin("POST", "/admin/transcripts/"+id+"/replay", `{"upstream":"`+other.URL+`","api_key":"sk-other"}`)
+	if replay := out["replay"].(map[string]any); replay["text"] != "Hello\nfrom a via other" || replay["upstream"] != other.URL {
+		t.Errorf("upstream replay: %v", out)
+	}
+	if backendAuth != "Bearer sk-other" {
+		t.Errorf("other upstream got Authorization %q", backendAuth)
+	}
+
+	// replays are not recorded
+	if _, list := admin("GET", "/admin/transcripts", ""); len(list["data"].([]any)) != 2 {
+		t.Errorf("replays were recorded")
+	}
+
+	for _, tt := range []struct {
+		path, body string
+		want       int
+	}{
+		{"/admin/transcripts/" + truncatedID + "/replay", "", http.StatusUnprocessableEntity},
+		{"/admin/transcripts/nonexistent/replay", "", http.StatusNotFound},
+		{"/admin/transcripts/" + id + "/replay", `{"tenant":"nobody"}`, http.StatusNotFound},
+		{"/admin/transcripts/" + id + "/replay", `{"upstream":"not a url"}`, http.StatusBadRequest},
+	} {
+		if code, out := admin("POST", tt.path, tt.body); code != tt.want {
+			t.Errorf("%s %s: %d %v, want %d", tt.path, tt.body, code, out, tt.want)
+		}
+	}
+}
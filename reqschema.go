@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// requestError is a chat completion body the relay rejects before it
+// reaches the upstream. Param names the offending field the way OpenAI
+// does, e.g. "messages[2].role".
+type requestError struct {
+	param   string
+	code    string // "missing_required_parameter", "invalid_type" or "invalid_value"
+	message string
+}
+
+func missingParam(param string) *requestError {
+	return &requestError{param, "missing_required_parameter", fmt.Sprintf("Missing required parameter: '%s'.", param)}
+}
+
+func invalidType(param, want string, got any) *requestError {
+	return &requestError{param, "invalid_type", fmt.Sprintf("Invalid type for '%s': expected %s, but got %s.", param, want, jsonTypeName(got))}
+}
+
+func invalidValue(param, detail string) *requestError {
+	return &requestError{param, "invalid_value", fmt.Sprintf("Invalid value for '%s': %s", param, detail)}
+}
+
+// jsonTypeName names the JSON type of a decoded value for error messages.
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []any:
+		return "an array"
+	case map[string]any:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+var (
+	messageRoles     = []string{"system", "developer", "user", "assistant", "tool", "function"}
+	toolChoiceModes  = []string{"none", "auto", "required"}
+	functionNameExpr = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// validateChatRequest checks the parts of a chat completion body that
+// upstreams most often reject with unhelpful errors: the messages array,
+// message roles and the tools schema. Unknown fields are left alone.
+func validateChatRequest(payload map[string]any) *requestError {
+	if v, ok := payload["model"]; !ok {
+		return missingParam("model")
+	} else if s, ok := v.(string); !ok {
+		return invalidType("model", "a string", v)
+	} else if s == "" {
+		return invalidValue("model", "must not be empty.")
+	}
+	if v, ok := payload["stream"]; ok && v != nil {
+		if _, ok := v.(bool); !ok {
+			return invalidType("stream", "a boolean", v)
+		}
+	}
+
+	v, ok := payload["messages"]
+	if !ok {
+		return missingParam("messages")
+	}
+	messages, ok := v.([]any)
+	if !ok {
+		return invalidType("messages", "an array", v)
+	}
+	if len(messages) == 0 {
+		return invalidValue("messages", "expected an array with minimum length 1, but got an empty array.")
+	}
+	for i, m := range messages {
+		if err := validateMessage(fmt.Sprintf("messages[%d]", i), m); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	if v, ok := payload["tools"]; ok && v != nil {
+		tools, ok := v.([]any)
+		if !ok {
+			return invalidType("tools", "an array", v)
+		}
+		for i, t := range tools {
+			name, err := validateTool(fmt.Sprintf("tools[%d]", i), t)
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+	}
+	if v, ok := payload["tool_choice"]; ok && v != nil {
+		return validateToolChoice(v, names, payload["tools"] != nil)
+	}
+	return nil
+}
+
+func validateMessage(param string, v any) *requestError {
+	msg, ok := v.(map[string]any)
+	if !ok {
+		return invalidType(param, "an object", v)
+	}
+	rv, ok := msg["role"]
+	if !ok {
+		return missingParam(param + ".role")
+	}
+	role, ok := rv.(string)
+	if !ok {
+		return invalidType(param+".role", "a string", rv)
+	}
+	if !slices.Contains(messageRoles, role) {
+		return invalidValue(param+".role", fmt.Sprintf("'%s'. Supported values are: '%s'.", role, strings.Join(messageRoles, "', '")))
+	}
+
+	content, hasContent := msg["content"]
+	switch c := content.(type) {
+	case nil:
+		// an assistant message may carry only tool calls
+		if role != "assistant" {
+			if !hasContent {
+				return missingParam(param + ".content")
+			}
+			return invalidType(param+".content", "a string or an array of content parts", content)
+		}
+	case string:
+	case []any:
+		for i, p := range c {
+			part, ok := p.(map[string]any)
+			if !ok {
+				return invalidType(fmt.Sprintf("%s.content[%d]", param, i), "an object", p)
+			}
+			if _, ok := part["type"].(string); !ok {
+				return missingParam(fmt.Sprintf("%s.content[%d].type", param, i))
+			}
+		}
+	default:
+		return invalidType(param+".content", "a string or an array of content parts", content)
+	}
+
+	switch role {
+	case "tool":
+		if id, ok := msg["tool_call_id"].(string); !ok || id == "" {
+			return missingParam(param + ".tool_call_id")
+		}
+	case "assistant":
+		if v, ok := msg["tool_calls"]; ok && v != nil {
+			calls, ok := v.([]any)
+			if !ok {
+				return invalidType(param+".tool_calls", "an array", v)
+			}
+			for i, c := range calls {
+				if err := validateMessageToolCall(fmt.Sprintf("%s.tool_calls[%d]", param, i), c); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateMessageToolCall(param string, v any) *requestError {
+	call, ok := v.(map[string]any)
+	if !ok {
+		return invalidType(param, "an object", v)
+	}
+	if _, ok := call["id"].(string); !ok {
+		return missingParam(param + ".id")
+	}
+	fv, ok := call["function"]
+	if !ok {
+		return missingParam(param + ".function")
+	}
+	fn, ok := fv.(map[string]any)
+	if !ok {
+		return invalidType(param+".function", "an object", fv)
+	}
+	if _, ok := fn["name"].(string); !ok {
+		return missingParam(param + ".function.name")
+	}
+	if av, ok := fn["arguments"]; ok {
+		if _, ok := av.(string); !ok {
+			return invalidType(param+".function.arguments", "a string", av)
+		}
+	}
+	return nil
+}
+
+// validateTool checks one entry of tools and returns its function name.
+func validateTool(param string, v any) (string, *requestError) {
+	tool, ok := v.(map[string]any)
+	if !ok {
+		return "", invalidType(param, "an object", v)
+	}
+	if typ := getString(tool, "type"); typ != "function" {
+		if _, ok := tool["type"]; !ok {
+			return "", missingParam(param + ".type")
+		}
+		return "", invalidValue(param+".type", fmt.Sprintf("'%v'. Supported values are: 'function'.", tool["type"]))
+	}
+	fv, ok := tool["function"]
+	if !ok {
+		return "", missingParam(param + ".function")
+	}
+	fn, ok := fv.(map[string]any)
+	if !ok {
+		return "", invalidType(param+".function", "an object", fv)
+	}
+	nv, ok := fn["name"]
+	if !ok {
+		return "", missingParam(param + ".function.name")
+	}
+	name, ok := nv.(string)
+	if !ok {
+		return "", invalidType(param+".function.name", "a string", nv)
+	}
+	if !functionNameExpr.MatchString(name) {
+		return "", invalidValue(param+".function.name", fmt.Sprintf("'%s'. Names must be 1 to 64 letters, digits, underscores or dashes.", name))
+	}
+	if pv, ok := fn["parameters"]; ok && pv != nil {
+		params, ok := pv.(map[string]any)
+		if !ok {
+			return "", invalidType(param+".function.parameters", "an object", pv)
+		}
+		if typ, ok := params["type"]; ok && typ != "object" {
+			return "", invalidValue(param+".function.parameters.type", fmt.Sprintf("'%v'. Function parameters must be a JSON Schema of type 'object'.", typ))
+		}
+	}
+	return name, nil
+}
+
+func validateToolChoice(v any, names []string, hasTools bool) *requestError {
+	switch c := v.(type) {
+	case string:
+		if !slices.Contains(toolChoiceModes, c) {
+			return invalidValue("tool_choice", fmt.Sprintf("'%s'. Supported values are: '%s'.", c, strings.Join(toolChoiceModes, "', '")))
+		}
+		if c == "required" && !hasTools {
+			return invalidValue("tool_choice", "'required' is only allowed when 'tools' are specified.")
+		}
+	case map[string]any:
+		if !hasTools {
+			return invalidValue("tool_choice", "a function is only allowed when 'tools' are specified.")
+		}
+		fn, _ := c["function"].(map[string]any)
+		name := getString(fn, "name")
+		if name == "" {
+			return missingParam("tool_choice.function.name")
+		}
+		if !slices.Contains(names, name) {
+			return invalidValue("tool_choice.function.name", fmt.Sprintf("no tool named '%s' in 'tools'.", name))
+		}
+	default:
+		return invalidType("tool_choice", "a string or an object", v)
+	}
+	return nil
+}
+
+// writeRequestError answers 400 with an OpenAI-style error naming the field.
+func writeRequestError(w http.ResponseWriter, e *requestError) {
+	writeJSON(w, http.StatusBadRequest, map[string]any{
+		"error": map[string]any{
+			"message": e.message,
+			"type":    "invalid_request_error",
+			"param":   e.param,
+			"code":    e.code,
+		},
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateChatRequest(t *testing.T) {
+	tests := []struct {
+		body      string
+		wantParam string // empty when the body is valid
+		wantCode  string
+	}{
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}]}`, "", ""},
+		{`{"model":"m","messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`, "", ""},
+		{`{"model":"m","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function","function":{"name":"f","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c1","content":"ok"}]}`, "", ""},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}],"tool_choice":{"type":"function","function":{"name":"get_weather"}}}`, "", ""},
+
+		{`{"messages":[{"role":"user","content":"hi"}]}`, "model", "missing_required_parameter"},
+		{`{"model":"m"}`, "messages", "missing_required_parameter"},
+		{`{"model":"m","messages":{"role":"user"}}`, "messages", "invalid_type"},
+		{`{"model":"m","messages":[]}`, "messages", "invalid_value"},
+		{`{"model":"m","stream":"yes","messages":[{"role":"user","content":"hi"}]}`, "stream", "invalid_type"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"},{"role":"bot","content":"hi"}]}`, "messages[1].role", "invalid_value"},
+		{`{"model":"m","messages":["hi"]}`, "messages[0]", "invalid_type"},
+		{`{"model":"m","messages":[{"content":"hi"}]}`, "messages[0].role", "missing_required_parameter"},
+		{`{"model":"m","messages":[{"role":"user"}]}`, "messages[0].content", "missing_required_parameter"},
+		{`{"model":"m","messages":[{"role":"user","content":42}]}`, "messages[0].content", "invalid_type"},
+		{`{"model":"m","messages":[{"role":"user","content":[{"text":"hi"}]}]}`, "messages[0].content[0].type", "missing_required_parameter"},
+		{`{"model":"m","messages":[{"role":"tool","content":"ok"}]}`, "messages[0].tool_call_id", "missing_required_parameter"},
+		{`{"model":"m","messages":[{"role":"assistant","tool_calls":[{"id":"c1","function":{"name":"f","arguments":{}}}]}]}`, "messages[0].tool_calls[0].function.arguments", "invalid_type"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":{}}`, "tools", "invalid_type"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"retrieval"}]}`, "tools[0].type", "invalid_value"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{}}]}`, "tools[0].function.name", "missing_required_parameter"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"get weather"}}]}`, "tools[0].function.name", "invalid_value"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f","parameters":{"type":"array"}}}]}`, "tools[0].function.parameters.type", "invalid_value"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tool_choice":"required"}`, "tool_choice", "invalid_value"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":"any"}`, "tool_choice", "invalid_value"},
+		{`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":{"type":"function","function":{"name":"g"}}}`, "tool_choice.function.name", "invalid_value"},
+	}
+	for _, tt := range tests {
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(tt.body), &payload); err != nil {
+			t.Fatalf("bad test body %s: %v", tt.body, err)
+		}
+		err := validateChatRequest(payload)
+		if tt.wantParam == "" {
+			if err != nil {
+				t.Errorf("validateChatRequest(%s) = %q, want nil", tt.body, err.message)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("validateChatRequest(%s) = nil, want error on %s", tt.body, tt.wantParam)
+			continue
+		}
+		if err.param != tt.wantParam || err.code != tt.wantCode {
+			t.Errorf("validateChatRequest(%s) = %s/%s (%s), want %s/%s", tt.body, err.param, err.code, err.message, tt.wantParam, tt.wantCode)
+		}
+	}
+}
+
+func TestValidateRequests(t *testing.T) {
+	upstream := echoUpstream("global")
+	defer upstream.Close()
+	body := `{"model":"m","messages":[{"role":"bot","content":"hi"}]}`
+
+	for _, enabled := range []bool{false, true} {
+		mux, err := newRelayMux(&Config{Upstream: upstream.URL, ValidateRequests: enabled})
+		if err != nil {
+			t.Fatalf("newRelayMux() failed: %v", err)
+		}
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if !enabled {
+			if w.Code != 200 {
+				t.Errorf("validation off: status %d, want the request forwarded", w.Code)
+			}
+			continue
+		}
+		if w.Code != 400 {
+			t.Fatalf("validation on: status %d, want 400", w.Code)
+		}
+		var resp struct {
+			Error struct {
+				Message, Type, Param, Code string
+			}
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Error.Param != "messages[0].role" || resp.Error.Type != "invalid_request_error" || !strings.Contains(resp.Error.Message, "'bot'") {
+			t.Errorf("error = %+v", resp.Error)
+		}
+	}
+
+	// legacy completions carry no messages and are not checked
+	mux, _ := newRelayMux(&Config{Upstream: upstream.URL, ValidateRequests: true})
+	r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model":"m","prompt":"hi"}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Errorf("completions: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds the client's X-Request-Id the relay adopts; a
+// longer or unprintable one is replaced rather than logged and forwarded.
+const maxRequestIDLength = 128
+
+// validRequestID reports whether id is safe to log and forward as it is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID gives the request its ID: the client's X-Request-Id when
+// it sent a usable one, a new UUID otherwise. The ID is set on the request,
+// so every upstream request copying the client's headers carries it, and on
+// the response.
+func assignRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// requestIDFrom returns the ID of the request ctx belongs to, or "" outside
+// of a request.
+func requestIDFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"req-123":                  true,
+		"4bf92f3577b34da6a3ce929d": true,
+		"":                         false,
+		"with space":               false,
+		"line\nbreak":              false,
+		"ünicode":                  false,
+		strings.Repeat("a", 129):   false,
+	} {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v", id, got)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get(requestIDHeader))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(requestIDHeader, "provider-1")
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}]}`)
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{Upstream: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := loggingMiddleware(mux)
+
+	orig := slog.Default()
+	defer func() {
+		slog.SetDefault(orig)
+		setDebugLogging(false)
+	}()
+	var logged bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, &slog.HandlerOptions{Level: logLevel})))
+	setDebugLogging(true)
+
+	send := func(path, id string, headers ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{"model":"m","messages":[]}`))
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// the client's ID is kept, forwarded and returned once
+	w := send("/v1/chat/completions", "client-1")
+	if got := w.Header().Values(requestIDHeader); len(got) != 1 || got[0] != "client-1" {
+		t.Errorf("X-Request-Id: %v", got)
+	}
+	if got := w.Header().Get(upstreamRequestIDHeader); got != "provider-1" {
+		t.Errorf("X-Upstream-Request-Id: %q", got)
+	}
+
+	// without one, or with an unusable one, the relay assigns its own
+	for _, id := range []string{"", "bad id"} {
+		w = send("/v1/chat/completions", id)
+		got := w.Header().Values(requestIDHeader)
+		if len(got) != 1 || got[0] == id || !validRequestID(got[0]) {
+			t.Fatalf("sent %q, got X-Request-Id %v", id, got)
+		}
+		if seen[len(seen)-1] != got[0] {
+			t.Errorf("upstream saw %q, client got %q", seen[len(seen)-1], got[0])
+		}
+	}
+	if seen[0] != "client-1" || seen[1] == seen[2] {
+		t.Errorf("upstream saw %v", seen)
+	}
+
+	// endpoints that are not relayed return an ID too
+	if w := send("/admin/nonexistent", ""); w.Header().Get(requestIDHeader) == "" {
+		t.Error("no X-Request-Id on a local endpoint")
+	}
+
+	// the refusal is logged for the request
+	if w := send("/v1/chat/completions", "looped-1", relayHopsHeader, "100"); w.Code != http.StatusLoopDetected {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	// every line logged while handling a request carries its ID
+	var access, refused int
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		var rec struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("not a JSON record: %s", line)
+		}
+		switch {
+		case rec.Msg == "request":
+			access++
+		case strings.HasPrefix(rec.Msg, "RELAY:"):
+			refused++
+			if rec.RequestID != "looped-1" {
+				t.Errorf("refusal logged with request_id %q", rec.RequestID)
+			}
+		case strings.HasPrefix(rec.Msg, "RULE:"):
+			continue // logged by the rule engine, which has no request
+		}
+		if rec.RequestID == "" {
+			t.Errorf("no request_id: %s", line)
+		}
+	}
+	if access != 5 || refused != 1 {
+		t.Errorf("%d access and %d refusal lines:\n%s", access, refused, logged.String())
+	}
+}
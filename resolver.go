@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// upstreamResolver chooses the addresses dialed for the upstream host: fixed
+// ones, or ones looked up through a custom DNS server. With an interval the
+// host is re-resolved in the background and the pool drops its idle
+// connections when the answer changes, so DNS-based failover is followed
+// without a restart.
+type upstreamResolver struct {
+	host     string
+	static   []string
+	resolver *net.Resolver
+	interval time.Duration
+	dialer   *net.Dialer
+
+	mu    sync.Mutex
+	addrs []string // cached answer when interval is set
+}
+
+// newUpstreamResolver returns nil when the options keep the system resolver
+// and its per-dial lookups.
+func newUpstreamResolver(host string, o UpstreamOptions) *upstreamResolver {
+	if len(o.Resolve) == 0 && o.DNSServer == "" && o.ResolveInterval == "" {
+		return nil
+	}
+	r := &upstreamResolver{
+		host:     host,
+		static:   o.Resolve,
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	if o.DNSServer != "" {
+		server := dnsServerAddr(o.DNSServer)
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return r.dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	// validated at startup
+	r.interval, _ = time.ParseDuration(o.ResolveInterval)
+	return r
+}
+
+func validateResolveOptions(o *UpstreamOptions) error {
+	for _, ip := range o.Resolve {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("upstream_options.resolve: invalid IP address %q", ip)
+		}
+	}
+	if len(o.Resolve) > 0 && (o.DNSServer != "" || o.ResolveInterval != "") {
+		return errors.New("upstream_options.resolve cannot be combined with dns_server or resolve_interval")
+	}
+	if o.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServerAddr(o.DNSServer)); err != nil {
+			return fmt.Errorf("upstream_options.dns_server: %w", err)
+		}
+	}
+	if o.ResolveInterval != "" {
+		if d, err := time.ParseDuration(o.ResolveInterval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid upstream_options.resolve_interval %q", o.ResolveInterval)
+		}
+	}
+	return nil
+}
+
+// dnsServerAddr adds the default DNS port when server has none.
+func dnsServerAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// dialContext dials the upstream host through the resolver and anything else
+// as usual. Addresses are tried in order until one connects.
+func (r *upstreamResolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.dial(ctx, network, addr, "")
+}
+
+// dialPreferring returns a dial function that tries the address prefer
+// first and the others only when it does not connect.
+func (r *upstreamResolver) dialPreferring(prefer string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return r.dial(ctx, network, addr, prefer)
+	}
+}
+
+func (r *upstreamResolver) dial(ctx context.Context, network, addr, prefer string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != r.host || net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := r.addresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if i := slices.Index(addrs, prefer); i > 0 {
+		addrs = append([]string{prefer}, slices.Delete(slices.Clone(addrs), i, i+1)...)
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// addresses returns the static addresses, the cached answer, or a fresh
+// lookup when nothing is cached.
+func (r *upstreamResolver) addresses(ctx context.Context) ([]string, error) {
+	if len(r.static) > 0 {
+		return r.static, nil
+	}
+	if r.interval > 0 {
+		r.mu.Lock()
+		addrs := r.addrs
+		r.mu.Unlock()
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	addrs, err := r.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.interval > 0 {
+		r.mu.Lock()
+		r.addrs = addrs
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func (r *upstreamResolver) lookup(ctx context.Context) ([]string, error) {
+	addrs, err := r.resolver.LookupHost(ctx, r.host)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(addrs)
+	return addrs, nil
+}
+
+// refreshLoop re-resolves the host every interval until ctx is canceled and
+// calls changed when the answer differs from the cached one.
+func (r *upstreamResolver) refreshLoop(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		addrs, err := r.lookup(lctx)
+		cancel()
+		if err != nil {
+			// keep dialing the last known addresses
+			vlog("RESOLVE: re-resolving %s failed: %v", r.host, err)
+			continue
+		}
+		r.mu.Lock()
+		old := r.addrs
+		r.addrs = addrs
+		r.mu.Unlock()
+		if old != nil && !slices.Equal(old, addrs) {
+			vlog("RESOLVE: %s moved from %v to %v", r.host, old, addrs)
+			changed()
+		}
+	}
+}
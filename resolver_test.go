@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticResolve(t *testing.T) {
+	var host string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	named := parseURL("http://llm.invalid:" + u.Port())
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{Resolve: []string{"127.0.0.1"}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	proxyWithJSONPatch(w, r, named, false, cfg, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if host != named.Host {
+		t.Errorf("upstream got Host %q, want %q", host, named.Host)
+	}
+}
+
+func TestRefreshLoopStops(t *testing.T) {
+	r := newUpstreamResolver("localhost", UpstreamOptions{ResolveInterval: "10ms"})
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		r.refreshLoop(ctx, func() {})
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop still running after its context was canceled")
+	}
+}
+
+func TestValidateResolveOptions(t *testing.T) {
+	tests := []struct {
+		opts    UpstreamOptions
+		wantErr bool
+	}{
+		{UpstreamOptions{Resolve: []string{"10.0.0.1", "::1"}}, false},
+		{UpstreamOptions{DNSServer: "10.0.0.53", ResolveInterval: "30s"}, false},
+		{UpstreamOptions{Resolve: []string{"llm.internal"}}, true},
+		{UpstreamOptions{Resolve: []string{"10.0.0.1"}, ResolveInterval: "30s"}, true},
+		{UpstreamOptions{ResolveInterval: "soon"}, true},
+	}
+	for _, tt := range tests {
+		err := validateUpstreamOptions(&tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, wantErr %v", tt.opts, err, tt.wantErr)
+		}
+	}
+}
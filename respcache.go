@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ResponseCacheConfig makes a rule's non-streaming responses cacheable, so
+// caching can be rolled out one model or team at a time.
+type ResponseCacheConfig struct {
+	TTL                 string   `json:"ttl"`                   // how long a response is served from the cache, e.g. "10m"
+	VaryOn              []string `json:"vary_on"`               // request fields the key is built from (default: the whole body)
+	OnlyTemperatureZero bool     `json:"only_temperature_zero"` // cache only requests that set temperature to 0
+}
+
+// cacheHeader tells clients whether the response came from the cache.
+const cacheHeader = "X-Relay-Cache"
+
+const (
+	responseCacheEntries  = 1024    // responses kept across all rules
+	responseCacheMaxBytes = 1 << 20 // larger responses are not cached
+)
+
+var responseCacheTotal = metrics.newCounterVec("relay_response_cache_total",
+	"Requests of rules with a cache policy, by result (hit, miss or bypass).", "tenant", "model", "result")
+
+func validateResponseCache(c *ResponseCacheConfig) error {
+	if c.TTL == "" {
+		return errors.New("cache.ttl is required")
+	}
+	if d, err := time.ParseDuration(c.TTL); err != nil || d <= 0 {
+		return fmt.Errorf("invalid cache.ttl %q", c.TTL)
+	}
+	for _, f := range c.VaryOn {
+		if f == "" {
+			return errors.New("cache.vary_on must not contain empty field names")
+		}
+	}
+	return nil
+}
+
+// cacheable reports whether a request may be answered from the cache.
+func (c *ResponseCacheConfig) cacheable(payload map[string]any, stream bool) bool {
+	if stream {
+		return false
+	}
+	if c.OnlyTemperatureZero {
+		t, ok := payload["temperature"].(float64)
+		return ok && t == 0
+	}
+	return true
+}
+
+// key identifies a cached response: the rule, endpoint, upstream and tenant,
+// plus the vary_on fields of the patched request, or all of it.
+func (c *ResponseCacheConfig) key(r *http.Request, rule *ModelRule, upstream *url.URL, payload map[string]any, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{ruleName(rule), r.URL.Path, upstream.String(), tenantName(r.Context())} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	if len(c.VaryOn) == 0 {
+		h.Write(body)
+	} else {
+		for _, f := range c.VaryOn {
+			v, _ := json.Marshal(payload[f]) // map keys are sorted, so equal values match
+			h.Write([]byte(f))
+			h.Write([]byte{0})
+			h.Write(v)
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache is an LRU of upstream responses shared by every rule.
+type responseCache struct {
+	max int
+
+	mu      sync.Mutex
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+var responses = newResponseCache(responseCacheEntries)
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *responseCache) get(key string, now time.Time) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cachedResponse)
+	if !now.Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return &http.Response{
+		StatusCode:    e.status,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+	}
+}
+
+func (c *responseCache) put(e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// withResponseCache answers from the cache when it can and stores the
+// upstream's successful responses otherwise. The response is cached as the
+// upstream sent it, so everything the relay does to a response afterwards
+// runs again on a hit. The result goes to the client in X-Relay-Cache.
+func withResponseCache(w http.ResponseWriter, r *http.Request, rule *ModelRule, upstream *url.URL, payload map[string]any, stream bool, send func([]byte) (*http.Response, error)) func([]byte) (*http.Response, error) {
+	if rule == nil || rule.Cache == nil {
+		return send
+	}
+	cfg := rule.Cache
+	tenant, model, label := tenantName(r.Context()), getString(payload, "model"), metricModel(rule)
+	if !cfg.cacheable(payload, stream) {
+		w.Header().Set(cacheHeader, "BYPASS")
+		responseCacheTotal.Inc(tenant, label, "bypass")
+		return send
+	}
+	ttl, _ := time.ParseDuration(cfg.TTL) // validated at load
+	return func(body []byte) (*http.Response, error) {
+		key := cfg.key(r, rule, upstream, payload, body)
+		if resp := responses.get(key, time.Now()); resp != nil {
+			vlogCtx(r.Context(), "CACHE: hit for model '%s'", model)
+			w.Header().Set(cacheHeader, "HIT")
+			responseCacheTotal.Inc(tenant, label, "hit")
+			return resp, nil
+		}
+		w.Header().Set(cacheHeader, "MISS")
+		responseCacheTotal.Inc(tenant, label, "miss")
+		resp, err := send(body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, responseCacheMaxBytes+1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if len(raw) > responseCacheMaxBytes {
+			// too large to keep; hand on what was read and the rest
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		responses.put(&cachedResponse{key: key, status: resp.StatusCode, header: resp.Header.Clone(), body: raw, expires: time.Now().Add(ttl)})
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		return resp, nil
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if strings.Contains(r.URL.Path, "fail") {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":"answer %d"}}]}`, n)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{
+		{MatchModel: "cached", Cache: &ResponseCacheConfig{TTL: "1h", VaryOn: []string{"messages"}}},
+		{MatchModel: "cold", Cache: &ResponseCacheConfig{TTL: "1h", OnlyTemperatureZero: true}},
+		{MatchModel: "default"},
+	}}
+	send := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), true, cfg, nil)
+		return w
+	}
+	check := func(w *httptest.ResponseRecorder, cache, content string) {
+		t.Helper()
+		if got := w.Header().Get(cacheHeader); got != cache {
+			t.Errorf("%s = %q, want %q", cacheHeader, got, cache)
+		}
+		if !strings.Contains(w.Body.String(), content) {
+			t.Errorf("body %s, want %q", w.Body, content)
+		}
+	}
+
+	msgs := `"messages":[{"role":"user","content":"hi"}]`
+	check(send("/v1/chat/completions", `{"model":"cached",`+msgs+`,"user":"a"}`), "MISS", "answer 1")
+	// fields outside vary_on do not matter
+	check(send("/v1/chat/completions", `{"model":"cached",`+msgs+`,"user":"b"}`), "HIT", "answer 1")
+	check(send("/v1/chat/completions", `{"model":"cached","messages":[{"role":"user","content":"bye"}]}`), "MISS", "answer 2")
+	check(send("/v1/chat/completions", `{"model":"cached",`+msgs+`,"stream":true}`), "BYPASS", "answer 3")
+
+	check(send("/v1/chat/completions", `{"model":"cold",`+msgs+`,"temperature":0.7}`), "BYPASS", "answer 4")
+	check(send("/v1/chat/completions", `{"model":"cold",`+msgs+`}`), "BYPASS", "answer 5")
+	check(send("/v1/chat/completions", `{"model":"cold",`+msgs+`,"temperature":0}`), "MISS", "answer 6")
+	check(send("/v1/chat/completions", `{"model":"cold",`+msgs+`,"temperature":0}`), "HIT", "answer 6")
+
+	// errors are not cached, rules without a policy get no header
+	check(send("/v1/fail", `{"model":"cached",`+msgs+`}`), "MISS", "busy")
+	check(send("/v1/fail", `{"model":"cached",`+msgs+`}`), "MISS", "busy")
+	check(send("/v1/chat/completions", `{"model":"other",`+msgs+`}`), "", "answer 9")
+	check(send("/v1/chat/completions", `{"model":"other",`+msgs+`}`), "", "answer 10")
+}
+
+func TestResponseCacheExpiryAndEviction(t *testing.T) {
+	c := newResponseCache(2)
+	now := time.Now()
+	for _, k := range []string{"a", "b"} {
+		c.put(&cachedResponse{key: k, status: 200, header: http.Header{}, body: []byte(k), expires: now.Add(time.Minute)})
+	}
+	if c.get("a", now) == nil {
+		t.Fatal("a missing")
+	}
+	c.put(&cachedResponse{key: "c", status: 200, header: http.Header{}, body: []byte("c"), expires: now.Add(time.Minute)})
+	if c.get("b", now) != nil {
+		t.Error("least recently used entry b not evicted")
+	}
+	if c.get("a", now) == nil || c.get("c", now) == nil {
+		t.Error("recent entries evicted")
+	}
+	if c.get("a", now.Add(time.Minute)) != nil {
+		t.Error("expired entry served")
+	}
+}
+
+func TestValidateResponseCache(t *testing.T) {
+	for _, c := range []ResponseCacheConfig{{}, {TTL: "soon"}, {TTL: "-1s"}, {TTL: "1m", VaryOn: []string{""}}} {
+		if validateResponseCache(&c) == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	if err := validateResponseCache(&ResponseCacheConfig{TTL: "10m", VaryOn: []string{"messages"}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// validate_response modes. Both log and count every deviation; flag also
+// marks them in the response, as SSE comments in streams and in the
+// X-Relay-Deviations header otherwise.
+const (
+	validateResponseLog  = "log"
+	validateResponseFlag = "flag"
+)
+
+const deviationsHeader = "X-Relay-Deviations"
+
+var responseDeviationsTotal = metrics.newCounterVec("relay_response_deviations_total",
+	"Upstream responses deviating from the OpenAI schema, by kind of deviation.", "tenant", "model", "kind")
+
+// The fields the OpenAI API defines; anything else is reported as
+// nonstandard.
+var (
+	standardCompletionFields = []string{"id", "object", "created", "model", "choices", "usage", "system_fingerprint", "service_tier"}
+	standardChoiceFields     = []string{"index", "delta", "message", "text", "finish_reason", "logprobs"}
+	standardMessageFields    = []string{"role", "content", "refusal", "tool_calls", "function_call", "annotations", "audio"}
+	standardFinishReasons    = []string{"stop", "length", "tool_calls", "content_filter", "function_call"}
+)
+
+func validateResponseMode(mode string) error {
+	switch mode {
+	case "", validateResponseLog, validateResponseFlag:
+		return nil
+	}
+	return fmt.Errorf("unknown validate_response %q (want log or flag)", mode)
+}
+
+// deviation is one way a response departs from the schema; detail names
+// the field or value.
+type deviation struct {
+	kind, detail string
+}
+
+func (d deviation) String() string {
+	if d.detail == "" {
+		return d.kind
+	}
+	return d.kind + "=" + d.detail
+}
+
+// checkCompletion lists how a completion object or stream chunk deviates
+// from the schema of object ("chat.completion", "chat.completion.chunk" or
+// "text_completion").
+func checkCompletion(obj map[string]any, object string) []deviation {
+	var devs []deviation
+	add := func(kind, detail string) { devs = append(devs, deviation{kind, detail}) }
+	chunk := strings.HasSuffix(object, ".chunk")
+
+	if id, _ := obj["id"].(string); id == "" {
+		add("missing_id", "")
+	}
+	if got, _ := obj["object"].(string); got != object {
+		add("wrong_object", fmt.Sprintf("%v", obj["object"]))
+	}
+	if _, ok := obj["created"].(float64); !ok {
+		add("missing_created", "")
+	}
+	if model, _ := obj["model"].(string); model == "" {
+		add("missing_model", "")
+	}
+	if u, ok := obj["usage"]; ok && u != nil {
+		usage, _ := u.(map[string]any)
+		for _, k := range []string{"prompt_tokens", "completion_tokens", "total_tokens"} {
+			if _, ok := usage[k].(float64); !ok {
+				add("bad_usage", k)
+				break
+			}
+		}
+	}
+	for k := range obj {
+		if !slices.Contains(standardCompletionFields, k) {
+			add("nonstandard_field", k)
+		}
+	}
+
+	choices, ok := obj["choices"].([]any)
+	// chunks without choices carry usage or content filter results
+	if !ok || (len(choices) == 0 && !chunk) {
+		add("missing_choices", "")
+	}
+	body := "message"
+	if chunk {
+		body = "delta"
+	}
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		if _, ok := choice["index"].(float64); !ok {
+			add("missing_index", "")
+		}
+		if fr, ok := choice["finish_reason"]; ok && fr != nil {
+			if s, _ := fr.(string); !slices.Contains(standardFinishReasons, s) {
+				add("bad_finish_reason", fmt.Sprintf("%v", fr))
+			}
+		} else if !ok && !chunk {
+			add("bad_finish_reason", "")
+		}
+		for k := range choice {
+			if !slices.Contains(standardChoiceFields, k) {
+				add("nonstandard_field", "choices[]."+k)
+			}
+		}
+		if object == "text_completion" {
+			if _, ok := choice["text"].(string); !ok {
+				add("missing_text", "")
+			}
+			continue
+		}
+		msg, ok := choice[body].(map[string]any)
+		if !ok {
+			add("missing_"+body, "")
+			continue
+		}
+		for k := range msg {
+			if !slices.Contains(standardMessageFields, k) {
+				add("nonstandard_field", "choices[]."+body+"."+k)
+			}
+		}
+		calls, _ := msg["tool_calls"].([]any)
+		for _, tc := range calls {
+			call, _ := tc.(map[string]any)
+			fn, _ := call["function"].(map[string]any)
+			if chunk {
+				if _, ok := call["index"].(float64); !ok {
+					add("bad_tool_call", "index")
+				}
+				continue
+			}
+			if id, _ := call["id"].(string); id == "" {
+				add("bad_tool_call", "id")
+			}
+			if name, _ := fn["name"].(string); name == "" {
+				add("bad_tool_call", "function.name")
+			}
+			if _, ok := fn["arguments"].(string); !ok {
+				add("bad_tool_call", "function.arguments")
+			}
+		}
+	}
+	return devs
+}
+
+// completionObject is the object a response to payload should carry.
+func completionObject(payload map[string]any, stream bool) string {
+	if _, ok := payload["messages"]; !ok {
+		return "text_completion"
+	}
+	if stream {
+		return "chat.completion.chunk"
+	}
+	return "chat.completion"
+}
+
+// deviationReporter logs and counts each deviation of one response once.
+type deviationReporter struct {
+	ctx           context.Context
+	tenant, model string
+	label         string // model label of the metrics, see metricModel
+	reported      map[deviation]bool
+	counted       map[string]bool
+}
+
+func newDeviationReporter(ctx context.Context, rule *ModelRule, tenant, model string) *deviationReporter {
+	return &deviationReporter{ctx: ctx, tenant: tenant, model: model, label: metricModel(rule), reported: map[deviation]bool{}, counted: map[string]bool{}}
+}
+
+// report returns the deviations not seen before in this response.
+func (d *deviationReporter) report(devs []deviation, sample string) []deviation {
+	if len(sample) > 200 {
+		sample = sample[:200] + "..."
+	}
+	var fresh []deviation
+	for _, dev := range devs {
+		if d.reported[dev] {
+			continue
+		}
+		d.reported[dev] = true
+		fresh = append(fresh, dev)
+		if !d.counted[dev.kind] {
+			d.counted[dev.kind] = true
+			responseDeviationsTotal.Inc(d.tenant, d.label, dev.kind)
+		}
+		logCtxf(d.ctx, slog.LevelWarn, "CONFORMANCE: model '%s' response deviates from the OpenAI schema: %s in %s", d.model, dev, sample)
+	}
+	return fresh
+}
+
+// responseValidator checks each chunk of a stream as the upstream sent it,
+// plus what only the stream as a whole shows: a changing id and a missing
+// data: [DONE].
+type responseValidator struct {
+	*deviationReporter
+	flag       bool
+	object     string
+	id         string
+	data, done bool
+}
+
+// newResponseValidator wraps src, or returns nil when the rule does not set
+// validate_response.
+func newResponseValidator(ctx context.Context, src io.Reader, rule *ModelRule, payload map[string]any, tenant, model string) io.ReadCloser {
+	if rule == nil || rule.ValidateResponse == "" {
+		return nil
+	}
+	v := &responseValidator{
+		deviationReporter: newDeviationReporter(ctx, rule, tenant, model),
+		flag:              rule.ValidateResponse == validateResponseFlag,
+		object:            completionObject(payload, true),
+	}
+	return pipeSSEWithEnd(src, v.handle, v.end)
+}
+
+func (v *responseValidator) handle(line string) ([]string, bool) {
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		return []string{line}, true
+	}
+	if data == "[DONE]" {
+		v.done = true
+		return []string{line}, true
+	}
+	v.data = true
+	var devs []deviation
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(data), &obj); err != nil {
+		devs = append(devs, deviation{kind: "invalid_json"})
+	} else {
+		if id, _ := obj["id"].(string); id != "" {
+			if v.id == "" {
+				v.id = id
+			} else if id != v.id {
+				devs = append(devs, deviation{kind: "inconsistent_id"})
+			}
+		}
+		devs = append(devs, checkCompletion(obj, v.object)...)
+	}
+	return append(v.flagLines(v.report(devs, data)), line), true
+}
+
+func (v *responseValidator) end() []string {
+	if !v.data || v.done {
+		return nil
+	}
+	return v.flagLines(v.report([]deviation{{kind: "missing_done"}}, "the end of the stream"))
+}
+
+// flagLines are the SSE comments marking devs, which clients ignore.
+func (v *responseValidator) flagLines(devs []deviation) []string {
+	if !v.flag {
+		return nil
+	}
+	out := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		out = append(out, ": deviation "+dev.String())
+	}
+	return out
+}
+
+// validateResponseBody checks a non-streaming response and in flag mode
+// lists its deviations in X-Relay-Deviations. resp.Body is replaced with
+// the bytes read.
+func validateResponseBody(w http.ResponseWriter, r *http.Request, rule *ModelRule, payload map[string]any, resp *http.Response) error {
+	raw, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	var devs []deviation
+	var obj map[string]any
+	if json.Unmarshal(raw, &obj) != nil {
+		devs = []deviation{{kind: "invalid_json"}}
+	} else {
+		devs = checkCompletion(obj, completionObject(payload, false))
+	}
+	devs = newDeviationReporter(r.Context(), rule, tenantName(r.Context()), getString(payload, "model")).report(devs, string(raw))
+	if rule.ValidateResponse == validateResponseFlag && len(devs) > 0 {
+		list := make([]string, len(devs))
+		for i, dev := range devs {
+			list[i] = dev.String()
+		}
+		w.Header().Set(deviationsHeader, strings.Join(list, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckCompletion(t *testing.T) {
+	tests := []struct {
+		object, body string
+		want         []string
+	}{
+		{"chat.completion.chunk", `{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"a"},"finish_reason":null}]}`, nil},
+		{"chat.completion.chunk", `{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`, nil},
+		{"chat.completion", `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"a","tool_calls":[{"id":"t1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`, nil},
+		{"text_completion", `{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[{"index":0,"text":"a","finish_reason":"length","logprobs":null}]}`, nil},
+		{"chat.completion.chunk", `{"object":"chat.completion","model":"m","choices":[{"delta":{"content":"a","reasoning_content":"r"},"finish_reason":"eos"}],"x_latency":3}`,
+			[]string{"missing_id", "wrong_object=chat.completion", "missing_created", "nonstandard_field=x_latency", "missing_index", "bad_finish_reason=eos", "nonstandard_field=choices[].delta.reasoning_content"}},
+		{"chat.completion", `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"tool_calls":[{"function":{"arguments":{}}}]}}],"usage":{"prompt_tokens":1}}`,
+			[]string{"bad_usage=completion_tokens", "bad_finish_reason", "bad_tool_call=id", "bad_tool_call=function.name", "bad_tool_call=function.arguments"}},
+		{"chat.completion", `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[]}`, []string{"missing_choices"}},
+		{"text_completion", `{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[{"index":0,"message":{}}]}`,
+			[]string{"bad_finish_reason", "missing_text"}},
+	}
+	for _, tt := range tests {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(tt.body), &obj); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, dev := range checkCompletion(obj, tt.object) {
+			got = append(got, dev.String())
+		}
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s\ngot  %v\nwant %v", tt.body, got, want)
+		}
+	}
+}
+
+func TestResponseValidatorStage(t *testing.T) {
+	payload := map[string]any{"messages": []any{}}
+	before := responseDeviationsTotal.Value("default", "m", "nonstandard_field")
+
+	// conforming streams pass through unmarked
+	rule := &ModelRule{MatchModel: "m", ValidateResponse: validateResponseFlag}
+	if out := runPipeline(t, rule, payload, chatStream("a", "b")); out != chatStream("a", "b") {
+		t.Errorf("changed a conforming stream:\n%s", out)
+	}
+
+	// each deviation is flagged once, before the chunk first showing it
+	chunk := `data: {"id":"%s","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"reasoning_content":"r"},"finish_reason":null}]}` + "\n\n"
+	in := fmt.Sprintf(chunk, "c1") + fmt.Sprintf(chunk, "c1") + fmt.Sprintf(chunk, "c2") + "data: {oops\n\n"
+	out := runPipeline(t, rule, payload, in)
+	var flags []string
+	for _, line := range strings.Split(out, "\n") {
+		if dev, ok := strings.CutPrefix(line, ": deviation "); ok {
+			flags = append(flags, dev)
+		}
+	}
+	want := []string{"nonstandard_field=choices[].delta.reasoning_content", "inconsistent_id", "invalid_json", "missing_done"}
+	if !slices.Equal(flags, want) {
+		t.Errorf("flags %v, want %v:\n%s", flags, want, out)
+	}
+	if !strings.HasPrefix(out, ": deviation nonstandard_field") || !strings.Contains(out, fmt.Sprintf(chunk, "c2")) {
+		t.Errorf("stream:\n%s", out)
+	}
+	if got := responseDeviationsTotal.Value("default", "m", "nonstandard_field") - before; got != 1 {
+		t.Errorf("counted %v nonstandard_field responses", got)
+	}
+
+	// log mode leaves the stream as it is
+	if out := runPipeline(t, &ModelRule{ValidateResponse: validateResponseLog}, payload, in); out != in {
+		t.Errorf("log mode changed the stream:\n%s", out)
+	}
+}
+
+func TestValidateResponseBody(t *testing.T) {
+	body := `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop","stop_reason":2}]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	defer upstream.Close()
+
+	for mode, want := range map[string]string{
+		validateResponseFlag: "nonstandard_field=choices[].stop_reason",
+		validateResponseLog:  "",
+	} {
+		mux, err := newRelayMux(&Config{Upstream: upstream.URL, ModelRules: []ModelRule{{MatchModel: "m", ValidateResponse: mode}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`)))
+		if w.Code != http.StatusOK || w.Body.String() != body {
+			t.Errorf("%s: status %d: %s", mode, w.Code, w.Body)
+		}
+		if got := w.Header().Get(deviationsHeader); got != want {
+			t.Errorf("%s: %s: %q, want %q", mode, deviationsHeader, got, want)
+		}
+	}
+
+	if err := validateModelRules([]ModelRule{{MatchModel: "m", ValidateResponse: "strict"}}); err == nil {
+		t.Error("accepted an unknown validate_response mode")
+	}
+}
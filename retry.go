@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryConfig re-issues upstream requests that failed in a way worth trying
+// again. Many local backends report conditions like "model is loading" only
+// in the body, sometimes with status 200, so body matchers apply to any
+// response that is not a completion. Refused and reset connections are
+// always retried; nothing has reached the client at that point.
+type RetryConfig struct {
+	MaxAttempts  int      `json:"max_attempts"`  // re-issues after the first attempt
+	Backoff      string   `json:"backoff"`       // wait before each re-issue, doubled every time (default "1s")
+	MaxBackoff   string   `json:"max_backoff"`   // cap on the wait, including Retry-After (default "30s")
+	Statuses     []int    `json:"statuses"`      // retryable status codes (default 429, 502, 503, 504)
+	BodyMatchers []string `json:"body_matchers"` // regexes over error bodies, e.g. "overloaded_error", "CUDA out of memory"
+}
+
+var defaultRetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+const defaultRetryMaxBackoff = 30 * time.Second
+
+// maxRetryBodyBytes bounds how much of an error body is read for matching.
+const maxRetryBodyBytes = 64 << 10
+
+var upstreamRetriesTotal = metrics.newCounterVec("relay_upstream_retries_total",
+	"Upstream requests re-issued by retry rules.", "tenant", "model", "reason")
+
+func validateRetry(rc *RetryConfig) error {
+	if rc.MaxAttempts < 1 {
+		return fmt.Errorf("retry.max_attempts must be at least 1")
+	}
+	if rc.Backoff != "" {
+		if d, err := time.ParseDuration(rc.Backoff); err != nil || d < 0 {
+			return fmt.Errorf("invalid retry.backoff %q", rc.Backoff)
+		}
+	}
+	if rc.MaxBackoff != "" {
+		if d, err := time.ParseDuration(rc.MaxBackoff); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retry.max_backoff %q", rc.MaxBackoff)
+		}
+	}
+	_, err := compileRetryMatchers(rc.BodyMatchers)
+	return err
+}
+
+func compileRetryMatchers(matchers []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(matchers))
+	for _, m := range matchers {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			return nil, fmt.Errorf("retry body matcher %q: %w", m, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// retrier wraps a send function with a rule's retry policy.
+type retrier struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	statuses    []int
+	matchers    []*regexp.Regexp
+	tenant      string
+	model       string
+	label       string // model label of the metrics, see metricModel
+}
+
+// newRetrier returns nil when the rule does not retry.
+func newRetrier(rule *ModelRule, tenant, model string) *retrier {
+	if rule == nil || rule.Retry == nil {
+		return nil
+	}
+	rc := rule.Retry
+	// validated at startup
+	matchers, _ := compileRetryMatchers(rc.BodyMatchers)
+	backoff, _ := time.ParseDuration(rc.Backoff)
+	if rc.Backoff == "" {
+		backoff = time.Second
+	}
+	maxBackoff, _ := time.ParseDuration(rc.MaxBackoff)
+	if rc.MaxBackoff == "" {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	statuses := rc.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	return &retrier{
+		maxAttempts: rc.MaxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		statuses:    statuses,
+		matchers:    matchers,
+		tenant:      tenant,
+		model:       model,
+		label:       metricModel(rule),
+	}
+}
+
+// wrap returns send with retries. The last response or error is returned as
+// is when every attempt is retryable, and when the upstream asks via
+// Retry-After for a longer wait than max_backoff.
+func (rt *retrier) wrap(ctx context.Context, send func([]byte) (*http.Response, error)) func([]byte) (*http.Response, error) {
+	if rt == nil {
+		return send
+	}
+	return func(body []byte) (*http.Response, error) {
+		backoff := rt.backoff
+		for attempt := 0; ; attempt++ {
+			resp, err := send(body)
+			reason := ""
+			if err != nil {
+				if !isConnectionError(err) || attempt >= rt.maxAttempts {
+					return nil, err
+				}
+				reason = "connection " + err.Error()
+			} else if resp, reason = rt.check(resp); reason == "" || attempt >= rt.maxAttempts {
+				return resp, nil
+			}
+			wait := min(backoff, rt.maxBackoff)
+			if resp != nil {
+				if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+					if d > rt.maxBackoff {
+						vlogCtx(ctx, "RETRY: upstream asked to retry model '%s' in %s, beyond max_backoff", rt.model, d)
+						return resp, nil
+					}
+					wait = d
+				}
+				resp.Body.Close()
+			}
+			vlogCtx(ctx, "RETRY: upstream %s for model '%s', retrying in %s (%d/%d)", reason, rt.model, wait, attempt+1, rt.maxAttempts)
+			upstreamRetriesTotal.Inc(rt.tenant, rt.label, strings.Fields(reason)[0])
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// isConnectionError reports whether err means the upstream refused or
+// dropped the connection, so it never produced a response.
+func isConnectionError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// check reports why resp should be retried, or "" when it should not. The
+// part of the body it reads is put back so resp can still be relayed.
+func (rt *retrier) check(resp *http.Response) (*http.Response, string) {
+	retryStatus := slices.Contains(rt.statuses, resp.StatusCode)
+	if len(rt.matchers) == 0 {
+		if retryStatus {
+			return resp, fmt.Sprintf("status %d", resp.StatusCode)
+		}
+		return resp, ""
+	}
+
+	var head []byte
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		head = peekFirstEvent(resp)
+		if !strings.Contains(string(head), `"error"`) {
+			return resp, ""
+		}
+	} else {
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRetryBodyBytes))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		if err != nil {
+			return resp, ""
+		}
+		head = raw
+		// a body larger than the limit is not an error message
+		if resp.StatusCode == http.StatusOK && (len(raw) == maxRetryBodyBytes || isCompletionBody(raw)) {
+			return resp, ""
+		}
+	}
+	if retryStatus {
+		return resp, fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	for _, re := range rt.matchers {
+		if re.Match(head) {
+			return resp, fmt.Sprintf("body matched %q", re.String())
+		}
+	}
+	return resp, ""
+}
+
+// peekFirstEvent reads the first non-empty line of a stream and puts it back.
+func peekFirstEvent(resp *http.Response) []byte {
+	reader := bufio.NewReader(io.LimitReader(resp.Body, maxRetryBodyBytes))
+	var head []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		head = append(head, line...)
+		if len(bytes.TrimSpace(line)) > 0 || err != nil {
+			break
+		}
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), reader, resp.Body), resp.Body}
+	return head
+}
+
+// isCompletionBody reports whether a 200 body is a normal completion rather
+// than an error in disguise.
+func isCompletionBody(raw []byte) bool {
+	var body map[string]any
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return false
+	}
+	_, hasError := body["error"]
+	_, hasChoices := body["choices"]
+	return hasChoices && !hasError
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryMatchers(t *testing.T) {
+	var failures []func(w http.ResponseWriter)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(failures) {
+			failures[n-1](w)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"model is loading fine"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+
+	loading200 := func(w http.ResponseWriter) { fmt.Fprint(w, `{"error":{"message":"model is loading"}}`) }
+	oom400 := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"CUDA out of memory"}`)
+	}
+	unavailable := func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }
+	streamErr := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, `data: {"error":{"type":"overloaded_error"}}`)
+	}
+	badRequest := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid messages"}`)
+	}
+
+	matchers := []string{"model is loading", "CUDA out of memory", "overloaded_error"}
+	tests := []struct {
+		name      string
+		failures  []func(w http.ResponseWriter)
+		stream    bool
+		wantCalls int
+		wantCode  int
+	}{
+		{"200 with error body", []func(http.ResponseWriter){loading200}, false, 2, 200},
+		{"400 with matching body", []func(http.ResponseWriter){oom400, oom400}, false, 3, 200},
+		{"retryable status", []func(http.ResponseWriter){unavailable}, false, 2, 200},
+		{"stream error event", []func(http.ResponseWriter){streamErr}, true, 2, 200},
+		{"non-matching error", []func(http.ResponseWriter){badRequest}, false, 1, 400},
+		{"attempts exhausted", []func(http.ResponseWriter){oom400, oom400, oom400}, false, 3, 400},
+		{"completion mentioning a matcher", nil, false, 1, 200},
+	}
+	for _, tt := range tests {
+		failures = tt.failures
+		calls.Store(0)
+		cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", Retry: &RetryConfig{MaxAttempts: 2, Backoff: "1ms", BodyMatchers: matchers}}}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(fmt.Sprintf(`{"model":"m","stream":%v}`, tt.stream)))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		if int(calls.Load()) != tt.wantCalls || w.Code != tt.wantCode {
+			t.Errorf("%s: calls/status = %d/%d, want %d/%d: %s", tt.name, calls.Load(), w.Code, tt.wantCalls, tt.wantCode, w.Body.String())
+		}
+		if tt.wantCode == 400 && !strings.Contains(w.Body.String(), "error") {
+			t.Errorf("%s: the last error body was not relayed: %q", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestRetryConnectionErrorsAndRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	var fail func(w http.ResponseWriter, r *http.Request) bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if fail(w, r) {
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+
+	send := func(rc *RetryConfig) (*httptest.ResponseRecorder, time.Duration) {
+		calls.Store(0)
+		cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", Retry: rc}}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		start := time.Now()
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		return w, time.Since(start)
+	}
+
+	// a reset connection is retried
+	fail = func(w http.ResponseWriter, r *http.Request) bool {
+		if calls.Load() > 1 {
+			return false
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+		return true
+	}
+	if w, _ := send(&RetryConfig{MaxAttempts: 1, Backoff: "1ms"}); w.Code != 200 || calls.Load() != 2 {
+		t.Errorf("reset connection: status %d after %d calls", w.Code, calls.Load())
+	}
+
+	// Retry-After replaces the backoff
+	fail = func(w http.ResponseWriter, r *http.Request) bool {
+		if calls.Load() > 1 {
+			return false
+		}
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+	if w, took := send(&RetryConfig{MaxAttempts: 1, Backoff: "1ms"}); w.Code != 200 || calls.Load() != 2 || took < time.Second {
+		t.Errorf("Retry-After: status %d after %d calls in %s", w.Code, calls.Load(), took)
+	}
+	// a Retry-After beyond max_backoff is relayed instead of waited for
+	if w, took := send(&RetryConfig{MaxAttempts: 1, Backoff: "1ms", MaxBackoff: "100ms"}); w.Code != 429 || calls.Load() != 1 || took > time.Second {
+		t.Errorf("Retry-After beyond max_backoff: status %d after %d calls in %s", w.Code, calls.Load(), took)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	} {
+		if got, ok := parseRetryAfter(tt.in, now); got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v; want %s, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ruleRegexps caches compiled match_model_regex patterns; rules are
+// validated at load, so lookups never see a bad pattern.
+var ruleRegexps sync.Map // pattern -> *regexp.Regexp
+
+// compileRuleRegexp compiles a match_model_regex. The pattern must match the
+// whole model name.
+func compileRuleRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := ruleRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match_model_regex %q: %w", pattern, err)
+	}
+	ruleRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// isGlob reports whether a match_model is a glob pattern such as "qwen2.5-*".
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+func validateRuleMatch(rule ModelRule) error {
+	if isGlob(rule.MatchModel) {
+		if _, err := path.Match(rule.MatchModel, ""); err != nil {
+			return fmt.Errorf("invalid match_model pattern %q: %w", rule.MatchModel, err)
+		}
+	}
+	if rule.MatchModelRegex != "" {
+		if _, err := compileRuleRegexp(rule.MatchModelRegex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findRule returns the rule for model. An exact match_model wins, then glob
+// patterns, then match_model_regex; within each kind the first rule in the
+// config wins.
+func findRule(rules []ModelRule, model string) *ModelRule {
+	if rule := findExactRule(rules, model); rule != nil {
+		return rule
+	}
+	for i := range rules {
+		if isGlob(rules[i].MatchModel) {
+			if ok, _ := path.Match(rules[i].MatchModel, model); ok {
+				return &rules[i]
+			}
+		}
+	}
+	for i := range rules {
+		if rules[i].MatchModelRegex == "" {
+			continue
+		}
+		if re, err := compileRuleRegexp(rules[i].MatchModelRegex); err == nil && re.MatchString(model) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func findExactRule(rules []ModelRule, model string) *ModelRule {
+	for i := range rules {
+		if rules[i].MatchModel == model {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// ruleName identifies a rule in logs and errors.
+func ruleName(rule *ModelRule) string {
+	if rule.MatchModel == "" && rule.MatchModelRegex != "" {
+		return "/" + rule.MatchModelRegex + "/"
+	}
+	return rule.MatchModel
+}
+
+// Values of unmatched_models, which decides what happens to requests for a
+// model that no rule, not even "default", matches.
+const (
+	unmatchedPass   = "pass"   // forward unchanged (the default)
+	unmatchedReject = "reject" // answer 404 model_not_found
+	unmatchedRoute  = "route"  // forward to catch_all_model
+)
+
+func validateUnmatched(cfg *Config) error {
+	switch cfg.UnmatchedModels {
+	case "", unmatchedPass, unmatchedReject:
+	case unmatchedRoute:
+		if cfg.CatchAllModel == "" {
+			return fmt.Errorf("unmatched_models %q requires catch_all_model", unmatchedRoute)
+		}
+	default:
+		return fmt.Errorf("unknown unmatched_models %q", cfg.UnmatchedModels)
+	}
+	return nil
+}
+
+// routeUnmatched applies unmatched_models to the request. It reports false
+// when the request must be rejected.
+func routeUnmatched(cfg *Config, payload map[string]any) bool {
+	if cfg.UnmatchedModels == "" || cfg.UnmatchedModels == unmatchedPass {
+		return true
+	}
+	model := getString(payload, "model")
+	if resolveRule(cfg, model) != nil {
+		return true
+	}
+	if cfg.UnmatchedModels == unmatchedReject {
+		vlog("RULE: no rule for model '%s', rejecting", model)
+		return false
+	}
+	vlog("RULE: no rule for model '%s', routing to '%s'", model, cfg.CatchAllModel)
+	payload["model"] = cfg.CatchAllModel
+	return true
+}
+
+// writeModelNotFound answers like OpenAI does for a model that does not
+// exist or that the key may not use.
+func writeModelNotFound(w http.ResponseWriter, model string) {
+	writeJSONError(w, http.StatusNotFound,
+		fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model),
+		"invalid_request_error", "model_not_found")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindRulePatterns(t *testing.T) {
+	rules := []ModelRule{
+		{MatchModelRegex: `qwen2\.5-.*-instruct`},
+		{MatchModel: "qwen2.5-*"},
+		{MatchModel: "qwen2.5-7b-*"},
+		{MatchModel: "qwen2.5-72b-instruct"},
+		{MatchModel: "llama-3.?-8b"},
+		{MatchModelRegex: `(?i)deepseek-(r1|v3)`},
+		{MatchModel: "default"},
+	}
+
+	tests := []struct {
+		model string
+		want  int // index into rules, -1 for no match
+	}{
+		{"qwen2.5-72b-instruct", 3}, // exact beats patterns
+		{"qwen2.5-7b-instruct", 1},  // first glob in config order, regardless of specificity
+		{"qwen2.5-14b", 1},
+		{"llama-3.1-8b", 4},
+		{"llama-3.10-8b", -1},
+		{"DeepSeek-R1", 5},
+		{"deepseek-r1-distill", -1}, // regexes match the whole name
+		{"gpt-4", -1},
+	}
+	for _, tt := range tests {
+		got := findRule(rules, tt.model)
+		switch {
+		case tt.want < 0 && got != nil:
+			t.Errorf("findRule(%q) = %q, want no match", tt.model, ruleName(got))
+		case tt.want >= 0 && got != &rules[tt.want]:
+			t.Errorf("findRule(%q) = %v, want rule %d", tt.model, got, tt.want)
+		}
+	}
+
+	cfg := &Config{ModelRules: rules}
+	if got := resolveRule(cfg, "gpt-4"); got != &rules[6] {
+		t.Errorf("resolveRule(gpt-4) = %v, want the default rule", got)
+	}
+}
+
+func TestValidateRuleMatch(t *testing.T) {
+	for _, rule := range []ModelRule{
+		{MatchModel: "qwen[2"},
+		{MatchModelRegex: "qwen("},
+	} {
+		if err := validateModelRules([]ModelRule{rule}); err == nil {
+			t.Errorf("validateModelRules(%+v) succeeded, want error", rule)
+		}
+	}
+}
+
+func TestUnmatchedModels(t *testing.T) {
+	upstream := echoUpstream("global")
+	defer upstream.Close()
+	rules := []ModelRule{
+		{MatchModel: "qwen-*"},
+		{MatchModel: "catch-all", Set: map[string]any{"model": "qwen-7b"}},
+	}
+
+	tests := []struct {
+		mode, model string
+		wantStatus  int
+		wantModel   string
+	}{
+		{"", "gpt-4", 200, "gpt-4"},
+		{"pass", "gpt-4", 200, "gpt-4"},
+		{"reject", "gpt-4", 404, ""},
+		{"reject", "qwen-72b", 200, "qwen-72b"},
+		{"route", "gpt-4", 200, "qwen-7b"}, // the catch-all model's own rule applies
+		{"route", "qwen-72b", 200, "qwen-72b"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Upstream: upstream.URL, ModelRules: rules, UnmatchedModels: tt.mode, CatchAllModel: "catch-all"}
+		mux, err := newRelayMux(cfg)
+		if err != nil {
+			t.Fatalf("newRelayMux() failed: %v", err)
+		}
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+tt.model+`"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: status %d, want %d", tt.mode, tt.model, w.Code, tt.wantStatus)
+			continue
+		}
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		if tt.wantStatus == 404 {
+			if e, _ := body["error"].(map[string]any); e["code"] != "model_not_found" {
+				t.Errorf("%s %s: body %v, want model_not_found", tt.mode, tt.model, body)
+			}
+			continue
+		}
+		if body["model"] != tt.wantModel {
+			t.Errorf("%s %s: upstream got model %v, want %s", tt.mode, tt.model, body["model"], tt.wantModel)
+		}
+	}
+
+	for _, cfg := range []*Config{{UnmatchedModels: "route"}, {UnmatchedModels: "drop"}} {
+		if err := validateUnmatched(cfg); err == nil {
+			t.Errorf("validateUnmatched(%q) succeeded, want error", cfg.UnmatchedModels)
+		}
+	}
+}
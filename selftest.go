@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"llm-api-relay/toolcallfix"
+)
+
+// selftestScripts hold, per toolcallfix format, the content a model streams
+// when it emits a tool call as plain text; toolcallfix must turn it into
+// tool_calls.
+var selftestScripts = map[string][]string{
+	toolcallfix.FormatGLM: {
+		"Let me search for that information.",
+		"\n</think>\n",
+		"<tool_call>",
+		"search",
+		"<arg_key>",
+		"query",
+		"</arg_key>",
+		"<arg_value>",
+		"test query",
+		"</arg_value>",
+		"</tool_call>",
+	},
+	toolcallfix.FormatHermes: {
+		"Let me search for that information.",
+		"<tool_call>",
+		`{"name": "search", `,
+		`"arguments": {"query": "test query"}}`,
+		"</tool_call>",
+	},
+	toolcallfix.FormatDeepSeek: {
+		"<think>",
+		"The user wants a search.",
+		"</think>",
+		"Let me search for that information.",
+		"<｜tool▁calls▁begin｜>",
+		"<｜tool▁call▁begin｜>",
+		"function",
+		"<｜tool▁sep｜>",
+		"search\n```json\n",
+		`{"query": "test query"}`,
+		"\n```",
+		"<｜tool▁call▁end｜>",
+		"<｜tool▁calls▁end｜>",
+	},
+}
+
+// selftestFormatHeader tells the mock upstream which script to stream;
+// selftestTagsHeader carries a rule's toolcallfix_tags as JSON.
+const (
+	selftestFormatHeader = "X-Selftest-Format"
+	selftestTagsHeader   = "X-Selftest-Tags"
+)
+
+// selftestTagScript is the tool call a model with custom tags streams.
+func selftestTagScript(format string, tags *toolcallfix.Tags) []string {
+	body := "search<arg_key>query</arg_key><arg_value>test query</arg_value>"
+	if tags.Body == toolcallfix.BodyJSON || (tags.Body == "" && format == toolcallfix.FormatHermes) {
+		body = `{"name": "search", "arguments": {"query": "test query"}}`
+	}
+	return []string{"Let me search for that information.", tags.Start, body, tags.End}
+}
+
+// selftestUpstream mocks both chat and legacy completions streaming APIs.
+func selftestUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/models" {
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": []any{}})
+		return
+	}
+	chat := strings.HasSuffix(r.URL.Path, "/chat/completions")
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	format := r.Header.Get(selftestFormatHeader)
+	script, ok := selftestScripts[format]
+	if !ok {
+		script = selftestScripts[toolcallfix.FormatGLM]
+	}
+	var tags toolcallfix.Tags
+	if json.Unmarshal([]byte(r.Header.Get(selftestTagsHeader)), &tags) == nil {
+		script = selftestTagScript(format, &tags)
+	}
+	// like real backends, end with a finish chunk of its own
+	for i, piece := range append(script, "") {
+		choice := map[string]any{"index": 0, "finish_reason": nil}
+		if i == len(script) {
+			choice["finish_reason"] = "stop"
+		}
+		object := "text_completion"
+		if chat {
+			choice["delta"] = map[string]any{"content": piece}
+			object = "chat.completion.chunk"
+		} else {
+			choice["text"] = piece
+		}
+		chunk, _ := json.Marshal(map[string]any{
+			"id": "selftest", "object": object, "created": 0, "model": "selftest",
+			"choices": []any{choice},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", chunk)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// runSelftest implements `relay selftest --config cfg.jsonc`. It returns the
+// process exit code.
+func runSelftest(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(out)
+	var configPath string
+	fs.StringVar(&configPath, "config", "", "path to jsonc config")
+	fs.StringVar(&configPath, "c", "", "path to jsonc config")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if configPath == "" {
+		fmt.Fprintln(out, "Usage: selftest --config <config.jsonc>")
+		return 2
+	}
+
+	cfg, err := loadConfigJSONC(configPath)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  load config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "llm-api-relay %s selftest\n", buildVersion())
+
+	upstream, err := serveLocal(http.HandlerFunc(selftestUpstream))
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  start mock upstream: %v\n", err)
+		return 1
+	}
+	defer upstream.Close()
+
+	// Run the user's rules against the mock, without side effects on
+	// transcripts, exporters, metrics, tracing backends, the audit log, the
+	// event and body logs or the usage ledger.
+	// Preflight is skipped since it would hold /health at "starting".
+	testCfg := *cfg
+	testCfg.Upstream = "http://" + upstream.Addr().String()
+	testCfg.Transcripts = nil
+	testCfg.Exporters = nil
+	testCfg.Tracing = nil
+	testCfg.MetricsPush = nil
+	testCfg.Preflight = nil
+	testCfg.ClientKeys = nil
+	testCfg.Audit = nil
+	testCfg.EventLog = nil
+	testCfg.BodyLog = nil
+	testCfg.UsageLedger = nil
+	mux, err := newRelayMux(&testCfg)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  build relay: %v\n", err)
+		return 1
+	}
+	relay, err := serveLocal(mux)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL  start relay: %v\n", err)
+		return 1
+	}
+	defer relay.Close()
+	base := "http://" + relay.Addr().String()
+
+	passed, failed := 0, 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		passed++
+		fmt.Fprintf(out, "PASS  %s\n", name)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	report("GET /health", func() error {
+		resp, err := client.Get(base + "/health")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}())
+
+	var models, formats []string
+	var tags []*toolcallfix.Tags
+	skipped := 0
+	for _, rule := range cfg.ModelRules {
+		if !rule.EnableToolCallFix {
+			continue
+		}
+		model := rule.MatchModel
+		if model == "default" {
+			model = "selftest-default"
+		}
+		if model == "" || (isGlob(model) && findRule([]ModelRule{rule}, model) == nil) {
+			fmt.Fprintf(out, "SKIP  toolcallfix for rule %q: pattern has no model name to test with\n", ruleName(&rule))
+			skipped++
+			continue
+		}
+		models = append(models, model)
+		formats = append(formats, rule.ToolCallFixFormat)
+		tags = append(tags, rule.ToolCallFixTags)
+	}
+	if len(models) == 0 && skipped == 0 {
+		fmt.Fprintln(out, "SKIP  toolcallfix: no model rule sets enable_toolcallfix")
+	}
+	for i, model := range models {
+		report(fmt.Sprintf("toolcallfix stream for model %q", model), selftestToolCall(client, base, model, formats[i], tags[i]))
+	}
+
+	fmt.Fprintf(out, "%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// selftestToolCall streams the scripted response for model through the relay
+// and checks that a well-formed tool call comes out the other side.
+func selftestToolCall(client *http.Client, base, model, format string, tags *toolcallfix.Tags) error {
+	body, _ := json.Marshal(map[string]any{
+		"model":    model,
+		"messages": []any{map[string]any{"role": "user", "content": "search for something"}},
+		"stream":   true,
+	})
+	req, err := http.NewRequest(http.MethodPost, base+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(selftestFormatHeader, format)
+	if tags != nil {
+		b, _ := json.Marshal(tags)
+		req.Header.Set(selftestTagsHeader, string(b))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var name, args, finish, content string
+	done := false
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk toolcallfix.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("invalid chunk %q: %w", data, err)
+		}
+		for _, c := range chunk.Choices {
+			content += c.Delta.Content
+			for _, tc := range c.Delta.ToolCalls {
+				name += tc.Function.Name
+				args += tc.Function.Arguments
+			}
+			if c.FinishReason != nil && *c.FinishReason != "" {
+				finish = *c.FinishReason
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case !done:
+		return errors.New("stream ended without [DONE]")
+	case name == "":
+		return errors.New("no tool_calls in stream; tool call markup was not converted")
+	case strings.Contains(content, "<tool_call>") || strings.Contains(content, "tool▁call"):
+		return errors.New("raw tool call markup leaked into content")
+	case name != "search":
+		return fmt.Errorf("tool name %q, want %q", name, "search")
+	case finish != "tool_calls":
+		return fmt.Errorf("finish_reason %q, want %q", finish, "tool_calls")
+	}
+	var parsed map[string]string
+	if err := json.Unmarshal([]byte(args), &parsed); err != nil || parsed["query"] != "test query" {
+		return fmt.Errorf("unexpected tool arguments %q", args)
+	}
+	return nil
+}
+
+// serveLocal serves h on an ephemeral loopback port.
+func serveLocal(h http.Handler) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() { _ = http.Serve(ln, h) }()
+	return ln, nil
+}
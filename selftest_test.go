@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSelftest(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "bridged completions upstream",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"glm","enable_toolcallfix":true,"upstream_api":"completions","prompt_template":"chatml"}]}`,
+			wantCode: 0,
+			want:     []string{`PASS  toolcallfix stream for model "glm"`, "2 passed, 0 failed"},
+		},
+		{
+			name:     "deepseek format",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"deepseek-r1","enable_toolcallfix":true,"toolcallfix_format":"deepseek"}]}`,
+			wantCode: 0,
+			want:     []string{`PASS  toolcallfix stream for model "deepseek-r1"`, "2 passed, 0 failed"},
+		},
+		{
+			name:     "hermes format and custom tags",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"qwen3","enable_toolcallfix":true,"toolcallfix_format":"hermes"},{"match_model":"phi","enable_toolcallfix":true,"toolcallfix_tags":{"start":"<|tool_call|>","end":"<|/tool_call|>","body":"json"}}]}`,
+			wantCode: 0,
+			want:     []string{`PASS  toolcallfix stream for model "qwen3"`, `PASS  toolcallfix stream for model "phi"`, "3 passed, 0 failed"},
+		},
+		{
+			name:     "pattern rules",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"glm-*","enable_toolcallfix":true},{"match_model_regex":"qwen.*","enable_toolcallfix":true}]}`,
+			wantCode: 0,
+			want:     []string{`PASS  toolcallfix stream for model "glm-*"`, `SKIP  toolcallfix for rule "/qwen.*/"`, "2 passed, 0 failed"},
+		},
+		{
+			name:     "rule breaks streaming",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"glm","enable_toolcallfix":true,"unset":["stream"]}]}`,
+			wantCode: 1,
+			want:     []string{`FAIL  toolcallfix stream for model "glm"`, "1 passed, 1 failed"},
+		},
+		{
+			name:     "no toolcallfix rules",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"glm"}]}`,
+			wantCode: 0,
+			want:     []string{"SKIP  toolcallfix", "1 passed, 0 failed"},
+		},
+		{
+			name:     "unknown toolcallfix format",
+			config:   `{"upstream":"http://127.0.0.1:1","model_rules":[{"match_model":"glm","toolcallfix_format":"mistral"}]}`,
+			wantCode: 1,
+			want:     []string{"FAIL  load config", `unknown toolcallfix format "mistral"`},
+		},
+		{
+			name:     "invalid config",
+			config:   `{"model_rules":[{"match_model":"glm","prompt_template":"nope"}]}`,
+			wantCode: 1,
+			want:     []string{"FAIL  load config"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.jsonc")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if code := runSelftest([]string{"-c", path}, &out); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d:\n%s", code, tt.wantCode, out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output missing %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
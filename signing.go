@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request signing lets a relay trust requests from the relays in front of it
+// over a network it does not trust, with a shared secret instead of mTLS.
+// The sender signs the method, path, a timestamp, a nonce and the SHA-256 of
+// the body; the receiver recomputes the HMAC with each key it accepts.
+const (
+	signatureHeader       = "X-Relay-Signature"
+	signatureTimeHeader   = "X-Relay-Timestamp"
+	signatureNonceHeader  = "X-Relay-Nonce"
+	signatureDigestHeader = "X-Relay-Content-Sha256"
+
+	signatureVersion = "v1"
+)
+
+// defaultMaxSignatureSkew bounds both clock drift between relays and how
+// long a captured request could be replayed, were it not for the nonces.
+const defaultMaxSignatureSkew = 5 * time.Minute
+
+var signatureRejectionsTotal = metrics.newCounterVec("relay_signature_rejections_total",
+	"Requests refused for a missing or invalid relay signature, by reason.", "reason")
+
+// RequestSigningConfig makes the relay accept only requests signed by a
+// relay holding one of the keys.
+type RequestSigningConfig struct {
+	Keys     []string `json:"keys"`      // accepted secrets; list the old and new one during a rotation
+	KeyFiles []string `json:"key_files"` // files holding accepted secrets, re-read when they change
+	MaxSkew  string   `json:"max_skew"`  // how far a timestamp may be from the relay's clock (default "5m")
+	Optional bool     `json:"optional"`  // let unsigned requests through while senders are being set up
+}
+
+func validateRequestSigning(c *RequestSigningConfig) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Keys) == 0 && len(c.KeyFiles) == 0 {
+		return errors.New("request_signing needs keys or key_files")
+	}
+	for i, k := range c.Keys {
+		if k == "" {
+			return fmt.Errorf("request_signing.keys[%d] is empty", i)
+		}
+	}
+	for _, f := range c.KeyFiles {
+		k, err := apiKeyFiles.read(f)
+		if err != nil {
+			return fmt.Errorf("request_signing.key_files: %w", err)
+		}
+		if k == "" {
+			return fmt.Errorf("request_signing.key_files: %s is empty", f)
+		}
+	}
+	if c.MaxSkew != "" {
+		if d, err := time.ParseDuration(c.MaxSkew); err != nil || d <= 0 {
+			return fmt.Errorf("request_signing: invalid max_skew %q", c.MaxSkew)
+		}
+	}
+	return nil
+}
+
+// validateSigningKey checks the signing key of upstream_options.
+func validateSigningKey(o *UpstreamOptions) error {
+	if o.SigningKey != "" && o.SigningKeyFile != "" {
+		return errors.New("upstream_options: signing_key and signing_key_file are mutually exclusive")
+	}
+	if o.SigningKeyFile == "" {
+		return nil
+	}
+	k, err := apiKeyFiles.read(o.SigningKeyFile)
+	if err != nil {
+		return fmt.Errorf("upstream_options.signing_key_file: %w", err)
+	}
+	if k == "" {
+		return fmt.Errorf("upstream_options.signing_key_file %s is empty", o.SigningKeyFile)
+	}
+	return nil
+}
+
+// signaturePayload is the text the HMAC is computed over.
+func signaturePayload(method, uri, timestamp, nonce, digest string) string {
+	return strings.Join([]string{signatureVersion, timestamp, nonce, method, uri, digest}, "\n")
+}
+
+func computeSignature(key, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sign adds the signature headers to an upstream request when the upstream
+// options have a signing key. The body is read to hash it and put back.
+func (c *upstreamClient) sign(req *http.Request) error {
+	key := resolveAPIKey(c.opts.SigningKey, c.opts.SigningKeyFile)
+	if key == "" {
+		return nil
+	}
+	body, err := bufferRequestBody(req)
+	if err != nil {
+		return fmt.Errorf("sign request: %w", err)
+	}
+	var nonce [12]byte
+	_, _ = rand.Read(nonce[:])
+	sum := sha256.Sum256(body)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h := req.Header
+	h.Set(signatureTimeHeader, ts)
+	h.Set(signatureNonceHeader, hex.EncodeToString(nonce[:]))
+	h.Set(signatureDigestHeader, hex.EncodeToString(sum[:]))
+	payload := signaturePayload(req.Method, req.URL.RequestURI(), ts, h.Get(signatureNonceHeader), h.Get(signatureDigestHeader))
+	h.Set(signatureHeader, signatureVersion+"="+hex.EncodeToString(computeSignature(key, payload)))
+	return nil
+}
+
+// bufferRequestBody returns the body of req and leaves req able to send it.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	return body, nil
+}
+
+// signatureVerifier checks the signatures of incoming requests and
+// remembers the nonces it accepted until their timestamps expire.
+type signatureVerifier struct {
+	cfg  RequestSigningConfig
+	skew time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // nonce -> when it may be forgotten
+	nextPrune time.Time
+}
+
+// newSignatureVerifier returns nil without a request_signing section.
+func newSignatureVerifier(c *RequestSigningConfig) *signatureVerifier {
+	if c == nil {
+		return nil
+	}
+	v := &signatureVerifier{cfg: *c, skew: defaultMaxSignatureSkew, nonces: map[string]time.Time{}}
+	if d, err := time.ParseDuration(c.MaxSkew); err == nil && d > 0 {
+		v.skew = d
+	}
+	return v
+}
+
+// keys returns the secrets accepted now, reading rotated key files again.
+func (v *signatureVerifier) keys() []string {
+	keys := append([]string(nil), v.cfg.Keys...)
+	for _, f := range v.cfg.KeyFiles {
+		if k := resolveAPIKey("", f); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// check returns why r carries no valid signature, as a metric label and a
+// message, or "" when it does.
+func (v *signatureVerifier) check(r *http.Request, now time.Time) (reason, msg string) {
+	h := r.Header
+	sig, ok := strings.CutPrefix(h.Get(signatureHeader), signatureVersion+"=")
+	ts, nonce, digest := h.Get(signatureTimeHeader), h.Get(signatureNonceHeader), h.Get(signatureDigestHeader)
+	if !ok || ts == "" || nonce == "" || digest == "" {
+		return "missing", "the request is not signed"
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "bad_timestamp", "invalid " + signatureTimeHeader
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > v.skew || d < -v.skew {
+		return "expired", fmt.Sprintf("the signature timestamp is %s off the relay's clock", d.Round(time.Second))
+	}
+	body, err := bufferRequestBody(r)
+	if err != nil {
+		return "bad_digest", "read body failed"
+	}
+	sum := sha256.Sum256(body)
+	if !strings.EqualFold(digest, hex.EncodeToString(sum[:])) {
+		return "bad_digest", "the body does not match " + signatureDigestHeader
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return "bad_signature", "the signature does not match"
+	}
+	payload := signaturePayload(r.Method, r.URL.RequestURI(), ts, nonce, digest)
+	valid := false
+	for _, k := range v.keys() {
+		if hmac.Equal(want, computeSignature(k, payload)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "bad_signature", "the signature does not match"
+	}
+	if !v.remember(nonce, time.Unix(sec, 0).Add(v.skew), now) {
+		return "replayed", "the request was already received"
+	}
+	return "", ""
+}
+
+// remember records a nonce until expires and reports whether it was new.
+func (v *signatureVerifier) remember(nonce string, expires, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.After(v.nextPrune) {
+		for n, exp := range v.nonces {
+			if now.After(exp) {
+				delete(v.nonces, n)
+			}
+		}
+		v.nextPrune = now.Add(v.skew)
+	}
+	if _, seen := v.nonces[nonce]; seen {
+		return false
+	}
+	v.nonces[nonce] = expires
+	return true
+}
+
+// guard rejects requests without a valid signature. The signature headers
+// are removed before the request goes on, so they are not forwarded to an
+// upstream that signs with a key of its own.
+func (v *signatureVerifier) guard(next http.HandlerFunc) http.HandlerFunc {
+	if v == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(signatureHeader) != "" || !v.cfg.Optional {
+			if reason, msg := v.check(r, time.Now()); reason != "" {
+				logCtxf(r.Context(), slog.LevelWarn, "SIGNING: rejected %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, msg)
+				signatureRejectionsTotal.Inc(reason)
+				writeJSONError(w, http.StatusUnauthorized, "Invalid relay signature: "+msg+".", "invalid_request_error", "invalid_signature")
+				return
+			}
+		}
+		for _, k := range []string{signatureHeader, signatureTimeHeader, signatureNonceHeader, signatureDigestHeader} {
+			r.Header.Del(k)
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestSigning(t *testing.T) {
+	var leaked []string
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = nil
+		for _, h := range []string{signatureHeader, signatureTimeHeader, signatureNonceHeader, signatureDigestHeader} {
+			if r.Header.Get(h) != "" {
+				leaked = append(leaked, h)
+			}
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer model.Close()
+	centralMux, err := newRelayMux(&Config{
+		Upstream:       model.URL,
+		RequestSigning: &RequestSigningConfig{Keys: []string{"old-secret", "new-secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	central := httptest.NewServer(centralMux)
+	defer central.Close()
+	edge, err := newRelayMux(&Config{
+		Upstream:        central.URL,
+		UpstreamOptions: &UpstreamOptions{SigningKey: "new-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	w := httptest.NewRecorder()
+	edge.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed by the edge relay: %d %s", w.Code, w.Body.String())
+	}
+	if len(leaked) > 0 {
+		t.Errorf("signature headers forwarded to the model server: %v", leaked)
+	}
+
+	// a request signed by hand, sent as is and then changed
+	signed := func(key, body string, at time.Time) *http.Request {
+		r, _ := http.NewRequest("POST", central.URL+"/v1/chat/completions", strings.NewReader(body))
+		c := &upstreamClient{opts: UpstreamOptions{SigningKey: key}}
+		if err := c.sign(r); err != nil {
+			t.Fatal(err)
+		}
+		if !at.IsZero() {
+			ts := strconv.FormatInt(at.Unix(), 10)
+			r.Header.Set(signatureTimeHeader, ts)
+			u, _ := url.Parse(central.URL + "/v1/chat/completions")
+			payload := signaturePayload("POST", u.RequestURI(), ts, r.Header.Get(signatureNonceHeader), r.Header.Get(signatureDigestHeader))
+			r.Header.Set(signatureHeader, "v1="+hex.EncodeToString(computeSignature(key, payload)))
+		}
+		return r
+	}
+	send := func(r *http.Request) int {
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	ok := signed("old-secret", body, time.Time{})
+	replay := ok.Clone(ok.Context())
+	if code := send(ok); code != http.StatusOK {
+		t.Errorf("signed with the old key: %d", code)
+	}
+	replay.Body, _ = replay.GetBody()
+	tampered := signed("new-secret", body, time.Time{})
+	tampered.Body, tampered.GetBody = nil, nil
+	setRequestBody(tampered, []byte(strings.Replace(body, "hi", "bye", 1)))
+	unsigned, _ := http.NewRequest("POST", central.URL+"/v1/chat/completions", strings.NewReader(body))
+	for _, tt := range []struct {
+		name   string
+		r      *http.Request
+		reason string
+	}{
+		{"unsigned", unsigned, "missing"},
+		{"replayed", replay, "replayed"},
+		{"changed body", tampered, "bad_digest"},
+		{"unknown key", signed("other-secret", body, time.Time{}), "bad_signature"},
+		{"stale", signed("new-secret", body, time.Now().Add(-10*time.Minute)), "expired"},
+	} {
+		before := signatureRejectionsTotal.Value(tt.reason)
+		if code := send(tt.r); code != http.StatusUnauthorized {
+			t.Errorf("%s: %d", tt.name, code)
+		}
+		if signatureRejectionsTotal.Value(tt.reason) != before+1 {
+			t.Errorf("%s: not counted as %s", tt.name, tt.reason)
+		}
+	}
+}
+
+func TestRequestSigningOptional(t *testing.T) {
+	v := newSignatureVerifier(&RequestSigningConfig{Keys: []string{"secret"}, Optional: true})
+	h := v.guard(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("unsigned request: %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(`{}`)))
+	r.Header.Set(signatureHeader, "v1=00")
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("badly signed request: %d", w.Code)
+	}
+}
+
+func TestValidateRequestSigning(t *testing.T) {
+	for _, c := range []*RequestSigningConfig{
+		{},
+		{Keys: []string{""}},
+		{Keys: []string{"k"}, MaxSkew: "soon"},
+		{KeyFiles: []string{"/nonexistent/key"}},
+	} {
+		if validateRequestSigning(c) == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	if err := validateSigningKey(&UpstreamOptions{SigningKey: "k", SigningKeyFile: "f"}); err == nil {
+		t.Error("signing_key with signing_key_file accepted")
+	}
+}
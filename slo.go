@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLOConfig sets service level objectives for the models a rule matches.
+type SLOConfig struct {
+	Availability float64 `json:"availability"` // share of requests answered without a 5xx, e.g. 0.995
+	TTFTP95      string  `json:"ttft_p95"`     // 95% of successful requests send their first byte within this, e.g. "2s"
+}
+
+// SLOAlertConfig notifies a webhook when an error budget burns too fast.
+type SLOAlertConfig struct {
+	Webhook     string  `json:"webhook"`      // URL that firing and resolved alerts are POSTed to
+	BurnRate    float64 `json:"burn_rate"`    // alert when both windows burn at least this fast, default 14.4
+	MinRequests int     `json:"min_requests"` // requests the short window needs before it can fire, default 10
+}
+
+const (
+	defaultSLOBurnRate    = 14.4 // spends 2% of a 30-day budget in an hour
+	defaultSLOMinRequests = 10
+)
+
+// Burn rates are measured over a short and a long window; an alert needs
+// both, so it fires quickly on a sharp drop but not on a brief blip.
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{{"5m", 5}, {"1h", 60}}
+
+func validateSLO(c *SLOConfig) error {
+	if c.Availability == 0 && c.TTFTP95 == "" {
+		return fmt.Errorf("slo needs availability or ttft_p95")
+	}
+	if c.Availability < 0 || c.Availability >= 1 {
+		return fmt.Errorf("invalid slo.availability %v, want a fraction below 1", c.Availability)
+	}
+	if c.TTFTP95 != "" {
+		if d, err := time.ParseDuration(c.TTFTP95); err != nil || d <= 0 {
+			return fmt.Errorf("invalid slo.ttft_p95 %q", c.TTFTP95)
+		}
+	}
+	return nil
+}
+
+func validateSLOAlert(c *SLOAlertConfig) error {
+	if c == nil {
+		return nil
+	}
+	if u, err := url.Parse(c.Webhook); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid slo_alert.webhook %q", c.Webhook)
+	}
+	if c.BurnRate < 0 || c.MinRequests < 0 {
+		return fmt.Errorf("slo_alert.burn_rate and min_requests must not be negative")
+	}
+	return nil
+}
+
+// sloSeries counts good and bad requests of one objective in one-minute
+// buckets covering the long window.
+type sloSeries struct {
+	target  float64 // objective, e.g. 0.995; the error budget is 1-target
+	minutes [60]sloBucket
+	firing  bool
+}
+
+type sloBucket struct {
+	minute     int64 // unix minute the counts belong to
+	total, bad float64
+}
+
+func (s *sloSeries) add(now time.Time, bad bool) {
+	minute := now.Unix() / 60
+	b := &s.minutes[minute%int64(len(s.minutes))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+// window sums the last n minutes.
+func (s *sloSeries) window(now time.Time, n int) (total, bad float64) {
+	minute := now.Unix() / 60
+	for _, b := range s.minutes {
+		if b.minute > minute-int64(n) && b.minute <= minute {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad
+}
+
+// burnRate is how many times faster than allowed the budget is spent over
+// the last n minutes; 1 spends exactly the budget.
+func (s *sloSeries) burnRate(now time.Time, n int) float64 {
+	total, bad := s.window(now, n)
+	if total == 0 {
+		return 0
+	}
+	return bad / total / (1 - s.target)
+}
+
+// sloTracker measures requests against the objectives of their model rule.
+// It is also a metric collector for the burn rates, which change as the
+// windows move even when no requests arrive.
+type sloTracker struct {
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	byKey map[sloKey]*sloSeries
+}
+
+type sloKey struct {
+	model     string
+	objective string // "availability" or "ttft_p95"
+}
+
+var sloEventsTotal = metrics.newCounterVec("relay_slo_events_total",
+	"Requests counted against an SLO, by model, objective and outcome (good/bad).", "model", "objective", "outcome")
+
+var slos = newSLOTracker(metrics)
+
+// newSLOTracker returns a tracker whose burn rates are exposed by reg, if set.
+func newSLOTracker(reg *metricsRegistry) *sloTracker {
+	t := &sloTracker{
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		byKey:  map[sloKey]*sloSeries{},
+	}
+	if reg != nil {
+		reg.register(t)
+	}
+	return t
+}
+
+// observe counts one finished request of model against the objectives of
+// its rule in cfg.
+func (t *sloTracker) observe(cfg *Config, model string, status int, ttft time.Duration) {
+	rule := resolveRule(cfg, model)
+	if rule == nil || rule.SLO == nil {
+		return
+	}
+	label := metricModel(rule)
+	if rule.SLO.Availability > 0 {
+		t.add(cfg.SLOAlert, sloKey{label, "availability"}, rule.SLO.Availability, status >= 500)
+	}
+	if limit, err := time.ParseDuration(rule.SLO.TTFTP95); err == nil && status > 0 && status < 400 {
+		t.add(cfg.SLOAlert, sloKey{label, "ttft_p95"}, 0.95, ttft > limit)
+	}
+}
+
+func (t *sloTracker) add(alert *SLOAlertConfig, key sloKey, target float64, bad bool) {
+	outcome := "good"
+	if bad {
+		outcome = "bad"
+	}
+	sloEventsTotal.Inc(key.model, key.objective, outcome)
+
+	now := t.now()
+	t.mu.Lock()
+	s := t.byKey[key]
+	if s == nil {
+		s = &sloSeries{}
+		t.byKey[key] = s
+	}
+	s.target = target // follows reloaded rules
+	s.add(now, bad)
+	a := t.evaluate(alert, key, s, now)
+	t.mu.Unlock()
+	if a != nil {
+		go t.notify(alert.Webhook, *a)
+	}
+}
+
+// sloAlert is the webhook body.
+type sloAlert struct {
+	State     string             `json:"state"` // "firing" or "resolved"
+	Model     string             `json:"model"`
+	Objective string             `json:"objective"`
+	Target    float64            `json:"target"`
+	BurnRates map[string]float64 `json:"burn_rates"` // by window
+	Threshold float64            `json:"threshold"`
+	Time      string             `json:"time"`
+}
+
+// evaluate returns an alert when the series starts or stops burning too
+// fast. Caller must hold t.mu.
+func (t *sloTracker) evaluate(alert *SLOAlertConfig, key sloKey, s *sloSeries, now time.Time) *sloAlert {
+	if alert == nil {
+		return nil
+	}
+	threshold := alert.BurnRate
+	if threshold == 0 {
+		threshold = defaultSLOBurnRate
+	}
+	minRequests := alert.MinRequests
+	if minRequests == 0 {
+		minRequests = defaultSLOMinRequests
+	}
+	rates := map[string]float64{}
+	burning := true
+	for _, w := range sloWindows {
+		rates[w.name] = s.burnRate(now, w.minutes)
+		burning = burning && rates[w.name] >= threshold
+	}
+	if total, _ := s.window(now, sloWindows[0].minutes); total < float64(minRequests) {
+		burning = false
+	}
+	if burning == s.firing {
+		return nil
+	}
+	s.firing = burning
+	state := "resolved"
+	if burning {
+		state = "firing"
+	}
+	return &sloAlert{
+		State:     state,
+		Model:     key.model,
+		Objective: key.objective,
+		Target:    s.target,
+		BurnRates: rates,
+		Threshold: threshold,
+		Time:      now.UTC().Format(time.RFC3339),
+	}
+}
+
+func (t *sloTracker) notify(webhook string, a sloAlert) {
+	logf(slog.LevelWarn, "SLO: %s %s for model '%s' (burn rates %v, threshold %g)", a.Objective, a.State, a.Model, a.BurnRates, a.Threshold)
+	body, _ := json.Marshal(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		logf(slog.LevelError, "SLO: webhook failed: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		logf(slog.LevelError, "SLO: webhook failed: %v", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logf(slog.LevelError, "SLO: webhook returned %s", resp.Status)
+	}
+}
+
+// sloStatus is one objective as reported by /admin/slo.
+type sloStatus struct {
+	Model     string             `json:"model"`
+	Objective string             `json:"objective"`
+	Target    float64            `json:"target"`
+	Requests  float64            `json:"requests"` // in the long window
+	Bad       float64            `json:"bad"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+	Budget    float64            `json:"error_budget_remaining"` // share of the long window's budget left, negative once overspent
+	Firing    bool               `json:"firing"`
+}
+
+func (t *sloTracker) status() []sloStatus {
+	now := t.now()
+	long := sloWindows[len(sloWindows)-1].minutes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]sloStatus, 0, len(t.byKey))
+	for key, s := range t.byKey {
+		st := sloStatus{Model: key.model, Objective: key.objective, Target: s.target, BurnRates: map[string]float64{}, Firing: s.firing}
+		for _, w := range sloWindows {
+			st.BurnRates[w.name] = s.burnRate(now, w.minutes)
+		}
+		st.Requests, st.Bad = s.window(now, long)
+		st.Budget = 1 - st.BurnRates[sloWindows[len(sloWindows)-1].name]
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Model != out[j].Model {
+			return out[i].Model < out[j].Model
+		}
+		return out[i].Objective < out[j].Objective
+	})
+	return out
+}
+
+// handleSLO serves GET /admin/slo: every objective with its burn rates.
+func (t *sloTracker) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": t.status()})
+}
+
+var sloBurnRateLabels = []string{"model", "objective", "window"}
+
+// series reports nothing: burn rates are gauges, and the statsd sink sends
+// every series as a counter. They reach /metrics and the pushgateway.
+func (t *sloTracker) series(fn func(name string, labels, values []string, v float64)) {}
+
+func (t *sloTracker) writeTo(w io.Writer, prefix string) {
+	name := prefix + "relay_slo_burn_rate"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name,
+		"Error budget burn rate by model, objective and window; 1 spends exactly the budget.", name)
+	for _, st := range t.status() {
+		for _, win := range sloWindows {
+			key := strings.Join([]string{st.Model, st.Objective, win.name}, "\xff")
+			fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(sloBurnRateLabels, key), st.BurnRates[win.name])
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOTracker(t *testing.T) {
+	alerts := make(chan sloAlert, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a sloAlert
+		_ = json.NewDecoder(r.Body).Decode(&a)
+		alerts <- a
+	}))
+	defer webhook.Close()
+
+	cfg := &Config{
+		ModelRules: []ModelRule{{MatchModel: "m", SLO: &SLOConfig{Availability: 0.99, TTFTP95: "1s"}}},
+		SLOAlert:   &SLOAlertConfig{Webhook: webhook.URL},
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newSLOTracker(nil)
+	tracker.now = func() time.Time { return now }
+
+	// 1 in 4 failing burns a 1% budget 25 times too fast
+	for i := 0; i < 20; i++ {
+		status := http.StatusOK
+		if i%4 == 0 {
+			status = http.StatusBadGateway
+		}
+		tracker.observe(cfg, "m", status, 100*time.Millisecond)
+	}
+	tracker.observe(cfg, "other", http.StatusBadGateway, 0)
+
+	select {
+	case a := <-alerts:
+		if a.State != "firing" || a.Model != "m" || a.Objective != "availability" || a.BurnRates["5m"] < 14.4 {
+			t.Errorf("alert = %+v", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert for a fast burn")
+	}
+
+	status := tracker.status()
+	if len(status) != 2 {
+		t.Fatalf("status = %+v, want availability and ttft_p95 of m", status)
+	}
+	if st := status[0]; st.Objective != "availability" || st.Requests != 20 || st.Bad != 5 || !near(st.BurnRates["1h"], 25) || !st.Firing {
+		t.Errorf("availability status = %+v", st)
+	}
+	if st := status[1]; st.Objective != "ttft_p95" || st.Bad != 0 || st.Requests != 15 {
+		t.Errorf("ttft_p95 status = %+v, want the successful requests only", st)
+	}
+
+	// an hour later the failures have left both windows
+	now = now.Add(61 * time.Minute)
+	tracker.observe(cfg, "m", http.StatusOK, 2*time.Second)
+	select {
+	case a := <-alerts:
+		if a.State != "resolved" || a.Objective != "availability" {
+			t.Errorf("alert = %+v, want availability resolved", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no resolved alert")
+	}
+	if st := tracker.status()[1]; st.Bad != 1 || !near(st.BurnRates["5m"], 20) {
+		t.Errorf("slow first byte not counted: %+v", st)
+	}
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestSLOMetricsAndAdmin(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusServiceUnavailable, "overloaded", "server_error", "")
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream:   upstream.URL,
+		Admin:      &AdminConfig{Token: "admin"},
+		ModelRules: []ModelRule{{MatchModel: "slo-test", SLO: &SLOConfig{Availability: 0.9}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"slo-test","messages":[]}`))
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `relay_slo_burn_rate{model="slo-test",objective="availability",window="5m"} 10`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics lack %s", want)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/slo", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"model":"slo-test"`) {
+		t.Errorf("/admin/slo = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestValidateSLO(t *testing.T) {
+	for _, c := range []SLOConfig{{}, {Availability: 1}, {Availability: 99.5}, {TTFTP95: "fast"}} {
+		if err := validateSLO(&c); err == nil {
+			t.Errorf("validateSLO(%+v) succeeded, want error", c)
+		}
+	}
+	if err := validateSLOAlert(&SLOAlertConfig{Webhook: "hooks"}); err == nil {
+		t.Error("validateSLOAlert accepted a webhook without a host")
+	}
+}
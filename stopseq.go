@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+var stopEnforcedTotal = metrics.newCounterVec("relay_stop_enforced_total",
+	"Streams ended by the relay because the output hit a client stop sequence.", "tenant", "model")
+
+// stopScanner ends a stream at the client's stop sequences, for backends that
+// ignore the stop parameter. Text that could be the start of a sequence split
+// across chunks is held back until the next chunk decides it.
+type stopScanner struct {
+	ctx    context.Context
+	stops  []string
+	single bool // n <= 1: end the whole stream at the first match
+	tenant string
+	model  string
+	label  string // model label of the metrics, see metricModel
+
+	held    map[any]string // per choice index
+	stopped map[any]bool
+	last    map[string]any
+}
+
+// newStopScanner wraps src, or returns nil when the rule does not enforce
+// stop sequences or the request has none.
+func newStopScanner(ctx context.Context, src io.Reader, rule *ModelRule, payload map[string]any, tenant string) io.ReadCloser {
+	if rule == nil || !rule.EnforceStop {
+		return nil
+	}
+	var stops []string
+	switch v := payload["stop"].(type) {
+	case string:
+		stops = []string{v}
+	case []any:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				stops = append(stops, s)
+			}
+		}
+	}
+	stops = removeEmpty(stops)
+	if len(stops) == 0 {
+		return nil
+	}
+	n, _ := payload["n"].(float64)
+	s := &stopScanner{
+		ctx:     ctx,
+		stops:   stops,
+		single:  n <= 1,
+		tenant:  tenant,
+		model:   getString(payload, "model"),
+		label:   metricModel(rule),
+		held:    map[any]string{},
+		stopped: map[any]bool{},
+	}
+	return pipeSSE(src, s.handle)
+}
+
+func removeEmpty(ss []string) []string {
+	out := ss[:0]
+	for _, s := range ss {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (s *stopScanner) handle(line string) ([]string, bool) {
+	if line == "data: [DONE]" {
+		return append(s.flush(), line), true
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	s.last = chunk
+
+	matched := false
+	choices, _ := chunk["choices"].([]any)
+	kept := choices[:0]
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			kept = append(kept, c)
+			continue
+		}
+		idx := choice["index"]
+		if s.stopped[idx] {
+			continue
+		}
+		kept = append(kept, choice)
+
+		holder, field := choice, "text"
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			holder, field = delta, "content"
+		}
+		text := s.held[idx] + getString(holder, field)
+		if _, ok := holder[field]; !ok && text == "" {
+			continue
+		}
+
+		if cut := s.indexStop(text); cut >= 0 {
+			holder[field] = text[:cut]
+			choice["finish_reason"] = "stop"
+			delete(s.held, idx)
+			s.stopped[idx] = true
+			matched = true
+			continue
+		}
+		if choice["finish_reason"] != nil {
+			// the upstream ended the choice; nothing more can complete a match
+			holder[field] = text
+			delete(s.held, idx)
+			continue
+		}
+		keep := len(text) - s.partialSuffix(text)
+		holder[field] = text[:keep]
+		s.held[idx] = text[keep:]
+	}
+	chunk["choices"] = kept
+
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{line}, true
+	}
+	out := []string{"data: " + string(data)}
+	if matched {
+		vlogCtx(s.ctx, "STOP: stop sequence reached for model '%s'", s.model)
+		stopEnforcedTotal.Inc(s.tenant, s.label)
+		if s.single {
+			return append(out, "", "data: [DONE]", ""), false
+		}
+	}
+	return out, true
+}
+
+// indexStop returns the position of the earliest stop sequence in text, or -1.
+func (s *stopScanner) indexStop(text string) int {
+	cut := -1
+	for _, stop := range s.stops {
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	return cut
+}
+
+// partialSuffix returns the length of the longest suffix of text that is a
+// proper prefix of some stop sequence.
+func (s *stopScanner) partialSuffix(text string) int {
+	longest := 0
+	for _, stop := range s.stops {
+		for n := min(len(stop)-1, len(text)); n > longest; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// flush emits text still held back when the stream ends without a finish_reason.
+func (s *stopScanner) flush() []string {
+	if len(s.held) == 0 || s.last == nil {
+		return nil
+	}
+	chunk := map[string]any{}
+	for _, k := range []string{"id", "object", "created", "model"} {
+		if v, ok := s.last[k]; ok {
+			chunk[k] = v
+		}
+	}
+	var choices []any
+	for idx, text := range s.held {
+		choice := map[string]any{"index": idx, "finish_reason": nil}
+		if getString(s.last, "object") == "text_completion" {
+			choice["text"] = text
+		} else {
+			choice["delta"] = map[string]any{"content": text}
+		}
+		choices = append(choices, choice)
+	}
+	s.held = map[any]string{}
+	chunk["choices"] = choices
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return []string{"data: " + string(data), ""}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStopScanner(t *testing.T) {
+	var deltas []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range deltas {
+			fmt.Fprintln(w, sseChunk("s", d, ""))
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, sseChunk("s", "", "stop"))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		enforce     bool
+		stop        string
+		deltas      []string
+		wantContent string
+	}{
+		{"single chunk", true, `"###"`, []string{"one two", " ### three", " four"}, "one two "},
+		{"split across chunks", true, `["\n\nUser:", "ENDING"]`, []string{"Hello wor", "ld END", "ING more"}, "Hello world "},
+		{"split over three chunks", true, `"<|end|>"`, []string{"a<|", "en", "d|>b"}, "a"},
+		{"partial prefix released", true, `"<|end|>"`, []string{"a<|", "en", "x"}, "a<|enx"},
+		{"held text flushed at finish", true, `"STOP"`, []string{"tail ST"}, "tail ST"},
+		{"earliest sequence wins", true, `["b", "a"]`, []string{"xxab"}, "xx"},
+		{"disabled", false, `"###"`, []string{"one ### two"}, "one ### two"},
+		{"no stop in request", true, `null`, []string{"one ### two"}, "one ### two"},
+	}
+	for _, tt := range tests {
+		deltas = tt.deltas
+		cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", EnforceStop: tt.enforce}}}
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"model":"m","stream":true,"stop":%s}`, tt.stop)
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		content, finishes, _ := streamedContent(t, w.Body.String())
+		if content != tt.wantContent {
+			t.Errorf("%s: content = %q, want %q", tt.name, content, tt.wantContent)
+		}
+		if len(finishes) != 1 || finishes[0] != "stop" {
+			t.Errorf("%s: expected a single stop finish, got %v", tt.name, finishes)
+		}
+		if !strings.Contains(w.Body.String(), "data: [DONE]") {
+			t.Errorf("%s: missing [DONE]:\n%s", tt.name, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// writeStreamError terminates a started SSE stream with an OpenAI-style error
+// event. No [DONE] follows, so clients can tell truncation from completion.
+func writeStreamError(ctx context.Context, w io.Writer, tenant string, rule *ModelRule, model string, err error) {
+	logCtxf(ctx, slog.LevelWarn, "STREAM: upstream failed mid-stream for model '%s' (tenant %s): %v", model, tenant, err)
+	streamErrorsTotal.Inc(tenant, metricModel(rule))
+
+	event, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("upstream stream interrupted: %v", err),
+			"type":    "upstream_error",
+			"code":    "stream_interrupted",
+		},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", event)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
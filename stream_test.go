@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTruncatingUpstream returns a server that starts a chunked SSE stream and
+// then drops the connection without terminating the chunked body.
+func newTruncatingUpstream(t *testing.T) *httptest.Server {
+	return httptest.NewServer(truncatedStreamHandler(t))
+}
+
+func truncatedStreamHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("hijacking not supported")
+		}
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			t.Fatalf("hijack failed: %v", err)
+		}
+		defer conn.Close()
+
+		line := `data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"partial"},"finish_reason":null}]}` + "\n\n"
+		fmt.Fprint(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n")
+		fmt.Fprintf(buf, "%x\r\n%s\r\n", len(line), line)
+		buf.Flush()
+	}
+}
+
+func TestMidStreamUpstreamFailure(t *testing.T) {
+	upstream := newTruncatingUpstream(t)
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		model       string
+		toolcallfix bool
+	}{
+		{"plain stream", "plain-model", false},
+		{"toolcallfix stream", "fix-model", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ModelRules: []ModelRule{{MatchModel: tt.model, EnableToolCallFix: tt.toolcallfix}}}
+			before := streamErrorsTotal.Value(defaultTenant, tt.model)
+
+			body := fmt.Sprintf(`{"model":%q,"messages":[],"stream":true}`, tt.model)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+			proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+			out := w.Body.String()
+			if !strings.Contains(out, "partial") {
+				t.Errorf("content before the failure should be relayed, got %s", out)
+			}
+			if !strings.Contains(out, `"code":"stream_interrupted"`) {
+				t.Errorf("expected stream_interrupted error event, got %s", out)
+			}
+			if strings.Contains(out, "[DONE]") {
+				t.Errorf("truncated stream must not end with [DONE]")
+			}
+			if got := streamErrorsTotal.Value(defaultTenant, tt.model); got != before+1 {
+				t.Errorf("expected stream error metric to increase by 1, got %v -> %v", before, got)
+			}
+		})
+	}
+}
+
+func TestCompletedStreamHasNoErrorEvent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"ok"},"finish_reason":"stop"}]}`)
+		fmt.Fprintln(w, `data: [DONE]`)
+	}))
+	defer upstream.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+
+	if strings.Contains(w.Body.String(), "stream_interrupted") {
+		t.Errorf("completed stream should not carry an error event: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// defaultRedactWindow is how many trailing bytes of streamed text are held
+// back so a secret split across chunks is still seen whole.
+const defaultRedactWindow = 64
+
+var redactionsTotal = metrics.newCounterVec("relay_stream_redactions_total",
+	"Matches of redact_patterns masked in streamed output.", "tenant", "model")
+
+// compiledPatterns caches redact_patterns so requests do not recompile them.
+var compiledPatterns sync.Map // pattern -> *regexp.Regexp
+
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if re, ok := compiledPatterns.Load(p); ok {
+			res = append(res, re.(*regexp.Regexp))
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		compiledPatterns.Store(p, re)
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// streamRedactor masks redact_patterns in streamed text. Each choice's text
+// is buffered per field and only the part that no later chunk can extend
+// into a match is released.
+type streamRedactor struct {
+	ctx      context.Context
+	patterns []*regexp.Regexp
+	window   int
+	tenant   string
+	model    string
+	label    string // model label of the metrics, see metricModel
+
+	pending map[redactKey]string
+	last    map[string]any
+}
+
+type redactKey struct {
+	index any
+	field string
+}
+
+// newStreamRedactor wraps src, or returns nil when the rule has no patterns.
+func newStreamRedactor(ctx context.Context, src io.Reader, rule *ModelRule, tenant, model string) io.ReadCloser {
+	if rule == nil || len(rule.RedactPatterns) == 0 {
+		return nil
+	}
+	patterns, err := compileRedactPatterns(rule.RedactPatterns)
+	if err != nil {
+		// validated at startup
+		return nil
+	}
+	r := &streamRedactor{
+		ctx:      ctx,
+		patterns: patterns,
+		window:   rule.RedactWindow,
+		tenant:   tenant,
+		model:    model,
+		label:    metricModel(rule),
+		pending:  map[redactKey]string{},
+	}
+	if r.window <= 0 {
+		r.window = defaultRedactWindow
+	}
+	return pipeSSE(src, r.handle)
+}
+
+func (r *streamRedactor) handle(line string) ([]string, bool) {
+	if line == "data: [DONE]" {
+		return append(r.flush(), line), true
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	r.last = chunk
+
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		final := choice["finish_reason"] != nil
+		holder, fields := choice, []string{"text"}
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			holder, fields = delta, []string{"content", "reasoning_content"}
+		}
+		for _, f := range fields {
+			key := redactKey{choice["index"], f}
+			text := r.pending[key] + getString(holder, f)
+			if text == "" {
+				continue
+			}
+			out, rest := r.release(text, final)
+			holder[f] = out
+			if rest == "" {
+				delete(r.pending, key)
+			} else {
+				r.pending[key] = rest
+			}
+		}
+	}
+
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{line}, true
+	}
+	return []string{"data: " + string(data)}, true
+}
+
+// release masks text and splits it into what can be sent now and what must
+// wait for more input. Everything is released when final is set.
+func (r *streamRedactor) release(text string, final bool) (out, rest string) {
+	var matches [][]int
+	for _, re := range r.patterns {
+		matches = append(matches, re.FindAllStringIndex(text, -1)...)
+	}
+	matches = mergeRanges(matches)
+
+	cut := len(text)
+	if !final {
+		cut = max(len(text)-r.window, 0)
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		for _, m := range matches {
+			if m[0] < cut && m[1] > cut {
+				if m[1] == len(text) {
+					// the match may still grow with the next chunk
+					cut = m[0]
+				} else {
+					cut = m[1]
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	pos, masked := 0, 0
+	for _, m := range matches {
+		if m[1] > cut {
+			break
+		}
+		b.WriteString(text[pos:m[0]])
+		b.WriteString(redactedValue)
+		pos = m[1]
+		masked++
+	}
+	b.WriteString(text[pos:cut])
+	if masked > 0 {
+		vlogCtx(r.ctx, "REDACT: masked %d match(es) in stream for model '%s'", masked, r.model)
+		redactionsTotal.Add(float64(masked), r.tenant, r.label)
+	}
+	return b.String(), text[cut:]
+}
+
+// mergeRanges sorts match ranges from several patterns and joins overlaps.
+func mergeRanges(ranges [][]int) [][]int {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var out [][]int
+	for _, m := range ranges {
+		if n := len(out); n > 0 && m[0] < out[n-1][1] {
+			out[n-1][1] = max(out[n-1][1], m[1])
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// flush releases held text when the stream ends without a finish_reason.
+func (r *streamRedactor) flush() []string {
+	if len(r.pending) == 0 || r.last == nil {
+		return nil
+	}
+	byIndex := map[any]map[string]any{}
+	var order []any
+	for key, text := range r.pending {
+		out, _ := r.release(text, true)
+		if byIndex[key.index] == nil {
+			byIndex[key.index] = map[string]any{}
+			order = append(order, key.index)
+		}
+		byIndex[key.index][key.field] = out
+	}
+	r.pending = map[redactKey]string{}
+
+	chunk := map[string]any{}
+	for _, k := range []string{"id", "object", "created", "model"} {
+		if v, ok := r.last[k]; ok {
+			chunk[k] = v
+		}
+	}
+	choices := make([]any, 0, len(order))
+	for _, idx := range order {
+		choice := map[string]any{"index": idx, "finish_reason": nil}
+		if text, ok := byIndex[idx]["text"]; ok {
+			choice["text"] = text
+		} else {
+			choice["delta"] = byIndex[idx]
+		}
+		choices = append(choices, choice)
+	}
+	chunk["choices"] = choices
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return []string{"data: " + string(data), ""}
+}
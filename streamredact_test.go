@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamRedactor(t *testing.T) {
+	var deltas []string
+	finish := "stop"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range deltas {
+			fmt.Fprintln(w, sseChunk("r", d, ""))
+			fmt.Fprintln(w)
+		}
+		if finish != "" {
+			fmt.Fprintln(w, sseChunk("r", "", finish))
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		patterns    []string
+		window      int
+		deltas      []string
+		finish      string
+		wantContent string
+	}{
+		{"single chunk", []string{`sk-[A-Za-z0-9]+`}, 0, []string{"key sk-abc123 ok"}, "stop", "key [REDACTED] ok"},
+		{"split across chunks", []string{`sk-[A-Za-z0-9]+`}, 0, []string{"key s", "k-ab", "c123", " ok"}, "stop", "key [REDACTED] ok"},
+		{"several patterns", []string{`sk-[a-z0-9]+`, `[a-z]+\.internal`}, 0, []string{"host db.inter", "nal and sk-x"}, "stop", "host [REDACTED] and [REDACTED]"},
+		{"match longer than window", []string{`sk-[a-z]+`}, 4, []string{"sk-aaaa", "aaaa", "aa."}, "stop", "[REDACTED]."},
+		{"flushed without finish", []string{`secret`}, 0, []string{"a secr", "et"}, "", "a [REDACTED]"},
+		{"no patterns", nil, 0, []string{"sk-abc"}, "stop", "sk-abc"},
+	}
+	for _, tt := range tests {
+		deltas, finish = tt.deltas, tt.finish
+		cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", RedactPatterns: tt.patterns, RedactWindow: tt.window}}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		content, _, _ := streamedContent(t, w.Body.String())
+		if content != tt.wantContent {
+			t.Errorf("%s: content = %q, want %q", tt.name, content, tt.wantContent)
+		}
+		if !strings.Contains(w.Body.String(), "data: [DONE]") {
+			t.Errorf("%s: missing [DONE]:\n%s", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestValidateRedactPatterns(t *testing.T) {
+	err := validateModelRules([]ModelRule{{MatchModel: "m", RedactPatterns: []string{"("}}})
+	if err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+var streamSynthesizedTotal = metrics.newCounterVec("relay_stream_synthesized_total",
+	"Opening role chunks and final [DONE] lines added to streams whose upstream left them out.", "tenant", "model", "part")
+
+// roleSynthesizer completes chat streams for strict clients: it sends the
+// opening delta {"role": "assistant"} of each choice when the upstream
+// starts with content right away, and ends a stream that closes without
+// data: [DONE] with one.
+type roleSynthesizer struct {
+	ctx           context.Context
+	tenant, model string
+	label         string          // model label of the metrics, see metricModel
+	started       map[string]bool // choice indexes whose first delta went out
+	data, done    bool            // a data chunk / [DONE] was seen
+}
+
+// newRoleSynthesizer wraps src, or returns nil when the rule does not set
+// synthesize_role.
+func newRoleSynthesizer(ctx context.Context, src io.Reader, rule *ModelRule, tenant, model string) io.ReadCloser {
+	if rule == nil || !rule.SynthesizeRole {
+		return nil
+	}
+	s := &roleSynthesizer{ctx: ctx, tenant: tenant, model: model, label: metricModel(rule), started: map[string]bool{}}
+	return pipeSSEWithEnd(src, s.handle, s.end)
+}
+
+func (s *roleSynthesizer) handle(line string) ([]string, bool) {
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		return []string{line}, true
+	}
+	if data == "[DONE]" {
+		s.done = true
+		return []string{line}, true
+	}
+	s.data = true
+	var chunk struct {
+		ID      any `json:"id"`
+		Object  any `json:"object"`
+		Created any `json:"created"`
+		Model   any `json:"model"`
+		Choices []struct {
+			Index json.RawMessage            `json:"index"`
+			Delta map[string]json.RawMessage `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{line}, true
+	}
+	var out []string
+	for _, c := range chunk.Choices {
+		idx := string(c.Index)
+		if c.Delta == nil || s.started[idx] {
+			continue // text completions carry no role
+		}
+		s.started[idx] = true
+		if _, ok := c.Delta["role"]; ok {
+			continue
+		}
+		opening, _ := json.Marshal(map[string]any{
+			"id":      chunk.ID,
+			"object":  chunk.Object,
+			"created": chunk.Created,
+			"model":   chunk.Model,
+			"choices": []any{map[string]any{
+				"index":         c.Index,
+				"delta":         map[string]any{"role": "assistant", "content": ""},
+				"finish_reason": nil,
+			}},
+		})
+		out = append(out, "data: "+string(opening), "")
+		streamSynthesizedTotal.Inc(s.tenant, s.label, "role")
+	}
+	if out != nil {
+		vlogCtx(s.ctx, "STREAM: synthesized the opening role chunk for model '%s'", s.model)
+	}
+	return append(out, line), true
+}
+
+func (s *roleSynthesizer) end() []string {
+	if !s.data || s.done {
+		return nil
+	}
+	vlogCtx(s.ctx, "STREAM: upstream ended the stream for model '%s' without [DONE], adding it", s.model)
+	streamSynthesizedTotal.Inc(s.tenant, s.label, "done")
+	return []string{"data: [DONE]", ""}
+}
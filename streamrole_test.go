@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoleSynthesizer(t *testing.T) {
+	rule := &ModelRule{SynthesizeRole: true}
+
+	// chatStream starts with content and no role
+	out := runPipeline(t, rule, nil, chatStream("Hel", "lo"))
+	lines := strings.Split(out, "\n")
+	if !strings.Contains(lines[0], `"delta":{"content":"","role":"assistant"}`) || !strings.Contains(lines[0], `"id":"c1"`) {
+		t.Errorf("first chunk = %s", lines[0])
+	}
+	if strings.Count(out, `"role"`) != 1 || strings.Count(out, "[DONE]") != 1 {
+		t.Errorf("role or [DONE] repeated:\n%s", out)
+	}
+	if got := streamFields(t, out, "content"); got != "Hello" {
+		t.Errorf("content = %q", got)
+	}
+
+	// a stream that already opens with the role and ends with [DONE] is untouched
+	withRole := sseChunk("c1", "", "") + "\n\n" + chatStream("hi")
+	if out := runPipeline(t, rule, nil, withRole); out != withRole {
+		t.Errorf("changed a complete stream:\n%s", out)
+	}
+
+	// each choice gets its own opening chunk; a missing [DONE] is added
+	noDone := `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"a"},"finish_reason":null},{"index":1,"delta":{"content":"b"},"finish_reason":null}]}` + "\n\n"
+	out = runPipeline(t, rule, nil, noDone)
+	if strings.Count(out, `"role":"assistant"`) != 2 || !strings.HasSuffix(out, "data: [DONE]\n\n") {
+		t.Errorf("n=2 stream:\n%s", out)
+	}
+
+	// text completions have no role; empty streams stay empty
+	text := `data: {"id":"c1","object":"text_completion","choices":[{"index":0,"text":"a","finish_reason":null}]}` + "\n\n"
+	if out := runPipeline(t, rule, nil, text); out != text+"data: [DONE]\n\n" {
+		t.Errorf("text completion:\n%s", out)
+	}
+	if out := runPipeline(t, rule, nil, ""); out != "" {
+		t.Errorf("empty stream: %q", out)
+	}
+	if out := runPipeline(t, &ModelRule{}, nil, noDone); out != noDone {
+		t.Errorf("synthesized without synthesize_role:\n%s", out)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StaleWhileRevalidateConfig answers /v1/models and the on-demand upstream
+// probes of /health from cache while they are refreshed in the background,
+// so a backend that is slow to enumerate its models does not stall model
+// pickers.
+type StaleWhileRevalidateConfig struct {
+	Models *StalenessConfig `json:"models"` // /v1/models responses; not cached without it
+	Health *StalenessConfig `json:"health"` // upstream probe results of /health and /healthz
+}
+
+// StalenessConfig bounds how old a cached answer may be. Until fresh_for it
+// is served as is; until max_stale it is served while a refresh runs in the
+// background; older answers are fetched while the client waits.
+type StalenessConfig struct {
+	FreshFor string `json:"fresh_for"` // default "30s" for models, "5s" for health
+	MaxStale string `json:"max_stale"` // default "10m" for models, "1m" for health
+}
+
+const (
+	defaultModelsFreshFor = 30 * time.Second
+	defaultModelsMaxStale = 10 * time.Minute
+	defaultHealthFreshFor = 5 * time.Second
+	defaultHealthMaxStale = time.Minute
+
+	modelsCacheEntries  = 256     // per tenant, client key and query
+	modelsCacheMaxBytes = 4 << 20 // larger model lists are not cached
+)
+
+var modelsCacheTotal = metrics.newCounterVec("relay_models_cache_total",
+	"/v1/models requests by cache result (hit, stale or miss).", "result")
+
+func validateStaleWhileRevalidate(c *StaleWhileRevalidateConfig) error {
+	if c == nil {
+		return nil
+	}
+	for name, s := range map[string]*StalenessConfig{"models": c.Models, "health": c.Health} {
+		if s == nil {
+			continue
+		}
+		fresh, stale, err := s.durations(time.Second, time.Second)
+		if err != nil {
+			return fmt.Errorf("stale_while_revalidate.%s: %w", name, err)
+		}
+		if s.FreshFor != "" && s.MaxStale != "" && stale < fresh {
+			return fmt.Errorf("stale_while_revalidate.%s: max_stale must not be shorter than fresh_for", name)
+		}
+	}
+	return nil
+}
+
+// durations parses the bounds, taking the defaults for unset ones. A
+// max_stale below fresh_for serves nothing stale.
+func (s *StalenessConfig) durations(defFresh, defStale time.Duration) (fresh, stale time.Duration, err error) {
+	fresh, stale = defFresh, defStale
+	if s.FreshFor != "" {
+		if fresh, err = time.ParseDuration(s.FreshFor); err != nil || fresh <= 0 {
+			return 0, 0, fmt.Errorf("invalid fresh_for %q", s.FreshFor)
+		}
+	}
+	if s.MaxStale != "" {
+		if stale, err = time.ParseDuration(s.MaxStale); err != nil || stale <= 0 {
+			return 0, 0, fmt.Errorf("invalid max_stale %q", s.MaxStale)
+		}
+	}
+	return fresh, stale, nil
+}
+
+// modelsCache holds /v1/models responses by tenant, client credential and
+// query, since a list may differ for each.
+type modelsCache struct {
+	fresh, stale time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*modelsEntry
+}
+
+type modelsEntry struct {
+	status     int
+	header     http.Header
+	body       []byte
+	fetched    time.Time
+	refreshing bool
+}
+
+func newModelsCache(c *StalenessConfig) *modelsCache {
+	fresh, stale, _ := c.durations(defaultModelsFreshFor, defaultModelsMaxStale) // validated at load
+	return &modelsCache{fresh: fresh, stale: stale, entries: map[string]*modelsEntry{}}
+}
+
+func (c *modelsCache) serve(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+		key := tenantName(r.Context()) + "\x00" + keyFingerprint(bearerToken(r)) + "\x00" + r.URL.RawQuery
+		now := time.Now()
+		c.mu.Lock()
+		e := c.entries[key]
+		switch {
+		case e != nil && now.Sub(e.fetched) < c.fresh:
+			c.mu.Unlock()
+			modelsCacheTotal.Inc("hit")
+			e.write(w, "HIT", now)
+			return
+		case e != nil && now.Sub(e.fetched) < c.stale:
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(key, r.Clone(context.WithoutCancel(r.Context())), next)
+			}
+			c.mu.Unlock()
+			modelsCacheTotal.Inc("stale")
+			e.write(w, "STALE", now)
+			return
+		}
+		c.mu.Unlock()
+		modelsCacheTotal.Inc("miss")
+		w.Header().Set(cacheHeader, "MISS")
+		cw := &captureWriter{ResponseWriter: w, limit: modelsCacheMaxBytes}
+		next(cw, r)
+		c.store(key, cw, now)
+	}
+}
+
+// refresh fetches a stale list in the background. A failed refresh keeps
+// the old list, which is served until it is older than max_stale.
+func (c *modelsCache) refresh(key string, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	cw := &captureWriter{ResponseWriter: debugSink{header: http.Header{}}, limit: modelsCacheMaxBytes}
+	next(cw, r)
+	if !c.store(key, cw, start) {
+		vlogCtx(r.Context(), "MODELS: background refresh failed with status %d, keeping the cached list", cw.status)
+		c.mu.Lock()
+		if e := c.entries[key]; e != nil {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// store keeps a complete 200 response, reporting whether it did.
+func (c *modelsCache) store(key string, cw *captureWriter, fetched time.Time) bool {
+	if cw.status != http.StatusOK || cw.truncated {
+		return false
+	}
+	// per-request headers are not replayed
+	header := cw.Header().Clone()
+	for _, h := range []string{cacheHeader, requestIDHeader, upstreamRequestIDHeader, traceparentHeader} {
+		header.Del(h)
+	}
+	e := &modelsEntry{status: cw.status, header: header, body: cw.buf.Bytes(), fetched: fetched}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= modelsCacheEntries {
+		c.evictOldest()
+	}
+	c.entries[key] = e
+	return true
+}
+
+func (c *modelsCache) evictOldest() {
+	var oldest string
+	for k, e := range c.entries {
+		if oldest == "" || e.fetched.Before(c.entries[oldest].fetched) {
+			oldest = k
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+func (e *modelsEntry) write(w http.ResponseWriter, result string, now time.Time) {
+	for k, vv := range e.header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
+	w.Header().Set(cacheHeader, result)
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.fetched).Seconds())))
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestModelsCache(t *testing.T) {
+	var calls atomic.Int32
+	status := atomic.Int32{}
+	status.Store(http.StatusOK)
+	release := make(chan struct{}, 10)
+	next := func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if n > 1 {
+			<-release // refreshes wait until the test lets them finish
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(status.Load()))
+		fmt.Fprintf(w, `{"object":"list","data":[{"id":"m%d"}]}`, n)
+	}
+	c := newModelsCache(&StalenessConfig{FreshFor: "1m", MaxStale: "1h"})
+	handler := c.serve(next)
+	get := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/models", nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		handler(w, r)
+		return w
+	}
+	age := func(d time.Duration) {
+		c.mu.Lock()
+		for _, e := range c.entries {
+			e.fetched = e.fetched.Add(-d)
+		}
+		c.mu.Unlock()
+	}
+	expect := func(w *httptest.ResponseRecorder, result, body string) {
+		t.Helper()
+		if w.Code != http.StatusOK || w.Header().Get(cacheHeader) != result || w.Body.String() != body {
+			t.Fatalf("got %d %s %s, want %s %s", w.Code, w.Header().Get(cacheHeader), w.Body, result, body)
+		}
+	}
+	m1 := `{"object":"list","data":[{"id":"m1"}]}`
+	m2 := `{"object":"list","data":[{"id":"m2"}]}`
+
+	expect(get("a"), "MISS", m1)
+	expect(get("a"), "HIT", m1)
+
+	// stale lists are served right away while one refresh runs
+	age(2 * time.Minute)
+	w := get("a")
+	expect(w, "STALE", m1)
+	if w.Header().Get("Age") != "120" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v", w.Header())
+	}
+	expect(get("a"), "STALE", m1)
+	release <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for get("a").Header().Get(cacheHeader) != "HIT" {
+		if time.Now().After(deadline) {
+			t.Fatal("refresh did not complete")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expect(get("a"), "HIT", m2)
+	if calls.Load() != 2 {
+		t.Errorf("%d upstream calls, want 2", calls.Load())
+	}
+
+	// a failed refresh keeps the old list
+	status.Store(http.StatusBadGateway)
+	age(2 * time.Minute)
+	expect(get("a"), "STALE", m2)
+	release <- struct{}{}
+	for calls.Load() != 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	expect(get("a"), "STALE", m2)
+
+	// past max_stale the client waits for the upstream, and errors are not cached
+	age(2 * time.Hour)
+	release <- struct{}{} // the refresh the last stale answer started
+	release <- struct{}{} // this request
+	if w := get("a"); w.Code != http.StatusBadGateway || w.Header().Get(cacheHeader) != "MISS" {
+		t.Errorf("past max_stale: %d %s", w.Code, w.Header().Get(cacheHeader))
+	}
+
+	// each client key has its own list
+	status.Store(http.StatusOK)
+	release <- struct{}{}
+	if w := get("b"); w.Header().Get(cacheHeader) != "MISS" {
+		t.Errorf("key b: %s", w.Header().Get(cacheHeader))
+	}
+}
+
+func TestHealthStaleWhileRevalidate(t *testing.T) {
+	var probes atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probes.Add(1) > 1 {
+			<-release
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	h := newHealthChecker()
+	h.addUpstream("default", u)
+	h.ttl, h.maxStale = time.Minute, time.Hour
+	first := h.upstreamStatus()
+	if !first[0].Healthy {
+		t.Fatalf("first probe: %+v", first)
+	}
+
+	// stale results come back without waiting for the slow probe
+	h.mu.Lock()
+	h.checkedAt = h.checkedAt.Add(-2 * time.Minute)
+	h.mu.Unlock()
+	start := time.Now()
+	for range 3 {
+		if got := h.upstreamStatus(); got[0].CheckedAt != first[0].CheckedAt {
+			t.Fatalf("served %+v", got)
+		}
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("stale status took %s", time.Since(start))
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.mu.Lock()
+		done := !h.refreshing
+		h.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh did not complete")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if probes.Load() != 2 {
+		t.Errorf("%d probes, want 2", probes.Load())
+	}
+}
+
+func TestValidateStaleWhileRevalidate(t *testing.T) {
+	for _, c := range []StaleWhileRevalidateConfig{
+		{Models: &StalenessConfig{FreshFor: "soon"}},
+		{Health: &StalenessConfig{MaxStale: "-1s"}},
+		{Models: &StalenessConfig{FreshFor: "10m", MaxStale: "1m"}},
+	} {
+		if validateStaleWhileRevalidate(&c) == nil {
+			t.Errorf("accepted %+v %+v", c.Models, c.Health)
+		}
+	}
+	if err := validateStaleWhileRevalidate(&StaleWhileRevalidateConfig{Models: &StalenessConfig{}, Health: &StalenessConfig{MaxStale: "5m"}}); err != nil {
+		t.Error(err)
+	}
+}
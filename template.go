@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// promptMessage is a chat message flattened to plain text for prompt rendering.
+type promptMessage struct {
+	Role    string
+	Content string
+}
+
+// promptTemplate renders chat messages into a raw completion prompt.
+type promptTemplate struct {
+	render func(msgs []promptMessage) (string, error)
+	stop   []string // default stop sequences, used when the request has none
+}
+
+var builtinPromptTemplates = map[string]promptTemplate{
+	"chatml": {
+		render: func(msgs []promptMessage) (string, error) {
+			var b strings.Builder
+			for _, m := range msgs {
+				fmt.Fprintf(&b, "<|im_start|>%s\n%s<|im_end|>\n", m.Role, m.Content)
+			}
+			b.WriteString("<|im_start|>assistant\n")
+			return b.String(), nil
+		},
+		stop: []string{"<|im_end|>"},
+	},
+	"llama2": {
+		render: func(msgs []promptMessage) (string, error) {
+			return renderInstPrompt(msgs, "<<SYS>>\n%s\n<</SYS>>\n\n", " </s><s>"), nil
+		},
+	},
+	"llama3": {
+		render: func(msgs []promptMessage) (string, error) {
+			var b strings.Builder
+			b.WriteString("<|begin_of_text|>")
+			for _, m := range msgs {
+				fmt.Fprintf(&b, "<|start_header_id|>%s<|end_header_id|>\n\n%s<|eot_id|>", m.Role, m.Content)
+			}
+			b.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+			return b.String(), nil
+		},
+		stop: []string{"<|eot_id|>"},
+	},
+	"mistral": {
+		render: func(msgs []promptMessage) (string, error) {
+			return renderInstPrompt(msgs, "%s\n\n", "</s>"), nil
+		},
+	},
+	"alpaca": {
+		render: func(msgs []promptMessage) (string, error) {
+			var b strings.Builder
+			for _, m := range msgs {
+				switch m.Role {
+				case "system":
+					fmt.Fprintf(&b, "%s\n\n", m.Content)
+				case "assistant":
+					fmt.Fprintf(&b, "### Response:\n%s\n\n", m.Content)
+				default:
+					fmt.Fprintf(&b, "### Instruction:\n%s\n\n", m.Content)
+				}
+			}
+			b.WriteString("### Response:\n")
+			return b.String(), nil
+		},
+		stop: []string{"### Instruction:"},
+	},
+}
+
+// renderInstPrompt renders the [INST] family of templates (llama2, mistral).
+// System prompts are folded into the first user turn using sysFormat, and
+// assistant turns are terminated with eos.
+func renderInstPrompt(msgs []promptMessage, sysFormat, eos string) string {
+	var b strings.Builder
+	b.WriteString("<s>")
+	system := ""
+	for _, m := range msgs {
+		switch m.Role {
+		case "system":
+			system += m.Content
+		case "assistant":
+			fmt.Fprintf(&b, " %s%s", m.Content, eos)
+		default:
+			content := m.Content
+			if system != "" {
+				content = fmt.Sprintf(sysFormat, system) + content
+				system = ""
+			}
+			fmt.Fprintf(&b, "[INST] %s [/INST]", content)
+		}
+	}
+	return b.String()
+}
+
+// lookupPromptTemplate returns a builtin template by name, or parses spec as a
+// Go text/template that receives {{.Messages}} (each with .Role and .Content).
+func lookupPromptTemplate(spec string) (*promptTemplate, error) {
+	if pt, ok := builtinPromptTemplates[spec]; ok {
+		return &pt, nil
+	}
+	if !strings.Contains(spec, "{{") {
+		return nil, fmt.Errorf("unknown prompt template %q", spec)
+	}
+	tmpl, err := template.New("prompt").Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse prompt template: %w", err)
+	}
+	return &promptTemplate{
+		render: func(msgs []promptMessage) (string, error) {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, map[string]any{"Messages": msgs}); err != nil {
+				return "", err
+			}
+			return b.String(), nil
+		},
+	}, nil
+}
+
+// messagesFromRequest converts an OpenAI "messages" array into promptMessages.
+// Array-form content is accepted as long as every part is text.
+func messagesFromRequest(v any) ([]promptMessage, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("messages must be an array")
+	}
+	msgs := make([]promptMessage, 0, len(arr))
+	for i, item := range arr {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] must be an object", i)
+		}
+		content, err := flattenContent(m["content"])
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d].content: %w", i, err)
+		}
+		msgs = append(msgs, promptMessage{Role: getString(m, "role"), Content: content})
+	}
+	return msgs, nil
+}
+
+func flattenContent(v any) (string, error) {
+	switch c := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return c, nil
+	case []any:
+		var b strings.Builder
+		for _, p := range c {
+			part, ok := p.(map[string]any)
+			if !ok || getString(part, "type") != "text" {
+				return "", errors.New("only text content parts are supported")
+			}
+			b.WriteString(getString(part, "text"))
+		}
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported content type %T", v)
+	}
+}
+
+// renderPromptFromMessages renders req["messages"] with the given template spec
+// and returns the prompt along with the template's default stop sequences.
+func renderPromptFromMessages(spec string, messages any) (string, []string, error) {
+	pt, err := lookupPromptTemplate(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	msgs, err := messagesFromRequest(messages)
+	if err != nil {
+		return "", nil, err
+	}
+	prompt, err := pt.render(msgs)
+	if err != nil {
+		return "", nil, err
+	}
+	return prompt, pt.stop, nil
+}
+
+// applyPromptTemplate turns a chat-style /v1/completions request (one that
+// carries "messages" instead of "prompt") into a raw prompt using the rule's
+// prompt_template.
+func applyPromptTemplate(rule *ModelRule, req map[string]any) error {
+	if rule == nil || rule.PromptTemplate == "" {
+		return nil
+	}
+	messages, ok := req["messages"]
+	if !ok {
+		return nil
+	}
+	if _, hasPrompt := req["prompt"]; hasPrompt {
+		return errors.New("request must not contain both prompt and messages")
+	}
+
+	prompt, stop, err := renderPromptFromMessages(rule.PromptTemplate, messages)
+	if err != nil {
+		return err
+	}
+	vlog("TEMPLATE: rendered %q template, prompt length %d", rule.PromptTemplate, len(prompt))
+
+	delete(req, "messages")
+	req["prompt"] = prompt
+	if _, hasStop := req["stop"]; !hasStop && len(stop) > 0 {
+		req["stop"] = stop
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderPromptFromMessages(t *testing.T) {
+	messages := []any{
+		map[string]any{"role": "system", "content": "You are helpful."},
+		map[string]any{"role": "user", "content": "Hi"},
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		expected string
+		stop     []string
+	}{
+		{
+			name:     "chatml",
+			spec:     "chatml",
+			expected: "<|im_start|>system\nYou are helpful.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n",
+			stop:     []string{"<|im_end|>"},
+		},
+		{
+			name:     "llama2 folds system into first user turn",
+			spec:     "llama2",
+			expected: "<s>[INST] <<SYS>>\nYou are helpful.\n<</SYS>>\n\nHi [/INST]",
+		},
+		{
+			name:     "llama3",
+			spec:     "llama3",
+			expected: "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nYou are helpful.<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n",
+			stop:     []string{"<|eot_id|>"},
+		},
+		{
+			name:     "mistral",
+			spec:     "mistral",
+			expected: "<s>[INST] You are helpful.\n\nHi [/INST]",
+		},
+		{
+			name:     "alpaca",
+			spec:     "alpaca",
+			expected: "You are helpful.\n\n### Instruction:\nHi\n\n### Response:\n",
+			stop:     []string{"### Instruction:"},
+		},
+		{
+			name:     "custom text/template",
+			spec:     "{{range .Messages}}{{.Role}}: {{.Content}}\n{{end}}assistant:",
+			expected: "system: You are helpful.\nuser: Hi\nassistant:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, stop, err := renderPromptFromMessages(tt.spec, messages)
+			if err != nil {
+				t.Fatalf("renderPromptFromMessages() failed: %v", err)
+			}
+			if prompt != tt.expected {
+				t.Errorf("prompt = %q, want %q", prompt, tt.expected)
+			}
+			if !reflect.DeepEqual(stop, tt.stop) {
+				t.Errorf("stop = %v, want %v", stop, tt.stop)
+			}
+		})
+	}
+}
+
+func TestRenderPromptFromMessages_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		messages any
+	}{
+		{"unknown template", "nope", []any{}},
+		{"messages not an array", "chatml", "hello"},
+		{"non-text content part", "chatml", []any{
+			map[string]any{"role": "user", "content": []any{map[string]any{"type": "image_url"}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := renderPromptFromMessages(tt.spec, tt.messages); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestApplyPromptTemplate(t *testing.T) {
+	rule := &ModelRule{MatchModel: "raw-model", PromptTemplate: "chatml"}
+
+	t.Run("messages rendered into prompt", func(t *testing.T) {
+		req := map[string]any{
+			"model": "raw-model",
+			"messages": []any{
+				map[string]any{"role": "user", "content": []any{
+					map[string]any{"type": "text", "text": "Hello "},
+					map[string]any{"type": "text", "text": "world"},
+				}},
+			},
+		}
+		if err := applyPromptTemplate(rule, req); err != nil {
+			t.Fatalf("applyPromptTemplate() failed: %v", err)
+		}
+		if _, exists := req["messages"]; exists {
+			t.Errorf("messages should be removed")
+		}
+		want := "<|im_start|>user\nHello world<|im_end|>\n<|im_start|>assistant\n"
+		if req["prompt"] != want {
+			t.Errorf("prompt = %q, want %q", req["prompt"], want)
+		}
+		if !reflect.DeepEqual(req["stop"], []string{"<|im_end|>"}) {
+			t.Errorf("stop should default to template stop, got %v", req["stop"])
+		}
+	})
+
+	t.Run("client stop is kept", func(t *testing.T) {
+		req := map[string]any{
+			"messages": []any{map[string]any{"role": "user", "content": "x"}},
+			"stop":     "END",
+		}
+		if err := applyPromptTemplate(rule, req); err != nil {
+			t.Fatalf("applyPromptTemplate() failed: %v", err)
+		}
+		if req["stop"] != "END" {
+			t.Errorf("stop should be preserved, got %v", req["stop"])
+		}
+	})
+
+	t.Run("plain prompt untouched", func(t *testing.T) {
+		req := map[string]any{"prompt": "raw"}
+		if err := applyPromptTemplate(rule, req); err != nil {
+			t.Fatalf("applyPromptTemplate() failed: %v", err)
+		}
+		if req["prompt"] != "raw" {
+			t.Errorf("prompt should be unchanged, got %v", req["prompt"])
+		}
+	})
+
+	t.Run("prompt and messages together rejected", func(t *testing.T) {
+		req := map[string]any{"prompt": "raw", "messages": []any{}}
+		if err := applyPromptTemplate(rule, req); err == nil {
+			t.Error("expected error but got none")
+		}
+	})
+}
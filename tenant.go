@@ -0,0 +1,425 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantConfig gives a group of client keys its own upstream, model rules
+// and limits. Requests whose key matches no tenant use the top-level config.
+type TenantConfig struct {
+	Name         string       `json:"name"`
+	Keys         []string     `json:"keys"`          // exact client keys
+	KeyPrefixes  []string     `json:"key_prefixes"`  // e.g. "sk-team-a-"; longest prefix wins
+	Upstream     string       `json:"upstream"`      // defaults to the top-level upstream
+	UpstreamType string       `json:"upstream_type"` // defaults to the top-level upstream_type
+	ForwardAuth  *bool        `json:"forward_auth"`  // defaults to the top-level forward_auth
+	ModelRules   []ModelRule  `json:"model_rules"`   // replaces the top-level rules when set
+	Limits       TenantLimits `json:"limits"`
+	Priority     string       `json:"priority"` // "low", "normal" (default) or "high"; lower priorities are shed first
+
+	UpstreamOptions *UpstreamOptions `json:"upstream_options"` // defaults to the top-level upstream_options
+}
+
+// TenantLimits caps a tenant's completion traffic; zero means unlimited.
+type TenantLimits struct {
+	MaxConcurrent     int `json:"max_concurrent"`
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// defaultTenant labels traffic whose client key matches no tenant.
+const defaultTenant = "default"
+
+// validateTenants checks tenant sections for conflicts before startup.
+func validateTenants(cfg *Config) error {
+	names := map[string]bool{}
+	owners := map[string]string{}
+	for _, t := range cfg.Tenants {
+		if t.Name == "" {
+			return errors.New("tenant name is required")
+		}
+		if t.Name == defaultTenant {
+			return fmt.Errorf("tenant name %q is reserved for requests without a tenant", defaultTenant)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Keys) == 0 && len(t.KeyPrefixes) == 0 {
+			return fmt.Errorf("tenant %q: keys or key_prefixes is required", t.Name)
+		}
+		for _, k := range append(append([]string{}, t.Keys...), t.KeyPrefixes...) {
+			if k == "" {
+				return fmt.Errorf("tenant %q: empty key or key prefix", t.Name)
+			}
+			if owner, ok := owners[k]; ok {
+				return fmt.Errorf("tenant %q: key %q already belongs to tenant %q", t.Name, maskKey(k), owner)
+			}
+			owners[k] = t.Name
+		}
+		if t.Upstream != "" {
+			if u, err := url.Parse(t.Upstream); err != nil || u.Host == "" {
+				return fmt.Errorf("tenant %q: invalid upstream %q", t.Name, t.Upstream)
+			}
+		}
+		if err := validateUpstreamType(t.UpstreamType); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		if err := validatePriority(t.Priority); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		if err := validateModelRules(t.ModelRules); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		if err := validateUpstreamOptions(t.UpstreamOptions); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// maskKey keeps a key recognisable in logs without revealing it.
+func maskKey(k string) string {
+	if len(k) <= 8 {
+		return strings.Repeat("*", len(k))
+	}
+	return k[:6] + "..."
+}
+
+type tenant struct {
+	name     string
+	cfg      *Config
+	upstream *url.URL // nil when the top-level upstream is used
+	handlers proxyHandlers
+	limiter  *tenantLimiter
+	priority string
+}
+
+type tenantPrefix struct {
+	prefix string
+	tenant *tenant
+}
+
+// tenantRouter maps client keys to tenants and their handlers.
+type tenantRouter struct {
+	all      []*tenant
+	byKey    map[string]*tenant
+	prefixes []tenantPrefix // longest first
+	fallback proxyHandlers
+}
+
+func newTenantRouter(cfg *Config, fallback proxyHandlers) (*tenantRouter, error) {
+	tr := &tenantRouter{byKey: map[string]*tenant{}, fallback: fallback}
+	for _, tc := range cfg.Tenants {
+		tcfg := *cfg
+		tcfg.Tenants = nil
+		if tc.Upstream != "" {
+			tcfg.Upstream = tc.Upstream
+		}
+		if tc.UpstreamType != "" {
+			tcfg.UpstreamType = tc.UpstreamType
+		}
+		if tc.ForwardAuth != nil {
+			tcfg.ForwardAuth = *tc.ForwardAuth
+		}
+		if tc.ModelRules != nil {
+			tcfg.ModelRules = tc.ModelRules
+		}
+		tcfg.live = newLiveRules(tcfg.ModelRules)
+		if cfg.tenantRules == nil {
+			cfg.tenantRules = map[string]*liveRules{}
+		}
+		cfg.tenantRules[tc.Name] = tcfg.live
+		if tc.UpstreamOptions != nil {
+			tcfg.UpstreamOptions = tc.UpstreamOptions
+		}
+		up, err := url.Parse(tcfg.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: invalid upstream: %w", tc.Name, err)
+		}
+
+		t := &tenant{
+			name:     tc.Name,
+			cfg:      &tcfg,
+			handlers: newProxyHandlers(&tcfg, up),
+			limiter:  newTenantLimiter(tc.Limits),
+			priority: tc.Priority,
+		}
+		if tc.Upstream != "" {
+			t.upstream = up
+		}
+		tr.all = append(tr.all, t)
+		for _, k := range tc.Keys {
+			tr.byKey[k] = t
+		}
+		for _, p := range tc.KeyPrefixes {
+			tr.prefixes = append(tr.prefixes, tenantPrefix{p, t})
+		}
+	}
+	sort.SliceStable(tr.prefixes, func(i, j int) bool {
+		return len(tr.prefixes[i].prefix) > len(tr.prefixes[j].prefix)
+	})
+	return tr, nil
+}
+
+// lookup returns the tenant owning key, or nil.
+func (tr *tenantRouter) lookup(key string) *tenant {
+	if key == "" {
+		return nil
+	}
+	if t, ok := tr.byKey[key]; ok {
+		return t
+	}
+	for _, p := range tr.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.tenant
+		}
+	}
+	return nil
+}
+
+type tenantContextKey struct{}
+
+// tenantFromContext returns the tenant identified for the request, or nil.
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// tenantName is the tenant label for metrics, records and logs.
+func tenantName(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil {
+		return t.name
+	}
+	return defaultTenant
+}
+
+// byName returns the tenant called name, or nil. It is safe to call on a
+// nil router.
+func (tr *tenantRouter) byName(name string) *tenant {
+	if tr == nil {
+		return nil
+	}
+	for _, t := range tr.all {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// identify resolves the tenant from the client key, stores it in the request
+// context and, for limited endpoints, enforces the tenant's limits. It wraps
+// the whole handler chain so every layer can see the tenant.
+func (tr *tenantRouter) identify(next http.HandlerFunc, limited bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := tr.lookup(bearerToken(r))
+		if t == nil {
+			next(w, r)
+			return
+		}
+		if limited {
+			release, err := t.limiter.acquire(time.Now())
+			if err != nil {
+				vlogCtx(r.Context(), "TENANT: '%s' rejected: %v", t.name, err)
+				writeJSONError(w, http.StatusTooManyRequests, err.Error(), "rate_limit_error", "tenant_rate_limited")
+				return
+			}
+			defer release()
+		}
+		vlogCtx(r.Context(), "TENANT: request for '%s'", t.name)
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.tenant = t.name
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+	}
+}
+
+// dispatch picks the tenant's handler, falling back to the top-level config.
+func (tr *tenantRouter) dispatch(pick func(proxyHandlers) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t := tenantFromContext(r.Context()); t != nil {
+			pick(t.handlers)(w, r)
+			return
+		}
+		pick(tr.fallback)(w, r)
+	}
+}
+
+// tenantLimiter enforces a concurrency cap and a fixed one-minute request window.
+type tenantLimiter struct {
+	limits TenantLimits
+	slots  chan struct{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+func newTenantLimiter(limits TenantLimits) *tenantLimiter {
+	l := &tenantLimiter{limits: limits}
+	if limits.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return l
+}
+
+func (l *tenantLimiter) acquire(now time.Time) (release func(), err error) {
+	if rpm := l.limits.RequestsPerMinute; rpm > 0 {
+		l.mu.Lock()
+		if now.Sub(l.windowStart) >= time.Minute {
+			l.windowStart, l.count = now, 0
+		}
+		if l.count >= rpm {
+			l.mu.Unlock()
+			return nil, fmt.Errorf("tenant request limit of %d per minute reached", rpm)
+		}
+		l.count++
+		l.mu.Unlock()
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	default:
+		return nil, fmt.Errorf("tenant concurrency limit of %d reached", l.limits.MaxConcurrent)
+	}
+}
+
+// tenantModelStats aggregates the request and token counters for one model.
+type tenantModelStats struct {
+	Model            string         `json:"model"`
+	Requests         int64          `json:"requests"`
+	Errors           int64          `json:"errors"` // responses with status >= 400
+	PromptTokens     int64          `json:"prompt_tokens"`
+	CompletionTokens int64          `json:"completion_tokens"`
+	StreamErrors     int64          `json:"stream_errors"`
+	Statuses         map[string]int `json:"statuses"`
+}
+
+type tenantStats struct {
+	Name             string              `json:"name"`
+	Upstream         string              `json:"upstream,omitempty"`
+	Limits           *TenantLimits       `json:"limits,omitempty"`
+	Requests         int64               `json:"requests"`
+	Errors           int64               `json:"errors"`
+	PromptTokens     int64               `json:"prompt_tokens"`
+	CompletionTokens int64               `json:"completion_tokens"`
+	StreamErrors     int64               `json:"stream_errors"`
+	Models           []*tenantModelStats `json:"models,omitempty"`
+}
+
+// redactUpstream hides the password of an upstream URL; one that does not
+// parse is left out rather than shown as is.
+func redactUpstream(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// collectTenantStats builds per-tenant views from the relay's counters, so
+// the admin API and /metrics can never disagree.
+func collectTenantStats(cfg *Config) map[string]*tenantStats {
+	stats := map[string]*tenantStats{defaultTenant: {Name: defaultTenant, Upstream: redactUpstream(cfg.Upstream)}}
+	for _, tc := range cfg.Tenants {
+		st := &tenantStats{Name: tc.Name, Upstream: redactUpstream(cmp.Or(tc.Upstream, cfg.Upstream))}
+		if tc.Limits != (TenantLimits{}) {
+			limits := tc.Limits
+			st.Limits = &limits
+		}
+		stats[tc.Name] = st
+	}
+
+	models := map[[2]string]*tenantModelStats{}
+	model := func(tenant, name string) *tenantModelStats {
+		if stats[tenant] == nil {
+			stats[tenant] = &tenantStats{Name: tenant}
+		}
+		m := models[[2]string{tenant, name}]
+		if m == nil {
+			m = &tenantModelStats{Model: name, Statuses: map[string]int{}}
+			models[[2]string{tenant, name}] = m
+			stats[tenant].Models = append(stats[tenant].Models, m)
+		}
+		return m
+	}
+	requestsTotal.each(func(lv []string, v float64) {
+		m := model(lv[0], lv[1])
+		m.Requests += int64(v)
+		m.Statuses[lv[2]] += int(v)
+		if status, _ := strconv.Atoi(lv[2]); status >= 400 {
+			m.Errors += int64(v)
+		}
+	})
+	tokensTotal.each(func(lv []string, v float64) {
+		m := model(lv[0], lv[1])
+		switch lv[2] {
+		case "prompt":
+			m.PromptTokens += int64(v)
+		case "completion":
+			m.CompletionTokens += int64(v)
+		}
+	})
+	streamErrorsTotal.each(func(lv []string, v float64) {
+		model(lv[0], lv[1]).StreamErrors += int64(v)
+	})
+
+	for _, st := range stats {
+		sort.Slice(st.Models, func(i, j int) bool { return st.Models[i].Model < st.Models[j].Model })
+		for _, m := range st.Models {
+			st.Requests += m.Requests
+			st.Errors += m.Errors
+			st.PromptTokens += m.PromptTokens
+			st.CompletionTokens += m.CompletionTokens
+			st.StreamErrors += m.StreamErrors
+		}
+	}
+	return stats
+}
+
+// handleTenants serves GET /admin/tenants (totals per tenant) and
+// GET /admin/tenants/{name} (per-model breakdown for one tenant).
+func handleTenants(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats := collectTenantStats(cfg)
+		if name := strings.TrimPrefix(r.URL.Path, "/admin/tenants/"); name != r.URL.Path && name != "" {
+			st, ok := stats[name]
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "tenant not found", "invalid_request_error", "not_found")
+				return
+			}
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		data := make([]tenantStats, 0, len(names))
+		for _, name := range names {
+			st := *stats[name]
+			st.Models = nil
+			data = append(data, st)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+	}
+}
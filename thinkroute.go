@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// thinkRouter moves <think> sections that a model writes into content over
+// to reasoning_content, or drops them, per choice of a chat stream.
+type thinkRouter struct {
+	drop   bool
+	states map[any]*thinkState // by choice index
+}
+
+type thinkState struct {
+	inside bool
+	hold   string // tail that may be the start of a tag
+}
+
+// newThinkRouter wraps src, or returns nil when the rule sets no think_routing.
+func newThinkRouter(src io.Reader, rule *ModelRule) io.ReadCloser {
+	if rule == nil || rule.ThinkRouting == "" {
+		return nil
+	}
+	r := &thinkRouter{drop: rule.ThinkRouting == "drop", states: map[any]*thinkState{}}
+	return pipeSSE(src, r.handle)
+}
+
+func (r *thinkRouter) handle(line string) ([]string, bool) {
+	if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	choices, _ := chunk["choices"].([]any)
+	changed := false
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		delta, ok := choice["delta"].(map[string]any)
+		if !ok {
+			continue
+		}
+		st := r.states[choice["index"]]
+		if st == nil {
+			st = &thinkState{}
+			r.states[choice["index"]] = st
+		}
+		text := getString(delta, "content")
+		if text == "" && st.hold == "" {
+			continue
+		}
+		content, reasoning := st.split(text, choice["finish_reason"] != nil)
+		delta["content"] = content
+		if reasoning != "" && !r.drop {
+			delta["reasoning_content"] = getString(delta, "reasoning_content") + reasoning
+		}
+		changed = true
+	}
+	if !changed {
+		return []string{line}, true
+	}
+	b, _ := json.Marshal(chunk)
+	return []string{"data: " + string(b)}, true
+}
+
+// split divides text into content and reasoning. A tail that could begin a
+// tag is held for the next chunk unless final is set.
+func (st *thinkState) split(text string, final bool) (content, reasoning string) {
+	s := st.hold + text
+	st.hold = ""
+	var c, rsn strings.Builder
+	for s != "" {
+		tag, out := thinkOpen, &c
+		if st.inside {
+			tag, out = thinkClose, &rsn
+		}
+		if i := strings.Index(s, tag); i >= 0 {
+			out.WriteString(s[:i])
+			s = s[i+len(tag):]
+			st.inside = !st.inside
+			continue
+		}
+		keep := 0
+		if !final {
+			keep = partialSuffix(s, tag)
+		}
+		out.WriteString(s[:len(s)-keep])
+		st.hold = s[len(s)-keep:]
+		break
+	}
+	return c.String(), rsn.String()
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a
+// proper prefix of tag.
+func partialSuffix(s, tag string) int {
+	for n := min(len(tag)-1, len(s)); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
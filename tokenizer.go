@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenizer estimates how many tokens a model makes of a text. The built-in
+// ones weigh each character; a vocabulary read from a file is matched
+// greedily, longest token first, which comes within a few percent of the
+// real BPE count without its merge rules.
+type tokenizer struct {
+	name    string
+	perRune func(r rune) float64 // built-in tokenizers
+	vocab   *tokenVocab          // tokenizers read from a file
+}
+
+// tokenVocab is the set of tokens in a vocabulary file.
+type tokenVocab struct {
+	tokens    map[string]struct{}
+	maxLen    int       // longest token, in bytes
+	byteLevel bool      // tokens spell bytes as GPT-2 characters, "Ġ" for a space
+	spaceRune rune      // SentencePiece vocabularies spell a space "▁"
+	byteRunes [256]rune // byte-level mapping, when byteLevel is set
+}
+
+var charTokenizer = &tokenizer{name: "chars", perRune: func(rune) float64 { return 0.25 }}
+
+// cjkTokenizer counts a Chinese, Japanese or Korean character as a token of
+// its own, which is closer for those languages than four characters a token.
+var cjkTokenizer = &tokenizer{name: "cjk", perRune: func(r rune) float64 {
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+		return 1
+	}
+	return 0.25
+}}
+
+// tokenizers caches the tokenizers of the rules; they are loaded at
+// validation, so lookups never see a bad file.
+var tokenizers sync.Map // spec -> *tokenizer
+
+// loadTokenizer returns the tokenizer a rule names: "chars" (the default, four
+// characters a token), "cjk", or the path of a Hugging Face tokenizer.json,
+// a vocab.json or a tiktoken file.
+func loadTokenizer(spec string) (*tokenizer, error) {
+	switch spec {
+	case "", "chars":
+		return charTokenizer, nil
+	case "cjk":
+		return cjkTokenizer, nil
+	}
+	if t, ok := tokenizers.Load(spec); ok {
+		return t.(*tokenizer), nil
+	}
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer: %w", err)
+	}
+	v, err := parseVocab(data)
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer %s: %w", spec, err)
+	}
+	t := &tokenizer{name: spec, vocab: v}
+	tokenizers.Store(spec, t)
+	return t, nil
+}
+
+// ruleTokenizer returns the rule's tokenizer, the default one without a rule.
+func ruleTokenizer(rule *ModelRule) *tokenizer {
+	if rule == nil {
+		return charTokenizer
+	}
+	t, err := loadTokenizer(rule.Tokenizer)
+	if err != nil {
+		// validated at startup
+		return charTokenizer
+	}
+	return t
+}
+
+// parseVocab reads the tokens of a tokenizer.json (BPE or Unigram), a
+// vocab.json mapping tokens to ids, or a tiktoken file of base64 tokens and
+// ranks.
+func parseVocab(data []byte) (*tokenVocab, error) {
+	var tokens []string
+	var file struct {
+		Model struct {
+			Vocab json.RawMessage `json:"vocab"`
+		} `json:"model"`
+	}
+	var ids map[string]json.RawMessage
+	if json.Unmarshal(data, &file) == nil && file.Model.Vocab != nil {
+		var bpe map[string]int
+		var unigram [][]json.RawMessage
+		switch {
+		case json.Unmarshal(file.Model.Vocab, &bpe) == nil:
+			for tok := range bpe {
+				tokens = append(tokens, tok)
+			}
+		case json.Unmarshal(file.Model.Vocab, &unigram) == nil:
+			for _, entry := range unigram {
+				var tok string
+				if len(entry) > 0 && json.Unmarshal(entry[0], &tok) == nil {
+					tokens = append(tokens, tok)
+				}
+			}
+		default:
+			return nil, errors.New("unsupported model.vocab")
+		}
+	} else if json.Unmarshal(data, &ids) == nil {
+		for tok := range ids {
+			tokens = append(tokens, tok)
+		}
+	} else {
+		// tiktoken: the tokens are raw bytes, no mapping needed
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			tok, rank, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+			if !ok {
+				return nil, errors.New("not a tokenizer.json, vocab.json or tiktoken file")
+			}
+			b, err := base64.StdEncoding.DecodeString(tok)
+			if _, rerr := strconv.Atoi(rank); err != nil || rerr != nil {
+				return nil, fmt.Errorf("invalid tiktoken line %q", sc.Text())
+			}
+			tokens = append(tokens, string(b))
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty vocabulary")
+	}
+
+	v := &tokenVocab{tokens: make(map[string]struct{}, len(tokens))}
+	for _, tok := range tokens {
+		v.tokens[tok] = struct{}{}
+		v.maxLen = max(v.maxLen, len(tok))
+		switch {
+		case strings.HasPrefix(tok, "Ġ"):
+			v.byteLevel = true
+		case strings.HasPrefix(tok, "▁"):
+			v.spaceRune = '▁'
+		}
+	}
+	if v.byteLevel {
+		v.byteRunes = gpt2ByteRunes()
+	}
+	return v, nil
+}
+
+// gpt2ByteRunes is the byte to character table of byte-level BPE: printable
+// bytes stand for themselves, the rest are moved past U+0100.
+func gpt2ByteRunes() [256]rune {
+	var table [256]rune
+	n := 0
+	for b := range 256 {
+		if b >= '!' && b <= '~' || b >= 0xA1 && b <= 0xAC || b >= 0xAE {
+			table[b] = rune(b)
+		} else {
+			table[b] = rune(256 + n)
+			n++
+		}
+	}
+	return table
+}
+
+// spell writes text the way the vocabulary does.
+func (v *tokenVocab) spell(text string) string {
+	switch {
+	case v.byteLevel:
+		var b strings.Builder
+		for i := 0; i < len(text); i++ {
+			b.WriteRune(v.byteRunes[text[i]])
+		}
+		return b.String()
+	case v.spaceRune != 0:
+		return strings.ReplaceAll(text, " ", string(v.spaceRune))
+	}
+	return text
+}
+
+// count matches the longest token at each position; what no token covers
+// counts a token a character.
+func (v *tokenVocab) count(text string) int {
+	s := v.spell(text)
+	n := 0
+	for i := 0; i < len(s); {
+		l := min(v.maxLen, len(s)-i)
+		for ; l > 0; l-- {
+			if i+l < len(s) && !utf8.RuneStart(s[i+l]) {
+				continue
+			}
+			if _, ok := v.tokens[s[i:i+l]]; ok {
+				break
+			}
+		}
+		if l == 0 {
+			_, l = utf8.DecodeRuneInString(s[i:])
+		}
+		i += l
+		n++
+	}
+	return n
+}
+
+func (t *tokenizer) count(text string) int {
+	if t.vocab != nil {
+		return t.vocab.count(text)
+	}
+	var w float64
+	for _, r := range text {
+		w += t.perRune(r)
+	}
+	return int(math.Ceil(w))
+}
+
+// tokenCounter counts the tokens of a text that arrives in pieces, such as
+// a stream. Vocabulary matches do not cross whitespace, so only the text
+// after the last whitespace is counted again as pieces arrive.
+type tokenCounter struct {
+	t       *tokenizer
+	weight  float64 // built-in tokenizers
+	counted int     // tokens of the text before pending
+	pending string
+}
+
+// maxPendingBytes bounds the text counted again for each piece, for
+// languages written without spaces.
+const maxPendingBytes = 256
+
+func (t *tokenizer) newCounter() *tokenCounter {
+	return &tokenCounter{t: t}
+}
+
+func (c *tokenCounter) add(text string) {
+	if c.t.vocab == nil {
+		for _, r := range text {
+			c.weight += c.t.perRune(r)
+		}
+		return
+	}
+	c.pending += text
+	cut := strings.LastIndexFunc(c.pending, unicode.IsSpace)
+	if cut <= 0 && len(c.pending) > maxPendingBytes {
+		cut = len(c.pending) - maxPendingBytes/4
+		for cut > 0 && !utf8.RuneStart(c.pending[cut]) {
+			cut--
+		}
+	}
+	if cut > 0 {
+		c.counted += c.t.vocab.count(c.pending[:cut])
+		c.pending = c.pending[cut:]
+	}
+}
+
+func (c *tokenCounter) tokens() int {
+	if c.t.vocab == nil {
+		return int(math.Ceil(c.weight))
+	}
+	return c.counted + c.t.vocab.count(c.pending)
+}
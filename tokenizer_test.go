@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenizers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	files := map[string]string{
+		"byte-level BPE": write("bpe.json", `{"model":{"type":"BPE","vocab":{"Hello":0,"Ġworld":1,"Ġ":2,"!":3,"ä½ł":4}}}`),
+		"unigram":        write("unigram.json", `{"model":{"type":"Unigram","vocab":[["▁Hello",0],["▁world",-1],["!",-2],["你",-3]]}}`),
+		"vocab.json":     write("vocab.json", `{"Hello":0,"Ġworld":1,"!":2}`),
+		"tiktoken":       write("cl.tiktoken", fmt.Sprintf("%s 0\n%s 1\n%s 2\n%s 3\n", b64("Hello"), b64(" world"), b64("!"), b64("你"))),
+	}
+	for name, path := range files {
+		tok, err := loadTokenizer(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		text := "Hello world!"
+		if name == "unigram" {
+			text = " Hello world!"
+		}
+		if got := tok.count(text); got != 3 {
+			t.Errorf("%s: %q is %d tokens, want 3", name, text, got)
+		}
+		// a stream split inside words counts the same
+		c := tok.newCounter()
+		for _, piece := range []string{text[:3], text[3:8], text[8:]} {
+			c.add(piece)
+		}
+		if c.tokens() != 3 {
+			t.Errorf("%s: streamed %q is %d tokens, want 3", name, text, c.tokens())
+		}
+	}
+	if tok, _ := loadTokenizer(files["byte-level BPE"]); tok.count("你好") != 1+3 {
+		// 你 is one token, each byte of 好 one more
+		t.Errorf("byte-level BPE: 你好 is %d tokens", tok.count("你好"))
+	}
+
+	if got := charTokenizer.count("Hello world!"); got != estimateTokens(12) {
+		t.Errorf("chars: %d tokens", got)
+	}
+	if got := cjkTokenizer.count("你好, world"); got != 2+2 {
+		t.Errorf("cjk: %d tokens", got)
+	}
+	c := cjkTokenizer.newCounter()
+	c.add("你")
+	c.add("好, wo")
+	c.add("rld")
+	if c.tokens() != 4 {
+		t.Errorf("cjk streamed: %d tokens", c.tokens())
+	}
+
+	for _, spec := range []string{filepath.Join(dir, "missing.json"), write("junk.txt", "not a vocabulary")} {
+		if _, err := loadTokenizer(spec); err == nil {
+			t.Errorf("%s loaded", spec)
+		}
+	}
+}
+
+func TestStreamUsageEstimate(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test") == "second" {
+			fmt.Fprint(w, `{"choices":[{"message":{"content":"ok"}}],"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for range 10 {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":null}]}\n\n", strings.Repeat("y", 20))
+		}
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream:   upstream.URL,
+		ClientKeys: []ClientKey{{Key: "sk-stream", Name: "stream", TokensPerMinute: 100}},
+		ModelRules: []ModelRule{{MatchModel: "estimate-m"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := httptest.NewServer(mux)
+	defer relay.Close()
+	prompt := strings.Repeat("x", 40) // 10 tokens
+	send := func(body, header string) *http.Response {
+		r, _ := http.NewRequest("POST", relay.URL+"/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sk-stream")
+		r.Header.Set("X-Test", header)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	stream := send(`{"model":"estimate-m","stream":true,"messages":[{"role":"user","content":"`+prompt+`"}]}`, "first")
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	for n := 0; n < 10; {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			n++
+		}
+	}
+	// the 200 characters streamed so far count against the key at once:
+	// 10 + 50 used leaves no room for 10 + 50 more
+	resp := send(`{"model":"m","max_tokens":50,"messages":[{"role":"user","content":"`+prompt+`"}]}`, "second")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request during the stream: %d", resp.StatusCode)
+	}
+	close(release)
+	_, _ = io.Copy(io.Discard, reader)
+	stream.Body.Close()
+
+	if got := tokensTotal.Value(defaultTenant, "estimate-m", "completion"); got != 50 {
+		t.Errorf("completion tokens %v, want the estimated 50", got)
+	}
+	if got := estimatedUsageTotal.Value(defaultTenant, "estimate-m"); got != 1 {
+		t.Errorf("%v estimated streams", got)
+	}
+}
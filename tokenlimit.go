@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var clientTokenRejectionsTotal = metrics.newCounterVec("relay_client_token_rejections_total",
+	"Requests rejected before forwarding because their estimated tokens exceed the client key's limit.", "client", "reason")
+
+// tokenWindow counts a client key's tokens in a fixed one-minute window.
+// Admitted requests reserve their estimate, which is replaced by the usage
+// the upstream reports once they finish, so concurrent requests cannot all
+// squeeze into the same remaining budget.
+type tokenWindow struct {
+	limit int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	used        int
+}
+
+// tokenLimitError explains why a request was not admitted.
+type tokenLimitError struct {
+	limit, used, requested int
+	retryAfter             time.Duration // zero when the request can never fit
+}
+
+func (e *tokenLimitError) Error() string {
+	if e.retryAfter == 0 {
+		return fmt.Sprintf("Request too large for tokens per min (TPM): Limit %d, Requested %d. The input or max_tokens must be reduced in order to run successfully.", e.limit, e.requested)
+	}
+	return fmt.Sprintf("Rate limit reached for tokens per min (TPM): Limit %d, Used %d, Requested %d. Please try again in %ds.", e.limit, e.used, e.requested, e.retryAfterSeconds())
+}
+
+// retryAfterSeconds rounds the wait up, so a client that waits that long
+// lands in the next window.
+func (e *tokenLimitError) retryAfterSeconds() int {
+	return int((e.retryAfter + time.Second - 1) / time.Second)
+}
+
+func (tw *tokenWindow) roll(now time.Time) {
+	if now.Sub(tw.windowStart) >= time.Minute {
+		tw.windowStart, tw.used = now, 0
+	}
+}
+
+// admit reserves estimate tokens, returning the window they were reserved in.
+func (tw *tokenWindow) admit(estimate int, now time.Time) (time.Time, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.roll(now)
+	if estimate > tw.limit {
+		return time.Time{}, &tokenLimitError{limit: tw.limit, used: tw.used, requested: estimate}
+	}
+	if tw.used+estimate > tw.limit {
+		return time.Time{}, &tokenLimitError{limit: tw.limit, used: tw.used, requested: estimate, retryAfter: tw.windowStart.Add(time.Minute).Sub(now)}
+	}
+	tw.used += estimate
+	return tw.windowStart, nil
+}
+
+// charge adds tokens to a reservation while its request runs.
+func (tw *tokenWindow) charge(window time.Time, tokens int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.windowStart.Equal(window) {
+		tw.used += tokens
+	}
+}
+
+// settle replaces a reservation with the tokens actually used. A request
+// that outlived its window is not charged to the next one.
+func (tw *tokenWindow) settle(window time.Time, reserved, actual int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.windowStart.Equal(window) {
+		tw.used = max(tw.used-reserved+actual, 0)
+	}
+}
+
+// estimateRequestTokens approximates what a completion request can cost:
+// its prompt plus all the output max_tokens allows.
+func estimateRequestTokens(payload map[string]any) (prompt, total int) {
+	prompt = estimateTokens(utf8.RuneCountInString(promptText(payload)))
+	total = prompt
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		if n, ok := payload[field].(float64); ok && n > 0 {
+			total += int(n)
+			break
+		}
+	}
+	return prompt, total
+}
+
+// limitClientTokens rejects requests whose estimated tokens do not fit the
+// client key's tokens_per_minute before they reach the upstream, then
+// charges the key what the upstream reports. It runs inside clientAuth.
+func limitClientTokens(idx clientKeyIndex, windows map[string]*tokenWindow, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, _ := idx.authenticate(r)
+		tw := windows[bearerToken(r)]
+		if k == nil || tw == nil {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var payload map[string]any
+		_ = json.Unmarshal(body, &payload)
+		prompt, estimate := estimateRequestTokens(payload)
+
+		window, err := tw.admit(estimate, time.Now())
+		if err != nil {
+			lerr := err.(*tokenLimitError)
+			if lerr.retryAfter == 0 {
+				vlogCtx(r.Context(), "TOKENS: client '%s' sent a request of ~%d tokens, over its limit of %d", k.label(), estimate, tw.limit)
+				clientTokenRejectionsTotal.Inc(k.label(), "too_large")
+				writeJSONError(w, http.StatusBadRequest, lerr.Error(), "tokens", "request_too_large")
+				return
+			}
+			vlogCtx(r.Context(), "TOKENS: client '%s' used %d of %d tokens this minute, rejecting ~%d more", k.label(), lerr.used, tw.limit, estimate)
+			clientTokenRejectionsTotal.Inc(k.label(), "tpm")
+			w.Header().Set("Retry-After", strconv.Itoa(lerr.retryAfterSeconds()))
+			writeJSONError(w, http.StatusTooManyRequests, lerr.Error(), "tokens", "rate_limit_exceeded")
+			return
+		}
+
+		info := requestInfoFrom(r.Context())
+		if info == nil {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		}
+		// a stream that outgrows its reservation is charged as it goes, so
+		// the key's other requests see the tokens before it ends
+		charged := estimate
+		info.outputTokens = func(n int) {
+			if extra := prompt + n - charged; extra > 0 {
+				tw.charge(window, extra)
+				charged += extra
+			}
+		}
+		next(w, r)
+		actual := info.usage.TotalTokens
+		if actual == 0 {
+			// no usage reported; the prompt was certainly spent
+			actual = prompt
+		}
+		tw.settle(window, charged, actual)
+	}
+}
+
+func newTokenWindows(keys []ClientKey) map[string]*tokenWindow {
+	windows := map[string]*tokenWindow{}
+	for _, k := range keys {
+		if k.TokensPerMinute > 0 {
+			windows[k.Key] = &tokenWindow{limit: k.TokensPerMinute}
+		}
+	}
+	return windows
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientTokenLimit(t *testing.T) {
+	var forwarded int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"ok"}}],"usage":{"prompt_tokens":30,"completion_tokens":20,"total_tokens":50}}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Upstream:   upstream.URL,
+		ClientKeys: []ClientKey{{Key: "sk-relay-alice", Name: "alice", TokensPerMinute: 250}},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatalf("newRelayMux() failed: %v", err)
+	}
+	send := func(maxTokens int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"model":"m","max_tokens":%d,"messages":[{"role":"user","content":%q}]}`, maxTokens, strings.Repeat("x", 40))
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer sk-relay-alice")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	code := func(w *httptest.ResponseRecorder) string {
+		var body struct {
+			Error struct{ Code string } `json:"error"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Error.Code
+	}
+
+	// 10 prompt tokens plus 500 can never fit 250 per minute
+	if w := send(500); w.Code != http.StatusBadRequest || code(w) != "request_too_large" || forwarded != 0 {
+		t.Fatalf("oversized request: %d %s, forwarded %d", w.Code, w.Body, forwarded)
+	}
+	// 10 + 100 is reserved, then settled to the 50 the upstream reports
+	for i := 0; i < 3; i++ {
+		if w := send(100); w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	// 150 used, 110 more does not fit this minute
+	w := send(100)
+	if w.Code != http.StatusTooManyRequests || code(w) != "rate_limit_exceeded" || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("over the window: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "Used 150, Requested 110") {
+		t.Errorf("error message: %s", w.Body)
+	}
+	if forwarded != 3 {
+		t.Errorf("forwarded %d requests, want 3", forwarded)
+	}
+}
+
+func TestTokenWindow(t *testing.T) {
+	tw := &tokenWindow{limit: 100}
+	now := time.Now()
+	window, err := tw.admit(80, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.admit(30, now); err == nil {
+		t.Fatal("a reservation that does not fit was admitted")
+	}
+	tw.settle(window, 80, 20)
+	if _, err := tw.admit(30, now); err != nil {
+		t.Fatalf("after settling to 20: %v", err)
+	}
+	err = func() error { _, err := tw.admit(60, now.Add(30*time.Second)); return err }()
+	if lerr, ok := err.(*tokenLimitError); !ok || lerr.retryAfterSeconds() != 30 {
+		t.Fatalf("retry after: %v", err)
+	}
+	if _, err := tw.admit(60, now.Add(time.Minute)); err != nil {
+		t.Errorf("next window: %v", err)
+	}
+	// a request that outlived its window is not charged to the next one
+	tw.settle(window, 80, 1000)
+	if _, err := tw.admit(40, now.Add(time.Minute)); err != nil {
+		t.Errorf("settled into the wrong window: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// typedArgsJSON converts XML arguments to a JSON object. A value takes the
+// type its property declares in props; without a declared type, numbers,
+// booleans, null and embedded JSON objects or arrays are recognized and
+// anything else stays a string.
+func typedArgsJSON(args []ToolCallArg, props map[string]any) string {
+	if len(args) == 0 {
+		return "{}"
+	}
+	argMap := make(map[string]any, len(args))
+	for _, arg := range args {
+		prop, _ := props[arg.Key].(map[string]any)
+		argMap[arg.Key] = typedValue(arg.Value, schemaTypes(prop))
+	}
+	jsonBytes, err := json.Marshal(argMap)
+	if err != nil {
+		return "{}"
+	}
+	return string(jsonBytes)
+}
+
+// schemaTypes returns the types a property allows, or nil when it does not say
+func schemaTypes(prop map[string]any) []string {
+	switch typ := prop["type"].(type) {
+	case string:
+		return []string{typ}
+	case []any:
+		var types []string
+		for _, t := range typ {
+			if s, ok := t.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// typedValue converts one argument value. With declared types the first
+// one the value fits is used; a value that fits none is kept as a string.
+func typedValue(s string, types []string) any {
+	if types == nil {
+		if v, ok := inferValue(s); ok {
+			return v
+		}
+		return s
+	}
+	for _, typ := range types {
+		if v, ok := asType(s, typ); ok {
+			return v
+		}
+	}
+	Logf("TOOLCALLFIX: argument value %q does not match schema type %v, keeping it as a string", s, types)
+	return s
+}
+
+// inferValue recognizes a value that is a JSON scalar, object or array
+func inferValue(s string) (any, bool) {
+	t := strings.TrimSpace(s)
+	switch {
+	case t == "true":
+		return true, true
+	case t == "false":
+		return false, true
+	case t == "null":
+		return nil, true
+	case jsonNumber.MatchString(t):
+		return json.Number(t), true
+	case strings.HasPrefix(t, "{") || strings.HasPrefix(t, "["):
+		if json.Valid([]byte(t)) {
+			return json.RawMessage(t), true
+		}
+	}
+	return nil, false
+}
+
+// asType converts s to the JSON Schema type typ
+func asType(s, typ string) (any, bool) {
+	t := strings.TrimSpace(s)
+	switch typ {
+	case "string":
+		return s, true
+	case "integer":
+		if jsonNumber.MatchString(t) && !strings.ContainsAny(t, ".eE") {
+			return json.Number(t), true
+		}
+	case "number":
+		if jsonNumber.MatchString(t) {
+			return json.Number(t), true
+		}
+	case "boolean":
+		switch strings.ToLower(t) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	case "null":
+		if t == "null" || t == "" {
+			return nil, true
+		}
+	case "object":
+		if strings.HasPrefix(t, "{") && json.Valid([]byte(t)) {
+			return json.RawMessage(t), true
+		}
+	case "array":
+		if strings.HasPrefix(t, "[") && json.Valid([]byte(t)) {
+			return json.RawMessage(t), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,58 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTypedArgsJSON(t *testing.T) {
+	args := []ToolCallArg{
+		{Key: "limit", Value: "10"},
+		{Key: "ratio", Value: "-0.5e2"},
+		{Key: "recursive", Value: "true"},
+		{Key: "cursor", Value: "null"},
+		{Key: "filter", Value: ` {"ext": [".go"], "depth": 2} `},
+		{Key: "paths", Value: `["a", "b"]`},
+		{Key: "pattern", Value: "func main"},
+		{Key: "version", Value: "1.2.3"},
+		{Key: "broken", Value: "{not json"},
+	}
+	want := `{"broken":"{not json","cursor":null,"filter":{"ext":[".go"],"depth":2},"limit":10,"paths":["a","b"],"pattern":"func main","ratio":-0.5e2,"recursive":true,"version":"1.2.3"}`
+	if got := typedArgsJSON(args, nil); got != want {
+		t.Errorf("inferred:\n got %s\nwant %s", got, want)
+	}
+
+	var props map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"limit": {"type": "string"},
+		"ratio": {"type": "integer"},
+		"recursive": {"type": "boolean"},
+		"cursor": {"type": ["string", "null"]},
+		"filter": {"type": "object"},
+		"paths": {"type": "array"},
+		"pattern": {"description": "no type"},
+		"version": {"type": "number"}
+	}`), &props)
+	want = `{"broken":"{not json","cursor":"null","filter":{"ext":[".go"],"depth":2},"limit":"10","paths":["a","b"],"pattern":"func main","ratio":"-0.5e2","recursive":true,"version":"1.2.3"}`
+	if got := typedArgsJSON(args, props); got != want {
+		t.Errorf("with schema:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestStreamTransformer_SetTools(t *testing.T) {
+	transformer := NewStreamTransformer()
+	if err := transformer.SetTools(json.RawMessage(`{"not":"a list"}`)); err == nil {
+		t.Error("SetTools() accepted an object, want error")
+	}
+	tools := `[{"type":"function","function":{"name":"grep","parameters":{"type":"object","properties":{"pattern":{"type":"string"},"max":{"type":"integer"}}}}},{"type":"function","function":{"name":"ls"}}]`
+	if err := transformer.SetTools(json.RawMessage(tools)); err != nil {
+		t.Fatalf("SetTools() failed: %v", err)
+	}
+	_, calls, _ := runTags(t, transformer,
+		"<tool_call>grep<arg_key>pattern</arg_key><arg_value>404</arg_value><arg_key>max</arg_key><arg_value>3</arg_value></tool_call>",
+		"<tool_call>ls<arg_key>all</arg_key><arg_value>true</arg_value></tool_call>",
+	)
+	if len(calls) != 2 || calls[0].Arguments != `{"max":3,"pattern":"404"}` || calls[1].Arguments != `{"all":true}` {
+		t.Errorf("tool calls = %v", calls)
+	}
+}
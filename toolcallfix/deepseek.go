@@ -0,0 +1,276 @@
+package toolcallfix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DeepSeek-R1 special tokens. The bars are fullwidth (U+FF5C) and the
+// spaces are U+2581, exactly as the tokenizer emits them.
+const (
+	deepSeekThinkStart = "<think>"
+	deepSeekThinkEnd   = "</think>"
+	deepSeekCallsBegin = "<｜tool▁calls▁begin｜>"
+	deepSeekCallsEnd   = "<｜tool▁calls▁end｜>"
+	deepSeekCallBegin  = "<｜tool▁call▁begin｜>"
+	deepSeekCallEnd    = "<｜tool▁call▁end｜>"
+	deepSeekSep        = "<｜tool▁sep｜>"
+)
+
+type deepSeekMode int
+
+const (
+	deepSeekText deepSeekMode = iota
+	deepSeekThinking
+	deepSeekToolCalls
+	deepSeekStart // nothing seen yet; the output may open with reasoning whose <think> the template filled in
+)
+
+// deepSeekMaxImplicitReasoning is how much leading content is held back
+// waiting for a </think> before it is passed on as ordinary content.
+const deepSeekMaxImplicitReasoning = 64 << 10
+
+// DeepSeekTransformer moves <think> sections of the content into
+// reasoning_content and turns DeepSeek tool call blocks into tool_calls.
+// Output that opens without <think> but later has </think> is reasoning
+// too, as R1 chat templates put the <think> in the prompt.
+type DeepSeekTransformer struct {
+	StreamTransformer
+	mode deepSeekMode
+	done bool // tool calls were emitted; later content is dropped
+}
+
+// NewDeepSeekTransformer creates a transformer for DeepSeek-R1 style output
+func NewDeepSeekTransformer() *DeepSeekTransformer {
+	return &DeepSeekTransformer{StreamTransformer: *NewStreamTransformer(), mode: deepSeekStart}
+}
+
+// parseDeepSeekToolCalls parses the inside of a tool calls block. Both the
+// R1 layout and the later one without the "function" type are accepted:
+//
+//	<｜tool▁call▁begin｜>function<｜tool▁sep｜>name\n```json\n{...}\n```<｜tool▁call▁end｜>
+//	<｜tool▁call▁begin｜>name<｜tool▁sep｜>{...}<｜tool▁call▁end｜>
+func parseDeepSeekToolCalls(block string) ([]FunctionCall, error) {
+	var calls []FunctionCall
+	for _, part := range strings.Split(block, deepSeekCallBegin)[1:] {
+		part, _, _ = strings.Cut(part, deepSeekCallEnd)
+		head, rest, ok := strings.Cut(part, deepSeekSep)
+		if !ok {
+			return nil, fmt.Errorf("tool call without separator: %q", part)
+		}
+		name, args := strings.TrimSpace(head), strings.TrimSpace(rest)
+		if name == "function" {
+			name, args, _ = strings.Cut(args, "\n")
+			name = strings.TrimSpace(name)
+			args = strings.TrimSpace(args)
+		}
+		args = strings.TrimPrefix(args, "```json")
+		args = strings.TrimSuffix(strings.TrimPrefix(args, "```"), "```")
+		args = strings.TrimSpace(args)
+		if name == "" {
+			return nil, fmt.Errorf("tool call without name")
+		}
+		if args == "" {
+			args = "{}"
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(args)); err != nil {
+			return nil, fmt.Errorf("tool call %s has invalid arguments: %w", name, err)
+		}
+		calls = append(calls, FunctionCall{Name: name, Arguments: compact.String()})
+	}
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("empty tool calls block")
+	}
+	return calls, nil
+}
+
+// TransformLine processes a single SSE line and returns transformed lines
+func (t *DeepSeekTransformer) TransformLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "data: [DONE]" {
+		return append(append(t.flushHeld(), t.flushFinish()...), line), nil
+	}
+	if line == "" || !strings.HasPrefix(line, "data: ") {
+		return []string{line}, nil
+	}
+	var chunk ChatCompletionChunk
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, nil
+	}
+	t.lastChunk = &chunk
+	if len(chunk.Choices) == 0 {
+		return []string{line}, nil
+	}
+	if t.done {
+		if chunk.Choices[0].FinishReason != nil {
+			t.calledTools = false
+			return []string{deriveFinishChunk(line, "", true)}, nil
+		}
+		return nil, nil
+	}
+
+	choice := chunk.Choices[0]
+	content := choice.Delta.Content
+	finish := choice.FinishReason
+	if t.held == "" && content == "" && finish == nil {
+		// e.g. the opening chunk with the role
+		return []string{line}, nil
+	}
+	if t.mode == deepSeekText && t.held == "" && !strings.Contains(content, deepSeekThinkStart) && !strings.Contains(content, deepSeekCallsBegin) &&
+		(finish != nil || partialDeepSeekTag(content) == 0) {
+		return []string{line}, nil
+	}
+	t.logprobs = choice.Logprobs
+	// a tail held back from the last chunk belongs to the current mode
+	content = t.held + content
+	t.held = ""
+
+	var text, reasoning strings.Builder
+	var calls []FunctionCall
+	for content != "" {
+		switch t.mode {
+		case deepSeekStart:
+			end := strings.Index(content, deepSeekThinkEnd)
+			think := strings.Index(content, deepSeekThinkStart)
+			tools := strings.Index(content, deepSeekCallsBegin)
+			switch {
+			case end >= 0 && (think < 0 || end < think) && (tools < 0 || end < tools):
+				reasoning.WriteString(content[:end])
+				content = content[end+len(deepSeekThinkEnd):]
+				t.mode = deepSeekText
+			case think >= 0 || tools >= 0 || finish != nil || len(content) > deepSeekMaxImplicitReasoning:
+				t.mode = deepSeekText
+			default:
+				t.held = content
+				content = ""
+			}
+		case deepSeekThinking:
+			before, after, found := strings.Cut(content, deepSeekThinkEnd)
+			if !found && finish == nil {
+				n := partialTagSuffix(before, deepSeekThinkEnd)
+				before, t.held = before[:len(before)-n], before[len(before)-n:]
+			}
+			reasoning.WriteString(before)
+			content = after
+			if found {
+				t.mode = deepSeekText
+			}
+		case deepSeekToolCalls:
+			t.buffer.WriteString(content)
+			content = ""
+			block, after, found := strings.Cut(t.buffer.String(), deepSeekCallsEnd)
+			if !found {
+				break
+			}
+			t.buffer.Reset()
+			t.mode = deepSeekText
+			parsed, err := parseDeepSeekToolCalls(block)
+			if err == nil {
+				parsed, err = t.checkCalls(parsed)
+				if t.schemaMode != SchemaStrict {
+					err = nil
+				}
+			}
+			if err != nil {
+				Logf("TOOLCALLFIX: failed to parse DeepSeek tool calls, returning as regular content: %v", err)
+				text.WriteString(block + deepSeekCallsEnd)
+			} else {
+				calls = append(calls, parsed...)
+			}
+			content = after
+		default:
+			think := strings.Index(content, deepSeekThinkStart)
+			tools := strings.Index(content, deepSeekCallsBegin)
+			switch {
+			case think >= 0 && (tools < 0 || think < tools):
+				text.WriteString(content[:think])
+				content = content[think+len(deepSeekThinkStart):]
+				t.mode = deepSeekThinking
+			case tools >= 0:
+				text.WriteString(content[:tools])
+				t.buffer.WriteString(deepSeekCallsBegin)
+				content = content[tools+len(deepSeekCallsBegin):]
+				t.mode = deepSeekToolCalls
+			default:
+				n := 0
+				if finish == nil {
+					n = partialDeepSeekTag(content)
+				}
+				text.WriteString(content[:len(content)-n])
+				t.held = content[len(content)-n:]
+				content = ""
+			}
+		}
+	}
+
+	if finish != nil && t.mode == deepSeekToolCalls {
+		// the stream ended inside an unterminated block; hand it back as text
+		text.WriteString(t.buffer.String())
+		t.buffer.Reset()
+		t.mode = deepSeekText
+	}
+
+	var out []string
+	emit := func(c ChatCompletionChunk) {
+		if len(out) > 0 {
+			out = append(out, "") // each chunk is its own SSE event
+		}
+		out = append(out, marshalChunk(c))
+	}
+	if text.Len() > 0 || reasoning.Len() > 0 {
+		c := t.createContentChunk(text.String(), nil)
+		if reasoning.Len() > 0 {
+			r := reasoning.String()
+			c.Choices[0].Delta.ReasoningContent = &r
+		}
+		emit(c)
+	}
+	for _, call := range calls {
+		Logf("TOOLCALLFIX: successfully transformed DeepSeek tool call - name: %s, arguments: %s", call.Name, call.Arguments)
+		c := t.createToolCallChunk(call)
+		emit(c)
+		t.toolCallIndex++
+		t.calledTools = true
+		t.done = true
+	}
+	if finish != nil {
+		// keep the upstream's finish chunk with its logprobs and stop_reason
+		if len(out) > 0 {
+			out = append(out, "")
+		}
+		out = append(out, deriveChunk(line, "", t.calledTools, t.takeLogprobs() == nil))
+		t.calledTools = false
+	}
+	if len(out) == 0 {
+		// keep the stream alive while buffering
+		return t.createEmptyContentChunks(), nil
+	}
+	return out, nil
+}
+
+// partialDeepSeekTag returns the length of the tail of content that may be
+// the start of a <think> or tool calls tag split across chunks.
+func partialDeepSeekTag(content string) int {
+	return max(partialTagSuffix(content, deepSeekThinkStart), partialTagSuffix(content, deepSeekCallsBegin))
+}
+
+// flushHeld returns held content when the stream ends without a finish
+// chunk, as reasoning when it was held inside a <think> section.
+func (t *DeepSeekTransformer) flushHeld() []string {
+	if t.mode != deepSeekThinking || t.held == "" || t.lastChunk == nil {
+		return t.StreamTransformer.flushHeld()
+	}
+	c := t.createContentChunk("", nil)
+	r := t.held
+	c.Choices[0].Delta.ReasoningContent = &r
+	t.held = ""
+	return []string{marshalChunk(c), ""}
+}
+
+func marshalChunk(chunk ChatCompletionChunk) string {
+	b, _ := json.Marshal(chunk)
+	return "data: " + string(b)
+}
@@ -0,0 +1,204 @@
+package toolcallfix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func deepSeekStream(pieces ...string) string {
+	var b strings.Builder
+	for _, p := range pieces {
+		content, _ := json.Marshal(p)
+		fmt.Fprintf(&b, `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"deepseek-r1","choices":[{"index":0,"delta":{"content":%s},"finish_reason":null}]}`+"\n\n", content)
+	}
+	b.WriteString(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"deepseek-r1","choices":[{"index":0,"delta":{"content":""},"finish_reason":"stop"}]}` + "\n\n")
+	b.WriteString("data: [DONE]\n")
+	return b.String()
+}
+
+// collectDeepSeek runs a stream through the transformer and gathers the
+// content, reasoning, tool calls and finish reasons it produced.
+func collectDeepSeek(t *testing.T, input string) (content, reasoning string, calls []FunctionCall, finishes []string) {
+	t.Helper()
+	return collectDeepSeekWith(t, NewDeepSeekTransformer(), input)
+}
+
+func collectDeepSeekWith(t *testing.T, transformer *DeepSeekTransformer, input string) (content, reasoning string, calls []FunctionCall, finishes []string) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := TransformStreamWith(transformer, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("TransformStreamWith() failed: %v", err)
+	}
+	prev := ""
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(prev, "data: ") && strings.HasPrefix(line, "data: ") {
+			t.Fatalf("chunks not separated into events:\n%s\n%s", prev, line)
+		}
+		prev = line
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, c := range chunk.Choices {
+			content += c.Delta.Content
+			if c.Delta.ReasoningContent != nil {
+				reasoning += *c.Delta.ReasoningContent
+			}
+			for _, tc := range c.Delta.ToolCalls {
+				calls = append(calls, tc.Function)
+			}
+			if c.FinishReason != nil {
+				finishes = append(finishes, *c.FinishReason)
+			}
+		}
+	}
+	return content, reasoning, calls, finishes
+}
+
+func TestDeepSeekTransformer_ReasoningAndToolCalls(t *testing.T) {
+	input := deepSeekStream(
+		"<think>", "Need the", " weather.", "</think>", "Checking.",
+		"<｜tool▁calls▁begin｜>", "<｜tool▁call▁begin｜>", "function", "<｜tool▁sep｜>",
+		"get_weather\n```json\n", `{"city": "Tokyo"}`, "\n```", "<｜tool▁call▁end｜>",
+		"<｜tool▁call▁begin｜>", "get_time", "<｜tool▁sep｜>", `{"tz":"JST"}`, "<｜tool▁call▁end｜>",
+		"<｜tool▁calls▁end｜>",
+	)
+	content, reasoning, calls, finishes := collectDeepSeek(t, input)
+
+	if reasoning != "Need the weather." {
+		t.Errorf("reasoning = %q", reasoning)
+	}
+	if content != "Checking." {
+		t.Errorf("content = %q", content)
+	}
+	want := []FunctionCall{{Name: "get_weather", Arguments: `{"city":"Tokyo"}`}, {Name: "get_time", Arguments: `{"tz":"JST"}`}}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("tool calls = %v, want %v", calls, want)
+	}
+	// the upstream's "stop" is reported as tool_calls
+	if len(finishes) != 1 || finishes[0] != "tool_calls" {
+		t.Errorf("finish reasons = %v, want [tool_calls]", finishes)
+	}
+}
+
+func TestDeepSeekTransformer_TagsInsideChunk(t *testing.T) {
+	input := deepSeekStream("<think>plan</think>Hello", " world")
+	content, reasoning, calls, finishes := collectDeepSeek(t, input)
+	if reasoning != "plan" || content != "Hello world" || len(calls) != 0 {
+		t.Errorf("reasoning = %q, content = %q, calls = %v", reasoning, content, calls)
+	}
+	if len(finishes) != 1 || finishes[0] != "stop" {
+		t.Errorf("finish reasons = %v, want [stop]", finishes)
+	}
+}
+
+func TestDeepSeekTransformer_ImplicitReasoning(t *testing.T) {
+	// the template filled in <think>, so the output opens with reasoning
+	content, reasoning, _, _ := collectDeepSeek(t, deepSeekStream("Need", " a plan.", "</think>", "\n\nHello"))
+	if reasoning != "Need a plan." || content != "\n\nHello" {
+		t.Errorf("reasoning = %q, content = %q", reasoning, content)
+	}
+
+	// without any think tag the content is released when the stream ends
+	content, reasoning, _, finishes := collectDeepSeek(t, deepSeekStream("Hello", " world"))
+	if reasoning != "" || content != "Hello world" || len(finishes) != 1 {
+		t.Errorf("reasoning = %q, content = %q, finishes = %v", reasoning, content, finishes)
+	}
+
+	// a tool call block before any </think> is not reasoning
+	content, reasoning, calls, _ := collectDeepSeek(t, deepSeekStream("Checking.", "<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>"))
+	if reasoning != "" || content != "Checking." || len(calls) != 1 {
+		t.Errorf("reasoning = %q, content = %q, calls = %v", reasoning, content, calls)
+	}
+}
+
+func TestDeepSeekTransformer_SplitTags(t *testing.T) {
+	input := deepSeekStream(
+		"<th", "ink>plan</th", "ink>Sure.<｜tool▁calls",
+		"▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>",
+	)
+	content, reasoning, calls, _ := collectDeepSeek(t, input)
+	if reasoning != "plan" || content != "Sure." || fmt.Sprint(calls) != "[{search {}}]" {
+		t.Errorf("reasoning = %q, content = %q, calls = %v", reasoning, content, calls)
+	}
+
+	// text that only looks like the start of a tag is released unchanged
+	content, _, _, _ = collectDeepSeek(t, deepSeekStream("<think></think>a <", "b", " <th"))
+	if content != "a <b <th" {
+		t.Errorf("content = %q", content)
+	}
+
+	// held reasoning is not lost when the stream ends without a finish chunk
+	stream := deepSeekStream("<think>hmm</")
+	stream = stream[:strings.LastIndex(stream, "data: {")] + "data: [DONE]\n"
+	_, reasoning, _, _ = collectDeepSeek(t, stream)
+	if reasoning != "hmm</" {
+		t.Errorf("reasoning = %q", reasoning)
+	}
+}
+
+func TestDeepSeekTransformer_InvalidToolCall(t *testing.T) {
+	block := "<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{not json<｜tool▁call▁end｜><｜tool▁calls▁end｜>"
+	content, _, calls, _ := collectDeepSeek(t, deepSeekStream(block))
+	if len(calls) != 0 || content != block {
+		t.Errorf("content = %q, calls = %v; want the block returned as content", content, calls)
+	}
+}
+
+func TestDeepSeekTransformer_UnterminatedBlock(t *testing.T) {
+	content, _, calls, finishes := collectDeepSeek(t, deepSeekStream("Hi", "<｜tool▁calls▁begin｜>", "<｜tool▁call▁begin｜>search"))
+	if len(calls) != 0 || content != "Hi<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search" {
+		t.Errorf("content = %q, calls = %v", content, calls)
+	}
+	if len(finishes) != 1 || finishes[0] != "stop" {
+		t.Errorf("finish reasons = %v, want [stop]", finishes)
+	}
+}
+
+func TestDeepSeekTransformer_KeepsFinishMetadata(t *testing.T) {
+	input := strings.Replace(deepSeekStream("<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>"),
+		`"finish_reason":"stop"`, `"finish_reason":"stop","logprobs":{"content":[]},"stop_reason":"Observation:"`, 1)
+	var out bytes.Buffer
+	if err := TransformStreamWith(NewDeepSeekTransformer(), strings.NewReader(input), &out); err != nil {
+		t.Fatalf("TransformStreamWith() failed: %v", err)
+	}
+	for _, want := range []string{`"finish_reason":"tool_calls"`, `"logprobs":{"content":[]}`, `"stop_reason":"Observation:"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %s:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDeepSeekTransformer_KeepsLogprobs(t *testing.T) {
+	chunk := func(content, finish string) string {
+		c, _ := json.Marshal(content)
+		return fmt.Sprintf(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"deepseek-r1","choices":[{"index":0,"delta":{"content":%s},"logprobs":{"content":[{"token":%s,"logprob":-0.25}]},"finish_reason":%s}]}`, c, c, finish)
+	}
+	lines := []string{
+		chunk("<think>", "null"), chunk("hmm", "null"), chunk("</think>", "null"), chunk("Sure.", "null"),
+		chunk("<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>", `"stop"`),
+		"data: [DONE]",
+	}
+	want := "<think>hmm</think>Sure.<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>search<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>"
+	if got := logprobTokens(t, NewDeepSeekTransformer(), lines); got != want {
+		t.Errorf("logprobs carry %q, want %q", got, want)
+	}
+}
+
+func TestNewTransformer(t *testing.T) {
+	for _, format := range []string{"", FormatGLM, FormatHermes, FormatDeepSeek} {
+		if _, err := NewTransformer(format); err != nil {
+			t.Errorf("NewTransformer(%q) failed: %v", format, err)
+		}
+	}
+	if _, err := NewTransformer("mistral"); err == nil {
+		t.Error("NewTransformer(\"mistral\") succeeded, want error")
+	}
+}
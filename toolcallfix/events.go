@@ -0,0 +1,85 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Event is one choice of a transformed chunk, decoded for consumers that
+// observe a stream in-process instead of parsing its SSE output
+type Event struct {
+	ID           string
+	Model        string
+	Index        int        // choice index
+	Content      string     // content delta
+	Reasoning    string     // reasoning_content delta
+	ToolCalls    []ToolCall // tool calls in this chunk; with SetStreamArgs, deltas sharing an Index
+	FinishReason string     // empty until the choice finishes
+	Usage        *Usage     // set on the usage chunk, which has no choices
+	Done         bool       // the stream ended with [DONE]; no other field is set
+}
+
+// EventFunc receives the events of a stream in order
+type EventFunc func(Event)
+
+// EventChannel returns an EventFunc that sends every event on ch. The
+// transformer blocks until each event is received, so ch must be drained
+// for the stream to make progress.
+func EventChannel(ch chan<- Event) EventFunc {
+	return func(e Event) { ch <- e }
+}
+
+// observer calls an EventFunc for every chunk the wrapped transformer emits
+type observer struct {
+	LineTransformer
+	fn EventFunc
+}
+
+// Observe wraps transformer so that fn sees each chunk it emits, after tool
+// calls have been rewritten. Lines that are not JSON chunks produce no event.
+func Observe(transformer LineTransformer, fn EventFunc) LineTransformer {
+	return &observer{LineTransformer: transformer, fn: fn}
+}
+
+func (o *observer) TransformLine(line string) ([]string, error) {
+	out, err := o.LineTransformer.TransformLine(line)
+	if err != nil {
+		return out, err
+	}
+	for _, l := range out {
+		data, ok := strings.CutPrefix(l, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			o.fn(Event{Done: true})
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if json.Unmarshal([]byte(data), &chunk) != nil {
+			continue
+		}
+		if len(chunk.Choices) == 0 && chunk.Usage != nil {
+			o.fn(Event{ID: chunk.ID, Model: chunk.Model, Usage: chunk.Usage})
+			continue
+		}
+		for _, c := range chunk.Choices {
+			e := Event{
+				ID:        chunk.ID,
+				Model:     chunk.Model,
+				Index:     c.Index,
+				Content:   c.Delta.Content,
+				ToolCalls: c.Delta.ToolCalls,
+				Usage:     chunk.Usage,
+			}
+			if c.Delta.ReasoningContent != nil {
+				e.Reasoning = *c.Delta.ReasoningContent
+			}
+			if c.FinishReason != nil {
+				e.FinishReason = *c.FinishReason
+			}
+			o.fn(e)
+		}
+	}
+	return out, nil
+}
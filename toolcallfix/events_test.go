@@ -0,0 +1,89 @@
+package toolcallfix
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const observedStream = `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"","reasoning_content":"thinking"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"Searching."},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"<tool_call>search<arg_key>q</arg_key><arg_value>go</arg_value></tool_call>"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":""},"finish_reason":"stop"}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"glm-4.7","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":5,"total_tokens":8}}
+
+data: [DONE]
+
+`
+
+func TestObserve(t *testing.T) {
+	var events []Event
+	transformer := Observe(NewStreamTransformer(), func(e Event) { events = append(events, e) })
+	var out strings.Builder
+	if err := TransformStreamWith(transformer, strings.NewReader(observedStream), &out); err != nil {
+		t.Fatalf("TransformStreamWith() failed: %v", err)
+	}
+
+	var content, reasoning, finish string
+	var calls []ToolCall
+	var usage *Usage
+	for _, e := range events[:len(events)-1] {
+		if e.Model != "glm-4.7" || e.ID != "c1" {
+			t.Errorf("event %+v lacks the chunk's id and model", e)
+		}
+		content += e.Content
+		reasoning += e.Reasoning
+		calls = append(calls, e.ToolCalls...)
+		if e.FinishReason != "" {
+			finish = e.FinishReason
+		}
+		if e.Usage != nil {
+			usage = e.Usage
+		}
+	}
+	if content != "Searching." || reasoning != "thinking" {
+		t.Errorf("content = %q, reasoning = %q", content, reasoning)
+	}
+	if len(calls) != 1 || calls[0].Function.Name != "search" || calls[0].Function.Arguments != `{"q":"go"}` {
+		t.Errorf("tool calls = %+v", calls)
+	}
+	if finish != "tool_calls" {
+		t.Errorf("finish reason = %q, want tool_calls", finish)
+	}
+	if usage == nil || usage.TotalTokens != 8 {
+		t.Errorf("usage = %+v", usage)
+	}
+	if last := events[len(events)-1]; !last.Done {
+		t.Errorf("last event = %+v, want Done", last)
+	}
+
+	// the output is the same as without an observer, up to tool call ids
+	var plain strings.Builder
+	_ = TransformStreamWith(NewStreamTransformer(), strings.NewReader(observedStream), &plain)
+	ids := regexp.MustCompile(`chatcmpl-tool-[^"]*`)
+	if ids.ReplaceAllString(out.String(), "") != ids.ReplaceAllString(plain.String(), "") {
+		t.Errorf("observed output differs:\n%s\nwant:\n%s", out.String(), plain.String())
+	}
+}
+
+func TestEventChannel(t *testing.T) {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		_ = TransformStreamWith(Observe(NewStreamTransformer(), EventChannel(ch)), strings.NewReader(observedStream), io.Discard)
+	}()
+	var n int
+	var done bool
+	for e := range ch {
+		n++
+		done = e.Done
+	}
+	if n != 6 || !done {
+		t.Errorf("got %d events ending with done=%v, want 6 ending with [DONE]", n, done)
+	}
+}
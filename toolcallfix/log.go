@@ -0,0 +1,8 @@
+package toolcallfix
+
+import "log"
+
+// Logf receives the package's diagnostic output: the lines it transforms
+// and every tool call it parses or rejects. It defaults to log.Printf; the
+// relay routes it to its toolcallfix verbose scope.
+var Logf = log.Printf
@@ -0,0 +1,185 @@
+package toolcallfix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Schema modes accepted by SetSchemaMode
+const (
+	SchemaCoerce = "coerce" // convert argument types, keep calls that still do not fit (default)
+	SchemaStrict = "strict" // convert argument types, return calls that do not fit as content
+)
+
+// toolSchema is the part of a tool's parameters schema calls are checked against
+type toolSchema struct {
+	props    map[string]any
+	required []string
+}
+
+// toolSchemas holds the request's tools by function name
+type toolSchemas map[string]*toolSchema
+
+// props returns the declared properties of a tool, or nil
+func (s toolSchemas) props(name string) map[string]any {
+	if ts := s[name]; ts != nil {
+		return ts.props
+	}
+	return nil
+}
+
+// ToolsSetter is implemented by transformers that check tool calls against
+// the request's tools
+type ToolsSetter interface {
+	SetTools(tools json.RawMessage) error
+	SetSchemaMode(mode string) error
+}
+
+// SetTools gives the transformer the request's tools (the OpenAI "tools"
+// array). Emitted calls are then checked against the declared function
+// names and parameter schemas, and argument values are converted to the
+// declared types; see SetSchemaMode for calls that still do not fit.
+func (t *StreamTransformer) SetTools(tools json.RawMessage) error {
+	var list []struct {
+		Function struct {
+			Name       string `json:"name"`
+			Parameters struct {
+				Properties map[string]any `json:"properties"`
+				Required   []string       `json:"required"`
+			} `json:"parameters"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(tools, &list); err != nil {
+		return fmt.Errorf("invalid tools: %w", err)
+	}
+	t.schemas = toolSchemas{}
+	for _, tool := range list {
+		if tool.Function.Name != "" {
+			t.schemas[tool.Function.Name] = &toolSchema{
+				props:    tool.Function.Parameters.Properties,
+				required: tool.Function.Parameters.Required,
+			}
+		}
+	}
+	return nil
+}
+
+// SetSchemaMode sets what happens to tool calls that do not fit the tools
+// given to SetTools
+func (t *StreamTransformer) SetSchemaMode(mode string) error {
+	switch mode {
+	case "", SchemaCoerce, SchemaStrict:
+		t.schemaMode = mode
+		return nil
+	}
+	return fmt.Errorf("unknown toolcallfix schema mode %q", mode)
+}
+
+// checkCalls converts the arguments of calls to their declared types and
+// reports the first call that names an unknown function, lacks a required
+// argument or has a value that cannot be converted. Without tools every
+// call passes unchanged.
+func (t *StreamTransformer) checkCalls(calls []FunctionCall) ([]FunctionCall, error) {
+	if t.schemas == nil {
+		return calls, nil
+	}
+	var firstErr error
+	out := make([]FunctionCall, len(calls))
+	for i, call := range calls {
+		checked, err := t.schemas.check(call)
+		if err != nil {
+			Logf("TOOLCALLFIX: tool call %s does not match the request tools: %v", call.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		out[i] = checked
+	}
+	return out, firstErr
+}
+
+func (s toolSchemas) check(call FunctionCall) (FunctionCall, error) {
+	ts, ok := s[call.Name]
+	if !ok {
+		return call, fmt.Errorf("unknown function %q", call.Name)
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(call.Arguments)))
+	dec.UseNumber()
+	var args map[string]any
+	if err := dec.Decode(&args); err != nil || args == nil {
+		return call, fmt.Errorf("arguments are not a JSON object")
+	}
+
+	var err error
+	changed := false
+	for key, v := range args {
+		prop, _ := ts.props[key].(map[string]any)
+		types := schemaTypes(prop)
+		if types == nil || slices.ContainsFunc(types, func(typ string) bool { return isJSONType(v, typ) }) {
+			continue
+		}
+		nv, ok := convertJSON(v, types)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("argument %q is not of type %v", key, types)
+			}
+			continue
+		}
+		args[key] = nv
+		changed = true
+	}
+	for _, key := range ts.required {
+		if _, ok := args[key]; !ok && err == nil {
+			err = fmt.Errorf("missing required argument %q", key)
+		}
+	}
+	if changed {
+		b, _ := json.Marshal(args)
+		call.Arguments = string(b)
+	}
+	return call, err
+}
+
+// convertJSON converts v to the first of types it can be converted to:
+// strings to numbers, booleans, null or JSON-encoded objects and arrays,
+// and numbers or booleans to strings
+func convertJSON(v any, types []string) (any, bool) {
+	for _, typ := range types {
+		switch v := v.(type) {
+		case string:
+			if nv, ok := asType(v, typ); ok {
+				return nv, true
+			}
+		case json.Number, bool:
+			if typ == "string" {
+				return fmt.Sprint(v), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isJSONType reports whether a decoded value is of the JSON Schema type typ
+func isJSONType(v any, typ string) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number:
+		if typ == "integer" {
+			_, err := v.Int64()
+			return err == nil
+		}
+		return typ == "number"
+	case map[string]any:
+		return typ == "object"
+	case []any:
+		return typ == "array"
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const schemaTools = `[
+	{"type":"function","function":{"name":"grep","parameters":{"type":"object","required":["pattern"],"properties":{
+		"pattern":{"type":"string"},"max":{"type":"integer"},"ignore_case":{"type":"boolean"},
+		"paths":{"type":"array"},"opts":{"type":["object","null"]}}}}},
+	{"type":"function","function":{"name":"now"}}
+]`
+
+func TestToolSchemasCheck(t *testing.T) {
+	transformer := NewStreamTransformer()
+	if err := transformer.SetTools(json.RawMessage(schemaTools)); err != nil {
+		t.Fatalf("SetTools() failed: %v", err)
+	}
+	tests := []struct {
+		call    FunctionCall
+		want    string // arguments after conversion
+		wantErr string
+	}{
+		{FunctionCall{"grep", `{"pattern":"x","max":3}`}, `{"pattern":"x","max":3}`, ""},
+		{FunctionCall{"grep", `{"pattern":404,"max":"3","ignore_case":"TRUE","paths":"[\"a\"]","opts":null}`}, `{"ignore_case":true,"max":3,"opts":null,"paths":["a"],"pattern":"404"}`, ""},
+		{FunctionCall{"now", `{"tz":"UTC"}`}, `{"tz":"UTC"}`, ""},
+		{FunctionCall{"grep", `{"max":3}`}, `{"max":3}`, `missing required argument "pattern"`},
+		{FunctionCall{"grep", `{"pattern":"x","max":"many"}`}, `{"pattern":"x","max":"many"}`, `argument "max" is not of type [integer]`},
+		{FunctionCall{"grep", `{"pattern":"x","max":2.5}`}, `{"pattern":"x","max":2.5}`, `argument "max"`},
+		{FunctionCall{"grep", `["x"]`}, `["x"]`, "not a JSON object"},
+		{FunctionCall{"find", `{}`}, `{}`, `unknown function "find"`},
+	}
+	for _, tt := range tests {
+		got, err := transformer.checkCalls([]FunctionCall{tt.call})
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkCalls(%v) error = %v, want %q", tt.call, err, tt.wantErr)
+		}
+		if got[0].Arguments != tt.want {
+			t.Errorf("checkCalls(%v) arguments = %s, want %s", tt.call, got[0].Arguments, tt.want)
+		}
+	}
+
+	if err := transformer.SetSchemaMode("lenient"); err == nil {
+		t.Error("SetSchemaMode(\"lenient\") succeeded, want error")
+	}
+}
+
+func TestStreamTransformer_SchemaMode(t *testing.T) {
+	pieces := []string{
+		`<tool_call>{"name":"grep","arguments":{"pattern":"x","max":"5"}}</tool_call>`,
+		`<tool_call>find<arg_key>name</arg_key><arg_value>a.go</arg_value></tool_call>`,
+	}
+	for _, tt := range []struct {
+		mode    string
+		calls   string
+		content string
+	}{
+		{SchemaCoerce, `[{grep {"max":5,"pattern":"x"}} {find {"name":"a.go"}}]`, ""},
+		{SchemaStrict, `[{grep {"max":5,"pattern":"x"}}]`, pieces[1]},
+	} {
+		transformer := NewStreamTransformer()
+		_ = transformer.SetTools(json.RawMessage(schemaTools))
+		if err := transformer.SetSchemaMode(tt.mode); err != nil {
+			t.Fatalf("SetSchemaMode(%q) failed: %v", tt.mode, err)
+		}
+		content, calls, _ := runTags(t, transformer, pieces...)
+		if got := fmtCalls(calls); got != tt.calls {
+			t.Errorf("%s: tool calls = %s, want %s", tt.mode, got, tt.calls)
+		}
+		if content != tt.content {
+			t.Errorf("%s: content = %q, want %q", tt.mode, content, tt.content)
+		}
+	}
+
+	// DeepSeek calls are checked the same way
+	transformer := NewDeepSeekTransformer()
+	_ = transformer.SetTools(json.RawMessage(schemaTools))
+	_ = transformer.SetSchemaMode(SchemaStrict)
+	content, _, _, _ := collectDeepSeekWith(t, transformer, deepSeekStream("<｜tool▁calls▁begin｜><｜tool▁call▁begin｜>find<｜tool▁sep｜>{}<｜tool▁call▁end｜><｜tool▁calls▁end｜>"))
+	if !strings.Contains(content, "find") {
+		t.Errorf("strict DeepSeek call to an unknown function: content = %q", content)
+	}
+}
+
+func fmtCalls(calls []FunctionCall) string {
+	parts := make([]string, len(calls))
+	for i, c := range calls {
+		parts[i] = "{" + c.Name + " " + c.Arguments + "}"
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,132 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ArgsStreamer is implemented by transformers that can stream the arguments
+// of a tool call while it is still arriving
+type ArgsStreamer interface {
+	SetStreamArgs(enabled bool)
+}
+
+// argStream is the state of a tool call whose arguments are being streamed
+type argStream struct {
+	started bool   // the chunk with the function name was emitted
+	sent    string // arguments emitted so far
+}
+
+// SetStreamArgs makes the transformer emit an XML format tool call as it
+// arrives, the way OpenAI streams tool calls: a chunk with the function
+// name once the first <arg_key> shows up, then `arguments` deltas. String
+// values are streamed as they grow; other values are sent once complete.
+// JSON bodies are still sent whole, and so is everything in strict schema
+// mode, where a call that does not fit has to be taken back.
+func (t *StreamTransformer) SetStreamArgs(enabled bool) {
+	t.streamArgs = enabled
+}
+
+// streamToolCall emits the part of the buffered tool call that is known so
+// far. With done set the buffer holds the whole call, which is closed off.
+func (t *StreamTransformer) streamToolCall(done bool) []string {
+	if !t.streamArgs || t.schemaMode == SchemaStrict {
+		return nil
+	}
+	inner := cutToolCallBody(t.buffer.String(), t.tags)
+	idx := strings.Index(inner, "<arg_key>")
+	if !t.args.started && (idx < 0 || t.tags.Body == BodyJSON || t.tags.Body == BodyAuto && isJSONBody(inner[:idx])) {
+		return nil
+	}
+	name := strings.TrimSpace(inner[:idx])
+	if name == "" {
+		return nil
+	}
+
+	var out []string
+	emit := func(chunk ChatCompletionChunk) {
+		chunkJSON, _ := json.Marshal(chunk)
+		if len(out) > 0 {
+			out = append(out, "")
+		}
+		out = append(out, fmt.Sprintf("data: %s", chunkJSON))
+	}
+	if !t.args.started {
+		t.args.started = true
+		Logf("TOOLCALLFIX: streaming tool call - name: %s", name)
+		emit(t.createToolCallChunk(FunctionCall{Name: name}))
+	}
+	args := xmlArgsPrefix(inner[idx:], t.schemas.props(name), done)
+	if delta, ok := strings.CutPrefix(args, t.args.sent); ok && delta != "" {
+		t.args.sent = args
+		emit(t.createToolCallChunkWith(ToolCall{Index: t.toolCallIndex, Function: FunctionCall{Arguments: delta}}))
+	}
+
+	if done {
+		Logf("TOOLCALLFIX: successfully streamed tool call - name: %s, arguments: %s", name, t.args.sent)
+		_, _ = t.checkCalls([]FunctionCall{{Name: name, Arguments: t.args.sent}})
+		t.args = argStream{}
+		t.toolCallIndex++
+		t.calledTools = true
+	}
+	return out
+}
+
+// xmlArgsPrefix converts the <arg_key>/<arg_value> pairs of s to as much of
+// a JSON object as is certain: complete values, and the part of a string
+// value seen so far. The result only ever grows as s does, so the
+// difference to the previous result is the next `arguments` delta. With done
+// set s is complete and the object is closed.
+func xmlArgsPrefix(s string, props map[string]any, done bool) string {
+	var b strings.Builder
+	b.WriteString("{")
+	open := false // a string value is still being written
+	for n := 0; ; n++ {
+		i := strings.Index(s, "<arg_key>")
+		if i < 0 {
+			break
+		}
+		key, rest, ok := strings.Cut(s[i+len("<arg_key>"):], "</arg_key>")
+		if !ok {
+			break
+		}
+		rest, ok = strings.CutPrefix(strings.TrimLeft(rest, " \t\r\n"), "<arg_value>")
+		if !ok {
+			break
+		}
+		key = strings.TrimSpace(key)
+		prop, _ := props[key].(map[string]any)
+		types := schemaTypes(prop)
+		value, rest, closed := cutArgValue(rest, done)
+		if !closed && !done && (len(types) == 0 || types[0] != "string") {
+			break // the type of the value is known once it is complete
+		}
+		if n > 0 {
+			b.WriteString(",")
+		}
+		keyJSON, _ := json.Marshal(key)
+		b.Write(keyJSON)
+		b.WriteString(":")
+		if !closed {
+			if !done {
+				// CDATA and entities may still change what follows
+				value = streamableValue(value)
+			}
+			valueJSON, _ := json.Marshal(value)
+			b.Write(valueJSON[:len(valueJSON)-1])
+			open = true
+			break
+		}
+		valueJSON, _ := json.Marshal(typedValue(decodeArgValue(value), types))
+		b.Write(valueJSON)
+		s = rest
+	}
+	if done {
+		if open {
+			b.WriteString(`"`)
+		}
+		b.WriteString("}")
+	}
+	return b.String()
+}
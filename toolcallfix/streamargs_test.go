@@ -0,0 +1,97 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStreamArgs(t *testing.T) {
+	transformer := NewStreamTransformer()
+	transformer.SetStreamArgs(true)
+	if err := transformer.SetTools(json.RawMessage(`[{"type":"function","function":{"name":"write","parameters":{"properties":{"path":{"type":"string"},"content":{"type":"string"}}}}}]`)); err != nil {
+		t.Fatal(err)
+	}
+	pieces := []string{
+		"Writing.<tool_call>write",
+		"<arg_key>path</arg_key><arg_value>a.go</arg_value>",
+		"<arg_key>mode</arg_key><arg_value>6",
+		"44</arg_value><arg_key>content</arg_key><arg_value>package ",
+		"main\n\"x\"</arg_",
+		"value></tool_call>",
+	}
+	content, calls, indexes := runTags(t, transformer, pieces...)
+	if content != "Writing." {
+		t.Errorf("content = %q", content)
+	}
+
+	// the name comes first, then the arguments piece by piece
+	var args []string
+	for i, call := range calls {
+		if indexes[i] != 0 {
+			t.Errorf("delta %d has index %d", i, indexes[i])
+		}
+		if (i == 0) != (call.Name == "write") {
+			t.Errorf("delta %d has name %q", i, call.Name)
+		}
+		if call.Arguments != "" {
+			args = append(args, call.Arguments)
+		}
+	}
+	want := []string{`{"path":"a.go"`, `,"mode":644,"content":"package `, `main\n\"x\"`, `"}`}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("argument deltas = %q, want %q", args, want)
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(strings.Join(args, "")), &parsed); err != nil || parsed["mode"] != 644.0 {
+		t.Errorf("arguments %q do not parse: %v", strings.Join(args, ""), err)
+	}
+}
+
+func TestStreamArgs_Fallbacks(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*StreamTransformer)
+		pieces  []string
+		content string
+		deltas  int
+	}{
+		{
+			name:   "json body is sent whole",
+			pieces: []string{`<tool_call>{"name":"ls",`, `"arguments":{"a":"<arg_key>"}}</tool_call>`},
+			deltas: 1,
+		},
+		{
+			name:   "strict schema mode is sent whole",
+			setup:  func(t *StreamTransformer) { _ = t.SetSchemaMode(SchemaStrict) },
+			pieces: []string{"<tool_call>ls<arg_key>a</arg_key>", "<arg_value>1</arg_value></tool_call>"},
+			deltas: 1,
+		},
+		{
+			name:   "stream ending inside a streamed call closes it",
+			pieces: []string{"<tool_call>ls<arg_key>a</arg_key><arg_value>x"},
+			deltas: 3,
+		},
+		{
+			name:    "stream ending before the first argument returns content",
+			pieces:  []string{"<tool_call>ls"},
+			content: "<tool_call>ls",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer := NewStreamTransformer()
+			transformer.SetStreamArgs(true)
+			if tt.setup != nil {
+				tt.setup(transformer)
+			}
+			content, calls, _ := runTags(t, transformer, tt.pieces...)
+			if content != tt.content {
+				t.Errorf("content = %q, want %q", content, tt.content)
+			}
+			if len(calls) != tt.deltas {
+				t.Errorf("got %d tool call deltas %v, want %d", len(calls), calls, tt.deltas)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package toolcallfix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tags describes the markup a model wraps each tool call in
+type Tags struct {
+	Start string `json:"start"`          // e.g. "<tool_call>" or "<|tool_call|>"
+	End   string `json:"end"`            // e.g. "</tool_call>" or "<|/tool_call|>"
+	Body  string `json:"body,omitempty"` // BodyAuto (default), BodyXML or BodyJSON
+}
+
+// Bodies accepted in Tags.Body
+const (
+	BodyAuto = "auto" // JSON when the body starts with { or [, else XML
+	BodyXML  = "xml"  // name<arg_key>k</arg_key><arg_value>v</arg_value>
+	BodyJSON = "json" // {"name": ..., "arguments": {...}} or a list of them
+)
+
+var (
+	glmTags    = Tags{Start: "<tool_call>", End: "</tool_call>", Body: BodyAuto}
+	hermesTags = Tags{Start: "<tool_call>", End: "</tool_call>", Body: BodyJSON}
+)
+
+// Validate reports tags the transformer cannot work with
+func (t Tags) Validate() error {
+	if t.Start == "" || t.End == "" {
+		return fmt.Errorf("toolcallfix tags need both start and end")
+	}
+	switch t.Body {
+	case "", BodyAuto, BodyXML, BodyJSON:
+	default:
+		return fmt.Errorf("unknown toolcallfix tag body %q", t.Body)
+	}
+	return nil
+}
+
+// FormatTags returns the tags the transformer NewTransformerWithTags(format,
+// tags) looks for, e.g. to tell a model how to write its calls
+func FormatTags(format string, tags *Tags) (Tags, error) {
+	if _, err := NewTransformerWithTags(format, tags); err != nil {
+		return Tags{}, err
+	}
+	switch {
+	case format == FormatDeepSeek:
+		return Tags{}, fmt.Errorf("toolcallfix format %q does not use tags", format)
+	case tags != nil:
+		t := *tags
+		if t.Body == "" {
+			t.Body = BodyAuto
+			if format == FormatHermes {
+				t.Body = BodyJSON
+			}
+		}
+		return t, nil
+	case format == FormatHermes:
+		return hermesTags, nil
+	}
+	return glmTags, nil
+}
+
+// Render writes call in the markup the tags describe, so that it parses
+// back to the same call. BodyAuto renders XML.
+func (t Tags) Render(call FunctionCall) string {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+		args = nil
+	}
+	var b strings.Builder
+	b.WriteString(t.Start)
+	if t.Body == BodyJSON {
+		if args == nil {
+			args = map[string]json.RawMessage{}
+		}
+		body, _ := json.Marshal(map[string]any{"name": call.Name, "arguments": args})
+		fmt.Fprintf(&b, "\n%s\n", body)
+	} else {
+		b.WriteString(call.Name)
+		keys := make([]string, 0, len(args))
+		for k := range args {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value := string(args[k])
+			var s string
+			if json.Unmarshal(args[k], &s) == nil {
+				value = s
+			}
+			fmt.Fprintf(&b, "\n<arg_key>%s</arg_key>\n<arg_value>%s</arg_value>", k, t.xmlArgValue(value))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(t.End)
+	return b.String()
+}
+
+// xmlArgValue wraps a value holding markup, an entity or the end tag in a
+// CDATA section, splitting any "]]>" in it across two sections.
+func (t Tags) xmlArgValue(value string) string {
+	if !strings.ContainsAny(value, "<&") && !strings.Contains(value, t.End) {
+		return value
+	}
+	return cdataStart + strings.ReplaceAll(value, cdataEnd, "]]"+cdataEnd+cdataStart+">") + cdataEnd
+}
+
+// jsonToolCall is one call in a JSON body. Some models name the arguments
+// "parameters", some send them as a JSON-encoded string, and some copy the
+// OpenAI shape with the call under "function".
+type jsonToolCall struct {
+	Name       string          `json:"name"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Parameters json.RawMessage `json:"parameters"`
+	Function   *jsonToolCall   `json:"function"`
+}
+
+// stripCodeFence removes a Markdown code fence such as ```json ... ```
+// around a tool call body
+func stripCodeFence(body string) string {
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, "```") {
+		return body
+	}
+	// the info string ("json") runs up to the first newline or brace
+	body = strings.TrimLeft(body[3:], "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	body = strings.TrimSuffix(strings.TrimSpace(body), "```")
+	return strings.TrimSpace(body)
+}
+
+// isJSONBody reports whether a tool call body of BodyAuto holds JSON
+func isJSONBody(body string) bool {
+	body = stripCodeFence(body)
+	return strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[")
+}
+
+// parseJSONToolCalls parses a JSON body holding one call or a list of
+// calls, optionally inside a code fence. Arguments keep their JSON types.
+func parseJSONToolCalls(body string) ([]FunctionCall, error) {
+	body = stripCodeFence(body)
+	var list []jsonToolCall
+	if strings.HasPrefix(body, "[") {
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			return nil, fmt.Errorf("invalid tool call list: %w", err)
+		}
+	} else {
+		var one jsonToolCall
+		if err := json.Unmarshal([]byte(body), &one); err != nil {
+			return nil, fmt.Errorf("invalid tool call: %w", err)
+		}
+		list = append(list, one)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("empty tool call list")
+	}
+
+	calls := make([]FunctionCall, 0, len(list))
+	for _, c := range list {
+		if c.Name == "" && c.Function != nil {
+			c = *c.Function
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("tool call without name")
+		}
+		args := c.Arguments
+		if len(args) == 0 {
+			args = c.Parameters
+		}
+		var s string
+		if json.Unmarshal(args, &s) == nil {
+			args = json.RawMessage(s)
+		}
+		if len(bytes.TrimSpace(args)) == 0 || string(args) == "null" {
+			args = json.RawMessage("{}")
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, args); err != nil {
+			return nil, fmt.Errorf("tool call %s has invalid arguments: %w", c.Name, err)
+		}
+		calls = append(calls, FunctionCall{Name: c.Name, Arguments: compact.String()})
+	}
+	return calls, nil
+}
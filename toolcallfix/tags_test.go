@@ -0,0 +1,227 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runTags streams pieces through transformer and collects what comes out.
+func runTags(t *testing.T, transformer LineTransformer, pieces ...string) (content string, calls []FunctionCall, indexes []int) {
+	t.Helper()
+	var lines []string
+	for _, piece := range pieces {
+		c, _ := json.Marshal(piece)
+		lines = append(lines, fmt.Sprintf(`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"qwen3","choices":[{"index":0,"delta":{"content":%s},"finish_reason":null}]}`, c))
+	}
+	lines = append(lines,
+		`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"qwen3","choices":[{"index":0,"delta":{"content":""},"finish_reason":"stop"}]}`,
+		"data: [DONE]")
+	for _, line := range lines {
+		results, err := transformer.TransformLine(line)
+		if err != nil {
+			t.Fatalf("TransformLine() failed: %v", err)
+		}
+		for _, result := range results {
+			var c ChatCompletionChunk
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(result, "data: ")), &c); err != nil || len(c.Choices) == 0 {
+				continue
+			}
+			content += c.Choices[0].Delta.Content
+			for _, tc := range c.Choices[0].Delta.ToolCalls {
+				calls = append(calls, tc.Function)
+				indexes = append(indexes, tc.Index)
+			}
+		}
+	}
+	return content, calls, indexes
+}
+
+func TestStreamTransformer_Hermes(t *testing.T) {
+	transformer, err := NewTransformer(FormatHermes)
+	if err != nil {
+		t.Fatalf("NewTransformer() failed: %v", err)
+	}
+	content, calls, _ := runTags(t, transformer,
+		"Let me search.",
+		"<tool_call>\n",
+		`{"name": "search", "arguments": `,
+		`{"query": "test query", "limit": 5}}`,
+		"\n</tool_call>",
+	)
+	if content != "Let me search." {
+		t.Errorf("content = %q", content)
+	}
+	if fmt.Sprint(calls) != `[{search {"query":"test query","limit":5}}]` {
+		t.Errorf("tool calls = %v", calls)
+	}
+}
+
+func TestStreamTransformer_CustomTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		tags    Tags
+		pieces  []string
+		want    string
+		content string
+	}{
+		{
+			name:   "xml body in function_call",
+			tags:   Tags{Start: "<function_call>", End: "</function_call>"},
+			pieces: []string{"<function_call>", "grep<arg_key>pattern</arg_key><arg_value>x</arg_value>", "</function_call>"},
+			want:   `[{grep {"pattern":"x"}}]`,
+		},
+		{
+			name:   "json list in special tokens",
+			tags:   Tags{Start: "<|tool_call|>", End: "<|/tool_call|>", Body: BodyJSON},
+			pieces: []string{"<|tool_", `call|>[{"name":"a","arguments":"{\"x\":1}"},`, `{"name":"b","parameters":null}]<|/tool_call|>`},
+			want:   `[{a {"x":1}} {b {}}]`,
+		},
+		{
+			name:   "hermes defaults to a json body",
+			format: FormatHermes,
+			tags:   Tags{Start: "[TOOL]", End: "[/TOOL]"},
+			pieces: []string{`[TOOL]{"name":"ls","arguments":{}}[/TOOL]`},
+			want:   `[{ls {}}]`,
+		},
+		{
+			name:    "invalid json is returned as content",
+			tags:    Tags{Start: "<tool>", End: "</tool>", Body: BodyJSON},
+			pieces:  []string{`<tool>{"name":</tool>`},
+			content: `<tool>{"name":</tool>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := NewTransformerWithTags(tt.format, &tt.tags)
+			if err != nil {
+				t.Fatalf("NewTransformerWithTags() failed: %v", err)
+			}
+			content, calls, indexes := runTags(t, transformer, tt.pieces...)
+			if content != tt.content {
+				t.Errorf("content = %q, want %q", content, tt.content)
+			}
+			if tt.want != "" && fmt.Sprint(calls) != tt.want {
+				t.Errorf("tool calls = %v, want %s", calls, tt.want)
+			}
+			for i, index := range indexes {
+				if index != i {
+					t.Errorf("tool call %d has index %d", i, index)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTransformerWithTags_Invalid(t *testing.T) {
+	tests := []struct {
+		format string
+		tags   Tags
+		want   string
+	}{
+		{"", Tags{Start: "<tool_call>"}, "need both start and end"},
+		{"", Tags{Start: "<a>", End: "</a>", Body: "yaml"}, `unknown toolcallfix tag body "yaml"`},
+		{FormatDeepSeek, Tags{Start: "<a>", End: "</a>"}, `format "deepseek" does not take custom tags`},
+	}
+	for _, tt := range tests {
+		_, err := NewTransformerWithTags(tt.format, &tt.tags)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewTransformerWithTags(%q, %+v) error = %v, want %q", tt.format, tt.tags, err, tt.want)
+		}
+	}
+}
+
+func TestStreamTransformer_JSONBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces []string
+		want   string
+	}{
+		{
+			name:   "fenced json",
+			pieces: []string{"<tool_call>\n```json\n", `{"name":"grep","arguments":{"pattern":"TODO","paths":["a.go","b.go"],`, `"max":10,"opts":{"i":true,"ctx":null}}}`, "\n```\n</tool_call>"},
+			want:   `[{grep {"pattern":"TODO","paths":["a.go","b.go"],"max":10,"opts":{"i":true,"ctx":null}}}]`,
+		},
+		{
+			name:   "bare fence",
+			pieces: []string{"<tool_call>```", `{"name":"ls","arguments":{"all":false}}`, "```</tool_call>"},
+			want:   `[{ls {"all":false}}]`,
+		},
+		{
+			name:   "openai shape",
+			pieces: []string{`<tool_call>{"type":"function","function":{"name":"view","arguments":"{\"limit\": 5}"}}</tool_call>`},
+			want:   `[{view {"limit":5}}]`,
+		},
+		{
+			name:   "xml still parsed",
+			pieces: []string{"<tool_call>view<arg_key>path</arg_key><arg_value>{x}</arg_value></tool_call>"},
+			want:   `[{view {"path":"{x}"}}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, calls, _ := runTags(t, NewStreamTransformer(), tt.pieces...)
+			if content != "" {
+				t.Errorf("content = %q, want none", content)
+			}
+			if fmt.Sprint(calls) != tt.want {
+				t.Errorf("tool calls = %v, want %s", calls, tt.want)
+			}
+		})
+	}
+
+	// an explicit xml body never takes JSON
+	transformer, _ := NewTransformerWithTags(FormatGLM, &Tags{Start: "<tool_call>", End: "</tool_call>", Body: BodyXML})
+	_, calls, _ := runTags(t, transformer, `<tool_call>{"name":"ls"}</tool_call>`)
+	if len(calls) != 1 || calls[0].Name != `{"name":"ls"}` {
+		t.Errorf("xml body: tool calls = %v", calls)
+	}
+}
+
+func TestTagsRender(t *testing.T) {
+	call := FunctionCall{Name: "write", Arguments: `{"path":"a.go","lines":3,"opts":{"force":true}}`}
+	for _, format := range []string{FormatGLM, FormatHermes} {
+		tags, err := FormatTags(format, nil)
+		if err != nil {
+			t.Fatalf("FormatTags(%q) failed: %v", format, err)
+		}
+		transformer, _ := NewTransformer(format)
+		_, calls, _ := runTags(t, transformer, tags.Render(call))
+		if len(calls) != 1 || calls[0].Name != call.Name {
+			t.Fatalf("%s: rendered call parsed to %v", format, calls)
+		}
+		var got, want map[string]any
+		_ = json.Unmarshal([]byte(calls[0].Arguments), &got)
+		_ = json.Unmarshal([]byte(call.Arguments), &want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: arguments = %s, want %s", format, calls[0].Arguments, call.Arguments)
+		}
+	}
+
+	// values with markup survive XML bodies, whatever the end tag
+	code := map[string]string{"code": "if a < b && c {}</arg_value>\n<arg_key>x</arg_key></tool_call>", "end": "[/TOOL] ]]> &amp;"}
+	b, _ := json.Marshal(code)
+	call = FunctionCall{Name: "write", Arguments: string(b)}
+	for _, tags := range []Tags{glmTags, {Start: "[TOOL]", End: "[/TOOL]", Body: BodyXML}} {
+		transformer, _ := NewTransformerWithTags(FormatGLM, &tags)
+		_, calls, _ := runTags(t, transformer, tags.Render(call))
+		if len(calls) != 1 {
+			t.Fatalf("%s: rendered call parsed to %v", tags.Start, calls)
+		}
+		var got map[string]string
+		_ = json.Unmarshal([]byte(calls[0].Arguments), &got)
+		if fmt.Sprint(got) != fmt.Sprint(code) {
+			t.Errorf("%s: arguments = %s, want %s", tags.Start, calls[0].Arguments, call.Arguments)
+		}
+	}
+
+	tags, _ := FormatTags(FormatHermes, &Tags{Start: "[TOOL]", End: "[/TOOL]"})
+	if tags.Body != BodyJSON {
+		t.Errorf("hermes custom tags body = %q, want json", tags.Body)
+	}
+	if _, err := FormatTags(FormatDeepSeek, nil); err == nil {
+		t.Error("FormatTags(deepseek) succeeded")
+	}
+}
@@ -5,10 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"regexp"
-	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -25,12 +22,12 @@ type ChatCompletionChunk struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Delta        Delta   `json:"delta"`
-	Logprobs     *string `json:"logprobs"`
-	FinishReason *string `json:"finish_reason"`
-	StopReason   *int    `json:"stop_reason,omitempty"`
-	TokenIDs     *string `json:"token_ids"`
+	Index        int             `json:"index"`
+	Delta        Delta           `json:"delta"`
+	Logprobs     json.RawMessage `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+	StopReason   json.RawMessage `json:"stop_reason,omitempty"` // vLLM sends a token id or a stop string
+	TokenIDs     json.RawMessage `json:"token_ids"`
 }
 
 type Delta struct {
@@ -40,14 +37,14 @@ type Delta struct {
 }
 
 type ToolCall struct {
-	ID       string       `json:"id"`
-	Type     string       `json:"type"`
+	ID       string       `json:"id,omitempty"`   // only on the first chunk of a streamed call
+	Type     string       `json:"type,omitempty"` // only on the first chunk of a streamed call
 	Index    int          `json:"index"`
 	Function FunctionCall `json:"function"`
 }
 
 type FunctionCall struct {
-	Name      string `json:"name"`
+	Name      string `json:"name,omitempty"`
 	Arguments string `json:"arguments"`
 }
 
@@ -72,23 +69,46 @@ type ParsedToolCall struct {
 // StreamTransformer transforms streams with embedded tool calls in content
 // to proper OpenAI-style tool_calls format
 type StreamTransformer struct {
+	tags          Tags
 	buffer        strings.Builder
 	inToolCall    bool
 	lastChunk     *ChatCompletionChunk
 	toolCallIndex int
+	calledTools   bool        // tool calls were emitted and the finish chunk is still due
+	held          string      // content tail that may be the start of a split start tag
+	schemas       toolSchemas // nil until SetTools
+	schemaMode    string
+	streamArgs    bool
+	args          argStream       // the tool call being streamed, see SetStreamArgs
+	logprobs      json.RawMessage // logprobs of the upstream chunk being rewritten, until passed on
 }
 
-// NewStreamTransformer creates a new StreamTransformer
+// NewStreamTransformer creates a new StreamTransformer for GLM tool calls
 func NewStreamTransformer() *StreamTransformer {
-	return &StreamTransformer{}
+	return NewStreamTransformerWithTags(glmTags)
+}
+
+// NewStreamTransformerWithTags creates a StreamTransformer for tool calls
+// wrapped in tags
+func NewStreamTransformerWithTags(tags Tags) *StreamTransformer {
+	if tags.Body == "" {
+		tags.Body = BodyAuto
+	}
+	return &StreamTransformer{tags: tags}
 }
 
 // parseToolCallXML parses the XML format tool call into structured data
 // Format: <tool_call>name<arg_key>key1</arg_key><arg_value>value1</arg_value>...</tool_call>
+// Values may be wrapped in <![CDATA[...]]> or XML-escaped.
 func parseToolCallXML(xml string) (*ParsedToolCall, error) {
 	// Remove the outer tags
 	inner := strings.TrimPrefix(xml, "<tool_call>")
 	inner = strings.TrimSuffix(inner, "</tool_call>")
+	return parseXMLBody(inner)
+}
+
+// parseXMLBody parses what is between the tags of an XML format tool call
+func parseXMLBody(inner string) (*ParsedToolCall, error) {
 	inner = strings.TrimSpace(inner)
 
 	if inner == "" {
@@ -108,18 +128,31 @@ func parseToolCallXML(xml string) (*ParsedToolCall, error) {
 		argsSection = inner[argKeyIndex:]
 	}
 
-	// Parse arguments using (?s) flag to allow . to match newlines
+	// Values may hold code: see cutArgValue and decodeArgValue
 	var args []ToolCallArg
-	argKeyRe := regexp.MustCompile(`(?s)<arg_key>(.*?)</arg_key>\s*<arg_value>(.*?)</arg_value>`)
-	matches := argKeyRe.FindAllStringSubmatch(argsSection, -1)
-
-	for _, match := range matches {
-		if len(match) == 3 {
-			args = append(args, ToolCallArg{
-				Key:   strings.TrimSpace(match[1]), // 键名可以 TrimSpace
-				Value: match[2],                    // 值保持原样
-			})
+	for s := argsSection; ; {
+		i := strings.Index(s, "<arg_key>")
+		if i < 0 {
+			break
+		}
+		key, rest, ok := strings.Cut(s[i+len("<arg_key>"):], "</arg_key>")
+		if !ok {
+			break
+		}
+		s = rest
+		rest, ok = strings.CutPrefix(strings.TrimLeft(rest, " \t\r\n"), "<arg_value>")
+		if !ok {
+			continue
 		}
+		value, rest, ok := cutArgValue(rest, true)
+		if !ok {
+			break
+		}
+		args = append(args, ToolCallArg{
+			Key:   strings.TrimSpace(key), // 键名可以 TrimSpace
+			Value: decodeArgValue(value),  // 值保持原样
+		})
+		s = rest
 	}
 
 	return &ParsedToolCall{
@@ -128,40 +161,10 @@ func parseToolCallXML(xml string) (*ParsedToolCall, error) {
 	}, nil
 }
 
-// argsToJSON converts tool call arguments to JSON string
+// argsToJSON converts tool call arguments to JSON string, inferring the
+// type of each value
 func argsToJSON(functionName string, args []ToolCallArg) string {
-	if len(args) == 0 {
-		return "{}"
-	}
-
-	argMap := make(map[string]any)
-	for _, arg := range args {
-		argMap[arg.Key] = arg.Value
-	}
-
-	// Special handling for view function: convert limit and offset to integers
-	if functionName == "view" {
-		if limitVal, ok := argMap["limit"]; ok {
-			if limitStr, ok := limitVal.(string); ok {
-				if intVal, err := strconv.ParseInt(limitStr, 10, 64); err == nil {
-					argMap["limit"] = intVal
-				}
-			}
-		}
-		if offsetVal, ok := argMap["offset"]; ok {
-			if offsetStr, ok := offsetVal.(string); ok {
-				if intVal, err := strconv.ParseInt(offsetStr, 10, 64); err == nil {
-					argMap["offset"] = intVal
-				}
-			}
-		}
-	}
-
-	jsonBytes, err := json.Marshal(argMap)
-	if err != nil {
-		return "{}"
-	}
-	return string(jsonBytes)
+	return typedArgsJSON(args, nil)
 }
 
 // data: {"id":"chatcmpl-887db6c4f6e02924","object":"chat.completion.chunk","created":1766605451,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"：","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}
@@ -179,7 +182,7 @@ func (t *StreamTransformer) TransformLine(line string) ([]string, error) {
 		return []string{""}, nil
 	}
 	if line == "data: [DONE]" {
-		return []string{"data: [DONE]"}, nil
+		return append(append(t.flushHeld(), t.flushFinish()...), "data: [DONE]"), nil
 	}
 
 	// Parse the SSE data
@@ -202,109 +205,292 @@ func (t *StreamTransformer) TransformLine(line string) ([]string, error) {
 	}
 
 	content := chunk.Choices[0].Delta.Content
+	finished := chunk.Choices[0].FinishReason != nil
+	if t.held != "" && !t.inToolCall {
+		content = t.held + content
+		t.held = ""
+	}
 
-	// Check for tool call start
-	if strings.Contains(content, "<tool_call>") {
-		log.Println(line)
-
-		t.inToolCall = true
-		t.buffer.Reset()
-
-		// Check if there's content before <tool_call>
-		idx := strings.Index(content, "<tool_call>")
-		if idx > 0 {
-			// Output the content before the tool call
-			preContent := content[:idx]
-			preChunk := t.createContentChunk(preContent, nil)
-			preJSON, _ := json.Marshal(preChunk)
-			t.buffer.WriteString(content[idx:])
-			log.Println("prestart:", string(preJSON))
-			return []string{fmt.Sprintf("data: %s", preJSON)}, nil
+	var out []string
+	emit := func(lines ...string) {
+		if len(out) > 0 {
+			out = append(out, "") // each chunk is its own SSE event
 		}
-
-		t.buffer.WriteString(content)
-		// Return empty content chunks while buffering
-		return t.createEmptyContentChunks(), nil
+		out = append(out, lines...)
 	}
 
-	// If we're in a tool call, buffer the content
-	if t.inToolCall {
-		log.Println(line)
+	if !t.inToolCall && !strings.Contains(content, t.tags.Start) {
+		if finished && t.calledTools {
+			// The upstream's finish chunk after the tool calls
+			t.calledTools = false
+			return []string{deriveFinishChunk(line, content, true)}, nil
+		}
+		// Hold back a tail that may be the start of a tag split across
+		// chunks, e.g. "<tool" followed by "_call>"
+		if !finished {
+			if n := partialTagSuffix(content, t.tags.Start); n > 0 {
+				t.held = content[len(content)-n:]
+				content = content[:len(content)-n]
+			}
+		}
+		if content == chunk.Choices[0].Delta.Content {
+			// Normal content, pass through
+			return []string{line}, nil
+		}
+		return []string{replaceContent(line, content)}, nil
+	}
+	Logf("%s", line)
+	// the chunk's logprobs go out once, on the first chunk made from it
+	t.logprobs = chunk.Choices[0].Logprobs
+
+	// Content and tool calls go out in the order they appear, wherever the
+	// chunk boundaries fall: text after an end tag may be content or start
+	// the next call
+	for {
+		if !t.inToolCall {
+			idx := strings.Index(content, t.tags.Start)
+			if idx < 0 {
+				break
+			}
+			t.inToolCall = true
+			t.buffer.Reset()
+			if idx > 0 {
+				preJSON, _ := json.Marshal(t.createContentChunk(content[:idx], nil))
+				Logf("prestart: %s", preJSON)
+				emit(fmt.Sprintf("data: %s", preJSON))
+			}
+			content = content[idx:]
+		}
 		t.buffer.WriteString(content)
-
-		// Check if tool call is complete
-		if strings.Contains(t.buffer.String(), "</tool_call>") {
-			return t.flushToolCall()
+		content = ""
+		buffered := t.buffer.String()
+		end := indexOutsideCDATA(buffered, t.tags.End)
+		if end < 0 {
+			emit(t.streamToolCall(false)...)
+			break
 		}
-
-		// Return empty content chunks while buffering
-		return t.createEmptyContentChunks(), nil
+		end += len(t.tags.End)
+		t.buffer.Reset()
+		t.buffer.WriteString(buffered[:end])
+		emit(t.flushToolCall()...)
+		content = buffered[end:]
 	}
 
-	// Check finish_reason
-	if chunk.Choices[0].FinishReason != nil && *chunk.Choices[0].FinishReason == "stop" {
-		// If we have buffered content that wasn't a complete tool call, flush it as content
-		if t.buffer.Len() > 0 {
-			log.Println(line)
-			buffered := t.buffer.String()
+	if finished {
+		// A tool call the stream ended inside is handed back as content,
+		// unless part of it was streamed already
+		rest := content
+		if t.inToolCall && t.args.started {
+			emit(t.flushToolCall()...)
+		}
+		if t.inToolCall {
+			rest = t.buffer.String()
 			t.buffer.Reset()
-			contentChunk := t.createContentChunk(buffered, chunk.Choices[0].FinishReason)
-			contentJSON, _ := json.Marshal(contentChunk)
-			log.Println("finish:", string(contentJSON))
-			return []string{fmt.Sprintf("data: %s", contentJSON)}, nil
+			t.inToolCall = false
+		}
+		emit(deriveChunk(line, rest, t.calledTools, t.takeLogprobs() == nil))
+		t.calledTools = false
+		Logf("finish: %s", out[len(out)-1])
+	} else if content != "" {
+		// content after the last call, with a possible split start tag held
+		if n := partialTagSuffix(content, t.tags.Start); n > 0 {
+			t.held = content[len(content)-n:]
+			content = content[:len(content)-n]
+		}
+		if content != "" {
+			chunkJSON, _ := json.Marshal(t.createContentChunk(content, nil))
+			emit(fmt.Sprintf("data: %s", chunkJSON))
 		}
 	}
 
-	// Normal content, pass through
-	return []string{line}, nil
+	if len(out) == 0 {
+		// Return empty content chunks while buffering
+		return t.createEmptyContentChunks(), nil
+	}
+	return out, nil
 }
 
 // flushToolCall parses the buffered tool call and returns the transformed chunks
-func (t *StreamTransformer) flushToolCall() ([]string, error) {
+func (t *StreamTransformer) flushToolCall() []string {
 	buffered := t.buffer.String()
 	t.buffer.Reset()
 	t.inToolCall = false
 
-	log.Println("flushToolCall:", buffered)
+	Logf("flushToolCall: %s", buffered)
+	if t.args.started {
+		t.buffer.WriteString(buffered)
+		defer t.buffer.Reset()
+		return t.streamToolCall(true)
+	}
+	inner := cutToolCallBody(buffered, t.tags)
+
 	// Parse the tool call
-	parsed, err := parseToolCallXML(buffered)
-	if err != nil {
-		// If parsing fails, return as regular content
-		log.Printf("TOOLCALLFIX: failed to parse tool call (invalid XML format), returning as regular content: %v", err)
-		chunk := t.createContentChunk(buffered, nil)
-		jsonBytes, _ := json.Marshal(chunk)
-		return []string{fmt.Sprintf("data: %s", jsonBytes)}, nil
-	}
-
-	// Format arguments for logging
-	argsStr := ""
-	for i, arg := range parsed.Args {
-		if i > 0 {
-			argsStr += ", "
+	var calls []FunctionCall
+	body := t.tags.Body
+	if body == BodyAuto {
+		body = BodyXML
+		if isJSONBody(inner) {
+			body = BodyJSON
+		}
+	}
+	if body == BodyJSON {
+		var err error
+		calls, err = parseJSONToolCalls(inner)
+		if err != nil {
+			return t.failedToolCall(buffered, err)
+		}
+	} else {
+		parsed, err := parseXMLBody(inner)
+		if err != nil {
+			return t.failedToolCall(buffered, err)
+		}
+
+		// Format arguments for logging
+		argsStr := ""
+		for i, arg := range parsed.Args {
+			if i > 0 {
+				argsStr += ", "
+			}
+			argsStr += fmt.Sprintf("%s=%s", arg.Key, arg.Value)
+		}
+		Logf("TOOLCALLFIX: parsed tool call - name: %s, arguments: [%s]", parsed.Name, argsStr)
+		calls = []FunctionCall{{Name: parsed.Name, Arguments: typedArgsJSON(parsed.Args, t.schemas.props(parsed.Name))}}
+	}
+	calls, err := t.checkCalls(calls)
+	if err != nil && t.schemaMode == SchemaStrict {
+		return t.failedToolCall(buffered, err)
+	}
+
+	// Create the tool call chunks
+	var toolCallChunks []ChatCompletionChunk
+	for _, call := range calls {
+		Logf("TOOLCALLFIX: successfully transformed tool call - name: %s, arguments: %s", call.Name, call.Arguments)
+		toolCallChunks = append(toolCallChunks, t.createToolCallChunk(call))
+		t.toolCallIndex++
+	}
+
+	// The finish_reason is set on the upstream's own finish chunk later
+	t.calledTools = true
+
+	var out []string
+	for _, chunk := range toolCallChunks {
+		toolCallJSON, _ := json.Marshal(chunk)
+		Logf("data: %s", toolCallJSON)
+		if len(out) > 0 {
+			out = append(out, "")
 		}
-		argsStr += fmt.Sprintf("%s=%s", arg.Key, arg.Value)
+		out = append(out, fmt.Sprintf("data: %s", toolCallJSON))
+	}
+	return out
+}
+
+// cutToolCallBody returns what is between the tags of a buffered tool call.
+// An end tag inside a CDATA section is part of a value.
+func cutToolCallBody(buffered string, tags Tags) string {
+	inner := strings.TrimPrefix(buffered, tags.Start)
+	if i := indexOutsideCDATA(inner, tags.End); i >= 0 {
+		return inner[:i]
+	}
+	return inner
+}
+
+// failedToolCall returns a tool call that could not be parsed as content
+func (t *StreamTransformer) failedToolCall(buffered string, err error) []string {
+	Logf("TOOLCALLFIX: failed to parse tool call, returning as regular content: %v", err)
+	chunk := t.createContentChunk(buffered, nil)
+	jsonBytes, _ := json.Marshal(chunk)
+	return []string{fmt.Sprintf("data: %s", jsonBytes)}
+}
+
+// flushHeld returns held content when the stream ends without a finish chunk.
+func (t *StreamTransformer) flushHeld() []string {
+	if t.held == "" || t.lastChunk == nil {
+		return nil
 	}
-	log.Printf("TOOLCALLFIX: successfully transformed tool call - name: %s, arguments: [%s]", parsed.Name, argsStr)
+	chunkJSON, _ := json.Marshal(t.createContentChunk(t.held, nil))
+	t.held = ""
+	return []string{fmt.Sprintf("data: %s", chunkJSON), ""}
+}
 
-	// Create the tool call chunk
-	toolCallChunk := t.createToolCallChunk(parsed)
-	toolCallJSON, _ := json.Marshal(toolCallChunk)
+// partialTagSuffix returns the length of the longest suffix of s that is a
+// proper prefix of tag.
+func partialTagSuffix(s, tag string) int {
+	for n := min(len(tag)-1, len(s)); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
 
-	// Create the finish chunk with tool_calls reason
+// flushFinish returns a tool_calls finish chunk when the stream ends after
+// tool calls without a finish chunk of its own.
+func (t *StreamTransformer) flushFinish() []string {
+	if !t.calledTools {
+		return nil
+	}
+	t.calledTools = false
 	finishReason := "tool_calls"
-	finishChunk := t.createFinishChunk(&finishReason)
-	finishJSON, _ := json.Marshal(finishChunk)
+	finishJSON, _ := json.Marshal(t.createFinishChunk(&finishReason))
+	return []string{fmt.Sprintf("data: %s", finishJSON), ""}
+}
 
-	t.toolCallIndex++
+// replaceContent rewrites the first choice's content of an upstream chunk,
+// keeping its other fields.
+func replaceContent(line, content string) string {
+	return deriveFinishChunk(line, content, false)
+}
 
-	log.Printf("data: %s", toolCallJSON)
-	log.Printf("data: %s", finishJSON)
+// deriveFinishChunk rewrites the upstream chunk carrying finish_reason so it
+// keeps fields such as logprobs and stop_reason. The first choice's content
+// is replaced, and when tools were called a "stop" becomes "tool_calls".
+func deriveFinishChunk(line, content string, calledTools bool) string {
+	return deriveChunk(line, content, calledTools, false)
+}
 
-	return []string{
-		fmt.Sprintf("data: %s", toolCallJSON),
-		"",
-		fmt.Sprintf("data: %s", finishJSON),
-	}, nil
+// deriveChunk is deriveFinishChunk that can clear the first choice's
+// logprobs, when a chunk made from the same upstream chunk carried them.
+func deriveChunk(line, content string, calledTools, dropLogprobs bool) string {
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return line
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil || len(choices) == 0 {
+		return line
+	}
+	for i, choice := range choices {
+		if i == 0 {
+			var delta map[string]json.RawMessage
+			_ = json.Unmarshal(choice["delta"], &delta)
+			if delta == nil {
+				delta = map[string]json.RawMessage{}
+			}
+			delta["content"], _ = json.Marshal(content)
+			choice["delta"], _ = json.Marshal(delta)
+			if _, ok := choice["logprobs"]; ok && dropLogprobs {
+				choice["logprobs"] = json.RawMessage("null")
+			}
+		}
+		var reason string
+		if calledTools && json.Unmarshal(choice["finish_reason"], &reason) == nil && reason == "stop" {
+			choice["finish_reason"] = json.RawMessage(`"tool_calls"`)
+		}
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	b, _ := json.Marshal(chunk)
+	return "data: " + string(b)
+}
+
+// takeLogprobs returns the logprobs of the upstream chunk being rewritten
+// the first time it is called for that chunk, and nil after.
+func (t *StreamTransformer) takeLogprobs() json.RawMessage {
+	lp := t.logprobs
+	t.logprobs = nil
+	if string(lp) == "null" {
+		return nil
+	}
+	return lp
 }
 
 func (t *StreamTransformer) createEmptyContentChunks() []string {
@@ -326,7 +512,7 @@ func (t *StreamTransformer) createContentChunk(content string, finishReason *str
 					Content:          content,
 					ReasoningContent: nil,
 				},
-				Logprobs:     nil,
+				Logprobs:     t.takeLogprobs(),
 				FinishReason: finishReason,
 				TokenIDs:     nil,
 			},
@@ -335,9 +521,19 @@ func (t *StreamTransformer) createContentChunk(content string, finishReason *str
 	return chunk
 }
 
-func (t *StreamTransformer) createToolCallChunk(parsed *ParsedToolCall) ChatCompletionChunk {
+func (t *StreamTransformer) createToolCallChunk(call FunctionCall) ChatCompletionChunk {
 	toolCallID := fmt.Sprintf("chatcmpl-tool-%s", uuid.New().String()[:12])
+	return t.createToolCallChunkWith(ToolCall{
+		ID:       toolCallID,
+		Type:     "function",
+		Index:    t.toolCallIndex,
+		Function: call,
+	})
+}
 
+// createToolCallChunkWith wraps a tool call, or a later delta of one that
+// has only its index and arguments set
+func (t *StreamTransformer) createToolCallChunkWith(toolCall ToolCall) ChatCompletionChunk {
 	chunk := ChatCompletionChunk{
 		ID:      t.lastChunk.ID,
 		Object:  t.lastChunk.Object,
@@ -349,19 +545,9 @@ func (t *StreamTransformer) createToolCallChunk(parsed *ParsedToolCall) ChatComp
 				Delta: Delta{
 					Content:          "",
 					ReasoningContent: nil,
-					ToolCalls: []ToolCall{
-						{
-							ID:    toolCallID,
-							Type:  "function",
-							Index: t.toolCallIndex,
-							Function: FunctionCall{
-								Name:      parsed.Name,
-								Arguments: argsToJSON(parsed.Name, parsed.Args),
-							},
-						},
-					},
+					ToolCalls:        []ToolCall{toolCall},
 				},
-				Logprobs:     nil,
+				Logprobs:     t.takeLogprobs(),
 				FinishReason: nil,
 				TokenIDs:     nil,
 			},
@@ -370,6 +556,8 @@ func (t *StreamTransformer) createToolCallChunk(parsed *ParsedToolCall) ChatComp
 	return chunk
 }
 
+// createFinishChunk synthesizes a finish chunk for streams that end without
+// one; when the upstream sends its own, deriveFinishChunk is used instead.
 func (t *StreamTransformer) createFinishChunk(finishReason *string) ChatCompletionChunk {
 	chunk := ChatCompletionChunk{
 		ID:      t.lastChunk.ID,
@@ -383,15 +571,12 @@ func (t *StreamTransformer) createFinishChunk(finishReason *string) ChatCompleti
 					Content:          "",
 					ReasoningContent: nil,
 				},
-				Logprobs:     nil,
+				Logprobs:     t.takeLogprobs(),
 				FinishReason: finishReason,
 				TokenIDs:     nil,
 			},
 		},
 	}
-	if t.lastChunk.Choices != nil && len(t.lastChunk.Choices) > 0 {
-		chunk.Choices[0].StopReason = t.lastChunk.Choices[0].StopReason
-	}
 	return chunk
 }
 
@@ -400,9 +585,64 @@ type noopFlusher struct{}
 
 func (n *noopFlusher) Flush() {}
 
+// Formats accepted by NewTransformer. FormatGLM is the default.
+const (
+	FormatGLM      = "glm"
+	FormatHermes   = "hermes" // <tool_call>{"name": ..., "arguments": {...}}</tool_call>
+	FormatDeepSeek = "deepseek"
+)
+
+// LineTransformer rewrites one SSE line into zero or more lines
+type LineTransformer interface {
+	TransformLine(line string) ([]string, error)
+}
+
+// NewTransformer returns the transformer for a tool call format
+func NewTransformer(format string) (LineTransformer, error) {
+	switch format {
+	case "", FormatGLM:
+		return NewStreamTransformer(), nil
+	case FormatHermes:
+		return NewStreamTransformerWithTags(hermesTags), nil
+	case FormatDeepSeek:
+		return NewDeepSeekTransformer(), nil
+	}
+	return nil, fmt.Errorf("unknown toolcallfix format %q", format)
+}
+
+// NewTransformerWithTags returns the transformer for a format, or for
+// custom tags when tags is set. Custom tags replace the tags of the glm and
+// hermes formats and cannot be used with deepseek.
+func NewTransformerWithTags(format string, tags *Tags) (LineTransformer, error) {
+	if tags == nil {
+		return NewTransformer(format)
+	}
+	if err := tags.Validate(); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "", FormatGLM:
+		return NewStreamTransformerWithTags(*tags), nil
+	case FormatHermes:
+		t := *tags
+		if t.Body == "" {
+			t.Body = BodyJSON
+		}
+		return NewStreamTransformerWithTags(t), nil
+	}
+	if _, err := NewTransformer(format); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("toolcallfix format %q does not take custom tags", format)
+}
+
 // TransformStream transforms an entire SSE stream
 func TransformStream(input io.Reader, output io.Writer) error {
-	transformer := NewStreamTransformer()
+	return TransformStreamWith(NewStreamTransformer(), input, output)
+}
+
+// TransformStreamWith transforms an entire SSE stream with transformer
+func TransformStreamWith(transformer LineTransformer, input io.Reader, output io.Writer) error {
 	scanner := bufio.NewScanner(input)
 
 	// Check if output implements http.Flusher, otherwise use no-op flusher
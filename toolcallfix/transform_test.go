@@ -3,6 +3,7 @@ package toolcallfix
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -331,6 +332,7 @@ func TestStreamTransformer_ToolCallInContent(t *testing.T) {
 		`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"test","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
 		`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"</arg_value>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
 		`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"</tool_call>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
+		`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":"","reasoning_content":null},"logprobs":{"content":[]},"finish_reason":"stop","stop_reason":151336,"token_ids":null}]}`,
 	}
 
 	var allResults []string
@@ -342,6 +344,12 @@ func TestStreamTransformer_ToolCallInContent(t *testing.T) {
 		allResults = append(allResults, results...)
 	}
 
+	// The finish chunk is the upstream's own, with its metadata intact
+	last := allResults[len(allResults)-1]
+	if !strings.Contains(last, `"finish_reason":"tool_calls"`) || !strings.Contains(last, `"stop_reason":151336`) || !strings.Contains(last, `"logprobs":{"content":[]}`) {
+		t.Errorf("finish chunk lost upstream fields: %s", last)
+	}
+
 	// Check that we got a tool_calls chunk
 	foundToolCall := false
 	foundToolCallsFinish := false
@@ -593,3 +601,254 @@ func TestStreamTransformer_UsageChunk(t *testing.T) {
 		t.Errorf("usage chunk should pass through unchanged")
 	}
 }
+
+func TestStreamTransformer_FinishChunk(t *testing.T) {
+	chunk := func(content, finish string) string {
+		c, _ := json.Marshal(content)
+		return fmt.Sprintf(`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":%s},"logprobs":null,"finish_reason":%s,"token_ids":null}]}`, c, finish)
+	}
+	finishes := func(lines []string) (reasons []string, content string) {
+		transformer := NewStreamTransformer()
+		for _, line := range lines {
+			results, _ := transformer.TransformLine(line)
+			for _, result := range results {
+				var c ChatCompletionChunk
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(result, "data: ")), &c); err != nil || len(c.Choices) == 0 {
+					continue
+				}
+				content += c.Choices[0].Delta.Content
+				if c.Choices[0].FinishReason != nil {
+					reasons = append(reasons, *c.Choices[0].FinishReason)
+				}
+			}
+		}
+		return reasons, content
+	}
+
+	// two tool calls share one finish chunk
+	reasons, _ := finishes([]string{
+		chunk("<tool_call>a</tool_call>", "null"),
+		chunk("<tool_call>b</tool_call>", "null"),
+		chunk("", `"stop"`),
+		"data: [DONE]",
+	})
+	if fmt.Sprint(reasons) != "[tool_calls]" {
+		t.Errorf("finish reasons = %v, want [tool_calls]", reasons)
+	}
+
+	// a stream without its own finish chunk gets one before [DONE]
+	reasons, _ = finishes([]string{chunk("<tool_call>a</tool_call>", "null"), "data: [DONE]"})
+	if fmt.Sprint(reasons) != "[tool_calls]" {
+		t.Errorf("finish reasons = %v, want [tool_calls]", reasons)
+	}
+
+	// a truncated tool call comes back as content with the upstream's reason
+	reasons, content := finishes([]string{chunk("<tool_call>a<arg_key>", "null"), chunk("q", `"length"`), "data: [DONE]"})
+	if fmt.Sprint(reasons) != "[length]" || content != "<tool_call>a<arg_key>q" {
+		t.Errorf("finish reasons = %v, content = %q", reasons, content)
+	}
+}
+
+func TestStreamTransformer_SplitTags(t *testing.T) {
+	chunk := func(content, finish string) string {
+		c, _ := json.Marshal(content)
+		return fmt.Sprintf(`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":%s},"logprobs":null,"finish_reason":%s,"token_ids":null}]}`, c, finish)
+	}
+	run := func(lines ...string) (content string, calls []FunctionCall) {
+		transformer := NewStreamTransformer()
+		for _, line := range lines {
+			results, _ := transformer.TransformLine(line)
+			for _, result := range results {
+				var c ChatCompletionChunk
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(result, "data: ")), &c); err != nil || len(c.Choices) == 0 {
+					continue
+				}
+				content += c.Choices[0].Delta.Content
+				for _, tc := range c.Choices[0].Delta.ToolCalls {
+					calls = append(calls, tc.Function)
+				}
+			}
+		}
+		return content, calls
+	}
+
+	content, calls := run(
+		chunk("Let me search.<to", "null"),
+		chunk("ol_call>grep<arg_key>pattern</arg_key><arg_value>x</arg_value></tool", "null"),
+		chunk("_call>", "null"),
+		chunk("", `"stop"`),
+		"data: [DONE]",
+	)
+	if content != "Let me search." {
+		t.Errorf("content = %q, want the text before the tool call", content)
+	}
+	if fmt.Sprint(calls) != `[{grep {"pattern":"x"}}]` {
+		t.Errorf("tool calls = %v", calls)
+	}
+
+	// text that only looks like the start of a tag is released unchanged
+	for _, tt := range []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{chunk("if a <", "null"), chunk(" b then", "null"), chunk("", `"stop"`)}, "if a < b then"},
+		{[]string{chunk("see <tool", "null"), chunk("", `"stop"`)}, "see <tool"},
+		{[]string{chunk("see <tool", "null"), "data: [DONE]"}, "see <tool"},
+	} {
+		if content, calls := run(tt.lines...); content != tt.want || len(calls) != 0 {
+			t.Errorf("content = %q, calls = %v; want %q", content, calls, tt.want)
+		}
+	}
+}
+
+func TestStreamTransformer_InterleavedContent(t *testing.T) {
+	text := "Checking.<tool_call>read<arg_key>path</arg_key><arg_value>a.go</arg_value></tool_call>\nThen <b>.<tool_call>list</tool_call>Done."
+	want := `["Checking." "call read" "\nThen <b>." "call list" "Done."]`
+
+	chunk := func(content, finish string) string {
+		c, _ := json.Marshal(content)
+		return fmt.Sprintf(`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":%s},"finish_reason":%s}]}`, c, finish)
+	}
+	// events returns the content runs and tool calls in the order they are
+	// emitted, and the finish reason
+	events := func(transformer *StreamTransformer, pieces []string, last string) (got []string, finish string) {
+		var lines []string
+		for _, p := range pieces {
+			lines = append(lines, chunk(p, "null"))
+		}
+		lines = append(lines, chunk(last, `"stop"`), "data: [DONE]")
+		content := false
+		for _, line := range lines {
+			results, _ := transformer.TransformLine(line)
+			for _, result := range results {
+				var c ChatCompletionChunk
+				if json.Unmarshal([]byte(strings.TrimPrefix(result, "data: ")), &c) != nil || len(c.Choices) == 0 {
+					continue
+				}
+				if s := c.Choices[0].Delta.Content; s != "" {
+					if content {
+						got[len(got)-1] += s
+					} else {
+						got = append(got, s)
+					}
+					content = true
+				}
+				for _, tc := range c.Choices[0].Delta.ToolCalls {
+					if tc.Function.Name != "" {
+						got = append(got, "call "+tc.Function.Name)
+						content = false
+					}
+				}
+				if c.Choices[0].FinishReason != nil {
+					finish = *c.Choices[0].FinishReason
+				}
+			}
+		}
+		return got, finish
+	}
+
+	var splits [][]string
+	for i := 1; i < len(text); i++ {
+		splits = append(splits, []string{text[:i], text[i:]})
+	}
+	var single []string
+	for _, r := range text {
+		single = append(single, string(r))
+	}
+	splits = append(splits, single, []string{text})
+
+	for _, streamArgs := range []bool{false, true} {
+		for _, pieces := range splits {
+			// the last piece arrives either alone or with the finish chunk
+			for _, inFinish := range []bool{false, true} {
+				last := ""
+				if inFinish {
+					pieces, last = pieces[:len(pieces)-1], pieces[len(pieces)-1]
+				}
+				transformer := NewStreamTransformer()
+				transformer.SetStreamArgs(streamArgs)
+				got, finish := events(transformer, pieces, last)
+				if fmt.Sprintf("%q", got) != want || finish != "tool_calls" {
+					t.Fatalf("streamArgs=%v pieces %q + %q: events %q, finish %q; want %s", streamArgs, pieces, last, got, finish, want)
+				}
+			}
+		}
+	}
+}
+
+// logprobTokens gathers the tokens of the logprobs in a transformed stream,
+// in the order they were emitted
+func logprobTokens(t *testing.T, transformer LineTransformer, lines []string) string {
+	t.Helper()
+	var tokens strings.Builder
+	for _, line := range lines {
+		results, err := transformer.TransformLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			var c ChatCompletionChunk
+			if json.Unmarshal([]byte(strings.TrimPrefix(result, "data: ")), &c) != nil || len(c.Choices) == 0 {
+				continue
+			}
+			var lp struct {
+				Content []struct {
+					Token   string  `json:"token"`
+					Logprob float64 `json:"logprob"`
+				} `json:"content"`
+			}
+			_ = json.Unmarshal(c.Choices[0].Logprobs, &lp)
+			for _, tok := range lp.Content {
+				tokens.WriteString(tok.Token)
+			}
+		}
+	}
+	return tokens.String()
+}
+
+func TestStreamTransformer_KeepsLogprobs(t *testing.T) {
+	text := "Checking.<tool_call>read<arg_key>path</arg_key><arg_value>a.go</arg_value></tool_call>Done."
+	chunk := func(tokens []string, finish string) string {
+		content := strings.Join(tokens, "")
+		var entries []string
+		for _, tok := range tokens {
+			b, _ := json.Marshal(tok)
+			entries = append(entries, fmt.Sprintf(`{"token":%s,"logprob":-1.1920929e-07,"bytes":null,"top_logprobs":[]}`, b))
+		}
+		c, _ := json.Marshal(content)
+		return fmt.Sprintf(`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"glm-4.7","choices":[{"index":0,"delta":{"content":%s},"logprobs":{"content":[%s]},"finish_reason":%s}]}`,
+			c, strings.Join(entries, ","), finish)
+	}
+
+	// one token per chunk, two tokens per chunk, and everything in the
+	// finish chunk
+	var tokens []string
+	for _, r := range text {
+		tokens = append(tokens, string(r))
+	}
+	layouts := [][][]string{nil, nil, {tokens}}
+	for i, tok := range tokens {
+		layouts[0] = append(layouts[0], []string{tok})
+		if i%2 == 0 {
+			layouts[1] = append(layouts[1], tokens[i:min(i+2, len(tokens))])
+		}
+	}
+	for _, streamArgs := range []bool{false, true} {
+		for i, layout := range layouts {
+			var lines []string
+			for j, tokens := range layout {
+				finish := "null"
+				if j == len(layout)-1 {
+					finish = `"stop"`
+				}
+				lines = append(lines, chunk(tokens, finish))
+			}
+			lines = append(lines, "data: [DONE]")
+			transformer := NewStreamTransformer()
+			transformer.SetStreamArgs(streamArgs)
+			if got := logprobTokens(t, transformer, lines); got != text {
+				t.Errorf("layout %d, streamArgs %v: logprobs carry %q, want %q", i, streamArgs, got, text)
+			}
+		}
+	}
+}
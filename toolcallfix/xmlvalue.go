@@ -0,0 +1,130 @@
+package toolcallfix
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+const (
+	cdataStart  = "<![CDATA["
+	cdataEnd    = "]]>"
+	argValueEnd = "</arg_value>"
+)
+
+// xmlEntity matches the entities XML defines: the five named ones and
+// character references.
+var xmlEntity = regexp.MustCompile(`&(lt|gt|amp|quot|apos|#[0-9]+|#x[0-9a-fA-F]+);`)
+
+// indexOutsideCDATA is strings.Index that skips CDATA sections. Nothing is
+// found after a CDATA section that is not closed yet.
+func indexOutsideCDATA(s, sub string) int {
+	for i := 0; i < len(s); {
+		c := strings.Index(s[i:], cdataStart)
+		j := strings.Index(s[i:], sub)
+		if j >= 0 && (c < 0 || j < c) {
+			return i + j
+		}
+		if c < 0 {
+			return -1
+		}
+		e := strings.Index(s[i+c+len(cdataStart):], cdataEnd)
+		if e < 0 {
+			return -1
+		}
+		i += c + len(cdataStart) + e + len(cdataEnd)
+	}
+	return -1
+}
+
+// cutArgValue splits s, which starts with the content of an <arg_value>, at
+// the tag closing it. A closing tag inside a CDATA section does not count,
+// and neither does one followed by anything but the next <arg_key> or the
+// end of the call, so code that contains "</arg_value>" stays in the value.
+// With complete unset s may still grow: a closing tag at its end is taken
+// as the close, one followed by part of "<arg_key>" waits for more. A
+// complete s without a closing tag that fits is cut at its last one.
+func cutArgValue(s string, complete bool) (value, rest string, ok bool) {
+	last := -1
+	for i := 0; ; {
+		j := indexOutsideCDATA(s[i:], argValueEnd)
+		if j < 0 {
+			break
+		}
+		end := i + j
+		after := s[end+len(argValueEnd):]
+		next := strings.TrimLeft(after, " \t\r\n")
+		switch {
+		case next == "", strings.HasPrefix(next, "<arg_key>"):
+			return s[:end], after, true
+		case !complete && strings.HasPrefix("<arg_key>", next):
+			return s, "", false // what follows is not known yet
+		}
+		last = end
+		i = end + len(argValueEnd)
+	}
+	if complete && last >= 0 {
+		return s[:last], s[last+len(argValueEnd):], true
+	}
+	return s, "", false
+}
+
+// decodeArgValue returns the text of a raw argument value: CDATA sections
+// are taken literally and entities outside them are unescaped. Entities are
+// only unescaped when the text is consistently escaped, without a bare "<"
+// or "&", since models that do not escape may well write "&amp;" in code.
+// Whitespace around a value that is one CDATA section is dropped.
+func decodeArgValue(raw string) string {
+	if !strings.Contains(raw, cdataStart) {
+		return unescapeArgText(raw)
+	}
+	var all, data strings.Builder
+	rest := raw
+	onlyCDATA := true
+	for {
+		i := strings.Index(rest, cdataStart)
+		if i < 0 {
+			break
+		}
+		section, after, ok := strings.Cut(rest[i+len(cdataStart):], cdataEnd)
+		if !ok {
+			break // an unclosed section is kept as it is
+		}
+		text := rest[:i]
+		if strings.TrimSpace(text) != "" {
+			onlyCDATA = false
+		}
+		all.WriteString(unescapeArgText(text))
+		all.WriteString(section)
+		data.WriteString(section)
+		rest = after
+	}
+	if onlyCDATA && strings.TrimSpace(rest) == "" {
+		return data.String()
+	}
+	all.WriteString(unescapeArgText(rest))
+	return all.String()
+}
+
+// unescapeArgText unescapes s when it is escaped text.
+func unescapeArgText(s string) string {
+	if !strings.Contains(s, "&") || strings.Contains(s, "<") {
+		return s
+	}
+	if strings.Contains(xmlEntity.ReplaceAllString(s, ""), "&") {
+		return s // a bare "&": the text is not escaped
+	}
+	return xmlEntity.ReplaceAllStringFunc(s, html.UnescapeString)
+}
+
+// streamableValue is the part of an unfinished value that decoding cannot
+// change: the text before the first CDATA section or entity.
+func streamableValue(s string) string {
+	if i := strings.IndexAny(s, "<&"); i >= 0 {
+		s = s[:i]
+	}
+	if strings.TrimSpace(s) == "" {
+		return "" // may be the space around a CDATA section
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package toolcallfix
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseToolCallXML_CodeValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []ToolCallArg
+	}{
+		{
+			name:  "cdata holding the closing tags",
+			input: "<tool_call>write<arg_key>content</arg_key><arg_value>\n<![CDATA[if s == \"</arg_value>\" || s == \"</tool_call>\" {\n\treturn\n}]]>\n</arg_value><arg_key>path</arg_key><arg_value>a.go</arg_value></tool_call>",
+			want: []ToolCallArg{
+				{Key: "content", Value: "if s == \"</arg_value>\" || s == \"</tool_call>\" {\n\treturn\n}"},
+				{Key: "path", Value: "a.go"},
+			},
+		},
+		{
+			name:  "literal closing tag inside a value",
+			input: "<tool_call>write<arg_key>content</arg_key><arg_value>end := \"</arg_value>\"\nn := len(end)</arg_value>\n<arg_key>path</arg_key><arg_value>b.go</arg_value></tool_call>",
+			want: []ToolCallArg{
+				{Key: "content", Value: "end := \"</arg_value>\"\nn := len(end)"},
+				{Key: "path", Value: "b.go"},
+			},
+		},
+		{
+			name:  "escaped value",
+			input: "<tool_call>edit<arg_key>old</arg_key><arg_value>if a &lt; b &amp;&amp; c &gt; d { s = &quot;&#x2F;&#39;&quot; }</arg_value></tool_call>",
+			want:  []ToolCallArg{{Key: "old", Value: `if a < b && c > d { s = "/'" }`}},
+		},
+		{
+			name:  "unescaped code keeps entity-like text",
+			input: "<tool_call>edit<arg_key>new</arg_key><arg_value>html := a < b && \"&amp;\"</arg_value></tool_call>",
+			want:  []ToolCallArg{{Key: "new", Value: `html := a < b && "&amp;"`}},
+		},
+		{
+			name:  "cdata between escaped text",
+			input: "<tool_call>note<arg_key>text</arg_key><arg_value>x &lt; 1 <![CDATA[& y < 2]]> &amp; z</arg_value></tool_call>",
+			want:  []ToolCallArg{{Key: "text", Value: "x < 1 & y < 2 & z"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseToolCallXML(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Args) != len(tt.want) {
+				t.Fatalf("args = %q, want %q", got.Args, tt.want)
+			}
+			for i := range tt.want {
+				if got.Args[i] != tt.want[i] {
+					t.Errorf("arg %d = %q, want %q", i, got.Args[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTransformer_CDATA(t *testing.T) {
+	pieces := []string{
+		"<tool_call>write<arg_key>content</arg_key><arg_value>\n",
+		"<![CDATA[",
+		"fmt.Println(\"</tool_",
+		"call>\")]]></arg_value><arg_key>path</arg_key><arg_value>a &amp; b.go</arg_value>",
+		"</tool_call>",
+	}
+	want := map[string]any{"content": `fmt.Println("</tool_call>")`, "path": "a & b.go"}
+
+	for _, streamArgs := range []bool{false, true} {
+		transformer := NewStreamTransformer()
+		transformer.SetStreamArgs(streamArgs)
+		content, calls, _ := runTags(t, transformer, pieces...)
+		if content != "" {
+			t.Errorf("streamArgs=%v: content = %q", streamArgs, content)
+		}
+		var args strings.Builder
+		for _, c := range calls {
+			args.WriteString(c.Arguments)
+		}
+		var got map[string]any
+		if err := json.Unmarshal([]byte(args.String()), &got); err != nil || got["content"] != want["content"] || got["path"] != want["path"] {
+			t.Errorf("streamArgs=%v: arguments %s, want %v", streamArgs, args.String(), want)
+		}
+	}
+}
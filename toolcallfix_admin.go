@@ -0,0 +1,263 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"llm-api-relay/toolcallfix"
+)
+
+// toolCallFixOverride is what the admin API set for one rule. Unset fields
+// fall back to the rule.
+type toolCallFixOverride struct {
+	Enabled *bool
+	// Format, when set, decides the format and the tags together, so an
+	// override never mixes with tags meant for the rule's format.
+	Format *string
+	Tags   *toolcallfix.Tags
+}
+
+// toolCallFixKey is what an override applies to: a rule of one tenant, by
+// its match_model, or for requests that match no rule, the model they ask
+// for.
+type toolCallFixKey struct {
+	tenant string
+	model  string
+}
+
+// toolCallFixKeyFor returns the override key of a request from tenant that
+// matched rule (nil when none did) and asked for model.
+func toolCallFixKeyFor(tenant string, rule *ModelRule, model string) toolCallFixKey {
+	if rule != nil {
+		return toolCallFixKey{tenant, ruleName(rule)}
+	}
+	return toolCallFixKey{tenant, model}
+}
+
+// toolCallFixOverrides holds toolcallfix settings changed at runtime
+// through the admin API. They take precedence over model rules until cleared
+// and are not persisted across restarts.
+type toolCallFixOverrides struct {
+	mu    sync.RWMutex
+	rules map[toolCallFixKey]toolCallFixOverride
+}
+
+var toolCallFixToggles = newToolCallFixOverrides()
+
+func newToolCallFixOverrides() *toolCallFixOverrides {
+	return &toolCallFixOverrides{rules: map[toolCallFixKey]toolCallFixOverride{}}
+}
+
+func (o *toolCallFixOverrides) get(key toolCallFixKey) (toolCallFixOverride, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	ov, ok := o.rules[key]
+	return ov, ok
+}
+
+// update changes the override of key with fn, keeping it only when fn
+// returns nil.
+func (o *toolCallFixOverrides) update(key toolCallFixKey, fn func(*toolCallFixOverride) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ov := o.rules[key]
+	if err := fn(&ov); err != nil {
+		return err
+	}
+	o.rules[key] = ov
+	return nil
+}
+
+func (o *toolCallFixOverrides) set(key toolCallFixKey, enabled bool) {
+	_ = o.update(key, func(ov *toolCallFixOverride) error {
+		ov.Enabled = &enabled
+		return nil
+	})
+}
+
+func (o *toolCallFixOverrides) clear(key toolCallFixKey) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.rules[key]
+	delete(o.rules, key)
+	return ok
+}
+
+// models returns the names overridden for tenant.
+func (o *toolCallFixOverrides) models(tenant string) []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var out []string
+	for k := range o.rules {
+		if k.tenant == tenant {
+			out = append(out, k.model)
+		}
+	}
+	return out
+}
+
+type toolCallFixState struct {
+	Tenant  string            `json:"tenant"`
+	Model   string            `json:"model"` // the rule's match_model, or a model no rule matches
+	Enabled bool              `json:"enabled"`
+	Source  string            `json:"source"` // "override", "rule" or "default"
+	Format  string            `json:"format"`
+	Tags    *toolcallfix.Tags `json:"tags,omitempty"`
+}
+
+// toolCallFixRules returns the rules in effect for tenant, or false when
+// there is no such tenant.
+func toolCallFixRules(cfg *Config, tenant string) ([]ModelRule, bool) {
+	if tenant == defaultTenant {
+		return cfg.rules(), true
+	}
+	live, ok := cfg.tenantRules[tenant]
+	if !ok {
+		return nil, false
+	}
+	return *live.rules.Load(), true
+}
+
+// toolCallFixStateFor reports the effective setting for the rule of tenant
+// named model, or for model when no rule has that name, and where it comes
+// from. Source is "override" when any setting is overridden.
+func toolCallFixStateFor(tenant string, rule *ModelRule, model string) toolCallFixState {
+	st := toolCallFixState{
+		Tenant: tenant,
+		Model:  model,
+		Source: "default",
+		Format: toolCallFixFormat(tenant, rule, model),
+		Tags:   toolCallFixTags(tenant, rule, model),
+	}
+	if rule != nil {
+		st.Enabled, st.Source = rule.EnableToolCallFix, "rule"
+	}
+	if ov, ok := toolCallFixToggles.get(toolCallFixKeyFor(tenant, rule, model)); ok {
+		st.Source = "override"
+		if ov.Enabled != nil {
+			st.Enabled = *ov.Enabled
+		}
+	}
+	return st
+}
+
+// handleToolCallFix serves /admin/toolcallfix. Settings belong to a rule,
+// named by its match_model, of the tenant given with ?tenant= (default the
+// top-level rules); a model that no rule matches can be named directly.
+//
+//	GET    /admin/toolcallfix          list rules and overrides
+//	GET    /admin/toolcallfix/{model}  effective setting for one rule
+//	PUT    /admin/toolcallfix/{model}  {"enabled": true|false, "format": "hermes", "tags": {...}}
+//	DELETE /admin/toolcallfix/{model}  drop the override, back to the rule
+func handleToolCallFix(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		model := strings.TrimPrefix(r.URL.Path, "/admin/toolcallfix")
+		model = strings.TrimPrefix(model, "/")
+		tenant := cmp.Or(r.URL.Query().Get("tenant"), defaultTenant)
+		rules, ok := toolCallFixRules(cfg, tenant)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown tenant", "invalid_request_error", "not_found")
+			return
+		}
+
+		if model == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			seen := map[string]bool{}
+			for i := range rules {
+				seen[ruleName(&rules[i])] = true
+			}
+			for _, m := range toolCallFixToggles.models(tenant) {
+				seen[m] = true
+			}
+			models := make([]string, 0, len(seen))
+			for m := range seen {
+				models = append(models, m)
+			}
+			sort.Strings(models)
+			data := make([]toolCallFixState, 0, len(models))
+			for _, m := range models {
+				data = append(data, toolCallFixStateFor(tenant, namedRule(rules, m), m))
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+			return
+		}
+
+		rule := namedRule(rules, model)
+		if rule == nil {
+			// an override keyed by a model name only applies when no rule
+			// matches it
+			matched := findRule(rules, model)
+			if matched == nil {
+				matched = findExactRule(rules, "default")
+			}
+			if matched != nil {
+				writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no rule named %q; its requests use rule %q", model, ruleName(matched)), "invalid_request_error", "not_found")
+				return
+			}
+		}
+		key := toolCallFixKeyFor(tenant, rule, model)
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Enabled *bool             `json:"enabled"`
+				Format  *string           `json:"format"`
+				Tags    *toolcallfix.Tags `json:"tags"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil && body.Format == nil && body.Tags == nil {
+				writeJSONError(w, http.StatusBadRequest, `body must set "enabled", "format" or "tags"`, "invalid_request_error", "invalid_parameter")
+				return
+			}
+			err := toolCallFixToggles.update(key, func(ov *toolCallFixOverride) error {
+				if body.Format != nil || body.Tags != nil {
+					format := ""
+					if body.Format != nil {
+						format = *body.Format
+					}
+					if _, err := toolcallfix.NewTransformerWithTags(format, body.Tags); err != nil {
+						return err
+					}
+					ov.Format, ov.Tags = &format, body.Tags
+				}
+				if body.Enabled != nil {
+					ov.Enabled = body.Enabled
+				}
+				return nil
+			})
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_parameter")
+				return
+			}
+			vlog("TOOLCALLFIX: runtime override for '%s' of tenant '%s' updated", model, tenant)
+		case http.MethodDelete:
+			if !toolCallFixToggles.clear(key) {
+				writeJSONError(w, http.StatusNotFound, "no override for model", "invalid_request_error", "not_found")
+				return
+			}
+			vlog("TOOLCALLFIX: runtime override for '%s' of tenant '%s' cleared", model, tenant)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, toolCallFixStateFor(tenant, rule, model))
+	}
+}
+
+// namedRule returns the rule whose name, as ruleName gives it, is name.
+func namedRule(rules []ModelRule, name string) *ModelRule {
+	for i := range rules {
+		if ruleName(&rules[i]) == name {
+			return &rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"llm-api-relay/toolcallfix"
+)
+
+func TestToolCallFixRuntimeToggle(t *testing.T) {
+	t.Cleanup(func() { toolCallFixToggles = newToolCallFixOverrides() })
+
+	cfg := &Config{
+		Admin:      &AdminConfig{Token: "admin-secret"},
+		ModelRules: []ModelRule{{MatchModel: "glm", EnableToolCallFix: false}},
+	}
+	handler := adminAuth(cfg, handleToolCallFix(cfg))
+	do := func(method, path, body string) (int, toolCallFixState) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var st toolCallFixState
+		_ = json.Unmarshal(w.Body.Bytes(), &st)
+		return w.Code, st
+	}
+
+	if _, st := do("GET", "/admin/toolcallfix/glm", ""); st.Enabled || st.Source != "rule" {
+		t.Errorf("expected rule setting, got %+v", st)
+	}
+
+	code, st := do("PUT", "/admin/toolcallfix/glm", `{"enabled":true}`)
+	if code != http.StatusOK || !st.Enabled || st.Source != "override" {
+		t.Fatalf("expected override to be applied, got %d %+v", code, st)
+	}
+	if !shouldEnableToolCallFix(defaultTenant, resolveRule(cfg, "glm"), "glm") {
+		t.Errorf("override should take precedence over the rule")
+	}
+
+	// overrides also work for models without a rule, including names with slashes
+	do("PUT", "/admin/toolcallfix/Qwen/Qwen3-32B", `{"enabled":true}`)
+	if !shouldEnableToolCallFix(defaultTenant, resolveRule(cfg, "Qwen/Qwen3-32B"), "Qwen/Qwen3-32B") {
+		t.Errorf("expected override for unconfigured model")
+	}
+
+	r := httptest.NewRequest("GET", "/admin/toolcallfix", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	var list struct {
+		Data []toolCallFixState `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	if fmt.Sprint(list.Data) != "[{default Qwen/Qwen3-32B true override glm <nil>} {default glm true override glm <nil>}]" {
+		t.Errorf("unexpected list: %v", list.Data)
+	}
+
+	if code, _ := do("PUT", "/admin/toolcallfix/glm", `{"enable":true}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without any setting, got %d", code)
+	}
+	if code, st := do("DELETE", "/admin/toolcallfix/glm", ""); code != http.StatusOK || st.Source != "rule" {
+		t.Errorf("delete should revert to the rule, got %d %+v", code, st)
+	}
+	if shouldEnableToolCallFix(defaultTenant, resolveRule(cfg, "glm"), "glm") {
+		t.Errorf("rule setting should apply again after delete")
+	}
+	if code, _ := do("DELETE", "/admin/toolcallfix/glm", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 when no override exists, got %d", code)
+	}
+}
+
+func TestToolCallFixOverrideByRule(t *testing.T) {
+	t.Cleanup(func() { toolCallFixToggles = newToolCallFixOverrides() })
+
+	rules := []ModelRule{{MatchModel: "gpt-4", Set: map[string]any{"model": "glm-4.7"}}, {MatchModel: "default"}}
+	cfg := &Config{
+		Admin:      &AdminConfig{Token: "admin-secret"},
+		ModelRules: rules,
+		Tenants:    []TenantConfig{{Name: "team-a", Keys: []string{"sk-a"}}},
+	}
+	if _, err := newTenantRouter(cfg, proxyHandlers{}); err != nil {
+		t.Fatal(err)
+	}
+	handler := adminAuth(cfg, handleToolCallFix(cfg))
+	do := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// the override is set on the rule shown by GET and applies to its
+	// requests although the rule renames the model
+	if code := do("PUT", "/admin/toolcallfix/gpt-4", `{"enabled":true}`); code != http.StatusOK {
+		t.Fatalf("PUT on the rule: %d", code)
+	}
+	if !shouldEnableToolCallFix(defaultTenant, findRule(cfg.rules(), "gpt-4"), "glm-4.7") {
+		t.Error("override not applied to the renaming rule")
+	}
+	// another tenant's rule of the same name is left alone
+	if shouldEnableToolCallFix("team-a", findRule(*cfg.tenantRules["team-a"].rules.Load(), "gpt-4"), "glm-4.7") {
+		t.Error("override leaked to another tenant")
+	}
+	if code := do("PUT", "/admin/toolcallfix/gpt-4?tenant=team-a", `{"enabled":true}`); code != http.StatusOK {
+		t.Fatalf("PUT for a tenant: %d", code)
+	}
+	if !shouldEnableToolCallFix("team-a", findRule(*cfg.tenantRules["team-a"].rules.Load(), "gpt-4"), "glm-4.7") {
+		t.Error("tenant override not applied")
+	}
+
+	// a model that a rule matches is not a key of its own
+	if code := do("PUT", "/admin/toolcallfix/claude", `{"enabled":true}`); code != http.StatusNotFound {
+		t.Errorf("PUT on a model served by the default rule: %d, want 404", code)
+	}
+	if code := do("GET", "/admin/toolcallfix?tenant=nobody", ""); code != http.StatusNotFound {
+		t.Errorf("unknown tenant: %d, want 404", code)
+	}
+}
+
+func TestToolCallFixFormatOverride(t *testing.T) {
+	t.Cleanup(func() { toolCallFixToggles = newToolCallFixOverrides() })
+
+	tags := &toolcallfix.Tags{Start: "<|tool|>", End: "<|/tool|>"}
+	cfg := &Config{
+		Admin:      &AdminConfig{Token: "admin-secret"},
+		ModelRules: []ModelRule{{MatchModel: "m", EnableToolCallFix: true, ToolCallFixTags: tags}},
+	}
+	handler := adminAuth(cfg, handleToolCallFix(cfg))
+	do := func(body string) (int, toolCallFixState) {
+		r := httptest.NewRequest("PUT", "/admin/toolcallfix/m", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var st toolCallFixState
+		_ = json.Unmarshal(w.Body.Bytes(), &st)
+		return w.Code, st
+	}
+
+	// the format replaces the rule's tags too, which belong to its format
+	code, st := do(`{"format":"deepseek"}`)
+	if code != http.StatusOK || st.Format != toolcallfix.FormatDeepSeek || st.Tags != nil || !st.Enabled {
+		t.Fatalf("format override: %d %+v", code, st)
+	}
+	if toolCallFixFormat(defaultTenant, resolveRule(cfg, "m"), "m") != toolcallfix.FormatDeepSeek || toolCallFixTags(defaultTenant, resolveRule(cfg, "m"), "m") != nil {
+		t.Errorf("toolCallFixFormat/Tags ignore the override")
+	}
+
+	code, st = do(`{"format":"hermes","tags":{"start":"<call>","end":"</call>"},"enabled":false}`)
+	if code != http.StatusOK || st.Format != toolcallfix.FormatHermes || st.Tags == nil || st.Tags.Start != "<call>" || st.Enabled {
+		t.Fatalf("tags override: %d %+v", code, st)
+	}
+	for _, body := range []string{`{"format":"xml"}`, `{"format":"deepseek","tags":{"start":"<a>","end":"</a>"}}`, `{"tags":{"start":"<a>"}}`} {
+		if code, _ := do(body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, code)
+		}
+	}
+	if toolCallFixFormat(defaultTenant, resolveRule(cfg, "m"), "m") != toolcallfix.FormatHermes {
+		t.Errorf("a rejected update changed the override")
+	}
+
+	toolCallFixToggles.clear(toolCallFixKey{defaultTenant, "m"})
+	if toolCallFixFormat(defaultTenant, resolveRule(cfg, "m"), "m") != toolcallfix.FormatGLM || toolCallFixTags(defaultTenant, resolveRule(cfg, "m"), "m") != tags {
+		t.Errorf("rule settings not back after clearing the override")
+	}
+}
+
+func TestToolCallFixToggleAffectsStream(t *testing.T) {
+	t.Cleanup(func() { toolCallFixToggles = newToolCallFixOverrides() })
+
+	upstream := httptest.NewServer(http.HandlerFunc(selftestUpstream))
+	defer upstream.Close()
+
+	run := func() string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"glm","stream":true}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+		return w.Body.String()
+	}
+
+	if out := run(); strings.Contains(out, `"tool_calls"`) {
+		t.Errorf("toolcallfix should be off without a rule")
+	}
+	toolCallFixToggles.set(toolCallFixKey{defaultTenant, "glm"}, true)
+	if out := run(); !strings.Contains(out, `"tool_calls"`) {
+		t.Errorf("runtime override should enable toolcallfix without a restart:\n%s", out)
+	}
+}
@@ -1,76 +1,26 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
-	"time"
-
-	"llm-api-relay/toolcallfix"
 )
 
-// TestToolCallFixIntegration tests the complete toolcallfix integration
+// TestToolCallFixIntegration runs the selftest subcommand, which drives a
+// scripted tool-call stream through the full relay and toolcallfix pipeline.
 func TestToolCallFixIntegration(t *testing.T) {
-	// Create a test upstream server that returns mock responses with tool calls in content
-	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Verify the request was forwarded correctly
-		if r.Method != http.MethodPost {
-			t.Errorf("expected POST request, got %s", r.Method)
-		}
-
-		// Return a mock streaming response with tool call in content
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.WriteHeader(http.StatusOK)
-
-		// Send streaming chunks with tool call embedded in content
-		chunks := []string{
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"Let me search for that information.","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"` + "\n" + `</think>` + "\n" + `","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"<tool_call>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"search","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"<arg_key>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"query","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"</arg_key>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"<arg_value>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"test query","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"</arg_value>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"</tool_call>","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: {"id":"test-123","object":"chat.completion.chunk","created":1234567890,"model":"test-model","choices":[{"index":0,"delta":{"content":"\nHere are the search results.","reasoning_content":null},"logprobs":null,"finish_reason":null,"token_ids":null}]}`,
-			`data: [DONE]`,
-		}
-
-		for _, chunk := range chunks {
-			fmt.Fprintln(w, chunk)
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
-	}))
-	defer upstream.Close()
-
-	// Create test config
-	configFile, err := os.CreateTemp("", "config-*.jsonc")
-	if err != nil {
-		t.Fatalf("failed to create temp config: %v", err)
-	}
-	defer os.Remove(configFile.Name())
-
-	configContent := fmt.Sprintf(`{
+	configFile := filepath.Join(t.TempDir(), "config.jsonc")
+	configContent := `{
   "listen": "127.0.0.1:8080",
-  "upstream": "%s",
+  "upstream": "http://127.0.0.1:1",
   "forward_auth": false,
   "model_rules": [
     {
@@ -82,147 +32,25 @@ func TestToolCallFixIntegration(t *testing.T) {
       "enable_toolcallfix": true
     }
   ]
-}`, upstream.URL)
-
-	if _, err := configFile.WriteString(configContent); err != nil {
+}`
+	if err := os.WriteFile(configFile, []byte(configContent), 0o644); err != nil {
 		t.Fatalf("failed to write config: %v", err)
 	}
-	configFile.Close()
-
-	// Build the main binary
-	cmd := exec.Command("go", "build", "-o", "test-relay", ".")
-	cmd.Dir = "."
-	if err := cmd.Run(); err != nil {
-		t.Fatalf("failed to build main binary: %v", err)
-	}
-	defer os.Remove("test-relay")
-
-	// Start the relay server with test config
-	serverCmd := exec.Command("./test-relay", "--config", configFile.Name())
-
-	// Start the server process
-	if err := serverCmd.Start(); err != nil {
-		t.Fatalf("failed to start relay server: %v", err)
-	}
-	defer serverCmd.Process.Kill() // Force kill on cleanup
-
-	// Wait for server to start
-	time.Sleep(500 * time.Millisecond)
-
-	// Check if server is still running
-	if serverCmd.ProcessState != nil && serverCmd.ProcessState.Exited() {
-		output, _ := serverCmd.CombinedOutput()
-		t.Fatalf("relay server failed to start: %s", string(output))
-	}
-
-	// Wait a bit longer for server to be ready
-	time.Sleep(1 * time.Second)
-
-	// Test health endpoint first
-	client := &http.Client{Timeout: 5 * time.Second}
-	healthResp, err := client.Get("http://127.0.0.1:8080/health")
-	if err != nil {
-		t.Fatalf("server health check failed: %v", err)
-	}
-	healthResp.Body.Close()
-
-	// For this integration test, we'll test by making HTTP requests to the actual server
-	// Create a POST request with streaming enabled
-	reqBody := map[string]any{
-		"model":    "test-model",
-		"messages": []map[string]string{{"role": "user", "content": "search for something"}},
-		"stream":   true,
-	}
-
-	bodyBytes, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(bodyBytes))
-	if err != nil {
-		t.Fatalf("failed to create request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send the request and capture the streaming response
-	client = &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatalf("failed to connect to server: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("expected status 200, got %d", resp.StatusCode)
-	}
 
-	// Verify the response is a stream
-	contentType := resp.Header.Get("Content-Type")
-	if !strings.Contains(contentType, "text/event-stream") && !strings.Contains(contentType, "multipart/x-ndjson") {
-		t.Errorf("expected streaming content type, got %s", contentType)
+	var out bytes.Buffer
+	if code := runSelftest([]string{"--config", configFile}, &out); code != 0 {
+		t.Fatalf("selftest failed with exit code %d:\n%s", code, out.String())
 	}
-
-	// Read and verify the streaming response
-	reader := bufio.NewReader(resp.Body)
-	toolCallFound := false
-	finishReasonFound := false
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			t.Fatalf("error reading stream: %v", err)
-		}
-
-		line = strings.TrimSpace(line)
-		if line == "" || line == "data: [DONE]" {
-			if line == "data: [DONE]" {
-				break
-			}
-			continue
-		}
-
-		// Parse the SSE data
-		if strings.HasPrefix(line, "data: ") {
-			jsonStr := strings.TrimPrefix(line, "data: ")
-			var chunk toolcallfix.ChatCompletionChunk
-			if err := json.Unmarshal([]byte(jsonStr), &chunk); err == nil {
-				// Check for tool_calls in the response
-				if len(chunk.Choices) > 0 && len(chunk.Choices[0].Delta.ToolCalls) > 0 {
-					toolCallFound = true
-					tc := chunk.Choices[0].Delta.ToolCalls[0]
-
-					// Verify the function name and arguments
-					if tc.Function.Name != "search" {
-						t.Errorf("expected function name 'search', got %q", tc.Function.Name)
-					}
-
-					// Parse arguments to verify structure
-					var args map[string]string
-					if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
-						t.Errorf("failed to parse tool call arguments: %v", err)
-					} else {
-						if args["query"] != "test query" {
-							t.Errorf("expected query argument 'test query', got %q", args["query"])
-						}
-					}
-				}
-
-				// Check for finish_reason
-				if chunk.Choices[0].FinishReason != nil && *chunk.Choices[0].FinishReason == "tool_calls" {
-					finishReasonFound = true
-				}
-			}
+	for _, want := range []string{
+		"PASS  GET /health",
+		`PASS  toolcallfix stream for model "test-model"`,
+		`PASS  toolcallfix stream for model "selftest-default"`,
+		"3 passed, 0 failed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("selftest output missing %q:\n%s", want, out.String())
 		}
 	}
-
-	// Verify that toolcallfix transformation occurred
-	if !toolCallFound {
-		t.Errorf("expected to find tool_calls in the transformed response")
-	}
-
-	if !finishReasonFound {
-		t.Errorf("expected to find finish_reason 'tool_calls' in the response")
-	}
 }
 
 // TestShouldEnableToolCallFix tests the decision logic for enabling toolcallfix
@@ -348,7 +176,7 @@ func TestShouldEnableToolCallFix(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := shouldEnableToolCallFix(tt.config, tt.model)
+			result := shouldEnableToolCallFix(defaultTenant, resolveRule(tt.config, tt.model), tt.model)
 			if result != tt.expectedEnabled {
 				t.Errorf("shouldEnableToolCallFix() = %v, want %v", result, tt.expectedEnabled)
 			}
@@ -457,7 +285,7 @@ func TestConfigWithoutToolCallFix(t *testing.T) {
 	}
 
 	// shouldEnableToolCallFix should return false for models without explicit rules
-	result := shouldEnableToolCallFix(&cfg, "gpt-4")
+	result := shouldEnableToolCallFix(defaultTenant, resolveRule(&cfg, "gpt-4"), "gpt-4")
 	if result != false {
 		t.Errorf("shouldEnableToolCallFix should default to false, got %v", result)
 	}
@@ -519,6 +347,52 @@ func TestProxyWithJSONPatchWithToolCallFix(t *testing.T) {
 	}
 }
 
+// TestToolCallFixRenamingRule checks that toolcallfix follows the matched
+// rule when the rule's "set" renames the model.
+func TestToolCallFixRenamingRule(t *testing.T) {
+	call := "<tool_call>get_weather<arg_key>city</arg_key><arg_value>Paris</arg_value></tool_call>"
+	var upstreamModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		upstreamModel, _ = body["model"].(string)
+		if body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, chatStream(call))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"object":  "chat.completion",
+			"choices": []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": call}, "finish_reason": "stop"}},
+		})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream: upstream.URL,
+		ModelRules: []ModelRule{{
+			MatchModel:        "gpt-4",
+			Set:               map[string]any{"model": "glm-4.7"},
+			EnableToolCallFix: true,
+			ToolsViaPrompt:    true,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range []bool{true, false} {
+		body := fmt.Sprintf(`{"model":"gpt-4","stream":%v,"tools":%s,"messages":[{"role":"user","content":"Paris?"}]}`, stream, weatherTools)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		out := w.Body.String()
+		if upstreamModel != "glm-4.7" {
+			t.Errorf("stream=%v: upstream got model %q", stream, upstreamModel)
+		}
+		if !strings.Contains(out, `"tool_calls"`) || strings.Contains(out, "<tool_call>") {
+			t.Errorf("stream=%v: tool call not converted:\n%s", stream, out)
+		}
+	}
+}
+
 // parseURL is a helper to parse a URL string
 func parseURL(s string) *url.URL {
 	u, err := url.Parse(s)
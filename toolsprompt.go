@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"llm-api-relay/toolcallfix"
+)
+
+// defaultToolsPrompt follows the tool section of the GLM-4 and Qwen chat
+// templates. It receives .Tools (one JSON definition per line), .Start and
+// .End (the tool call tags), .Example (a call in the expected markup) and
+// .Choice (an instruction from tool_choice, may be empty).
+const defaultToolsPrompt = `# Tools
+
+You may call one or more functions to assist with the user query.
+
+You are provided with function signatures within <tools></tools> XML tags:
+<tools>
+{{.Tools}}
+</tools>
+
+For each function call, output the function name and arguments in the following format:
+{{.Example}}
+{{- if .Choice}}
+
+{{.Choice}}{{end}}`
+
+// exampleCall shows the model the markup of a call, with placeholders.
+var exampleCall = toolcallfix.FunctionCall{
+	Name:      "{function-name}",
+	Arguments: `{"{arg-key-1}":"{arg-value-1}","{arg-key-2}":"{arg-value-2}"}`,
+}
+
+func validateToolsViaPrompt(rule *ModelRule) error {
+	if !rule.ToolsViaPrompt {
+		if rule.ToolsPrompt != "" {
+			return fmt.Errorf("tools_prompt requires tools_via_prompt")
+		}
+		return nil
+	}
+	if !rule.EnableToolCallFix {
+		return fmt.Errorf("tools_via_prompt requires enable_toolcallfix")
+	}
+	if _, err := toolcallfix.FormatTags(rule.ToolCallFixFormat, rule.ToolCallFixTags); err != nil {
+		return fmt.Errorf("tools_via_prompt: %w", err)
+	}
+	if rule.ToolsPrompt != "" {
+		if _, err := template.New("tools").Parse(rule.ToolsPrompt); err != nil {
+			return fmt.Errorf("parse tools_prompt: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyToolsViaPrompt prepares a chat request for a model without native
+// tool support: tools and tool_choice are removed and described in the
+// system prompt, and earlier tool calls and results are written out as
+// text. It returns the removed tools, which the calls in the response are
+// still checked against.
+func applyToolsViaPrompt(rule *ModelRule, req map[string]any) (any, error) {
+	tags, _ := toolcallfix.FormatTags(rule.ToolCallFixFormat, rule.ToolCallFixTags) // validated at load
+	tools := req["tools"]
+	choice := req["tool_choice"]
+	delete(req, "tools")
+	delete(req, "tool_choice")
+	delete(req, "parallel_tool_calls")
+
+	messages, _ := req["messages"].([]any)
+	messages, err := toolHistoryAsText(messages, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	list, _ := tools.([]any)
+	if len(list) > 0 && choice != "none" {
+		prompt, err := renderToolsPrompt(rule, tags, list, choice)
+		if err != nil {
+			return nil, err
+		}
+		messages = withSystemPrompt(messages, prompt)
+		vlog("TOOLS: described %d tool(s) in the system prompt", len(list))
+	}
+	req["messages"] = messages
+	return tools, nil
+}
+
+func renderToolsPrompt(rule *ModelRule, tags toolcallfix.Tags, tools []any, choice any) (string, error) {
+	spec := rule.ToolsPrompt
+	if spec == "" {
+		spec = defaultToolsPrompt
+	}
+	tmpl, err := template.New("tools").Parse(spec)
+	if err != nil {
+		return "", fmt.Errorf("parse tools_prompt: %w", err)
+	}
+	var lines []string
+	for _, tool := range tools {
+		b, _ := json.Marshal(tool)
+		lines = append(lines, string(b))
+	}
+	example := tags.Render(exampleCall)
+	if tags.Body == toolcallfix.BodyJSON {
+		example = tags.Start + "\n" + `{"name": <function-name>, "arguments": <args-json-object>}` + "\n" + tags.End
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, map[string]any{
+		"Tools":   strings.Join(lines, "\n"),
+		"Start":   tags.Start,
+		"End":     tags.End,
+		"Example": example,
+		"Choice":  toolChoiceInstruction(choice),
+	})
+	if err != nil {
+		return "", fmt.Errorf("render tools_prompt: %w", err)
+	}
+	return b.String(), nil
+}
+
+// toolChoiceInstruction turns tool_choice into a sentence for the prompt.
+func toolChoiceInstruction(choice any) string {
+	switch c := choice.(type) {
+	case string:
+		if c == "required" {
+			return "You must call at least one function."
+		}
+	case map[string]any:
+		fn, _ := c["function"].(map[string]any)
+		if name := getString(fn, "name"); name != "" {
+			return fmt.Sprintf("You must call the function %s.", name)
+		}
+	}
+	return ""
+}
+
+// withSystemPrompt appends prompt to the leading system message, or adds one.
+func withSystemPrompt(messages []any, prompt string) []any {
+	if len(messages) > 0 {
+		if m, ok := messages[0].(map[string]any); ok && getString(m, "role") == "system" {
+			if content, err := flattenContent(m["content"]); err == nil {
+				m["content"] = content + "\n\n" + prompt
+				return messages
+			}
+		}
+	}
+	system := map[string]any{"role": "system", "content": prompt}
+	return append([]any{system}, messages...)
+}
+
+// toolHistoryAsText rewrites assistant tool calls into the markup the model
+// is asked to write, and tool results into user turns wrapped in
+// <tool_response>. Consecutive results become one turn.
+func toolHistoryAsText(messages []any, tags toolcallfix.Tags) ([]any, error) {
+	out := make([]any, 0, len(messages))
+	var responses []string
+	flush := func() {
+		if len(responses) > 0 {
+			out = append(out, map[string]any{"role": "user", "content": strings.Join(responses, "\n")})
+			responses = nil
+		}
+	}
+	for i, item := range messages {
+		m, ok := item.(map[string]any)
+		if !ok {
+			out = append(out, item)
+			continue
+		}
+		switch getString(m, "role") {
+		case "tool":
+			content, err := flattenContent(m["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d].content: %w", i, err)
+			}
+			responses = append(responses, "<tool_response>\n"+content+"\n</tool_response>")
+			continue
+		case "assistant":
+			calls, _ := m["tool_calls"].([]any)
+			if len(calls) == 0 {
+				break
+			}
+			content, err := flattenContent(m["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d].content: %w", i, err)
+			}
+			for _, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				if content != "" {
+					content += "\n"
+				}
+				content += tags.Render(toolcallfix.FunctionCall{Name: getString(fn, "name"), Arguments: getString(fn, "arguments")})
+			}
+			delete(m, "tool_calls")
+			m["content"] = content
+		}
+		flush()
+		out = append(out, m)
+	}
+	flush()
+	return out, nil
+}
+
+// toolCallsFromContent converts the tool call markup in the messages of a
+// non-streaming chat response into tool_calls, with the same transformer
+// that rewrites streams.
+func toolCallsFromContent(tenant string, rule *ModelRule, model string, tools any, raw []byte) []byte {
+	var resp map[string]any
+	if err := decodeResponse(raw, &resp); err != nil {
+		return raw
+	}
+	choices, _ := resp["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		message, _ := choice["message"].(map[string]any)
+		content, ok := message["content"].(string)
+		if !ok || content == "" {
+			continue
+		}
+		transformer, _ := toolcallfix.NewTransformerWithTags(toolCallFixFormat(tenant, rule, model), toolCallFixTags(tenant, rule, model)) // validated at load
+		if setter, ok := transformer.(toolcallfix.ToolsSetter); ok && tools != nil {
+			b, _ := json.Marshal(tools)
+			if setter.SetTools(b) == nil {
+				_ = setter.SetSchemaMode(rule.ToolCallFixSchema) // validated at load
+			}
+		}
+		var stream bytes.Buffer
+		for _, chunk := range []map[string]any{
+			{"choices": []any{map[string]any{"index": 0, "delta": map[string]any{"content": content}, "finish_reason": nil}}},
+			{"choices": []any{map[string]any{"index": 0, "delta": map[string]any{}, "finish_reason": choice["finish_reason"]}}},
+		} {
+			b, _ := json.Marshal(chunk)
+			fmt.Fprintf(&stream, "data: %s\n\n", b)
+		}
+		stream.WriteString("data: [DONE]\n\n")
+		var out bytes.Buffer
+		if err := toolcallfix.TransformStreamWith(transformer, &stream, &out); err != nil {
+			continue
+		}
+
+		var text strings.Builder
+		var calls []toolcallfix.ToolCall
+		finish := choice["finish_reason"]
+		for _, line := range strings.Split(out.String(), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+			var chunk toolcallfix.ChatCompletionChunk
+			if json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+				continue
+			}
+			text.WriteString(chunk.Choices[0].Delta.Content)
+			calls = append(calls, chunk.Choices[0].Delta.ToolCalls...)
+			if r := chunk.Choices[0].FinishReason; r != nil {
+				finish = *r
+			}
+		}
+		if len(calls) == 0 {
+			continue
+		}
+		message["tool_calls"] = calls
+		message["content"] = nil
+		if s := strings.TrimSpace(text.String()); s != "" {
+			message["content"] = s
+		}
+		choice["finish_reason"] = finish
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return raw
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const weatherTools = `[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}}]`
+
+func TestApplyToolsViaPrompt(t *testing.T) {
+	var req map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"model": "m",
+		"tools": `+weatherTools+`,
+		"tool_choice": "required",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Rome\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "1", "content": "sunny"},
+			{"role": "tool", "tool_call_id": "2", "content": "rain"}
+		]
+	}`), &req)
+	rule := &ModelRule{MatchModel: "m", EnableToolCallFix: true, ToolsViaPrompt: true}
+	tools, err := applyToolsViaPrompt(rule, req)
+	if err != nil {
+		t.Fatalf("applyToolsViaPrompt() failed: %v", err)
+	}
+	if tools == nil || req["tools"] != nil || req["tool_choice"] != nil {
+		t.Errorf("tools not moved out of the request: %v", req)
+	}
+
+	messages := req["messages"].([]any)
+	if len(messages) != 4 {
+		t.Fatalf("messages = %v, want system, user, assistant and one user turn with both results", messages)
+	}
+	content := func(i int) string { return getString(messages[i].(map[string]any), "content") }
+	for _, want := range []string{"Be brief.\n\n# Tools", `"name":"get_weather"`, "<tool_call>{function-name}\n<arg_key>{arg-key-1}</arg_key>", "You must call at least one function."} {
+		if !strings.Contains(content(0), want) {
+			t.Errorf("system prompt lacks %q:\n%s", want, content(0))
+		}
+	}
+	if want := "<tool_call>get_weather\n<arg_key>city</arg_key>\n<arg_value>Paris</arg_value>\n</tool_call>\n<tool_call>get_weather"; !strings.HasPrefix(content(2), want) {
+		t.Errorf("assistant turn = %q", content(2))
+	}
+	if messages[2].(map[string]any)["tool_calls"] != nil {
+		t.Error("assistant turn kept tool_calls")
+	}
+	if m := messages[3].(map[string]any); getString(m, "role") != "user" || content(3) != "<tool_response>\nsunny\n</tool_response>\n<tool_response>\nrain\n</tool_response>" {
+		t.Errorf("tool results turn = %v", m)
+	}
+
+	// hermes asks for JSON bodies; tool_choice "none" leaves the prompt alone
+	_ = json.Unmarshal([]byte(`{"tools":`+weatherTools+`,"messages":[{"role":"user","content":"hi"}]}`), &req)
+	_, _ = applyToolsViaPrompt(&ModelRule{ToolsViaPrompt: true, ToolCallFixFormat: "hermes"}, req)
+	if got := getString(req["messages"].([]any)[0].(map[string]any), "content"); !strings.Contains(got, `{"name": <function-name>, "arguments": <args-json-object>}`) {
+		t.Errorf("hermes system prompt = %q", got)
+	}
+	req = map[string]any{"tools": []any{map[string]any{}}, "tool_choice": "none", "messages": []any{}}
+	_, _ = applyToolsViaPrompt(rule, req)
+	if len(req["messages"].([]any)) != 0 {
+		t.Errorf("tool_choice none added a prompt: %v", req["messages"])
+	}
+}
+
+func TestToolsViaPromptResponses(t *testing.T) {
+	call := "Checking.<tool_call>get_weather<arg_key>city</arg_key><arg_value>Paris</arg_value></tool_call>"
+	var upstreamBody map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		if upstreamBody["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, chatStream("Checking.", "<tool_call>get_weather<arg_key>city</arg_key>", "<arg_value>Paris</arg_value></tool_call>"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":      "c1",
+			"object":  "chat.completion",
+			"choices": []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": call}, "finish_reason": "stop"}},
+		})
+	}))
+	defer upstream.Close()
+	mux, err := newRelayMux(&Config{
+		Upstream:   upstream.URL,
+		ModelRules: []ModelRule{{MatchModel: "m", EnableToolCallFix: true, ToolsViaPrompt: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(stream bool) string {
+		body := `{"model":"m","stream":` + map[bool]string{true: "true", false: "false"}[stream] + `,"tools":` + weatherTools + `,"messages":[{"role":"user","content":"Paris?"}]}`
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		return w.Body.String()
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					Function struct{ Name, Arguments string }
+				} `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	out := send(false)
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || len(resp.Choices) != 1 {
+		t.Fatalf("invalid response %s: %v", out, err)
+	}
+	if upstreamBody["tools"] != nil {
+		t.Errorf("upstream got tools: %v", upstreamBody["tools"])
+	}
+	c := resp.Choices[0]
+	if c.Message.Content != "Checking." || c.FinishReason != "tool_calls" || len(c.Message.ToolCalls) != 1 ||
+		c.Message.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("response = %s", out)
+	}
+
+	out = send(true)
+	if !strings.Contains(out, `"arguments":"{\"city\":\"Paris\"}"`) || !strings.Contains(out, `"finish_reason":"tool_calls"`) {
+		t.Errorf("stream = %s", out)
+	}
+}
+
+func TestValidateToolsViaPrompt(t *testing.T) {
+	for _, rule := range []ModelRule{
+		{ToolsViaPrompt: true},
+		{ToolsViaPrompt: true, EnableToolCallFix: true, ToolCallFixFormat: "deepseek"},
+		{ToolsViaPrompt: true, EnableToolCallFix: true, ToolsPrompt: "{{.Tools"},
+		{ToolsPrompt: "{{.Tools}}"},
+	} {
+		if err := validateToolsViaPrompt(&rule); err == nil {
+			t.Errorf("validateToolsViaPrompt(%+v) succeeded, want error", rule)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	spanKindInternal  = 1
+	traceparentHeader = "traceparent"
+)
+
+// requestTrace is the trace of one relayed request. The proxy records the
+// stages of the request (parse, rules, each upstream call, first token and
+// the rest of the stream) as children of the request span, and upstreams
+// join the trace through the traceparent the relay sends them.
+type requestTrace struct {
+	traceID, spanID string
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+type requestTraceKey struct{}
+
+// requestTraceFrom returns the trace of a request, or nil when tracing is
+// off. Every method is a no-op on nil.
+func requestTraceFrom(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	return t
+}
+
+// traceparent is the W3C traceparent naming the request span.
+func (t *requestTrace) traceparent() string {
+	return "00-" + t.traceID + "-" + t.spanID + "-01"
+}
+
+// traceSpan is a stage of a request in progress.
+type traceSpan struct {
+	trace *requestTrace
+	span  otlpSpan
+	attrs spanAttrs
+}
+
+// start begins a child span of the request span.
+func (t *requestTrace) start(name string, kind int) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	return &traceSpan{trace: t, span: otlpSpan{
+		TraceID:           t.traceID,
+		SpanID:            randomHex(8),
+		ParentSpanID:      t.spanID,
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(now.UnixNano(), 10),
+	}}
+}
+
+func (s *traceSpan) str(key, v string) {
+	if s != nil {
+		s.attrs.str(key, v)
+	}
+}
+
+// end finishes the span, marking it failed when err is set. Ending a span
+// twice keeps the first end.
+func (s *traceSpan) end(err error) {
+	if s == nil || s.span.EndTimeUnixNano != "" {
+		return
+	}
+	s.span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.span.Attributes = s.attrs
+	if err != nil {
+		s.span.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, s.span)
+	s.trace.mu.Unlock()
+}
+
+// endStatus finishes an upstream call span with the response status.
+func (s *traceSpan) endStatus(resp *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	if err == nil {
+		s.attrs.i64("http.response.status_code", int64(resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			s.span.Status = otlpStatus{Code: 2, Message: http.StatusText(resp.StatusCode)}
+		}
+	}
+	s.end(err)
+}
+
+// startUpstreamSpan begins the span of one upstream request and sends its
+// traceparent along, replacing the client's.
+func startUpstreamSpan(r *http.Request, req *http.Request) *traceSpan {
+	s := requestTraceFrom(r.Context()).start("upstream call", spanKindClient)
+	if s == nil {
+		return nil
+	}
+	s.str("http.request.method", req.Method)
+	s.str("server.address", req.URL.Hostname())
+	s.str("url.path", req.URL.Path)
+	req.Header.Set(traceparentHeader, "00-"+s.span.TraceID+"-"+s.span.SpanID+"-01")
+	return s
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// trailerInjector appends a rule's trailer text to each choice of a stream,
+// in the chunk that carries the choice's finish_reason. Choices that end
+// with tool calls are left alone.
+type trailerInjector struct {
+	trailer string
+
+	done map[any]bool // choice indexes that got the trailer
+	seen []any        // choice indexes in order of appearance
+	last map[string]any
+}
+
+// newTrailerInjector wraps src, or returns nil when there is no trailer.
+func newTrailerInjector(src io.Reader, trailer string) io.ReadCloser {
+	if trailer == "" {
+		return nil
+	}
+	t := &trailerInjector{trailer: trailer, done: map[any]bool{}}
+	return pipeSSE(src, t.handle)
+}
+
+func (t *trailerInjector) handle(line string) ([]string, bool) {
+	if line == "data: [DONE]" {
+		return append(t.flush(), line), true
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	t.last = chunk
+
+	changed := false
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		idx := choice["index"]
+		if _, ok := t.done[idx]; !ok {
+			t.done[idx] = false
+			t.seen = append(t.seen, idx)
+		}
+		finish := choice["finish_reason"]
+		if finish == nil || t.done[idx] {
+			continue
+		}
+		t.done[idx] = true
+		if finish == "tool_calls" {
+			continue
+		}
+		holder, field := choice, "text"
+		if getString(chunk, "object") != "text_completion" {
+			delta, _ := choice["delta"].(map[string]any)
+			if delta == nil {
+				delta = map[string]any{}
+				choice["delta"] = delta
+			}
+			holder, field = delta, "content"
+		}
+		holder[field] = getString(holder, field) + t.trailer
+		changed = true
+	}
+	if !changed {
+		return []string{line}, true
+	}
+
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{line}, true
+	}
+	return []string{"data: " + string(data)}, true
+}
+
+// flush emits the trailer for choices the stream ended without finishing.
+func (t *trailerInjector) flush() []string {
+	if t.last == nil {
+		return nil
+	}
+	var choices []any
+	for _, idx := range t.seen {
+		if t.done[idx] {
+			continue
+		}
+		choice := map[string]any{"index": idx, "finish_reason": nil}
+		if getString(t.last, "object") == "text_completion" {
+			choice["text"] = t.trailer
+		} else {
+			choice["delta"] = map[string]any{"content": t.trailer}
+		}
+		choices = append(choices, choice)
+		t.done[idx] = true
+	}
+	if len(choices) == 0 {
+		return nil
+	}
+	chunk := map[string]any{}
+	for _, k := range []string{"id", "object", "created", "model"} {
+		if v, ok := t.last[k]; ok {
+			chunk[k] = v
+		}
+	}
+	chunk["choices"] = choices
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return []string{"data: " + string(data), ""}
+}
+
+// appendTrailer adds the trailer to every choice of a non-streaming
+// response. The body is returned unchanged when it is not a completion.
+func appendTrailer(raw []byte, trailer string) []byte {
+	var resp map[string]any
+	if err := decodeResponse(raw, &resp); err != nil {
+		return raw
+	}
+	choices, ok := resp["choices"].([]any)
+	if !ok {
+		return raw
+	}
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok || choice["finish_reason"] == "tool_calls" {
+			continue
+		}
+		if msg, ok := choice["message"].(map[string]any); ok {
+			msg["content"] = getString(msg, "content") + trailer
+		} else if _, ok := choice["text"]; ok {
+			choice["text"] = getString(choice, "text") + trailer
+		}
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return raw
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrailerStream(t *testing.T) {
+	finish := "stop"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, sseChunk("t", "Hello", ""))
+		fmt.Fprintln(w)
+		if finish != "" {
+			fmt.Fprintln(w, sseChunk("t", "", finish))
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "data: [DONE]")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		finish      string
+		wantContent string
+	}{
+		{"finish chunk", "stop", "Hello\n\n[AI-generated]"},
+		{"no finish", "", "Hello\n\n[AI-generated]"},
+		{"tool calls", "tool_calls", "Hello"},
+	}
+	for _, tt := range tests {
+		finish = tt.finish
+		cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", Trailer: "\n\n[AI-generated]"}}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true}`))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+		content, _, _ := streamedContent(t, w.Body.String())
+		if content != tt.wantContent {
+			t.Errorf("%s: content = %q, want %q", tt.name, content, tt.wantContent)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(w.Body.String()), "data: [DONE]") {
+			t.Errorf("%s: stream does not end with [DONE]:\n%s", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestTrailerNonStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ModelRules: []ModelRule{{MatchModel: "m", Trailer: " -- bot"}}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Hi -- bot" {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TranscriptConfig enables persisting full request/response transcripts.
+type TranscriptConfig struct {
+	Path           string   `json:"path"`            // JSONL file backing the store
+	Retention      string   `json:"retention"`       // e.g. "168h"; empty keeps everything
+	MaxBodyBytes   int      `json:"max_body_bytes"`  // per body; default 1 MiB
+	MaxRecords     int      `json:"max_records"`     // oldest records are dropped beyond this; default 10000
+	RedactFields   []string `json:"redact_fields"`   // JSON field names masked anywhere in bodies
+	RedactPatterns []string `json:"redact_patterns"` // regexes masked in bodies and extracted text
+}
+
+const redactedValue = "[REDACTED]"
+
+// defaultMaxTranscripts bounds the records kept in memory, since without a
+// retention they would otherwise accumulate until the process runs out.
+const defaultMaxTranscripts = 10000
+
+// transcript is one relayed request and its response.
+type transcript struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	DurationMs   int64     `json:"duration_ms"`
+	Path         string    `json:"path"`
+	Model        string    `json:"model"`
+	Tenant       string    `json:"tenant"`
+	Key          string    `json:"key,omitempty"`          // client key fingerprint, never the key itself
+	Conversation string    `json:"conversation,omitempty"` // X-Conversation-Id of the request
+	Status       int       `json:"status"`
+	Stream       bool      `json:"stream"`
+	Request      string    `json:"request"`
+	Response     string    `json:"response"`
+	ResponseText string    `json:"response_text,omitempty"` // assistant text extracted from the response
+	Truncated    bool      `json:"truncated,omitempty"`
+}
+
+// transcriptStore is an embedded append-only store: records live in memory
+// for querying and are appended to a JSONL file so they survive restarts.
+type transcriptStore struct {
+	bodyRedactor
+	cfg       TranscriptConfig
+	retention time.Duration
+
+	mu      sync.Mutex
+	records []*transcript // oldest first
+	file    *os.File
+}
+
+func newTranscriptStore(cfg TranscriptConfig) (*transcriptStore, error) {
+	redactor, err := newBodyRedactor("transcripts", cfg.RedactFields, cfg.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+	s := &transcriptStore{bodyRedactor: redactor, cfg: cfg}
+	if s.cfg.MaxBodyBytes <= 0 {
+		s.cfg.MaxBodyBytes = 1 << 20
+	}
+	if s.cfg.MaxRecords <= 0 {
+		s.cfg.MaxRecords = defaultMaxTranscripts
+	}
+	if cfg.Retention != "" {
+		d, err := time.ParseDuration(cfg.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("transcripts.retention: %w", err)
+		}
+		s.retention = d
+	}
+
+	if cfg.Path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load reads existing records from the backing file, skipping corrupt lines.
+func (s *transcriptStore) load() error {
+	f, err := os.Open(s.cfg.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*s.cfg.MaxBodyBytes+64*1024)
+	for scanner.Scan() {
+		var t transcript
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			continue
+		}
+		s.records = append(s.records, &t)
+	}
+	return scanner.Err()
+}
+
+// compact drops expired records and rewrites the backing file.
+func (s *transcriptStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+
+	if s.cfg.Path == "" {
+		return nil
+	}
+	tmp := s.cfg.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, t := range s.records {
+		if err := enc.Encode(t); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmp, s.cfg.Path); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.cfg.Path, os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
+
+// pruneLocked drops the records past the retention and, beyond
+// max_records, the oldest ones.
+func (s *transcriptStore) pruneLocked(now time.Time) {
+	i := max(len(s.records)-s.cfg.MaxRecords, 0)
+	if s.retention > 0 {
+		cutoff := now.Add(-s.retention)
+		for i < len(s.records) && s.records[i].Time.Before(cutoff) {
+			i++
+		}
+	}
+	s.records = s.records[i:]
+}
+
+// compactLoop periodically enforces retention on disk.
+func (s *transcriptStore) compactLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.compact(); err != nil {
+			logf(slog.LevelError, "TRANSCRIPT: compaction failed: %v", err)
+		}
+	}
+}
+
+func (s *transcriptStore) add(t *transcript) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, t)
+	s.pruneLocked(t.Time)
+	if s.file != nil {
+		if err := json.NewEncoder(s.file).Encode(t); err != nil {
+			logf(slog.LevelError, "TRANSCRIPT: append failed: %v", err)
+		}
+	}
+}
+
+func (s *transcriptStore) get(id string) *transcript {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.records {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// transcriptQuery filters transcripts; zero values match everything.
+type transcriptQuery struct {
+	Model        string
+	Tenant       string
+	Key          string // fingerprint, or a raw key which is fingerprinted first
+	Conversation string
+	Since        time.Time
+	Until        time.Time
+	Text         string // case-insensitive search over request and response text
+	Limit        int
+}
+
+// search returns matching transcripts, newest first.
+func (s *transcriptStore) search(q transcriptQuery) []*transcript {
+	if q.Key != "" && !strings.HasPrefix(q.Key, "sha256:") {
+		q.Key = keyFingerprint(q.Key)
+	}
+	text := strings.ToLower(q.Text)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*transcript
+	for i := len(s.records) - 1; i >= 0; i-- {
+		t := s.records[i]
+		if q.Model != "" && t.Model != q.Model {
+			continue
+		}
+		if q.Tenant != "" && t.Tenant != q.Tenant {
+			continue
+		}
+		if q.Key != "" && t.Key != q.Key {
+			continue
+		}
+		if q.Conversation != "" && t.Conversation != q.Conversation {
+			continue
+		}
+		if !q.Since.IsZero() && t.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && t.Time.After(q.Until) {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(t.Request), text) &&
+			!strings.Contains(strings.ToLower(t.ResponseText), text) {
+			continue
+		}
+		out = append(out, t)
+		if q.Limit > 0 && len(out) >= q.Limit {
+			break
+		}
+	}
+	return out
+}
+
+// keyFingerprint identifies a client key without storing it.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])[:16]
+}
+
+// bodyRedactor masks secrets in the bodies the relay stores.
+type bodyRedactor struct {
+	redact []*regexp.Regexp
+	fields map[string]bool
+}
+
+// newBodyRedactor compiles the redaction settings of the config section
+// named section.
+func newBodyRedactor(section string, fields, patterns []string) (bodyRedactor, error) {
+	b := bodyRedactor{fields: map[string]bool{}}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return bodyRedactor{}, fmt.Errorf("%s.redact_patterns: %w", section, err)
+		}
+		b.redact = append(b.redact, re)
+	}
+	for _, f := range fields {
+		b.fields[f] = true
+	}
+	return b, nil
+}
+
+// redactBody masks configured fields in a JSON body (each SSE data line for
+// streams) and then applies the redaction patterns.
+func (s *bodyRedactor) redactBody(body string) string {
+	if len(s.fields) > 0 {
+		if strings.HasPrefix(strings.TrimSpace(body), "{") {
+			body = s.redactJSON(body)
+		} else {
+			lines := strings.Split(body, "\n")
+			for i, line := range lines {
+				if strings.HasPrefix(line, "data: {") {
+					lines[i] = "data: " + s.redactJSON(strings.TrimPrefix(line, "data: "))
+				}
+			}
+			body = strings.Join(lines, "\n")
+		}
+	}
+	return s.redactText(body)
+}
+
+func (s *bodyRedactor) redactJSON(body string) string {
+	var v any
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return body
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch x := v.(type) {
+		case map[string]any:
+			for k, child := range x {
+				if s.fields[k] {
+					x[k] = redactedValue
+					continue
+				}
+				walk(child)
+			}
+		case []any:
+			for _, child := range x {
+				walk(child)
+			}
+		}
+	}
+	walk(v)
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return string(out)
+}
+
+func (s *bodyRedactor) redactText(text string) string {
+	for _, re := range s.redact {
+		text = re.ReplaceAllString(text, redactedValue)
+	}
+	return text
+}
+
+// extractResponseText pulls the assistant text out of a JSON or SSE response.
+func extractResponseText(body string, stream bool) string {
+	var b strings.Builder
+	appendChoices := func(raw string) {
+		var resp struct {
+			Choices []struct {
+				Text    string `json:"text"`
+				Message struct {
+					Content any `json:"content"`
+				} `json:"message"`
+				Delta struct {
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+			return
+		}
+		for _, c := range resp.Choices {
+			b.WriteString(c.Text)
+			if s, ok := c.Message.Content.(string); ok {
+				b.WriteString(s)
+			}
+			b.WriteString(c.Delta.ReasoningContent)
+			b.WriteString(c.Delta.Content)
+		}
+	}
+	if !stream {
+		appendChoices(body)
+		return b.String()
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: {") {
+			appendChoices(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return b.String()
+}
+
+// captureWriter tees what is written to the client, up to limit bytes.
+type captureWriter struct {
+	http.ResponseWriter
+	status    int
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if room := c.limit - c.buf.Len(); room > 0 {
+		if len(p) > room {
+			c.buf.Write(p[:room])
+			c.truncated = true
+		} else {
+			c.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		c.truncated = true
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *captureWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordTranscript wraps a completion handler so every exchange is stored.
+func recordTranscript(store *transcriptStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqBody, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+		cw := &captureWriter{ResponseWriter: w, limit: store.cfg.MaxBodyBytes}
+		next(cw, r)
+
+		var meta struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		_ = json.Unmarshal(reqBody, &meta)
+
+		truncated := cw.truncated
+		if len(reqBody) > store.cfg.MaxBodyBytes {
+			reqBody = reqBody[:store.cfg.MaxBodyBytes]
+			truncated = true
+		}
+		response := cw.buf.String()
+		store.add(&transcript{
+			ID:           uuid.NewString(),
+			Time:         start,
+			DurationMs:   time.Since(start).Milliseconds(),
+			Path:         r.URL.Path,
+			Model:        meta.Model,
+			Tenant:       tenantName(r.Context()),
+			Key:          keyFingerprint(bearerToken(r)),
+			Conversation: r.Header.Get(conversationHeader),
+			Status:       cw.status,
+			Stream:       meta.Stream,
+			Request:      store.redactBody(string(reqBody)),
+			Response:     store.redactBody(response),
+			ResponseText: store.redactText(extractResponseText(response, meta.Stream)),
+			Truncated:    truncated,
+		})
+	}
+}
+
+// handleTranscripts serves GET /admin/transcripts with query filters
+// model, tenant, key, conversation, since, until (RFC 3339), q and limit.
+func handleTranscripts(store *transcriptStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if id := strings.TrimPrefix(r.URL.Path, "/admin/transcripts/"); id != r.URL.Path && id != "" {
+			t := store.get(id)
+			if t == nil {
+				writeJSONError(w, http.StatusNotFound, "transcript not found", "invalid_request_error", "not_found")
+				return
+			}
+			writeJSON(w, http.StatusOK, t)
+			return
+		}
+
+		v := r.URL.Query()
+		q := transcriptQuery{
+			Model:        v.Get("model"),
+			Tenant:       v.Get("tenant"),
+			Key:          v.Get("key"),
+			Conversation: v.Get("conversation"),
+			Text:         v.Get("q"),
+			Limit:        50,
+		}
+		for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if s := v.Get(name); s != "" {
+				t, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %v", name, err), "invalid_request_error", "invalid_parameter")
+					return
+				}
+				*dst = t
+			}
+		}
+		if s := v.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid limit", "invalid_request_error", "invalid_parameter")
+				return
+			}
+			q.Limit = n
+		}
+
+		results := store.search(q)
+		if results == nil {
+			results = []*transcript{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": results})
+	}
+}
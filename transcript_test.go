@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordTranscript(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"The secret is "}}]}`)
+		fmt.Fprintln(w, `data: {"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"sk-abcdef123456"}}]}`)
+		fmt.Fprintln(w, `data: [DONE]`)
+	}))
+	defer upstream.Close()
+
+	store, err := newTranscriptStore(TranscriptConfig{
+		RedactFields:   []string{"api_key"},
+		RedactPatterns: []string{`sk-[A-Za-z0-9]+`},
+	})
+	if err != nil {
+		t.Fatalf("newTranscriptStore() failed: %v", err)
+	}
+	handler := recordTranscript(store, func(w http.ResponseWriter, r *http.Request) {
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{}, nil)
+	})
+
+	body := `{"model":"glm","stream":true,"api_key":"hunter2","messages":[{"role":"user","content":"tell me the secret"}]}`
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer client-key-1")
+	r.Header.Set(conversationHeader, "conv-1")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if !strings.Contains(w.Body.String(), "sk-abcdef123456") {
+		t.Errorf("client response must not be redacted")
+	}
+
+	results := store.search(transcriptQuery{Model: "glm"})
+	if len(results) != 1 {
+		t.Fatalf("expected 1 transcript, got %d", len(results))
+	}
+	tr := results[0]
+	if tr.Status != http.StatusOK || !tr.Stream || tr.Path != "/v1/chat/completions" {
+		t.Errorf("unexpected metadata: %+v", tr)
+	}
+	if tr.Key != keyFingerprint("client-key-1") || strings.Contains(tr.Key, "client-key-1") {
+		t.Errorf("expected key fingerprint, got %q", tr.Key)
+	}
+	if strings.Contains(tr.Request, "hunter2") || !strings.Contains(tr.Request, redactedValue) {
+		t.Errorf("api_key field should be redacted: %s", tr.Request)
+	}
+	if strings.Contains(tr.Response, "sk-abcdef") || strings.Contains(tr.ResponseText, "sk-abcdef") {
+		t.Errorf("pattern should be redacted in stored response")
+	}
+	if tr.ResponseText != "The secret is "+redactedValue {
+		t.Errorf("unexpected response text %q", tr.ResponseText)
+	}
+
+	for name, q := range map[string]transcriptQuery{
+		"raw key":         {Key: "client-key-1"},
+		"fingerprint key": {Key: tr.Key},
+		"conversation":    {Conversation: "conv-1"},
+		"request text":    {Text: "TELL ME"},
+		"response text":   {Text: "secret is"},
+	} {
+		if got := store.search(q); len(got) != 1 {
+			t.Errorf("%s: expected 1 match, got %d", name, len(got))
+		}
+	}
+	for name, q := range map[string]transcriptQuery{
+		"other model": {Model: "other"},
+		"other key":   {Key: "client-key-2"},
+		"other conv":  {Conversation: "conv-2"},
+		"future":      {Since: time.Now().Add(time.Hour)},
+		"past":        {Until: time.Now().Add(-time.Hour)},
+		"no text":     {Text: "nowhere"},
+	} {
+		if got := store.search(q); len(got) != 0 {
+			t.Errorf("%s: expected no match, got %d", name, len(got))
+		}
+	}
+}
+
+func TestTranscriptStorePersistenceAndRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	cfg := TranscriptConfig{Path: path, Retention: "1h"}
+
+	store, err := newTranscriptStore(cfg)
+	if err != nil {
+		t.Fatalf("newTranscriptStore() failed: %v", err)
+	}
+	store.add(&transcript{ID: "old", Time: time.Now().Add(-2 * time.Hour), Model: "m"})
+	store.add(&transcript{ID: "new", Time: time.Now(), Model: "m"})
+	if store.get("old") != nil {
+		t.Errorf("expired record should be pruned on add")
+	}
+
+	reopened, err := newTranscriptStore(cfg)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	results := reopened.search(transcriptQuery{})
+	if len(results) != 1 || results[0].ID != "new" {
+		t.Errorf("expected only the unexpired record after reload, got %d", len(results))
+	}
+}
+
+func TestTranscriptStoreMaxRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	cfg := TranscriptConfig{Path: path, MaxRecords: 3}
+	store, err := newTranscriptStore(cfg)
+	if err != nil {
+		t.Fatalf("newTranscriptStore() failed: %v", err)
+	}
+	for i := range 5 {
+		store.add(&transcript{ID: fmt.Sprint(i), Time: time.Now(), Model: "m"})
+	}
+	if store.get("1") != nil || store.get("2") == nil || len(store.search(transcriptQuery{})) != 3 {
+		t.Errorf("expected the 3 newest records, got %d", len(store.search(transcriptQuery{})))
+	}
+
+	// the file still holds all five until it is compacted on reload
+	cfg.MaxRecords = 2
+	reopened, err := newTranscriptStore(cfg)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	results := reopened.search(transcriptQuery{})
+	if len(results) != 2 || results[0].ID != "4" || results[1].ID != "3" {
+		t.Errorf("expected the 2 newest records after reload, got %d", len(results))
+	}
+}
+
+func TestHandleTranscripts(t *testing.T) {
+	store, _ := newTranscriptStore(TranscriptConfig{})
+	now := time.Now()
+	store.add(&transcript{ID: "a", Time: now.Add(-time.Minute), Model: "m1"})
+	store.add(&transcript{ID: "b", Time: now, Model: "m2"})
+
+	cfg := &Config{Admin: &AdminConfig{Token: "admin-secret"}}
+	handler := adminAuth(cfg, handleTranscripts(store))
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := get("/admin/transcripts", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	if w := get("/admin/transcripts", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong token, got %d", w.Code)
+	}
+
+	w := get("/admin/transcripts?model=m2", "admin-secret")
+	var list struct {
+		Data []transcript `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != "b" {
+		t.Errorf("expected only transcript b, got %+v", list.Data)
+	}
+
+	since := now.Add(-30 * time.Second).UTC().Format(time.RFC3339)
+	w = get("/admin/transcripts?limit=5&since="+since, "admin-secret")
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 {
+		t.Errorf("since filter: expected 1 result, got %d", len(list.Data))
+	}
+
+	if w := get("/admin/transcripts?since=yesterday", "admin-secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid since, got %d", w.Code)
+	}
+	if w := get("/admin/transcripts/a", "admin-secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"m1"`) {
+		t.Errorf("expected transcript a by id, got %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/admin/transcripts/missing", "admin-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", w.Code)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transportStats counts the connection activity of one upstream so slowness
+// can be told apart from connection churn.
+type transportStats struct {
+	open     atomic.Int64 // connections currently open
+	idle     atomic.Int64 // open connections waiting in the idle pool (HTTP/1.1 only)
+	inFlight atomic.Int64 // requests whose response body is still open
+	requests atomic.Int64
+	dials    atomic.Int64
+	dialErrs atomic.Int64
+	reused   atomic.Int64
+
+	mu      sync.Mutex
+	timings map[string]*timingStats // dns, connect, tls, first_byte
+}
+
+type timingStats struct {
+	Count int64   `json:"count"`
+	AvgMS float64 `json:"avg_ms"`
+	MaxMS float64 `json:"max_ms"`
+	total time.Duration
+}
+
+func newTransportStats() *transportStats {
+	return &transportStats{timings: map[string]*timingStats{}}
+}
+
+func (s *transportStats) observe(phase string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.timings[phase]
+	if t == nil {
+		t = &timingStats{}
+		s.timings[phase] = t
+	}
+	t.Count++
+	t.total += d
+	ms := float64(d) / float64(time.Millisecond)
+	t.MaxMS = max(t.MaxMS, ms)
+	t.AvgMS = float64(t.total) / float64(time.Millisecond) / float64(t.Count)
+}
+
+// newUpstreamTransport clones the default transport, dials through dial when
+// set and counts the connections it dials.
+func newUpstreamTransport(stats *transportStats, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if dial == nil {
+		dial = tr.DialContext
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		stats.dials.Add(1)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			stats.dialErrs.Add(1)
+			return nil, err
+		}
+		stats.open.Add(1)
+		return &countedConn{Conn: conn, open: &stats.open, idleConns: &stats.idle}, nil
+	}
+	return tr
+}
+
+// countedConn decrements the open connection count once when closed, and
+// keeps the idle count while it sits in the transport's idle pool.
+type countedConn struct {
+	net.Conn
+	open      *atomic.Int64
+	idleConns *atomic.Int64
+	closed    atomic.Bool
+	idle      atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.open.Add(-1)
+		c.setIdle(false)
+	}
+	return c.Conn.Close()
+}
+
+func (c *countedConn) setIdle(idle bool) {
+	if !c.idle.CompareAndSwap(!idle, idle) {
+		return
+	}
+	if !idle {
+		c.idleConns.Add(-1)
+		return
+	}
+	c.idleConns.Add(1)
+	if c.closed.Load() {
+		// closed while being returned to the pool
+		c.setIdle(false)
+	}
+}
+
+// countedConnOf returns the countedConn under a connection the transport
+// hands out, unwrapping TLS; nil for connections not dialed by
+// newUpstreamTransport.
+func countedConnOf(conn net.Conn) *countedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	cc, _ := conn.(*countedConn)
+	return cc
+}
+
+// traced attaches an httptrace to req that feeds the phase timings and
+// follows its connection in and out of the idle pool.
+func (s *transportStats) traced(req *http.Request) *http.Request {
+	start := time.Now()
+	// dials may race several addresses, so phase starts are kept per phase
+	// and guarded
+	var mu sync.Mutex
+	starts := map[string]time.Time{}
+	var conn atomic.Pointer[countedConn]
+	begin := func(phase string) {
+		mu.Lock()
+		starts[phase] = time.Now()
+		mu.Unlock()
+	}
+	end := func(phase string, err error) {
+		mu.Lock()
+		t, ok := starts[phase]
+		mu.Unlock()
+		if ok && err == nil {
+			s.observe(phase, time.Since(t))
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { begin("dns") },
+		DNSDone:           func(info httptrace.DNSDoneInfo) { end("dns", info.Err) },
+		ConnectStart:      func(string, string) { begin("connect") },
+		ConnectDone:       func(_, _ string, err error) { end("connect", err) },
+		TLSHandshakeStart: func() { begin("tls") },
+		TLSHandshakeDone:  func(_ tls.ConnectionState, err error) { end("tls", err) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reused.Add(1)
+			}
+			if cc := countedConnOf(info.Conn); cc != nil {
+				if info.WasIdle {
+					cc.setIdle(false)
+				}
+				conn.Store(cc)
+			}
+		},
+		// HTTP/2 connections are shared and never returned to the pool, so
+		// only HTTP/1.1 connections are counted as idle
+		PutIdleConn: func(err error) {
+			if cc := conn.Load(); cc != nil && err == nil {
+				cc.setIdle(true)
+			}
+		},
+		GotFirstResponseByte: func() { s.observe("first_byte", time.Since(start)) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// do sends req through the upstream's client and keeps the in-flight count
+// until the response body is closed. With replicas, req goes to the one the
+// balancer picks.
+func (c *upstreamClient) do(req *http.Request) (*http.Response, error) {
+	return c.doLimited(req, c.send)
+}
+
+// send is do without the concurrency limit.
+func (c *upstreamClient) send(req *http.Request) (*http.Response, error) {
+	if c.lb != nil {
+		return c.doReplica(req)
+	}
+	if err := c.sign(req); err != nil {
+		return nil, err
+	}
+	c.stats.requests.Add(1)
+	c.stats.inFlight.Add(1)
+	client := c.client
+	if id := req.Header.Get(conversationHeader); id != "" {
+		client = c.pinnedClient(req.Context(), id)
+	}
+	resp, err := client.Do(c.stats.traced(req))
+	if err != nil {
+		c.stats.inFlight.Add(-1)
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, inFlight: &c.stats.inFlight}
+	c.observeAuth(req, resp.StatusCode)
+	return resp, nil
+}
+
+// doReplica sends a copy of req to a replica and marks the replica down
+// when it cannot be reached.
+func (c *upstreamClient) doReplica(req *http.Request) (*http.Response, error) {
+	rep := c.lb.pick(req.Header.Get(conversationHeader), time.Now())
+	out := req.Clone(req.Context())
+	c.lb.route(out, rep)
+	if c.opts.Host == "" {
+		out.Host = rep.url.Host
+	}
+	if err := c.sign(out); err != nil {
+		return nil, err
+	}
+	c.stats.requests.Add(1)
+	c.stats.inFlight.Add(1)
+	rep.inFlight.Add(1)
+	resp, err := c.client.Do(c.stats.traced(out))
+	if err != nil {
+		c.stats.inFlight.Add(-1)
+		rep.inFlight.Add(-1)
+		if replicaFailed(req.Context(), err) {
+			replicaFailuresTotal.Inc(c.lb.upstream, rep.url.Host)
+			c.lb.markDown(rep, err, time.Now())
+		}
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: &inFlightBody{ReadCloser: resp.Body, inFlight: &rep.inFlight}, inFlight: &c.stats.inFlight}
+	c.observeAuth(req, resp.StatusCode)
+	return resp, nil
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	inFlight *atomic.Int64
+	closed   atomic.Bool
+}
+
+func (b *inFlightBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.inFlight.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
+
+type upstreamTransportReport struct {
+	Upstream       string                 `json:"upstream"`
+	OpenConns      int64                  `json:"open_connections"`
+	IdleConns      int64                  `json:"idle_connections"`
+	ActiveRequests int64                  `json:"active_requests"`
+	Requests       int64                  `json:"requests"`
+	ReusedConns    int64                  `json:"reused_connections"`
+	Dials          int64                  `json:"dials"`
+	DialErrors     int64                  `json:"dial_errors"`
+	Timings        map[string]timingStats `json:"timings"`
+	Replicas       []replicaReport        `json:"replicas,omitempty"`
+	MaxConcurrent  int                    `json:"max_concurrent,omitempty"`
+	Queued         int                    `json:"queued,omitempty"` // requests waiting for a max_concurrent slot
+}
+
+func (c *upstreamClient) transportReport() upstreamTransportReport {
+	s := c.stats
+	rep := upstreamTransportReport{
+		Upstream:       c.url.Redacted(),
+		OpenConns:      s.open.Load(),
+		IdleConns:      s.idle.Load(),
+		ActiveRequests: s.inFlight.Load(),
+		Requests:       s.requests.Load(),
+		ReusedConns:    s.reused.Load(),
+		Dials:          s.dials.Load(),
+		DialErrors:     s.dialErrs.Load(),
+		Timings:        map[string]timingStats{},
+	}
+	if c.lb != nil {
+		rep.Replicas = c.lb.report()
+	}
+	if c.limit != nil {
+		rep.MaxConcurrent, rep.Queued = c.limit.max, c.limit.queued()
+	}
+	s.mu.Lock()
+	for phase, t := range s.timings {
+		rep.Timings[phase] = *t
+	}
+	s.mu.Unlock()
+	return rep
+}
+
+// handleTransport serves GET /admin/transport with the connection stats of
+// every upstream the relay has talked to.
+func handleTransport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data := []upstreamTransportReport{}
+	upstreamClients.Range(func(_, v any) bool {
+		data = append(data, v.(*upstreamClient).transportReport())
+		return true
+	})
+	sort.Slice(data, func(i, j int) bool { return data[i].Upstream < data[j].Upstream })
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+}
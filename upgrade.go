@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// A running relay upgrades itself on SIGUSR2: it starts the binary at its
+// own path again with the same arguments, hands the listening socket over
+// as an inherited file descriptor, and once the new process is serving it
+// stops accepting and lets the requests it still has, long agent streams
+// included, run to the end. The socket is never closed, so clients see
+// neither refused connections nor cut streams.
+const (
+	listenFDEnv = "LLM_API_RELAY_LISTEN_FD" // inherited listening socket
+	readyFDEnv  = "LLM_API_RELAY_READY_FD"  // pipe the new process reports readiness on
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Minute
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+func validateDrainTimeout(v string) error {
+	if v == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		return fmt.Errorf("invalid drain_timeout %q", v)
+	}
+	return nil
+}
+
+// listen opens the relay's listener, or takes over the one inherited from
+// the process being upgraded.
+func listen(addr string) (net.Listener, error) {
+	fd := os.Getenv(listenFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(listenFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", listenFDEnv, fd)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	logf(slog.LevelInfo, "UPGRADE: took over the listener on %s", ln.Addr())
+	return ln, nil
+}
+
+// notifyReady tells the process that started this one that it is serving.
+func notifyReady() {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	_, _ = f.Write([]byte{1})
+	f.Close()
+}
+
+// startUpgrade starts the new process with a copy of ln and waits until it
+// serves. The caller keeps serving when it fails.
+func startUpgrade(ln net.Listener) (int, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, errors.New("the listener cannot be handed over")
+	}
+	lf, err := fl.File()
+	if err != nil {
+		return 0, err
+	}
+	defer lf.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, readyW} // fds 3 and 4
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// the pipe reads EOF without a byte when the new process exits early
+	got := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := ready.Read(b)
+		got <- n == 1
+	}()
+	select {
+	case ok := <-got:
+		if ok {
+			go func() { _ = cmd.Wait() }()
+			return cmd.Process.Pid, nil
+		}
+		_ = cmd.Wait()
+		return 0, fmt.Errorf("new process exited before serving: %v", cmd.ProcessState)
+	case <-time.After(upgradeReadyTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, fmt.Errorf("new process not ready after %s", upgradeReadyTimeout)
+	}
+}
+
+// serveUntilStopped serves ln until SIGTERM or SIGINT, or until SIGUSR2
+// hands ln to a new process, then drains in-flight requests for at most
+// drain before returning.
+func serveUntilStopped(srv *http.Server, ln net.Listener, drain time.Duration) {
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// certificates come from TLSConfig.GetCertificate
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+	notifyReady()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case err := <-serveErr:
+			fatalf("%v", err)
+		case s := <-sig:
+			if s == syscall.SIGUSR2 {
+				pid, err := startUpgrade(ln)
+				if err != nil {
+					logf(slog.LevelError, "UPGRADE: failed, still serving: %v", err)
+					continue
+				}
+				logf(slog.LevelInfo, "UPGRADE: process %d is serving; draining this one", pid)
+			} else {
+				logf(slog.LevelInfo, "received %s, draining", s)
+			}
+			drainServer(srv, drain)
+			return
+		}
+	}
+}
+
+// drainServer stops accepting connections and waits for in-flight requests,
+// closing whatever is left after timeout.
+func drainServer(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logf(slog.LevelWarn, "drain did not finish within %s, closing the remaining connections", timeout)
+		_ = srv.Close()
+		return
+	}
+	logf(slog.LevelInfo, "drained")
+}
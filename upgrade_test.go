@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenInheritsSocket(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := inheritedFD(t, orig.(*net.TCPListener))
+	addr := orig.Addr().String()
+	// the old process closes its copy once the new one serves
+	orig.Close()
+
+	t.Setenv(listenFDEnv, strconv.Itoa(fd))
+	ln, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != addr {
+		t.Errorf("listening on %s, want the inherited %s", ln.Addr(), addr)
+	}
+	if os.Getenv(listenFDEnv) != "" {
+		t.Error("the fd variable is left for the next upgrade")
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestNotifyReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fd := inheritedFD(t, w)
+	w.Close()
+	t.Setenv(readyFDEnv, strconv.Itoa(fd))
+	notifyReady()
+	b, _ := io.ReadAll(r)
+	if len(b) != 1 {
+		t.Errorf("read %v from the ready pipe", b)
+	}
+}
+
+// inheritedFD duplicates the descriptor of f the way a child process would
+// inherit it: a bare fd that the code under test owns and closes. Handing it
+// f's own descriptor would close that twice, the second time whatever socket
+// another test has opened under the same number meanwhile.
+func inheritedFD(t *testing.T, f syscall.Conn) int {
+	t.Helper()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, dupErr := -1, error(nil)
+	if err := rc.Control(func(orig uintptr) { fd, dupErr = syscall.Dup(int(orig)) }); err != nil {
+		t.Fatal(err)
+	}
+	if dupErr != nil {
+		t.Fatal(dupErr)
+	}
+	return fd
+}
+
+func TestDrainServerFinishesStreams(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("data: [DONE]\n\n"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		drainServer(srv, 5*time.Second)
+		close(drained)
+	}()
+	// new connections are refused while the stream keeps going
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the stream ended")
+	default:
+	}
+	close(release)
+	if got := <-body; got != "data: first\n\ndata: [DONE]\n\n" {
+		t.Errorf("stream cut by the drain: %q", got)
+	}
+	<-drained
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// UpstreamOptions tunes how the relay talks to an upstream. Tenants with their
+// own upstream may set their own; otherwise the top-level options apply.
+type UpstreamOptions struct {
+	CompressRequests string `json:"compress_requests"`  // "off" (default), "auto" or "always"
+	CompressMinBytes int    `json:"compress_min_bytes"` // bodies below this size are sent as is (default 16384)
+
+	Resolve         []string `json:"resolve"`          // fixed IP addresses for the upstream host, skipping DNS
+	DNSServer       string   `json:"dns_server"`       // "host[:port]" of the DNS server for the upstream host
+	ResolveInterval string   `json:"resolve_interval"` // re-resolve the upstream host this often, e.g. "30s"
+
+	Host          string `json:"host"`            // Host header sent instead of the upstream URL's host
+	TLSServerName string `json:"tls_server_name"` // SNI and certificate name; defaults to host when that is set
+
+	Paths map[string]string `json:"paths"` // client path -> upstream path; "/v1/*" patterns map whole subtrees
+
+	Replicas        []Replica `json:"replicas"`         // base URLs requests are spread over instead of the upstream's
+	Balance         string    `json:"balance"`          // "round_robin" (default), "weighted" or "least_outstanding"
+	ReplicaCooldown string    `json:"replica_cooldown"` // how long an unreachable replica is skipped (default "30s")
+
+	MaxConcurrent int    `json:"max_concurrent"` // requests open against the upstream at once (0 = unlimited)
+	MaxQueue      int    `json:"max_queue"`      // requests waiting in FIFO order for a slot; more get 503 (0 = no queue)
+	QueueTimeout  string `json:"queue_timeout"`  // longest wait in the queue before 503 (default "30s")
+
+	APIKey     string `json:"api_key"`      // sent as the upstream Authorization header instead of the client's
+	APIKeyFile string `json:"api_key_file"` // file holding the key; re-read when it changes
+
+	APIKeys         []string `json:"api_keys"`          // pool used in order instead of api_key; keys answered with 401/403 are skipped
+	KeyAlertWebhook string   `json:"key_alert_webhook"` // URL a rejected pool key is reported to
+
+	UserAgent              string   `json:"user_agent"`               // sent instead of the client's User-Agent; {version} is the relay's version
+	UserAgentSuffix        string   `json:"user_agent_suffix"`        // appended to the client's User-Agent, e.g. "llm-api-relay/{version}"
+	StripHeaders           []string `json:"strip_headers"`            // client headers not forwarded; "X-Foo-*" matches a prefix
+	StripClientFingerprint bool     `json:"strip_client_fingerprint"` // drop forwarding, SDK and browser headers that identify the client
+
+	SigningKey     string `json:"signing_key"`      // HMAC-sign requests for an upstream relay with request_signing
+	SigningKeyFile string `json:"signing_key_file"` // file holding the signing key; re-read when it changes
+}
+
+const defaultCompressMinBytes = 16 << 10
+
+var requestCompressionsTotal = metrics.newCounterVec("relay_upstream_compressed_requests_total",
+	"Request bodies sent gzip-compressed to the upstream.", "upstream")
+
+func validateUpstreamOptions(o *UpstreamOptions) error {
+	if o == nil {
+		return nil
+	}
+	switch o.CompressRequests {
+	case "", "off", "auto", "always":
+	default:
+		return fmt.Errorf("unknown upstream_options.compress_requests %q", o.CompressRequests)
+	}
+	if err := validatePaths(o.Paths); err != nil {
+		return err
+	}
+	if err := validateAPIKey(o.APIKey, o.APIKeyFile); err != nil {
+		return fmt.Errorf("upstream_options: %w", err)
+	}
+	if err := validateKeyPool(o); err != nil {
+		return err
+	}
+	if err := validateReplicas(o); err != nil {
+		return err
+	}
+	if err := validateConcurrency(o); err != nil {
+		return err
+	}
+	if err := validateClientHeaders(o); err != nil {
+		return err
+	}
+	if err := validateSigningKey(o); err != nil {
+		return err
+	}
+	return validateResolveOptions(o)
+}
+
+// upstreamClient sends requests to one upstream with its options applied.
+type upstreamClient struct {
+	url    *url.URL
+	opts   UpstreamOptions
+	client *http.Client
+	stats  *transportStats
+	paths  *pathMapping
+	res    *upstreamResolver   // nil when the system resolver is used
+	keys   *keyPool            // nil without api_keys
+	lb     *balancer           // nil without replicas
+	limit  *concurrencyLimiter // nil without max_concurrent
+
+	replicas sync.Map // address -> *http.Client for conversations pinned to it
+
+	stop context.CancelFunc // ends the resolver's refresh loop; nil without one
+
+	// gzip is what the upstream told us about compressed request bodies:
+	// 0 unknown, 1 advertised through Accept-Encoding, -1 rejected with 415.
+	gzip atomic.Int32
+}
+
+// upstreamKey identifies a shared client by the upstream URL and the values
+// of its options, so configs that carry equal options in different structs,
+// such as tenants, replays and each mux built in tests, share one client.
+type upstreamKey struct {
+	url  string
+	opts string // UpstreamOptions as JSON
+}
+
+var upstreamClients sync.Map // upstreamKey -> *upstreamClient
+
+// upstreamFor returns the shared client for up under cfg's upstream options.
+func upstreamFor(cfg *Config, up *url.URL) *upstreamClient {
+	key := upstreamKey{url: up.String()}
+	if cfg.UpstreamOptions != nil {
+		b, _ := json.Marshal(cfg.UpstreamOptions)
+		key.opts = string(b)
+	}
+	if c, ok := upstreamClients.Load(key); ok {
+		return c.(*upstreamClient)
+	}
+	c := &upstreamClient{url: up, stats: newTransportStats()}
+	if cfg.UpstreamOptions != nil {
+		c.opts = *cfg.UpstreamOptions
+	}
+	c.paths = newPathMapping(c.opts.Paths)
+	c.keys = newKeyPool(c.opts)
+	c.lb = newBalancer(up, c.opts)
+	c.limit = newConcurrencyLimiter(up.Host, c.opts)
+	c.res = newUpstreamResolver(up.Hostname(), c.opts)
+	var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	if c.res != nil {
+		dial = c.res.dialContext
+	}
+	c.client = c.newClient(dial)
+	actual, loaded := upstreamClients.LoadOrStore(key, c)
+	if !loaded && c.res != nil && c.res.interval > 0 {
+		var ctx context.Context
+		ctx, c.stop = context.WithCancel(context.Background())
+		go c.res.refreshLoop(ctx, c.closeIdleConnections)
+	}
+	return actual.(*upstreamClient)
+}
+
+// closeUpstreams drops every shared client, ending their resolver loops and
+// closing their idle connections. Clients asked for afterwards are new.
+func closeUpstreams() {
+	upstreamClients.Range(func(key, v any) bool {
+		upstreamClients.Delete(key)
+		v.(*upstreamClient).close()
+		return true
+	})
+}
+
+// close ends the client's resolver loop and closes its idle connections.
+func (c *upstreamClient) close() {
+	if c.stop != nil {
+		c.stop()
+	}
+	c.closeIdleConnections()
+}
+
+// newClient returns a client for the upstream that dials through dial.
+func (c *upstreamClient) newClient(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	tr := newUpstreamTransport(c.stats, dial)
+	if name := c.serverName(); name != "" {
+		tr.TLSClientConfig = &tls.Config{ServerName: name}
+	}
+	return &http.Client{Transport: tr, Timeout: 0}
+}
+
+// closeIdleConnections drops the idle connections of every client, so the
+// next requests dial the addresses the resolver returns now.
+func (c *upstreamClient) closeIdleConnections() {
+	c.client.CloseIdleConnections()
+	c.replicas.Range(func(_, v any) bool {
+		v.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
+
+// host is the Host header for requests to the upstream.
+func (c *upstreamClient) host() string {
+	if c.opts.Host != "" {
+		return c.opts.Host
+	}
+	return c.url.Host
+}
+
+// serverName is the TLS server name to present and verify, or "" for the
+// name in the upstream URL.
+func (c *upstreamClient) serverName() string {
+	if c.opts.TLSServerName != "" {
+		return c.opts.TLSServerName
+	}
+	if c.opts.Host != "" {
+		if h, _, err := net.SplitHostPort(c.opts.Host); err == nil {
+			return h
+		}
+		return c.opts.Host
+	}
+	return ""
+}
+
+// shouldCompress decides whether a body of n bytes is sent gzip-compressed.
+func (c *upstreamClient) shouldCompress(n int) bool {
+	min := c.opts.CompressMinBytes
+	if min <= 0 {
+		min = defaultCompressMinBytes
+	}
+	if n < min || c.gzip.Load() < 0 {
+		return false
+	}
+	switch c.opts.CompressRequests {
+	case "always":
+		return true
+	case "auto":
+		return c.gzip.Load() > 0
+	}
+	return false
+}
+
+// doJSON sends body to the upstream, switching to the next pooled api key
+// when the one used is rejected.
+func (c *upstreamClient) doJSON(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := c.doJSONOnce(req, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.retryWithNextKey(req, resp, func() (*http.Response, error) { return c.doJSONOnce(req, body) })
+}
+
+// doJSONOnce sends body to the upstream, compressing it when the options and
+// the upstream allow. An upstream that rejects the compressed body with 415
+// gets it again uncompressed and is not sent compressed bodies afterwards.
+func (c *upstreamClient) doJSONOnce(req *http.Request, body []byte) (*http.Response, error) {
+	if c.shouldCompress(len(body)) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		zreq := req.Clone(req.Context())
+		zreq.Header.Set("Content-Encoding", "gzip")
+		setRequestBody(zreq, buf.Bytes())
+		resp, err := c.do(zreq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			vlogCtx(req.Context(), "UPSTREAM: sent %d bytes gzip-compressed to %s (was %d)", buf.Len(), c.url.Host, len(body))
+			requestCompressionsTotal.Inc(c.url.Host)
+			c.learn(resp)
+			return resp, nil
+		}
+		resp.Body.Close()
+		vlogCtx(req.Context(), "UPSTREAM: %s rejected a gzip body, sending uncompressed from now on", c.url.Host)
+		c.gzip.Store(-1)
+	}
+	req.Header.Del("Content-Encoding")
+	setRequestBody(req, body)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.learn(resp)
+	return resp, nil
+}
+
+// learn records an Accept-Encoding response header (RFC 7694) that
+// advertises gzip request bodies.
+func (c *upstreamClient) learn(resp *http.Response) {
+	if c.gzip.Load() != 0 {
+		return
+	}
+	for _, v := range resp.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]), "gzip") {
+				c.gzip.Store(1)
+				return
+			}
+		}
+	}
+}
+
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestCompression(t *testing.T) {
+	var encodings []string
+	reject := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, enc)
+		if enc == "gzip" && reject {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var body io.Reader = r.Body
+		if enc == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+				return
+			}
+			body = zr
+		}
+		var payload map[string]any
+		if err := json.NewDecoder(body).Decode(&payload); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+		w.Header().Set("Accept-Encoding", "gzip")
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	big := fmt.Sprintf(`{"model":"m","prompt":%q}`, strings.Repeat("x", 100))
+	send := func(cfg *Config) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(big))
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, cfg, nil)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		opts   *UpstreamOptions
+		reject bool
+		want   []string
+	}{
+		{"off", nil, false, []string{"", ""}},
+		{"always", &UpstreamOptions{CompressRequests: "always", CompressMinBytes: 10}, false, []string{"gzip", "gzip"}},
+		{"auto learns from response", &UpstreamOptions{CompressRequests: "auto", CompressMinBytes: 10}, false, []string{"", "gzip"}},
+		{"below min size", &UpstreamOptions{CompressRequests: "always", CompressMinBytes: 1000}, false, []string{"", ""}},
+		{"rejected", &UpstreamOptions{CompressRequests: "always", CompressMinBytes: 10}, true, []string{"gzip", "", ""}},
+	}
+	for _, tt := range tests {
+		encodings, reject = nil, tt.reject
+		cfg := &Config{UpstreamOptions: tt.opts}
+		for range 2 {
+			if code := send(cfg); code != http.StatusOK {
+				t.Errorf("%s: status = %d", tt.name, code)
+			}
+		}
+		if fmt.Sprint(encodings) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: encodings = %q, want %q", tt.name, encodings, tt.want)
+		}
+	}
+}
+
+func TestHostAndSNIOverride(t *testing.T) {
+	var host, sni string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, sni = r.Host, r.TLS.ServerName
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	// the test certificate is valid for example.com
+	cfg := &Config{UpstreamOptions: &UpstreamOptions{Host: "llm.internal:8443", TLSServerName: "example.com"}}
+	up := parseURL(upstream.URL)
+	tr := upstreamFor(cfg, up).client.Transport.(*http.Transport)
+	tr.TLSClientConfig.RootCAs = upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	proxyWithJSONPatch(w, r, up, false, cfg, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if host != "llm.internal:8443" || sni != "example.com" {
+		t.Errorf("Host/SNI = %q/%q, want llm.internal:8443/example.com", host, sni)
+	}
+
+	o := &UpstreamOptions{Host: "llm.internal:8443"}
+	if name := (&upstreamClient{opts: *o}).serverName(); name != "llm.internal" {
+		t.Errorf("serverName = %q, want the host override without port", name)
+	}
+}
+
+func TestUpstreamClientCache(t *testing.T) {
+	up := parseURL("http://llm.invalid")
+	opts := func() *UpstreamOptions {
+		return &UpstreamOptions{ResolveInterval: "1h", Paths: map[string]string{"/v1/*": "/api/*"}}
+	}
+	c := upstreamFor(&Config{UpstreamOptions: opts()}, up)
+	if upstreamFor(&Config{UpstreamOptions: opts()}, up) != c {
+		t.Error("equal options in another struct got a new client")
+	}
+	if upstreamFor(&Config{UpstreamOptions: &UpstreamOptions{ResolveInterval: "2h"}}, up) == c {
+		t.Error("different options share a client")
+	}
+	if c.stop == nil {
+		t.Fatal("no refresh loop started")
+	}
+
+	closeUpstreams()
+	if upstreamFor(&Config{UpstreamOptions: opts()}, up) == c {
+		t.Error("closed client still cached")
+	}
+	closeUpstreams()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// usageWriter tracks the status code and token usage of a proxied response.
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+	stream bool
+	buf    bytes.Buffer
+	usage  tokenUsage
+	bytes  int // body bytes written to the client
+
+	finishReason string // last finish_reason the response carried
+	streamError  bool   // a stream ended with an error event
+
+	start     time.Time
+	firstByte time.Duration // until the first body byte was written
+
+	// output counts the streamed text, for upstreams that report no usage;
+	// onOutput is told the running count
+	output   *tokenCounter
+	onOutput func(n int)
+}
+
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// maxUsageBodyBytes caps how much of a non-streaming body is kept to find usage.
+const maxUsageBodyBytes = 4 << 20
+
+func (u *usageWriter) WriteHeader(status int) {
+	if u.status == 0 {
+		u.status = status
+	}
+	u.ResponseWriter.WriteHeader(status)
+}
+
+func (u *usageWriter) Write(p []byte) (int, error) {
+	if u.status == 0 {
+		u.status = http.StatusOK
+	}
+	if u.bytes == 0 && len(p) > 0 {
+		u.firstByte = time.Since(u.start)
+	}
+	u.bytes += len(p)
+	if !u.stream {
+		if u.buf.Len()+len(p) <= maxUsageBodyBytes {
+			u.buf.Write(p)
+		}
+		return u.ResponseWriter.Write(p)
+	}
+
+	// Streaming: inspect complete SSE lines and keep only the unfinished tail.
+	u.buf.Write(p)
+	for {
+		line, err := u.buf.ReadBytes('\n')
+		if err != nil {
+			u.buf.Reset()
+			u.buf.Write(line)
+			break
+		}
+		if bytes.HasPrefix(line, []byte(`data: {"error"`)) {
+			u.streamError = true
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("data: {")) {
+			continue
+		}
+		if bytes.Contains(line, []byte(`"usage"`)) || bytes.Contains(line, []byte(`"finish_reason":"`)) {
+			u.parseUsage(bytes.TrimPrefix(line, []byte("data: ")))
+		}
+		if u.output != nil && u.usage == (tokenUsage{}) {
+			u.countOutput(bytes.TrimPrefix(line, []byte("data: ")))
+		}
+	}
+	return u.ResponseWriter.Write(p)
+}
+
+func (u *usageWriter) Flush() {
+	if f, ok := u.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// parseUsage picks the usage and finish_reason out of a response body or
+// stream chunk.
+func (u *usageWriter) parseUsage(raw []byte) {
+	var body struct {
+		Usage   *tokenUsage `json:"usage"`
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(raw, &body) != nil {
+		return
+	}
+	if body.Usage != nil {
+		u.usage = *body.Usage
+	}
+	for _, c := range body.Choices {
+		if c.FinishReason != "" {
+			u.finishReason = c.FinishReason
+		}
+	}
+}
+
+// countOutput adds the text of a stream chunk to the output estimate.
+func (u *usageWriter) countOutput(raw []byte) {
+	var chunk struct {
+		Choices []struct {
+			Text  string `json:"text"`
+			Delta struct {
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(raw, &chunk) != nil {
+		return
+	}
+	before := u.output.tokens()
+	for _, c := range chunk.Choices {
+		u.output.add(c.Text)
+		u.output.add(c.Delta.Content)
+		u.output.add(c.Delta.ReasoningContent)
+	}
+	if n := u.output.tokens(); n != before && u.onOutput != nil {
+		u.onOutput(n)
+	}
+}
+
+// requestMeta is the part of a completion request every wrapper needs.
+type requestMeta struct {
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
+}
+
+// readRequestMeta reads the request body, restores it for the next handler
+// and decodes the model and stream flag.
+func readRequestMeta(r *http.Request) (requestMeta, []byte, error) {
+	var meta requestMeta
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return meta, nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	_ = json.Unmarshal(body, &meta)
+	return meta, body, nil
+}
+
+// recordUsage wraps a completion handler, accounts and prices each request
+// and its token usage per tenant and model, counts it against the SLOs in cfg
+// and queues a record for every exporter, the event log and the usage ledger.
+func recordUsage(cfg *Config, exporters []*exporter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		meta, body, err := readRequestMeta(r)
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		info := requestInfoFrom(r.Context())
+		if info == nil {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		}
+
+		ruleCfg := cfg
+		if t := tenantFromContext(r.Context()); t != nil {
+			ruleCfg = t.cfg
+		}
+		rule := resolveRule(ruleCfg, meta.Model)
+		model := metricModel(rule)
+
+		uw := &usageWriter{ResponseWriter: w, stream: meta.Stream, start: start}
+		var tok *tokenizer
+		if meta.Stream {
+			tok = ruleTokenizer(rule)
+			uw.output, uw.onOutput = tok.newCounter(), info.outputTokens
+		}
+		next(uw, r)
+		if !meta.Stream {
+			uw.parseUsage(uw.buf.Bytes())
+		} else if uw.usage == (tokenUsage{}) && uw.status == http.StatusOK && uw.output.tokens() > 0 {
+			// the upstream reported no usage; count the stream as estimated
+			// rather than as free
+			var payload map[string]any
+			_ = json.Unmarshal(body, &payload)
+			prompt, completion := tok.count(promptText(payload)), uw.output.tokens()
+			uw.usage = tokenUsage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+			estimatedUsageTotal.Inc(tenantName(r.Context()), model)
+			vlogCtx(r.Context(), "USAGE: no usage reported for the stream of model '%s', estimated %d prompt and %d completion tokens with the %s tokenizer",
+				meta.Model, prompt, completion, tok.name)
+		}
+
+		info.usage = uw.usage
+		tenant := tenantName(r.Context())
+		client := info.client
+		if client == "" {
+			client = keyFingerprint(bearerToken(r))
+		}
+		cost, priced := requestCost(cfg.Prices, meta.Model, info.upstreamModel, uw.usage)
+		if priced {
+			info.cost = cost
+			costTotal.Add(cost, tenant, client, model)
+		}
+		cfg.events.record(r, info, meta, start, len(body), uw)
+		cfg.usage.add(usageKey{Hour: start.UTC().Truncate(time.Hour).Unix(), Tenant: tenant, Client: client, Model: meta.Model}, uw.usage, cost)
+		requestsTotal.Inc(tenant, model, strconv.Itoa(uw.status))
+		tokensTotal.Add(float64(uw.usage.PromptTokens), tenant, model, "prompt")
+		tokensTotal.Add(float64(uw.usage.CompletionTokens), tenant, model, "completion")
+		observeWorkload(tenant, model, body, uw)
+		if meta.Stream && uw.status == http.StatusOK {
+			generationSpeeds.observe(model, uw.firstByte, time.Since(start), uw.usage.CompletionTokens)
+		}
+		slos.observe(cfg, meta.Model, uw.status, uw.firstByte)
+		observeExperiments(info, uw.status, uw.usage, cost, priced, time.Since(start))
+
+		rec := requestRecord{
+			Time:             start.UTC(),
+			Path:             r.URL.Path,
+			Model:            meta.Model,
+			Tenant:           tenant,
+			Key:              keyFingerprint(bearerToken(r)),
+			Status:           uw.status,
+			Stream:           meta.Stream,
+			LatencyMs:        time.Since(start).Milliseconds(),
+			PromptTokens:     uw.usage.PromptTokens,
+			CompletionTokens: uw.usage.CompletionTokens,
+			TotalTokens:      uw.usage.TotalTokens,
+		}
+		for _, e := range exporters {
+			e.add(rec)
+		}
+	}
+}
+
+// unmatchedModel is the model label of requests for a model no rule
+// matches.
+const unmatchedModel = "unmatched"
+
+// metricModel is the model label of the request metrics: the rule the
+// requested model matches. Model names come from clients, so labelling with
+// them would let any client create series without bound.
+func metricModel(rule *ModelRule) string {
+	if rule == nil {
+		return unmatchedModel
+	}
+	return ruleName(rule)
+}
+
+// observeWorkload records the shape of a request and its response in the
+// size, message count and token histograms.
+func observeWorkload(tenant, model string, body []byte, uw *usageWriter) {
+	requestBytes.Observe(float64(len(body)), tenant, model)
+	responseBytes.Observe(float64(uw.bytes), tenant, model)
+	var req struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if json.Unmarshal(body, &req) == nil && req.Messages != nil {
+		requestMessages.Observe(float64(len(req.Messages)), tenant, model)
+	}
+	// upstreams that report no usage would skew the token distributions
+	if uw.usage.PromptTokens > 0 || uw.usage.CompletionTokens > 0 {
+		promptTokens.Observe(float64(uw.usage.PromptTokens), tenant, model)
+		completionTokens.Observe(float64(uw.usage.CompletionTokens), tenant, model)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageLedgerConfig keeps hourly token totals per tenant, client and model,
+// queryable at /admin/usage. Without a path the totals live in memory and
+// are lost on restart.
+type UsageLedgerConfig struct {
+	Path  string `json:"path"`  // JSON lines file; "" keeps the totals in memory
+	Flush string `json:"flush"` // how often buffered totals are written to the file (default "10s")
+}
+
+const defaultUsageFlush = 10 * time.Second
+
+// usageGroupings are the dimensions /admin/usage can group by.
+var usageGroupings = []string{"hour", "day", "tenant", "client", "model"}
+
+var usageLedgerErrorsTotal = metrics.newCounterVec("relay_usage_ledger_errors_total",
+	"Failed writes of buffered usage totals to the usage ledger file.", "path")
+
+func validateUsageLedger(c *UsageLedgerConfig) error {
+	if c == nil || c.Flush == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.Flush); err != nil || d <= 0 {
+		return fmt.Errorf("usage_ledger.flush: invalid duration %q", c.Flush)
+	}
+	return nil
+}
+
+// usageKey is one row of the ledger: the hour a request started in and who
+// made it.
+type usageKey struct {
+	Hour   int64 // unix seconds at the start of the hour, UTC
+	Tenant string
+	Client string // client key name, or the token fingerprint without client_keys
+	Model  string
+}
+
+type usageTotals struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"` // from the prices table
+}
+
+func (t *usageTotals) add(o usageTotals) {
+	t.Requests += o.Requests
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+	t.Cost += o.Cost
+}
+
+// usageLedger sums usage in memory. With a file the sums are appended to it
+// periodically as JSON lines, one per row and flush, which are added up
+// again when the ledger is opened.
+type usageLedger struct {
+	path     string // "" keeps everything in memory
+	interval time.Duration
+
+	mu      sync.Mutex
+	rows    map[usageKey]*usageTotals // written to the file, or everything without one
+	pending map[usageKey]*usageTotals // not written yet
+	file    *os.File
+}
+
+// usageEntry is one line of the ledger file.
+type usageEntry struct {
+	Hour   int64  `json:"hour"`
+	Tenant string `json:"tenant"`
+	Client string `json:"client"`
+	Model  string `json:"model"`
+	usageTotals
+}
+
+// openUsageLedger reads the totals in c.Path and compacts the file to one
+// line per row.
+func openUsageLedger(c UsageLedgerConfig) (*usageLedger, error) {
+	l := &usageLedger{path: c.Path, interval: defaultUsageFlush, rows: map[usageKey]*usageTotals{}, pending: map[usageKey]*usageTotals{}}
+	if c.Flush != "" {
+		l.interval, _ = time.ParseDuration(c.Flush) // validated at load
+	}
+	if c.Path == "" {
+		return l, nil
+	}
+	if err := l.load(); err != nil {
+		return nil, fmt.Errorf("open usage ledger %s: %w", c.Path, err)
+	}
+	if err := l.compact(); err != nil {
+		return nil, fmt.Errorf("open usage ledger %s: %w", c.Path, err)
+	}
+	return l, nil
+}
+
+// load adds up the lines of the ledger file, skipping a line cut short by
+// a crash. A file that does not start with a JSON object is refused rather
+// than compacted away.
+func (l *usageLedger) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(1); len(head) > 0 && head[0] != '{' {
+		return errors.New("not a JSON lines usage ledger")
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e usageEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			logf(slog.LevelWarn, "USAGE: skipping a corrupt line in %s: %v", l.path, err)
+			continue
+		}
+		mergeUsage(l.rows, usageKey{Hour: e.Hour, Tenant: e.Tenant, Client: e.Client, Model: e.Model}, e.usageTotals)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the file with one line per row and opens it for
+// appending.
+func (l *usageLedger) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeUsage(l.rows)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
+
+func encodeUsage(rows map[usageKey]*usageTotals) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for k, t := range rows {
+		_ = enc.Encode(usageEntry{k.Hour, k.Tenant, k.Client, k.Model, *t})
+	}
+	return buf.Bytes()
+}
+
+// mergeUsage adds t to the row k of rows.
+func mergeUsage(rows map[usageKey]*usageTotals, k usageKey, t usageTotals) {
+	sum := rows[k]
+	if sum == nil {
+		sum = &usageTotals{}
+		rows[k] = sum
+	}
+	sum.add(t)
+}
+
+// add counts one request.
+func (l *usageLedger) add(k usageKey, u tokenUsage, cost float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	mergeUsage(l.pending, k, usageTotals{Requests: 1, PromptTokens: int64(u.PromptTokens), CompletionTokens: int64(u.CompletionTokens), TotalTokens: int64(u.TotalTokens), Cost: cost})
+}
+
+// flush appends the pending totals to the file in one write. On failure
+// they stay pending and are retried with the next flush.
+func (l *usageLedger) flush(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		return nil
+	}
+	if l.file != nil {
+		if _, err := l.file.Write(encodeUsage(l.pending)); err != nil {
+			usageLedgerErrorsTotal.Inc(l.path)
+			return err
+		}
+	}
+	for k, t := range l.pending {
+		mergeUsage(l.rows, k, *t)
+	}
+	l.pending = map[usageKey]*usageTotals{}
+	return nil
+}
+
+// run flushes the pending totals every interval until ctx is done.
+func (l *usageLedger) run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.flush(ctx); err != nil {
+			logf(slog.LevelWarn, "USAGE: flush to %s failed, retrying later: %v", l.path, err)
+		}
+	}
+}
+
+// usageQuery selects ledger rows by the hour they fall in, [From, To), and
+// by exact tenant, client and model where those are set.
+type usageQuery struct {
+	From, To              time.Time
+	Tenant, Client, Model string
+	GroupBy               []string
+}
+
+type usageRow struct {
+	Time   string `json:"time,omitempty"` // start of the hour or day, RFC 3339
+	Tenant string `json:"tenant,omitempty"`
+	Client string `json:"client,omitempty"`
+	Model  string `json:"model,omitempty"`
+	usageTotals
+}
+
+func (q usageQuery) matches(k usageKey) bool {
+	return (q.From.IsZero() || k.Hour >= q.From.Unix()) &&
+		(q.To.IsZero() || k.Hour < q.To.Unix()) &&
+		(q.Tenant == "" || k.Tenant == q.Tenant) &&
+		(q.Client == "" || k.Client == q.Client) &&
+		(q.Model == "" || k.Model == q.Model)
+}
+
+// query sums the matching rows by q.GroupBy, ordered by the grouped fields.
+func (l *usageLedger) query(ctx context.Context, q usageQuery) ([]usageRow, error) {
+	if err := l.flush(ctx); err != nil {
+		return nil, err
+	}
+	rows := map[usageRow]*usageTotals{}
+	collect := func(k usageKey, t usageTotals) {
+		if !q.matches(k) {
+			return
+		}
+		var row usageRow
+		for _, g := range q.GroupBy {
+			switch g {
+			case "hour":
+				row.Time = time.Unix(k.Hour, 0).UTC().Format(time.RFC3339)
+			case "day":
+				row.Time = time.Unix(k.Hour, 0).UTC().Truncate(24 * time.Hour).Format(time.RFC3339)
+			case "tenant":
+				row.Tenant = k.Tenant
+			case "client":
+				row.Client = k.Client
+			case "model":
+				row.Model = k.Model
+			}
+		}
+		sum := rows[row]
+		if sum == nil {
+			sum = &usageTotals{}
+			rows[row] = sum
+		}
+		sum.add(t)
+	}
+
+	l.mu.Lock()
+	for k, t := range l.rows {
+		collect(k, *t)
+	}
+	l.mu.Unlock()
+
+	out := make([]usageRow, 0, len(rows))
+	for row, t := range rows {
+		row.usageTotals = *t
+		out = append(out, row)
+	}
+	slices.SortFunc(out, func(a, b usageRow) int {
+		return strings.Compare(a.Time+"\x00"+a.Tenant+"\x00"+a.Client+"\x00"+a.Model,
+			b.Time+"\x00"+b.Tenant+"\x00"+b.Client+"\x00"+b.Model)
+	})
+	return out, nil
+}
+
+// parseUsageTime accepts RFC 3339 times and plain dates, which mean
+// midnight UTC.
+func parseUsageTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// handleUsage serves GET /admin/usage. from and to bound the hours counted
+// (to is exclusive), tenant, client and model filter, and group_by lists the
+// dimensions to sum by (default client,model).
+func handleUsage(l *usageLedger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v := r.URL.Query()
+		q := usageQuery{Tenant: v.Get("tenant"), Client: v.Get("client"), Model: v.Get("model"), GroupBy: []string{"client", "model"}}
+		for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+			if s := v.Get(name); s != "" {
+				t, err := parseUsageTime(s)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %q (want RFC 3339 or YYYY-MM-DD)", name, s), "invalid_request_error", "invalid_parameter")
+					return
+				}
+				*dst = t
+			}
+		}
+		if s := v.Get("group_by"); s != "" {
+			q.GroupBy = strings.Split(s, ",")
+			for _, g := range q.GroupBy {
+				if !slices.Contains(usageGroupings, g) {
+					writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid group_by %q (want %s)", g, strings.Join(usageGroupings, ", ")), "invalid_request_error", "invalid_parameter")
+					return
+				}
+			}
+			if slices.Contains(q.GroupBy, "hour") && slices.Contains(q.GroupBy, "day") {
+				writeJSONError(w, http.StatusBadRequest, "group_by cannot have both hour and day", "invalid_request_error", "invalid_parameter")
+				return
+			}
+		}
+
+		rows, err := l.query(r.Context(), q)
+		if err != nil {
+			logCtxf(r.Context(), slog.LevelError, "USAGE: query failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "usage query failed", "server_error", "usage_query_failed")
+			return
+		}
+		var total usageTotals
+		for _, row := range rows {
+			total.add(row.usageTotals)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": rows, "total": total})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageLedger(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintln(w, `data: {"choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`)
+			fmt.Fprintln(w, `data: {"choices":[],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}`)
+			fmt.Fprintln(w, `data: [DONE]`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8,"cost":0}}`)
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	cfg := &Config{
+		Upstream:    upstream.URL,
+		Admin:       &AdminConfig{Token: "admin"},
+		ClientKeys:  []ClientKey{{Key: "sk-alice", Name: "alice"}, {Key: "sk-bob", Name: "bob"}},
+		UsageLedger: &UsageLedgerConfig{Path: path},
+	}
+	mux, err := newRelayMux(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := loggingMiddleware(mux) // records the client key name
+	for _, req := range []struct{ key, body string }{
+		{"sk-alice", `{"model":"a","messages":[]}`},
+		{"sk-alice", `{"model":"a","messages":[],"stream":true}`},
+		{"sk-alice", `{"model":"b","messages":[]}`},
+		{"sk-bob", `{"model":"a","messages":[]}`},
+	} {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(req.body))
+		r.Header.Set("Authorization", "Bearer "+req.key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	query := func(params string) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/admin/usage"+params, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	want := `{"data":[` +
+		`{"client":"alice","model":"a","requests":2,"prompt_tokens":12,"completion_tokens":5,"total_tokens":17,"cost":0},` +
+		`{"client":"alice","model":"b","requests":1,"prompt_tokens":5,"completion_tokens":3,"total_tokens":8,"cost":0},` +
+		`{"client":"bob","model":"a","requests":1,"prompt_tokens":5,"completion_tokens":3,"total_tokens":8,"cost":0}],` +
+		`"total":{"requests":4,"prompt_tokens":22,"completion_tokens":11,"total_tokens":33,"cost":0}}`
+	if code, body := query(""); code != http.StatusOK || body != want {
+		t.Errorf("got %d %s\nwant %s", code, body, want)
+	}
+
+	// the totals survive a restart
+	if err := cfg.usage.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openUsageLedger(UsageLedgerConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := reopened.query(context.Background(), usageQuery{Model: "a", GroupBy: []string{"model"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Requests != 3 || rows[0].TotalTokens != 25 {
+		t.Errorf("after reopening: %+v", rows)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Format(time.DateOnly)
+	if _, body := query("?group_by=day&client=bob&from=" + today + "&to=" + tomorrow); !strings.Contains(body, `"time":"`+today+`T00:00:00Z","requests":1,`) {
+		t.Errorf("bob today: %s", body)
+	}
+	if _, body := query("?from=" + tomorrow); body != `{"data":[],"total":{"requests":0,"prompt_tokens":0,"completion_tokens":0,"total_tokens":0,"cost":0}}` {
+		t.Errorf("from tomorrow: %s", body)
+	}
+	for _, params := range []string{"?from=yesterday", "?group_by=key", "?group_by=hour,day"} {
+		if code, _ := query(params); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", params, code)
+		}
+	}
+}
+
+func TestUsageLedgerInMemory(t *testing.T) {
+	l, err := openUsageLedger(UsageLedgerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Date(2025, 1, 7, 8, 0, 0, 0, time.UTC)
+	for i, k := range []usageKey{
+		{Hour: hour.Unix(), Client: "sha256:1", Model: "a"},
+		{Hour: hour.Unix(), Client: "sha256:1", Model: "a"},
+		{Hour: hour.Add(time.Hour).Unix(), Client: "sha256:1", Model: "a"},
+		{Hour: hour.Add(time.Hour).Unix(), Tenant: "t", Client: "sha256:2", Model: "a"},
+	} {
+		l.add(k, tokenUsage{PromptTokens: i, TotalTokens: i}, 0)
+	}
+	rows, err := l.query(context.Background(), usageQuery{From: hour.Add(time.Hour), GroupBy: []string{"hour", "tenant"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Tenant != "" || rows[0].TotalTokens != 2 || rows[1].Tenant != "t" || rows[1].Time != "2025-01-07T09:00:00Z" {
+		t.Errorf("rows %+v", rows)
+	}
+	rows, _ = l.query(context.Background(), usageQuery{To: hour.Add(time.Hour), GroupBy: []string{"client"}})
+	if len(rows) != 1 || rows[0].Requests != 2 || rows[0].PromptTokens != 1 {
+		t.Errorf("rows %+v", rows)
+	}
+
+	if validateUsageLedger(&UsageLedgerConfig{Flush: "0s"}) == nil {
+		t.Error("accepted a zero flush interval")
+	}
+}
+
+func TestUsageLedgerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	// a repeated row and a line cut short by a crash
+	lines := `{"hour":0,"tenant":"","client":"c","model":"m","requests":1,"prompt_tokens":1,"completion_tokens":1,"total_tokens":2,"cost":0}
+{"hour":0,"tenant":"","client":"c","model":"m","requests":2,"prompt_tokens":2,"completion_tokens":2,"total_tokens":4,"cost":0.25}
+{"hour":0,"tenant":"","client":"c","mo`
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := openUsageLedger(UsageLedgerConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.add(usageKey{Client: "c", Model: "m"}, tokenUsage{TotalTokens: 2}, 0.5)
+	if err := l.flush(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openUsageLedger(UsageLedgerConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := reopened.query(t.Context(), usageQuery{GroupBy: []string{"client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Requests != 4 || rows[0].TotalTokens != 8 || rows[0].Cost != 0.75 {
+		t.Errorf("rows %+v", rows)
+	}
+	if b, _ := os.ReadFile(path); strings.Count(string(b), "\n") != 1 {
+		t.Errorf("file not compacted on open:\n%s", b)
+	}
+
+	other := filepath.Join(t.TempDir(), "usage.db")
+	if err := os.WriteFile(other, []byte("\x00\x01 binary data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openUsageLedger(UsageLedgerConfig{Path: other}); err == nil || !strings.Contains(err.Error(), "not a JSON lines usage ledger") {
+		t.Errorf("opened a file that is not a ledger: %v", err)
+	}
+	if b, _ := os.ReadFile(other); string(b) != "\x00\x01 binary data" {
+		t.Error("file that is not a ledger was rewritten")
+	}
+}
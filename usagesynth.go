@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// usageSynthesizer adds an estimated usage chunk before [DONE] when the
+// upstream streams none, so usage accounting works with backends that
+// ignore stream_options.include_usage.
+type usageSynthesizer struct {
+	promptTokens int
+	output       *tokenCounter
+	seen         bool           // the upstream sent usage itself
+	last         map[string]any // envelope of the latest chunk
+}
+
+// newUsageSynthesizer wraps src, or returns nil when the rule does not set
+// synthesize_usage.
+func newUsageSynthesizer(src io.Reader, rule *ModelRule, payload map[string]any) io.ReadCloser {
+	if rule == nil || !rule.SynthesizeUsage {
+		return nil
+	}
+	t := ruleTokenizer(rule)
+	u := &usageSynthesizer{promptTokens: t.count(promptText(payload)), output: t.newCounter()}
+	return pipeSSE(src, u.handle)
+}
+
+func (u *usageSynthesizer) handle(line string) ([]string, bool) {
+	if line == "data: [DONE]" {
+		if u.seen || u.last == nil {
+			return []string{line}, true
+		}
+		completion := u.output.tokens()
+		chunk := map[string]any{
+			"id":      u.last["id"],
+			"object":  u.last["object"],
+			"created": u.last["created"],
+			"model":   u.last["model"],
+			"choices": []any{},
+			"usage": map[string]any{
+				"prompt_tokens":     u.promptTokens,
+				"completion_tokens": completion,
+				"total_tokens":      u.promptTokens + completion,
+			},
+		}
+		b, _ := json.Marshal(chunk)
+		return []string{"data: " + string(b), "", line}, true
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		return []string{line}, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+		return []string{line}, true
+	}
+	u.last = chunk
+	if chunk["usage"] != nil {
+		u.seen = true
+	}
+	for _, t := range chunkTexts(chunk) {
+		u.output.add(t.get())
+	}
+	return []string{line}, true
+}
+
+// promptText joins the text a request sends to the model.
+func promptText(payload map[string]any) string {
+	if p := getString(payload, "prompt"); p != "" {
+		return p
+	}
+	var b strings.Builder
+	messages, _ := payload["messages"].([]any)
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		switch content := msg["content"].(type) {
+		case string:
+			b.WriteString(content)
+		case []any:
+			for _, p := range content {
+				part, _ := p.(map[string]any)
+				b.WriteString(getString(part, "text"))
+			}
+		}
+	}
+	return b.String()
+}
+
+// estimateTokens approximates a token count at four characters per token.
+func estimateTokens(runes int) int {
+	return (runes + 3) / 4
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fingerprintHeaders identify the client, its SDK or the proxies in front of
+// the relay rather than the request. A trailing "*" matches a prefix.
+var fingerprintHeaders = []string{
+	"X-Forwarded-*", "X-Real-Ip", "Forwarded", "Via",
+	"X-Stainless-*", // OpenAI and Anthropic SDK runtime details
+	"Sec-Ch-*", "Sec-Fetch-*", "Origin", "Referer", "Cookie", "Accept-Language",
+}
+
+func validateClientHeaders(o *UpstreamOptions) error {
+	if o.UserAgent != "" && o.UserAgentSuffix != "" {
+		return errors.New("upstream_options.user_agent and user_agent_suffix are mutually exclusive")
+	}
+	for _, h := range o.StripHeaders {
+		name := strings.TrimSuffix(h, "*")
+		if name == "" || strings.ContainsAny(name, "*: ") {
+			return fmt.Errorf("invalid upstream_options.strip_headers entry %q", h)
+		}
+	}
+	return nil
+}
+
+// normalizeClientHeaders applies the User-Agent and header stripping
+// options to a request whose headers were copied from the client.
+func (c *upstreamClient) normalizeClientHeaders(req *http.Request) {
+	strip := c.opts.StripHeaders
+	if c.opts.StripClientFingerprint {
+		strip = append(append([]string{}, strip...), fingerprintHeaders...)
+	}
+	for k := range req.Header {
+		for _, pattern := range strip {
+			if headerMatches(k, pattern) {
+				req.Header.Del(k)
+				break
+			}
+		}
+	}
+
+	switch {
+	case c.opts.UserAgent != "":
+		req.Header.Set("User-Agent", expandUserAgent(c.opts.UserAgent))
+	case c.opts.UserAgentSuffix != "":
+		ua := strings.TrimSpace(req.Header.Get("User-Agent") + " " + expandUserAgent(c.opts.UserAgentSuffix))
+		req.Header.Set("User-Agent", ua)
+	}
+}
+
+// headerMatches compares a header name with an exact or "Prefix-*" pattern,
+// ignoring case.
+func headerMatches(name, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(name, pattern)
+}
+
+// expandUserAgent fills in {version}, the relay's build version.
+func expandUserAgent(ua string) string {
+	return strings.ReplaceAll(ua, "{version}", buildVersion())
+}
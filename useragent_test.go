@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientHeaderNormalization(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	send := func(o *UpstreamOptions) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		r.Header.Set("User-Agent", "OpenAI/Python 1.50.0")
+		r.Header.Set("X-Stainless-Os", "MacOS")
+		r.Header.Set("X-Forwarded-For", "203.0.113.7")
+		r.Header.Set("X-Team", "search")
+		r.Header.Set(conversationHeader, "c1")
+		w := httptest.NewRecorder()
+		proxyWithJSONPatch(w, r, parseURL(upstream.URL), false, &Config{UpstreamOptions: o}, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	}
+
+	send(&UpstreamOptions{UserAgent: "llm-api-relay/{version}", StripClientFingerprint: true})
+	if ua := got.Get("User-Agent"); ua != "llm-api-relay/"+buildVersion() {
+		t.Errorf("User-Agent = %q", ua)
+	}
+	if got.Get("X-Stainless-Os") != "" || got.Get("X-Forwarded-For") != "" {
+		t.Errorf("fingerprint headers forwarded: %v", got)
+	}
+	if got.Get("X-Team") != "search" || got.Get(conversationHeader) != "c1" {
+		t.Errorf("other headers dropped: %v", got)
+	}
+
+	send(&UpstreamOptions{UserAgentSuffix: "relay", StripHeaders: []string{"x-team"}})
+	if ua := got.Get("User-Agent"); ua != "OpenAI/Python 1.50.0 relay" {
+		t.Errorf("User-Agent = %q, want the suffix appended", ua)
+	}
+	if got.Get("X-Team") != "" || got.Get("X-Stainless-Os") != "MacOS" {
+		t.Errorf("strip_headers: %v", got)
+	}
+
+	send(&UpstreamOptions{StripHeaders: []string{"X-*"}})
+	if got.Get("X-Team") != "" || got.Get("X-Stainless-Os") != "" || got.Get("User-Agent") != "OpenAI/Python 1.50.0" {
+		t.Errorf("prefix pattern: %v", got)
+	}
+}
+
+func TestValidateClientHeaders(t *testing.T) {
+	for _, o := range []UpstreamOptions{
+		{UserAgent: "a", UserAgentSuffix: "b"},
+		{StripHeaders: []string{"*"}},
+		{StripHeaders: []string{"X-*-Id"}},
+	} {
+		if err := validateUpstreamOptions(&o); err == nil {
+			t.Errorf("validateUpstreamOptions(%+v) succeeded, want error", o)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var runesJoinedTotal = metrics.newCounterVec("relay_stream_split_runes_total",
+	"Multibyte characters the upstream split across streamed deltas, joined by the relay.", "tenant", "model")
+
+// highSurrogateEscape finds \uD800-\uDBFF escapes, which some upstreams
+// send without the low half when an emoji spans two tokens.
+var highSurrogateEscape = regexp.MustCompile(`\\u[dD][89abAB][0-9a-fA-F]{2}`)
+
+// runeJoiner keeps multibyte characters whole across streamed deltas. Some
+// backends emit each token's bytes as they are detokenized, so a CJK
+// character or an emoji can arrive as invalid UTF-8 (or as a lone UTF-16
+// surrogate escape) split over two chunks. Decoding such a chunk anywhere
+// in the relay would turn both halves into U+FFFD; the joiner holds the
+// incomplete tail of each choice's text back and prepends it to the next
+// delta, so no stage and no client ever sees part of a character.
+type runeJoiner struct {
+	tenant, label string            // label is the metrics model label, see metricModel
+	pending       map[string][]byte // "index/field" -> bytes of an unfinished character
+}
+
+// newRuneJoiner wraps src. It runs ahead of every stream_pipeline stage and
+// passes lines through untouched unless one carries a split character.
+func newRuneJoiner(src io.Reader, tenant, label string) io.ReadCloser {
+	j := &runeJoiner{tenant: tenant, label: label, pending: map[string][]byte{}}
+	return pipeSSE(src, j.handle)
+}
+
+func (j *runeJoiner) handle(line string) ([]string, bool) {
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok || data == "[DONE]" {
+		return []string{line}, true
+	}
+	if len(j.pending) == 0 && utf8.ValidString(data) && !highSurrogateEscape.MatchString(data) {
+		return []string{line}, true
+	}
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{line}, true
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil || len(choices) == 0 {
+		return []string{line}, true
+	}
+	for _, choice := range choices {
+		idx := string(choice["index"])
+		finished := len(choice["finish_reason"]) > 0 && string(choice["finish_reason"]) != "null"
+		if raw, ok := choice["text"]; ok {
+			choice["text"] = j.join(idx+"/text", raw, finished)
+			continue
+		}
+		var delta map[string]json.RawMessage
+		if json.Unmarshal(choice["delta"], &delta) != nil || delta == nil {
+			continue
+		}
+		for _, field := range []string{"content", "reasoning_content", "reasoning"} {
+			key := idx + "/" + field
+			raw, ok := delta[field]
+			if !ok && !(finished && j.pending[key] != nil) {
+				continue
+			}
+			delta[field] = j.join(key, raw, finished)
+		}
+		choice["delta"], _ = json.Marshal(delta)
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{line}, true
+	}
+	return []string{"data: " + string(out)}, true
+}
+
+// join prepends the held bytes of key to the JSON string raw and holds back
+// a new incomplete tail, unless the choice finished. What remains invalid
+// becomes U+FFFD.
+func (j *runeJoiner) join(key string, raw json.RawMessage, finished bool) json.RawMessage {
+	b, ok := jsonStringBytes(raw)
+	if !ok && j.pending[key] == nil {
+		return raw
+	}
+	held := j.pending[key]
+	if held != nil {
+		b = append(held, b...)
+		delete(j.pending, key)
+		runesJoinedTotal.Inc(j.tenant, j.label)
+	}
+	b = joinSurrogates(b)
+	if n := incompleteTail(b); n > 0 && !finished {
+		j.pending[key] = append([]byte(nil), b[len(b)-n:]...)
+		b = b[:len(b)-n]
+	}
+	out, _ := json.Marshal(strings.ToValidUTF8(string(b), "\uFFFD"))
+	return out
+}
+
+// incompleteTail returns how many bytes at the end of b start a character
+// that is not complete yet: the lead of a multibyte sequence, or a high
+// surrogate (kept in its 3-byte form) waiting for its low half.
+func incompleteTail(b []byte) int {
+	if n := len(b); n >= 3 && isSurrogateBytes(b[n-3:], 0xA0) {
+		return 3
+	}
+	for i := 1; i <= min(utf8.UTFMax-1, len(b)); i++ {
+		c := b[len(b)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if c >= 0xC0 && !utf8.FullRune(b[len(b)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
+
+// isSurrogateBytes reports whether b starts with the 3-byte form of a high
+// (base 0xA0) or low (base 0xB0) surrogate.
+func isSurrogateBytes(b []byte, base byte) bool {
+	return len(b) >= 3 && b[0] == 0xED && b[1]&0xF0 == base && b[2]&0xC0 == 0x80
+}
+
+// joinSurrogates replaces high/low surrogate pairs in their 3-byte forms
+// with the UTF-8 of the character they encode.
+func joinSurrogates(b []byte) []byte {
+	for i := 0; i+6 <= len(b); i++ {
+		if !isSurrogateBytes(b[i:], 0xA0) || !isSurrogateBytes(b[i+3:], 0xB0) {
+			continue
+		}
+		r := utf16.DecodeRune(decodeSurrogate(b[i:]), decodeSurrogate(b[i+3:]))
+		b = append(b[:i], append(utf8.AppendRune(nil, r), b[i+6:]...)...)
+	}
+	return b
+}
+
+func decodeSurrogate(b []byte) rune {
+	return rune(b[0]&0x0F)<<12 | rune(b[1]&0x3F)<<6 | rune(b[2]&0x3F)
+}
+
+// jsonStringBytes decodes a JSON string like json.Unmarshal, except that
+// invalid UTF-8 is kept byte for byte and an unpaired surrogate escape
+// becomes its 3-byte form instead of U+FFFD, so split characters can be
+// put back together.
+func jsonStringBytes(raw json.RawMessage) ([]byte, bool) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return nil, false
+	}
+	s := raw[1 : len(raw)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, false
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			out = append(out, s[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			if i+5 > len(s) {
+				return nil, false
+			}
+			v, err := strconv.ParseUint(string(s[i+1:i+5]), 16, 16)
+			if err != nil {
+				return nil, false
+			}
+			i += 4
+			r := rune(v)
+			if utf16.IsSurrogate(r) {
+				// 3-byte form, as utf8 would encode it if allowed
+				out = append(out, 0xE0|byte(r>>12), 0x80|byte(r>>6)&0x3F, 0x80|byte(r)&0x3F)
+				continue
+			}
+			out = utf8.AppendRune(out, r)
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
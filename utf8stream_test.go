@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// rawChunk builds a chunk whose content is inserted into the JSON verbatim,
+// so it can carry invalid UTF-8 and unpaired surrogate escapes.
+func rawChunk(content, finish string) string {
+	fr := "null"
+	if finish != "" {
+		fr = `"` + finish + `"`
+	}
+	return `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"` + content + `"},"finish_reason":` + fr + `}]}` + "\n\n"
+}
+
+func TestRuneJoinerSplitCharacters(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"utf-8 bytes", []string{rawChunk("你\xe5\xa5", ""), rawChunk("\xbd，世界", "")}, "你好，世界"},
+		{"emoji over three chunks", []string{rawChunk("ok \xf0\x9f", ""), rawChunk("\x98", ""), rawChunk("\x80!", "")}, "ok 😀!"},
+		{"surrogate escapes", []string{rawChunk(`a\ud83d`, ""), rawChunk(`\ude00b`, "")}, "a😀b"},
+		{"unfinished at the end", []string{rawChunk("中\xe6\x96", ""), rawChunk("", "stop")}, "中\uFFFD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := strings.Join(tt.chunks, "") + "data: [DONE]\n\n"
+			out := runPipeline(t, &ModelRule{}, nil, input)
+			if !utf8.ValidString(out) {
+				t.Fatalf("invalid UTF-8 in output:\n%q", out)
+			}
+			if got := streamFields(t, out, "content"); got != tt.want {
+				t.Errorf("content %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultibyteStreamStages(t *testing.T) {
+	// CJK and emoji pieces split at every possible point by the stages that
+	// hold text back or cut it
+	pieces := []string{"密码是", "123", "4，🙂请", "勿外传。", "👨‍👩‍👧 家庭", "😀😀😀", "结束。"}
+	input := chatStream(pieces...)
+	rules := []*ModelRule{
+		{RedactPatterns: []string{`密码是\d+`}, RedactWindow: 16},
+		{MaxOutputBytes: 31},
+		{EnforceStop: true},
+		{ThinkRouting: "reasoning"},
+	}
+	payload := map[string]any{"stop": []any{"勿外"}}
+	for _, rule := range rules {
+		out := runPipeline(t, rule, payload, input)
+		if !utf8.ValidString(out) {
+			t.Errorf("%+v: invalid UTF-8 in output:\n%q", rule, out)
+		}
+		if strings.Contains(out, "\uFFFD") || strings.Contains(out, `\ufffd`) {
+			t.Errorf("%+v: a character was broken:\n%s", rule, out)
+		}
+	}
+	if got := streamFields(t, runPipeline(t, rules[0], nil, input), "content"); !strings.HasPrefix(got, "[REDACTED]，🙂请勿外传。") {
+		t.Errorf("redacted content: %q", got)
+	}
+	if got := streamFields(t, runPipeline(t, rules[2], payload, input), "content"); got != "密码是1234，🙂请" {
+		t.Errorf("stopped content: %q", got)
+	}
+}
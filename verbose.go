@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Verbose scopes split the verbose log by subsystem, so one of them can be
+// debugged in production without the others flooding the log. The debug
+// level (-v, log.level or /admin/verbose {"enabled": true}) still turns on
+// all of them.
+var verboseScopeNames = []string{"rules", "proxy", "toolcallfix", "auth", "stream"}
+
+// verboseScopes holds one bit per entry of verboseScopeNames.
+var verboseScopes atomic.Uint32
+
+// logScopes maps the prefix of a vlog message to its scope. Prefixes not
+// listed belong to "proxy".
+var logScopes = map[string]string{
+	"RULE": "rules", "TEMPLATE": "rules", "TOOLS": "rules", "VALIDATE": "rules",
+	"BRIDGE": "rules", "JSONMODE": "rules", "TENANT": "rules",
+
+	"TOOLCALLFIX": "toolcallfix",
+
+	"AUTH": "auth", "TOKENS": "auth",
+
+	"CAPTURE": "stream", "STOP": "stream", "REDACT": "stream", "GUARD": "stream",
+	"CONTINUE": "stream", "STREAM": "stream",
+}
+
+func verboseScopeBit(name string) (uint32, bool) {
+	for i, s := range verboseScopeNames {
+		if s == name {
+			return 1 << i, true
+		}
+	}
+	return 0, false
+}
+
+func validateVerboseScopes(scopes []string) error {
+	for _, s := range scopes {
+		if _, ok := verboseScopeBit(s); !ok {
+			return fmt.Errorf("unknown verbose scope %q (want one of %s)", s, strings.Join(verboseScopeNames, ", "))
+		}
+	}
+	return nil
+}
+
+// setVerboseScopes replaces the enabled scopes; names are validated by the
+// caller.
+func setVerboseScopes(scopes []string) {
+	var mask uint32
+	for _, s := range scopes {
+		bit, _ := verboseScopeBit(s)
+		mask |= bit
+	}
+	verboseScopes.Store(mask)
+}
+
+// enabledVerboseScopes lists the scopes switched on individually.
+func enabledVerboseScopes() []string {
+	mask := verboseScopes.Load()
+	scopes := []string{}
+	for i, s := range verboseScopeNames {
+		if mask&(1<<i) != 0 {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// verboseEnabled reports whether messages of scope are logged.
+func verboseEnabled(scope string) bool {
+	if debugLogging() {
+		return true
+	}
+	bit, _ := verboseScopeBit(scope)
+	return verboseScopes.Load()&bit != 0
+}
+
+// logScope returns the scope of a vlog format by its "PREFIX:".
+func logScope(format string) string {
+	prefix, _, ok := strings.Cut(format, ":")
+	if !ok {
+		return "proxy"
+	}
+	if scope, ok := logScopes[prefix]; ok {
+		return scope
+	}
+	return "proxy"
+}
+
+// scopedLogf logs at the debug level while scope is enabled, for packages
+// that take a logging function.
+func scopedLogf(scope string) func(format string, args ...any) {
+	return func(format string, args ...any) {
+		debugf(context.Background(), scope, format, args...)
+	}
+}
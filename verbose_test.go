@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerboseScopes(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer setVerboseScopes(nil)
+
+	setVerboseScopes([]string{"auth", "toolcallfix"})
+	vlog("AUTH: client key rejected")
+	vlog("TOOLCALLFIX: parsed a call")
+	vlog("RULE: applying rule")
+	vlog("UPSTREAM: retrying")
+	scopedLogf("toolcallfix")("data: {}")
+	scopedLogf("stream")("dropped")
+	out := buf.String()
+	for _, want := range []string{"AUTH: client key rejected", "TOOLCALLFIX: parsed a call", "data: {}"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"RULE:", "UPSTREAM:", "dropped"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("logged %q outside the enabled scopes:\n%s", unwanted, out)
+		}
+	}
+
+	if logScope("REDACT: masked") != "stream" || logScope("FANOUT: x") != "proxy" || logScope("no prefix") != "proxy" {
+		t.Error("logScope maps prefixes wrongly")
+	}
+	path := filepath.Join(t.TempDir(), "config.jsonc")
+	_ = os.WriteFile(path, []byte(`{"upstream":"http://llm","verbose_scopes":["everything"]}`), 0o644)
+	if _, err := loadConfigJSONC(path); err == nil {
+		t.Error("unknown scope accepted in the config")
+	}
+}
+
+func TestAdminVerboseScopes(t *testing.T) {
+	defer setVerboseScopes(nil)
+	mux, err := newRelayMux(&Config{Upstream: "http://127.0.0.1:1", Admin: &AdminConfig{Token: "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, body string) (int, []string) {
+		r := httptest.NewRequest(method, "/admin/verbose", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var got struct {
+			Scopes []string `json:"scopes"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &got)
+		return w.Code, got.Scopes
+	}
+	if code, scopes := send("PUT", `{"scopes":["stream","rules"]}`); code != http.StatusOK || strings.Join(scopes, ",") != "rules,stream" {
+		t.Errorf("PUT scopes: %d %v", code, scopes)
+	}
+	if !verboseEnabled("stream") || verboseEnabled("auth") {
+		t.Error("scopes not applied")
+	}
+	if code, _ := send("PUT", `{"scopes":["nope"]}`); code != http.StatusBadRequest {
+		t.Errorf("unknown scope: status %d", code)
+	}
+	if code, scopes := send("PUT", `{"scopes":[]}`); code != http.StatusOK || len(scopes) != 0 || verboseEnabled("stream") {
+		t.Errorf("clearing scopes: %d %v", code, scopes)
+	}
+}